@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// androidCachePathsEnvKey is the output listing the Android project's cache paths, for the cache push step.
+const androidCachePathsEnvKey = "BITRISE_CACHE_ANDROID_PATHS"
+
+var (
+	gradleDistributionPattern = regexp.MustCompile(`gradle-([0-9][^/]*?)-(bin|all)\.zip$`)
+	// agpVersionPatterns find the Android Gradle Plugin's version in the build scripts and the version catalog
+	agpVersionPatterns = []*regexp.Regexp{
+		regexp.MustCompile(`com\.android\.tools\.build:gradle:([0-9][0-9A-Za-z.\-]*)`),
+		regexp.MustCompile(`id[ (]*["']com\.android\.(?:application|library)["'][ )]*version[ (]*["']([0-9][0-9A-Za-z.\-]*)["']`),
+		regexp.MustCompile(`(?m)^\s*(?:agp|androidGradlePlugin|android-gradle-plugin)\s*=\s*["']([0-9][0-9A-Za-z.\-]*)["']`),
+	}
+	gradleVersionDirPattern = regexp.MustCompile(`^[0-9]+\.[0-9]+(\.[0-9]+)?(-[0-9A-Za-z.\-]+)?$`)
+	transformsDirPattern    = regexp.MustCompile(`^transforms-[0-9]+$`)
+)
+
+// androidProject is a Gradle based Android project, with its Gradle and Android Gradle Plugin versions.
+type androidProject struct {
+	Dir           string
+	GradleVersion string
+	// AGPVersion is the Android Gradle Plugin's version, empty if it is not found (e.g. set in an included build).
+	AGPVersion string
+}
+
+// androidCacheDirs are the user's Gradle and Android directories.
+type androidCacheDirs struct {
+	GradleHome  string
+	AndroidHome string
+}
+
+// userAndroidCacheDirs returns the user's Gradle (GRADLE_USER_HOME) and Android directories.
+func userAndroidCacheDirs() (androidCacheDirs, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return androidCacheDirs{}, err
+	}
+	return androidCacheDirs{GradleHome: gradleUserHome(home), AndroidHome: filepath.Join(home, ".android")}, nil
+}
+
+// parseVersion returns the numeric components of the version (e.g. 8.2.1-rc-1 is 8, 2, 1).
+func parseVersion(s string) []int {
+	var parts []int
+	for _, field := range strings.Split(strings.SplitN(s, "-", 2)[0], ".") {
+		n, err := strconv.Atoi(field)
+		if err != nil {
+			break
+		}
+		parts = append(parts, n)
+	}
+	return parts
+}
+
+// versionLess reports whether the version a is older than b, by their numeric components.
+func versionLess(a, b []int) bool {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] != b[i] {
+			return a[i] < b[i]
+		}
+	}
+	return len(a) < len(b)
+}
+
+// readGradleWrapperVersion returns the Gradle version of the project's wrapper properties, empty if it has no wrapper.
+func readGradleWrapperVersion(dir string) (string, error) {
+	f, err := os.Open(filepath.Join(dir, "gradle", "wrapper", "gradle-wrapper.properties"))
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if err := f.Close(); err != nil {
+			log.Warnf("Failed to close %s: %s", f.Name(), err)
+		}
+	}()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if !strings.HasPrefix(line, "distributionUrl") {
+			continue
+		}
+		if match := gradleDistributionPattern.FindStringSubmatch(line); match != nil {
+			return match[1], nil
+		}
+	}
+	return "", scanner.Err()
+}
+
+// findAGPVersion returns the Android Gradle Plugin version of the project's build scripts and version catalog
+// (empty if only the modules apply the plugin), false if the project does not use the plugin.
+func findAGPVersion(dir string) (string, bool) {
+	candidates := []string{
+		"build.gradle", "build.gradle.kts", "settings.gradle", "settings.gradle.kts",
+		filepath.Join("gradle", "libs.versions.toml"),
+	}
+	for _, name := range candidates {
+		content, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			continue
+		}
+		for _, pattern := range agpVersionPatterns {
+			if match := pattern.FindSubmatch(content); match != nil {
+				return string(match[1]), true
+			}
+		}
+	}
+
+	// the modules may apply the plugin without its version
+	modules, err := filepath.Glob(filepath.Join(dir, "*", "build.gradle*"))
+	if err != nil {
+		return "", false
+	}
+	for _, pth := range modules {
+		content, err := ioutil.ReadFile(pth)
+		if err == nil && strings.Contains(string(content), "com.android.") {
+			return "", true
+		}
+	}
+	return "", false
+}
+
+// detectAndroidProject returns the Android project of dir, nil if it is not a Gradle (wrapper) based Android project.
+func detectAndroidProject(dir string) (*androidProject, error) {
+	gradleVersion, err := readGradleWrapperVersion(dir)
+	if err != nil || gradleVersion == "" {
+		return nil, err
+	}
+	agpVersion, android := findAGPVersion(dir)
+	if !android {
+		return nil, nil
+	}
+	return &androidProject{Dir: dir, GradleVersion: gradleVersion, AGPVersion: agpVersion}, nil
+}
+
+// transformsDir returns the Gradle version's artifact transform cache, relative to the Gradle caches,
+// Gradle 8.8 and newer keep it in the version's directory.
+func (p androidProject) transformsDir() string {
+	v := parseVersion(p.GradleVersion)
+	switch {
+	case versionLess(v, []int{7}):
+		return "transforms-2"
+	case versionLess(v, []int{8, 5}):
+		return "transforms-3"
+	case versionLess(v, []int{8, 8}):
+		return "transforms-4"
+	}
+	return filepath.Join(p.GradleVersion, "transforms")
+}
+
+// usesBuildCache reports whether the project's Android Gradle Plugin uses the Android build cache (~/.android/build-cache),
+// removed in AGP 7.0. It is assumed to be used if the plugin's version is unknown.
+func (p androidProject) usesBuildCache() bool {
+	return p.AGPVersion == "" || versionLess(parseVersion(p.AGPVersion), []int{7})
+}
+
+// CachePaths returns the Gradle and Android cache paths used by the project's versions.
+func (p androidProject) CachePaths(dirs androidCacheDirs) []string {
+	caches := filepath.Join(dirs.GradleHome, "caches")
+	paths := []string{
+		filepath.Join(caches, "modules-2"),
+		filepath.Join(caches, "jars-9"),
+		filepath.Join(caches, "build-cache-1"),
+		filepath.Join(caches, p.transformsDir()),
+		filepath.Join(caches, p.GradleVersion),
+		filepath.Join(dirs.GradleHome, "wrapper", "dists", "gradle-"+p.GradleVersion+"-bin"),
+		filepath.Join(dirs.GradleHome, "wrapper", "dists", "gradle-"+p.GradleVersion+"-all"),
+	}
+	if p.usesBuildCache() {
+		paths = append(paths, filepath.Join(dirs.AndroidHome, "build-cache"))
+	}
+	return paths
+}
+
+// staleCachePath reports whether the path belongs to the caches of another Gradle or Android Gradle Plugin version:
+// the other wrapper distributions, version caches and transform caches, and the Android build cache of AGP 7.0 and newer.
+func (p androidProject) staleCachePath(pth string, dirs androidCacheDirs) bool {
+	if !p.usesBuildCache() && isUnderPath(pth, []string{filepath.Join(dirs.AndroidHome, "build-cache")}) {
+		return true
+	}
+
+	if name, ok := childName(pth, filepath.Join(dirs.GradleHome, "wrapper", "dists")); ok {
+		return name != "gradle-"+p.GradleVersion+"-bin" && name != "gradle-"+p.GradleVersion+"-all"
+	}
+	if name, ok := childName(pth, filepath.Join(dirs.GradleHome, "caches")); ok {
+		switch {
+		case gradleVersionDirPattern.MatchString(name):
+			return name != p.GradleVersion
+		case transformsDirPattern.MatchString(name):
+			return name != p.transformsDir()
+		}
+	}
+	return false
+}
+
+// childName returns the name of dir's child the path is (under), false if the path is not under dir.
+func childName(pth, dir string) (string, bool) {
+	rel, err := filepath.Rel(dir, pth)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return strings.SplitN(rel, string(filepath.Separator), 2)[0], true
+}
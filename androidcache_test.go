@@ -0,0 +1,81 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDetectAndroidProject(t *testing.T) {
+	dir, err := ioutil.TempDir("", "androidcache-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Logf("failed to remove temp dir: %s", err)
+		}
+	}()
+
+	if project, err := detectAndroidProject(dir); err != nil || project != nil {
+		t.Errorf("detectAndroidProject(empty) = %v, %v, want nil", project, err)
+	}
+
+	writeTestFiles(t, map[string]string{
+		filepath.Join(dir, "gradle", "wrapper", "gradle-wrapper.properties"): "distributionBase=GRADLE_USER_HOME\ndistributionUrl=https\\://services.gradle.org/distributions/gradle-8.2.1-bin.zip\n",
+		filepath.Join(dir, "gradle", "libs.versions.toml"):                   "[versions]\nagp = \"8.1.0\"\nkotlin = \"1.9.0\"\n",
+		filepath.Join(dir, "app", "build.gradle.kts"):                        "plugins {\n    id(\"com.android.application\")\n}\n",
+	})
+
+	project, err := detectAndroidProject(dir)
+	if err != nil {
+		t.Fatalf("detectAndroidProject() error = %s", err)
+	}
+	want := androidProject{Dir: dir, GradleVersion: "8.2.1", AGPVersion: "8.1.0"}
+	if project == nil || *project != want {
+		t.Errorf("detectAndroidProject() = %v, want %v", project, want)
+	}
+}
+
+func TestAndroidProjectStaleCachePath(t *testing.T) {
+	dirs := androidCacheDirs{GradleHome: "/home/.gradle", AndroidHome: "/home/.android"}
+	project := androidProject{GradleVersion: "8.2.1", AGPVersion: "8.1.0"}
+	tests := []struct {
+		pth  string
+		want bool
+	}{
+		{pth: "/home/.gradle/wrapper/dists/gradle-8.2.1-bin/abc/gradle-8.2.1/lib", want: false},
+		{pth: "/home/.gradle/wrapper/dists/gradle-7.6-all", want: true},
+		{pth: "/home/.gradle/wrapper/dists", want: false},
+		{pth: "/home/.gradle/caches/8.2.1/kotlin-dsl", want: false},
+		{pth: "/home/.gradle/caches/7.6/kotlin-dsl", want: true},
+		{pth: "/home/.gradle/caches/transforms-3/abc", want: false},
+		{pth: "/home/.gradle/caches/transforms-2/abc", want: true},
+		{pth: "/home/.gradle/caches/modules-2/files-2.1", want: false},
+		{pth: "/home/.android/build-cache/abc", want: true},
+		{pth: "/home/.android/avd", want: false},
+	}
+	for _, tt := range tests {
+		if got := project.staleCachePath(filepath.FromSlash(tt.pth), dirs); got != tt.want {
+			t.Errorf("staleCachePath(%s) = %v, want %v", tt.pth, got, tt.want)
+		}
+	}
+}
+
+func TestAndroidProjectTransformsDir(t *testing.T) {
+	tests := []struct {
+		gradleVersion string
+		want          string
+	}{
+		{gradleVersion: "6.9.4", want: "transforms-2"},
+		{gradleVersion: "7.6", want: "transforms-3"},
+		{gradleVersion: "8.6", want: "transforms-4"},
+		{gradleVersion: "8.10.2", want: filepath.Join("8.10.2", "transforms")},
+	}
+	for _, tt := range tests {
+		if got := (androidProject{GradleVersion: tt.gradleVersion}).transformsDir(); got != tt.want {
+			t.Errorf("transformsDir(%s) = %s, want %s", tt.gradleVersion, got, tt.want)
+		}
+	}
+}
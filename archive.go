@@ -5,6 +5,9 @@ import (
 	"compress/gzip"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"os"
+	"time"
 
 	"github.com/bitrise-io/go-utils/command"
 	"github.com/bitrise-io/go-utils/errorutil"
@@ -13,7 +16,7 @@ import (
 
 // uncompressArchive invokes tar tool against a local archive file.
 func uncompressArchive(pth string, relative, compressed bool) error {
-	cmd := command.New("tar", processArgs(relative, compressed), pth)
+	cmd := command.New("tar", tarArgs(pth, relative, compressed)...)
 
 	log.Donef(cmd.PrintableCommandArgs())
 
@@ -28,28 +31,143 @@ func uncompressArchive(pth string, relative, compressed bool) error {
 	return nil
 }
 
-// extractCacheArchive invokes tar tool by piping the archive to the command's input.
-func extractCacheArchive(r io.Reader, relative, compressed bool) error {
-	cmd := command.New("tar", processArgs(relative, compressed), "-")
-	cmd.SetStdin(r)
-
-	printableCmd := fmt.Sprintf("curl <CACHE_URL> | %s", cmd.PrintableCommandArgs())
-	log.Donef(printableCmd)
+// extractArchive extracts the archive stream in-process using the given Extractor.
+// With the Extractor's PipelineBuffer the download, the decompression and the tar parsing run concurrently.
+func extractArchive(r io.Reader, extractor *Extractor, compressed bool) error {
+	var stages []*stageReader
+	stage := func(src io.Reader) io.Reader {
+		if extractor.PipelineBuffer <= 0 {
+			return src
+		}
+		s := newStageReader(src, extractor.PipelineBuffer)
+		stages = append(stages, s)
+		return s
+	}
+	// the stages are stopped before their sources are closed
+	stop := func() {
+		for i := len(stages) - 1; i >= 0; i-- {
+			if err := stages[i].Close(); err != nil {
+				log.Warnf("Failed to stop the extraction pipeline: %s", err)
+			}
+		}
+	}
+	defer stop()
 
-	if out, err := cmd.RunAndReturnTrimmedCombinedOutput(); err != nil {
-		errMsg := err.Error()
-		if errorutil.IsExitStatusError(err) {
-			errMsg = out
+	archive := stage(r)
+	if compressed {
+		var timer decompressionTimer
+		start := time.Now()
+		gr, err := gzip.NewReader(timer.Source(archive))
+		timer.Opened(time.Since(start))
+		if err != nil {
+			return fmt.Errorf("failed to open gzip stream: %s", err)
 		}
-		return fmt.Errorf("%s failed: %s", printableCmd, errMsg)
+		defer func() {
+			stop()
+			if err := gr.Close(); err != nil {
+				log.Warnf("Failed to close gzip reader: %s", err)
+			}
+			extractor.DecompressionTime += timer.Elapsed()
+		}()
+		archive = stage(timer.Decompressed(gr))
+	}
+
+	log.Donef("Extracting archive in-process")
+
+	if err := extractor.extractReplicated(archive); err != nil {
+		return err
 	}
 
+	stop()
 	if rc, ok := r.(io.ReadCloser); ok {
 		return rc.Close()
 	}
 	return nil
 }
 
+// extractZstdArchiveFile decompresses a local zstd compressed archive file with the zstd tool and extracts it in-process.
+func extractZstdArchiveFile(pth string, extractor *Extractor) error {
+	f, err := os.Open(pth)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := f.Close(); err != nil {
+			log.Warnf("Failed to close %s: %s", pth, err)
+		}
+	}()
+
+	zr, err := NewZstdReader(f)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := zr.Close(); err != nil {
+			log.Warnf("Failed to stop zstd: %s", err)
+		}
+		extractor.DecompressionTime += zr.CPUTime()
+	}()
+
+	return extractArchive(zr, extractor, false)
+}
+
+// verifyArchiveFile reads the local archive file to its end, to check that it is not truncated or corrupted.
+func verifyArchiveFile(pth string, compressed, zstdCompressed bool) (err error) {
+	f, err := os.Open(pth)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cErr := f.Close(); cErr != nil {
+			log.Warnf("Failed to close %s: %s", pth, cErr)
+		}
+	}()
+
+	var r io.Reader = f
+	if zstdCompressed {
+		zr, err := NewZstdReader(f)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if cErr := zr.Close(); cErr != nil && err == nil {
+				err = cErr
+			}
+		}()
+		r = zr
+	} else if compressed {
+		gr, err := gzip.NewReader(f)
+		if err != nil {
+			return fmt.Errorf("invalid gzip stream: %s", err)
+		}
+		defer func() {
+			if cErr := gr.Close(); cErr != nil && err == nil {
+				err = cErr
+			}
+		}()
+		r = gr
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		_, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("invalid archive: %s", err)
+		}
+		if _, err := io.Copy(ioutil.Discard, tr); err != nil {
+			return fmt.Errorf("invalid archive: %s", err)
+		}
+	}
+	// read the rest (padding, gzip trailer) to verify the checksum of the compressed stream
+	if _, err := io.Copy(ioutil.Discard, r); err != nil {
+		return fmt.Errorf("invalid archive: %s", err)
+	}
+	return nil
+}
+
 func processArgs(relative, compressed bool) string {
 	/*
 		GNU  tar options
@@ -105,15 +223,38 @@ func readFirstEntry(r io.Reader) (*tar.Reader, *tar.Header, bool, error) {
 		compressed = false
 	}
 
+	tr, hdr, err := readFirstTarEntry(archive)
+	return tr, hdr, compressed, err
+}
+
+// readFirstEntryAs reads the first entry of the archive with the known compression, without sniffing it.
+func readFirstEntryAs(r io.Reader, compressed bool) (*tar.Reader, *tar.Header, error) {
+	archive := r
+	if compressed {
+		gr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, nil, err
+		}
+		archive = gr
+	}
+	return readFirstTarEntry(archive)
+}
+
+// readFirstTarEntry reads the first entry of the tar stream, nil if there are no entries.
+func readFirstTarEntry(archive io.Reader) (*tar.Reader, *tar.Header, error) {
 	tr := tar.NewReader(archive)
 	hdr, err := tr.Next()
+	for err == nil && hdr.Typeflag == tar.TypeXGlobalHeader {
+		// the first entry is the one after the global PAX records
+		hdr, err = tr.Next()
+	}
 	if err == io.EOF {
 		// no entries in the archive
-		return nil, nil, compressed, nil
+		return nil, nil, nil
 	}
 	if err != nil {
-		return nil, nil, compressed, err
+		return nil, nil, err
 	}
 
-	return tr, hdr, compressed, nil
+	return tr, hdr, nil
 }
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_verifyArchiveFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Logf("failed to remove temp dir: %s", err)
+		}
+	}()
+
+	archive := createTestArchive(t, []testEntry{{name: "file", content: "content"}}).Bytes()
+
+	var buff bytes.Buffer
+	gw := gzip.NewWriter(&buff)
+	if _, err := gw.Write(archive); err != nil {
+		t.Fatalf("failed to compress archive: %s", err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatalf("failed to close gzip writer: %s", err)
+	}
+	compressed := buff.Bytes()
+
+	tests := []struct {
+		name       string
+		content    []byte
+		compressed bool
+		wantErr    bool
+	}{
+		{name: "tar", content: archive},
+		{name: "tar.gz", content: compressed, compressed: true},
+		{name: "truncated tar", content: archive[:515], wantErr: true},
+		{name: "truncated tar.gz", content: compressed[:len(compressed)-4], compressed: true, wantErr: true},
+		{name: "not gzip", content: archive, compressed: true, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pth := filepath.Join(dir, "archive")
+			if err := ioutil.WriteFile(pth, tt.content, 0644); err != nil {
+				t.Fatalf("failed to write archive: %s", err)
+			}
+			if err := verifyArchiveFile(pth, tt.compressed, false); (err != nil) != tt.wantErr {
+				t.Errorf("verifyArchiveFile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
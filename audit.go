@@ -0,0 +1,57 @@
+package main
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+const overwriteAuditPathEnvKey = "BITRISE_CACHE_PULL_OVERWRITE_AUDIT_PATH"
+
+// overwrittenFile is a pre-existing file overwritten by the extraction, see the overwrite_audit_path input.
+type overwrittenFile struct {
+	Path       string    `json:"path"`
+	OldSize    int64     `json:"old_size"`
+	OldModTime time.Time `json:"old_mod_time"`
+	NewSize    int64     `json:"new_size"`
+	NewModTime time.Time `json:"new_mod_time"`
+}
+
+// overwriteAudit is the content of the overwrite audit file.
+type overwriteAudit struct {
+	CacheKey    string            `json:"cache_key,omitempty"`
+	CacheURL    string            `json:"cache_url,omitempty"`
+	Overwritten []overwrittenFile `json:"overwritten"`
+}
+
+// auditOverwrite records the target in the Overwritten files, if it exists and is not a directory.
+func (e *Extractor) auditOverwrite(target string, hdr *tar.Header) {
+	info, err := os.Lstat(target)
+	if err != nil || info.IsDir() {
+		return
+	}
+	e.Overwritten = append(e.Overwritten, overwrittenFile{
+		Path:       target,
+		OldSize:    info.Size(),
+		OldModTime: info.ModTime(),
+		NewSize:    hdr.Size,
+		NewModTime: hdr.ModTime,
+	})
+}
+
+// writeOverwriteAudit writes the overwrite audit file and exports its path for the next steps.
+func writeOverwriteAudit(pth string, audit overwriteAudit) error {
+	if audit.Overwritten == nil {
+		audit.Overwritten = []overwrittenFile{}
+	}
+	b, err := json.MarshalIndent(audit, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(pth, b, 0644); err != nil {
+		return err
+	}
+	return exportEnv(overwriteAuditPathEnvKey, pth)
+}
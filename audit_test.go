@@ -0,0 +1,48 @@
+package main
+
+import (
+	"archive/tar"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestExtractor_Extract_auditOverwrites(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Logf("failed to remove temp dir: %s", err)
+		}
+	}()
+
+	if err := os.MkdirAll(filepath.Join(dir, "Pods"), 0755); err != nil {
+		t.Fatalf("failed to create dir: %s", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "Pods", "Manifest.lock"), []byte("local change"), 0644); err != nil {
+		t.Fatalf("failed to write file: %s", err)
+	}
+
+	archive := createTestArchive(t, []testEntry{
+		{name: "Pods", typeflag: tar.TypeDir, mode: 0755},
+		{name: "Pods/Manifest.lock", content: "cached"},
+		{name: "Pods/new.txt", content: "new"},
+	})
+
+	extractor := NewExtractor(dir, true)
+	extractor.AuditOverwrites = true
+	if err := extractor.Extract(archive); err != nil {
+		t.Fatalf("Extract() error = %v", err)
+	}
+
+	if len(extractor.Overwritten) != 1 {
+		t.Fatalf("Overwritten = %v, want the Manifest.lock", extractor.Overwritten)
+	}
+	got := extractor.Overwritten[0]
+	if got.Path != filepath.Join(dir, "Pods", "Manifest.lock") || got.OldSize != int64(len("local change")) || got.NewSize != int64(len("cached")) {
+		t.Errorf("Overwritten[0] = %+v", got)
+	}
+}
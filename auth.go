@@ -0,0 +1,486 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// Download auth schemes, see the download_auth input.
+const (
+	downloadAuthNone   = "none"
+	downloadAuthOAuth2 = "oauth2"
+	downloadAuthSigV4  = "aws_sigv4"
+	downloadAuthGoogle = "google"
+	downloadAuthAzure  = "azure_ad"
+)
+
+const (
+	// oauth2ExpiryLeeway is the time before the access token's expiry, when it is already renewed.
+	oauth2ExpiryLeeway = 30 * time.Second
+	oauth2TokenTimeout = 20 * time.Second
+
+	sigV4Algorithm  = "AWS4-HMAC-SHA256"
+	sigV4TimeFormat = "20060102T150405Z"
+	sigV4Service    = "s3"
+	// emptyPayloadSHA256 is the SHA256 of the download requests' empty body.
+	emptyPayloadSHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+// bearerToken is an OAuth2 access token, Expires is zero if unknown.
+type bearerToken struct {
+	AccessToken string
+	Expires     time.Time
+}
+
+// tokenSource gets the access tokens of one kind of credentials, like a service account key or a metadata server.
+type tokenSource interface {
+	Name() string
+	Token() (bearerToken, error)
+}
+
+// CredentialProvider authorizes the download requests of backends not serving anonymous (presigned) URLs.
+type CredentialProvider interface {
+	Authorize(req *http.Request) error
+}
+
+// newCredentialProvider returns the configured download auth scheme's provider, nil for anonymous downloads.
+func newCredentialProvider(conf Config) CredentialProvider {
+	switch conf.DownloadAuth {
+	case downloadAuthOAuth2:
+		return &OAuth2Provider{
+			TokenURL:     conf.OAuth2TokenURL,
+			ClientID:     conf.OAuth2ClientID,
+			ClientSecret: string(conf.OAuth2ClientSecret),
+			Scopes:       strings.Fields(conf.OAuth2Scopes),
+		}
+	case downloadAuthSigV4:
+		p := &SigV4Provider{
+			AccessKeyID:     conf.AWSAccessKeyID,
+			SecretAccessKey: string(conf.AWSSecretAccessKey),
+			SessionToken:    string(conf.AWSSessionToken),
+			Region:          conf.AWSRegion,
+			Service:         sigV4Service,
+		}
+		if p.AccessKeyID == "" {
+			p.Chain = newAWSCredentialChain(conf.AWSRegion)
+		}
+		return p
+	case downloadAuthGoogle:
+		return &GoogleProvider{CredentialsFile: conf.GoogleApplicationCredentials, Scopes: []string{googleStorageScope}}
+	case downloadAuthAzure:
+		return &AzureProvider{Source: newAzureTokenSource(azureCredentialsOptions{
+			TenantID:     conf.AzureTenantID,
+			ClientID:     conf.AzureClientID,
+			ClientSecret: string(conf.AzureClientSecret),
+		}, os.Getenv)}
+	default:
+		return nil
+	}
+}
+
+// OAuth2Provider authorizes the requests with an OAuth2 access token, got by the client credentials grant.
+type OAuth2Provider struct {
+	TokenURL     string
+	ClientID     string
+	ClientSecret string
+	Scopes       []string
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+type oauth2TokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int    `json:"expires_in"`
+}
+
+func (r oauth2TokenResponse) token() bearerToken {
+	token := bearerToken{AccessToken: r.AccessToken}
+	if r.ExpiresIn > 0 {
+		token.Expires = time.Now().Add(time.Duration(r.ExpiresIn) * time.Second)
+	}
+	return token
+}
+
+// Authorize implements the CredentialProvider interface.
+func (p *OAuth2Provider) Authorize(req *http.Request) error {
+	token, err := p.accessToken()
+	if err != nil {
+		return fmt.Errorf("failed to get OAuth2 access token: %s", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return nil
+}
+
+func (p *OAuth2Provider) accessToken() (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.token != "" && (p.expires.IsZero() || time.Now().Add(oauth2ExpiryLeeway).Before(p.expires)) {
+		return p.token, nil
+	}
+
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if len(p.Scopes) > 0 {
+		form.Set("scope", strings.Join(p.Scopes, " "))
+	}
+	req, err := http.NewRequest("POST", p.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+
+	client := &http.Client{Timeout: oauth2TokenTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			log.Warnf("Failed to close response body: %s", err)
+		}
+	}()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("non success response code: %d, body: %s", resp.StatusCode, body)
+	}
+
+	var tokenResp oauth2TokenResponse
+	if err := json.Unmarshal(body, &tokenResp); err != nil {
+		return "", fmt.Errorf("failed to parse token response: %s", err)
+	}
+	if tokenResp.AccessToken == "" {
+		return "", fmt.Errorf("access token not included in the response")
+	}
+
+	addSecret(tokenResp.AccessToken)
+	p.token = tokenResp.AccessToken
+	p.expires = time.Time{}
+	if tokenResp.ExpiresIn > 0 {
+		p.expires = time.Now().Add(time.Duration(tokenResp.ExpiresIn) * time.Second)
+	}
+	log.Debugf("OAuth2 access token received, expires in %ds", tokenResp.ExpiresIn)
+	return p.token, nil
+}
+
+// GoogleProvider authorizes the requests with an access token of the Google Application Default Credentials.
+type GoogleProvider struct {
+	// CredentialsFile is the credentials JSON file, empty looks up gcloud's credentials or the metadata server.
+	CredentialsFile string
+	Scopes          []string
+
+	mu     sync.Mutex
+	source tokenSource
+	token  bearerToken
+}
+
+// Authorize implements the CredentialProvider interface.
+// Signed URLs (carrying X-Goog-Signature) are not authorized again.
+func (p *GoogleProvider) Authorize(req *http.Request) error {
+	if req.URL.Query().Get("X-Goog-Signature") != "" {
+		return nil
+	}
+	token, err := p.accessToken()
+	if err != nil {
+		return fmt.Errorf("failed to get Google access token: %s", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return nil
+}
+
+func (p *GoogleProvider) accessToken() (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.token.AccessToken != "" && (p.token.Expires.IsZero() || time.Now().Add(oauth2ExpiryLeeway).Before(p.token.Expires)) {
+		return p.token.AccessToken, nil
+	}
+
+	if p.source == nil {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			log.Debugf("Failed to get the home directory: %s", err)
+		}
+		source, err := newGoogleTokenSource(p.CredentialsFile, os.Getenv, home, p.Scopes)
+		if err != nil {
+			return "", err
+		}
+		p.source = source
+	}
+
+	token, err := p.source.Token()
+	if err != nil {
+		return "", err
+	}
+	if token.AccessToken == "" {
+		return "", fmt.Errorf("access token not included in the response")
+	}
+
+	addSecret(token.AccessToken)
+	p.token = token
+	log.Debugf("Google access token received from %s, expires at %s", p.source.Name(), token.Expires)
+	return token.AccessToken, nil
+}
+
+// postTokenForm posts the form to the OAuth2 token endpoint.
+func postTokenForm(tokenURL string, form url.Values) (bearerToken, error) {
+	req, err := http.NewRequest("POST", tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return bearerToken{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	var resp oauth2TokenResponse
+	if err := doTokenRequest(req, oauth2TokenTimeout, &resp); err != nil {
+		return bearerToken{}, err
+	}
+	return resp.token(), nil
+}
+
+// doTokenRequest sends the token request and parses the JSON response.
+// The requests bypass the step's auth transport, which authorizes its requests with the token being retrieved.
+func doTokenRequest(req *http.Request, timeout time.Duration, v interface{}) error {
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	body, err := readMetadataResponse(resp)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal([]byte(body), v); err != nil {
+		return fmt.Errorf("failed to parse the token response: %s", err)
+	}
+	return nil
+}
+
+// AzureProvider authorizes the Azure Blob Storage requests with an Azure AD access token.
+type AzureProvider struct {
+	Source tokenSource
+
+	mu    sync.Mutex
+	token bearerToken
+}
+
+// Authorize implements the CredentialProvider interface.
+// SAS URLs (carrying sig) are not authorized again.
+func (p *AzureProvider) Authorize(req *http.Request) error {
+	if req.URL.Query().Get("sig") != "" {
+		return nil
+	}
+	token, err := p.accessToken()
+	if err != nil {
+		return fmt.Errorf("failed to get Azure AD access token: %s", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	if req.Header.Get("x-ms-version") == "" {
+		req.Header.Set("x-ms-version", azureStorageVersion)
+	}
+	return nil
+}
+
+func (p *AzureProvider) accessToken() (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.token.AccessToken != "" && (p.token.Expires.IsZero() || time.Now().Add(oauth2ExpiryLeeway).Before(p.token.Expires)) {
+		return p.token.AccessToken, nil
+	}
+
+	token, err := p.Source.Token()
+	if err != nil {
+		return "", err
+	}
+	if token.AccessToken == "" {
+		return "", fmt.Errorf("access token not included in the response")
+	}
+
+	addSecret(token.AccessToken)
+	p.token = token
+	log.Debugf("Azure AD access token received from %s, expires at %s", p.Source.Name(), token.Expires)
+	return token.AccessToken, nil
+}
+
+// SigV4Provider signs the requests with AWS Signature Version 4.
+// The static credentials (AccessKeyID) are used if set, otherwise the ones of the credential chain.
+type SigV4Provider struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	Chain           *awsCredentialChain
+	Region          string
+	Service         string
+
+	// now returns the signing time, time.Now if nil.
+	now func() time.Time
+}
+
+// Authorize implements the CredentialProvider interface.
+// Presigned URLs (carrying X-Amz-Signature) are not signed again.
+func (p *SigV4Provider) Authorize(req *http.Request) error {
+	if req.URL.Query().Get("X-Amz-Signature") != "" {
+		return nil
+	}
+
+	creds := awsCredentials{AccessKeyID: p.AccessKeyID, SecretAccessKey: p.SecretAccessKey, SessionToken: p.SessionToken}
+	if creds.AccessKeyID == "" && p.Chain != nil {
+		var err error
+		if creds, err = p.Chain.Retrieve(); err != nil {
+			return fmt.Errorf("failed to get AWS credentials: %s", err)
+		}
+	}
+
+	now := time.Now
+	if p.now != nil {
+		now = p.now
+	}
+	t := now().UTC()
+	amzDate := t.Format(sigV4TimeFormat)
+	scope := strings.Join([]string{t.Format("20060102"), p.Region, p.Service, "aws4_request"}, "/")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", emptyPayloadSHA256)
+	if creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+
+	canonicalRequest, signedHeaders := sigV4CanonicalRequest(req)
+	stringToSign := strings.Join([]string{sigV4Algorithm, amzDate, scope, sha256Hex(canonicalRequest)}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+creds.SecretAccessKey), t.Format("20060102"))
+	for _, part := range []string{p.Region, p.Service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s", sigV4Algorithm, creds.AccessKeyID, scope, signedHeaders, signature))
+	return nil
+}
+
+// sigV4CanonicalRequest returns the canonical form of the (body less) request and its signed headers,
+// signing the host, range and x-amz-* headers.
+func sigV4CanonicalRequest(req *http.Request) (string, string) {
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		if name == "range" || strings.HasPrefix(name, "x-amz-") {
+			headers[name] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+
+	query := req.URL.Query()
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var params []string
+	for _, key := range keys {
+		values := query[key]
+		sort.Strings(values)
+		for _, value := range values {
+			params = append(params, sigV4Escape(key)+"="+sigV4Escape(value))
+		}
+	}
+
+	signedHeaders := strings.Join(names, ";")
+	return strings.Join([]string{
+		req.Method,
+		path,
+		strings.Join(params, "&"),
+		canonicalHeaders.String(),
+		signedHeaders,
+		emptyPayloadSHA256,
+	}, "\n"), signedHeaders
+}
+
+// sigV4Escape URI encodes the query component as SigV4 requires (RFC 3986, spaces as %20).
+func sigV4Escape(s string) string {
+	return strings.Replace(url.QueryEscape(s), "+", "%20", -1)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	if _, err := h.Write([]byte(data)); err != nil {
+		panic(err)
+	}
+	return h.Sum(nil)
+}
+
+func sha256Hex(data string) string {
+	sum := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(sum[:])
+}
+
+// authTransport authorizes the download requests with the credential provider.
+// The requests already carrying credentials and the requests to the cache APIs are left as they are.
+type authTransport struct {
+	provider  CredentialProvider
+	skipHosts map[string]bool
+	next      http.RoundTripper
+}
+
+// newAuthTransport wraps the transport, to authorize the requests not sent to the given (cache API) URLs' hosts.
+func newAuthTransport(next http.RoundTripper, provider CredentialProvider, apiURLs ...string) http.RoundTripper {
+	skipHosts := map[string]bool{}
+	for _, apiURL := range apiURLs {
+		if u, err := url.Parse(apiURL); err == nil && u.Host != "" {
+			skipHosts[u.Host] = true
+		}
+	}
+	return authTransport{provider: provider, skipHosts: skipHosts, next: next}
+}
+
+// RoundTrip implements the http.RoundTripper interface.
+func (t authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.skipHosts[req.URL.Host] || req.Header.Get("Authorization") != "" {
+		return t.next.RoundTrip(req)
+	}
+
+	req = req.Clone(req.Context())
+	if err := t.provider.Authorize(req); err != nil {
+		return nil, err
+	}
+	return t.next.RoundTrip(req)
+}
@@ -0,0 +1,528 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+const (
+	// awsExpiryLeeway is the time before the credentials' expiry, when they are already renewed.
+	awsExpiryLeeway = 5 * time.Minute
+	// awsMetadataTimeout is the timeout of the metadata endpoints, which are not reachable outside of AWS.
+	awsMetadataTimeout = 2 * time.Second
+	awsSTSTimeout      = 20 * time.Second
+
+	ec2MetadataEndpoint = "http://169.254.169.254"
+	ecsMetadataEndpoint = "http://169.254.170.2"
+)
+
+// errAWSSourceNotConfigured is returned by the credential sources not set up on the machine, the chain tries the next one.
+var errAWSSourceNotConfigured = errors.New("not configured")
+
+// awsCredentials are temporary (Expires is set) or long-lived AWS credentials.
+type awsCredentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	Expires         time.Time
+}
+
+// awsCredentialSource retrieves the AWS credentials from one place, like the environment or an instance's metadata.
+type awsCredentialSource interface {
+	Name() string
+	Retrieve() (awsCredentials, error)
+}
+
+// awsCredentialChain retrieves the credentials from the first configured source and caches them until their expiry.
+// The sources follow the AWS SDKs' default chain: env vars, shared credentials and config files (including SSO),
+// web identity (IRSA), ECS container credentials and EC2 instance metadata.
+type awsCredentialChain struct {
+	Sources []awsCredentialSource
+
+	mu    sync.Mutex
+	creds *awsCredentials
+}
+
+// newAWSCredentialChain returns the default credential chain of the machine.
+func newAWSCredentialChain(region string) *awsCredentialChain {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		log.Debugf("Failed to get the home directory: %s", err)
+	}
+	return &awsCredentialChain{Sources: []awsCredentialSource{
+		envAWSCredentials{getenv: os.Getenv},
+		newSharedAWSCredentials(os.Getenv, home),
+		newWebIdentityAWSCredentials(os.Getenv, region),
+		newECSAWSCredentials(os.Getenv),
+		newEC2AWSCredentials(os.Getenv),
+	}}
+}
+
+// Retrieve returns the cached credentials, or retrieves them from the sources.
+func (c *awsCredentialChain) Retrieve() (awsCredentials, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.creds != nil && (c.creds.Expires.IsZero() || time.Now().Add(awsExpiryLeeway).Before(c.creds.Expires)) {
+		return *c.creds, nil
+	}
+
+	var errs []string
+	for _, source := range c.Sources {
+		creds, err := source.Retrieve()
+		if err == errAWSSourceNotConfigured {
+			continue
+		}
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", source.Name(), err))
+			continue
+		}
+
+		log.Debugf("AWS credentials retrieved from %s", source.Name())
+		addSecret(creds.SecretAccessKey)
+		addSecret(creds.SessionToken)
+		c.creds = &creds
+		return creds, nil
+	}
+
+	if len(errs) == 0 {
+		return awsCredentials{}, fmt.Errorf("no AWS credentials found (env vars, shared config, web identity, container or instance metadata)")
+	}
+	return awsCredentials{}, fmt.Errorf("no AWS credentials found: %s", strings.Join(errs, ", "))
+}
+
+// envAWSCredentials reads the AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN env vars.
+type envAWSCredentials struct {
+	getenv func(string) string
+}
+
+// Name implements the awsCredentialSource interface.
+func (envAWSCredentials) Name() string {
+	return "env vars"
+}
+
+// Retrieve implements the awsCredentialSource interface.
+func (s envAWSCredentials) Retrieve() (awsCredentials, error) {
+	id, secret := s.getenv("AWS_ACCESS_KEY_ID"), s.getenv("AWS_SECRET_ACCESS_KEY")
+	if id == "" || secret == "" {
+		return awsCredentials{}, errAWSSourceNotConfigured
+	}
+	return awsCredentials{AccessKeyID: id, SecretAccessKey: secret, SessionToken: s.getenv("AWS_SESSION_TOKEN")}, nil
+}
+
+// sharedAWSCredentials reads the profile (AWS_PROFILE, default) of the shared credentials (~/.aws/credentials)
+// and config (~/.aws/config) files: static keys, or an SSO role whose token was cached by `aws sso login`.
+type sharedAWSCredentials struct {
+	CredentialsFile string
+	ConfigFile      string
+	Profile         string
+	// SSOCacheDir is the directory of the SSO tokens cached by the AWS CLI.
+	SSOCacheDir string
+	// SSOEndpoint returns the SSO portal's endpoint of a region.
+	SSOEndpoint func(region string) string
+}
+
+func newSharedAWSCredentials(getenv func(string) string, home string) *sharedAWSCredentials {
+	s := &sharedAWSCredentials{
+		CredentialsFile: getenv("AWS_SHARED_CREDENTIALS_FILE"),
+		ConfigFile:      getenv("AWS_CONFIG_FILE"),
+		Profile:         getenv("AWS_PROFILE"),
+		SSOCacheDir:     filepath.Join(home, ".aws", "sso", "cache"),
+		SSOEndpoint: func(region string) string {
+			return fmt.Sprintf("https://portal.sso.%s.amazonaws.com", region)
+		},
+	}
+	if s.CredentialsFile == "" {
+		s.CredentialsFile = filepath.Join(home, ".aws", "credentials")
+	}
+	if s.ConfigFile == "" {
+		s.ConfigFile = filepath.Join(home, ".aws", "config")
+	}
+	if s.Profile == "" {
+		s.Profile = "default"
+	}
+	return s
+}
+
+// Name implements the awsCredentialSource interface.
+func (s *sharedAWSCredentials) Name() string {
+	return fmt.Sprintf("shared config (profile: %s)", s.Profile)
+}
+
+// Retrieve implements the awsCredentialSource interface.
+func (s *sharedAWSCredentials) Retrieve() (awsCredentials, error) {
+	credentials, err := readINISection(s.CredentialsFile, s.Profile)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	configSection := "profile " + s.Profile
+	if s.Profile == "default" {
+		configSection = "default"
+	}
+	config, err := readINISection(s.ConfigFile, configSection)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+
+	for _, section := range []map[string]string{credentials, config} {
+		if section["aws_access_key_id"] != "" && section["aws_secret_access_key"] != "" {
+			return awsCredentials{
+				AccessKeyID:     section["aws_access_key_id"],
+				SecretAccessKey: section["aws_secret_access_key"],
+				SessionToken:    section["aws_session_token"],
+			}, nil
+		}
+	}
+
+	if config["sso_account_id"] != "" && config["sso_role_name"] != "" {
+		if name := config["sso_session"]; name != "" {
+			session, err := readINISection(s.ConfigFile, "sso-session "+name)
+			if err != nil {
+				return awsCredentials{}, err
+			}
+			return s.retrieveSSO(config, session["sso_region"], name)
+		}
+		return s.retrieveSSO(config, config["sso_region"], config["sso_start_url"])
+	}
+	return awsCredentials{}, errAWSSourceNotConfigured
+}
+
+type ssoCachedToken struct {
+	AccessToken string    `json:"accessToken"`
+	ExpiresAt   time.Time `json:"expiresAt"`
+}
+
+type ssoRoleCredentials struct {
+	RoleCredentials struct {
+		AccessKeyID     string `json:"accessKeyId"`
+		SecretAccessKey string `json:"secretAccessKey"`
+		SessionToken    string `json:"sessionToken"`
+		Expiration      int64  `json:"expiration"`
+	} `json:"roleCredentials"`
+}
+
+// retrieveSSO exchanges the SSO token cached by the AWS CLI (named by the SHA1 of the session name or the start URL)
+// for the profile's role credentials.
+func (s *sharedAWSCredentials) retrieveSSO(profile map[string]string, region, cacheKey string) (awsCredentials, error) {
+	sum := sha1.Sum([]byte(cacheKey))
+	b, err := ioutil.ReadFile(filepath.Join(s.SSOCacheDir, hex.EncodeToString(sum[:])+".json"))
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("no cached SSO token, run `aws sso login`: %s", err)
+	}
+	var token ssoCachedToken
+	if err := json.Unmarshal(b, &token); err != nil {
+		return awsCredentials{}, fmt.Errorf("failed to parse the cached SSO token: %s", err)
+	}
+	if token.AccessToken == "" || time.Now().After(token.ExpiresAt) {
+		return awsCredentials{}, fmt.Errorf("the cached SSO token expired, run `aws sso login`")
+	}
+	addSecret(token.AccessToken)
+
+	query := url.Values{"account_id": {profile["sso_account_id"]}, "role_name": {profile["sso_role_name"]}}
+	req, err := http.NewRequest("GET", s.SSOEndpoint(region)+"/federation/credentials?"+query.Encode(), nil)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	req.Header.Set("x-amz-sso_bearer_token", token.AccessToken)
+
+	var resp ssoRoleCredentials
+	if err := doAWSCredentialsRequest(req, awsSTSTimeout, &resp, json.Unmarshal); err != nil {
+		return awsCredentials{}, err
+	}
+	return awsCredentials{
+		AccessKeyID:     resp.RoleCredentials.AccessKeyID,
+		SecretAccessKey: resp.RoleCredentials.SecretAccessKey,
+		SessionToken:    resp.RoleCredentials.SessionToken,
+		Expires:         time.Unix(0, resp.RoleCredentials.Expiration*int64(time.Millisecond)),
+	}, nil
+}
+
+// readINISection returns the keys of the INI file's section, nil if the file does not exist.
+func readINISection(pth, section string) (map[string]string, error) {
+	f, err := os.Open(pth)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := f.Close(); err != nil {
+			log.Warnf("Failed to close %s: %s", pth, err)
+		}
+	}()
+
+	values := map[string]string{}
+	current := ""
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";"):
+		case strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]"):
+			current = strings.Join(strings.Fields(line[1:len(line)-1]), " ")
+		case current == section:
+			if kv := strings.SplitN(line, "=", 2); len(kv) == 2 {
+				values[strings.ToLower(strings.TrimSpace(kv[0]))] = strings.TrimSpace(kv[1])
+			}
+		}
+	}
+	return values, scanner.Err()
+}
+
+// webIdentityAWSCredentials assumes the AWS_ROLE_ARN role with the AWS_WEB_IDENTITY_TOKEN_FILE token,
+// like the EKS pods' service accounts (IRSA).
+type webIdentityAWSCredentials struct {
+	TokenFile   string
+	RoleARN     string
+	SessionName string
+	STSEndpoint string
+}
+
+func newWebIdentityAWSCredentials(getenv func(string) string, region string) *webIdentityAWSCredentials {
+	s := &webIdentityAWSCredentials{
+		TokenFile:   getenv("AWS_WEB_IDENTITY_TOKEN_FILE"),
+		RoleARN:     getenv("AWS_ROLE_ARN"),
+		SessionName: getenv("AWS_ROLE_SESSION_NAME"),
+		STSEndpoint: "https://sts.amazonaws.com",
+	}
+	if region != "" {
+		s.STSEndpoint = fmt.Sprintf("https://sts.%s.amazonaws.com", region)
+	}
+	if s.SessionName == "" {
+		s.SessionName = fmt.Sprintf("%s-%d", stepID, time.Now().Unix())
+	}
+	return s
+}
+
+// Name implements the awsCredentialSource interface.
+func (s *webIdentityAWSCredentials) Name() string {
+	return "web identity"
+}
+
+type assumeRoleWithWebIdentityResponse struct {
+	Credentials struct {
+		AccessKeyID     string    `xml:"AccessKeyId"`
+		SecretAccessKey string    `xml:"SecretAccessKey"`
+		SessionToken    string    `xml:"SessionToken"`
+		Expiration      time.Time `xml:"Expiration"`
+	} `xml:"AssumeRoleWithWebIdentityResult>Credentials"`
+}
+
+// Retrieve implements the awsCredentialSource interface.
+func (s *webIdentityAWSCredentials) Retrieve() (awsCredentials, error) {
+	if s.TokenFile == "" || s.RoleARN == "" {
+		return awsCredentials{}, errAWSSourceNotConfigured
+	}
+	token, err := ioutil.ReadFile(s.TokenFile)
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("failed to read the web identity token: %s", err)
+	}
+
+	form := url.Values{
+		"Action":           {"AssumeRoleWithWebIdentity"},
+		"Version":          {"2011-06-15"},
+		"RoleArn":          {s.RoleARN},
+		"RoleSessionName":  {s.SessionName},
+		"WebIdentityToken": {strings.TrimSpace(string(token))},
+	}
+	req, err := http.NewRequest("POST", s.STSEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	var resp assumeRoleWithWebIdentityResponse
+	if err := doAWSCredentialsRequest(req, awsSTSTimeout, &resp, xml.Unmarshal); err != nil {
+		return awsCredentials{}, err
+	}
+	return awsCredentials{
+		AccessKeyID:     resp.Credentials.AccessKeyID,
+		SecretAccessKey: resp.Credentials.SecretAccessKey,
+		SessionToken:    resp.Credentials.SessionToken,
+		Expires:         resp.Credentials.Expiration,
+	}, nil
+}
+
+// metadataCredentials are the credentials served by the ECS and EC2 metadata endpoints.
+type metadataCredentials struct {
+	AccessKeyID     string    `json:"AccessKeyId"`
+	SecretAccessKey string    `json:"SecretAccessKey"`
+	Token           string    `json:"Token"`
+	Expiration      time.Time `json:"Expiration"`
+}
+
+func (c metadataCredentials) credentials() awsCredentials {
+	return awsCredentials{AccessKeyID: c.AccessKeyID, SecretAccessKey: c.SecretAccessKey, SessionToken: c.Token, Expires: c.Expiration}
+}
+
+// ecsAWSCredentials reads the ECS (or EKS Pod Identity) container credentials endpoint.
+type ecsAWSCredentials struct {
+	URL                string
+	AuthorizationToken string
+}
+
+func newECSAWSCredentials(getenv func(string) string) *ecsAWSCredentials {
+	s := &ecsAWSCredentials{URL: getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI"), AuthorizationToken: getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN")}
+	if relative := getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); relative != "" {
+		s.URL = ecsMetadataEndpoint + relative
+	}
+	if file := getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE"); file != "" {
+		if b, err := ioutil.ReadFile(file); err == nil {
+			s.AuthorizationToken = strings.TrimSpace(string(b))
+		} else {
+			log.Debugf("Failed to read the container authorization token: %s", err)
+		}
+	}
+	return s
+}
+
+// Name implements the awsCredentialSource interface.
+func (s *ecsAWSCredentials) Name() string {
+	return "container credentials"
+}
+
+// Retrieve implements the awsCredentialSource interface.
+func (s *ecsAWSCredentials) Retrieve() (awsCredentials, error) {
+	if s.URL == "" {
+		return awsCredentials{}, errAWSSourceNotConfigured
+	}
+	req, err := http.NewRequest("GET", s.URL, nil)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	if s.AuthorizationToken != "" {
+		req.Header.Set("Authorization", s.AuthorizationToken)
+	}
+
+	var resp metadataCredentials
+	if err := doAWSCredentialsRequest(req, awsMetadataTimeout, &resp, json.Unmarshal); err != nil {
+		return awsCredentials{}, err
+	}
+	return resp.credentials(), nil
+}
+
+// ec2AWSCredentials reads the instance profile's credentials from the EC2 instance metadata (IMDSv2).
+type ec2AWSCredentials struct {
+	Endpoint string
+	Disabled bool
+}
+
+func newEC2AWSCredentials(getenv func(string) string) *ec2AWSCredentials {
+	s := &ec2AWSCredentials{Endpoint: getenv("AWS_EC2_METADATA_SERVICE_ENDPOINT"), Disabled: strings.EqualFold(getenv("AWS_EC2_METADATA_DISABLED"), "true")}
+	if s.Endpoint == "" {
+		s.Endpoint = ec2MetadataEndpoint
+	}
+	return s
+}
+
+// Name implements the awsCredentialSource interface.
+func (s *ec2AWSCredentials) Name() string {
+	return "instance metadata"
+}
+
+// Retrieve implements the awsCredentialSource interface.
+func (s *ec2AWSCredentials) Retrieve() (awsCredentials, error) {
+	if s.Disabled {
+		return awsCredentials{}, errAWSSourceNotConfigured
+	}
+	endpoint := strings.TrimSuffix(s.Endpoint, "/")
+	client := &http.Client{Timeout: awsMetadataTimeout}
+
+	req, err := http.NewRequest("PUT", endpoint+"/latest/api/token", nil)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "21600")
+	resp, err := client.Do(req)
+	if err != nil {
+		// not on EC2
+		log.Debugf("EC2 instance metadata is not available: %s", err)
+		return awsCredentials{}, errAWSSourceNotConfigured
+	}
+	token, err := readMetadataResponse(resp)
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("failed to get the metadata token: %s", err)
+	}
+
+	get := func(pth string) (string, error) {
+		req, err := http.NewRequest("GET", endpoint+"/latest/meta-data/iam/security-credentials/"+pth, nil)
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("X-aws-ec2-metadata-token", token)
+		resp, err := client.Do(req)
+		if err != nil {
+			return "", err
+		}
+		return readMetadataResponse(resp)
+	}
+
+	roles, err := get("")
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("failed to get the instance profile: %s", err)
+	}
+	role := strings.TrimSpace(strings.SplitN(roles, "\n", 2)[0])
+	if role == "" {
+		return awsCredentials{}, fmt.Errorf("the instance has no instance profile")
+	}
+	body, err := get(role)
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("failed to get the instance profile's credentials: %s", err)
+	}
+
+	var creds metadataCredentials
+	if err := json.Unmarshal([]byte(body), &creds); err != nil {
+		return awsCredentials{}, fmt.Errorf("failed to parse the instance profile's credentials: %s", err)
+	}
+	return creds.credentials(), nil
+}
+
+func readMetadataResponse(resp *http.Response) (string, error) {
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			log.Warnf("Failed to close response body: %s", err)
+		}
+	}()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("non success response code: %d", resp.StatusCode)
+	}
+	return string(body), nil
+}
+
+// doAWSCredentialsRequest sends the credentials request and parses the response.
+// The requests bypass the step's auth transport, which signs its requests with the credentials being retrieved.
+func doAWSCredentialsRequest(req *http.Request, timeout time.Duration, v interface{}, unmarshal func([]byte, interface{}) error) error {
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	body, err := readMetadataResponse(resp)
+	if err != nil {
+		return err
+	}
+	if err := unmarshal([]byte(body), v); err != nil {
+		return fmt.Errorf("failed to parse the credentials: %s", err)
+	}
+	return nil
+}
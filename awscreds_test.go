@@ -0,0 +1,263 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type fakeAWSSource struct {
+	name  string
+	creds awsCredentials
+	err   error
+	calls int
+}
+
+func (s *fakeAWSSource) Name() string { return s.name }
+
+func (s *fakeAWSSource) Retrieve() (awsCredentials, error) {
+	s.calls++
+	return s.creds, s.err
+}
+
+func TestAWSCredentialChain_Retrieve(t *testing.T) {
+	notConfigured := &fakeAWSSource{name: "env vars", err: errAWSSourceNotConfigured}
+	failing := &fakeAWSSource{name: "web identity", err: fmt.Errorf("access denied")}
+	expiring := &fakeAWSSource{name: "instance metadata", creds: awsCredentials{AccessKeyID: "chain-id", SecretAccessKey: "chain-secret-key", Expires: time.Now().Add(time.Minute)}}
+	chain := &awsCredentialChain{Sources: []awsCredentialSource{notConfigured, failing, expiring}}
+
+	creds, err := chain.Retrieve()
+	if err != nil || creds.AccessKeyID != "chain-id" {
+		t.Fatalf("awsCredentialChain.Retrieve() = %v, %v, want the instance metadata's", creds, err)
+	}
+
+	t.Log("credentials expiring within the leeway are renewed")
+	{
+		if _, err := chain.Retrieve(); err != nil {
+			t.Fatalf("awsCredentialChain.Retrieve() error = %v", err)
+		}
+		if expiring.calls != 2 {
+			t.Errorf("source calls = %d, want 2", expiring.calls)
+		}
+	}
+
+	t.Log("long-lived credentials are cached")
+	{
+		expiring.creds.Expires = time.Time{}
+		chain.creds = nil
+		for i := 0; i < 2; i++ {
+			if _, err := chain.Retrieve(); err != nil {
+				t.Fatalf("awsCredentialChain.Retrieve() error = %v", err)
+			}
+		}
+		if expiring.calls != 3 {
+			t.Errorf("source calls = %d, want 3", expiring.calls)
+		}
+	}
+
+	t.Log("no source")
+	{
+		chain := &awsCredentialChain{Sources: []awsCredentialSource{notConfigured, failing}}
+		if _, err := chain.Retrieve(); err == nil {
+			t.Errorf("awsCredentialChain.Retrieve() error = nil, want error")
+		}
+	}
+}
+
+func TestSharedAWSCredentials_Retrieve(t *testing.T) {
+	dir, err := ioutil.TempDir("", "awscreds-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Logf("failed to remove temp dir: %s", err)
+		}
+	}()
+
+	credentials := "[default]\naws_access_key_id = default-id\naws_secret_access_key = default-secret\n\n[ci]\naws_access_key_id=ci-id\naws_secret_access_key=ci-secret\naws_session_token=ci-token\n"
+	config := "[profile sso]\nsso_session = corp\nsso_account_id = 123456789012\nsso_role_name = CacheReader\n\n[sso-session corp]\nsso_region = eu-west-1\nsso_start_url = https://corp.awsapps.com/start\n"
+	for name, content := range map[string]string{"credentials": credentials, "config": config} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatalf("failed to write file: %s", err)
+		}
+	}
+
+	sum := sha1.Sum([]byte("corp"))
+	if err := os.MkdirAll(filepath.Join(dir, "sso"), 0700); err != nil {
+		t.Fatalf("failed to create dir: %s", err)
+	}
+	token := fmt.Sprintf(`{"accessToken": "sso-token", "expiresAt": "%s"}`, time.Now().Add(time.Hour).UTC().Format(time.RFC3339))
+	if err := ioutil.WriteFile(filepath.Join(dir, "sso", hex.EncodeToString(sum[:])+".json"), []byte(token), 0600); err != nil {
+		t.Fatalf("failed to write file: %s", err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("x-amz-sso_bearer_token") != "sso-token" || r.URL.Query().Get("role_name") != "CacheReader" || r.URL.Query().Get("account_id") != "123456789012" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if _, err := w.Write([]byte(`{"roleCredentials": {"accessKeyId": "sso-id", "secretAccessKey": "sso-secret", "sessionToken": "sso-session", "expiration": 1893456000000}}`)); err != nil {
+			t.Errorf("failed to write response: %s", err)
+		}
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		profile string
+		want    awsCredentials
+		wantErr error
+	}{
+		{profile: "default", want: awsCredentials{AccessKeyID: "default-id", SecretAccessKey: "default-secret"}},
+		{profile: "ci", want: awsCredentials{AccessKeyID: "ci-id", SecretAccessKey: "ci-secret", SessionToken: "ci-token"}},
+		{profile: "sso", want: awsCredentials{AccessKeyID: "sso-id", SecretAccessKey: "sso-secret", SessionToken: "sso-session", Expires: time.Unix(1893456000, 0)}},
+		{profile: "missing", wantErr: errAWSSourceNotConfigured},
+	}
+	for _, tt := range tests {
+		t.Run(tt.profile, func(t *testing.T) {
+			s := &sharedAWSCredentials{
+				CredentialsFile: filepath.Join(dir, "credentials"),
+				ConfigFile:      filepath.Join(dir, "config"),
+				Profile:         tt.profile,
+				SSOCacheDir:     filepath.Join(dir, "sso"),
+				SSOEndpoint: func(region string) string {
+					if region != "eu-west-1" {
+						t.Errorf("SSO region = %s, want eu-west-1", region)
+					}
+					return server.URL
+				},
+			}
+			got, err := s.Retrieve()
+			if err != tt.wantErr {
+				t.Fatalf("sharedAWSCredentials.Retrieve() error = %v, want %v", err, tt.wantErr)
+			}
+			if !got.Expires.Equal(tt.want.Expires) {
+				t.Errorf("sharedAWSCredentials.Retrieve() expires = %v, want %v", got.Expires, tt.want.Expires)
+			}
+			got.Expires, tt.want.Expires = time.Time{}, time.Time{}
+			if got != tt.want {
+				t.Errorf("sharedAWSCredentials.Retrieve() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWebIdentityAWSCredentials_Retrieve(t *testing.T) {
+	f, err := ioutil.TempFile("", "awscreds-token")
+	if err != nil {
+		t.Fatalf("failed to create temp file: %s", err)
+	}
+	defer func() {
+		if err := os.Remove(f.Name()); err != nil {
+			t.Logf("failed to remove temp file: %s", err)
+		}
+	}()
+	if _, err := f.WriteString("jwt\n"); err != nil {
+		t.Fatalf("failed to write token: %s", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("failed to close token: %s", err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Errorf("failed to parse form: %s", err)
+		}
+		if r.Form.Get("Action") != "AssumeRoleWithWebIdentity" || r.Form.Get("WebIdentityToken") != "jwt" || r.Form.Get("RoleArn") != "arn:aws:iam::123456789012:role/cache" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		response := `<AssumeRoleWithWebIdentityResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <AssumeRoleWithWebIdentityResult>
+    <Credentials>
+      <AccessKeyId>irsa-id</AccessKeyId>
+      <SecretAccessKey>irsa-secret</SecretAccessKey>
+      <SessionToken>irsa-token</SessionToken>
+      <Expiration>2030-01-01T00:00:00Z</Expiration>
+    </Credentials>
+  </AssumeRoleWithWebIdentityResult>
+</AssumeRoleWithWebIdentityResponse>`
+		if _, err := w.Write([]byte(response)); err != nil {
+			t.Errorf("failed to write response: %s", err)
+		}
+	}))
+	defer server.Close()
+
+	env := map[string]string{"AWS_WEB_IDENTITY_TOKEN_FILE": f.Name(), "AWS_ROLE_ARN": "arn:aws:iam::123456789012:role/cache"}
+	s := newWebIdentityAWSCredentials(func(key string) string { return env[key] }, "eu-west-1")
+	if s.STSEndpoint != "https://sts.eu-west-1.amazonaws.com" {
+		t.Errorf("STS endpoint = %s, want the regional one", s.STSEndpoint)
+	}
+	s.STSEndpoint = server.URL
+
+	got, err := s.Retrieve()
+	if err != nil {
+		t.Fatalf("webIdentityAWSCredentials.Retrieve() error = %v", err)
+	}
+	want := awsCredentials{AccessKeyID: "irsa-id", SecretAccessKey: "irsa-secret", SessionToken: "irsa-token", Expires: time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)}
+	if got != want {
+		t.Errorf("webIdentityAWSCredentials.Retrieve() = %+v, want %+v", got, want)
+	}
+
+	if _, err := newWebIdentityAWSCredentials(func(string) string { return "" }, "").Retrieve(); err != errAWSSourceNotConfigured {
+		t.Errorf("webIdentityAWSCredentials.Retrieve() error = %v, want not configured", err)
+	}
+}
+
+func TestMetadataAWSCredentials_Retrieve(t *testing.T) {
+	creds := `{"Code": "Success", "AccessKeyId": "meta-id", "SecretAccessKey": "meta-secret", "Token": "meta-token", "Expiration": "2030-01-01T00:00:00Z"}`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body string
+		switch {
+		case r.Method == "PUT" && r.URL.Path == "/latest/api/token":
+			body = "imds-token"
+		case r.Header.Get("X-aws-ec2-metadata-token") != "imds-token" && r.URL.Path != "/v2/credentials/ecs":
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		case r.URL.Path == "/latest/meta-data/iam/security-credentials/":
+			body = "runner-role"
+		case r.URL.Path == "/latest/meta-data/iam/security-credentials/runner-role":
+			body = creds
+		case r.URL.Path == "/v2/credentials/ecs" && r.Header.Get("Authorization") == "ecs-token":
+			body = creds
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if _, err := w.Write([]byte(body)); err != nil {
+			t.Errorf("failed to write response: %s", err)
+		}
+	}))
+	defer server.Close()
+
+	want := awsCredentials{AccessKeyID: "meta-id", SecretAccessKey: "meta-secret", SessionToken: "meta-token", Expires: time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)}
+	for _, source := range []awsCredentialSource{
+		&ec2AWSCredentials{Endpoint: server.URL},
+		&ecsAWSCredentials{URL: server.URL + "/v2/credentials/ecs", AuthorizationToken: "ecs-token"},
+	} {
+		got, err := source.Retrieve()
+		if err != nil {
+			t.Fatalf("%s Retrieve() error = %v", source.Name(), err)
+		}
+		if got != want {
+			t.Errorf("%s Retrieve() = %+v, want %+v", source.Name(), got, want)
+		}
+	}
+
+	t.Log("disabled instance metadata")
+	{
+		s := newEC2AWSCredentials(func(key string) string {
+			return map[string]string{"AWS_EC2_METADATA_DISABLED": "true"}[key]
+		})
+		if _, err := s.Retrieve(); err != errAWSSourceNotConfigured {
+			t.Errorf("ec2AWSCredentials.Retrieve() error = %v, want not configured", err)
+		}
+	}
+}
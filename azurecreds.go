@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// azureStorageResource is the resource (audience) of the access tokens, the Azure Storage data plane.
+	azureStorageResource = "https://storage.azure.com/"
+	// azureStorageVersion is the Blob service REST API version sent with the token authorized requests,
+	// Azure AD auth requires 2017-11-09 or later.
+	azureStorageVersion = "2021-08-06"
+
+	azureAuthorityHost   = "https://login.microsoftonline.com"
+	azureIMDSEndpoint    = "http://169.254.169.254/metadata/identity/oauth2/token"
+	azureMetadataTimeout = 2 * time.Second
+
+	azureClientAssertionType = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+)
+
+// azureCredentialsOptions are the Azure AD app registration's or the user-assigned managed identity's settings.
+type azureCredentialsOptions struct {
+	TenantID     string
+	ClientID     string
+	ClientSecret string
+}
+
+// newAzureTokenSource returns the Azure AD token source for the options and the environment:
+// the app registration's client secret, workload identity (AZURE_FEDERATED_TOKEN_FILE, e.g. AKS),
+// then the managed identity of the VM or scale set (or App Service), ClientID selecting a user-assigned identity.
+func newAzureTokenSource(opts azureCredentialsOptions, getenv func(string) string) tokenSource {
+	authorityHost := strings.TrimSuffix(getenv("AZURE_AUTHORITY_HOST"), "/")
+	if authorityHost == "" {
+		authorityHost = azureAuthorityHost
+	}
+	tokenURL := fmt.Sprintf("%s/%s/oauth2/v2.0/token", authorityHost, url.PathEscape(opts.TenantID))
+
+	if opts.ClientSecret != "" {
+		return &clientSecretAzureCredentials{TokenURL: tokenURL, ClientID: opts.ClientID, ClientSecret: opts.ClientSecret}
+	}
+	if file := getenv("AZURE_FEDERATED_TOKEN_FILE"); file != "" && opts.TenantID != "" && opts.ClientID != "" {
+		return &workloadIdentityAzureCredentials{TokenURL: tokenURL, ClientID: opts.ClientID, TokenFile: file}
+	}
+
+	s := &managedIdentityAzureCredentials{Endpoint: azureIMDSEndpoint, ClientID: opts.ClientID}
+	if endpoint, header := getenv("IDENTITY_ENDPOINT"), getenv("IDENTITY_HEADER"); endpoint != "" && header != "" {
+		s.Endpoint, s.IdentityHeader = endpoint, header
+	}
+	return s
+}
+
+// clientSecretAzureCredentials gets the access tokens of an app registration by the client credentials grant.
+type clientSecretAzureCredentials struct {
+	TokenURL     string
+	ClientID     string
+	ClientSecret string
+}
+
+// Name implements the tokenSource interface.
+func (s *clientSecretAzureCredentials) Name() string {
+	return "client secret"
+}
+
+// Token implements the tokenSource interface.
+func (s *clientSecretAzureCredentials) Token() (bearerToken, error) {
+	return postTokenForm(s.TokenURL, url.Values{
+		"grant_type":    {"client_credentials"},
+		"client_id":     {s.ClientID},
+		"client_secret": {s.ClientSecret},
+		"scope":         {azureStorageResource + ".default"},
+	})
+}
+
+// workloadIdentityAzureCredentials exchanges the federated token (e.g. an AKS service account token)
+// for an app registration's access token.
+type workloadIdentityAzureCredentials struct {
+	TokenURL  string
+	ClientID  string
+	TokenFile string
+}
+
+// Name implements the tokenSource interface.
+func (s *workloadIdentityAzureCredentials) Name() string {
+	return "workload identity"
+}
+
+// Token implements the tokenSource interface.
+func (s *workloadIdentityAzureCredentials) Token() (bearerToken, error) {
+	assertion, err := ioutil.ReadFile(s.TokenFile)
+	if err != nil {
+		return bearerToken{}, fmt.Errorf("failed to read the federated token: %s", err)
+	}
+	return postTokenForm(s.TokenURL, url.Values{
+		"grant_type":            {"client_credentials"},
+		"client_id":             {s.ClientID},
+		"client_assertion_type": {azureClientAssertionType},
+		"client_assertion":      {strings.TrimSpace(string(assertion))},
+		"scope":                 {azureStorageResource + ".default"},
+	})
+}
+
+// managedIdentityAzureCredentials gets the access tokens of the managed identity from the instance metadata service
+// (VMs, scale sets) or the App Service identity endpoint (IdentityHeader set).
+type managedIdentityAzureCredentials struct {
+	Endpoint       string
+	IdentityHeader string
+	// ClientID selects a user-assigned identity, empty uses the system-assigned one.
+	ClientID string
+}
+
+// Name implements the tokenSource interface.
+func (s *managedIdentityAzureCredentials) Name() string {
+	return "managed identity"
+}
+
+// azureManagedIdentityToken is the managed identity endpoints' token response, with the expiry as (quoted) unix time.
+type azureManagedIdentityToken struct {
+	AccessToken string      `json:"access_token"`
+	ExpiresOn   json.Number `json:"expires_on"`
+}
+
+// Token implements the tokenSource interface.
+func (s *managedIdentityAzureCredentials) Token() (bearerToken, error) {
+	query := url.Values{"api-version": {"2018-02-01"}, "resource": {azureStorageResource}}
+	if s.IdentityHeader != "" {
+		query.Set("api-version", "2019-08-01")
+	}
+	if s.ClientID != "" {
+		query.Set("client_id", s.ClientID)
+	}
+	req, err := http.NewRequest("GET", s.Endpoint+"?"+query.Encode(), nil)
+	if err != nil {
+		return bearerToken{}, err
+	}
+	if s.IdentityHeader != "" {
+		req.Header.Set("X-IDENTITY-HEADER", s.IdentityHeader)
+	} else {
+		req.Header.Set("Metadata", "true")
+	}
+
+	var resp azureManagedIdentityToken
+	if err := doTokenRequest(req, azureMetadataTimeout, &resp); err != nil {
+		return bearerToken{}, fmt.Errorf("no Azure managed identity found: %s", err)
+	}
+
+	token := bearerToken{AccessToken: resp.AccessToken}
+	if expiresOn, err := resp.ExpiresOn.Int64(); err == nil {
+		token.Expires = time.Unix(expiresOn, 0)
+	}
+	return token, nil
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestNewAzureTokenSource(t *testing.T) {
+	env := map[string]string{}
+	getenv := func(key string) string { return env[key] }
+
+	tests := []struct {
+		name string
+		opts azureCredentialsOptions
+		env  map[string]string
+		want string
+	}{
+		{name: "client secret", opts: azureCredentialsOptions{TenantID: "tenant", ClientID: "app", ClientSecret: "azure-app-secret"}, want: "client secret"},
+		{name: "workload identity", opts: azureCredentialsOptions{TenantID: "tenant", ClientID: "app"}, env: map[string]string{"AZURE_FEDERATED_TOKEN_FILE": "/var/run/token"}, want: "workload identity"},
+		{name: "workload identity without client", env: map[string]string{"AZURE_FEDERATED_TOKEN_FILE": "/var/run/token"}, want: "managed identity"},
+		{name: "managed identity", opts: azureCredentialsOptions{ClientID: "identity"}, want: "managed identity"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env = tt.env
+			if got := newAzureTokenSource(tt.opts, getenv).Name(); got != tt.want {
+				t.Errorf("newAzureTokenSource() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+
+	t.Log("authority host")
+	{
+		env = map[string]string{"AZURE_AUTHORITY_HOST": "https://login.microsoftonline.us/"}
+		s, ok := newAzureTokenSource(azureCredentialsOptions{TenantID: "tenant", ClientID: "app", ClientSecret: "azure-app-secret"}, getenv).(*clientSecretAzureCredentials)
+		if !ok || s.TokenURL != "https://login.microsoftonline.us/tenant/oauth2/v2.0/token" {
+			t.Errorf("newAzureTokenSource() = %#v, want the sovereign cloud's token URL", s)
+		}
+	}
+}
+
+func TestAzureCredentials_Token(t *testing.T) {
+	f, err := ioutil.TempFile("", "azurecreds-token")
+	if err != nil {
+		t.Fatalf("failed to create temp file: %s", err)
+	}
+	defer func() {
+		if err := os.Remove(f.Name()); err != nil {
+			t.Logf("failed to remove temp file: %s", err)
+		}
+	}()
+	if _, err := f.WriteString("aks-jwt\n"); err != nil {
+		t.Fatalf("failed to write token: %s", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("failed to close token: %s", err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body string
+		switch r.URL.Path {
+		case "/tenant/oauth2/v2.0/token":
+			if err := r.ParseForm(); err != nil {
+				t.Errorf("failed to parse form: %s", err)
+			}
+			if r.Form.Get("scope") != "https://storage.azure.com/.default" || (r.Form.Get("client_secret") != "azure-app-secret" && r.Form.Get("client_assertion") != "aks-jwt") {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			body = `{"token_type": "Bearer", "expires_in": 3599, "access_token": "aad-token"}`
+		case "/metadata/identity/oauth2/token":
+			if r.Header.Get("Metadata") != "true" || r.URL.Query().Get("resource") != azureStorageResource || r.URL.Query().Get("client_id") != "identity" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			body = `{"access_token": "imds-access-token", "expires_in": "86399", "expires_on": "1893456000", "resource": "https://storage.azure.com/", "token_type": "Bearer"}`
+		case "/msi/token":
+			if r.Header.Get("X-IDENTITY-HEADER") != "app-service-header" || r.URL.Query().Get("api-version") != "2019-08-01" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			body = `{"access_token": "app-service-access-token", "expires_on": 1893456000}`
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if _, err := w.Write([]byte(body)); err != nil {
+			t.Errorf("failed to write response: %s", err)
+		}
+	}))
+	defer server.Close()
+
+	tokenURL := server.URL + "/tenant/oauth2/v2.0/token"
+	expires := time.Unix(1893456000, 0)
+	tests := []struct {
+		source      tokenSource
+		want        string
+		wantExpires bool
+	}{
+		{source: &clientSecretAzureCredentials{TokenURL: tokenURL, ClientID: "app", ClientSecret: "azure-app-secret"}, want: "aad-token"},
+		{source: &workloadIdentityAzureCredentials{TokenURL: tokenURL, ClientID: "app", TokenFile: f.Name()}, want: "aad-token"},
+		{source: &managedIdentityAzureCredentials{Endpoint: server.URL + "/metadata/identity/oauth2/token", ClientID: "identity"}, want: "imds-access-token", wantExpires: true},
+		{source: &managedIdentityAzureCredentials{Endpoint: server.URL + "/msi/token", IdentityHeader: "app-service-header"}, want: "app-service-access-token", wantExpires: true},
+	}
+	for _, tt := range tests {
+		got, err := tt.source.Token()
+		if err != nil {
+			t.Fatalf("%s Token() error = %v", tt.source.Name(), err)
+		}
+		if got.AccessToken != tt.want {
+			t.Errorf("%s Token() = %s, want %s", tt.source.Name(), got.AccessToken, tt.want)
+		}
+		if tt.wantExpires && !got.Expires.Equal(expires) {
+			t.Errorf("%s Token() expires = %s, want %s", tt.source.Name(), got.Expires, expires)
+		}
+	}
+}
+
+func TestAzureProvider_Authorize(t *testing.T) {
+	p := &AzureProvider{Source: &managedIdentityAzureCredentials{Endpoint: "http://127.0.0.1:1"}}
+	p.token = bearerToken{AccessToken: "cached-aad-token", Expires: time.Now().Add(time.Hour)}
+
+	req, err := http.NewRequest("GET", "https://account.blob.core.windows.net/cache/archive.tar", nil)
+	if err != nil {
+		t.Fatalf("failed to create request: %s", err)
+	}
+	if err := p.Authorize(req); err != nil {
+		t.Fatalf("AzureProvider.Authorize() error = %v", err)
+	}
+	if got := req.Header.Get("Authorization"); got != "Bearer cached-aad-token" {
+		t.Errorf("Authorization = %s, want the cached token", got)
+	}
+	if got := req.Header.Get("x-ms-version"); got != azureStorageVersion {
+		t.Errorf("x-ms-version = %s, want %s", got, azureStorageVersion)
+	}
+
+	t.Log("SAS URL")
+	{
+		req, err := http.NewRequest("GET", "https://account.blob.core.windows.net/cache/archive.tar?sv=2021-08-06&sig=abc", nil)
+		if err != nil {
+			t.Fatalf("failed to create request: %s", err)
+		}
+		if err := p.Authorize(req); err != nil {
+			t.Fatalf("AzureProvider.Authorize() error = %v", err)
+		}
+		if got := req.Header.Get("Authorization"); got != "" {
+			t.Errorf("Authorization = %s, want empty", got)
+		}
+	}
+
+	t.Log("expired token, no managed identity")
+	{
+		p.token.Expires = time.Now()
+		if err := p.Authorize(req); err == nil {
+			t.Errorf("AzureProvider.Authorize() error = nil, want error")
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// errCircuitOpen is returned for the cache requests after the circuit breaker tripped.
+var errCircuitOpen = errors.New("cache backend is unhealthy, circuit breaker is open")
+
+// CircuitBreaker stops sending requests to the cache API and blob store after too many failed or slow requests,
+// so that the build proceeds without cache instead of spending minutes in retries.
+type CircuitBreaker struct {
+	// MaxErrors is the number of failed requests tripping the breaker, 0 disables the breaker.
+	MaxErrors int
+	// Timeout is the maximum time to wait for a response's headers, slower requests fail. 0 means no limit.
+	Timeout time.Duration
+	// OnTrip is called once, when the breaker trips.
+	OnTrip func(reason string)
+
+	mu     sync.Mutex
+	errors int
+	open   bool
+}
+
+// breaker is the current pull's circuit breaker, checked by failf.
+var breaker *CircuitBreaker
+
+// NewCircuitBreaker creates a new CircuitBreaker.
+func NewCircuitBreaker(maxErrors int, timeout time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{MaxErrors: maxErrors, Timeout: timeout}
+}
+
+// Open reports whether the breaker tripped.
+func (b *CircuitBreaker) Open() bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.open
+}
+
+func (b *CircuitBreaker) recordFailure(reason string) {
+	if b.MaxErrors <= 0 {
+		return
+	}
+
+	b.mu.Lock()
+	b.errors++
+	trip := !b.open && b.errors >= b.MaxErrors
+	if trip {
+		b.open = true
+	}
+	b.mu.Unlock()
+
+	if trip {
+		log.Warnf("Circuit breaker tripped after %d failed cache requests, last: %s", b.MaxErrors, reason)
+		if b.OnTrip != nil {
+			b.OnTrip(reason)
+		}
+	}
+}
+
+// Transport wraps the given transport, to fail fast when the breaker is open and to count the failed requests.
+func (b *CircuitBreaker) Transport(next http.RoundTripper) http.RoundTripper {
+	if t, ok := next.(*http.Transport); ok && b.Timeout > 0 {
+		t = t.Clone()
+		t.ResponseHeaderTimeout = b.Timeout
+		next = t
+	}
+	return breakerTransport{breaker: b, next: next}
+}
+
+type breakerTransport struct {
+	breaker *CircuitBreaker
+	next    http.RoundTripper
+}
+
+// RoundTrip implements the http.RoundTripper interface.
+func (t breakerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.breaker.Open() {
+		return nil, errCircuitOpen
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		t.breaker.recordFailure(err.Error())
+		return nil, err
+	}
+	if resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests {
+		t.breaker.recordFailure(fmt.Sprintf("%s %s: %d", req.Method, redactURL(req.URL.String()), resp.StatusCode))
+	}
+	return resp, nil
+}
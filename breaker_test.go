@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker_Transport(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.URL.Path == "/slow" {
+			time.Sleep(200 * time.Millisecond)
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	b := NewCircuitBreaker(2, 100*time.Millisecond)
+	tripped := 0
+	b.OnTrip = func(string) { tripped++ }
+	client := &http.Client{Transport: b.Transport(http.DefaultTransport)}
+
+	for i, path := range []string{"/slow", "/", "/"} {
+		resp, err := client.Get(server.URL + path)
+		if err == nil {
+			if err := resp.Body.Close(); err != nil {
+				t.Logf("failed to close response body: %s", err)
+			}
+		}
+
+		if wantOpen := i >= 1; b.Open() != wantOpen {
+			t.Errorf("request (%d): CircuitBreaker.Open() = %v, want %v", i, b.Open(), wantOpen)
+		}
+	}
+
+	if requests != 2 {
+		t.Errorf("requests = %d, want 2", requests)
+	}
+	if tripped != 1 {
+		t.Errorf("OnTrip called %d times, want 1", tripped)
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Path group priorities, see the path_budgets input.
+const (
+	budgetPriorityHigh = "high"
+	budgetPriorityLow  = "low"
+)
+
+// budgetTotalPath is the path_budgets line of the budget of the whole restore.
+const budgetTotalPath = "*"
+
+var budgetSizePattern = regexp.MustCompile(`^(\d+(?:\.\d+)?)\s*([KMGT]?B)$`)
+
+// pathGroup is a cached path with its restore priority and size budget.
+type pathGroup struct {
+	Path     string
+	Priority string
+	// MaxSize is the group's budget in Bytes, 0 if the group is not limited.
+	MaxSize int64
+
+	Restored       int64
+	SkippedEntries int
+	SkippedSize    int64
+}
+
+// pathBudgets are the size budgets of the restore, the entries over the budgets are skipped:
+//
+//   - the rest of a group is skipped once an entry does not fit its MaxSize,
+//   - once an entry does not fit the Total, only the high priority groups are restored further,
+//     the rest of the low priority groups and of the paths outside of the groups are skipped.
+//
+// A truncated group stays truncated, so the later small entries do not restore pieces of it.
+type pathBudgets struct {
+	// Groups are sorted by the length of their path, longest first, so a path belongs to its innermost group.
+	Groups []*pathGroup
+	// Total is the budget of the whole restore in Bytes, 0 if not limited.
+	Total int64
+
+	Restored int64
+	// SkippedEntries counts the skipped entries outside of the groups.
+	SkippedEntries int
+	// exceeded is set once an entry did not fit the Total.
+	exceeded bool
+}
+
+// parseBudgetSize parses a size with a unit (e.g. 512MB, 2GB, 1.5 GB), the units are powers of 1024.
+func parseBudgetSize(s string) (int64, error) {
+	match := budgetSizePattern.FindStringSubmatch(strings.ToUpper(strings.TrimSpace(s)))
+	if match == nil {
+		return 0, fmt.Errorf("invalid size (%s), use e.g. 512MB or 2GB", s)
+	}
+	value, err := strconv.ParseFloat(match[1], 64)
+	if err != nil {
+		return 0, err
+	}
+	exp := strings.Index("BKMGT", match[2][:1])
+	if match[2] == "B" {
+		exp = 0
+	}
+	for i := 0; i < exp; i++ {
+		value *= 1024
+	}
+	return int64(value), nil
+}
+
+// parsePathBudgets parses the path_budgets input, one group per line:
+//
+//	<path>: <high|low>[, max <size>]
+//	*: max <size>
+//
+// The relative paths are relative to dir. It returns nil if s is empty.
+func parsePathBudgets(s, dir string) (*pathBudgets, error) {
+	budgets := &pathBudgets{}
+	for _, line := range strings.Split(s, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		i := strings.LastIndex(line, ":")
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid path budget (%s), use <path>: <high|low>[, max <size>]", line)
+		}
+		pth := strings.TrimSpace(line[:i])
+
+		group := pathGroup{}
+		for _, field := range strings.Split(line[i+1:], ",") {
+			field = strings.TrimSpace(field)
+			switch {
+			case field == budgetPriorityHigh || field == budgetPriorityLow:
+				group.Priority = field
+			case strings.HasPrefix(field, "max "):
+				size, err := parseBudgetSize(strings.TrimPrefix(field, "max "))
+				if err != nil {
+					return nil, fmt.Errorf("invalid path budget (%s): %s", line, err)
+				}
+				group.MaxSize = size
+			default:
+				return nil, fmt.Errorf("invalid path budget (%s): unknown setting (%s)", line, field)
+			}
+		}
+
+		if pth == budgetTotalPath {
+			if group.Priority != "" || group.MaxSize == 0 {
+				return nil, fmt.Errorf("invalid path budget (%s), use %s: max <size>", line, budgetTotalPath)
+			}
+			budgets.Total = group.MaxSize
+			continue
+		}
+		if group.Priority == "" {
+			return nil, fmt.Errorf("invalid path budget (%s): no priority (high or low)", line)
+		}
+		if !filepath.IsAbs(pth) {
+			pth = filepath.Join(dir, pth)
+		}
+		group.Path = filepath.Clean(pth)
+		budgets.Groups = append(budgets.Groups, &group)
+	}
+
+	if len(budgets.Groups) == 0 && budgets.Total == 0 {
+		return nil, nil
+	}
+	sort.SliceStable(budgets.Groups, func(i, j int) bool { return len(budgets.Groups[i].Path) > len(budgets.Groups[j].Path) })
+	return budgets, nil
+}
+
+// group returns the innermost group of the target, nil if it is not in any group.
+func (b *pathBudgets) group(target string) *pathGroup {
+	for _, g := range b.Groups {
+		if isUnderPath(target, []string{g.Path}) {
+			return g
+		}
+	}
+	return nil
+}
+
+// admit reports whether the entry of the given size fits the budgets, and accounts it if it does.
+func (b *pathBudgets) admit(target string, size int64) bool {
+	if b.Total > 0 && b.Restored+size > b.Total {
+		b.exceeded = true
+	}
+
+	g := b.group(target)
+	if g == nil {
+		if b.exceeded {
+			b.SkippedEntries++
+			return false
+		}
+		b.Restored += size
+		return true
+	}
+
+	if g.SkippedEntries > 0 || (g.MaxSize > 0 && g.Restored+size > g.MaxSize) || (b.exceeded && g.Priority != budgetPriorityHigh) {
+		g.SkippedEntries++
+		g.SkippedSize += size
+		return false
+	}
+	g.Restored += size
+	b.Restored += size
+	return true
+}
+
+// Truncated reports whether any entry is skipped.
+func (b *pathBudgets) Truncated() bool {
+	return b.SkippedEntries > 0 || len(b.TruncatedGroups()) > 0
+}
+
+// TruncatedGroups returns the groups with skipped entries.
+func (b *pathBudgets) TruncatedGroups() []*pathGroup {
+	var truncated []*pathGroup
+	for _, g := range b.Groups {
+		if g.SkippedEntries > 0 {
+			truncated = append(truncated, g)
+		}
+	}
+	return truncated
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"archive/tar"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParsePathBudgets(t *testing.T) {
+	budgets, err := parsePathBudgets("Pods: high, max 2GB\n/dd: low, max 1.5 mb\nPods/Local: low\n*: max 512KB", "/project")
+	if err != nil {
+		t.Fatalf("parsePathBudgets() error = %s", err)
+	}
+	if budgets.Total != 512*1024 {
+		t.Errorf("parsePathBudgets() Total = %d, want %d", budgets.Total, 512*1024)
+	}
+
+	want := []pathGroup{
+		{Path: "/project/Pods/Local", Priority: budgetPriorityLow},
+		{Path: "/project/Pods", Priority: budgetPriorityHigh, MaxSize: 2 * 1024 * 1024 * 1024},
+		{Path: "/dd", Priority: budgetPriorityLow, MaxSize: 1.5 * 1024 * 1024},
+	}
+	if len(budgets.Groups) != len(want) {
+		t.Fatalf("parsePathBudgets() = %d groups, want %d", len(budgets.Groups), len(want))
+	}
+	for i, g := range budgets.Groups {
+		if *g != want[i] {
+			t.Errorf("parsePathBudgets() group %d = %+v, want %+v", i, *g, want[i])
+		}
+	}
+
+	if budgets, err := parsePathBudgets("\n", "/project"); err != nil || budgets != nil {
+		t.Errorf("parsePathBudgets(empty) = %v, %v, want nil", budgets, err)
+	}
+	for _, s := range []string{"Pods", "Pods: max 2GB", "Pods: urgent", "Pods: high, max 2 apples", "*: high, max 1GB"} {
+		if _, err := parsePathBudgets(s, "/project"); err == nil {
+			t.Errorf("parsePathBudgets(%s) error = nil, want error", s)
+		}
+	}
+}
+
+func TestPathBudgetsAdmit(t *testing.T) {
+	budgets := &pathBudgets{
+		Groups: []*pathGroup{
+			{Path: "/pods", Priority: budgetPriorityHigh, MaxSize: 30},
+			{Path: "/dd", Priority: budgetPriorityLow},
+		},
+		Total: 50,
+	}
+	entries := []struct {
+		target string
+		size   int64
+		want   bool
+	}{
+		{target: "/pods/a", size: 20, want: true},
+		{target: "/dd/a", size: 10, want: true},
+		// over the group's budget, the rest of the group is skipped
+		{target: "/pods/b", size: 20, want: false},
+		{target: "/pods/c", size: 5, want: false},
+		{target: "/other", size: 10, want: true},
+		// over the total, only the high priority groups are restored further
+		{target: "/dd/b", size: 20, want: false},
+		{target: "/dd/c", size: 1, want: false},
+		{target: "/other2", size: 1, want: false},
+	}
+	for _, e := range entries {
+		if got := budgets.admit(e.target, e.size); got != e.want {
+			t.Errorf("admit(%s, %d) = %v, want %v", e.target, e.size, got, e.want)
+		}
+	}
+
+	truncated := budgets.TruncatedGroups()
+	if len(truncated) != 2 || truncated[0].SkippedEntries != 2 || truncated[1].SkippedSize != 21 {
+		t.Errorf("TruncatedGroups() = %+v, want both groups", truncated)
+	}
+	if budgets.SkippedEntries != 1 || !budgets.Truncated() {
+		t.Errorf("SkippedEntries = %d, want 1", budgets.SkippedEntries)
+	}
+}
+
+func TestExtractWithBudgets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "budget-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Logf("failed to remove temp dir: %s", err)
+		}
+	}()
+
+	archive := createTestArchive(t, []testEntry{
+		{name: "Pods/a", content: "0123456789"},
+		{name: "DerivedData/a", content: "0123456789"},
+		{name: "DerivedData/b", content: "0123456789"},
+		{name: "DerivedData/link", typeflag: tar.TypeLink, linkname: "DerivedData/b"},
+	})
+
+	extractor := NewExtractor(dir, true)
+	extractor.Budgets = &pathBudgets{Groups: []*pathGroup{
+		{Path: filepath.Join(dir, "DerivedData"), Priority: budgetPriorityLow, MaxSize: 15},
+	}}
+	if err := extractor.Extract(archive); err != nil {
+		t.Fatalf("Extract() error = %s", err)
+	}
+
+	for name, want := range map[string]bool{"Pods/a": true, "DerivedData/a": true, "DerivedData/b": false, "DerivedData/link": false} {
+		_, err := os.Lstat(filepath.Join(dir, name))
+		if got := err == nil; got != want {
+			t.Errorf("%s restored = %v, want %v", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// blobIndex describes an archive downloaded earlier in the build.
+type blobIndex struct {
+	CacheURL   string   `json:"cache_url"`
+	CacheKey   string   `json:"cache_key,omitempty"`
+	Compressed bool     `json:"compressed"`
+	Size       int64    `json:"size"`
+	Entries    []string `json:"entries"`
+}
+
+// restoresAny reports whether any entry of the archive is restored with the filter,
+// dir and relative are the Extractor's settings.
+func (i blobIndex) restoresAny(filter pathFilter, dir string, relative bool) bool {
+	e := NewExtractor(dir, relative)
+	for _, entry := range i.Entries {
+		if !filter.excludes(e.targetPath(entry)) {
+			return true
+		}
+	}
+	return false
+}
+
+// BuildBlobCache keeps the downloaded archive (and its index) for the later pulls of the same build,
+// e.g. when several steps restore different paths of the same cache (skip_on_change).
+// Each project_path has its own archive, as the subprojects have their own cache.
+type BuildBlobCache struct {
+	Dir string
+	ID  string
+}
+
+// NewBuildBlobCache creates a new BuildBlobCache for the build, the archive is identified by the given values
+// (e.g. the cache API URL and the keys).
+func NewBuildBlobCache(buildSlug string, identity ...string) *BuildBlobCache {
+	sum := sha256.Sum256([]byte(strings.Join(identity, "\n")))
+	return &BuildBlobCache{
+		Dir: filepath.Join(blobCacheRoot(), buildSlug),
+		ID:  hex.EncodeToString(sum[:16]),
+	}
+}
+
+// blobCacheRoot is the directory of the builds' BuildBlobCaches, in the tenant's temporary directory.
+func blobCacheRoot() string {
+	return filepath.Join(stepTempDir, "blobs")
+}
+
+// BlobPath is the path of the kept archive.
+func (c *BuildBlobCache) BlobPath() string {
+	return filepath.Join(c.Dir, c.ID+".blob")
+}
+
+func (c *BuildBlobCache) indexPath() string {
+	return filepath.Join(c.Dir, c.ID+".index.json")
+}
+
+// Load returns the index of the archive downloaded earlier in the build, nil if there is none.
+func (c *BuildBlobCache) Load() (*blobIndex, error) {
+	b, err := ioutil.ReadFile(c.indexPath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var index blobIndex
+	if err := json.Unmarshal(b, &index); err != nil {
+		return nil, fmt.Errorf("failed to parse archive index: %s", err)
+	}
+
+	if info, err := os.Stat(c.BlobPath()); err != nil || info.Size() != index.Size {
+		log.Debugf("kept archive is missing or incomplete, ignoring it")
+		return nil, nil
+	}
+	return &index, nil
+}
+
+// Create creates the temporary file the downloaded archive is written to, see Store.
+func (c *BuildBlobCache) Create() (*os.File, error) {
+	if err := os.MkdirAll(c.Dir, 0700); err != nil {
+		return nil, err
+	}
+	return ioutil.TempFile(c.Dir, c.ID+".blob-")
+}
+
+// Store keeps the written archive and its index.
+func (c *BuildBlobCache) Store(f *os.File, index blobIndex) error {
+	if err := f.Close(); err != nil {
+		return err
+	}
+	info, err := os.Stat(f.Name())
+	if err != nil {
+		return err
+	}
+	index.Size = info.Size()
+
+	if err := os.Rename(f.Name(), c.BlobPath()); err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(c.indexPath(), b, 0600)
+}
+
+// Discard removes the written archive.
+func (c *BuildBlobCache) Discard(f *os.File) {
+	if err := f.Close(); err != nil {
+		log.Debugf("Failed to close %s: %s", f.Name(), err)
+	}
+	if err := os.Remove(f.Name()); err != nil {
+		log.Warnf("Failed to remove %s: %s", f.Name(), err)
+	}
+}
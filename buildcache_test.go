@@ -0,0 +1,100 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestBuildBlobCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "buildcache-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Logf("failed to remove temp dir: %s", err)
+		}
+	}()
+
+	c := NewBuildBlobCache("slug", "https://cache.example.com", "key")
+	c.Dir = dir
+	if other := NewBuildBlobCache("slug", "https://cache.example.com", "other-key"); other.ID == c.ID {
+		t.Errorf("NewBuildBlobCache() ID = %s for different caches", c.ID)
+	}
+
+	if index, err := c.Load(); err != nil || index != nil {
+		t.Fatalf("BuildBlobCache.Load() = %v, %v, want nil, nil", index, err)
+	}
+
+	t.Log("discarded archive")
+	{
+		f, err := c.Create()
+		if err != nil {
+			t.Fatalf("BuildBlobCache.Create() error = %v", err)
+		}
+		c.Discard(f)
+		if _, err := os.Stat(f.Name()); !os.IsNotExist(err) {
+			t.Errorf("discarded archive exists: %v", err)
+		}
+	}
+
+	t.Log("stored archive")
+	{
+		f, err := c.Create()
+		if err != nil {
+			t.Fatalf("BuildBlobCache.Create() error = %v", err)
+		}
+		if _, err := io.Copy(f, createTestArchive(t, []testEntry{{name: "/cache/file", content: "content"}})); err != nil {
+			t.Fatalf("failed to write archive: %s", err)
+		}
+
+		want := blobIndex{CacheURL: "https://cache.example.com", CacheKey: "key", Entries: []string{"/cache/file"}}
+		if err := c.Store(f, want); err != nil {
+			t.Fatalf("BuildBlobCache.Store() error = %v", err)
+		}
+
+		got, err := c.Load()
+		if err != nil || got == nil {
+			t.Fatalf("BuildBlobCache.Load() = %v, %v, want index", got, err)
+		}
+		want.Size = got.Size
+		if got.Size == 0 || !reflect.DeepEqual(*got, want) {
+			t.Errorf("BuildBlobCache.Load() = %+v, want %+v", *got, want)
+		}
+	}
+
+	t.Log("incomplete archive")
+	{
+		if err := ioutil.WriteFile(c.BlobPath(), []byte("partial"), 0600); err != nil {
+			t.Fatalf("failed to write archive: %s", err)
+		}
+		if index, err := c.Load(); err != nil || index != nil {
+			t.Errorf("BuildBlobCache.Load() = %v, %v, want nil, nil", index, err)
+		}
+	}
+}
+
+func TestBlobIndex_restoresAny(t *testing.T) {
+	index := blobIndex{Entries: []string{"/cache/apps/ios/Pods/", "/cache/apps/ios/Pods/file", "/cache/apps/android/build"}}
+
+	tests := []struct {
+		name   string
+		filter pathFilter
+		want   bool
+	}{
+		{name: "no filter", want: true},
+		{name: "only matching", filter: pathFilter{Only: []string{"/cache/apps/ios"}}, want: true},
+		{name: "only not matching", filter: pathFilter{Only: []string{"/cache/apps/web"}}, want: false},
+		{name: "everything skipped", filter: pathFilter{Skip: []string{"/cache/apps"}}, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := index.restoresAny(tt.filter, "/", false); got != tt.want {
+				t.Errorf("blobIndex.restoresAny() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
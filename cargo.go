@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/bitrise-io/go-utils/command"
+)
+
+// rustcInfoFileName is cargo's cache of the rustc outputs in the target directory, with the toolchain's version.
+const rustcInfoFileName = ".rustc_info.json"
+
+// cargoCompiledDirs are the directories of a target profile (e.g. target/debug, target/<triple>/release)
+// compiled by the toolchain, useless to another toolchain.
+var cargoCompiledDirs = []string{".fingerprint", "deps", "build", "incremental"}
+
+// currentRustcVersion returns the rustc version of the toolchain, e.g. "rustc 1.75.0 (82e1608df 2023-12-21)".
+func currentRustcVersion(dir string) (string, error) {
+	out, err := command.New("rustc", "-V").SetDir(dir).RunAndReturnTrimmedCombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("rustc -V failed: %s", out)
+	}
+	return out, nil
+}
+
+// readTargetRustcVersion returns the rustc version the target directory was compiled with, from its .rustc_info.json,
+// empty if it is unknown.
+func readTargetRustcVersion(targetDir string) (string, error) {
+	content, err := ioutil.ReadFile(filepath.Join(targetDir, rustcInfoFileName))
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	var info struct {
+		Outputs map[string]struct {
+			Stdout string `json:"stdout"`
+		} `json:"outputs"`
+	}
+	if err := json.Unmarshal(content, &info); err != nil {
+		return "", fmt.Errorf("invalid %s: %s", rustcInfoFileName, err)
+	}
+	for _, output := range info.Outputs {
+		// the output of rustc -vV
+		if strings.HasPrefix(output.Stdout, "rustc ") && strings.Contains(output.Stdout, "\nbinary: rustc") {
+			return strings.SplitN(output.Stdout, "\n", 2)[0], nil
+		}
+	}
+	return "", nil
+}
+
+// isCargoCompiledPath reports whether the path is compiled by the toolchain in the target directory:
+// the rustc info, or under a compiled directory of a host (target/<profile>) or cross (target/<triple>/<profile>) profile.
+func isCargoCompiledPath(pth, targetDir string) bool {
+	rel, err := filepath.Rel(targetDir, pth)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return false
+	}
+	if rel == rustcInfoFileName {
+		return true
+	}
+	parts := strings.Split(rel, string(filepath.Separator))
+	for _, i := range []int{1, 2} {
+		if len(parts) > i && isCargoCompiledDir(parts[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+func isCargoCompiledDir(name string) bool {
+	for _, dir := range cargoCompiledDirs {
+		if name == dir {
+			return true
+		}
+	}
+	return false
+}
+
+// pruneCargoTarget removes the compiled directories of the target directory's profiles, found by their .fingerprint
+// directory, and the rustc info. The rest (e.g. the docs) is kept. It returns the removed paths.
+func pruneCargoTarget(targetDir string) ([]string, error) {
+	var profiles []string
+	for _, pattern := range []string{filepath.Join("*", ".fingerprint"), filepath.Join("*", "*", ".fingerprint")} {
+		matches, err := filepath.Glob(filepath.Join(targetDir, pattern))
+		if err != nil {
+			return nil, err
+		}
+		for _, match := range matches {
+			profiles = append(profiles, filepath.Dir(match))
+		}
+	}
+
+	var pruned []string
+	for _, profile := range profiles {
+		for _, name := range cargoCompiledDirs {
+			pth := filepath.Join(profile, name)
+			if _, err := os.Lstat(pth); err != nil {
+				continue
+			}
+			if err := os.RemoveAll(pth); err != nil {
+				return pruned, err
+			}
+			pruned = append(pruned, pth)
+		}
+	}
+	if err := os.Remove(filepath.Join(targetDir, rustcInfoFileName)); err != nil && !os.IsNotExist(err) {
+		return pruned, err
+	}
+	return pruned, nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIsCargoCompiledPath(t *testing.T) {
+	target := filepath.FromSlash("/project/target")
+	tests := []struct {
+		pth  string
+		want bool
+	}{
+		{pth: "/project/target/.rustc_info.json", want: true},
+		{pth: "/project/target/debug/deps/libserde-abc.rlib", want: true},
+		{pth: "/project/target/debug/.fingerprint/serde-abc", want: true},
+		{pth: "/project/target/aarch64-apple-ios/release/incremental/app-1", want: true},
+		{pth: "/project/target/debug/app", want: false},
+		{pth: "/project/target/doc/serde/index.html", want: false},
+		{pth: "/project/target", want: false},
+		{pth: "/project/src/build/main.rs", want: false},
+	}
+	for _, tt := range tests {
+		if got := isCargoCompiledPath(filepath.FromSlash(tt.pth), target); got != tt.want {
+			t.Errorf("isCargoCompiledPath(%s) = %v, want %v", tt.pth, got, tt.want)
+		}
+	}
+}
+
+func TestPruneCargoTarget(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cargo-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Logf("failed to remove temp dir: %s", err)
+		}
+	}()
+
+	rustcInfo := `{"rustc_fingerprint": 1, "outputs": {"123": {"success": true, "status": "", "code": 0, "stdout": "rustc 1.74.0 (79e9716c9 2023-11-13)\nbinary: rustc\nrelease: 1.74.0\n", "stderr": ""}}}`
+	writeTestFiles(t, map[string]string{
+		filepath.Join(dir, rustcInfoFileName):                                   rustcInfo,
+		filepath.Join(dir, "debug", ".fingerprint", "serde-abc", "lib-serde"):   "",
+		filepath.Join(dir, "debug", "deps", "libserde-abc.rlib"):                "",
+		filepath.Join(dir, "aarch64-apple-ios", "release", ".fingerprint", "a"): "",
+		filepath.Join(dir, "doc", "index.html"):                                 "",
+	})
+
+	version, err := readTargetRustcVersion(dir)
+	if err != nil || version != "rustc 1.74.0 (79e9716c9 2023-11-13)" {
+		t.Errorf("readTargetRustcVersion() = %s, %v, want rustc 1.74.0", version, err)
+	}
+
+	pruned, err := pruneCargoTarget(dir)
+	if err != nil {
+		t.Fatalf("pruneCargoTarget() error = %s", err)
+	}
+	if len(pruned) != 3 {
+		t.Errorf("pruneCargoTarget() = %v, want 3 directories", pruned)
+	}
+	for _, pth := range []string{rustcInfoFileName, filepath.Join("debug", "deps")} {
+		if _, err := os.Stat(filepath.Join(dir, pth)); !os.IsNotExist(err) {
+			t.Errorf("%s exists after pruneCargoTarget()", pth)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "doc", "index.html")); err != nil {
+		t.Errorf("docs removed: %s", err)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/bitrise-io/go-utils/command"
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// changeRule skips restoring the cache path if any of the files changed in the commit matches the patterns.
+type changeRule struct {
+	Patterns []string
+	Path     string
+}
+
+// parseChangeRules parses the newline separated rules, each in the
+// `<pattern>[,<pattern>...]: <cache path>` format (e.g. `Podfile, Podfile.lock: ios/Pods`).
+// The relative cache paths are relative to the given directory.
+func parseChangeRules(s, dir string) ([]changeRule, error) {
+	var rules []changeRule
+	for _, line := range strings.Split(s, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		i := strings.LastIndex(line, ":")
+		if i == -1 {
+			return nil, fmt.Errorf("invalid rule (%s): missing ':' between the patterns and the cache path", line)
+		}
+
+		pth := strings.TrimSpace(line[i+1:])
+		if pth == "" {
+			return nil, fmt.Errorf("invalid rule (%s): empty cache path", line)
+		}
+		if !filepath.IsAbs(pth) {
+			pth = filepath.Join(dir, pth)
+		}
+
+		rule := changeRule{Path: filepath.Clean(pth)}
+		for _, pattern := range strings.Split(line[:i], ",") {
+			pattern = strings.TrimSpace(pattern)
+			if pattern == "" {
+				continue
+			}
+			if _, err := filepath.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("invalid pattern (%s) in rule (%s): %s", pattern, line, err)
+			}
+			rule.Patterns = append(rule.Patterns, pattern)
+		}
+		if len(rule.Patterns) == 0 {
+			return nil, fmt.Errorf("invalid rule (%s): no pattern", line)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// matchChangedFile reports whether the changed file (relative to the repository root) matches the pattern.
+// Patterns without a path separator match the file name in any directory (Podfile matches ios/Podfile).
+func matchChangedFile(pattern, file string) bool {
+	if !strings.Contains(pattern, "/") {
+		file = filepath.Base(file)
+	}
+	match, err := filepath.Match(pattern, file)
+	return err == nil && match
+}
+
+// skippedPaths returns the cache paths to skip, because of the changed files.
+func skippedPaths(rules []changeRule, changed []string) []string {
+	var paths []string
+	for _, rule := range rules {
+	files:
+		for _, file := range changed {
+			for _, pattern := range rule.Patterns {
+				if matchChangedFile(pattern, file) {
+					log.Printf("%s changed (%s), skipping restore of %s", file, pattern, rule.Path)
+					paths = append(paths, rule.Path)
+					break files
+				}
+			}
+		}
+	}
+	return paths
+}
+
+// changedFiles lists the files changed in the current (HEAD) commit of the git repository at the given directory.
+func changedFiles(dir string) ([]string, error) {
+	cmd := command.New("git", "diff-tree", "--no-commit-id", "--name-only", "-r", "--root", "HEAD")
+	cmd.SetDir(dir)
+	out, err := cmd.RunAndReturnTrimmedCombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("%s failed: %s: %s", cmd.PrintableCommandArgs(), err, out)
+	}
+	if out == "" {
+		return nil, nil
+	}
+	return strings.Split(out, "\n"), nil
+}
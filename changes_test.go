@@ -0,0 +1,88 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseChangeRules(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    []changeRule
+		wantErr bool
+	}{
+		{
+			name:  "rules",
+			input: "Podfile, Podfile.lock: ios/Pods\n\n# comment\npackage.json:/abs/node_modules",
+			want: []changeRule{
+				{Patterns: []string{"Podfile", "Podfile.lock"}, Path: "/src/ios/Pods"},
+				{Patterns: []string{"package.json"}, Path: "/abs/node_modules"},
+			},
+		},
+		{name: "missing path", input: "Podfile", wantErr: true},
+		{name: "missing pattern", input: ": ios/Pods", wantErr: true},
+		{name: "invalid pattern", input: "[: ios/Pods", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseChangeRules(tt.input, "/src")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseChangeRules() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseChangeRules() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSkippedPaths(t *testing.T) {
+	rules := []changeRule{
+		{Patterns: []string{"Podfile", "Podfile.lock"}, Path: "/src/ios/Pods"},
+		{Patterns: []string{"android/*.gradle"}, Path: "/src/android/.gradle"},
+		{Patterns: []string{"package.json"}, Path: "/src/node_modules"},
+	}
+	changed := []string{"ios/Podfile.lock", "android/app/build.gradle", "README.md"}
+
+	want := []string{"/src/ios/Pods"}
+	if got := skippedPaths(rules, changed); !reflect.DeepEqual(got, want) {
+		t.Errorf("skippedPaths() = %v, want %v", got, want)
+	}
+}
+
+func TestExtractor_Extract_skipPaths(t *testing.T) {
+	dir, err := ioutil.TempDir("", "extract-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Logf("failed to remove temp dir: %s", err)
+		}
+	}()
+
+	entries := []testEntry{
+		{name: "ios/Pods/Manifest.lock", content: "pods"},
+		{name: "ios/Podsfile", content: "not skipped"},
+		{name: "node_modules/pkg/index.js", content: "index"},
+	}
+
+	e := NewExtractor(dir, true)
+	e.Filter = pathFilter{Skip: []string{filepath.Join(dir, "ios/Pods")}}
+	if err := e.Extract(createTestArchive(t, entries)); err != nil {
+		t.Fatalf("Extractor.Extract() error = %v", err)
+	}
+	if e.SkippedEntries != 1 {
+		t.Errorf("Extractor.SkippedEntries = %d, want 1", e.SkippedEntries)
+	}
+
+	for name, wantExists := range map[string]bool{"ios/Pods/Manifest.lock": false, "ios/Podsfile": true, "node_modules/pkg/index.js": true} {
+		if _, err := os.Stat(filepath.Join(dir, name)); (err == nil) != wantExists {
+			t.Errorf("%s exists = %v, want %v", name, err == nil, wantExists)
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// checkpointRetries is the number of times a corrupted byte range of the archive is downloaded again.
+const checkpointRetries = 3
+
+// maxCheckpointInterval is the largest checkpoint interval verified, a range is buffered in memory until it matches
+// its checkpoint. The archives with larger intervals are downloaded without verifying their checkpoints.
+const maxCheckpointInterval = 64 * 1024 * 1024
+
+// archiveCheckpoints are the checksums of the archive's consecutive byte ranges, reported by the cache API.
+type archiveCheckpoints struct {
+	// Interval is the size of the byte ranges, the last range is the rest of the archive.
+	Interval int64 `json:"interval"`
+	// SHA256 are the ranges' checksums, in order.
+	SHA256 []string `json:"sha256"`
+}
+
+// valid reports whether the checkpoints can be verified: the interval is positive and not larger than maxCheckpointInterval.
+func (c *archiveCheckpoints) valid() bool {
+	return c != nil && c.Interval > 0 && c.Interval <= maxCheckpointInterval && len(c.SHA256) > 0
+}
+
+// checkpointReader reads a remote archive range by range, a range is read only once it matches its checkpoint.
+// A corrupted (or interrupted) range is downloaded again with a ranged request, instead of the whole archive.
+type checkpointReader struct {
+	uri         string
+	checkpoints archiveCheckpoints
+
+	// body is the archive's stream at the next range, nil if it has to be reopened.
+	body    io.ReadCloser
+	next    int
+	block   []byte
+	pending []byte
+	// Refetched counts the ranges downloaded again.
+	Refetched int
+}
+
+// openCheckpointedDownload starts the download of the archive, verified at its checkpoints.
+func openCheckpointedDownload(uri string, checkpoints archiveCheckpoints) (*checkpointReader, error) {
+	body, err := openArchiveRange(uri, 0, -1)
+	if err != nil {
+		return nil, err
+	}
+	return &checkpointReader{uri: uri, checkpoints: checkpoints, body: body, block: make([]byte, checkpoints.Interval)}, nil
+}
+
+// openArchiveRange requests the archive's bytes from start to end (inclusive), to its end if end is negative.
+// The response is not content encoded, the checkpoints are the checksums of the archive's bytes.
+func openArchiveRange(uri string, start, end int64) (io.ReadCloser, error) {
+	req, err := http.NewRequest("GET", uri, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %s", err)
+	}
+	req.Header.Set("Accept-Encoding", "identity")
+
+	want := http.StatusOK
+	if start > 0 || end >= 0 {
+		want = http.StatusPartialContent
+		if end >= 0 {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+		} else {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", start))
+		}
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != want {
+		closeBody(resp)
+		return nil, fmt.Errorf("non success response code: %d", resp.StatusCode)
+	}
+	if !isIdentityEncoding(resp.Header.Get("Content-Encoding")) {
+		closeBody(resp)
+		return nil, fmt.Errorf("content encoded response (%s)", resp.Header.Get("Content-Encoding"))
+	}
+	return resp.Body, nil
+}
+
+// Read implements the io.Reader interface.
+func (r *checkpointReader) Read(p []byte) (int, error) {
+	for len(r.pending) == 0 {
+		if r.next == len(r.checkpoints.SHA256) {
+			return 0, io.EOF
+		}
+		if err := r.readRange(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+// readRange reads the next range from the stream, and downloads it again until it matches its checkpoint.
+func (r *checkpointReader) readRange() error {
+	start := int64(r.next) * r.checkpoints.Interval
+	last := r.next == len(r.checkpoints.SHA256)-1
+
+	block, err := r.readStream(last)
+	if err == nil {
+		err = r.verify(block)
+	}
+	for attempt := 0; err != nil && attempt < checkpointRetries; attempt++ {
+		if attempt == 0 {
+			r.Refetched++
+		}
+		log.Warnf("The archive's range at %s is corrupted, downloading it again: %s", formatBytes(start), err)
+
+		end := start + r.checkpoints.Interval - 1
+		if last {
+			end = -1
+		}
+		if block, err = r.fetch(start, end, last); err == nil {
+			err = r.verify(block)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("the archive's range at %s is corrupted: %s", formatBytes(start), err)
+	}
+
+	r.pending = block
+	r.next++
+	return nil
+}
+
+// readStream reads the next range from the archive's stream, the stream is reopened at the range, if it was interrupted.
+func (r *checkpointReader) readStream(last bool) ([]byte, error) {
+	if r.body == nil {
+		body, err := openArchiveRange(r.uri, int64(r.next)*r.checkpoints.Interval, -1)
+		if err != nil {
+			return nil, err
+		}
+		r.body = body
+	}
+
+	block, err := r.readBlock(r.body, last)
+	if err != nil {
+		// the rest of the stream is not read after a failure
+		r.closeStream()
+	}
+	return block, err
+}
+
+// fetch downloads the range with a ranged request.
+func (r *checkpointReader) fetch(start, end int64, last bool) ([]byte, error) {
+	body, err := openArchiveRange(r.uri, start, end)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := body.Close(); err != nil {
+			log.Warnf("Failed to close response body: %s", err)
+		}
+	}()
+	return r.readBlock(body, last)
+}
+
+// readBlock reads a range into the block buffer, only the last range can be shorter than the interval.
+func (r *checkpointReader) readBlock(src io.Reader, last bool) ([]byte, error) {
+	n, err := io.ReadFull(src, r.block)
+	if last && (err == io.EOF || err == io.ErrUnexpectedEOF) {
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return r.block[:n], nil
+}
+
+func (r *checkpointReader) verify(block []byte) error {
+	sum := sha256.Sum256(block)
+	if got, want := hex.EncodeToString(sum[:]), r.checkpoints.SHA256[r.next]; !strings.EqualFold(got, want) {
+		return fmt.Errorf("checksum mismatch: %s, expected %s", got, want)
+	}
+	return nil
+}
+
+func (r *checkpointReader) closeStream() {
+	if r.body == nil {
+		return
+	}
+	if err := r.body.Close(); err != nil {
+		log.Warnf("Failed to close response body: %s", err)
+	}
+	r.body = nil
+}
+
+// Close implements the io.Closer interface.
+func (r *checkpointReader) Close() error {
+	r.closeStream()
+	return nil
+}
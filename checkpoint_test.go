@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCheckpointReader(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 25)
+	const interval = 100
+
+	var checksums []string
+	for start := 0; start < len(content); start += interval {
+		end := start + interval
+		if end > len(content) {
+			end = len(content)
+		}
+		sum := sha256.Sum256(content[start:end])
+		checksums = append(checksums, hex.EncodeToString(sum[:]))
+	}
+
+	tests := []struct {
+		name string
+		// corrupt is the number of responses served with a corrupted byte at offset 150 (in the second range)
+		corrupt       int
+		wantErr       bool
+		wantRefetched int
+	}{
+		{name: "intact"},
+		{name: "corrupted range downloaded again", corrupt: 1, wantRefetched: 1},
+		{name: "corrupted range", corrupt: checkpointRetries + 1, wantErr: true, wantRefetched: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			corrupt := tt.corrupt
+			var ranges []string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				served := content
+				if corrupt > 0 {
+					corrupt--
+					served = append([]byte{}, content...)
+					served[150] ^= 0xff
+				}
+				ranges = append(ranges, r.Header.Get("Range"))
+				mu.Unlock()
+				http.ServeContent(w, r, "archive", time.Time{}, bytes.NewReader(served))
+			}))
+			defer server.Close()
+
+			r, err := openCheckpointedDownload(server.URL, archiveCheckpoints{Interval: interval, SHA256: checksums})
+			if err != nil {
+				t.Fatalf("openCheckpointedDownload() error = %v", err)
+			}
+			defer func() {
+				if err := r.Close(); err != nil {
+					t.Errorf("Close() error = %v", err)
+				}
+			}()
+
+			got, err := ioutil.ReadAll(r)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Read() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if r.Refetched != tt.wantRefetched {
+				t.Errorf("Refetched = %d, want %d", r.Refetched, tt.wantRefetched)
+			}
+			if tt.wantErr {
+				if len(got) != interval {
+					t.Errorf("read %d Bytes before the corrupted range, want %d", len(got), interval)
+				}
+				return
+			}
+			if !bytes.Equal(got, content) {
+				t.Errorf("Read() = %q, want %q", got, content)
+			}
+			if tt.wantRefetched > 0 && ranges[1] != "bytes=100-199" {
+				t.Errorf("refetched range = %q, want bytes=100-199", ranges[1])
+			}
+		})
+	}
+}
+
+func TestArchiveCheckpoints_valid(t *testing.T) {
+	checksums := []string{"e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"}
+
+	tests := []struct {
+		name        string
+		checkpoints *archiveCheckpoints
+		want        bool
+	}{
+		{name: "valid", checkpoints: &archiveCheckpoints{Interval: 8 * 1024 * 1024, SHA256: checksums}, want: true},
+		{name: "largest interval", checkpoints: &archiveCheckpoints{Interval: maxCheckpointInterval, SHA256: checksums}, want: true},
+		{name: "not reported"},
+		{name: "no interval", checkpoints: &archiveCheckpoints{SHA256: checksums}},
+		{name: "negative interval", checkpoints: &archiveCheckpoints{Interval: -1, SHA256: checksums}},
+		{name: "interval too large", checkpoints: &archiveCheckpoints{Interval: maxCheckpointInterval + 1, SHA256: checksums}},
+		{name: "huge interval", checkpoints: &archiveCheckpoints{Interval: 1 << 62, SHA256: checksums}},
+		{name: "no checksums", checkpoints: &archiveCheckpoints{Interval: 8 * 1024 * 1024}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.checkpoints.valid(); got != tt.want {
+				t.Errorf("valid() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
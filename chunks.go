@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// archiveChunk is a byte range of the archive with its expected checksum.
+type archiveChunk struct {
+	Offset int64  `json:"offset"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// NewChunksReader downloads the chunks of the archive from the mirrors in parallel and reads them in order.
+// The chunks are distributed across the mirrors, a chunk failing on one mirror is retried on the next one.
+func NewChunksReader(mirrors []string, chunks []archiveChunk) *PartsReader {
+	return newPartsReader(len(chunks), func(ctx context.Context, i int) (string, error) {
+		return downloadChunk(ctx, mirrors, chunks[i], i)
+	})
+}
+
+func downloadChunk(ctx context.Context, mirrors []string, chunk archiveChunk, index int) (string, error) {
+	var errs []string
+	for attempt := 0; attempt < len(mirrors); attempt++ {
+		mirror := mirrors[(index+attempt)%len(mirrors)]
+
+		pth, err := downloadRange(ctx, mirror, chunk, index)
+		if err == nil {
+			return pth, nil
+		}
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+
+		log.Debugf("Failed to download chunk (%d) from mirror (%d): %s", index, (index+attempt)%len(mirrors), err)
+		errs = append(errs, err.Error())
+	}
+	return "", fmt.Errorf("failed to download chunk from every mirror: %s", strings.Join(errs, "; "))
+}
+
+// downloadRange downloads the chunk's byte range into a temporary file and verifies its checksum.
+func downloadRange(ctx context.Context, uri string, chunk archiveChunk, index int) (string, error) {
+	req, err := http.NewRequest("GET", uri, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to create request: %s", err)
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", chunk.Offset, chunk.Offset+chunk.Size-1))
+
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			log.Warnf("Failed to close response body: %s", err)
+		}
+	}()
+
+	if resp.StatusCode != http.StatusPartialContent {
+		return "", fmt.Errorf("non partial content response code: %d", resp.StatusCode)
+	}
+
+	h := sha256.New()
+	pth, n, err := writeTempPart(io.TeeReader(io.LimitReader(resp.Body, chunk.Size), h), index)
+	if err != nil {
+		return "", err
+	}
+
+	if n != chunk.Size {
+		removePart(pth)
+		return "", fmt.Errorf("chunk size mismatch: %d Bytes received, %d expected", n, chunk.Size)
+	}
+	if sum := hex.EncodeToString(h.Sum(nil)); chunk.SHA256 != "" && !strings.EqualFold(sum, chunk.SHA256) {
+		removePart(pth)
+		return "", fmt.Errorf("chunk checksum mismatch: %s, expected %s", sum, chunk.SHA256)
+	}
+
+	return pth, nil
+}
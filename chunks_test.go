@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestNewChunksReader(t *testing.T) {
+	content := []byte("0123456789abcdefghij")
+
+	good := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "archive", time.Time{}, bytes.NewReader(content))
+	}))
+	defer good.Close()
+
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer broken.Close()
+
+	chunk := func(offset, size int64) archiveChunk {
+		sum := sha256.Sum256(content[offset : offset+size])
+		return archiveChunk{Offset: offset, Size: size, SHA256: hex.EncodeToString(sum[:])}
+	}
+
+	t.Log("chunks are retried on the next mirror")
+	{
+		chunks := []archiveChunk{chunk(0, 8), chunk(8, 8), chunk(16, 4)}
+		r := NewChunksReader([]string{broken.URL, good.URL}, chunks)
+
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatalf("ChunksReader.Read() error = %v", err)
+		}
+		if err := r.Close(); err != nil {
+			t.Errorf("ChunksReader.Close() error = %v", err)
+		}
+		if string(b) != string(content) {
+			t.Errorf("ChunksReader content = %s, want %s", b, content)
+		}
+	}
+
+	t.Log("checksum mismatch")
+	{
+		chunks := []archiveChunk{{Offset: 0, Size: 8, SHA256: "invalid"}}
+		r := NewChunksReader([]string{good.URL}, chunks)
+
+		if _, err := ioutil.ReadAll(r); err == nil {
+			t.Errorf("ChunksReader.Read() error = %v, wantErr %v", err, true)
+		}
+		if err := r.Close(); err != nil {
+			t.Errorf("ChunksReader.Close() error = %v", err)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// applyCompatibility resolves the deprecated inputs of the earlier step versions into the current ones,
+// and returns the migration warnings of the inputs which are deprecated, or have no effect with the other inputs.
+//
+// The precedence of the archive URL of the legacy cache API:
+// 1. cache_api_url, if it is set to other than BITRISE_CACHE_API_URL (its default),
+// 2. the deprecated cache_download_url,
+// 3. cache_api_url (BITRISE_CACHE_API_URL).
+func (c *Config) applyCompatibility() []string {
+	var warnings []string
+	warn := func(format string, args ...interface{}) {
+		warnings = append(warnings, fmt.Sprintf(format, args...))
+	}
+
+	customURL := c.CacheAPIURL != "" && c.CacheAPIURL != c.BitriseCacheAPIURL
+	if c.CacheAPI == cacheAPIKeyBased {
+		if customURL || c.CacheDownloadURL != "" {
+			warn("The cache_api_url and the deprecated cache_download_url inputs are only used by the legacy cache API, they have no effect: the cache is restored by the keys")
+		}
+		return warnings
+	}
+
+	switch {
+	case c.CacheDownloadURL == "":
+	case customURL && c.CacheAPIURL != c.CacheDownloadURL:
+		warn("The cache_download_url input is deprecated and ignored, cache_api_url is set: remove cache_download_url")
+	case customURL:
+		warn("The cache_download_url input is deprecated: remove it, cache_api_url is set to the same URL")
+	default:
+		warn("The cache_download_url input is deprecated, it is used as cache_api_url: rename it to cache_api_url")
+		c.CacheAPIURL = c.CacheDownloadURL
+	}
+
+	if strings.TrimSpace(c.Key) != "" {
+		warn("The key input is only used by the key-based cache API, it has no effect: set cache_api to %s to restore by the keys", cacheAPIKeyBased)
+	}
+	return warnings
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestConfig_applyCompatibility(t *testing.T) {
+	const bitriseURL = "https://cache.bitrise.io/api"
+	tests := []struct {
+		name         string
+		conf         Config
+		wantURL      string
+		wantWarnings []string
+	}{
+		{
+			name:    "current inputs",
+			conf:    Config{CacheAPI: cacheAPILegacy, CacheAPIURL: bitriseURL, BitriseCacheAPIURL: bitriseURL},
+			wantURL: bitriseURL,
+		},
+		{
+			name:         "deprecated url with the default cache api url",
+			conf:         Config{CacheAPI: cacheAPILegacy, CacheAPIURL: bitriseURL, BitriseCacheAPIURL: bitriseURL, CacheDownloadURL: "https://example.com/cache.tar.gz"},
+			wantURL:      "https://example.com/cache.tar.gz",
+			wantWarnings: []string{"rename it to cache_api_url"},
+		},
+		{
+			name:         "deprecated url without cache api url",
+			conf:         Config{CacheAPI: cacheAPILegacy, CacheDownloadURL: "https://example.com/cache.tar.gz"},
+			wantURL:      "https://example.com/cache.tar.gz",
+			wantWarnings: []string{"rename it to cache_api_url"},
+		},
+		{
+			name:         "custom cache api url wins",
+			conf:         Config{CacheAPI: cacheAPILegacy, CacheAPIURL: "file:///tmp/cache.tar", BitriseCacheAPIURL: bitriseURL, CacheDownloadURL: "https://example.com/cache.tar.gz"},
+			wantURL:      "file:///tmp/cache.tar",
+			wantWarnings: []string{"deprecated and ignored"},
+		},
+		{
+			name:         "key with the legacy cache api",
+			conf:         Config{CacheAPI: cacheAPILegacy, CacheAPIURL: bitriseURL, BitriseCacheAPIURL: bitriseURL, Key: "npm-{{ .Branch }}"},
+			wantURL:      bitriseURL,
+			wantWarnings: []string{"set cache_api to key_based"},
+		},
+		{
+			name:         "urls with the key-based cache api",
+			conf:         Config{CacheAPI: cacheAPIKeyBased, CacheAPIURL: bitriseURL, BitriseCacheAPIURL: bitriseURL, CacheDownloadURL: "https://example.com/cache.tar.gz", Key: "npm"},
+			wantURL:      bitriseURL,
+			wantWarnings: []string{"only used by the legacy cache API"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := tt.conf
+			warnings := conf.applyCompatibility()
+			if conf.CacheAPIURL != tt.wantURL {
+				t.Errorf("applyCompatibility() CacheAPIURL = %s, want %s", conf.CacheAPIURL, tt.wantURL)
+			}
+			if len(warnings) != len(tt.wantWarnings) {
+				t.Fatalf("applyCompatibility() = %v, want %d warnings", warnings, len(tt.wantWarnings))
+			}
+			for i, want := range tt.wantWarnings {
+				if !strings.Contains(warnings[i], want) {
+					t.Errorf("applyCompatibility() warning = %s, want containing %s", warnings[i], want)
+				}
+			}
+		})
+	}
+}
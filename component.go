@@ -0,0 +1,116 @@
+package main
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"os"
+	"strings"
+
+	"github.com/bitrise-io/go-utils/log"
+	"github.com/bitrise-steplib/steps-cache-pull/pkg/cachepreset"
+)
+
+// componentsEnvKey is the output of the split_components input, the names of the restored archive's components.
+const componentsEnvKey = "BITRISE_CACHE_PULL_COMPONENTS"
+
+// componentOther is the component of the entries not under a detected ecosystem's paths.
+const componentOther = "other"
+
+// componentState is a component of the restored archive, the entries of a detected ecosystem (see cachepreset.Detect).
+// The cache push step can push the changed components as separate archives.
+type componentState struct {
+	Name  string   `json:"name"`
+	Paths []string `json:"paths,omitempty"`
+	// LockfileFingerprint is the fingerprint of the ecosystem's lockfiles, empty if the project has none.
+	LockfileFingerprint string `json:"lockfile_fingerprint,omitempty"`
+	// Fingerprint is the sha256:<hex> of the component's entries (name, type, size and modification time) in the archive's order.
+	Fingerprint string `json:"fingerprint"`
+	Entries     int    `json:"entries"`
+	Size        int64  `json:"size"`
+}
+
+// componentSplitter splits the extracted entries into components, while the archive is extracted.
+type componentSplitter struct {
+	components []componentState
+	hashes     []hash.Hash
+}
+
+// newComponentSplitter creates a componentSplitter of the expansions' components, and the componentOther.
+// An entry under more expansions' paths is the first one's.
+func newComponentSplitter(expansions []cachepreset.Expansion) *componentSplitter {
+	s := &componentSplitter{}
+	for _, x := range expansions {
+		s.components = append(s.components, componentState{Name: x.Preset, Paths: x.AllPaths(), LockfileFingerprint: x.Fingerprint})
+		s.hashes = append(s.hashes, sha256.New())
+	}
+	s.components = append(s.components, componentState{Name: componentOther})
+	s.hashes = append(s.hashes, sha256.New())
+	return s
+}
+
+func (s *componentSplitter) add(target string, hdr *tar.Header) {
+	i := len(s.components) - 1
+	for j, c := range s.components[:i] {
+		if isUnderPath(target, c.Paths) {
+			i = j
+			break
+		}
+	}
+
+	s.components[i].Entries++
+	s.components[i].Size += hdr.Size
+	fmt.Fprintf(s.hashes[i], "%s\x00%c\x00%d\x00%d\n", target, hdr.Typeflag, hdr.Size, hdr.ModTime.Unix())
+}
+
+// Components returns the components with extracted entries.
+func (s *componentSplitter) Components() []componentState {
+	var components []componentState
+	for i, c := range s.components {
+		if c.Entries == 0 {
+			continue
+		}
+		c.Fingerprint = formatChecksum(s.hashes[i])
+		components = append(components, c)
+	}
+	return components
+}
+
+// detectComponents returns the componentSplitter of the ecosystems detected in the working directory.
+// A failure only warns, the archive is not split.
+func detectComponents() *componentSplitter {
+	wd, err := os.Getwd()
+	if err != nil {
+		result.Warnf("Failed to get working directory, the cache archive is not split: %s", err)
+		return nil
+	}
+	env, err := cachepreset.NewEnv(wd)
+	if err != nil {
+		result.Warnf("Failed to get the cache presets' environment, the cache archive is not split: %s", err)
+		return nil
+	}
+
+	var expansions []cachepreset.Expansion
+	var names []string
+	for _, p := range cachepreset.Detect(env) {
+		x, err := p.Expand(env)
+		if err != nil {
+			result.Warnf("Failed to expand the %s cache preset, its paths are not split: %s", p.Name, err)
+			continue
+		}
+		expansions = append(expansions, x)
+		names = append(names, p.Name)
+	}
+	log.Printf("Splitting the cache archive into components: %s", strings.Join(append(names, componentOther), ", "))
+	return newComponentSplitter(expansions)
+}
+
+// exportComponents exports the names of the restored archive's components.
+func exportComponents(components []componentState) error {
+	var names []string
+	for _, c := range components {
+		names = append(names, c.Name)
+	}
+	return exportEnv(componentsEnvKey, strings.Join(names, ","))
+}
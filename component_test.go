@@ -0,0 +1,61 @@
+package main
+
+import (
+	"archive/tar"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/bitrise-steplib/steps-cache-pull/pkg/cachepreset"
+)
+
+func TestComponentSplitter(t *testing.T) {
+	modTime := time.Unix(1700000000, 0)
+	entries := func(s *componentSplitter, targets ...string) {
+		for _, target := range targets {
+			s.add(target, &tar.Header{Typeflag: tar.TypeReg, Size: 10, ModTime: modTime})
+		}
+	}
+
+	s := newComponentSplitter([]cachepreset.Expansion{
+		{Preset: "gradle", Paths: []string{"/home/user/.gradle/caches/modules-2"}, Fingerprint: "sha256:lockfiles"},
+		{Preset: "npm", Paths: []string{"/home/user/.npm"}, ProjectPaths: []string{"/project/node_modules"}},
+		{Preset: "cocoapods", ProjectPaths: []string{"/project/Pods"}},
+	})
+	entries(s, "/home/user/.gradle/caches/modules-2/a.jar", "/project/node_modules/left-pad/index.js", "/home/user/.npm/_cacache/index", "/project/build/out.o")
+
+	var got []string
+	for _, c := range s.Components() {
+		got = append(got, c.Name)
+		if c.Fingerprint == "" {
+			t.Errorf("%s component's fingerprint is empty", c.Name)
+		}
+	}
+	if want := []string{"gradle", "npm", componentOther}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("Components() = %v, want %v", got, want)
+	}
+	npm := s.Components()[1]
+	if npm.Entries != 2 || npm.Size != 20 {
+		t.Errorf("npm component = %d entries, %d Bytes, want 2 entries, 20 Bytes", npm.Entries, npm.Size)
+	}
+	if gradle := s.Components()[0]; gradle.LockfileFingerprint != "sha256:lockfiles" {
+		t.Errorf("gradle component's lockfile fingerprint = %s, want sha256:lockfiles", gradle.LockfileFingerprint)
+	}
+
+	t.Log("the fingerprints change with the component's entries only")
+	{
+		changed := newComponentSplitter([]cachepreset.Expansion{
+			{Preset: "gradle", Paths: []string{"/home/user/.gradle/caches/modules-2"}},
+			{Preset: "npm", Paths: []string{"/home/user/.npm"}, ProjectPaths: []string{"/project/node_modules"}},
+		})
+		entries(changed, "/home/user/.gradle/caches/modules-2/a.jar", "/project/node_modules/left-pad/index.js", "/home/user/.npm/_cacache/index", "/project/build/changed.o")
+
+		before, after := s.Components(), changed.Components()
+		if before[0].Fingerprint != after[0].Fingerprint || before[1].Fingerprint != after[1].Fingerprint {
+			t.Errorf("the unchanged components' fingerprints changed")
+		}
+		if before[2].Fingerprint == after[2].Fingerprint {
+			t.Errorf("the changed component's fingerprint did not change")
+		}
+	}
+}
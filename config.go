@@ -0,0 +1,420 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"github.com/bitrise-io/go-steputils/stepconf"
+	"github.com/bitrise-steplib/steps-cache-pull/pkg/cachepreset"
+)
+
+// Config stores the step inputs.
+type Config struct {
+	CacheAPI              string `env:"cache_api,opt[legacy,key_based]"`
+	CacheAPIURL           string `env:"cache_api_url"`
+	CacheDownloadURL      string `env:"cache_download_url"`
+	Key                   string `env:"key"`
+	DebugMode             bool   `env:"is_debug_mode,opt[true,false]"`
+	LogLevel              string `env:"log_level,opt[error,warn,info,debug,trace]"`
+	Quiet                 bool   `env:"quiet,opt[true,false]"`
+	AllowFallback         bool   `env:"allow_fallback,opt[true,false]"`
+	InvalidateCorrupted   bool   `env:"invalidate_corrupted,opt[true,false]"`
+	ExtractToRelativePath bool   `env:"extract_to_relative_path,opt[true,false]"`
+	CaseCollisionPolicy   string `env:"case_collision_policy,opt[warn,skip,fail,overwrite]"`
+	UnicodeNormalization  string `env:"unicode_normalization,opt[none,auto,nfc,nfd]"`
+	SpecialFilePolicy     string `env:"special_file_policy,opt[restore,skip,fail]"`
+	LazyRestore           bool   `env:"lazy_restore,opt[true,false]"`
+	PermissionErrors      string `env:"permission_errors,opt[warn,fail]"`
+	ExtractionWorkers     int    `env:"extraction_workers"`
+	PipelineBufferMB      int    `env:"pipeline_buffer_mb"`
+	FsyncPolicy           string `env:"fsync_policy,opt[none,per-file,end]"`
+	VerifyOnly            bool   `env:"verify_only,opt[true,false]"`
+	VerifyReportPath      string `env:"verify_report_path"`
+	FailedItemsThreshold  int    `env:"failed_items_threshold"`
+	FailedItemsAction     string `env:"failed_items_action,opt[warn,fail]"`
+	SkipOnChange          string `env:"skip_on_change"`
+	ProjectPath           string `env:"project_path"`
+	PipelineCache         bool   `env:"pipeline_cache,opt[true,false]"`
+	HandoffMode           bool   `env:"handoff_mode,opt[true,false]"`
+	SelectFastestRegion   bool   `env:"select_fastest_region,opt[true,false]"`
+	SkipUnchanged         bool   `env:"skip_unchanged,opt[true,false]"`
+	LocalWarmStart        bool   `env:"local_warm_start,opt[true,false]"`
+	SplitComponents       bool   `env:"split_components,opt[true,false]"`
+	DestinationRoots      string `env:"destination_roots"`
+	Preflight             bool   `env:"preflight,opt[true,false]"`
+	KeepArchive           bool   `env:"keep_archive,opt[true,false]"`
+	KeepArchiveDir        string `env:"keep_archive_dir"`
+	KeepArchiveMaxCount   int    `env:"keep_archive_max_count"`
+	SourceBuild           string `env:"source_build"`
+	PinnedCacheKey        string `env:"pinned_cache_key"`
+	QuarantineFile        string `env:"quarantine_file"`
+	QuarantineURL         string `env:"quarantine_url"`
+	ReuseWithinBuild      bool   `env:"reuse_within_build,opt[true,false]"`
+	BlobCacheMaxAgeHours  int    `env:"blob_cache_max_age_hours"`
+	BlobCacheMaxSizeMB    int    `env:"blob_cache_max_size_mb"`
+
+	RequestHeaders       string          `env:"request_headers"`
+	Downloader           string          `env:"downloader,opt[builtin,auto,aria2c,axel]"`
+	MaxRedirects         int             `env:"max_redirects"`
+	RedirectAllowedHosts string          `env:"redirect_allowed_hosts"`
+	IPVersion            string          `env:"ip_version,opt[auto,ipv4,ipv6]"`
+	DNSServer            string          `env:"dns_server"`
+	HostOverrides        string          `env:"host_overrides"`
+	TLSMinVersion        string          `env:"tls_min_version,opt[1.0,1.1,1.2,1.3]"`
+	TLSCipherSuites      string          `env:"tls_cipher_suites"`
+	TLSClientCert        string          `env:"tls_client_cert"`
+	TLSClientKey         stepconf.Secret `env:"tls_client_key"`
+
+	DownloadAuth       string          `env:"download_auth,opt[none,oauth2,aws_sigv4,google,azure_ad]"`
+	OAuth2TokenURL     string          `env:"oauth2_token_url"`
+	OAuth2ClientID     string          `env:"oauth2_client_id"`
+	OAuth2ClientSecret stepconf.Secret `env:"oauth2_client_secret"`
+	OAuth2Scopes       string          `env:"oauth2_scopes"`
+	AWSAccessKeyID     string          `env:"aws_access_key_id"`
+	AWSSecretAccessKey stepconf.Secret `env:"aws_secret_access_key"`
+	AWSSessionToken    stepconf.Secret `env:"aws_session_token"`
+	AWSRegion          string          `env:"aws_region"`
+
+	GoogleApplicationCredentials string          `env:"google_application_credentials"`
+	AzureTenantID                string          `env:"azure_tenant_id"`
+	AzureClientID                string          `env:"azure_client_id"`
+	AzureClientSecret            stepconf.Secret `env:"azure_client_secret"`
+
+	Offline       bool   `env:"offline,opt[true,false]"`
+	LocalCacheDir string `env:"local_cache_dir"`
+
+	ResultFilePath    string `env:"result_file_path"`
+	ExportJUnitResult bool   `env:"export_junit_result,opt[true,false]"`
+
+	WebhookURL               stepconf.Secret `env:"webhook_url"`
+	DefaultBranch            string          `env:"default_branch"`
+	PullRequestBaseKeys      bool            `env:"pull_request_base_keys,opt[true,false]"`
+	MaxArchiveAgeDays        int             `env:"max_archive_age_days"`
+	MaxArchiveSize           string          `env:"max_archive_size"`
+	SlowRestoreThreshold     int             `env:"slow_restore_threshold"`
+	SendTelemetry            bool            `env:"send_telemetry,opt[true,false]"`
+	StatsFilePath            string          `env:"stats_file_path"`
+	StatsGrowthThreshold     int             `env:"stats_growth_threshold"`
+	RestoreStatePath         string          `env:"restore_state_path"`
+	UsageSnapshotPath        string          `env:"usage_snapshot_path"`
+	OverwriteAuditPath       string          `env:"overwrite_audit_path"`
+	ProgressMode             string          `env:"progress_mode,opt[auto,bar,lines,none]"`
+	ProgressInterval         int             `env:"progress_interval"`
+	TimeBudget               int             `env:"time_budget"`
+	PriorityPaths            string          `env:"priority_paths"`
+	PathBudgets              string          `env:"path_budgets"`
+	ExpandNestedArchives     string          `env:"expand_nested_archives"`
+	ZstdDictionary           string          `env:"zstd_dictionary"`
+	RestoreUmask             string          `env:"restore_umask"`
+	RestoreACL               string          `env:"restore_acl"`
+	RestoreSELinuxLabels     bool            `env:"restore_selinux_labels,opt[true,false]"`
+	VerifyRepositoryCaches   bool            `env:"verify_repository_caches,opt[true,false]"`
+	ValidateDerivedData      bool            `env:"validate_derived_data,opt[true,false]"`
+	DerivedDataPath          string          `env:"derived_data_path"`
+	DerivedDataBuildSettings string          `env:"derived_data_build_settings"`
+	SwiftPackageResolved     string          `env:"swift_package_resolved"`
+	SwiftPackageBuildDir     string          `env:"swift_package_build_dir"`
+	AndroidProjectPath       string          `env:"android_project_path"`
+	CargoTargetDir           string          `env:"cargo_target_dir"`
+	CachePresets             string          `env:"cache_presets"`
+	TmpfsPaths               string          `env:"tmpfs_paths"`
+	TmpfsDir                 string          `env:"tmpfs_dir"`
+	TmpfsMaxSizeMB           int             `env:"tmpfs_max_size_mb"`
+	StateDir                 string          `env:"state_dir"`
+	InstanceName             string          `env:"instance_name"`
+	PartialDownloadsDir      string          `env:"partial_downloads_dir"`
+
+	CircuitBreakerErrors  int `env:"circuit_breaker_errors"`
+	CircuitBreakerTimeout int `env:"circuit_breaker_timeout"`
+
+	HooksDir string `env:"hooks_dir"`
+
+	FatalFailures string `env:"fatal_failures"`
+
+	BitriseCacheAPIURL string `env:"BITRISE_CACHE_API_URL"`
+	StackID            string `env:"BITRISEIO_STACK_ID"`
+	BuildSlug          string `env:"BITRISE_BUILD_SLUG"`
+	AppSlug            string `env:"BITRISE_APP_SLUG"`
+	SourceDir          string `env:"BITRISE_SOURCE_DIR"`
+	Branch             string `env:"BITRISE_GIT_BRANCH"`
+	PullRequestID      string `env:"BITRISE_PULL_REQUEST"`
+	TargetBranch       string `env:"BITRISEIO_GIT_BRANCH_DEST"`
+	PipelineID         string `env:"BITRISEIO_PIPELINE_ID"`
+	Datacenter         string `env:"BITRISE_DEN_VM_DATACENTER"`
+
+	ABCSAPIURL          string          `env:"BITRISEIO_ABCS_API_URL"`
+	ABCSAccessToken     stepconf.Secret `env:"BITRISEIO_ABCS_ACCESS_TOKEN"`
+	ServicesAccessToken stepconf.Secret `env:"BITRISEIO_BITRISE_SERVICES_ACCESS_TOKEN"`
+}
+
+// printable returns a copy of the config, which is safe to print: the signatures and tokens of the URLs are masked.
+func (c Config) printable() Config {
+	c.CacheAPIURL = redactSecrets(c.CacheAPIURL)
+	c.CacheDownloadURL = redactSecrets(c.CacheDownloadURL)
+	c.BitriseCacheAPIURL = redactSecrets(c.BitriseCacheAPIURL)
+	c.ABCSAPIURL = redactSecrets(c.ABCSAPIURL)
+	// the pinned archive, the quarantine list and the dictionary can be presigned URLs
+	c.PinnedCacheKey = redactSecrets(c.PinnedCacheKey)
+	c.QuarantineURL = redactSecrets(c.QuarantineURL)
+	c.ZstdDictionary = redactSecrets(c.ZstdDictionary)
+	c.OAuth2TokenURL = redactSecrets(c.OAuth2TokenURL)
+	// the custom headers can hold credentials (e.g. an API key)
+	c.RequestHeaders = redactRequestHeaders(c.RequestHeaders)
+	return c
+}
+
+// tlsOptions returns the TLS settings of the inputs.
+func (c Config) tlsOptions() tlsOptions {
+	return tlsOptions{
+		MinVersion:   c.TLSMinVersion,
+		CipherSuites: c.TLSCipherSuites,
+		ClientCert:   c.TLSClientCert,
+		ClientKey:    string(c.TLSClientKey),
+	}
+}
+
+// postProcessesRestoredPaths reports whether the restored paths are post-processed (restore_acl, restore_selinux_labels).
+func (c Config) postProcessesRestoredPaths() bool {
+	return c.RestoreACL != "" || c.RestoreSELinuxLabels
+}
+
+// collectsRestoredPaths reports whether the restored paths are needed after the restore (post-processed or in the
+// usage snapshot), so the archive's entries are collected during the extraction.
+func (c Config) collectsRestoredPaths() bool {
+	return c.postProcessesRestoredPaths() || c.UsageSnapshotPath != ""
+}
+
+// validate checks the dependencies between the inputs, which stepconf can not express,
+// and lists every invalid input at once.
+func (c Config) validate() error {
+	var errs []string
+	add := func(field string, format string, args ...interface{}) {
+		errs = append(errs, fmt.Sprintf("- %s: %s", field, fmt.Sprintf(format, args...)))
+	}
+
+	if c.CacheAPI == cacheAPIKeyBased {
+		if keys, err := parseCacheKeys(c.Key); err != nil {
+			add("Key", "%s", err)
+		} else {
+			for _, key := range keys {
+				if _, err := parseKeyTemplate(key, nil); err != nil {
+					add("Key", "invalid key template (%s): %s", key, err)
+				}
+			}
+		}
+		if c.ABCSAPIURL == "" && !c.Offline {
+			add("ABCSAPIURL", "BITRISEIO_ABCS_API_URL is required for the key-based cache API")
+		}
+	}
+
+	if c.SourceBuild != "" {
+		if _, _, err := parseSourceBuild(c.SourceBuild); err != nil {
+			add("SourceBuild", "%s", err)
+		}
+		if c.CacheAPI == cacheAPIKeyBased {
+			add("SourceBuild", "only supported by the legacy cache API")
+		}
+	}
+
+	if c.PinnedCacheKey != "" {
+		switch {
+		case c.Offline:
+			add("PinnedCacheKey", "not supported in offline mode")
+		case !isArchiveURL(c.PinnedCacheKey) && c.CacheAPI != cacheAPIKeyBased:
+			add("PinnedCacheKey", "a cache key requires the key-based cache API, pin an archive URL with the legacy cache API")
+		case !isArchiveURL(c.PinnedCacheKey) && c.ABCSAPIURL == "":
+			add("ABCSAPIURL", "BITRISEIO_ABCS_API_URL is required for the pinned cache key")
+		}
+	}
+
+	if _, err := parsePathBudgets(c.PathBudgets, ""); err != nil {
+		add("PathBudgets", "%s", err)
+	}
+
+	if _, err := parseNestedArchivePatterns(c.ExpandNestedArchives); err != nil {
+		add("ExpandNestedArchives", "%s", err)
+	}
+
+	if _, err := parseUmask(c.RestoreUmask); err != nil {
+		add("RestoreUmask", "%s", err)
+	}
+
+	if _, err := parseMaxArchiveSize(c.MaxArchiveSize); err != nil {
+		add("MaxArchiveSize", "%s", err)
+	}
+
+	if _, err := parseFatalFailures(c.FatalFailures); err != nil {
+		add("FatalFailures", "%s", err)
+	}
+
+	if c.TmpfsPaths != "" && c.TmpfsDir == "" {
+		add("TmpfsDir", "required for the tmpfs paths")
+	}
+
+	if c.ValidateDerivedData && c.DerivedDataPath == "" {
+		add("DerivedDataPath", "required for the DerivedData validation")
+	}
+
+	if c.SwiftPackageResolved != "" && c.SwiftPackageBuildDir == "" {
+		add("SwiftPackageBuildDir", "required for the Swift package restore")
+	}
+
+	if _, err := cachepreset.Parse(c.CachePresets); err != nil {
+		add("CachePresets", "%s", err)
+	}
+
+	if c.SkipUnchanged && c.StateDir == "" {
+		add("SkipUnchanged", "requires the state directory (state_dir)")
+	}
+	if c.InstanceName != "" && unsafeTenantChars.MatchString(c.InstanceName) {
+		add("InstanceName", "only letters, digits, `_` and `-` are allowed (%s)", c.InstanceName)
+	}
+	if c.SplitComponents && c.StateDir == "" {
+		add("SplitComponents", "requires the state directory (state_dir)")
+	}
+
+	if c.DestinationRoots != "" {
+		if !c.ExtractToRelativePath {
+			add("DestinationRoots", "requires extracting to relative paths (extract_to_relative_path)")
+		}
+		if _, err := parseDestinationRoots(c.DestinationRoots, ""); err != nil {
+			add("DestinationRoots", "%s", err)
+		}
+	}
+
+	if c.QuarantineURL != "" {
+		if u, err := url.Parse(c.QuarantineURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			add("QuarantineURL", "not a valid http(s) URL")
+		}
+	}
+
+	if _, err := parseChangeRules(c.SkipOnChange, ""); err != nil {
+		add("SkipOnChange", "%s", err)
+	}
+
+	if _, err := parseRequestHeaders(c.RequestHeaders); err != nil {
+		add("RequestHeaders", "%s", err)
+	}
+
+	switch c.DownloadAuth {
+	case downloadAuthOAuth2:
+		if u, err := url.Parse(c.OAuth2TokenURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			add("OAuth2TokenURL", "not a valid http(s) URL, it is required for the oauth2 download auth")
+		}
+		if c.OAuth2ClientID == "" || c.OAuth2ClientSecret == "" {
+			add("OAuth2ClientID", "the client ID and secret are required for the oauth2 download auth")
+		}
+	case downloadAuthSigV4:
+		if (c.AWSAccessKeyID == "") != (c.AWSSecretAccessKey == "") {
+			add("AWSAccessKeyID", "both the access key ID and secret access key are required for static credentials, leave them empty to use the AWS credential chain")
+		}
+		if c.AWSRegion == "" {
+			add("AWSRegion", "required for the aws_sigv4 download auth")
+		}
+	case downloadAuthGoogle:
+		if c.GoogleApplicationCredentials != "" {
+			if info, err := os.Stat(c.GoogleApplicationCredentials); err != nil || info.IsDir() {
+				add("GoogleApplicationCredentials", "the credentials file does not exist (%s)", c.GoogleApplicationCredentials)
+			}
+		}
+	case downloadAuthAzure:
+		if c.AzureClientSecret != "" && (c.AzureTenantID == "" || c.AzureClientID == "") {
+			add("AzureClientSecret", "the tenant ID and client ID are required for the client secret, leave it empty to use the managed identity")
+		}
+	}
+
+	if _, err := parseAllowedHosts(c.RedirectAllowedHosts); err != nil {
+		add("RedirectAllowedHosts", "%s", err)
+	}
+
+	if _, err := newTLSConfig(tlsOptions{MinVersion: c.TLSMinVersion, CipherSuites: c.TLSCipherSuites}); err != nil {
+		add("TLSCipherSuites", "%s", err)
+	}
+	if c.TLSClientCert != "" || c.TLSClientKey != "" {
+		if _, err := loadClientCertificate(c.TLSClientCert, string(c.TLSClientKey)); err != nil {
+			add("TLSClientCert", "%s", err)
+		}
+	}
+
+	if _, err := parseHostOverrides(c.HostOverrides); err != nil {
+		add("HostOverrides", "%s", err)
+	}
+
+	if c.DNSServer != "" {
+		if host, _, err := net.SplitHostPort(dnsServerAddress(c.DNSServer)); err != nil || net.ParseIP(host) == nil {
+			add("DNSServer", "not an IP address or IP:port (%s)", c.DNSServer)
+		}
+	}
+
+	if _, err := cleanProjectPath(c.ProjectPath); err != nil {
+		add("ProjectPath", "%s", err)
+	}
+
+	if c.Offline {
+		if info, err := os.Stat(c.LocalCacheDir); err != nil || !info.IsDir() {
+			add("LocalCacheDir", "local cache directory (%s) does not exist, it is required in offline mode", c.LocalCacheDir)
+		}
+	}
+
+	for _, input := range []struct {
+		field string
+		value int
+	}{
+		{"FailedItemsThreshold", c.FailedItemsThreshold},
+		{"CircuitBreakerErrors", c.CircuitBreakerErrors},
+		{"CircuitBreakerTimeout", c.CircuitBreakerTimeout},
+		{"MaxArchiveAgeDays", c.MaxArchiveAgeDays},
+		{"SlowRestoreThreshold", c.SlowRestoreThreshold},
+		{"StatsGrowthThreshold", c.StatsGrowthThreshold},
+		{"ProgressInterval", c.ProgressInterval},
+		{"TimeBudget", c.TimeBudget},
+		{"ExtractionWorkers", c.ExtractionWorkers},
+		{"PipelineBufferMB", c.PipelineBufferMB},
+		{"KeepArchiveMaxCount", c.KeepArchiveMaxCount},
+		{"BlobCacheMaxAgeHours", c.BlobCacheMaxAgeHours},
+		{"BlobCacheMaxSizeMB", c.BlobCacheMaxSizeMB},
+		{"MaxRedirects", c.MaxRedirects},
+		{"TmpfsMaxSizeMB", c.TmpfsMaxSizeMB},
+	} {
+		if input.value < 0 {
+			add(input.field, "%d is negative", input.value)
+		}
+	}
+
+	if c.WebhookURL != "" {
+		if u, err := url.Parse(string(c.WebhookURL)); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			add("WebhookURL", "not a valid http(s) URL")
+		}
+	}
+
+	if c.HooksDir != "" {
+		if info, err := os.Stat(c.HooksDir); err != nil || !info.IsDir() {
+			add("HooksDir", "hooks directory (%s) does not exist", c.HooksDir)
+		}
+	}
+
+	if c.ResultFilePath != "" {
+		if info, err := os.Stat(filepath.Dir(c.ResultFilePath)); err != nil || !info.IsDir() {
+			add("ResultFilePath", "parent directory (%s) does not exist", filepath.Dir(c.ResultFilePath))
+		}
+	}
+
+	if c.OverwriteAuditPath != "" {
+		if info, err := os.Stat(filepath.Dir(c.OverwriteAuditPath)); err != nil || !info.IsDir() {
+			add("OverwriteAuditPath", "parent directory (%s) does not exist", filepath.Dir(c.OverwriteAuditPath))
+		}
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+
+	msg := "invalid inputs:"
+	for _, err := range errs {
+		msg += "\n" + err
+	}
+	return fmt.Errorf("%s", msg)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestConfig_validate(t *testing.T) {
+	tests := []struct {
+		name       string
+		conf       Config
+		wantFields []string
+	}{
+		{
+			name: "valid",
+			conf: Config{CacheAPI: cacheAPILegacy, WebhookURL: "https://hooks.example.com/x", ResultFilePath: "/tmp/result.json"},
+		},
+		{
+			name:       "key-based without key",
+			conf:       Config{CacheAPI: cacheAPIKeyBased, ABCSAPIURL: "https://abcs.example.com"},
+			wantFields: []string{"Key"},
+		},
+		{
+			name:       "negative thresholds",
+			conf:       Config{CacheAPI: cacheAPILegacy, MaxArchiveAgeDays: -1, SlowRestoreThreshold: -1},
+			wantFields: []string{"MaxArchiveAgeDays", "SlowRestoreThreshold"},
+		},
+		{
+			name:       "invalid webhook and result path",
+			conf:       Config{CacheAPI: cacheAPILegacy, WebhookURL: "hooks.example.com", ResultFilePath: "/nonexistent/dir/result.json"},
+			wantFields: []string{"WebhookURL", "ResultFilePath"},
+		},
+		{
+			name:       "skip unchanged without state dir",
+			conf:       Config{CacheAPI: cacheAPILegacy, SkipUnchanged: true},
+			wantFields: []string{"SkipUnchanged"},
+		},
+		{
+			name:       "split components without state dir",
+			conf:       Config{CacheAPI: cacheAPILegacy, SplitComponents: true},
+			wantFields: []string{"SplitComponents"},
+		},
+		{
+			name:       "destination roots without relative extraction",
+			conf:       Config{CacheAPI: cacheAPILegacy, DestinationRoots: "apps/ios"},
+			wantFields: []string{"DestinationRoots"},
+		},
+		{
+			name:       "unsafe instance name",
+			conf:       Config{CacheAPI: cacheAPILegacy, InstanceName: "../deps"},
+			wantFields: []string{"InstanceName"},
+		},
+		{
+			name:       "path budget without priority",
+			conf:       Config{CacheAPI: cacheAPILegacy, PathBudgets: "Pods: max 2GB"},
+			wantFields: []string{"PathBudgets"},
+		},
+		{
+			name:       "unknown fatal failure class",
+			conf:       Config{CacheAPI: cacheAPILegacy, FatalFailures: "download,timeout"},
+			wantFields: []string{"FatalFailures"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.conf.validate()
+			if (err != nil) != (len(tt.wantFields) > 0) {
+				t.Fatalf("validate() error = %v, want errors for %v", err, tt.wantFields)
+			}
+			for _, field := range tt.wantFields {
+				if !strings.Contains(err.Error(), "- "+field+":") {
+					t.Errorf("validate() error = %v, want error for %s", err, field)
+				}
+			}
+		})
+	}
+}
+
+func TestConfig_printable(t *testing.T) {
+	signed := "https://storage.example.com/cache.tar.gz?X-Amz-Signature=abc123&X-Amz-Expires=60"
+	conf := Config{
+		CacheAPIURL:    signed,
+		PinnedCacheKey: signed,
+		QuarantineURL:  "https://cache.example.com/quarantine?token=abc123",
+		ZstdDictionary: signed,
+		OAuth2TokenURL: "https://auth.example.com/token?access_token=abc123",
+		RequestHeaders: "X-Api-Key: abc123\nX-Team: mobile",
+	}
+
+	printed := conf.printable()
+	for name, value := range map[string]string{
+		"CacheAPIURL":    printed.CacheAPIURL,
+		"PinnedCacheKey": printed.PinnedCacheKey,
+		"QuarantineURL":  printed.QuarantineURL,
+		"ZstdDictionary": printed.ZstdDictionary,
+		"OAuth2TokenURL": printed.OAuth2TokenURL,
+		"RequestHeaders": printed.RequestHeaders,
+	} {
+		if strings.Contains(value, "abc123") {
+			t.Errorf("printable().%s = %s, want the secret redacted", name, value)
+		}
+	}
+	if !strings.Contains(printed.RequestHeaders, "X-Team:") {
+		t.Errorf("printable().RequestHeaders = %s, want the header names kept", printed.RequestHeaders)
+	}
+	if conf.PinnedCacheKey != signed {
+		t.Errorf("printable() changed the config's PinnedCacheKey: %s", conf.PinnedCacheKey)
+	}
+}
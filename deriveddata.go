@@ -0,0 +1,108 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/bitrise-io/go-utils/command"
+)
+
+// derivedDataMarkerName is the file in the DerivedData directory describing the Xcode and the build settings
+// it was built with. It is written after the restore, so the next cache push archives it with the DerivedData.
+const derivedDataMarkerName = ".bitrise-cache-pull-derived-data.json"
+
+// moduleCachePatterns are the DerivedData's precompiled module caches, relative to the DerivedData directory.
+// They are only compatible with the compiler and the flags they were built with.
+var moduleCachePatterns = []string{
+	"ModuleCache.noindex",
+	"SDKStatCaches.noindex",
+	filepath.Join("*", "ModuleCache.noindex"),
+	filepath.Join("*", "Build", "Intermediates.noindex", "ExplicitPrecompiledModules"),
+	filepath.Join("*", "Build", "Intermediates.noindex", "SwiftExplicitPrecompiledModules"),
+}
+
+// derivedDataMarker is the content of the derivedDataMarkerName file.
+type derivedDataMarker struct {
+	XcodeVersion      string `json:"xcode_version"`
+	BuildSettingsHash string `json:"build_settings_hash,omitempty"`
+}
+
+// currentXcodeVersion returns the selected Xcode's version and build, e.g. "Xcode 15.2 Build version 15C500b".
+func currentXcodeVersion() (string, error) {
+	out, err := command.New("xcodebuild", "-version").RunAndReturnTrimmedCombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("xcodebuild -version failed: %s", out)
+	}
+	return strings.Join(strings.Fields(out), " "), nil
+}
+
+// buildSettingsHash returns the hash of the derived_data_build_settings input, empty if it is empty.
+func buildSettingsHash(settings string) string {
+	settings = strings.TrimSpace(settings)
+	if settings == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(settings))
+	return hex.EncodeToString(sum[:])
+}
+
+// readDerivedDataMarker reads the marker of the restored DerivedData, nil if it has none.
+func readDerivedDataMarker(dir string) (*derivedDataMarker, error) {
+	content, err := ioutil.ReadFile(filepath.Join(dir, derivedDataMarkerName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var marker derivedDataMarker
+	if err := json.Unmarshal(content, &marker); err != nil {
+		return nil, fmt.Errorf("invalid %s: %s", derivedDataMarkerName, err)
+	}
+	return &marker, nil
+}
+
+// writeDerivedDataMarker records the current Xcode and build settings in the DerivedData.
+func writeDerivedDataMarker(dir string, marker derivedDataMarker) error {
+	content, err := json.Marshal(marker)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, derivedDataMarkerName), content, 0644)
+}
+
+// incompatibility describes why the restored DerivedData's module caches can not be used with the current marker,
+// empty if they are compatible.
+func (m derivedDataMarker) incompatibility(current derivedDataMarker) string {
+	if m.XcodeVersion != current.XcodeVersion {
+		return fmt.Sprintf("built with %s, the current one is %s", m.XcodeVersion, current.XcodeVersion)
+	}
+	if m.BuildSettingsHash != current.BuildSettingsHash {
+		return "built with different build settings"
+	}
+	return ""
+}
+
+// clearModuleCaches removes the module caches of the DerivedData, returning the removed directories.
+func clearModuleCaches(dir string) ([]string, error) {
+	var cleared []string
+	for _, pattern := range moduleCachePatterns {
+		matches, err := filepath.Glob(filepath.Join(dir, pattern))
+		if err != nil {
+			return cleared, err
+		}
+		for _, pth := range matches {
+			if err := os.RemoveAll(pth); err != nil {
+				return cleared, err
+			}
+			cleared = append(cleared, pth)
+		}
+	}
+	return cleared, nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDerivedDataMarkerIncompatibility(t *testing.T) {
+	current := derivedDataMarker{XcodeVersion: "Xcode 15.2 Build version 15C500b", BuildSettingsHash: buildSettingsHash("CONFIGURATION=Release")}
+	tests := []struct {
+		name   string
+		marker derivedDataMarker
+		want   bool
+	}{
+		{name: "same", marker: current, want: false},
+		{name: "other xcode", marker: derivedDataMarker{XcodeVersion: "Xcode 15.1 Build version 15C65", BuildSettingsHash: current.BuildSettingsHash}, want: true},
+		{name: "other build settings", marker: derivedDataMarker{XcodeVersion: current.XcodeVersion, BuildSettingsHash: buildSettingsHash("CONFIGURATION=Debug")}, want: true},
+		{name: "no build settings", marker: derivedDataMarker{XcodeVersion: current.XcodeVersion}, want: true},
+	}
+	for _, tt := range tests {
+		if got := tt.marker.incompatibility(current) != ""; got != tt.want {
+			t.Errorf("%s: incompatibility() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	if buildSettingsHash(" \n") != "" {
+		t.Errorf("buildSettingsHash(empty) = %s, want empty", buildSettingsHash(" \n"))
+	}
+}
+
+func TestClearModuleCaches(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deriveddata-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Logf("failed to remove temp dir: %s", err)
+		}
+	}()
+
+	writeTestFiles(t, map[string]string{
+		filepath.Join(dir, "ModuleCache.noindex", "Foundation.pcm"):                                             "",
+		filepath.Join(dir, "App-abc", "Build", "Intermediates.noindex", "SwiftExplicitPrecompiledModules", "a"): "",
+		filepath.Join(dir, "App-abc", "Build", "Products", "Debug", "App.app"):                                  "",
+	})
+
+	marker := derivedDataMarker{XcodeVersion: "Xcode 15.2"}
+	if err := writeDerivedDataMarker(dir, marker); err != nil {
+		t.Fatalf("writeDerivedDataMarker() error = %s", err)
+	}
+	if got, err := readDerivedDataMarker(dir); err != nil || got == nil || *got != marker {
+		t.Errorf("readDerivedDataMarker() = %v, %v, want %v", got, err, marker)
+	}
+
+	cleared, err := clearModuleCaches(dir)
+	if err != nil {
+		t.Fatalf("clearModuleCaches() error = %s", err)
+	}
+	if len(cleared) != 2 {
+		t.Errorf("clearModuleCaches() = %v, want 2 directories", cleared)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "App-abc", "Build", "Products", "Debug", "App.app")); err != nil {
+		t.Errorf("build product removed: %s", err)
+	}
+}
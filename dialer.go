@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// IP versions, see the ip_version input.
+const (
+	ipVersionAuto = "auto"
+	ipVersion4    = "ipv4"
+	ipVersion6    = "ipv6"
+)
+
+// dialOptions customize the connections of the http requests.
+type dialOptions struct {
+	// IPVersion forces IPv4 or IPv6 connections, auto uses both (happy eyeballs).
+	IPVersion string
+	// DNSServer is the host:port of the DNS server resolving the hosts, instead of the system resolver.
+	DNSServer string
+	// Hosts maps the (lower case) host names to IP addresses, like /etc/hosts.
+	Hosts map[string]string
+}
+
+// parseHostOverrides parses the /etc/hosts-style (`<ip> <host> [<host>...]`) lines.
+func parseHostOverrides(s string) (map[string]string, error) {
+	hosts := map[string]string{}
+	for _, line := range strings.Split(s, "\n") {
+		if i := strings.Index(line, "#"); i != -1 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("invalid host override (%s), expected format: <ip> <host> [<host>...]", line)
+		}
+		if net.ParseIP(fields[0]) == nil {
+			return nil, fmt.Errorf("invalid IP address (%s) in host override (%s)", fields[0], line)
+		}
+		for _, host := range fields[1:] {
+			hosts[strings.ToLower(host)] = fields[0]
+		}
+	}
+	return hosts, nil
+}
+
+// dnsServerAddress returns the DNS server's host:port, the port defaults to 53.
+func dnsServerAddress(server string) string {
+	if _, _, err := net.SplitHostPort(server); err == nil {
+		return server
+	}
+	return net.JoinHostPort(strings.Trim(server, "[]"), "53")
+}
+
+// dialNetwork returns the network to dial for the IP version.
+func dialNetwork(network, ipVersion string) string {
+	if network != "tcp" {
+		return network
+	}
+	switch ipVersion {
+	case ipVersion4:
+		return "tcp4"
+	case ipVersion6:
+		return "tcp6"
+	default:
+		return network
+	}
+}
+
+// newDialContext returns a dial function applying the options.
+func newDialContext(opts dialOptions) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	if opts.DNSServer != "" {
+		server := dnsServerAddress(opts.DNSServer)
+		dialer.Resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, server)
+			},
+		}
+	}
+
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if host, port, err := net.SplitHostPort(addr); err == nil {
+			if ip, ok := opts.Hosts[strings.ToLower(host)]; ok {
+				addr = net.JoinHostPort(ip, port)
+			}
+		}
+		return dialer.DialContext(ctx, dialNetwork(network, opts.IPVersion), addr)
+	}
+}
+
+// newTransport returns a copy of the default transport, dialing with the options and the TLS config (if not nil).
+func newTransport(opts dialOptions, tlsConfig *tls.Config) http.RoundTripper {
+	t, ok := http.DefaultTransport.(*http.Transport)
+	if !ok {
+		return http.DefaultTransport
+	}
+	t = t.Clone()
+	t.DialContext = newDialContext(opts)
+	// the bodies are decoded explicitly, see decodeContentEncoding
+	t.DisableCompression = true
+	if tlsConfig != nil {
+		t.TLSClientConfig = tlsConfig
+	}
+	return t
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestParseHostOverrides(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    map[string]string
+		wantErr bool
+	}{
+		{
+			name:  "overrides",
+			input: "10.0.0.12 Cache.example.com cdn.example.com # cache\n\n# comment\n::1 v6.example.com",
+			want:  map[string]string{"cache.example.com": "10.0.0.12", "cdn.example.com": "10.0.0.12", "v6.example.com": "::1"},
+		},
+		{name: "missing host", input: "10.0.0.12", wantErr: true},
+		{name: "invalid ip", input: "cache.example.com 10.0.0.12", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseHostOverrides(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseHostOverrides() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseHostOverrides() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewTransport_hostOverride(t *testing.T) {
+	var host string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host = r.Host
+	}))
+	defer server.Close()
+
+	_, port, err := net.SplitHostPort(server.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to parse server address: %s", err)
+	}
+
+	client := &http.Client{Transport: newTransport(dialOptions{IPVersion: ipVersion4, Hosts: map[string]string{"cache.invalid": "127.0.0.1"}}, nil)}
+	resp, err := client.Get("http://cache.invalid:" + port)
+	if err != nil {
+		t.Fatalf("request error = %v", err)
+	}
+	if err := resp.Body.Close(); err != nil {
+		t.Logf("failed to close response body: %s", err)
+	}
+	if want := "cache.invalid:" + port; host != want {
+		t.Errorf("Host header = %s, want %s", host, want)
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// diffListLimit is the number of paths listed per group of the diff.
+const diffListLimit = 20
+
+// manifestEntry is an archive entry of the manifest.
+type manifestEntry struct {
+	Typeflag byte
+	Size     int64
+}
+
+// archiveManifest are the archive's entries by path.
+type archiveManifest map[string]manifestEntry
+
+// Size returns the sum of the entry sizes.
+func (m archiveManifest) Size() int64 {
+	var size int64
+	for _, entry := range m {
+		size += entry.Size
+	}
+	return size
+}
+
+// manifestChange is a path of the diff with its size in the old and the new archive.
+type manifestChange struct {
+	Path    string
+	OldSize int64
+	NewSize int64
+}
+
+func (c manifestChange) delta() int64 {
+	return c.NewSize - c.OldSize
+}
+
+// manifestDiff compares two archive manifests, the groups are sorted by the size change, largest first.
+type manifestDiff struct {
+	Added   []manifestChange
+	Removed []manifestChange
+	Changed []manifestChange
+	OldSize int64
+	NewSize int64
+}
+
+// diffManifests compares the old and the new manifest.
+// A path is changed if its entry type or size is different.
+func diffManifests(oldManifest, newManifest archiveManifest) manifestDiff {
+	diff := manifestDiff{OldSize: oldManifest.Size(), NewSize: newManifest.Size()}
+
+	for pth, newEntry := range newManifest {
+		oldEntry, ok := oldManifest[pth]
+		switch {
+		case !ok:
+			diff.Added = append(diff.Added, manifestChange{Path: pth, NewSize: newEntry.Size})
+		case oldEntry != newEntry:
+			diff.Changed = append(diff.Changed, manifestChange{Path: pth, OldSize: oldEntry.Size, NewSize: newEntry.Size})
+		}
+	}
+	for pth, oldEntry := range oldManifest {
+		if _, ok := newManifest[pth]; !ok {
+			diff.Removed = append(diff.Removed, manifestChange{Path: pth, OldSize: oldEntry.Size})
+		}
+	}
+
+	for _, changes := range [][]manifestChange{diff.Added, diff.Removed, diff.Changed} {
+		sortChanges(changes)
+	}
+	return diff
+}
+
+func sortChanges(changes []manifestChange) {
+	abs := func(n int64) int64 {
+		if n < 0 {
+			return -n
+		}
+		return n
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		if di, dj := abs(changes[i].delta()), abs(changes[j].delta()); di != dj {
+			return di > dj
+		}
+		return changes[i].Path < changes[j].Path
+	})
+}
+
+// readManifest reads the headers of a (gzip compressed) tar stream.
+func readManifest(r io.Reader) (archiveManifest, error) {
+	tr, hdr, _, err := readFirstEntry(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read first archive entry: %s", err)
+	}
+
+	manifest := archiveManifest{}
+	for {
+		if hdr.Typeflag != tar.TypeXGlobalHeader {
+			manifest[hdr.Name] = manifestEntry{Typeflag: hdr.Typeflag, Size: hdr.Size}
+		}
+
+		hdr, err = tr.Next()
+		if err == io.EOF {
+			return manifest, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read archive entry: %s", err)
+		}
+	}
+}
+
+// readArchiveManifest downloads the archive and reads its manifest.
+// The URI can be a cache API URL, an archive download URL or a local file:// URI.
+func readArchiveManifest(uri string) (archiveManifest, error) {
+	downloadInfo := cacheDownloadInfo{DownloadURL: uri}
+	if isBitriseCacheAPIURL(uri, os.Getenv("BITRISE_CACHE_API_URL")) {
+		var err error
+		if downloadInfo, err = getCacheDownloadInfo(uri); err != nil {
+			return nil, err
+		}
+	}
+
+	parts, err := resolveArchiveParts(downloadInfo.DownloadURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve archive parts: %s", err)
+	}
+
+	var archive io.ReadCloser
+	if len(downloadInfo.Chunks) > 0 && len(parts) == 1 {
+		archive = NewChunksReader(append([]string{parts[0]}, downloadInfo.Mirrors...), downloadInfo.Chunks)
+	} else if len(parts) > 1 {
+		archive = NewPartsReader(parts)
+	} else if archive, err = openPart(parts[0]); err != nil {
+		return nil, fmt.Errorf("failed to open archive: %s", err)
+	}
+	defer func() {
+		if err := archive.Close(); err != nil {
+			log.Warnf("Failed to close archive: %s", err)
+		}
+	}()
+
+	bufferedReader := bufio.NewReader(archive)
+	if !isZstdStream(bufferedReader) {
+		return readManifest(bufferedReader)
+	}
+
+	zr, err := NewZstdReader(bufferedReader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress archive: %s", err)
+	}
+	defer func() {
+		if err := zr.Close(); err != nil {
+			log.Warnf("Failed to stop zstd: %s", err)
+		}
+	}()
+	return readManifest(zr)
+}
+
+// runDiff compares the manifests of the two cache archives and prints the added, removed and changed paths.
+func runDiff(args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("two archives are required: --diff <old URL> <new URL>")
+	}
+
+	var manifests []archiveManifest
+	for _, uri := range args {
+		manifest, err := readArchiveManifest(uri)
+		if err != nil {
+			return fmt.Errorf("%s: %s", redactURL(uri), err)
+		}
+		manifests = append(manifests, manifest)
+	}
+
+	printManifestDiff(diffManifests(manifests[0], manifests[1]), diffListLimit)
+	return nil
+}
+
+// printManifestDiff prints the summary of the diff, listing at most limit paths per group.
+func printManifestDiff(diff manifestDiff, limit int) {
+	fmt.Println()
+	log.Infof("Cache diff")
+	log.Printf("- size: %s -> %s (%+d Bytes)", formatBytes(diff.OldSize), formatBytes(diff.NewSize), diff.NewSize-diff.OldSize)
+
+	for _, group := range []struct {
+		name    string
+		changes []manifestChange
+	}{
+		{name: "added", changes: diff.Added},
+		{name: "removed", changes: diff.Removed},
+		{name: "changed", changes: diff.Changed},
+	} {
+		log.Printf("- %s: %d", group.name, len(group.changes))
+		for i, change := range group.changes {
+			if i == limit {
+				log.Printf("  ... and %d more", len(group.changes)-limit)
+				break
+			}
+			log.Printf("  %s (%s -> %s)", change.Path, formatBytes(change.OldSize), formatBytes(change.NewSize))
+		}
+	}
+}
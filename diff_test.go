@@ -0,0 +1,63 @@
+package main
+
+import (
+	"archive/tar"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func Test_readManifest(t *testing.T) {
+	entries := []testEntry{
+		{name: "dir/", typeflag: tar.TypeDir},
+		{name: "dir/file", content: "content"},
+		{name: "dir/link", typeflag: tar.TypeSymlink, linkname: "file"},
+	}
+
+	got, err := readManifest(createTestArchive(t, entries))
+	if err != nil {
+		t.Fatalf("readManifest() error = %v", err)
+	}
+	want := archiveManifest{
+		"dir/":     {Typeflag: tar.TypeDir},
+		"dir/file": {Typeflag: tar.TypeReg, Size: 7},
+		"dir/link": {Typeflag: tar.TypeSymlink},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("readManifest() = %v, want %v", got, want)
+	}
+}
+
+func Test_diffManifests(t *testing.T) {
+	oldManifest := archiveManifest{
+		"same":    {Typeflag: tar.TypeReg, Size: 10},
+		"grown":   {Typeflag: tar.TypeReg, Size: 10},
+		"retyped": {Typeflag: tar.TypeReg, Size: 0},
+		"removed": {Typeflag: tar.TypeReg, Size: 5},
+	}
+	newManifest := archiveManifest{
+		"same":    {Typeflag: tar.TypeReg, Size: 10},
+		"grown":   {Typeflag: tar.TypeReg, Size: 1000},
+		"retyped": {Typeflag: tar.TypeSymlink, Size: 0},
+		"small":   {Typeflag: tar.TypeReg, Size: 1},
+		"large":   {Typeflag: tar.TypeReg, Size: 100},
+	}
+
+	got := diffManifests(oldManifest, newManifest)
+	want := manifestDiff{
+		Added:   []manifestChange{{Path: "large", NewSize: 100}, {Path: "small", NewSize: 1}},
+		Removed: []manifestChange{{Path: "removed", OldSize: 5}},
+		Changed: []manifestChange{{Path: "grown", OldSize: 10, NewSize: 1000}, {Path: "retyped"}},
+		OldSize: 25,
+		NewSize: 1111,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("diffManifests() = %+v, want %+v", got, want)
+	}
+}
+
+func Test_runDiff(t *testing.T) {
+	if err := runDiff([]string{"file:///tmp/cache.tar"}); err == nil || !strings.Contains(err.Error(), "two archives") {
+		t.Errorf("runDiff() error = %v, want two archives required", err)
+	}
+}
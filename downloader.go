@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/bitrise-io/go-utils/command"
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// Downloaders, see the downloader input.
+const (
+	downloaderBuiltin = "builtin"
+	downloaderAuto    = "auto"
+	downloaderAria2c  = "aria2c"
+	downloaderAxel    = "axel"
+)
+
+// externalDownloaderConnections is the number of connections the external downloaders open per archive.
+const externalDownloaderConnections = 8
+
+// resolveDownloader returns the downloader to use: the external tool if it is installed, the built-in one otherwise.
+// The auto setting prefers aria2c over axel.
+func resolveDownloader(setting string, lookPath func(string) (string, error)) string {
+	candidates := []string{setting}
+	switch setting {
+	case downloaderBuiltin, "":
+		return downloaderBuiltin
+	case downloaderAuto:
+		candidates = []string{downloaderAria2c, downloaderAxel}
+	}
+
+	for _, tool := range candidates {
+		if _, err := lookPath(tool); err == nil {
+			return tool
+		}
+	}
+	if setting != downloaderAuto {
+		log.Warnf("%s is not installed, using the built-in downloader", setting)
+	}
+	return downloaderBuiltin
+}
+
+// externalDownloadArgs returns the tool's arguments downloading the archive (from the URL and its mirrors) to pth.
+// aria2c reads the URLs and the headers from its input file (see aria2cInput), so they are not exposed
+// on its command line to the machine's other processes. axel only takes them as arguments.
+func externalDownloadArgs(tool string, urls []string, pth string, headers http.Header) []string {
+	connections := strconv.Itoa(externalDownloaderConnections)
+	switch tool {
+	case downloaderAria2c:
+		return []string{
+			"--console-log-level=warn", "--summary-interval=0", "--download-result=hide",
+			"--allow-overwrite=true", "--auto-file-renaming=false", "--continue=true",
+			"--max-connection-per-server=" + connections, "--split=" + connections, "--min-split-size=1M",
+			"--input-file=" + aria2cInputPath(pth),
+		}
+	case downloaderAxel:
+		args := []string{"--quiet", "--num-connections=" + connections, "--output=" + pth}
+		for _, name := range sortedHeaderNames(headers) {
+			for _, value := range headers[name] {
+				args = append(args, "--header="+name+": "+value)
+			}
+		}
+		return append(args, urls...)
+	}
+	return nil
+}
+
+// aria2cInputPath returns the path of aria2c's input file downloading the archive to pth.
+func aria2cInputPath(pth string) string {
+	return pth + ".aria2c"
+}
+
+// aria2cInput returns aria2c's input file downloading the archive (from the URL and its mirrors) to pth:
+// the tab separated URLs of the download, followed by its indented options.
+func aria2cInput(urls []string, pth string, headers http.Header) string {
+	var b strings.Builder
+	b.WriteString(strings.Join(urls, "\t") + "\n")
+	b.WriteString("  dir=" + filepath.Dir(pth) + "\n")
+	b.WriteString("  out=" + filepath.Base(pth) + "\n")
+	for _, name := range sortedHeaderNames(headers) {
+		for _, value := range headers[name] {
+			b.WriteString("  header=" + name + ": " + value + "\n")
+		}
+	}
+	return b.String()
+}
+
+func sortedHeaderNames(headers http.Header) []string {
+	var names []string
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// statArchive returns the archive's response headers and size (-1 if unknown), requesting its first Byte
+// with a ranged GET: the presigned URLs are only signed for GET requests, a HEAD request of them is refused.
+// Servers ignoring the Range header respond with the whole archive, its body is not read.
+func statArchive(uri string) (http.Header, int64, error) {
+	req, err := http.NewRequest("GET", uri, nil)
+	if err != nil {
+		return nil, -1, fmt.Errorf("failed to create request: %s", err)
+	}
+	req.Header.Set("Range", "bytes=0-0")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, -1, err
+	}
+	closeBody(resp)
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp.Header, resp.ContentLength, nil
+	case http.StatusPartialContent, http.StatusRequestedRangeNotSatisfiable:
+		// the Content-MD5 of a partial response is the checksum of its body (the other checksum headers are the object's)
+		header := resp.Header.Clone()
+		header.Del("Content-MD5")
+		// Content-Range: bytes 0-0/<size>, or bytes */0 for an empty archive
+		return header, contentRangeSize(resp.Header.Get("Content-Range")), nil
+	default:
+		return nil, -1, fmt.Errorf("non success response code: %d", resp.StatusCode)
+	}
+}
+
+// contentRangeSize returns the complete length of the Content-Range header, -1 if unknown.
+func contentRangeSize(contentRange string) int64 {
+	i := strings.LastIndex(contentRange, "/")
+	if i == -1 {
+		return -1
+	}
+	size, err := strconv.ParseInt(contentRange[i+1:], 10, 64)
+	if err != nil {
+		return -1
+	}
+	return size
+}
+
+// downloadWithExternalTool downloads the archive with the external tool, then verifies it against
+// the checksum (or the size) the server announces for the archive. Encoded archives are left to the built-in downloader.
+func downloadWithExternalTool(tool string, urls []string, pth string, headers http.Header) error {
+	header, size, err := statArchive(urls[0])
+	if err != nil {
+		return fmt.Errorf("failed to get the archive's checksum: %s", err)
+	}
+	// the downloaded file would not be decoded, see decodeContentEncoding
+	if encoding := header.Get("Content-Encoding"); encoding != "" && encoding != "identity" {
+		return fmt.Errorf("the archive is served with Content-Encoding: %s", encoding)
+	}
+
+	if err := os.Remove(pth); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if tool == downloaderAria2c {
+		input := aria2cInputPath(pth)
+		if err := ioutil.WriteFile(input, []byte(aria2cInput(urls, pth, headers)), 0600); err != nil {
+			return err
+		}
+		defer func() {
+			if err := os.Remove(input); err != nil {
+				log.Warnf("Failed to remove %s: %s", input, err)
+			}
+		}()
+	}
+
+	cmd := command.New(tool, externalDownloadArgs(tool, urls, pth, headers)...)
+	log.Debugf("$ %s", redactSecrets(cmd.PrintableCommandArgs()))
+	if out, err := cmd.RunAndReturnTrimmedCombinedOutput(); err != nil {
+		return fmt.Errorf("%s failed: %s: %s", tool, err, out)
+	}
+	return verifyDownloadedFile(pth, header, size)
+}
+
+// verifyDownloadedFile checks the file against the response's checksum header, or the size if there is none.
+func verifyDownloadedFile(pth string, header http.Header, size int64) error {
+	f, err := os.Open(pth)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := f.Close(); err != nil {
+			log.Warnf("Failed to close %s: %s", pth, err)
+		}
+	}()
+
+	checksum := newResponseChecksum(header)
+	if checksum == nil {
+		info, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		if size >= 0 && info.Size() != size {
+			return fmt.Errorf("downloaded %d Bytes, expected %d", info.Size(), size)
+		}
+		return nil
+	}
+
+	if _, err := io.Copy(checksum.hash, f); err != nil {
+		return err
+	}
+	if got := checksum.hash.Sum(nil); !bytes.Equal(got, checksum.want) {
+		return &checksumMismatchError{
+			header: checksum.header,
+			got:    base64.StdEncoding.EncodeToString(got),
+			want:   base64.StdEncoding.EncodeToString(checksum.want),
+		}
+	}
+	return nil
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_resolveDownloader(t *testing.T) {
+	tests := []struct {
+		setting   string
+		installed []string
+		want      string
+	}{
+		{setting: downloaderBuiltin, installed: []string{downloaderAria2c}, want: downloaderBuiltin},
+		{setting: downloaderAuto, installed: []string{downloaderAria2c, downloaderAxel}, want: downloaderAria2c},
+		{setting: downloaderAuto, installed: []string{downloaderAxel}, want: downloaderAxel},
+		{setting: downloaderAuto, want: downloaderBuiltin},
+		{setting: downloaderAxel, installed: []string{downloaderAria2c, downloaderAxel}, want: downloaderAxel},
+		{setting: downloaderAria2c, installed: []string{downloaderAxel}, want: downloaderBuiltin},
+	}
+	for _, tt := range tests {
+		lookPath := func(name string) (string, error) {
+			for _, tool := range tt.installed {
+				if tool == name {
+					return "/usr/bin/" + name, nil
+				}
+			}
+			return "", fmt.Errorf("%s not found", name)
+		}
+		if got := resolveDownloader(tt.setting, lookPath); got != tt.want {
+			t.Errorf("resolveDownloader(%s, %v) = %s, want %s", tt.setting, tt.installed, got, tt.want)
+		}
+	}
+}
+
+func Test_externalDownloadArgs(t *testing.T) {
+	urls := []string{"https://cache.example.com/archive", "https://mirror.example.com/archive"}
+	headers := http.Header{"User-Agent": {"cache-pull/1.0"}, "X-Team": {"ios"}}
+
+	got := externalDownloadArgs(downloaderAxel, urls, "/tmp/cache/archive", headers)
+	want := []string{"--quiet", "--num-connections=8", "--output=/tmp/cache/archive", "--header=User-Agent: cache-pull/1.0", "--header=X-Team: ios", urls[0], urls[1]}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("externalDownloadArgs(axel) = %v, want %v", got, want)
+	}
+
+	got = externalDownloadArgs(downloaderAria2c, urls, "/tmp/cache/archive", headers)
+	if got[len(got)-1] != "--input-file=/tmp/cache/archive.aria2c" {
+		t.Errorf("externalDownloadArgs(aria2c) = %v, want the input file", got)
+	}
+	for _, arg := range got {
+		if strings.Contains(arg, "ios") || strings.Contains(arg, "cache.example.com") {
+			t.Errorf("externalDownloadArgs(aria2c) = %v, want the headers and URLs in the input file", got)
+		}
+	}
+}
+
+func Test_aria2cInput(t *testing.T) {
+	urls := []string{"https://cache.example.com/archive", "https://mirror.example.com/archive"}
+	headers := http.Header{"User-Agent": {"cache-pull/1.0"}, "X-Team": {"ios"}}
+
+	got := aria2cInput(urls, "/tmp/cache/archive", headers)
+	want := "https://cache.example.com/archive\thttps://mirror.example.com/archive\n" +
+		"  dir=/tmp/cache\n" +
+		"  out=archive\n" +
+		"  header=User-Agent: cache-pull/1.0\n" +
+		"  header=X-Team: ios\n"
+	if got != want {
+		t.Errorf("aria2cInput() = %q, want %q", got, want)
+	}
+}
+
+func Test_statArchive(t *testing.T) {
+	content := "archive content"
+	sum := md5.Sum([]byte(content))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// presigned URLs are only signed for GET requests
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		switch r.URL.Path {
+		case "/ranged":
+			if r.Header.Get("Range") != "bytes=0-0" {
+				t.Errorf("Range header = %s, want bytes=0-0", r.Header.Get("Range"))
+			}
+			w.Header().Set("x-goog-hash", "md5="+base64.StdEncoding.EncodeToString(sum[:]))
+			http.ServeContent(w, r, "archive", time.Time{}, strings.NewReader(content))
+		case "/not-ranged":
+			if _, err := w.Write([]byte(content)); err != nil {
+				t.Errorf("failed to write response: %s", err)
+			}
+		case "/empty":
+			http.ServeContent(w, r, "archive", time.Time{}, strings.NewReader(""))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		path         string
+		wantSize     int64
+		wantChecksum bool
+		wantErr      bool
+	}{
+		{path: "/ranged", wantSize: int64(len(content)), wantChecksum: true},
+		{path: "/not-ranged", wantSize: int64(len(content))},
+		{path: "/empty", wantSize: 0},
+		{path: "/missing", wantSize: -1, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			header, size, err := statArchive(server.URL + tt.path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("statArchive() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if size != tt.wantSize {
+				t.Errorf("statArchive() size = %d, want %d", size, tt.wantSize)
+			}
+			if got := newResponseChecksum(header) != nil; got != tt.wantChecksum {
+				t.Errorf("statArchive() checksum = %v, want %v", got, tt.wantChecksum)
+			}
+		})
+	}
+}
+
+func Test_contentRangeSize(t *testing.T) {
+	for contentRange, want := range map[string]int64{
+		"bytes 0-0/1024": 1024,
+		"bytes */0":      0,
+		"bytes 0-0/*":    -1,
+		"":               -1,
+	} {
+		if got := contentRangeSize(contentRange); got != want {
+			t.Errorf("contentRangeSize(%s) = %d, want %d", contentRange, got, want)
+		}
+	}
+}
+
+func Test_verifyDownloadedFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "downloader-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Logf("failed to remove temp dir: %s", err)
+		}
+	}()
+
+	pth := filepath.Join(dir, "archive")
+	if err := ioutil.WriteFile(pth, []byte("content"), 0600); err != nil {
+		t.Fatalf("failed to write file: %s", err)
+	}
+	sum := md5.Sum([]byte("content"))
+	other := md5.Sum([]byte("other"))
+
+	tests := []struct {
+		name    string
+		header  http.Header
+		size    int64
+		wantErr bool
+	}{
+		{name: "matching checksum", header: http.Header{"Content-Md5": {base64.StdEncoding.EncodeToString(sum[:])}}, size: 7},
+		{name: "checksum mismatch", header: http.Header{"Content-Md5": {base64.StdEncoding.EncodeToString(other[:])}}, size: 7, wantErr: true},
+		{name: "matching size", header: http.Header{}, size: 7},
+		{name: "size mismatch", header: http.Header{}, size: 8, wantErr: true},
+		{name: "unknown size", header: http.Header{}, size: -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := verifyDownloadedFile(pth, tt.header, tt.size); (err != nil) != tt.wantErr {
+				t.Errorf("verifyDownloadedFile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
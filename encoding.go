@@ -0,0 +1,19 @@
+package main
+
+import (
+	"io"
+	"net/http"
+
+	"github.com/bitrise-steplib/steps-cache-pull/pkg/cachepull"
+)
+
+// decodeContentEncoding wraps the body to decode the response's Content-Encoding (if any) and returns the decoded body.
+// The body is closed if the encoding can not be decoded.
+//
+// The step's transport does not request compressed responses, so net/http never decompresses a body silently,
+// but servers can still encode the stored objects (e.g. a .tar.gz uploaded with Content-Encoding: gzip).
+// The body is decoded after the checksum verification (the checksums are the ones of the encoded bytes)
+// and before the archive format is sniffed.
+func decodeContentEncoding(header http.Header, body io.ReadCloser) (io.ReadCloser, error) {
+	return cachepull.DecodeContentEncoding(header, body)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func gzipBytes(t *testing.T, b []byte) []byte {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	if _, err := gw.Write(b); err != nil {
+		t.Fatalf("failed to write gzip: %s", err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatalf("failed to close gzip: %s", err)
+	}
+	return buf.Bytes()
+}
+
+func Test_decodeContentEncoding(t *testing.T) {
+	content := []byte("archive")
+
+	tests := []struct {
+		name     string
+		encoding string
+		body     []byte
+		wantErr  bool
+	}{
+		{name: "none", body: content},
+		{name: "identity", encoding: "identity", body: content},
+		{name: "gzip", encoding: "gzip", body: gzipBytes(t, content)},
+		{name: "x-gzip", encoding: "X-Gzip", body: gzipBytes(t, content)},
+		{name: "invalid gzip", encoding: "gzip", body: content, wantErr: true},
+		{name: "unsupported", encoding: "br", body: content, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			if tt.encoding != "" {
+				header.Set("Content-Encoding", tt.encoding)
+			}
+
+			body, err := decodeContentEncoding(header, ioutil.NopCloser(bytes.NewReader(tt.body)))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("decodeContentEncoding() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			got, err := ioutil.ReadAll(body)
+			if err != nil || !bytes.Equal(got, content) {
+				t.Errorf("decodeContentEncoding() body = %s, %v, want %s", got, err, content)
+			}
+			if err := body.Close(); err != nil {
+				t.Errorf("Close() error = %v", err)
+			}
+		})
+	}
+}
+
+func TestNewTransport_contentEncoding(t *testing.T) {
+	// a gzip compressed archive stored with Content-Encoding: gzip
+	archive := gzipBytes(t, []byte("tar"))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Accept-Encoding") != "" {
+			t.Errorf("Accept-Encoding = %s, want none", r.Header.Get("Accept-Encoding"))
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		if _, err := w.Write(gzipBytes(t, archive)); err != nil {
+			t.Errorf("failed to write response: %s", err)
+		}
+	}))
+	defer server.Close()
+
+	client := &http.Client{Transport: newTransport(dialOptions{}, nil)}
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	body, err := decodeContentEncoding(resp.Header, resp.Body)
+	if err != nil {
+		t.Fatalf("decodeContentEncoding() error = %v", err)
+	}
+	got, err := ioutil.ReadAll(body)
+	if err != nil {
+		t.Fatalf("failed to read body: %s", err)
+	}
+	if err := body.Close(); err != nil {
+		t.Errorf("Close() error = %v", err)
+	}
+
+	if !bytes.Equal(got, archive) {
+		t.Errorf("body = %x, want the gzip compressed archive %x", got, archive)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// errorDocumentSniffSize is the number of Bytes sniffed at the beginning of the downloaded archive, see http.DetectContentType.
+const errorDocumentSniffSize = 512
+
+// errorDocumentSummaryLimit is the maximum length of the error document's summary in the messages.
+const errorDocumentSummaryLimit = 200
+
+var utf8BOM = []byte{0xef, 0xbb, 0xbf}
+
+var (
+	htmlTitlePattern  = regexp.MustCompile(`(?is)<title[^>]*>(.*?)</title>`)
+	xmlCodePattern    = regexp.MustCompile(`(?is)<Code>(.*?)</Code>`)
+	xmlMessagePattern = regexp.MustCompile(`(?is)<Message>(.*?)</Message>`)
+	whitespacePattern = regexp.MustCompile(`\s+`)
+)
+
+// errorDocument is an HTML or XML document downloaded instead of the archive: the error page of a proxy or a login portal,
+// or the storage's error (e.g. the expired signature of a presigned URL) served with a success status code.
+type errorDocument struct {
+	// Kind is HTML or XML.
+	Kind string
+	// Summary is the HTML page's title or the XML error's code and message, if any.
+	Summary string
+}
+
+func (d errorDocument) Error() string {
+	msg := fmt.Sprintf("the downloaded cache archive is an %s document, not an archive", d.Kind)
+	if d.Summary != "" {
+		msg += fmt.Sprintf(" (%s)", d.Summary)
+	}
+	return msg + ": check the cache URL, a wrong or expired (presigned) URL returns an error page"
+}
+
+// sniffErrorDocument returns the HTML or XML document at the beginning of the buffered stream, nil if the stream is not one.
+// The archives (gzip, zstd or tar) are never detected as text documents.
+func sniffErrorDocument(r *bufio.Reader) *errorDocument {
+	// a short document is shorter than the sniffed Bytes, its Peek returns io.EOF with all of its Bytes
+	b, _ := r.Peek(errorDocumentSniffSize)
+	if len(b) == 0 {
+		return nil
+	}
+
+	// the UTF-8 BOM (e.g. of Azure's errors) is sniffed as plain text
+	b = bytes.TrimPrefix(b, utf8BOM)
+
+	var doc errorDocument
+	switch contentType := http.DetectContentType(b); {
+	case strings.HasPrefix(contentType, "text/html"):
+		doc.Kind = "HTML"
+		if m := htmlTitlePattern.FindSubmatch(b); m != nil {
+			doc.Summary = string(m[1])
+		}
+	case strings.HasPrefix(contentType, "text/xml"):
+		doc.Kind = "XML"
+		var parts []string
+		for _, pattern := range []*regexp.Regexp{xmlCodePattern, xmlMessagePattern} {
+			if m := pattern.FindSubmatch(b); m != nil {
+				parts = append(parts, string(m[1]))
+			}
+		}
+		doc.Summary = strings.Join(parts, ": ")
+	default:
+		return nil
+	}
+
+	doc.Summary = strings.TrimSpace(whitespacePattern.ReplaceAllString(doc.Summary, " "))
+	if len(doc.Summary) > errorDocumentSummaryLimit {
+		doc.Summary = doc.Summary[:errorDocumentSummaryLimit] + "..."
+	}
+	return &doc
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"reflect"
+	"testing"
+)
+
+func TestSniffErrorDocument(t *testing.T) {
+	var tarArchive bytes.Buffer
+	tw := tar.NewWriter(&tarArchive)
+	if err := tw.WriteHeader(&tar.Header{Name: "archive_info.json", Mode: 0644, Size: 2}); err != nil {
+		t.Fatalf("failed to write tar header: %s", err)
+	}
+	if _, err := tw.Write([]byte("{}")); err != nil {
+		t.Fatalf("failed to write tar entry: %s", err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("failed to close tar writer: %s", err)
+	}
+
+	var gzipArchive bytes.Buffer
+	gw := gzip.NewWriter(&gzipArchive)
+	if _, err := gw.Write(tarArchive.Bytes()); err != nil {
+		t.Fatalf("failed to write gzip stream: %s", err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatalf("failed to close gzip writer: %s", err)
+	}
+
+	tests := []struct {
+		name    string
+		content []byte
+		want    *errorDocument
+	}{
+		{
+			name:    "S3 expired presigned URL",
+			content: []byte("<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n<Error><Code>AccessDenied</Code><Message>Request has expired</Message><RequestId>1</RequestId></Error>"),
+			want:    &errorDocument{Kind: "XML", Summary: "AccessDenied: Request has expired"},
+		},
+		{
+			name:    "Azure error with BOM",
+			content: append([]byte{0xef, 0xbb, 0xbf}, []byte("<?xml version=\"1.0\" encoding=\"utf-8\"?><Error><Code>AuthenticationFailed</Code><Message>Signature not valid\n in the specified time frame</Message></Error>")...),
+			want:    &errorDocument{Kind: "XML", Summary: "AuthenticationFailed: Signature not valid in the specified time frame"},
+		},
+		{
+			name:    "HTML error page",
+			content: []byte("\n<!DOCTYPE html>\n<html><head><title>\n  404 Not Found\n</title></head><body></body></html>"),
+			want:    &errorDocument{Kind: "HTML", Summary: "404 Not Found"},
+		},
+		{
+			name:    "HTML without title",
+			content: []byte("<html><body>Sign in</body></html>"),
+			want:    &errorDocument{Kind: "HTML"},
+		},
+		{
+			name:    "gzip archive",
+			content: gzipArchive.Bytes(),
+		},
+		{
+			name:    "tar archive",
+			content: tarArchive.Bytes(),
+		},
+		{
+			name:    "zstd archive",
+			content: append(append([]byte{}, zstdMagic...), 0, 0, 0, 0),
+		},
+		{
+			name: "empty",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := bufio.NewReader(bytes.NewReader(tt.content))
+			if got := sniffErrorDocument(r); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("sniffErrorDocument() = %v, want %v", got, tt.want)
+			}
+			if rest, err := r.Peek(len(tt.content)); err != nil || !bytes.Equal(rest, tt.content) {
+				t.Errorf("the sniffed stream = %v, %v, want the unread content", rest, err)
+			}
+		})
+	}
+}
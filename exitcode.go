@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// failureClass is the class of a failed cache pull, see the README's Exit codes.
+type failureClass string
+
+// Failure classes, see the fatal_failures input.
+const (
+	failureMiss         failureClass = "miss"
+	failureDownload     failureClass = "download"
+	failureVerification failureClass = "verification"
+	failureExtraction   failureClass = "extraction"
+	failureConfig       failureClass = "config"
+)
+
+// Exit codes of the failure classes, the other failures exit with 1.
+var failureExitCodes = map[failureClass]int{
+	failureConfig:       2,
+	failureDownload:     3,
+	failureVerification: 4,
+	failureExtraction:   5,
+	failureMiss:         6,
+}
+
+// defaultFatalFailures are the failure classes failing the step by default: every failure but the cache miss.
+var defaultFatalFailures = []failureClass{failureConfig, failureDownload, failureVerification, failureExtraction}
+
+const failureClassEnvKey = "BITRISE_CACHE_PULL_FAILURE_CLASS"
+
+// fatalFailures are the current pull's fatal failure classes, checked by failAs and finishMiss.
+// The failures before the fatal_failures input is parsed are fatal.
+var fatalFailures map[failureClass]bool
+
+// parseFatalFailures parses the fatal_failures input: a comma separated list of the failure classes, or none.
+// Empty means the default classes.
+func parseFatalFailures(s string) (map[failureClass]bool, error) {
+	fatal := map[failureClass]bool{}
+	if strings.TrimSpace(s) == "" {
+		for _, class := range defaultFatalFailures {
+			fatal[class] = true
+		}
+		return fatal, nil
+	}
+	if strings.TrimSpace(s) == "none" {
+		return fatal, nil
+	}
+
+	for _, name := range strings.Split(s, ",") {
+		class := failureClass(strings.TrimSpace(name))
+		if _, ok := failureExitCodes[class]; !ok {
+			return nil, fmt.Errorf("unknown failure class: %s, supported: %s", class, strings.Join(failureClassNames(), ", "))
+		}
+		fatal[class] = true
+	}
+	return fatal, nil
+}
+
+func failureClassNames() []string {
+	var names []string
+	for class := range failureExitCodes {
+		names = append(names, string(class))
+	}
+	sort.Strings(names)
+	return names
+}
+
+// isFatalFailure reports whether the failure class fails the step.
+func isFatalFailure(class failureClass) bool {
+	if fatalFailures == nil {
+		return class != failureMiss
+	}
+	return fatalFailures[class]
+}
+
+// failAs prints an error of the failure class and terminates the step with the class' exit code.
+// If the class is not fatal, the step succeeds without cache.
+// If the circuit breaker tripped, the cache pull is skipped instead, as by failf.
+func failAs(class failureClass, format string, args ...interface{}) {
+	if breaker.Open() && result != nil {
+		failf(format, args...)
+	}
+
+	exportFailureClass(class)
+	if result != nil {
+		result.FailureClass = string(class)
+	}
+	if !isFatalFailure(class) && result != nil {
+		result.Warnf(format, args...)
+		result.Warnf("The %s failure is not fatal (fatal_failures), the build proceeds without cache", class)
+		result.Finish(statusFailed, fmt.Errorf(format, args...))
+		exit(0)
+	}
+
+	log.Errorf(format, args...)
+	if result != nil {
+		result.Finish(statusFailed, fmt.Errorf(format, args...))
+	}
+	exit(failureExitCodes[class])
+}
+
+// finishMiss finishes the pull as a cache miss. If the miss is fatal, the step terminates with its exit code.
+func finishMiss() {
+	if !isFatalFailure(failureMiss) {
+		result.Finish(statusMiss, nil)
+		return
+	}
+
+	exportFailureClass(failureMiss)
+	result.FailureClass = string(failureMiss)
+	result.Finish(statusMiss, nil)
+	log.Errorf("No cache restored, the cache miss is fatal (fatal_failures)")
+	exit(failureExitCodes[failureMiss])
+}
+
+// stepExit is the panic of exit, terminating the step run with the code.
+type stepExit struct {
+	code int
+}
+
+// exit terminates the step run with the code. The run's deferred cleanups (its temporary directory, lock
+// and pending downloads) run, unlike with os.Exit: run recovers the code and main exits with it.
+func exit(code int) {
+	panic(stepExit{code: code})
+}
+
+// recoverExit sets the code of the step run terminated by exit, the other panics are not recovered.
+// It has to be deferred directly.
+func recoverExit(code *int) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	e, ok := r.(stepExit)
+	if !ok {
+		panic(r)
+	}
+	*code = e.code
+}
+
+func exportFailureClass(class failureClass) {
+	if err := exportEnv(failureClassEnvKey, string(class)); err != nil {
+		log.Warnf("%s", err)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseFatalFailures(t *testing.T) {
+	tests := []struct {
+		name    string
+		s       string
+		want    map[failureClass]bool
+		wantErr bool
+	}{
+		{
+			name: "default",
+			s:    "",
+			want: map[failureClass]bool{failureConfig: true, failureDownload: true, failureVerification: true, failureExtraction: true},
+		},
+		{
+			name: "none",
+			s:    " none ",
+			want: map[failureClass]bool{},
+		},
+		{
+			name: "list",
+			s:    "miss, extraction",
+			want: map[failureClass]bool{failureMiss: true, failureExtraction: true},
+		},
+		{
+			name:    "unknown class",
+			s:       "download,timeout",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseFatalFailures(tt.s)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseFatalFailures() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseFatalFailures() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsFatalFailure(t *testing.T) {
+	defer func() { fatalFailures = nil }()
+
+	fatalFailures = nil
+	if isFatalFailure(failureMiss) || !isFatalFailure(failureConfig) {
+		t.Errorf("before parsing the inputs only the cache miss should be non-fatal")
+	}
+
+	fatalFailures = map[failureClass]bool{failureMiss: true}
+	if !isFatalFailure(failureMiss) || isFatalFailure(failureDownload) {
+		t.Errorf("isFatalFailure() does not follow the fatal_failures input")
+	}
+}
+
+func TestRecoverExit(t *testing.T) {
+	cleaned := false
+	run := func() (code int) {
+		defer recoverExit(&code)
+		defer func() { cleaned = true }()
+		exit(3)
+		return 0
+	}
+
+	if code := run(); code != 3 {
+		t.Errorf("run() = %d, want the exit code 3", code)
+	}
+	if !cleaned {
+		t.Errorf("the deferred cleanup did not run on exit")
+	}
+
+	defer func() {
+		if r := recover(); r != "unexpected" {
+			t.Errorf("recovered %v, want the other panic to be propagated", r)
+		}
+	}()
+	func() (code int) {
+		defer recoverExit(&code)
+		panic("unexpected")
+	}()
+}
@@ -0,0 +1,633 @@
+package main
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// Case collision policies, see the case_collision_policy input.
+const (
+	collisionPolicyWarn      = "warn"
+	collisionPolicySkip      = "skip"
+	collisionPolicyFail      = "fail"
+	collisionPolicyOverwrite = "overwrite"
+)
+
+// Special file (device, FIFO) policies, see the special_file_policy input.
+const (
+	specialFilePolicyRestore = "restore"
+	specialFilePolicySkip    = "skip"
+	specialFilePolicyFail    = "fail"
+)
+
+// errTimeBudgetExceeded is returned by Extract if the time budget is exceeded, the extracted entries are kept.
+var errTimeBudgetExceeded = errors.New("time budget exceeded")
+
+// Collision describes two archive entries which resolve to the same path on a case-insensitive filesystem.
+type Collision struct {
+	First  string
+	Second string
+}
+
+// pathFilter selects the restored paths (and their content).
+type pathFilter struct {
+	// Skip are the paths not restored.
+	Skip []string
+	// Only are the paths restored, if not empty.
+	Only []string
+	// SkipFunc reports the other paths not restored (e.g. the caches of other tool versions), if set.
+	SkipFunc func(pth string) bool
+}
+
+// active reports whether the filter excludes anything.
+func (f pathFilter) active() bool {
+	return len(f.Skip) > 0 || len(f.Only) > 0 || f.SkipFunc != nil
+}
+
+// skipAlso adds fn to the SkipFunc, a nil fn is ignored.
+func (f *pathFilter) skipAlso(fn func(pth string) bool) {
+	if fn == nil {
+		return
+	}
+	prev := f.SkipFunc
+	if prev == nil {
+		f.SkipFunc = fn
+		return
+	}
+	f.SkipFunc = func(pth string) bool { return prev(pth) || fn(pth) }
+}
+
+// excludes reports whether the path is not restored.
+func (f pathFilter) excludes(pth string) bool {
+	if isUnderPath(pth, f.Skip) || (f.SkipFunc != nil && f.SkipFunc(pth)) {
+		return true
+	}
+	return len(f.Only) > 0 && !isUnderPath(pth, f.Only)
+}
+
+// isUnderPath reports whether the path is (under) one of the given paths.
+func isUnderPath(pth string, paths []string) bool {
+	for _, p := range paths {
+		if pth == p || strings.HasPrefix(pth, p+string(os.PathSeparator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Extractor extracts a tar stream in-process.
+type Extractor struct {
+	// Dir is the directory relative entry names are extracted into.
+	Dir string
+	// Relative strips the leading `/` from the entry names (like tar without -P).
+	Relative bool
+	// CaseInsensitive enables case collision detection.
+	CaseInsensitive bool
+	CollisionPolicy string
+	// Normalization is the unicode normalization form applied to the entry names.
+	Normalization string
+	// SpecialFilePolicy controls the handling of char/block devices and FIFOs.
+	SpecialFilePolicy string
+	// Workers is the number of goroutines writing the small files, the files are written in order if it is 1.
+	Workers int
+	// FsyncPolicy controls when the written files are flushed to the disk.
+	FsyncPolicy string
+	// Umask is applied to the directories' modes too, if set (the files are created with the process umask).
+	Umask *os.FileMode
+	// Filter selects the restored paths.
+	Filter pathFilter
+	// Deadline is the end of the time budget, if set.
+	// After the deadline only the PriorityPaths are extracted from the rest of the archive,
+	// without PriorityPaths the extraction stops.
+	Deadline      time.Time
+	PriorityPaths []string
+	// LargeDirectories are pre-created before the extraction, if they have largeDirectoryEntries or more entries.
+	LargeDirectories []largeDirectory
+	// Budgets skip the files over the path groups' size budgets, if set.
+	Budgets *pathBudgets
+	// SparsePaths are written sparse, their zero blocks as holes (the GNU sparse files are written sparse anywhere).
+	SparsePaths []string
+	// AuditOverwrites records the pre-existing files overwritten by the extraction in Overwritten.
+	AuditOverwrites bool
+	// PipelineBuffer is the read-ahead (in Bytes) of the download and the decompression stages of extractArchive,
+	// running them concurrently with the tar parsing. The stages run in the extracting goroutine if it is 0.
+	PipelineBuffer int64
+	// Components splits the extracted entries into components, if set.
+	Components *componentSplitter
+	// PermissionErrors controls the handling of the permission errors of restoring the directories' mode and modification time.
+	PermissionErrors string
+	// Replicas extract the same archive into other directories, concurrently (see restoreInto).
+	Replicas []*Extractor
+	// Confined rejects the symlinks pointing outside of Dir and the entries written through any symlink in Dir,
+	// not only through the extracted ones (see expandNestedArchive).
+	Confined bool
+
+	Collisions []Collision
+	// CopiedLinks counts the hard links restored as copies.
+	CopiedLinks int
+	// SkippedSpecialFiles counts the devices and FIFOs not restored.
+	SkippedSpecialFiles int
+	// SkippedEntries counts the entries excluded by the Filter.
+	SkippedEntries int
+	// BudgetSkippedEntries counts the entries not extracted, because of the time budget.
+	BudgetSkippedEntries int
+	// PreallocatedDirs counts the directories pre-created for the LargeDirectories.
+	PreallocatedDirs int
+	// NestedArchives are the extracted files which are archives themselves (see nestedArchiveFormat).
+	NestedArchives []string
+	// Overwritten are the pre-existing files overwritten by the extraction, if AuditOverwrites is set.
+	Overwritten []overwrittenFile
+	// IgnoredPermissionErrors counts the permission errors ignored by the PermissionErrors policy.
+	IgnoredPermissionErrors int
+	// DecompressionTime is the time extractArchive spent decompressing the archive (see decompressionTimer),
+	// the zstd tool's CPU time for the zstd archives.
+	DecompressionTime time.Duration
+
+	// seen maps the case folded target paths to the first entry's name.
+	seen map[string]string
+	// links are the extracted symlinks, no entry is written through them.
+	links map[string]bool
+	// dirs are the extracted directories, their mode and modification time is applied after their content.
+	dirs []*tar.Header
+	// pool writes the small files, if Workers is more than 1.
+	pool *writerPool
+	// created are the pre-created directories, the files are written into them without creating their parent.
+	created dirSet
+}
+
+// NewExtractor creates a new Extractor which extracts relative entry names into dir.
+func NewExtractor(dir string, relative bool) *Extractor {
+	return &Extractor{
+		Dir:               dir,
+		Relative:          relative,
+		CollisionPolicy:   collisionPolicyOverwrite,
+		Normalization:     normalizationNone,
+		SpecialFilePolicy: specialFilePolicyRestore,
+		Workers:           1,
+		FsyncPolicy:       fsyncNone,
+		PermissionErrors:  permissionErrorsFail,
+		seen:              map[string]string{},
+		links:             map[string]bool{},
+	}
+}
+
+// Extract reads the tar stream and writes its entries to the filesystem.
+// The GNU tar, BSD tar and PAX dialects (long names, sparse files, global records) are restored the same way,
+// the extended attributes (the PAX xattr records of BSD tar) are not restored.
+func (e *Extractor) Extract(r io.Reader) (err error) {
+	if e.created, err = e.preallocateDirs(); err != nil {
+		return fmt.Errorf("failed to create the large directories: %s", err)
+	}
+	if e.Workers > 1 {
+		e.pool = newWriterPool(e.Workers, e.FsyncPolicy == fsyncPerFile, e.CaseInsensitive, e.created)
+		defer func() {
+			if cErr := e.pool.Close(); cErr != nil && err == nil {
+				err = cErr
+			}
+			e.pool = nil
+		}()
+	}
+	if e.FsyncPolicy == fsyncEnd {
+		defer syncFilesystems()
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			if err := e.finalizeDirs(); err != nil {
+				return err
+			}
+			if e.BudgetSkippedEntries > 0 {
+				return errTimeBudgetExceeded
+			}
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read archive entry: %s", err)
+		}
+
+		if err := e.waitPending(hdr); err != nil {
+			return err
+		}
+
+		if !e.Deadline.IsZero() && time.Now().After(e.Deadline) {
+			if len(e.PriorityPaths) == 0 {
+				if err := e.finalizeDirs(); err != nil {
+					return err
+				}
+				return errTimeBudgetExceeded
+			}
+			if !isUnderPath(e.targetPath(hdr.Name), e.PriorityPaths) || !e.linkSourceExists(hdr) {
+				e.BudgetSkippedEntries++
+				continue
+			}
+		}
+
+		if err := e.extractEntry(tr, hdr); err != nil {
+			return fmt.Errorf("failed to extract %s: %s", hdr.Name, err)
+		}
+	}
+}
+
+// waitPending flushes the writer pool, if the entry depends on a file written in the background:
+// a hard link to it or an entry with the same target.
+func (e *Extractor) waitPending(hdr *tar.Header) error {
+	if e.pool == nil {
+		return nil
+	}
+	if e.pool.Pending(e.targetPath(hdr.Name)) || (hdr.Typeflag == tar.TypeLink && e.pool.Pending(e.targetPath(hdr.Linkname))) {
+		return e.pool.Flush()
+	}
+	return nil
+}
+
+func (e *Extractor) extractEntry(tr *tar.Reader, hdr *tar.Header) error {
+	if hdr.Typeflag == tar.TypeXGlobalHeader {
+		// the global PAX records (e.g. git archive's pax_global_header) describe the archive, not an entry
+		log.Debugf("Skipping global PAX header: %s", hdr.Name)
+		return nil
+	}
+
+	target := e.targetPath(hdr.Name)
+
+	if e.Filter.excludes(target) || (hdr.Typeflag == tar.TypeLink && e.Filter.excludes(e.targetPath(hdr.Linkname))) {
+		e.SkippedEntries++
+		return nil
+	}
+
+	if err := e.checkTarget(hdr.Name, target); err != nil {
+		return err
+	}
+	if hdr.Typeflag == tar.TypeLink {
+		if err := e.checkTarget(hdr.Linkname, e.targetPath(hdr.Linkname)); err != nil {
+			return fmt.Errorf("hard link source: %s", err)
+		}
+	}
+
+	if e.Budgets != nil && !e.fitsBudgets(hdr, target) {
+		return nil
+	}
+
+	if hdr.Typeflag != tar.TypeDir {
+		skip, err := e.checkCollision(hdr.Name, target)
+		if err != nil {
+			return err
+		}
+		if skip {
+			return nil
+		}
+		if e.AuditOverwrites {
+			e.auditOverwrite(target, hdr)
+		}
+	}
+	if e.Components != nil {
+		e.Components.add(target, hdr)
+	}
+	if hdr.Typeflag != tar.TypeDir {
+		// the entry replaces the symlink extracted earlier to the same path
+		delete(e.links, target)
+	}
+
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if e.links[target] {
+			// the directory replaces the symlink extracted earlier, instead of being created through it
+			if err := os.Remove(target); err != nil {
+				return err
+			}
+			delete(e.links, target)
+		}
+		// the directory is writable until its content is extracted
+		if err := os.MkdirAll(target, 0700|hdr.FileInfo().Mode().Perm()); err != nil {
+			return err
+		}
+		e.dirs = append(e.dirs, hdr)
+		return nil
+	case tar.TypeReg, tar.TypeRegA, tar.TypeGNUSparse:
+		if nestedArchiveFormat(target) != "" {
+			e.NestedArchives = append(e.NestedArchives, target)
+		}
+		// the holes of sparse files are read as zeros, written as holes again
+		sparse := hdr.Typeflag == tar.TypeGNUSparse || isUnderPath(target, e.SparsePaths)
+		if e.pool != nil && hdr.Size <= smallFileSize && !sparse {
+			content, err := ioutil.ReadAll(tr)
+			if err != nil {
+				return err
+			}
+			e.pool.Submit(target, hdr, content)
+			return nil
+		}
+		return writeFile(tr, target, hdr, e.FsyncPolicy == fsyncPerFile, sparse, e.created)
+	case tar.TypeSymlink:
+		link := normalizeName(hdr.Linkname, e.Normalization)
+		if e.Confined {
+			if err := checkConfinedLink(e.Dir, target, link); err != nil {
+				return err
+			}
+		}
+		if err := prepareTarget(target, e.created); err != nil {
+			return err
+		}
+		if err := os.Symlink(link, target); err != nil {
+			return err
+		}
+		e.links[target] = true
+		return nil
+	case tar.TypeLink:
+		return e.link(e.targetPath(hdr.Linkname), target)
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		return e.special(target, hdr)
+	default:
+		log.Debugf("Skipping unsupported entry type (%c): %s", hdr.Typeflag, hdr.Name)
+		return nil
+	}
+}
+
+// fitsBudgets reports whether the entry is restored within the Budgets, only the regular files are accounted.
+// The hard links to the skipped files are skipped too.
+func (e *Extractor) fitsBudgets(hdr *tar.Header, target string) bool {
+	switch hdr.Typeflag {
+	case tar.TypeReg, tar.TypeRegA, tar.TypeGNUSparse:
+		return e.Budgets.admit(target, hdr.Size)
+	case tar.TypeLink:
+		return e.linkSourceExists(hdr)
+	}
+	return true
+}
+
+// linkSourceExists reports whether the hard link's source is extracted, true for the other entries.
+func (e *Extractor) linkSourceExists(hdr *tar.Header) bool {
+	if hdr.Typeflag != tar.TypeLink {
+		return true
+	}
+	_, err := os.Lstat(e.targetPath(hdr.Linkname))
+	return err == nil
+}
+
+// finalizeDirs applies the directories' mode and modification time in reverse order,
+// so neither restricting a parent's permissions nor writing into a directory affects the others.
+func (e *Extractor) finalizeDirs() error {
+	if e.pool != nil {
+		if err := e.pool.Flush(); err != nil {
+			return err
+		}
+	}
+
+	for i := len(e.dirs) - 1; i >= 0; i-- {
+		hdr := e.dirs[i]
+		target := e.targetPath(hdr.Name)
+
+		mode := hdr.FileInfo().Mode().Perm()
+		if e.Umask != nil {
+			mode &^= *e.Umask
+		}
+		if err := os.Chmod(target, mode); err != nil {
+			if err := e.permissionError(hdr.Name, err); err != nil {
+				return fmt.Errorf("failed to set mode of %s: %s", hdr.Name, err)
+			}
+		}
+		if err := os.Chtimes(target, hdr.ModTime, hdr.ModTime); err != nil {
+			if err := e.permissionError(hdr.Name, err); err != nil {
+				return fmt.Errorf("failed to set modification time of %s: %s", hdr.Name, err)
+			}
+		}
+	}
+	e.dirs = nil
+	return nil
+}
+
+// targetPath returns the filesystem path for the given entry name.
+func (e *Extractor) targetPath(name string) string {
+	name = normalizeName(name, e.Normalization)
+	if e.Relative {
+		name = strings.TrimLeft(name, "/")
+	}
+	if filepath.IsAbs(name) {
+		return filepath.Clean(name)
+	}
+	return filepath.Join(e.Dir, name)
+}
+
+// checkTarget returns an error if the entry would be written outside of Dir (its relative name leaves Dir with `..`)
+// or through a symlink extracted earlier, like tar refuses to.
+func (e *Extractor) checkTarget(name, target string) error {
+	name = normalizeName(name, e.Normalization)
+	if e.Relative || !filepath.IsAbs(name) {
+		if rel, err := filepath.Rel(e.Dir, target); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("%s is outside of %s", name, e.Dir)
+		}
+	}
+	for dir := filepath.Dir(target); dir != filepath.Dir(dir); dir = filepath.Dir(dir) {
+		if e.links[dir] {
+			return fmt.Errorf("%s is written through the extracted symlink %s", name, dir)
+		}
+	}
+	if e.Confined {
+		return checkSymlinkParents(e.Dir, target)
+	}
+	return nil
+}
+
+// checkCollision applies the collision policy and reports whether the entry should be skipped.
+func (e *Extractor) checkCollision(name, target string) (bool, error) {
+	if !e.CaseInsensitive {
+		return false, nil
+	}
+
+	key := strings.ToLower(target)
+	first, ok := e.seen[key]
+	if !ok {
+		e.seen[key] = name
+		return false, nil
+	}
+	if first == name {
+		// the same entry appended again, the later one wins
+		return false, nil
+	}
+
+	e.Collisions = append(e.Collisions, Collision{First: first, Second: name})
+
+	switch e.CollisionPolicy {
+	case collisionPolicyFail:
+		return false, fmt.Errorf("collides with %s on case-insensitive filesystem", first)
+	case collisionPolicySkip:
+		log.Warnf("Skipping %s, collides with %s on case-insensitive filesystem", name, first)
+		return true, nil
+	case collisionPolicyWarn:
+		log.Warnf("%s overwrites %s on case-insensitive filesystem", name, first)
+	default:
+		log.Debugf("%s overwrites %s on case-insensitive filesystem", name, first)
+	}
+	return false, nil
+}
+
+// link restores a hard link, if the link can not be created (for example the source is on a different filesystem)
+// it falls back to copying the source.
+func (e *Extractor) link(source, target string) error {
+	info, err := os.Lstat(source)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("hard link source %s does not exist, it should precede the link in the archive", source)
+		}
+		return fmt.Errorf("failed to check hard link source %s: %s", source, err)
+	}
+
+	if err := prepareTarget(target, e.created); err != nil {
+		return err
+	}
+
+	linkErr := os.Link(source, target)
+	if linkErr == nil {
+		return nil
+	}
+	log.Debugf("Failed to hard link %s to %s, copying: %s", target, source, linkErr)
+
+	if err := copyFile(source, target, info); err != nil {
+		return fmt.Errorf("failed to hard link to %s (%s) and failed to copy it: %s", source, linkErr, err)
+	}
+	e.CopiedLinks++
+	return nil
+}
+
+// special restores a char/block device or a FIFO according to the special file policy.
+func (e *Extractor) special(target string, hdr *tar.Header) error {
+	switch e.SpecialFilePolicy {
+	case specialFilePolicyFail:
+		return fmt.Errorf("archive contains a special file (%c), which is not allowed by the special file policy", hdr.Typeflag)
+	case specialFilePolicySkip:
+		log.Debugf("Skipping special file (%c): %s", hdr.Typeflag, hdr.Name)
+		e.SkippedSpecialFiles++
+		return nil
+	}
+
+	if err := prepareTarget(target, e.created); err != nil {
+		return err
+	}
+
+	mode := uint32(hdr.FileInfo().Mode().Perm())
+	switch hdr.Typeflag {
+	case tar.TypeChar:
+		return syscall.Mknod(target, mode|syscall.S_IFCHR, mkdev(hdr.Devmajor, hdr.Devminor))
+	case tar.TypeBlock:
+		return syscall.Mknod(target, mode|syscall.S_IFBLK, mkdev(hdr.Devmajor, hdr.Devminor))
+	default:
+		return syscall.Mkfifo(target, mode)
+	}
+}
+
+// copyFile copies the regular file at source to target, preserving its mode and modification time.
+func copyFile(source, target string, info os.FileInfo) (err error) {
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file", source)
+	}
+
+	src, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := src.Close(); err != nil {
+			log.Warnf("Failed to close %s: %s", source, err)
+		}
+	}()
+
+	dst, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cErr := dst.Close(); cErr != nil && err == nil {
+			err = cErr
+		}
+	}()
+
+	if _, err := io.Copy(dst, src); err != nil {
+		return err
+	}
+
+	return os.Chtimes(target, info.ModTime(), info.ModTime())
+}
+
+// prepareTarget creates the parent directory of the target (unless it is a created one)
+// and removes the existing file, like tar does.
+func prepareTarget(target string, created dirSet) error {
+	if dir := filepath.Dir(target); !created.contains(dir) {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+	if err := os.Remove(target); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// writeFile writes the regular file entry to target, flushing it to the disk if fsync is set.
+func writeFile(r io.Reader, target string, hdr *tar.Header, fsync, sparse bool, created dirSet) (err error) {
+	if err := prepareTarget(target, created); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, hdr.FileInfo().Mode().Perm())
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cErr := f.Close(); cErr != nil && err == nil {
+			err = cErr
+		}
+	}()
+
+	if sparse {
+		w := &sparseWriter{f: f}
+		if _, err := io.Copy(w, r); err != nil {
+			return err
+		}
+		if err := w.finish(); err != nil {
+			return err
+		}
+	} else if _, err := io.Copy(f, r); err != nil {
+		return err
+	}
+	if fsync {
+		if err := f.Sync(); err != nil {
+			return err
+		}
+	}
+
+	return os.Chtimes(target, hdr.ModTime, hdr.ModTime)
+}
+
+// isCaseInsensitiveFS reports whether the filesystem of the given directory ignores the case of file names.
+func isCaseInsensitiveFS(dir string) (bool, error) {
+	f, err := ioutil.TempFile(dir, "case-probe-")
+	if err != nil {
+		return false, err
+	}
+	pth := f.Name()
+	defer func() {
+		if err := os.Remove(pth); err != nil {
+			log.Warnf("Failed to remove %s: %s", pth, err)
+		}
+	}()
+	if err := f.Close(); err != nil {
+		return false, err
+	}
+
+	_, err = os.Stat(filepath.Join(filepath.Dir(pth), strings.ToUpper(filepath.Base(pth))))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
@@ -0,0 +1,566 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testEntry struct {
+	name     string
+	content  string
+	typeflag byte
+	linkname string
+	mode     int64
+	modTime  time.Time
+}
+
+func createTestArchive(t *testing.T, entries []testEntry) *bytes.Buffer {
+	var buff bytes.Buffer
+	tw := tar.NewWriter(&buff)
+	for _, entry := range entries {
+		hdr := &tar.Header{
+			Name:     entry.name,
+			Mode:     0644,
+			Size:     int64(len(entry.content)),
+			Typeflag: entry.typeflag,
+			Linkname: entry.linkname,
+		}
+		if hdr.Typeflag == 0 {
+			hdr.Typeflag = tar.TypeReg
+		}
+		if entry.mode != 0 {
+			hdr.Mode = entry.mode
+		}
+		if !entry.modTime.IsZero() {
+			hdr.ModTime = entry.modTime
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("failed to write header: %s", err)
+		}
+		if _, err := tw.Write([]byte(entry.content)); err != nil {
+			t.Fatalf("failed to write content: %s", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("failed to close archive: %s", err)
+	}
+	return &buff
+}
+
+func TestExtractor_Extract_caseCollision(t *testing.T) {
+	entries := []testEntry{
+		{name: "node_modules/pkg/README.md", content: "first"},
+		{name: "node_modules/pkg/readme.md", content: "second"},
+		{name: "node_modules/pkg/index.js", content: "index"},
+	}
+
+	tests := []struct {
+		name            string
+		caseInsensitive bool
+		policy          string
+		wantErr         bool
+		wantCollisions  int
+		wantFiles       map[string]string
+	}{
+		{
+			name:            "case-sensitive filesystem",
+			caseInsensitive: false,
+			policy:          collisionPolicyFail,
+			wantCollisions:  0,
+			wantFiles: map[string]string{
+				"node_modules/pkg/README.md": "first",
+				"node_modules/pkg/readme.md": "second",
+			},
+		},
+		{
+			name:            "warn",
+			caseInsensitive: true,
+			policy:          collisionPolicyWarn,
+			wantCollisions:  1,
+			wantFiles: map[string]string{
+				"node_modules/pkg/readme.md": "second",
+				"node_modules/pkg/index.js":  "index",
+			},
+		},
+		{
+			name:            "skip",
+			caseInsensitive: true,
+			policy:          collisionPolicySkip,
+			wantCollisions:  1,
+			wantFiles: map[string]string{
+				"node_modules/pkg/README.md": "first",
+				"node_modules/pkg/index.js":  "index",
+			},
+		},
+		{
+			name:            "fail",
+			caseInsensitive: true,
+			policy:          collisionPolicyFail,
+			wantErr:         true,
+			wantCollisions:  1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "extract-test")
+			if err != nil {
+				t.Fatalf("failed to create temp dir: %s", err)
+			}
+			defer func() {
+				if err := os.RemoveAll(dir); err != nil {
+					t.Logf("failed to remove temp dir: %s", err)
+				}
+			}()
+
+			e := NewExtractor(dir, true)
+			e.CaseInsensitive = tt.caseInsensitive
+			e.CollisionPolicy = tt.policy
+			if err := e.Extract(createTestArchive(t, entries)); (err != nil) != tt.wantErr {
+				t.Fatalf("Extractor.Extract() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(e.Collisions) != tt.wantCollisions {
+				t.Errorf("Extractor.Collisions = %v, want %d collisions", e.Collisions, tt.wantCollisions)
+			}
+
+			for name, want := range tt.wantFiles {
+				b, err := ioutil.ReadFile(filepath.Join(dir, name))
+				if err != nil {
+					t.Errorf("failed to read %s: %s", name, err)
+					continue
+				}
+				if string(b) != want {
+					t.Errorf("%s content = %s, want %s", name, b, want)
+				}
+			}
+		})
+	}
+}
+
+func TestExtractor_Extract_hardLink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "extract-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Logf("failed to remove temp dir: %s", err)
+		}
+	}()
+
+	entries := []testEntry{
+		{name: "store/pkg/index.js", content: "index"},
+		{name: "node_modules/pkg/index.js", typeflag: tar.TypeLink, linkname: "store/pkg/index.js"},
+	}
+
+	e := NewExtractor(dir, true)
+	if err := e.Extract(createTestArchive(t, entries)); err != nil {
+		t.Fatalf("Extractor.Extract() error = %v, wantErr %v", err, nil)
+	}
+
+	source, err := os.Stat(filepath.Join(dir, "store/pkg/index.js"))
+	if err != nil {
+		t.Fatalf("failed to stat link source: %s", err)
+	}
+	target, err := os.Stat(filepath.Join(dir, "node_modules/pkg/index.js"))
+	if err != nil {
+		t.Fatalf("failed to stat link: %s", err)
+	}
+	if !os.SameFile(source, target) && e.CopiedLinks != 1 {
+		t.Errorf("link is neither a hard link nor a copy, CopiedLinks = %d", e.CopiedLinks)
+	}
+
+	t.Log("missing link source")
+	{
+		entries := []testEntry{
+			{name: "node_modules/other/index.js", typeflag: tar.TypeLink, linkname: "store/other/index.js"},
+		}
+		if err := NewExtractor(dir, true).Extract(createTestArchive(t, entries)); err == nil {
+			t.Errorf("Extractor.Extract() error = %v, wantErr %v", err, true)
+		}
+	}
+}
+
+func TestExtractor_Extract_specialFile(t *testing.T) {
+	entries := []testEntry{
+		{name: "pipe", typeflag: tar.TypeFifo},
+	}
+
+	tests := []struct {
+		policy      string
+		wantErr     bool
+		wantExists  bool
+		wantSkipped int
+	}{
+		{policy: specialFilePolicyRestore, wantExists: true},
+		{policy: specialFilePolicySkip, wantSkipped: 1},
+		{policy: specialFilePolicyFail, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "extract-test")
+			if err != nil {
+				t.Fatalf("failed to create temp dir: %s", err)
+			}
+			defer func() {
+				if err := os.RemoveAll(dir); err != nil {
+					t.Logf("failed to remove temp dir: %s", err)
+				}
+			}()
+
+			e := NewExtractor(dir, true)
+			e.SpecialFilePolicy = tt.policy
+			if err := e.Extract(createTestArchive(t, entries)); (err != nil) != tt.wantErr {
+				t.Fatalf("Extractor.Extract() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if e.SkippedSpecialFiles != tt.wantSkipped {
+				t.Errorf("Extractor.SkippedSpecialFiles = %d, want %d", e.SkippedSpecialFiles, tt.wantSkipped)
+			}
+
+			info, err := os.Lstat(filepath.Join(dir, "pipe"))
+			if exists := err == nil; exists != tt.wantExists {
+				t.Fatalf("pipe exists = %v, want %v", exists, tt.wantExists)
+			}
+			if tt.wantExists && info.Mode()&os.ModeNamedPipe == 0 {
+				t.Errorf("pipe mode = %s, want named pipe", info.Mode())
+			}
+		})
+	}
+}
+
+func TestExtractor_Extract_directories(t *testing.T) {
+	dir, err := ioutil.TempDir("", "extract-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer func() {
+		if err := os.Chmod(filepath.Join(dir, "readonly"), 0755); err != nil {
+			t.Logf("failed to chmod: %s", err)
+		}
+		if err := os.RemoveAll(dir); err != nil {
+			t.Logf("failed to remove temp dir: %s", err)
+		}
+	}()
+
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	entries := []testEntry{
+		{name: "empty/", typeflag: tar.TypeDir, mode: 0750, modTime: modTime},
+		{name: "readonly/", typeflag: tar.TypeDir, mode: 0555, modTime: modTime},
+		{name: "readonly/file", content: "content"},
+	}
+
+	if err := NewExtractor(dir, true).Extract(createTestArchive(t, entries)); err != nil {
+		t.Fatalf("Extractor.Extract() error = %v", err)
+	}
+
+	for name, wantMode := range map[string]os.FileMode{"empty": 0750, "readonly": 0555} {
+		info, err := os.Stat(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatalf("failed to stat %s: %s", name, err)
+		}
+		if info.Mode().Perm() != wantMode {
+			t.Errorf("%s mode = %s, want %s", name, info.Mode().Perm(), wantMode)
+		}
+		if !info.ModTime().Equal(modTime) {
+			t.Errorf("%s modification time = %s, want %s", name, info.ModTime(), modTime)
+		}
+	}
+}
+
+// tarDialectArchive creates an archive with long names, links and the given format's specific records,
+// like the archives of GNU tar (Linux stacks), BSD tar (macOS stacks) and git archive.
+func tarDialectArchive(t *testing.T, format tar.Format, longName string) *bytes.Buffer {
+	var buff bytes.Buffer
+	tw := tar.NewWriter(&buff)
+
+	var headers []*tar.Header
+	if format == tar.FormatPAX {
+		// git archive's global comment
+		headers = append(headers, &tar.Header{Typeflag: tar.TypeXGlobalHeader, Name: "pax_global_header", PAXRecords: map[string]string{"comment": "0123456789abcdef"}})
+	}
+	file := &tar.Header{Name: "dir/file", Mode: 0644, Size: int64(len("content")), Typeflag: tar.TypeReg, Format: format}
+	if format == tar.FormatPAX {
+		// BSD tar's extended attributes
+		file.PAXRecords = map[string]string{"SCHILY.xattr.com.apple.quarantine": "0081", "LIBARCHIVE.xattr.com.apple.quarantine": "MDA4MQ"}
+	}
+	headers = append(headers,
+		&tar.Header{Name: "dir/", Mode: 0755, Typeflag: tar.TypeDir, Format: format},
+		file,
+		&tar.Header{Name: longName, Mode: 0644, Size: int64(len("content")), Typeflag: tar.TypeReg, Format: format},
+		&tar.Header{Name: "dir/symlink", Linkname: "../" + longName, Typeflag: tar.TypeSymlink, Format: format},
+		&tar.Header{Name: "dir/hardlink", Linkname: longName, Typeflag: tar.TypeLink, Format: format},
+	)
+
+	for _, hdr := range headers {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("failed to write header: %s", err)
+		}
+		if hdr.Size > 0 {
+			if _, err := tw.Write([]byte("content")); err != nil {
+				t.Fatalf("failed to write content: %s", err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("failed to close archive: %s", err)
+	}
+	return &buff
+}
+
+func TestExtractor_Extract_tarDialects(t *testing.T) {
+	longName := "long/" + strings.Repeat("directory/", 12) + "file"
+
+	tests := []struct {
+		name     string
+		format   tar.Format
+		longName string
+	}{
+		{name: "ustar", format: tar.FormatUSTAR, longName: "dir/short"},
+		{name: "pax", format: tar.FormatPAX, longName: longName},
+		{name: "gnu", format: tar.FormatGNU, longName: longName},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "extract-test")
+			if err != nil {
+				t.Fatalf("failed to create temp dir: %s", err)
+			}
+			defer func() {
+				if err := os.RemoveAll(dir); err != nil {
+					t.Logf("failed to remove temp dir: %s", err)
+				}
+			}()
+
+			archive := tarDialectArchive(t, tt.format, tt.longName)
+			if _, hdr, _, err := readFirstEntry(bytes.NewReader(archive.Bytes())); err != nil || hdr.Name != "dir/" {
+				t.Errorf("readFirstEntry() = %v, %v, want dir/", hdr, err)
+			}
+
+			if err := NewExtractor(dir, true).Extract(archive); err != nil {
+				t.Fatalf("Extractor.Extract() error = %v", err)
+			}
+
+			for _, name := range []string{"dir/file", tt.longName, "dir/symlink", "dir/hardlink"} {
+				b, err := ioutil.ReadFile(filepath.Join(dir, name))
+				if err != nil {
+					t.Errorf("failed to read %s: %s", name, err)
+					continue
+				}
+				if string(b) != "content" {
+					t.Errorf("%s content = %s, want content", name, b)
+				}
+			}
+			if _, err := os.Lstat(filepath.Join(dir, "pax_global_header")); !os.IsNotExist(err) {
+				t.Errorf("global PAX header restored as a file: %v", err)
+			}
+		})
+	}
+}
+
+// TestExtractor_Extract_gnuTar extracts the archives created by the tar tool of the stack, in its formats.
+func TestExtractor_Extract_gnuTar(t *testing.T) {
+	out, err := exec.Command("tar", "--version").CombinedOutput()
+	if err != nil || !strings.Contains(string(out), "GNU tar") {
+		t.Skip("GNU tar is not available")
+	}
+
+	src, err := ioutil.TempDir("", "extract-test-src")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(src); err != nil {
+			t.Logf("failed to remove temp dir: %s", err)
+		}
+	}()
+
+	longName := "long/" + strings.Repeat("directory/", 12) + "file"
+	if err := os.MkdirAll(filepath.Dir(filepath.Join(src, longName)), 0755); err != nil {
+		t.Fatalf("failed to create directory: %s", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(src, longName), []byte("content"), 0644); err != nil {
+		t.Fatalf("failed to write file: %s", err)
+	}
+	sparse, err := os.Create(filepath.Join(src, "sparse"))
+	if err != nil {
+		t.Fatalf("failed to create sparse file: %s", err)
+	}
+	if _, err := sparse.WriteAt([]byte("end"), 1024*1024); err != nil {
+		t.Fatalf("failed to write sparse file: %s", err)
+	}
+	if err := sparse.Close(); err != nil {
+		t.Fatalf("failed to close sparse file: %s", err)
+	}
+
+	for _, format := range []string{"gnu", "oldgnu", "posix"} {
+		t.Run(format, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "extract-test")
+			if err != nil {
+				t.Fatalf("failed to create temp dir: %s", err)
+			}
+			defer func() {
+				if err := os.RemoveAll(dir); err != nil {
+					t.Logf("failed to remove temp dir: %s", err)
+				}
+			}()
+
+			archive, err := exec.Command("tar", "-c", "--sparse", "--format", format, "-C", src, ".").Output()
+			if err != nil {
+				t.Fatalf("failed to create archive: %s", err)
+			}
+
+			if err := NewExtractor(dir, true).Extract(bytes.NewReader(archive)); err != nil {
+				t.Fatalf("Extractor.Extract() error = %v", err)
+			}
+
+			if b, err := ioutil.ReadFile(filepath.Join(dir, longName)); err != nil || string(b) != "content" {
+				t.Errorf("%s = %s, %v, want content", longName, b, err)
+			}
+			b, err := ioutil.ReadFile(filepath.Join(dir, "sparse"))
+			if err != nil {
+				t.Fatalf("failed to read sparse file: %s", err)
+			}
+			if len(b) != 1024*1024+3 || string(b[len(b)-3:]) != "end" {
+				t.Errorf("sparse file size = %d, want %d", len(b), 1024*1024+3)
+			}
+		})
+	}
+}
+
+func TestExtractor_Extract_timeBudget(t *testing.T) {
+	entries := []testEntry{
+		{name: "build/output", content: "output"},
+		{name: "pods/Pod/file", content: "pod"},
+		{name: "pods/Pod/link", typeflag: tar.TypeLink, linkname: "build/output"},
+	}
+
+	tests := []struct {
+		name          string
+		priorityPaths []string
+		wantFiles     []string
+		wantSkipped   int
+	}{
+		{name: "no priority paths"},
+		{name: "priority paths", priorityPaths: []string{"pods"}, wantFiles: []string{"pods/Pod/file"}, wantSkipped: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "extract-test")
+			if err != nil {
+				t.Fatalf("failed to create temp dir: %s", err)
+			}
+			defer func() {
+				if err := os.RemoveAll(dir); err != nil {
+					t.Logf("failed to remove temp dir: %s", err)
+				}
+			}()
+
+			e := NewExtractor(dir, true)
+			e.Deadline = time.Now().Add(-time.Second)
+			for _, pth := range tt.priorityPaths {
+				e.PriorityPaths = append(e.PriorityPaths, filepath.Join(dir, pth))
+			}
+			if err := e.Extract(createTestArchive(t, entries)); err != errTimeBudgetExceeded {
+				t.Fatalf("Extractor.Extract() error = %v, want %v", err, errTimeBudgetExceeded)
+			}
+			if e.BudgetSkippedEntries != tt.wantSkipped {
+				t.Errorf("Extractor.BudgetSkippedEntries = %d, want %d", e.BudgetSkippedEntries, tt.wantSkipped)
+			}
+
+			for _, entry := range entries {
+				_, err := os.Lstat(filepath.Join(dir, entry.name))
+				exists := err == nil
+				want := false
+				for _, name := range tt.wantFiles {
+					want = want || name == entry.name
+				}
+				if exists != want {
+					t.Errorf("%s exists = %v, want %v", entry.name, exists, want)
+				}
+			}
+		})
+	}
+}
+
+func TestExtractor_Extract_unsafePaths(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "extract-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(tmpDir); err != nil {
+			t.Logf("failed to remove temp dir: %s", err)
+		}
+	}()
+	outside := filepath.Join(tmpDir, "outside")
+
+	tests := []struct {
+		name    string
+		entries []testEntry
+		wantErr bool
+	}{
+		{
+			name:    "parent directory",
+			entries: []testEntry{{name: "../outside/evil.txt", content: "evil"}},
+			wantErr: true,
+		},
+		{
+			name:    "hard link to outside",
+			entries: []testEntry{{name: "evil.txt", typeflag: tar.TypeLink, linkname: "../outside/secret.txt"}},
+			wantErr: true,
+		},
+		{
+			name: "through extracted symlink",
+			entries: []testEntry{
+				{name: "link", typeflag: tar.TypeSymlink, linkname: outside},
+				{name: "link/evil.txt", content: "evil"},
+			},
+			wantErr: true,
+		},
+		{
+			name: "directory replacing extracted symlink",
+			entries: []testEntry{
+				{name: "link", typeflag: tar.TypeSymlink, linkname: outside},
+				{name: "link/", typeflag: tar.TypeDir, mode: 0755},
+				{name: "link/evil.txt", content: "evil"},
+			},
+		},
+		{
+			name: "symlink within the directory",
+			entries: []testEntry{
+				{name: "real/a.txt", content: "a"},
+				{name: "link", typeflag: tar.TypeSymlink, linkname: "real"},
+				{name: "./real/b.txt", content: "b"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, pth := range []string{outside, filepath.Join(tmpDir, "dir")} {
+				if err := os.RemoveAll(pth); err != nil {
+					t.Fatalf("failed to remove %s: %s", pth, err)
+				}
+				if err := os.MkdirAll(pth, 0755); err != nil {
+					t.Fatalf("failed to create %s: %s", pth, err)
+				}
+			}
+			if err := ioutil.WriteFile(filepath.Join(outside, "secret.txt"), []byte("secret"), 0644); err != nil {
+				t.Fatalf("failed to write file: %s", err)
+			}
+
+			e := NewExtractor(filepath.Join(tmpDir, "dir"), true)
+			if err := e.Extract(createTestArchive(t, tt.entries)); (err != nil) != tt.wantErr {
+				t.Fatalf("Extractor.Extract() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if _, err := os.Lstat(filepath.Join(outside, "evil.txt")); err == nil {
+				t.Errorf("%s is written outside of the directory", "evil.txt")
+			}
+		})
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// blobCacheEntry is a build's directory in the blob cache root.
+type blobCacheEntry struct {
+	Path     string
+	Size     int64
+	LastUsed time.Time
+}
+
+// listBlobCacheEntries returns the builds' directories of the root with their size and latest modification.
+func listBlobCacheEntries(root string) ([]blobCacheEntry, error) {
+	infos, err := ioutil.ReadDir(root)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []blobCacheEntry
+	for _, info := range infos {
+		entry := blobCacheEntry{Path: filepath.Join(root, info.Name())}
+		if err := filepath.Walk(entry.Path, func(_ string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !info.IsDir() {
+				entry.Size += info.Size()
+			}
+			if info.ModTime().After(entry.LastUsed) {
+				entry.LastUsed = info.ModTime()
+			}
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// gcBlobCaches removes the builds' directories of the root not used for maxAge,
+// then the least recently used ones while the root is larger than maxSize (in Bytes).
+// The keep directory (the current build's) is never removed, a 0 limit is disabled.
+// It returns the number of removed directories and the freed Bytes.
+func gcBlobCaches(root, keep string, maxAge time.Duration, maxSize int64, now time.Time) (int, int64, error) {
+	entries, err := listBlobCacheEntries(root)
+	if err != nil {
+		return 0, 0, err
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].LastUsed.Before(entries[j].LastUsed) })
+
+	var total int64
+	for _, entry := range entries {
+		total += entry.Size
+	}
+
+	var removed int
+	var freed int64
+	for _, entry := range entries {
+		if entry.Path == keep {
+			continue
+		}
+		expired := maxAge > 0 && now.Sub(entry.LastUsed) > maxAge
+		oversized := maxSize > 0 && total > maxSize
+		if !expired && !oversized {
+			continue
+		}
+
+		if err := os.RemoveAll(entry.Path); err != nil {
+			return removed, freed, err
+		}
+		removed++
+		freed += entry.Size
+		total -= entry.Size
+	}
+	return removed, freed, nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_gcBlobCaches(t *testing.T) {
+	now := time.Date(2020, 1, 10, 0, 0, 0, 0, time.UTC)
+	builds := []struct {
+		slug string
+		size int
+		age  time.Duration
+	}{
+		{slug: "current", size: 400, age: 100 * time.Hour},
+		{slug: "expired", size: 100, age: 80 * time.Hour},
+		{slug: "old", size: 300, age: 10 * time.Hour},
+		{slug: "recent", size: 300, age: time.Hour},
+	}
+
+	tests := []struct {
+		name        string
+		maxAge      time.Duration
+		maxSize     int64
+		wantKept    []string
+		wantRemoved int
+		wantFreed   int64
+	}{
+		{name: "no limits", wantKept: []string{"current", "expired", "old", "recent"}},
+		{name: "age limit", maxAge: 72 * time.Hour, wantKept: []string{"current", "old", "recent"}, wantRemoved: 1, wantFreed: 100},
+		{name: "size limit", maxSize: 700, wantKept: []string{"current", "recent"}, wantRemoved: 2, wantFreed: 400},
+		{name: "size limit kept by the current build", maxSize: 100, wantKept: []string{"current"}, wantRemoved: 3, wantFreed: 700},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root, err := ioutil.TempDir("", "gc-test")
+			if err != nil {
+				t.Fatalf("failed to create temp dir: %s", err)
+			}
+			defer func() {
+				if err := os.RemoveAll(root); err != nil {
+					t.Logf("failed to remove temp dir: %s", err)
+				}
+			}()
+
+			for _, build := range builds {
+				dir := filepath.Join(root, build.slug)
+				if err := os.MkdirAll(dir, 0700); err != nil {
+					t.Fatalf("failed to create dir: %s", err)
+				}
+				pth := filepath.Join(dir, "archive.blob")
+				if err := ioutil.WriteFile(pth, []byte(strings.Repeat("x", build.size)), 0600); err != nil {
+					t.Fatalf("failed to write file: %s", err)
+				}
+				modTime := now.Add(-build.age)
+				for _, p := range []string{pth, dir} {
+					if err := os.Chtimes(p, modTime, modTime); err != nil {
+						t.Fatalf("failed to set modification time: %s", err)
+					}
+				}
+			}
+
+			removed, freed, err := gcBlobCaches(root, filepath.Join(root, "current"), tt.maxAge, tt.maxSize, now)
+			if err != nil {
+				t.Fatalf("gcBlobCaches() error = %v", err)
+			}
+			if removed != tt.wantRemoved || freed != tt.wantFreed {
+				t.Errorf("gcBlobCaches() = %d, %d, want %d, %d", removed, freed, tt.wantRemoved, tt.wantFreed)
+			}
+
+			infos, err := ioutil.ReadDir(root)
+			if err != nil {
+				t.Fatalf("failed to read dir: %s", err)
+			}
+			var kept []string
+			for _, info := range infos {
+				kept = append(kept, info.Name())
+			}
+			sort.Strings(kept)
+			if !reflect.DeepEqual(kept, tt.wantKept) {
+				t.Errorf("kept = %v, want %v", kept, tt.wantKept)
+			}
+		})
+	}
+
+	t.Log("missing root")
+	{
+		if _, _, err := gcBlobCaches(filepath.Join(os.TempDir(), "gc-test-missing"), "", time.Hour, 1, now); err != nil {
+			t.Errorf("gcBlobCaches() error = %v, want nil", err)
+		}
+	}
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+const (
+	// googleStorageScope is the scope of the access tokens, reading the GCS objects.
+	googleStorageScope = "https://www.googleapis.com/auth/devstorage.read_only"
+	googleCloudScope   = "https://www.googleapis.com/auth/cloud-platform"
+
+	googleTokenURL        = "https://oauth2.googleapis.com/token"
+	googleSTSTokenURL     = "https://sts.googleapis.com/v1/token"
+	googleMetadataHost    = "169.254.169.254"
+	googleTokenLifetime   = time.Hour
+	googleMetadataTimeout = 2 * time.Second
+
+	googleJWTBearerGrant   = "urn:ietf:params:oauth:grant-type:jwt-bearer"
+	googleTokenExchange    = "urn:ietf:params:oauth:grant-type:token-exchange"
+	googleAccessTokenType  = "urn:ietf:params:oauth:token-type:access_token"
+	googleCredentialsADC   = "application_default_credentials.json"
+	googleServiceAccount   = "service_account"
+	googleAuthorizedUser   = "authorized_user"
+	googleExternalAccount  = "external_account"
+	googleSubjectTokenJSON = "json"
+)
+
+// googleCredentialsFile is the JSON credentials file of the Application Default Credentials,
+// holding a service account key, a gcloud user's refresh token or a workload identity federation config.
+type googleCredentialsFile struct {
+	Type string `json:"type"`
+
+	// service_account
+	ClientEmail  string `json:"client_email"`
+	PrivateKey   string `json:"private_key"`
+	PrivateKeyID string `json:"private_key_id"`
+	TokenURI     string `json:"token_uri"`
+
+	// authorized_user
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	RefreshToken string `json:"refresh_token"`
+
+	// external_account
+	Audience                       string                 `json:"audience"`
+	SubjectTokenType               string                 `json:"subject_token_type"`
+	TokenURL                       string                 `json:"token_url"`
+	ServiceAccountImpersonationURL string                 `json:"service_account_impersonation_url"`
+	CredentialSource               googleCredentialSource `json:"credential_source"`
+}
+
+// googleCredentialSource is the source of a workload identity federation's subject token (e.g. an OIDC token).
+type googleCredentialSource struct {
+	File          string            `json:"file"`
+	URL           string            `json:"url"`
+	Headers       map[string]string `json:"headers"`
+	EnvironmentID string            `json:"environment_id"`
+	Executable    json.RawMessage   `json:"executable"`
+	Format        struct {
+		Type                  string `json:"type"`
+		SubjectTokenFieldName string `json:"subject_token_field_name"`
+	} `json:"format"`
+}
+
+// newGoogleTokenSource finds the Application Default Credentials, like the Google Cloud SDKs do:
+// the credentials file (GOOGLE_APPLICATION_CREDENTIALS), gcloud's well-known file (`gcloud auth application-default login`),
+// then the metadata server of GCE, GKE (workload identity) and Cloud Run.
+func newGoogleTokenSource(credentialsFile string, getenv func(string) string, home string, scopes []string) (tokenSource, error) {
+	pth := credentialsFile
+	if pth == "" {
+		configDir := getenv("CLOUDSDK_CONFIG")
+		if configDir == "" {
+			configDir = filepath.Join(home, ".config", "gcloud")
+		}
+		candidate := filepath.Join(configDir, googleCredentialsADC)
+		if _, err := os.Stat(candidate); err == nil {
+			pth = candidate
+		}
+	}
+	if pth == "" {
+		host := getenv("GCE_METADATA_HOST")
+		if host == "" {
+			host = googleMetadataHost
+		}
+		return &metadataGoogleCredentials{Endpoint: "http://" + host, Scopes: scopes}, nil
+	}
+
+	b, err := ioutil.ReadFile(pth)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the credentials file: %s", err)
+	}
+	var file googleCredentialsFile
+	if err := json.Unmarshal(b, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse the credentials file (%s): %s", pth, err)
+	}
+	log.Debugf("Google credentials file: %s (%s)", pth, file.Type)
+
+	switch file.Type {
+	case googleServiceAccount:
+		key, err := parseRSAPrivateKey(file.PrivateKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid service account key: %s", err)
+		}
+		addSecret(file.PrivateKey)
+		s := &serviceAccountGoogleCredentials{Email: file.ClientEmail, Key: key, KeyID: file.PrivateKeyID, TokenURL: file.TokenURI, Scopes: scopes}
+		if s.TokenURL == "" {
+			s.TokenURL = googleTokenURL
+		}
+		return s, nil
+	case googleAuthorizedUser:
+		addSecret(file.ClientSecret)
+		addSecret(file.RefreshToken)
+		return &authorizedUserGoogleCredentials{ClientID: file.ClientID, ClientSecret: file.ClientSecret, RefreshToken: file.RefreshToken, TokenURL: googleTokenURL}, nil
+	case googleExternalAccount:
+		source := file.CredentialSource
+		if source.EnvironmentID != "" || len(source.Executable) > 0 || (source.File == "" && source.URL == "") {
+			return nil, fmt.Errorf("unsupported workload identity credential source, only file and url sources are supported")
+		}
+		s := &externalAccountGoogleCredentials{
+			Audience:         file.Audience,
+			SubjectTokenType: file.SubjectTokenType,
+			TokenURL:         file.TokenURL,
+			ImpersonationURL: file.ServiceAccountImpersonationURL,
+			Source:           source,
+			Scopes:           scopes,
+		}
+		if s.TokenURL == "" {
+			s.TokenURL = googleSTSTokenURL
+		}
+		return s, nil
+	default:
+		return nil, fmt.Errorf("unsupported credentials type (%s) in %s", file.Type, pth)
+	}
+}
+
+// parseRSAPrivateKey parses the PEM encoded PKCS #8 (or PKCS #1) RSA private key of a service account.
+func parseRSAPrivateKey(s string) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(s))
+	if block == nil {
+		return nil, fmt.Errorf("no PEM encoded key found")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("not an RSA private key")
+	}
+	return key, nil
+}
+
+// serviceAccountGoogleCredentials gets the access tokens with a service account key's signed JWT (RFC 7523).
+type serviceAccountGoogleCredentials struct {
+	Email    string
+	Key      *rsa.PrivateKey
+	KeyID    string
+	TokenURL string
+	Scopes   []string
+
+	// now returns the JWT's issue time, time.Now if nil.
+	now func() time.Time
+}
+
+// Name implements the tokenSource interface.
+func (s *serviceAccountGoogleCredentials) Name() string {
+	return "service account " + s.Email
+}
+
+// Token implements the tokenSource interface.
+func (s *serviceAccountGoogleCredentials) Token() (bearerToken, error) {
+	now := time.Now
+	if s.now != nil {
+		now = s.now
+	}
+	iat := now()
+	assertion, err := signJWT(s.Key, s.KeyID, map[string]interface{}{
+		"iss":   s.Email,
+		"scope": strings.Join(s.Scopes, " "),
+		"aud":   s.TokenURL,
+		"iat":   iat.Unix(),
+		"exp":   iat.Add(googleTokenLifetime).Unix(),
+	})
+	if err != nil {
+		return bearerToken{}, err
+	}
+	return postTokenForm(s.TokenURL, url.Values{"grant_type": {googleJWTBearerGrant}, "assertion": {assertion}})
+}
+
+// signJWT returns the RS256 signed JWT of the claims.
+func signJWT(key *rsa.PrivateKey, keyID string, claims map[string]interface{}) (string, error) {
+	header := map[string]string{"alg": "RS256", "typ": "JWT"}
+	if keyID != "" {
+		header["kid"] = keyID
+	}
+	var parts []string
+	for _, v := range []interface{}{header, claims} {
+		b, err := json.Marshal(v)
+		if err != nil {
+			return "", err
+		}
+		parts = append(parts, base64.RawURLEncoding.EncodeToString(b))
+	}
+
+	sum := sha256.Sum256([]byte(strings.Join(parts, ".")))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+	if err != nil {
+		return "", fmt.Errorf("failed to sign the JWT: %s", err)
+	}
+	return strings.Join(append(parts, base64.RawURLEncoding.EncodeToString(signature)), "."), nil
+}
+
+// authorizedUserGoogleCredentials gets the access tokens with the refresh token of `gcloud auth application-default login`.
+type authorizedUserGoogleCredentials struct {
+	ClientID     string
+	ClientSecret string
+	RefreshToken string
+	TokenURL     string
+}
+
+// Name implements the tokenSource interface.
+func (s *authorizedUserGoogleCredentials) Name() string {
+	return "gcloud user credentials"
+}
+
+// Token implements the tokenSource interface.
+func (s *authorizedUserGoogleCredentials) Token() (bearerToken, error) {
+	return postTokenForm(s.TokenURL, url.Values{
+		"grant_type":    {"refresh_token"},
+		"client_id":     {s.ClientID},
+		"client_secret": {s.ClientSecret},
+		"refresh_token": {s.RefreshToken},
+	})
+}
+
+// externalAccountGoogleCredentials exchanges a workload identity federation's subject token (e.g. the CI's OIDC token)
+// for an access token with the Security Token Service, then impersonates the service account if configured.
+type externalAccountGoogleCredentials struct {
+	Audience         string
+	SubjectTokenType string
+	TokenURL         string
+	ImpersonationURL string
+	Source           googleCredentialSource
+	Scopes           []string
+}
+
+// Name implements the tokenSource interface.
+func (s *externalAccountGoogleCredentials) Name() string {
+	return "workload identity federation"
+}
+
+// Token implements the tokenSource interface.
+func (s *externalAccountGoogleCredentials) Token() (bearerToken, error) {
+	subjectToken, err := s.subjectToken()
+	if err != nil {
+		return bearerToken{}, fmt.Errorf("failed to get the subject token: %s", err)
+	}
+	addSecret(subjectToken)
+
+	scopes := s.Scopes
+	if s.ImpersonationURL != "" {
+		scopes = []string{googleCloudScope}
+	}
+	token, err := postTokenForm(s.TokenURL, url.Values{
+		"grant_type":           {googleTokenExchange},
+		"audience":             {s.Audience},
+		"scope":                {strings.Join(scopes, " ")},
+		"requested_token_type": {googleAccessTokenType},
+		"subject_token":        {subjectToken},
+		"subject_token_type":   {s.SubjectTokenType},
+	})
+	if err != nil {
+		return bearerToken{}, fmt.Errorf("failed to exchange the subject token: %s", err)
+	}
+	if s.ImpersonationURL == "" {
+		return token, nil
+	}
+	addSecret(token.AccessToken)
+
+	body, err := json.Marshal(map[string]interface{}{"scope": s.Scopes, "lifetime": fmt.Sprintf("%ds", int(googleTokenLifetime.Seconds()))})
+	if err != nil {
+		return bearerToken{}, err
+	}
+	req, err := http.NewRequest("POST", s.ImpersonationURL, bytes.NewReader(body))
+	if err != nil {
+		return bearerToken{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token.AccessToken)
+
+	var resp struct {
+		AccessToken string    `json:"accessToken"`
+		ExpireTime  time.Time `json:"expireTime"`
+	}
+	if err := doTokenRequest(req, oauth2TokenTimeout, &resp); err != nil {
+		return bearerToken{}, fmt.Errorf("failed to impersonate the service account: %s", err)
+	}
+	return bearerToken{AccessToken: resp.AccessToken, Expires: resp.ExpireTime}, nil
+}
+
+// subjectToken reads the subject token from the credential source's file or URL,
+// the whole content or a field of its JSON.
+func (s *externalAccountGoogleCredentials) subjectToken() (string, error) {
+	var content string
+	if s.Source.File != "" {
+		b, err := ioutil.ReadFile(s.Source.File)
+		if err != nil {
+			return "", err
+		}
+		content = string(b)
+	} else {
+		req, err := http.NewRequest("GET", s.Source.URL, nil)
+		if err != nil {
+			return "", err
+		}
+		for name, value := range s.Source.Headers {
+			req.Header.Set(name, value)
+		}
+		resp, err := (&http.Client{Timeout: oauth2TokenTimeout}).Do(req)
+		if err != nil {
+			return "", err
+		}
+		if content, err = readMetadataResponse(resp); err != nil {
+			return "", err
+		}
+	}
+
+	if s.Source.Format.Type != googleSubjectTokenJSON {
+		return strings.TrimSpace(content), nil
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal([]byte(content), &fields); err != nil {
+		return "", fmt.Errorf("failed to parse the subject token JSON: %s", err)
+	}
+	token, ok := fields[s.Source.Format.SubjectTokenFieldName].(string)
+	if !ok || token == "" {
+		return "", fmt.Errorf("no %s field in the subject token JSON", s.Source.Format.SubjectTokenFieldName)
+	}
+	return token, nil
+}
+
+// metadataGoogleCredentials gets the access tokens of the attached service account from the metadata server
+// (GCE instances, GKE workload identity, Cloud Run).
+type metadataGoogleCredentials struct {
+	Endpoint string
+	Scopes   []string
+}
+
+// Name implements the tokenSource interface.
+func (s *metadataGoogleCredentials) Name() string {
+	return "metadata server"
+}
+
+// Token implements the tokenSource interface.
+func (s *metadataGoogleCredentials) Token() (bearerToken, error) {
+	u := strings.TrimSuffix(s.Endpoint, "/") + "/computeMetadata/v1/instance/service-accounts/default/token"
+	if len(s.Scopes) > 0 {
+		u += "?" + url.Values{"scopes": {strings.Join(s.Scopes, ",")}}.Encode()
+	}
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return bearerToken{}, err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+
+	var resp oauth2TokenResponse
+	if err := doTokenRequest(req, googleMetadataTimeout, &resp); err != nil {
+		return bearerToken{}, fmt.Errorf("no Google credentials found (credentials file, gcloud credentials or metadata server): %s", err)
+	}
+	return resp.token(), nil
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeGoogleCredentials(t *testing.T, dir string, v interface{}) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatalf("failed to marshal credentials: %s", err)
+	}
+	pth := filepath.Join(dir, "credentials.json")
+	if err := ioutil.WriteFile(pth, b, 0600); err != nil {
+		t.Fatalf("failed to write file: %s", err)
+	}
+	return pth
+}
+
+func TestNewGoogleTokenSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "googlecreds-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Logf("failed to remove temp dir: %s", err)
+		}
+	}()
+
+	env := map[string]string{"GCE_METADATA_HOST": "metadata.test"}
+	getenv := func(key string) string { return env[key] }
+
+	t.Log("metadata server without credentials files")
+	{
+		source, err := newGoogleTokenSource("", getenv, dir, nil)
+		if err != nil {
+			t.Fatalf("newGoogleTokenSource() error = %v", err)
+		}
+		if s, ok := source.(*metadataGoogleCredentials); !ok || s.Endpoint != "http://metadata.test" {
+			t.Errorf("newGoogleTokenSource() = %#v, want the metadata server", source)
+		}
+	}
+
+	t.Log("gcloud credentials")
+	{
+		configDir := filepath.Join(dir, ".config", "gcloud")
+		if err := os.MkdirAll(configDir, 0700); err != nil {
+			t.Fatalf("failed to create dir: %s", err)
+		}
+		b := []byte(`{"type": "authorized_user", "client_id": "gcloud", "client_secret": "gcloud-client-secret", "refresh_token": "gcloud-refresh"}`)
+		if err := ioutil.WriteFile(filepath.Join(configDir, "application_default_credentials.json"), b, 0600); err != nil {
+			t.Fatalf("failed to write file: %s", err)
+		}
+		source, err := newGoogleTokenSource("", getenv, dir, nil)
+		if err != nil {
+			t.Fatalf("newGoogleTokenSource() error = %v", err)
+		}
+		if s, ok := source.(*authorizedUserGoogleCredentials); !ok || s.RefreshToken != "gcloud-refresh" {
+			t.Errorf("newGoogleTokenSource() = %#v, want the gcloud user credentials", source)
+		}
+	}
+
+	t.Log("unsupported workload identity source")
+	{
+		pth := writeGoogleCredentials(t, dir, map[string]interface{}{
+			"type":              "external_account",
+			"credential_source": map[string]string{"environment_id": "aws1"},
+		})
+		if _, err := newGoogleTokenSource(pth, getenv, dir, nil); err == nil {
+			t.Errorf("newGoogleTokenSource() error = nil, want error")
+		}
+	}
+}
+
+func TestServiceAccountGoogleCredentials_Token(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("failed to marshal key: %s", err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Errorf("failed to parse form: %s", err)
+		}
+		parts := strings.Split(r.Form.Get("assertion"), ".")
+		if r.Form.Get("grant_type") != googleJWTBearerGrant || len(parts) != 3 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+		sum := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+		if err != nil || rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, sum[:], signature) != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		claims, err := base64.RawURLEncoding.DecodeString(parts[1])
+		if err != nil || !strings.Contains(string(claims), `"iss":"cache@project.iam.gserviceaccount.com"`) || !strings.Contains(string(claims), `"scope":"`+googleStorageScope+`"`) {
+			t.Errorf("JWT claims = %s", claims)
+		}
+		if _, err := w.Write([]byte(`{"access_token": "sa-token", "expires_in": 3600}`)); err != nil {
+			t.Errorf("failed to write response: %s", err)
+		}
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "googlecreds-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Logf("failed to remove temp dir: %s", err)
+		}
+	}()
+	pth := writeGoogleCredentials(t, dir, map[string]string{
+		"type":         "service_account",
+		"client_email": "cache@project.iam.gserviceaccount.com",
+		"private_key":  string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		"token_uri":    server.URL,
+	})
+
+	source, err := newGoogleTokenSource(pth, func(string) string { return "" }, dir, []string{googleStorageScope})
+	if err != nil {
+		t.Fatalf("newGoogleTokenSource() error = %v", err)
+	}
+	token, err := source.Token()
+	if err != nil {
+		t.Fatalf("serviceAccountGoogleCredentials.Token() error = %v", err)
+	}
+	if token.AccessToken != "sa-token" || token.Expires.IsZero() {
+		t.Errorf("serviceAccountGoogleCredentials.Token() = %+v, want sa-token", token)
+	}
+}
+
+func TestExternalAccountGoogleCredentials_Token(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body string
+		switch r.URL.Path {
+		case "/oidc":
+			if r.Header.Get("Authorization") != "Bearer ci-request-token" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			body = `{"value": "oidc-jwt"}`
+		case "/sts":
+			if err := r.ParseForm(); err != nil {
+				t.Errorf("failed to parse form: %s", err)
+			}
+			if r.Form.Get("grant_type") != googleTokenExchange || r.Form.Get("subject_token") != "oidc-jwt" || r.Form.Get("scope") != googleCloudScope {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			body = `{"access_token": "federated-token", "expires_in": 3600}`
+		case "/impersonate":
+			if r.Header.Get("Authorization") != "Bearer federated-token" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			body = `{"accessToken": "impersonated-token", "expireTime": "2030-01-01T00:00:00Z"}`
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if _, err := w.Write([]byte(body)); err != nil {
+			t.Errorf("failed to write response: %s", err)
+		}
+	}))
+	defer server.Close()
+
+	s := &externalAccountGoogleCredentials{
+		Audience:         "//iam.googleapis.com/projects/1/locations/global/workloadIdentityPools/ci/providers/bitrise",
+		SubjectTokenType: "urn:ietf:params:oauth:token-type:jwt",
+		TokenURL:         server.URL + "/sts",
+		ImpersonationURL: server.URL + "/impersonate",
+		Scopes:           []string{googleStorageScope},
+	}
+	s.Source.URL = server.URL + "/oidc"
+	s.Source.Headers = map[string]string{"Authorization": "Bearer ci-request-token"}
+	s.Source.Format.Type = "json"
+	s.Source.Format.SubjectTokenFieldName = "value"
+
+	token, err := s.Token()
+	if err != nil {
+		t.Fatalf("externalAccountGoogleCredentials.Token() error = %v", err)
+	}
+	if token.AccessToken != "impersonated-token" || token.Expires.Year() != 2030 {
+		t.Errorf("externalAccountGoogleCredentials.Token() = %+v, want impersonated-token", token)
+	}
+}
+
+func TestGoogleProvider_metadataServer(t *testing.T) {
+	tokenRequests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Metadata-Flavor") != "Google" || r.URL.Path != "/computeMetadata/v1/instance/service-accounts/default/token" || r.URL.Query().Get("scopes") != googleStorageScope {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		tokenRequests++
+		if _, err := w.Write([]byte(`{"access_token": "metadata-access-token", "expires_in": 3599, "token_type": "Bearer"}`)); err != nil {
+			t.Errorf("failed to write response: %s", err)
+		}
+	}))
+	defer server.Close()
+
+	p := &GoogleProvider{source: &metadataGoogleCredentials{Endpoint: server.URL, Scopes: []string{googleStorageScope}}}
+	for _, u := range []string{"https://storage.googleapis.com/bucket/cache.tar", "https://storage.googleapis.com/bucket/cache.tar?alt=media"} {
+		req, err := http.NewRequest("GET", u, nil)
+		if err != nil {
+			t.Fatalf("failed to create request: %s", err)
+		}
+		if err := p.Authorize(req); err != nil {
+			t.Fatalf("GoogleProvider.Authorize() error = %v", err)
+		}
+		if got := req.Header.Get("Authorization"); got != "Bearer metadata-access-token" {
+			t.Errorf("Authorization = %s, want the metadata server's token", got)
+		}
+	}
+	if tokenRequests != 1 {
+		t.Errorf("token requests = %d, want 1", tokenRequests)
+	}
+
+	t.Log("signed URL")
+	{
+		req, err := http.NewRequest("GET", "https://storage.googleapis.com/bucket/cache.tar?X-Goog-Signature=abc", nil)
+		if err != nil {
+			t.Fatalf("failed to create request: %s", err)
+		}
+		if err := p.Authorize(req); err != nil {
+			t.Fatalf("GoogleProvider.Authorize() error = %v", err)
+		}
+		if got := req.Header.Get("Authorization"); got != "" {
+			t.Errorf("Authorization = %s, want empty", got)
+		}
+	}
+
+	t.Log("no metadata server")
+	{
+		p := &GoogleProvider{source: &metadataGoogleCredentials{Endpoint: "http://127.0.0.1:1"}}
+		req, err := http.NewRequest("GET", fmt.Sprintf("%s/bucket/cache.tar", server.URL), nil)
+		if err != nil {
+			t.Fatalf("failed to create request: %s", err)
+		}
+		if err := p.Authorize(req); err == nil {
+			t.Errorf("GoogleProvider.Authorize() error = nil, want error")
+		}
+	}
+}
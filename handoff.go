@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// Archive compressions announced by the cache API, see the handoff_mode input.
+const (
+	archiveCompressionNone = "none"
+	archiveCompressionGzip = "gzip"
+	archiveCompressionZstd = "zstd"
+)
+
+// handoffMetadata returns whether the cache API's metadata of the archive can be trusted in handoff mode:
+// the compression is known (no sniffing of the stream) and the archive can be verified by its fingerprint.
+func handoffMetadata(info cacheDownloadInfo) (bool, error) {
+	switch info.Compression {
+	case "":
+		return false, nil
+	case archiveCompressionNone, archiveCompressionGzip, archiveCompressionZstd:
+	default:
+		return false, fmt.Errorf("unknown archive compression (%s)", info.Compression)
+	}
+	if info.Fingerprint == "" {
+		return false, nil
+	}
+	return true, nil
+}
+
+// preferDatacenter moves the archive URLs of the datacenter (see Datacenters) before the others,
+// keeping their order otherwise.
+func preferDatacenter(info cacheDownloadInfo, datacenter string) cacheDownloadInfo {
+	urls := append([]string{info.DownloadURL}, info.Mirrors...)
+	if datacenter == "" || len(info.Datacenters) != len(urls) {
+		return info
+	}
+
+	var same, others []string
+	var sameDatacenters, otherDatacenters []string
+	for i, u := range urls {
+		if info.Datacenters[i] == datacenter {
+			same = append(same, u)
+			sameDatacenters = append(sameDatacenters, info.Datacenters[i])
+		} else {
+			others = append(others, u)
+			otherDatacenters = append(otherDatacenters, info.Datacenters[i])
+		}
+	}
+	if len(same) == 0 {
+		log.Debugf("No archive URL in the datacenter (%s)", datacenter)
+		return info
+	}
+
+	urls = append(same, others...)
+	info.DownloadURL, info.Mirrors = urls[0], urls[1:]
+	info.Datacenters = append(sameDatacenters, otherDatacenters...)
+	return info
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestHandoffMetadata(t *testing.T) {
+	tests := []struct {
+		name    string
+		info    cacheDownloadInfo
+		want    bool
+		wantErr bool
+	}{
+		{name: "no metadata", info: cacheDownloadInfo{}},
+		{name: "no fingerprint", info: cacheDownloadInfo{Compression: archiveCompressionZstd}},
+		{name: "metadata", info: cacheDownloadInfo{Compression: archiveCompressionGzip, Fingerprint: "sha256:abc"}, want: true},
+		{name: "unknown compression", info: cacheDownloadInfo{Compression: "xz", Fingerprint: "sha256:abc"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := handoffMetadata(tt.info)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("handoffMetadata() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("handoffMetadata() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPreferDatacenter(t *testing.T) {
+	info := cacheDownloadInfo{
+		DownloadURL: "https://us.example.com/archive",
+		Mirrors:     []string{"https://eu-1.example.com/archive", "https://ap.example.com/archive", "https://eu-2.example.com/archive"},
+		Datacenters: []string{"us", "eu", "ap", "eu"},
+	}
+
+	tests := []struct {
+		name       string
+		info       cacheDownloadInfo
+		datacenter string
+		want       []string
+	}{
+		{name: "same datacenter first", info: info, datacenter: "eu", want: []string{"https://eu-1.example.com/archive", "https://eu-2.example.com/archive", "https://us.example.com/archive", "https://ap.example.com/archive"}},
+		{name: "already first", info: info, datacenter: "us", want: []string{"https://us.example.com/archive", "https://eu-1.example.com/archive", "https://ap.example.com/archive", "https://eu-2.example.com/archive"}},
+		{name: "unknown datacenter", info: info, datacenter: "sa", want: []string{"https://us.example.com/archive", "https://eu-1.example.com/archive", "https://ap.example.com/archive", "https://eu-2.example.com/archive"}},
+		{name: "no datacenters", info: cacheDownloadInfo{DownloadURL: "https://us.example.com/archive", Mirrors: []string{"https://eu-1.example.com/archive"}}, datacenter: "eu", want: []string{"https://us.example.com/archive", "https://eu-1.example.com/archive"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := preferDatacenter(tt.info, tt.datacenter)
+			if urls := append([]string{got.DownloadURL}, got.Mirrors...); !reflect.DeepEqual(urls, tt.want) {
+				t.Errorf("preferDatacenter() = %v, want %v", urls, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadFirstEntryAs(t *testing.T) {
+	archive := createTestArchive(t, []testEntry{{name: "file", content: "content"}}).Bytes()
+
+	_, hdr, err := readFirstEntryAs(bytes.NewReader(archive), false)
+	if err != nil || hdr == nil || hdr.Name != "file" {
+		t.Errorf("readFirstEntryAs() = %v, %v, want the file entry", hdr, err)
+	}
+
+	if _, _, err := readFirstEntryAs(bytes.NewReader(archive), true); err == nil {
+		t.Errorf("readFirstEntryAs() error = nil, want error for the not gzip compressed archive")
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/textproto"
+	"strings"
+)
+
+// version is the step's version, set at build time (-ldflags "-X main.version=<version>").
+var version = "dev"
+
+// userAgent returns the User-Agent of the cache requests, attributing the traffic to the step and the build.
+func userAgent(buildSlug string) string {
+	ua := fmt.Sprintf("%s/%s", stepID, version)
+	if buildSlug != "" {
+		ua += fmt.Sprintf(" (build: %s)", buildSlug)
+	}
+	return ua
+}
+
+// parseRequestHeaders parses the newline separated `Name: value` headers.
+func parseRequestHeaders(s string) (http.Header, error) {
+	headers := http.Header{}
+	for _, line := range strings.Split(s, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		kv := strings.SplitN(line, ":", 2)
+		name := strings.TrimSpace(kv[0])
+		if len(kv) != 2 || name == "" || strings.ContainsAny(name, " \t") {
+			return nil, fmt.Errorf("invalid header (%s), expected format: Name: value", line)
+		}
+		headers.Add(textproto.CanonicalMIMEHeaderKey(name), strings.TrimSpace(kv[1]))
+	}
+	return headers, nil
+}
+
+// headerTransport sets the headers on the requests, not overwriting the headers set by the request itself.
+type headerTransport struct {
+	headers http.Header
+	next    http.RoundTripper
+}
+
+// newHeaderTransport wraps the transport, to set the User-Agent and the custom headers on the requests.
+func newHeaderTransport(next http.RoundTripper, buildSlug string, headers http.Header) http.RoundTripper {
+	h := http.Header{"User-Agent": []string{userAgent(buildSlug)}}
+	for name, values := range headers {
+		h[name] = values
+	}
+	return headerTransport{headers: h, next: next}
+}
+
+// RoundTrip implements the http.RoundTripper interface.
+// Only the User-Agent is set on the requests redirected to another host, the custom headers are not sent there.
+func (t headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	sameHost := strings.EqualFold(originalRequest(req).URL.Host, req.URL.Host)
+	req = req.Clone(req.Context())
+	for name, values := range t.headers {
+		if name != "User-Agent" {
+			if _, ok := req.Header[name]; ok || !sameHost {
+				continue
+			}
+		}
+		req.Header[name] = values
+	}
+	return t.next.RoundTrip(req)
+}
+
+// originalRequest returns the first request of the redirects leading to the request.
+func originalRequest(req *http.Request) *http.Request {
+	for req.Response != nil && req.Response.Request != nil {
+		req = req.Response.Request
+	}
+	return req
+}
+
+// redactRequestHeaders masks the values of the newline separated `Name: value` headers, keeping their names.
+func redactRequestHeaders(s string) string {
+	var lines []string
+	for _, line := range strings.Split(s, "\n") {
+		if i := strings.Index(line, ":"); i != -1 {
+			line = line[:i+1] + " " + redacted
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestParseRequestHeaders(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    http.Header
+		wantErr bool
+	}{
+		{name: "empty", input: "", want: http.Header{}},
+		{
+			name:  "headers",
+			input: "x-team: mobile\n\nX-Trace:  a:b ",
+			want:  http.Header{"X-Team": {"mobile"}, "X-Trace": {"a:b"}},
+		},
+		{name: "missing value separator", input: "X-Team mobile", wantErr: true},
+		{name: "empty name", input: ": mobile", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseRequestHeaders(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseRequestHeaders() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseRequestHeaders() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHeaderTransport(t *testing.T) {
+	var got http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header
+	}))
+	defer server.Close()
+
+	client := &http.Client{Transport: newHeaderTransport(http.DefaultTransport, "slug", http.Header{"X-Team": {"mobile"}, "Authorization": {"custom"}})}
+
+	req, err := http.NewRequest("GET", server.URL, nil)
+	if err != nil {
+		t.Fatalf("failed to create request: %s", err)
+	}
+	req.Header.Set("Authorization", "Bearer token")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("request error = %v", err)
+	}
+	if err := resp.Body.Close(); err != nil {
+		t.Logf("failed to close response body: %s", err)
+	}
+
+	for name, want := range map[string]string{"User-Agent": "cache-pull/dev (build: slug)", "X-Team": "mobile", "Authorization": "Bearer token"} {
+		if got.Get(name) != want {
+			t.Errorf("%s header = %s, want %s", name, got.Get(name), want)
+		}
+	}
+	if req.Header.Get("X-Team") != "" {
+		t.Errorf("the original request is modified")
+	}
+}
+
+func TestHeaderTransport_redirect(t *testing.T) {
+	var got http.Header
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header
+	}))
+	defer other.Close()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/other-host":
+			http.Redirect(w, r, other.URL+"/archive", http.StatusFound)
+		case "/same-host":
+			http.Redirect(w, r, "/archive", http.StatusFound)
+		default:
+			got = r.Header
+		}
+	}))
+	defer server.Close()
+
+	client := &http.Client{Transport: newHeaderTransport(http.DefaultTransport, "slug", http.Header{"X-Api-Key": {"secret"}})}
+
+	tests := []struct {
+		path       string
+		wantAPIKey string
+	}{
+		{path: "/same-host", wantAPIKey: "secret"},
+		{path: "/other-host"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			got = nil
+			resp, err := client.Get(server.URL + tt.path)
+			if err != nil {
+				t.Fatalf("request error = %v", err)
+			}
+			if err := resp.Body.Close(); err != nil {
+				t.Logf("failed to close response body: %s", err)
+			}
+
+			if got.Get("X-Api-Key") != tt.wantAPIKey {
+				t.Errorf("X-Api-Key header = %s, want %s", got.Get("X-Api-Key"), tt.wantAPIKey)
+			}
+			if want := "cache-pull/dev (build: slug)"; got.Get("User-Agent") != want {
+				t.Errorf("User-Agent header = %s, want %s", got.Get("User-Agent"), want)
+			}
+		})
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+
+	"github.com/bitrise-io/go-utils/command"
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// Hook phases, see HookEvent.
+const (
+	hookPreDownload  = "pre-download"
+	hookPostDownload = "post-download"
+	hookPostRestore  = "post-restore"
+)
+
+// HookEvent is the JSON document the hooks receive on their standard input.
+type HookEvent struct {
+	Phase     string `json:"phase"`
+	BuildSlug string `json:"build_slug,omitempty"`
+	CacheURL  string `json:"cache_url,omitempty"`
+	CacheKey  string `json:"cache_key,omitempty"`
+	// ArchivePath is the downloaded archive file, only set in the post-download phase
+	// if the archive was downloaded to a file (the archive is streamed otherwise).
+	ArchivePath string `json:"archive_path,omitempty"`
+	ArchiveSize int64  `json:"archive_size,omitempty"`
+	Status      string `json:"status,omitempty"`
+}
+
+// Hooks runs the executables of a directory at the phases of the cache pull,
+// a hook exiting with a non-zero status fails the cache pull.
+type Hooks struct {
+	Dir    string
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+// NewHooks creates a new Hooks for the executables in dir, it returns nil if dir is empty.
+func NewHooks(dir string) *Hooks {
+	if dir == "" {
+		return nil
+	}
+	// the hooks' output is filtered by the log_level and quiet inputs, their errors are shown as warnings
+	return &Hooks{Dir: dir, Stdout: logFilter.At(logLevelInfo), Stderr: logFilter.At(logLevelWarn)}
+}
+
+// executables returns the executables of the hooks directory, in lexical order.
+func (h *Hooks) executables() ([]string, error) {
+	infos, err := ioutil.ReadDir(h.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var pths []string
+	for _, info := range infos {
+		if info.Mode().IsRegular() && info.Mode().Perm()&0111 != 0 {
+			pths = append(pths, filepath.Join(h.Dir, info.Name()))
+		}
+	}
+	sort.Strings(pths)
+	return pths, nil
+}
+
+// Run runs every hook with the event, it stops at the first failing hook.
+func (h *Hooks) Run(event HookEvent) error {
+	if h == nil {
+		return nil
+	}
+
+	pths, err := h.executables()
+	if err != nil {
+		return fmt.Errorf("failed to list hooks: %s", err)
+	}
+
+	b, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	for _, pth := range pths {
+		log.Debugf("Running %s hook: %s", event.Phase, pth)
+
+		cmd := command.New(pth).
+			SetStdin(bytes.NewReader(b)).
+			SetStdout(h.Stdout).
+			SetStderr(h.Stderr).
+			AppendEnvs("CACHE_PULL_HOOK_PHASE=" + event.Phase)
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("%s hook %s failed: %s", event.Phase, filepath.Base(pth), err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestHooks_Run(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hooks-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Logf("failed to remove temp dir: %s", err)
+		}
+	}()
+
+	hooksDir := filepath.Join(dir, "hooks")
+	if err := os.MkdirAll(hooksDir, 0755); err != nil {
+		t.Fatalf("failed to create hooks dir: %s", err)
+	}
+	out := filepath.Join(dir, "out")
+	for name, content := range map[string]string{
+		"10-record": "#!/bin/sh\ncat > " + out + ".json\necho \"$CACHE_PULL_HOOK_PHASE\" >> " + out + "\n",
+		"20-record": "#!/bin/sh\necho second >> " + out + "\n",
+		"README":    "not a hook",
+	} {
+		mode := os.FileMode(0755)
+		if name == "README" {
+			mode = 0644
+		}
+		if err := ioutil.WriteFile(filepath.Join(hooksDir, name), []byte(content), mode); err != nil {
+			t.Fatalf("failed to write hook: %s", err)
+		}
+	}
+
+	if err := (*Hooks)(nil).Run(HookEvent{Phase: hookPreDownload}); err != nil {
+		t.Errorf("Hooks.Run() error = %v, want nil without hooks", err)
+	}
+	if NewHooks("") != nil {
+		t.Errorf("NewHooks() = not nil, want nil without hooks directory")
+	}
+
+	event := HookEvent{Phase: hookPostDownload, BuildSlug: "slug", ArchivePath: "/tmp/cache-archive.tar", ArchiveSize: 10}
+	if err := NewHooks(hooksDir).Run(event); err != nil {
+		t.Fatalf("Hooks.Run() error = %v", err)
+	}
+
+	b, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatalf("failed to read hook output: %s", err)
+	}
+	if got, want := strings.TrimSpace(string(b)), hookPostDownload+"\nsecond"; got != want {
+		t.Errorf("hook output = %q, want %q", got, want)
+	}
+
+	b, err = ioutil.ReadFile(out + ".json")
+	if err != nil {
+		t.Fatalf("failed to read hook input: %s", err)
+	}
+	var got HookEvent
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatalf("failed to parse hook input (%s): %s", b, err)
+	}
+	if got != event {
+		t.Errorf("hook input = %+v, want %+v", got, event)
+	}
+
+	t.Log("failing hook")
+	{
+		if err := ioutil.WriteFile(filepath.Join(hooksDir, "15-fail"), []byte("#!/bin/sh\nexit 1\n"), 0755); err != nil {
+			t.Fatalf("failed to write hook: %s", err)
+		}
+		if err := NewHooks(hooksDir).Run(event); err == nil || !strings.Contains(err.Error(), "15-fail") {
+			t.Errorf("Hooks.Run() error = %v, want 15-fail failure", err)
+		}
+	}
+}
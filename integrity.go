@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// checksumMismatchError is returned when the downloaded bytes do not match the response's checksum header.
+type checksumMismatchError struct {
+	header string
+	got    string
+	want   string
+}
+
+func (e *checksumMismatchError) Error() string {
+	return fmt.Sprintf("checksum mismatch (%s): %s, expected %s", e.header, e.got, e.want)
+}
+
+// responseChecksum is the checksum announced by a blob store's response header.
+type responseChecksum struct {
+	header string
+	hash   hash.Hash
+	want   []byte
+}
+
+// checksumHeaders are the supported checksum headers, in order of preference.
+var checksumHeaders = []struct {
+	header string
+	hash   func() hash.Hash
+}{
+	{"x-amz-checksum-sha256", sha256.New},
+	{"x-amz-checksum-sha1", sha1.New},
+	{"Content-MD5", md5.New},
+	{"x-amz-checksum-crc32c", func() hash.Hash { return crc32.New(crc32.MakeTable(crc32.Castagnoli)) }},
+	{"x-amz-checksum-crc32", func() hash.Hash { return crc32.NewIEEE() }},
+}
+
+// newResponseChecksum returns the response's checksum, or nil if the response does not announce (a full object) checksum.
+func newResponseChecksum(header http.Header) *responseChecksum {
+	for _, h := range checksumHeaders {
+		value := header.Get(h.header)
+		// the checksums of multipart uploads (<checksum>-<parts>) are not the checksum of the object
+		if value == "" || strings.Contains(value, "-") {
+			continue
+		}
+		if want, err := base64.StdEncoding.DecodeString(value); err == nil {
+			return &responseChecksum{header: h.header, hash: h.hash(), want: want}
+		}
+	}
+
+	// GCS: x-goog-hash: crc32c=<base64>,md5=<base64>
+	var crc32c []byte
+	for _, value := range header[http.CanonicalHeaderKey("x-goog-hash")] {
+		for _, field := range strings.Split(value, ",") {
+			kv := strings.SplitN(strings.TrimSpace(field), "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			want, err := base64.StdEncoding.DecodeString(kv[1])
+			if err != nil {
+				continue
+			}
+			switch kv[0] {
+			case "md5":
+				return &responseChecksum{header: "x-goog-hash (md5)", hash: md5.New(), want: want}
+			case "crc32c":
+				crc32c = want
+			}
+		}
+	}
+	if crc32c != nil {
+		return &responseChecksum{header: "x-goog-hash (crc32c)", hash: crc32.New(crc32.MakeTable(crc32.Castagnoli)), want: crc32c}
+	}
+
+	return nil
+}
+
+// verifyingReader verifies the read bytes against the response's checksum, when reaching the end of the body.
+type verifyingReader struct {
+	io.ReadCloser
+	checksum *responseChecksum
+}
+
+// newVerifyingReader wraps the response body with checksum verification, if the response announces a checksum.
+func newVerifyingReader(resp *http.Response) io.ReadCloser {
+	checksum := newResponseChecksum(resp.Header)
+	if checksum == nil || resp.StatusCode != http.StatusOK {
+		return resp.Body
+	}
+	log.Debugf("verifying the download with the %s header", checksum.header)
+	return &verifyingReader{ReadCloser: resp.Body, checksum: checksum}
+}
+
+// Read implements the io.Reader interface.
+func (r *verifyingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if _, hErr := r.checksum.hash.Write(p[:n]); hErr != nil {
+		return n, hErr
+	}
+	if err == io.EOF {
+		if got := r.checksum.hash.Sum(nil); !bytes.Equal(got, r.checksum.want) {
+			return n, &checksumMismatchError{
+				header: r.checksum.header,
+				got:    base64.StdEncoding.EncodeToString(got),
+				want:   base64.StdEncoding.EncodeToString(r.checksum.want),
+			}
+		}
+	}
+	return n, err
+}
+
+// retryOnChecksumMismatch calls the download function once more, if the downloaded bytes did not match the checksum header.
+// A repeated mismatch is returned as *checksumMismatchError.
+func retryOnChecksumMismatch(name string, download func() error) error {
+	err := download()
+	if _, ok := err.(*checksumMismatchError); !ok {
+		return err
+	}
+
+	log.Warnf("Downloaded %s is corrupted (%s), retrying", name, err)
+	return download()
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"hash/crc32"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPerformRequest_checksumHeaders(t *testing.T) {
+	content := []byte("cache archive content")
+	md5Sum := md5.Sum(content)
+	crc32c := crc32.New(crc32.MakeTable(crc32.Castagnoli))
+	if _, err := crc32c.Write(content); err != nil {
+		t.Fatalf("failed to compute crc32c: %s", err)
+	}
+
+	tests := []struct {
+		name    string
+		header  string
+		value   string
+		wantErr bool
+	}{
+		{name: "no checksum header"},
+		{name: "Content-MD5", header: "Content-MD5", value: base64.StdEncoding.EncodeToString(md5Sum[:])},
+		{name: "Content-MD5 mismatch", header: "Content-MD5", value: base64.StdEncoding.EncodeToString(make([]byte, md5.Size)), wantErr: true},
+		{name: "x-goog-hash", header: "x-goog-hash", value: "crc32c=" + base64.StdEncoding.EncodeToString(crc32c.Sum(nil))},
+		{name: "x-goog-hash mismatch", header: "x-goog-hash", value: "crc32c=AAAAAA==", wantErr: true},
+		{name: "multipart upload checksum", header: "x-amz-checksum-sha256", value: "invalid-3"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.header != "" {
+					w.Header().Set(tt.header, tt.value)
+				}
+				if _, err := w.Write(content); err != nil {
+					t.Errorf("failed to write response: %s", err)
+				}
+			}))
+			defer server.Close()
+
+			body, err := performRequest(server.URL)
+			if err != nil {
+				t.Fatalf("performRequest() error = %v", err)
+			}
+			defer func() {
+				if err := body.Close(); err != nil {
+					t.Logf("failed to close body: %s", err)
+				}
+			}()
+
+			_, err = ioutil.ReadAll(body)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("read error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if _, ok := err.(*checksumMismatchError); tt.wantErr && !ok {
+				t.Errorf("read error = %T, want *checksumMismatchError", err)
+			}
+		})
+	}
+}
+
+func TestDownloadPart_retryOnChecksumMismatch(t *testing.T) {
+	content := []byte("cache archive content")
+	sum := md5.Sum(content)
+
+	for _, corrupted := range []int{1, 2} {
+		requests := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests++
+			w.Header().Set("Content-MD5", base64.StdEncoding.EncodeToString(sum[:]))
+			body := content
+			if requests <= corrupted {
+				body = []byte("corrupted archive content")
+			}
+			if _, err := w.Write(body); err != nil {
+				t.Errorf("failed to write response: %s", err)
+			}
+		}))
+
+		pth, err := downloadPart(context.Background(), server.URL, 0)
+		server.Close()
+
+		if wantErr := corrupted > 1; (err != nil) != wantErr {
+			t.Fatalf("downloadPart() (%d corrupted responses) error = %v, wantErr %v", corrupted, err, wantErr)
+		}
+		if requests != 2 {
+			t.Errorf("downloadPart() requests = %d, want 2", requests)
+		}
+		if err != nil {
+			continue
+		}
+
+		b, err := ioutil.ReadFile(pth)
+		if err != nil {
+			t.Fatalf("failed to read downloaded part: %s", err)
+		}
+		removePart(pth)
+		if string(b) != string(content) {
+			t.Errorf("downloaded part = %s, want %s", b, content)
+		}
+	}
+}
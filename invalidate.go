@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// invalidatePath is appended to the cache API URL to flag a corrupted cache entry.
+const invalidatePath = "/invalidate"
+
+// corruptedEntry identifies the corrupted cache entry for the cache API: the build's cache (legacy cache API),
+// or the cache key (key-based cache API), and the archive's fingerprint if known.
+type corruptedEntry struct {
+	BuildSlug   string `json:"build_slug"`
+	CacheKey    string `json:"cache_key,omitempty"`
+	Fingerprint string `json:"fingerprint,omitempty"`
+	Reason      string `json:"reason"`
+}
+
+// InvalidationClient flags the corrupted cache entries, so that the cache API stops serving them to the next builds.
+type InvalidationClient struct {
+	URL   string
+	Token string
+
+	client *http.Client
+}
+
+// NewInvalidationClient creates a new InvalidationClient for the given cache API URL,
+// token authorizes the requests to the key-based cache API.
+func NewInvalidationClient(cacheAPIURL, token string) *InvalidationClient {
+	return &InvalidationClient{
+		URL:    strings.TrimSuffix(cacheAPIURL, "/") + invalidatePath,
+		Token:  token,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Invalidate flags the corrupted cache entry.
+func (c *InvalidationClient) Invalidate(entry corruptedEntry) error {
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", c.URL, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			log.Warnf("Failed to close response body: %s", err)
+		}
+	}()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("non success response code: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// corruptedArchiveInvalidator invalidates the restored cache entry if the archive proves corrupt,
+// nil if invalidate_corrupted is disabled or the archive is not served by a cache API.
+var corruptedArchiveInvalidator func(reason error)
+
+// newCorruptedArchiveInvalidator returns the invalidator of the resolved cache entry.
+func newCorruptedArchiveInvalidator(client *InvalidationClient, entry corruptedEntry) func(reason error) {
+	return func(reason error) {
+		entry.Reason = redactSecrets(reason.Error())
+		if err := client.Invalidate(entry); err != nil {
+			result.Warnf("Failed to invalidate the corrupted cache entry: %s", err)
+			return
+		}
+		log.Printf("The corrupted cache entry is invalidated, the next builds will not restore it")
+	}
+}
+
+// invalidateCorruptedArchive invalidates the cache entry of the corrupted archive, if enabled.
+func invalidateCorruptedArchive(reason error) {
+	if corruptedArchiveInvalidator != nil {
+		corruptedArchiveInvalidator(reason)
+	}
+}
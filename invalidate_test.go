@@ -0,0 +1,45 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestInvalidationClient_Invalidate(t *testing.T) {
+	var got corruptedEntry
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.URL.Path != invalidatePath || r.Header.Get("Authorization") != "Bearer abcs-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Errorf("failed to decode request: %s", err)
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	result = NewPullResult("", false)
+	defer func() { result = nil }()
+
+	invalidate := newCorruptedArchiveInvalidator(NewInvalidationClient(server.URL+"/", "abcs-token"), corruptedEntry{BuildSlug: "slug", CacheKey: "deps-abc", Fingerprint: quarantinedFingerprint})
+	invalidate(fmt.Errorf("checksum mismatch"))
+
+	want := corruptedEntry{BuildSlug: "slug", CacheKey: "deps-abc", Fingerprint: quarantinedFingerprint, Reason: "checksum mismatch"}
+	if got != want {
+		t.Errorf("invalidated entry = %+v, want %+v", got, want)
+	}
+	if len(result.Warnings) != 0 {
+		t.Errorf("warnings = %v, want none", result.Warnings)
+	}
+
+	t.Log("unauthorized")
+	{
+		if err := NewInvalidationClient(server.URL, "").Invalidate(want); err == nil {
+			t.Errorf("InvalidationClient.Invalidate() error = nil, want error")
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// keptArchivePathEnvKey is the output of the keep_archive input, the path of the kept archive.
+const keptArchivePathEnvKey = "BITRISE_CACHE_PULL_ARCHIVE_PATH"
+
+const (
+	keptArchivePrefix  = "cache-archive-"
+	keptArchiveTempExt = ".tmp"
+)
+
+// keptArchiveDir returns the directory of the kept archives: the keep_archive_dir input, or the step's temporary directory.
+func keptArchiveDir(dir string) string {
+	if dir != "" {
+		return dir
+	}
+	return filepath.Join(stepTempDir, "kept-archives")
+}
+
+// keptArchiveName returns the kept archive's file name, by its checksum and compression.
+func keptArchiveName(checksum string, compressed, zstdCompressed bool) string {
+	name := keptArchivePrefix + strings.TrimPrefix(checksum, "sha256:")
+	switch {
+	case zstdCompressed:
+		return name + ".tar.zst"
+	case compressed:
+		return name + ".tar.gz"
+	default:
+		return name + ".tar"
+	}
+}
+
+// keptArchive writes the downloaded archive to a temporary file, for the later steps (see the keep_archive input).
+// A failed write does not fail the download: the archive is not kept.
+type keptArchive struct {
+	f   *os.File
+	err error
+	// done is set once the file is kept or discarded.
+	done bool
+}
+
+// createKeptArchive creates the temporary file of the archive in dir.
+func createKeptArchive(dir string) (*keptArchive, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	f, err := ioutil.TempFile(dir, keptArchivePrefix+"*"+keptArchiveTempExt)
+	if err != nil {
+		return nil, err
+	}
+	// the lock of the written file keeps the concurrent step runs from pruning it
+	if _, err := tryLock(f); err != nil {
+		log.Debugf("Failed to lock %s: %s", f.Name(), err)
+	}
+	return &keptArchive{f: f}, nil
+}
+
+// Write implements the io.Writer interface.
+func (k *keptArchive) Write(p []byte) (int, error) {
+	if k.err == nil {
+		_, k.err = k.f.Write(p)
+	}
+	return len(p), nil
+}
+
+// Keep renames the written archive to name in its directory, and returns its path.
+func (k *keptArchive) Keep(name string) (string, error) {
+	k.done = true
+	err := k.err
+	if cErr := k.f.Close(); cErr != nil && err == nil {
+		err = cErr
+	}
+	if err == nil {
+		pth := filepath.Join(filepath.Dir(k.f.Name()), name)
+		if err = os.Rename(k.f.Name(), pth); err == nil {
+			return pth, nil
+		}
+	}
+
+	if rErr := os.Remove(k.f.Name()); rErr != nil {
+		log.Warnf("Failed to remove %s: %s", k.f.Name(), rErr)
+	}
+	return "", err
+}
+
+// Discard removes the written archive, unless it is kept already.
+func (k *keptArchive) Discard() {
+	if k.done {
+		return
+	}
+	k.done = true
+	if err := k.f.Close(); err != nil {
+		log.Debugf("Failed to close %s: %s", k.f.Name(), err)
+	}
+	if err := os.Remove(k.f.Name()); err != nil {
+		log.Warnf("Failed to remove %s: %s", k.f.Name(), err)
+	}
+}
+
+// keepDownloadedArchive moves the archive file downloaded by the fallback into dir, and returns its path.
+func keepDownloadedArchive(pth, dir, name string) (string, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	kept := filepath.Join(dir, name)
+	if err := os.Rename(pth, kept); err != nil {
+		return "", err
+	}
+	return kept, nil
+}
+
+// pruneKeptArchives removes the kept archives in dir except for the maxCount newest ones (and keep),
+// and the temporary files of the interrupted pulls (not the ones being written by a running step).
+// A maxCount of 0 keeps every archive.
+func pruneKeptArchives(dir, keep string, maxCount int) ([]string, error) {
+	matches, err := filepath.Glob(filepath.Join(dir, keptArchivePrefix+"*"))
+	if err != nil {
+		return nil, err
+	}
+
+	type keptFile struct {
+		pth  string
+		info os.FileInfo
+	}
+	var kept []keptFile
+	var removed []string
+	for _, pth := range matches {
+		info, err := os.Stat(pth)
+		if err != nil {
+			continue
+		}
+		if strings.HasSuffix(pth, keptArchiveTempExt) {
+			l, err := tryLockFile(pth)
+			if err != nil {
+				return removed, err
+			}
+			if l == nil {
+				// written by a running step
+				continue
+			}
+			err = os.Remove(pth)
+			if uErr := l.Unlock(); uErr != nil {
+				log.Debugf("Failed to release the lock of %s: %s", pth, uErr)
+			}
+			if err != nil {
+				return removed, err
+			}
+			removed = append(removed, pth)
+			continue
+		}
+		if pth != keep {
+			kept = append(kept, keptFile{pth: pth, info: info})
+		}
+	}
+	if maxCount == 0 {
+		return removed, nil
+	}
+
+	sort.Slice(kept, func(i, j int) bool { return kept[i].info.ModTime().After(kept[j].info.ModTime()) })
+	// keep counts as one of the newest archives
+	for i := maxCount - 1; i < len(kept); i++ {
+		if err := os.Remove(kept[i].pth); err != nil {
+			return removed, fmt.Errorf("failed to remove %s: %s", kept[i].pth, err)
+		}
+		removed = append(removed, kept[i].pth)
+	}
+	return removed, nil
+}
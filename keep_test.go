@@ -0,0 +1,127 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestKeptArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keep-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Logf("failed to remove temp dir: %s", err)
+		}
+	}()
+
+	k, err := createKeptArchive(dir)
+	if err != nil {
+		t.Fatalf("createKeptArchive() error = %v", err)
+	}
+	if _, err := k.Write([]byte("archive")); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	name := keptArchiveName("sha256:abc", true, false)
+	pth, err := k.Keep(name)
+	if err != nil {
+		t.Fatalf("Keep() error = %v", err)
+	}
+	if want := filepath.Join(dir, "cache-archive-abc.tar.gz"); pth != want {
+		t.Errorf("Keep() = %s, want %s", pth, want)
+	}
+	if b, err := ioutil.ReadFile(pth); err != nil || string(b) != "archive" {
+		t.Errorf("kept archive = %q, %v, want archive", b, err)
+	}
+	k.Discard()
+	if _, err := os.Stat(pth); err != nil {
+		t.Errorf("Discard() removed the kept archive: %s", err)
+	}
+
+	t.Log("a failed write does not fail the download, the archive is not kept")
+	{
+		k, err := createKeptArchive(dir)
+		if err != nil {
+			t.Fatalf("createKeptArchive() error = %v", err)
+		}
+		if err := k.f.Close(); err != nil {
+			t.Fatalf("failed to close: %s", err)
+		}
+		if n, err := k.Write([]byte("archive")); err != nil || n != 7 {
+			t.Errorf("Write() = %d, %v, want 7, nil", n, err)
+		}
+		if _, err := k.Keep(keptArchiveName("sha256:def", false, false)); err == nil {
+			t.Errorf("Keep() error = nil, want error")
+		}
+		if _, err := os.Stat(k.f.Name()); !os.IsNotExist(err) {
+			t.Errorf("the temporary file is not removed: %v", err)
+		}
+	}
+}
+
+func TestPruneKeptArchives(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keep-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Logf("failed to remove temp dir: %s", err)
+		}
+	}()
+
+	now := time.Now()
+	files := []struct {
+		name string
+		age  time.Duration
+	}{
+		{name: "cache-archive-new.tar", age: 0},
+		{name: "cache-archive-old.tar", age: time.Hour},
+		{name: "cache-archive-older.tar.gz", age: 2 * time.Hour},
+		{name: "cache-archive-123.tmp", age: time.Hour},
+		{name: "cache-archive-456.tmp", age: time.Hour},
+		{name: "other.tar", age: 3 * time.Hour},
+	}
+	for _, f := range files {
+		pth := filepath.Join(dir, f.name)
+		if err := ioutil.WriteFile(pth, nil, 0600); err != nil {
+			t.Fatalf("failed to write file: %s", err)
+		}
+		if err := os.Chtimes(pth, now.Add(-f.age), now.Add(-f.age)); err != nil {
+			t.Fatalf("failed to set modification time: %s", err)
+		}
+	}
+
+	// being written by a running step
+	l, err := tryLockFile(filepath.Join(dir, "cache-archive-456.tmp"))
+	if err != nil || l == nil {
+		t.Fatalf("failed to lock file: %v", err)
+	}
+	defer func() {
+		if err := l.Unlock(); err != nil {
+			t.Logf("failed to unlock file: %s", err)
+		}
+	}()
+
+	removed, err := pruneKeptArchives(dir, filepath.Join(dir, "cache-archive-new.tar"), 2)
+	if err != nil {
+		t.Fatalf("pruneKeptArchives() error = %v", err)
+	}
+	want := []string{filepath.Join(dir, "cache-archive-123.tmp"), filepath.Join(dir, "cache-archive-older.tar.gz")}
+	if !reflect.DeepEqual(removed, want) {
+		t.Errorf("pruneKeptArchives() = %v, want %v", removed, want)
+	}
+
+	names, err := readDirNames(dir)
+	if err != nil {
+		t.Fatalf("failed to read dir: %s", err)
+	}
+	if want := []string{"cache-archive-456.tmp", "cache-archive-new.tar", "cache-archive-old.tar", "other.tar"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("kept files = %v, want %v", names, want)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// Cache APIs, see the cache_api input.
+const (
+	cacheAPILegacy   = "legacy"
+	cacheAPIKeyBased = "key_based"
+)
+
+// maxCacheKeys is the number of keys (the primary key and the fallbacks) the key-based cache API accepts.
+const maxCacheKeys = 8
+
+// keyBasedDownloadInfo is the key-based cache API's restore response.
+type keyBasedDownloadInfo struct {
+	URL        string `json:"url"`
+	MatchedKey string `json:"matched_cache_key"`
+	// Fingerprint is the archive's sha256:<hex> checksum, if known.
+	Fingerprint string `json:"fingerprint"`
+}
+
+// parseCacheKeys parses the newline separated keys, the first one is the primary key, the rest are fallbacks.
+func parseCacheKeys(input string) ([]string, error) {
+	var keys []string
+	for _, line := range strings.Split(input, "\n") {
+		if key := strings.TrimSpace(line); key != "" {
+			keys = append(keys, key)
+		}
+	}
+
+	if len(keys) == 0 {
+		return nil, errors.New("no cache key specified")
+	}
+	if len(keys) > maxCacheKeys {
+		return nil, fmt.Errorf("too many cache keys (%d), the maximum is %d", len(keys), maxCacheKeys)
+	}
+	for _, key := range keys {
+		if strings.Contains(key, ",") {
+			return nil, fmt.Errorf("cache key (%s) contains a comma", key)
+		}
+	}
+	return keys, nil
+}
+
+// getKeyBasedDownloadInfo gets the download URL of the first cache entry matching the keys.
+func getKeyBasedDownloadInfo(baseURL, token string, keys []string) (keyBasedDownloadInfo, error) {
+	if baseURL == "" {
+		return keyBasedDownloadInfo{}, errors.New("key-based cache API URL (BITRISEIO_ABCS_API_URL) is not set")
+	}
+	if token == "" {
+		return keyBasedDownloadInfo{}, errors.New("key-based cache API token (BITRISEIO_ABCS_ACCESS_TOKEN) is not set")
+	}
+
+	restoreURL := fmt.Sprintf("%s/restore?cache_keys=%s", strings.TrimSuffix(baseURL, "/"), url.QueryEscape(strings.Join(keys, ",")))
+	req, err := http.NewRequest("GET", restoreURL, nil)
+	if err != nil {
+		return keyBasedDownloadInfo{}, fmt.Errorf("failed to create request: %s", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	client := &http.Client{Timeout: 20 * time.Second, Transport: http.DefaultClient.Transport, CheckRedirect: http.DefaultClient.CheckRedirect}
+	resp, err := client.Do(req)
+	if err != nil {
+		return keyBasedDownloadInfo{}, fmt.Errorf("failed to send request: %s", err)
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			log.Warnf("Failed to close response body: %s", err)
+		}
+	}()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return keyBasedDownloadInfo{}, fmt.Errorf("request sent, but failed to read response body (http-code: %d): %s", resp.StatusCode, body)
+	}
+
+	if resp.StatusCode == http.StatusNotFound {
+		return keyBasedDownloadInfo{}, errCacheNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return keyBasedDownloadInfo{}, fmt.Errorf("non success response code: %d, body: %s", resp.StatusCode, body)
+	}
+
+	var respModel keyBasedDownloadInfo
+	if err := json.Unmarshal(body, &respModel); err != nil {
+		return keyBasedDownloadInfo{}, fmt.Errorf("failed to parse JSON response (%s): %s", body, err)
+	}
+
+	if respModel.URL == "" {
+		return keyBasedDownloadInfo{}, errors.New("download URL not included in the response")
+	}
+
+	return respModel, nil
+}
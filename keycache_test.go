@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func Test_parseCacheKeys(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    []string
+		wantErr bool
+	}{
+		{"single key", "npm-cache", []string{"npm-cache"}, false},
+		{"fallbacks", "npm-cache-abc\n  npm-cache-\n\nnpm\n", []string{"npm-cache-abc", "npm-cache-", "npm"}, false},
+		{"empty", " \n ", nil, true},
+		{"comma", "a,b", nil, true},
+		{"too many keys", "1\n2\n3\n4\n5\n6\n7\n8\n9", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseCacheKeys(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseCacheKeys() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseCacheKeys() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_getKeyBasedDownloadInfo(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path != "/restore" || r.URL.Query().Get("cache_keys") != "primary,fallback" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if _, err := w.Write([]byte(`{"url": "https://storage/archive", "matched_cache_key": "fallback"}`)); err != nil {
+			t.Errorf("failed to write response: %s", err)
+		}
+	}))
+	defer server.Close()
+
+	got, err := getKeyBasedDownloadInfo(server.URL, "token", []string{"primary", "fallback"})
+	if err != nil {
+		t.Fatalf("getKeyBasedDownloadInfo() error = %v", err)
+	}
+	want := keyBasedDownloadInfo{URL: "https://storage/archive", MatchedKey: "fallback"}
+	if got != want {
+		t.Errorf("getKeyBasedDownloadInfo() = %v, want %v", got, want)
+	}
+
+	if _, err := getKeyBasedDownloadInfo(server.URL, "token", []string{"other"}); err != errCacheNotFound {
+		t.Errorf("getKeyBasedDownloadInfo() error = %v, want %v", err, errCacheNotFound)
+	}
+}
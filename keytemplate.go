@@ -0,0 +1,371 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// keyCommandTimeout limits the commands run by the key templates.
+const keyCommandTimeout = 30 * time.Second
+
+// keyResolver renders the cache key templates: text/template with the build's facts (see keyTemplateData)
+// and the checksum, getenv and run functions, e.g. npm-{{ .Branch }}-{{ checksum "package-lock.json" }}.
+// Each fact, checksum and command is resolved once, the keys share the results.
+type keyResolver struct {
+	// Dir is the project's directory, the git facts, checksums and commands are resolved in it.
+	Dir    string
+	Getenv func(string) string
+	// Now is the time of the rolling key components, the same for every key.
+	Now time.Time
+
+	resolved map[string]string
+}
+
+// newKeyResolver creates a new keyResolver of the project in dir, with the process' environment.
+func newKeyResolver(dir string) *keyResolver {
+	return &keyResolver{Dir: dir, Getenv: os.Getenv, Now: time.Now().UTC(), resolved: map[string]string{}}
+}
+
+// resolve returns the result of fn, fn runs only once for the id.
+func (r *keyResolver) resolve(id string, fn func() (string, error)) (string, error) {
+	if v, ok := r.resolved[id]; ok {
+		return v, nil
+	}
+	v, err := fn()
+	if err != nil {
+		return "", err
+	}
+	r.resolved[id] = v
+	return v, nil
+}
+
+// run runs the command in the project's directory (without a shell) and returns its trimmed output.
+func (r *keyResolver) run(name string, args ...string) (string, error) {
+	return r.resolve("run "+strings.Join(append([]string{name}, args...), " "), func() (string, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), keyCommandTimeout)
+		defer cancel()
+
+		cmd := exec.CommandContext(ctx, name, args...)
+		cmd.Dir = r.Dir
+		out, err := cmd.Output()
+		if ctx.Err() == context.DeadlineExceeded {
+			return "", fmt.Errorf("%s timed out after %s", name, keyCommandTimeout)
+		}
+		if err != nil {
+			if exitErr, ok := err.(*exec.ExitError); ok {
+				return "", fmt.Errorf("%s failed: %s: %s", name, err, strings.TrimSpace(string(exitErr.Stderr)))
+			}
+			return "", fmt.Errorf("%s failed: %s", name, err)
+		}
+		return strings.TrimSpace(string(out)), nil
+	})
+}
+
+// checksum returns the sha256 hex of the project's files matching the patterns (see matchChangedFile),
+// in lexical order of their path. No matching file is the checksum of nothing.
+func (r *keyResolver) checksum(patterns ...string) (string, error) {
+	return r.resolve("checksum "+strings.Join(patterns, " "), func() (string, error) {
+		var files []string
+		err := filepath.Walk(r.Dir, func(pth string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() && info.Name() == ".git" {
+				return filepath.SkipDir
+			}
+			if !info.Mode().IsRegular() {
+				return nil
+			}
+			rel, err := filepath.Rel(r.Dir, pth)
+			if err != nil {
+				return err
+			}
+			rel = filepath.ToSlash(rel)
+			for _, pattern := range patterns {
+				if matchChangedFile(pattern, rel) {
+					files = append(files, rel)
+					break
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return "", err
+		}
+		sort.Strings(files)
+
+		h := sha256.New()
+		for _, file := range files {
+			sum, err := fileHash(filepath.Join(r.Dir, filepath.FromSlash(file)), sha256.New())
+			if err != nil {
+				return "", err
+			}
+			fmt.Fprintf(h, "%s %s\n", sum, file)
+		}
+		return fmt.Sprintf("%x", h.Sum(nil)), nil
+	})
+}
+
+func (r *keyResolver) funcs() template.FuncMap {
+	return template.FuncMap{
+		"checksum": func(patterns ...string) (string, error) { return r.checksum(patterns...) },
+		"getenv":   func(key string) string { return r.Getenv(key) },
+		"run":      func(name string, args ...string) (string, error) { return r.run(name, args...) },
+	}
+}
+
+// parseKeyTemplate parses the key template.
+func parseKeyTemplate(key string, r *keyResolver) (*template.Template, error) {
+	return template.New("key").Funcs(r.funcs()).Parse(key)
+}
+
+// Render renders the key template, the keys without an action are returned as they are.
+func (r *keyResolver) Render(key string) (string, error) {
+	return r.render(key, keyTemplateData{r: r})
+}
+
+// RenderAt renders the key template as if the build ran on the branch at the commit.
+func (r *keyResolver) RenderAt(key, branch, commit string) (string, error) {
+	return r.render(key, keyTemplateData{r: r, branch: branch, commit: commit})
+}
+
+func (r *keyResolver) render(key string, data keyTemplateData) (string, error) {
+	if !strings.Contains(key, "{{") {
+		return key, nil
+	}
+	tmpl, err := parseKeyTemplate(key, r)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	if err := tmpl.Execute(&b, data); err != nil {
+		return "", err
+	}
+
+	rendered := strings.TrimSpace(b.String())
+	if rendered == "" {
+		return "", fmt.Errorf("cache key (%s) is empty", key)
+	}
+	if strings.ContainsAny(rendered, ",\n") {
+		return "", fmt.Errorf("cache key (%s) renders to a comma or a new line: %s", key, rendered)
+	}
+	return rendered, nil
+}
+
+// keyTemplateData are the build's facts of the key templates, e.g. {{ .Branch }}.
+type keyTemplateData struct {
+	r *keyResolver
+	// branch and commit override the build's branch and commit, if set.
+	branch, commit string
+}
+
+// Branch is the build's git branch: BITRISE_GIT_BRANCH, or the checked out branch.
+func (d keyTemplateData) Branch() (string, error) {
+	if d.branch != "" {
+		return d.branch, nil
+	}
+	if branch := d.r.Getenv("BITRISE_GIT_BRANCH"); branch != "" {
+		return branch, nil
+	}
+	return d.r.run("git", "rev-parse", "--abbrev-ref", "HEAD")
+}
+
+// CommitHash is the build's git commit: BITRISE_GIT_COMMIT, or the checked out commit.
+func (d keyTemplateData) CommitHash() (string, error) {
+	if d.commit != "" {
+		return d.commit, nil
+	}
+	if commit := d.r.Getenv("BITRISE_GIT_COMMIT"); commit != "" {
+		return commit, nil
+	}
+	return d.r.run("git", "rev-parse", "HEAD")
+}
+
+// MergeBase is the merge base of the checked out commit and the branch.
+func (d keyTemplateData) MergeBase(branch string) (string, error) {
+	return d.r.mergeBase(branch)
+}
+
+// mergeBase returns the merge base of the checked out commit and the branch (its remote branch, if fetched).
+func (r *keyResolver) mergeBase(branch string) (string, error) {
+	if base, err := r.run("git", "merge-base", "HEAD", "origin/"+branch); err == nil {
+		return base, nil
+	}
+	return r.run("git", "merge-base", "HEAD", branch)
+}
+
+// branchTip returns the commit of the branch (its remote branch, if fetched).
+func (r *keyResolver) branchTip(branch string) (string, error) {
+	if tip, err := r.run("git", "rev-parse", "--verify", "origin/"+branch+"^{commit}"); err == nil {
+		return tip, nil
+	}
+	return r.run("git", "rev-parse", "--verify", branch+"^{commit}")
+}
+
+// Workflow is the triggered workflow's ID.
+func (d keyTemplateData) Workflow() string {
+	return d.r.Getenv("BITRISE_TRIGGERED_WORKFLOW_ID")
+}
+
+// OS is the operating system (darwin, linux).
+func (d keyTemplateData) OS() string {
+	return runtime.GOOS
+}
+
+// Arch is the CPU architecture (amd64, arm64).
+func (d keyTemplateData) Arch() string {
+	return runtime.GOARCH
+}
+
+// WeekOfYear is the ISO week of the year (1-53, in UTC), e.g. for a weekly rotated key.
+func (d keyTemplateData) WeekOfYear() int {
+	_, week := d.r.Now.ISOWeek()
+	return week
+}
+
+// Epoch is the number of the period (e.g. 7d, 12h, 2w) since the Unix epoch, e.g. for a key rotated in every period.
+func (d keyTemplateData) Epoch(period string) (int64, error) {
+	length, err := parseKeyPeriod(period)
+	if err != nil {
+		return 0, err
+	}
+	return d.r.Now.Unix() / int64(length/time.Second), nil
+}
+
+// parseKeyPeriod parses the period of a rolling key: <n>d, <n>w or a Go duration (e.g. 12h), at least a second.
+func parseKeyPeriod(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, fmt.Errorf("no period")
+	}
+	var length time.Duration
+	unit := map[byte]time.Duration{'d': 24 * time.Hour, 'w': 7 * 24 * time.Hour}
+	if multiplier, ok := unit[s[len(s)-1]]; ok && len(s) > 1 {
+		n, err := strconv.Atoi(s[:len(s)-1])
+		if err != nil {
+			return 0, fmt.Errorf("invalid period (%s): %s", s, err)
+		}
+		length = time.Duration(n) * multiplier
+	} else {
+		var err error
+		if length, err = time.ParseDuration(s); err != nil {
+			return 0, fmt.Errorf("invalid period (%s): %s", s, err)
+		}
+	}
+	if length < time.Second {
+		return 0, fmt.Errorf("invalid period (%s): shorter than a second", s)
+	}
+	return length, nil
+}
+
+// keyTemplateDir returns the directory the key templates are resolved in: the working directory,
+// the current directory if it is unknown.
+func keyTemplateDir() string {
+	wd, err := os.Getwd()
+	if err != nil {
+		return "."
+	}
+	return wd
+}
+
+// renderCacheKeys renders the key templates of the keys.
+func renderCacheKeys(keys []string, r *keyResolver) ([]string, error) {
+	var rendered []string
+	for _, key := range keys {
+		k, err := r.Render(key)
+		if err != nil {
+			return nil, err
+		}
+		if k != key {
+			log.Printf("Cache key: %s -> %s", key, k)
+		}
+		rendered = append(rendered, k)
+	}
+	return rendered, nil
+}
+
+// pullRequestKeys returns the keys of a pull request build into the target branch:
+//
+//   - the primary key at the merge base of the pull request and the target branch, as the pull request's commits
+//     rarely have a cache yet,
+//   - the keys of the build,
+//   - the keys at the target branch's tip, the latest cache of the target branch.
+//
+// The duplicates are dropped, at most maxCacheKeys are returned. Without the merge base (e.g. the target branch
+// is not fetched) the keys of the build and the target branch are returned.
+func pullRequestKeys(keys []string, r *keyResolver, targetBranch string) ([]string, error) {
+	var candidates []string
+	if base, err := r.mergeBase(targetBranch); err != nil {
+		log.Warnf("Failed to get the merge base with %s, the cache of the merge base is not used: %s", targetBranch, err)
+	} else {
+		key, err := r.RenderAt(keys[0], targetBranch, base)
+		if err != nil {
+			return nil, err
+		}
+		candidates = append(candidates, key)
+	}
+
+	rendered, err := renderCacheKeys(keys, r)
+	if err != nil {
+		return nil, err
+	}
+	candidates = append(candidates, rendered...)
+
+	if tip, err := r.branchTip(targetBranch); err != nil {
+		log.Warnf("Failed to get the commit of %s, the cache of the target branch is not used: %s", targetBranch, err)
+	} else {
+		for _, key := range keys {
+			k, err := r.RenderAt(key, targetBranch, tip)
+			if err != nil {
+				return nil, err
+			}
+			candidates = append(candidates, k)
+		}
+	}
+
+	var prKeys []string
+	seen := map[string]bool{}
+	for _, key := range candidates {
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		prKeys = append(prKeys, key)
+	}
+	if len(prKeys) > maxCacheKeys {
+		log.Warnf("%d cache keys of the pull request, only the first %d are used", len(prKeys), maxCacheKeys)
+		prKeys = prKeys[:maxCacheKeys]
+	}
+	return prKeys, nil
+}
+
+// resolveCacheKeys returns the rendered cache keys of the build, in pull request builds with the merge base's
+// and the target branch's keys (see pullRequestKeys), if enabled.
+func resolveCacheKeys(conf Config) ([]string, error) {
+	keys, err := parseCacheKeys(conf.Key)
+	if err != nil {
+		return nil, err
+	}
+	r := newKeyResolver(keyTemplateDir())
+	if conf.PullRequestBaseKeys && conf.PullRequestID != "" && conf.TargetBranch != "" {
+		log.Printf("Pull request build into %s, trying the merge base's and the target branch's cache too", conf.TargetBranch)
+		keys, err = pullRequestKeys(keys, r, conf.TargetBranch)
+	} else {
+		keys, err = renderCacheKeys(keys, r)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to render the cache keys: %s", err)
+	}
+	return keys, nil
+}
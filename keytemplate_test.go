@@ -0,0 +1,124 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestKeyResolverRender(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keytemplate-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Logf("failed to remove temp dir: %s", err)
+		}
+	}()
+	writeTestFiles(t, map[string]string{
+		filepath.Join(dir, "package-lock.json"):             "{}",
+		filepath.Join(dir, "packages", "a", "package.json"): "{}",
+	})
+
+	env := map[string]string{"BITRISE_GIT_BRANCH": "feature/login", "BITRISE_TRIGGERED_WORKFLOW_ID": "primary", "XCODE": "15.2"}
+	r := newKeyResolver(dir)
+	r.Getenv = func(key string) string { return env[key] }
+
+	lockChecksum, err := r.checksum("package-lock.json")
+	if err != nil {
+		t.Fatalf("checksum() error = %s", err)
+	}
+
+	tests := []struct {
+		key     string
+		want    string
+		wantErr bool
+	}{
+		{key: "npm-plain", want: "npm-plain"},
+		{key: `npm-{{ .Branch }}-{{ .Workflow }}`, want: "npm-feature/login-primary"},
+		{key: `xcode-{{ getenv "XCODE" }}`, want: "xcode-15.2"},
+		{key: `npm-{{ checksum "package-lock.json" }}`, want: "npm-" + lockChecksum},
+		{key: `ruby-{{ run "echo" "3.2.2" }}`, want: "ruby-3.2.2"},
+		{key: `{{ getenv "MISSING" }}`, wantErr: true},
+		{key: `{{ run "echo" "a,b" }}`, wantErr: true},
+		{key: `{{ run "false" }}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := r.Render(tt.key)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("Render(%s) error = %v, wantErr %v", tt.key, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("Render(%s) = %s, want %s", tt.key, got, tt.want)
+		}
+	}
+
+	t.Log("the patterns without a separator match in any directory")
+	{
+		all, err := r.checksum("package*.json")
+		if err != nil || all == lockChecksum {
+			t.Errorf("checksum(package*.json) = %s, %v, want the checksum of both files", all, err)
+		}
+	}
+}
+
+func TestParseKeyTemplate(t *testing.T) {
+	if _, err := parseKeyTemplate(`npm-{{ checksum "package-lock.json" }}`, nil); err != nil {
+		t.Errorf("parseKeyTemplate() error = %s", err)
+	}
+	if _, err := parseKeyTemplate(`npm-{{ hash "package-lock.json" }}`, nil); err == nil {
+		t.Errorf("parseKeyTemplate(unknown function) error = nil, want error")
+	}
+}
+
+func TestPullRequestKeys(t *testing.T) {
+	env := map[string]string{"BITRISE_GIT_BRANCH": "feature", "BITRISE_GIT_COMMIT": "head"}
+	r := newKeyResolver(".")
+	r.Getenv = func(key string) string { return env[key] }
+	// the git facts are resolved once, the resolved ones are not run
+	r.resolved["run git merge-base HEAD origin/main"] = "base"
+	r.resolved["run git rev-parse --verify origin/main^{commit}"] = "tip"
+
+	keys := []string{"npm-{{ .Branch }}-{{ .CommitHash }}", "npm-{{ .Branch }}", "npm"}
+	got, err := pullRequestKeys(keys, r, "main")
+	if err != nil {
+		t.Fatalf("pullRequestKeys() error = %s", err)
+	}
+	want := []string{"npm-main-base", "npm-feature-head", "npm-feature", "npm", "npm-main-tip", "npm-main"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("pullRequestKeys() = %v, want %v", got, want)
+	}
+}
+
+func TestKeyResolverRollingKeys(t *testing.T) {
+	r := newKeyResolver(".")
+	r.Now = time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		key     string
+		want    string
+		wantErr bool
+	}{
+		{key: "gradle-{{ .WeekOfYear }}", want: "gradle-2"},
+		{key: `gradle-{{ .Epoch "7d" }}`, want: "gradle-2818"},
+		{key: `gradle-{{ .Epoch "1w" }}`, want: "gradle-2818"},
+		{key: `gradle-{{ .Epoch "12h" }}`, want: "gradle-39465"},
+		{key: `gradle-{{ .Epoch "0d" }}`, wantErr: true},
+		{key: `gradle-{{ .Epoch "weekly" }}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := r.Render(tt.key)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("Render(%s) error = %v, wantErr %v", tt.key, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("Render(%s) = %s, want %s", tt.key, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+
+	"github.com/bitrise-io/go-utils/command"
+	"github.com/bitrise-io/go-utils/errorutil"
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// The FUSE tools of the lazy restore, see the lazy_restore input.
+const (
+	archivemountTool  = "archivemount"
+	fuseOverlayfsTool = "fuse-overlayfs"
+	fusermountTool    = "fusermount"
+)
+
+const (
+	fuseDevice         = "/dev/fuse"
+	lazyMountDirPrefix = "mount-"
+)
+
+// lazyMount is a cached directory restored lazily: the overlay of the archive's directory (read from the archive
+// on the first access) and of a writable directory (the files written by the build), mounted at Target.
+type lazyMount struct {
+	Source string
+	Target string
+}
+
+// checkLazyRestore returns why the lazy restore is not available: it needs FUSE (on Linux), archivemount
+// (mounting the archive read-only) and fuse-overlayfs (making the mounted directories writable).
+func checkLazyRestore(goos, device string, lookPath func(string) (string, error)) error {
+	if goos != "linux" {
+		return fmt.Errorf("the lazy restore is supported on Linux only")
+	}
+	if _, err := os.Stat(device); err != nil {
+		return fmt.Errorf("FUSE is not available: %s", err)
+	}
+	for _, tool := range []string{archivemountTool, fuseOverlayfsTool, fusermountTool} {
+		if _, err := lookPath(tool); err != nil {
+			return fmt.Errorf("%s is not installed", tool)
+		}
+	}
+	return nil
+}
+
+// planLazyMounts walks the mounted archive (mnt), restored into root: the archive's directories missing from root
+// are mounted lazily, the existing ones are walked into, and every other entry (e.g. the files of an existing
+// directory) is returned to be copied, so a mount does not hide the files of the workspace.
+func planLazyMounts(mnt, root string) ([]lazyMount, []string, error) {
+	var mounts []lazyMount
+	var copies []string
+
+	var walk func(rel string) error
+	walk = func(rel string) error {
+		infos, err := ioutil.ReadDir(filepath.Join(mnt, rel))
+		if err != nil {
+			return err
+		}
+		for _, info := range infos {
+			name := filepath.Join(rel, info.Name())
+			target := filepath.Join(root, name)
+			existing, err := os.Lstat(target)
+			switch {
+			case os.IsNotExist(err) && info.IsDir():
+				mounts = append(mounts, lazyMount{Source: filepath.Join(mnt, name), Target: target})
+			case err != nil && !os.IsNotExist(err):
+				return err
+			case err == nil && info.IsDir() && existing.IsDir():
+				if err := walk(name); err != nil {
+					return err
+				}
+			default:
+				copies = append(copies, name)
+			}
+		}
+		return nil
+	}
+
+	if err := walk(""); err != nil {
+		return nil, nil, err
+	}
+	return mounts, copies, nil
+}
+
+// isMountPoint reports whether pth is a mount point: it is on another device than its parent.
+func isMountPoint(pth string) bool {
+	var st, parent syscall.Stat_t
+	if err := syscall.Stat(pth, &st); err != nil {
+		return false
+	}
+	if err := syscall.Stat(filepath.Dir(pth), &parent); err != nil {
+		return false
+	}
+	return st.Dev != parent.Dev
+}
+
+// pruneLazyMountDirs removes the earlier builds' lazy restore directories in root, which are not mounted anymore.
+func pruneLazyMountDirs(root string) error {
+	infos, err := ioutil.ReadDir(root)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		pth := filepath.Join(root, info.Name())
+		if !info.IsDir() || !strings.HasPrefix(info.Name(), lazyMountDirPrefix) || isMountPoint(filepath.Join(pth, "archive")) {
+			continue
+		}
+		log.Debugf("Removing the lazy restore directory of an earlier build: %s", pth)
+		if err := os.RemoveAll(pth); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runFuseTool runs a FUSE tool, its error contains the tool's output.
+func runFuseTool(name string, args ...string) error {
+	cmd := command.New(name, args...)
+	log.Debugf("$ %s", cmd.PrintableCommandArgs())
+	out, err := cmd.RunAndReturnTrimmedCombinedOutput()
+	if err != nil {
+		if errorutil.IsExitStatusError(err) {
+			return fmt.Errorf("%s failed: %s", cmd.PrintableCommandArgs(), out)
+		}
+		return fmt.Errorf("%s failed: %s", cmd.PrintableCommandArgs(), err)
+	}
+	return nil
+}
+
+func unmountFuse(pth string) {
+	if err := runFuseTool(fusermountTool, "-u", pth); err != nil {
+		log.Warnf("Failed to unmount %s: %s", pth, err)
+	}
+}
+
+// readArchiveInfoFile returns the archive_info.json of the local archive, if it is the archive's first entry.
+func readArchiveInfoFile(pth string) (archiveInfo, bool, error) {
+	f, err := os.Open(pth)
+	if err != nil {
+		return archiveInfo{}, false, err
+	}
+	defer func() {
+		if err := f.Close(); err != nil {
+			log.Warnf("Failed to close %s: %s", pth, err)
+		}
+	}()
+
+	br := bufio.NewReader(f)
+	var r io.Reader = br
+	if isZstdStream(br) {
+		zr, err := NewZstdReader(br)
+		if err != nil {
+			return archiveInfo{}, false, err
+		}
+		defer func() {
+			if err := zr.Close(); err != nil {
+				log.Debugf("Failed to stop zstd: %s", err)
+			}
+		}()
+		r = zr
+	}
+
+	tr, hdr, _, err := readFirstEntry(r)
+	if err != nil {
+		return archiveInfo{}, false, err
+	}
+	if hdr == nil || filepath.Base(hdr.Name) != archiveInfoFileName {
+		return archiveInfo{}, false, nil
+	}
+	b, err := ioutil.ReadAll(tr)
+	if err != nil {
+		return archiveInfo{}, false, err
+	}
+	info, err := parseArchiveInfo(b)
+	return info, err == nil, err
+}
+
+// restoreLazily mounts the archive instead of extracting it, see the lazy_restore input, and returns the status
+// of the restore. It returns an empty status if the archive has to be extracted (eagerly) instead,
+// if the archive was downloaded already, cacheParts[0] is replaced by the downloaded file.
+func restoreLazily(conf Config, cacheParts []string, filtered bool) string {
+	if err := checkLazyRestore(runtime.GOOS, fuseDevice, exec.LookPath); err != nil {
+		result.Warnf("Lazy restore is not available (%s), extracting the cache archive", err)
+		return ""
+	}
+	switch {
+	case len(cacheParts) > 1:
+		result.Warnf("The split cache archives can not be restored lazily, extracting the cache archive")
+		return ""
+	case conf.ZstdDictionary != "":
+		result.Warnf("The archives compressed with a zstd dictionary can not be restored lazily, extracting the cache archive")
+		return ""
+	}
+	if filtered {
+		result.Warnf("The lazy restore does not support skip_on_change, project_path, swift_package_resolved and android_project_path, every path is restored")
+	}
+
+	root := filepath.Join(stepTempDir, "lazy")
+	if err := pruneLazyMountDirs(root); err != nil {
+		result.Warnf("Failed to remove the lazy restore directories of the earlier builds: %s", err)
+	}
+	if err := ensurePrivateDir(root); err != nil {
+		result.Warnf("Failed to create the lazy restore directory, extracting the cache archive: %s", err)
+		return ""
+	}
+	dir, err := ioutil.TempDir(root, lazyMountDirPrefix)
+	if err != nil {
+		result.Warnf("Failed to create the lazy restore directory, extracting the cache archive: %s", err)
+		return ""
+	}
+
+	result.StartSection("download_and_extract", "Downloading the cache archive for the lazy restore")
+	pth, err := downloadCacheArchive(cacheParts, conf.BuildSlug)
+	if err != nil {
+		failAs(failureDownload, "Failed to download the cache archive: %s", err)
+	}
+	local := strings.HasPrefix(cacheParts[0], "file://")
+	if !local {
+		// the mounted archive is read by the build, after the step run's directory is removed
+		archivePath := filepath.Join(dir, "cache-archive.tar")
+		if err := movePath(pth, archivePath); err != nil {
+			failAs(failureDownload, "Failed to move the cache archive to %s: %s", dir, err)
+		}
+		pth = archivePath
+	}
+	if info, err := os.Stat(pth); err == nil {
+		result.ArchiveSize = info.Size()
+	}
+
+	status, err := mountArchive(conf, pth, dir)
+	if err != nil {
+		result.Warnf("Failed to mount the cache archive, extracting it: %s", err)
+		if !local {
+			// extracted from the step run's directory, removed when the step exits
+			archivePath := filepath.Join(stepRunDir, "cache-archive.tar")
+			if err := movePath(pth, archivePath); err != nil {
+				failAs(failureDownload, "Failed to move the cache archive to %s: %s", stepRunDir, err)
+			}
+			cacheParts[0] = "file://" + archivePath
+		}
+	}
+	if status != statusRestored {
+		if err := os.RemoveAll(dir); err != nil {
+			log.Warnf("Failed to remove %s: %s", dir, err)
+		}
+	}
+	return status
+}
+
+// mountArchive mounts the archive at pth, and its directories missing from the workspace into their place,
+// and returns the status of the restore. If the archive can not be mounted, the mounts made so far are removed.
+func mountArchive(conf Config, pth, dir string) (status string, err error) {
+	result.StartSection("", "Mounting the cache archive")
+
+	info, hasInfo, err := readArchiveInfoFile(pth)
+	if err != nil {
+		return "", fmt.Errorf("failed to read the archive info: %s", err)
+	}
+	if hasInfo {
+		if _, err := checkArchiveSchema(info); err != nil {
+			result.Warnf("Incompatible cache archive: %s", err)
+			result.Warnf("Skipping cache pull, because of the incompatible cache archive")
+			return statusSkipped, nil
+		}
+		if currentStackID := strings.TrimSpace(conf.StackID); currentStackID != "" && !isSameStack(info.StackID, currentStackID) {
+			result.Warnf("Cache was created on stack: %s, current stack: %s", info.StackID, currentStackID)
+			result.Warnf("Skipping cache pull, because of the stack has changed")
+			return statusSkipped, nil
+		}
+	}
+
+	mnt := filepath.Join(dir, "archive")
+	if err := os.Mkdir(mnt, 0700); err != nil {
+		return "", err
+	}
+	if err := runFuseTool(archivemountTool, "-o", "readonly", pth, mnt); err != nil {
+		return "", err
+	}
+	mountPoints := []string{mnt}
+	defer func() {
+		if err == nil {
+			return
+		}
+		// the overlays are unmounted before the archive they are reading
+		for i := len(mountPoints) - 1; i >= 0; i-- {
+			unmountFuse(mountPoints[i])
+		}
+	}()
+
+	root := "/"
+	if conf.ExtractToRelativePath {
+		if root, err = os.Getwd(); err != nil {
+			return "", err
+		}
+	}
+	mounts, copies, err := planLazyMounts(mnt, root)
+	if err != nil {
+		return "", fmt.Errorf("failed to read the mounted cache archive: %s", err)
+	}
+
+	for i, m := range mounts {
+		upper := filepath.Join(dir, "upper", fmt.Sprintf("%d", i))
+		work := filepath.Join(dir, "work", fmt.Sprintf("%d", i))
+		for _, d := range []string{upper, work, m.Target} {
+			if err := os.MkdirAll(d, 0755); err != nil {
+				return "", fmt.Errorf("failed to mount %s: %s", m.Target, err)
+			}
+		}
+		opts := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", m.Source, upper, work)
+		if err := runFuseTool(fuseOverlayfsTool, "-o", opts, m.Target); err != nil {
+			return "", fmt.Errorf("failed to mount %s: %s", m.Target, err)
+		}
+		mountPoints = append(mountPoints, m.Target)
+		log.Printf("Mounted %s", m.Target)
+	}
+	for _, name := range copies {
+		if err := copyArchivePath(filepath.Join(mnt, name), filepath.Join(root, name)); err != nil {
+			return "", fmt.Errorf("failed to restore %s: %s", filepath.Join(root, name), err)
+		}
+	}
+	log.Donef("%d directories mounted, restored on their first access, %d paths copied", len(mounts), len(copies))
+	return statusRestored, nil
+}
+
+// copyArchivePath copies a file, symlink or directory of the mounted archive to target, replacing the existing file.
+func copyArchivePath(source, target string) error {
+	info, err := os.Lstat(source)
+	if err != nil {
+		return err
+	}
+	if err := os.RemoveAll(target); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	switch {
+	case info.IsDir():
+		return copyTree(source, target)
+	case info.Mode()&os.ModeSymlink != 0:
+		link, err := os.Readlink(source)
+		if err != nil {
+			return err
+		}
+		return os.Symlink(link, target)
+	default:
+		return copyFile(source, target, info)
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestCheckLazyRestore(t *testing.T) {
+	device, err := ioutil.TempFile("", "fuse")
+	if err != nil {
+		t.Fatalf("failed to create temp file: %s", err)
+	}
+	defer func() {
+		if err := os.Remove(device.Name()); err != nil {
+			t.Logf("failed to remove temp file: %s", err)
+		}
+	}()
+	if err := device.Close(); err != nil {
+		t.Fatalf("failed to close temp file: %s", err)
+	}
+
+	installed := func(tools ...string) func(string) (string, error) {
+		return func(name string) (string, error) {
+			for _, tool := range tools {
+				if tool == name {
+					return "/usr/bin/" + name, nil
+				}
+			}
+			return "", errors.New("not found")
+		}
+	}
+	every := installed(archivemountTool, fuseOverlayfsTool, fusermountTool)
+
+	tests := []struct {
+		name     string
+		goos     string
+		device   string
+		lookPath func(string) (string, error)
+		wantErr  bool
+	}{
+		{name: "available", goos: "linux", device: device.Name(), lookPath: every},
+		{name: "macOS", goos: "darwin", device: device.Name(), lookPath: every, wantErr: true},
+		{name: "no FUSE device", goos: "linux", device: device.Name() + "-missing", lookPath: every, wantErr: true},
+		{name: "no overlay tool", goos: "linux", device: device.Name(), lookPath: installed(archivemountTool, fusermountTool), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := checkLazyRestore(tt.goos, tt.device, tt.lookPath); (err != nil) != tt.wantErr {
+				t.Errorf("checkLazyRestore() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPlanLazyMounts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lazy-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Logf("failed to remove temp dir: %s", err)
+		}
+	}()
+
+	// the mounted archive
+	mnt := filepath.Join(dir, "archive")
+	root := filepath.Join(dir, "root")
+	writeTestFiles(t, map[string]string{
+		filepath.Join(mnt, "home/.gradle/caches/a.jar"):       "content",
+		filepath.Join(mnt, "home/.gradle/wrapper/gradle.zip"): "content",
+		filepath.Join(mnt, "home/.cocoapods/repos/spec"):      "content",
+		filepath.Join(mnt, "home/.netrc"):                     "content",
+		filepath.Join(mnt, "project/build.log"):               "content",
+		// the workspace
+		filepath.Join(root, "home/.gradle/caches/other.jar"): "content",
+		filepath.Join(root, "project"):                       "a file in place of the archive's directory",
+	})
+
+	mounts, copies, err := planLazyMounts(mnt, root)
+	if err != nil {
+		t.Fatalf("planLazyMounts() error = %s", err)
+	}
+
+	wantMounts := []lazyMount{
+		{Source: filepath.Join(mnt, "home/.cocoapods"), Target: filepath.Join(root, "home/.cocoapods")},
+		{Source: filepath.Join(mnt, "home/.gradle/wrapper"), Target: filepath.Join(root, "home/.gradle/wrapper")},
+	}
+	if !reflect.DeepEqual(mounts, wantMounts) {
+		t.Errorf("mounts = %v, want %v", mounts, wantMounts)
+	}
+	wantCopies := []string{"home/.gradle/caches/a.jar", "home/.netrc", "project"}
+	if !reflect.DeepEqual(copies, wantCopies) {
+		t.Errorf("copies = %v, want %v", copies, wantCopies)
+	}
+}
+
+func TestCopyArchivePath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lazy-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Logf("failed to remove temp dir: %s", err)
+		}
+	}()
+
+	writeTestFiles(t, map[string]string{
+		filepath.Join(dir, "archive/project/build/out.txt"): "archived",
+		filepath.Join(dir, "root/project"):                  "replaced",
+	})
+
+	if err := copyArchivePath(filepath.Join(dir, "archive/project"), filepath.Join(dir, "root/project")); err != nil {
+		t.Fatalf("copyArchivePath() error = %s", err)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, "root/project/build/out.txt"))
+	if err != nil || string(b) != "archived" {
+		t.Errorf("copied file = %q, %v, want %q", b, err, "archived")
+	}
+}
+
+func TestPruneLazyMountDirs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lazy-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Logf("failed to remove temp dir: %s", err)
+		}
+	}()
+
+	unmounted := filepath.Join(dir, lazyMountDirPrefix+"1")
+	other := filepath.Join(dir, "other")
+	writeTestFiles(t, map[string]string{
+		filepath.Join(unmounted, "cache-archive.tar"): "archive",
+		filepath.Join(other, "file"):                  "content",
+	})
+
+	if err := pruneLazyMountDirs(dir); err != nil {
+		t.Fatalf("pruneLazyMountDirs() error = %s", err)
+	}
+	if _, err := os.Stat(unmounted); !os.IsNotExist(err) {
+		t.Errorf("%s exists after the prune", unmounted)
+	}
+	if _, err := os.Stat(other); err != nil {
+		t.Errorf("%s is removed: %s", other, err)
+	}
+	if err := pruneLazyMountDirs(filepath.Join(dir, "missing")); err != nil {
+		t.Errorf("pruneLazyMountDirs() error = %s for a missing directory", err)
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// cacheInfoFileName is the metadata file of the legacy cache archive format.
+const cacheInfoFileName = "cache-info.json"
+
+// Cache item statuses, see ItemResult.
+const (
+	itemRestored = "restored"
+	itemFailed   = "failed"
+	itemSkipped  = "skipped"
+)
+
+// Failed items threshold actions, see the failed_items_action input.
+const (
+	failedItemsActionWarn = "warn"
+	failedItemsActionFail = "fail"
+)
+
+// ItemResult is the restore result of a cached path of the legacy cache archive format.
+type ItemResult struct {
+	Path   string `json:"path"`
+	Status string `json:"status"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// CacheContentModel describes a cached path in the legacy cache archive format.
+type CacheContentModel struct {
+	DestinationPath       string `json:"destination_path"`
+	RelativePathInArchive string `json:"relative_path_in_archive"`
+}
+
+// CacheInfosModel is the content of the legacy cache archive's cache-info.json.
+type CacheInfosModel struct {
+	Fingerprint string              `json:"fingerprint"`
+	Contents    []CacheContentModel `json:"cache_contents"`
+}
+
+// isLegacyCacheInfoEntry reports whether the archive entry is the legacy format's cache-info.json.
+// The legacy format stores the cached paths relative to the archive's root, described by cache-info.json,
+// while the current format stores them with absolute paths (tar -P).
+func isLegacyCacheInfoEntry(name string) bool {
+	return strings.TrimPrefix(filepath.Clean(name), "./") == cacheInfoFileName
+}
+
+// restoreLegacyCache extracts the legacy format archive stream into a temporary directory
+// and moves the cached paths selected by the filter to their destination.
+// The umask (if set) is applied to the directories' modes too.
+// It returns the per item results and the archive's fingerprint.
+func restoreLegacyCache(r io.Reader, compressed bool, filter pathFilter, umask *os.FileMode) ([]ItemResult, string, error) {
+	tmpDir, err := ioutil.TempDir(stepTempDir, "cache-pull-legacy")
+	if err != nil {
+		return nil, "", err
+	}
+	defer func() {
+		if err := os.RemoveAll(tmpDir); err != nil {
+			log.Warnf("Failed to remove temporary directory: %s", err)
+		}
+	}()
+
+	extractor := NewExtractor(tmpDir, true)
+	extractor.Umask = umask
+	if err := extractArchive(r, extractor, compressed); err != nil {
+		return nil, "", err
+	}
+
+	cacheInfo, err := readCacheInfo(filepath.Join(tmpDir, cacheInfoFileName))
+	if err != nil {
+		return nil, "", err
+	}
+	log.Debugf("cache fingerprint: %s", cacheInfo.Fingerprint)
+
+	return uncompressCaches(tmpDir, cacheInfo, filter), cacheInfo.Fingerprint, nil
+}
+
+func readCacheInfo(pth string) (CacheInfosModel, error) {
+	b, err := ioutil.ReadFile(pth)
+	if err != nil {
+		return CacheInfosModel{}, fmt.Errorf("failed to read %s: %s", cacheInfoFileName, err)
+	}
+
+	var cacheInfo CacheInfosModel
+	if err := json.Unmarshal(b, &cacheInfo); err != nil {
+		return CacheInfosModel{}, fmt.Errorf("failed to parse %s: %s", cacheInfoFileName, err)
+	}
+	return cacheInfo, nil
+}
+
+// uncompressCaches moves the extracted cache contents to their destination and returns the per item results.
+func uncompressCaches(tmpDir string, cacheInfo CacheInfosModel, filter pathFilter) []ItemResult {
+	var results []ItemResult
+	for _, content := range cacheInfo.Contents {
+		if filter.excludes(filepath.Clean(content.DestinationPath)) {
+			log.Printf("Skipping: %s", content.DestinationPath)
+			results = append(results, ItemResult{Path: content.DestinationPath, Status: itemSkipped, Reason: "excluded by skip_on_change or project_path"})
+			continue
+		}
+
+		log.Printf("Restoring: %s", content.DestinationPath)
+
+		status, reason := restoreCacheItem(tmpDir, content)
+		if status != itemRestored {
+			log.Warnf("%s %s: %s", strings.Title(status), content.DestinationPath, reason)
+		}
+		results = append(results, ItemResult{Path: content.DestinationPath, Status: status, Reason: reason})
+	}
+	return results
+}
+
+func restoreCacheItem(tmpDir string, content CacheContentModel) (string, string) {
+	srcPath := filepath.Join(tmpDir, content.RelativePathInArchive)
+	targetPath := content.DestinationPath
+
+	if _, err := os.Lstat(srcPath); os.IsNotExist(err) {
+		return itemSkipped, fmt.Sprintf("%s is not in the archive", content.RelativePathInArchive)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(targetPath), 0755); err != nil {
+		return itemFailed, fmt.Sprintf("failed to create parent directory: %s", err)
+	}
+	if err := os.RemoveAll(targetPath); err != nil {
+		return itemFailed, fmt.Sprintf("failed to remove the existing path: %s", err)
+	}
+	if err := movePath(srcPath, targetPath); err != nil {
+		return itemFailed, fmt.Sprintf("failed to move cache item (%s) to its place: %s", srcPath, err)
+	}
+	return itemRestored, ""
+}
+
+// countItems returns the number of items with the given status.
+func countItems(results []ItemResult, status string) int {
+	count := 0
+	for _, r := range results {
+		if r.Status == status {
+			count++
+		}
+	}
+	return count
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_isLegacyCacheInfoEntry(t *testing.T) {
+	for name, want := range map[string]bool{
+		"cache-info.json":         true,
+		"./cache-info.json":       true,
+		"/tmp/archive_info.json":  false,
+		"/tmp/cache-info.json":    false,
+		"content/cache-info.json": false,
+	} {
+		if got := isLegacyCacheInfoEntry(name); got != want {
+			t.Errorf("isLegacyCacheInfoEntry(%s) = %v, want %v", name, got, want)
+		}
+	}
+}
+
+func Test_restoreLegacyCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "legacy-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Logf("failed to remove temp dir: %s", err)
+		}
+	}()
+
+	destination := filepath.Join(dir, "Pods")
+	cacheInfo := fmt.Sprintf(`{"fingerprint": "abc", "cache_contents": [{"destination_path": "%s", "relative_path_in_archive": "content/0"}, {"destination_path": "%s", "relative_path_in_archive": "content/1"}]}`, destination, filepath.Join(dir, "missing"))
+	entries := []testEntry{
+		{name: "cache-info.json", content: cacheInfo},
+		{name: "content/0/Manifest.lock", content: "manifest"},
+	}
+
+	results, _, err := restoreLegacyCache(createTestArchive(t, entries), false, pathFilter{}, nil)
+	if err != nil {
+		t.Fatalf("restoreLegacyCache() error = %v", err)
+	}
+	if countItems(results, itemRestored) != 1 || countItems(results, itemSkipped) != 1 {
+		t.Errorf("restoreLegacyCache() = %v, want 1 restored and 1 skipped item", results)
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(destination, "Manifest.lock"))
+	if err != nil {
+		t.Fatalf("failed to read restored file: %s", err)
+	}
+	if string(b) != "manifest" {
+		t.Errorf("restored file content = %s, want %s", b, "manifest")
+	}
+}
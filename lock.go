@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+)
+
+// lockPollInterval is the interval of retrying a lock held by another process.
+const lockPollInterval = 100 * time.Millisecond
+
+// fileLock is an advisory (flock) lock of a file, shared by the concurrent step runs of the host.
+// The lock is released on Unlock, or when the process exits, so a crashed step does not keep it.
+type fileLock struct {
+	f *os.File
+}
+
+// tryLockFile locks the file (created if missing), it returns nil if the file is locked by another process.
+func tryLockFile(pth string) (*fileLock, error) {
+	f, err := os.OpenFile(pth, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	locked, err := tryLock(f)
+	if err != nil || !locked {
+		if cErr := f.Close(); cErr != nil && err == nil {
+			err = cErr
+		}
+		return nil, err
+	}
+	return &fileLock{f: f}, nil
+}
+
+// lockFile locks the file (created if missing), waiting at most timeout for the other processes to release it.
+func lockFile(pth string, timeout time.Duration) (*fileLock, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		l, err := tryLockFile(pth)
+		if err != nil || l != nil {
+			return l, err
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("%s is locked by another step for more than %s", pth, timeout)
+		}
+		time.Sleep(lockPollInterval)
+	}
+}
+
+// tryLock locks the open file, it returns false if the file is locked by another process.
+func tryLock(f *os.File) (bool, error) {
+	err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Unlock releases the lock.
+func (l *fileLock) Unlock() error {
+	return l.f.Close()
+}
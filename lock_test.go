@@ -0,0 +1,48 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lock-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Logf("failed to remove temp dir: %s", err)
+		}
+	}()
+
+	pth := filepath.Join(dir, "state.json.lock")
+	l, err := tryLockFile(pth)
+	if err != nil || l == nil {
+		t.Fatalf("tryLockFile() = %v, %v, want lock", l, err)
+	}
+
+	if other, err := tryLockFile(pth); err != nil || other != nil {
+		t.Errorf("tryLockFile() of a locked file = %v, %v, want nil", other, err)
+	}
+	if _, err := lockFile(pth, 2*lockPollInterval); err == nil {
+		t.Errorf("lockFile() of a locked file error = nil, want timeout")
+	}
+
+	go func() {
+		time.Sleep(lockPollInterval)
+		if err := l.Unlock(); err != nil {
+			t.Errorf("Unlock() error = %v", err)
+		}
+	}()
+	other, err := lockFile(pth, 10*lockPollInterval)
+	if err != nil {
+		t.Fatalf("lockFile() after unlock error = %v", err)
+	}
+	if err := other.Unlock(); err != nil {
+		t.Errorf("Unlock() error = %v", err)
+	}
+}
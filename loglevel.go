@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// Log levels, see the log_level input.
+const (
+	logLevelError = "error"
+	logLevelWarn  = "warn"
+	logLevelInfo  = "info"
+	logLevelDebug = "debug"
+	// logLevelTrace logs the HTTP requests too.
+	logLevelTrace = "trace"
+)
+
+var logLevels = map[string]int{
+	logLevelError: 0,
+	logLevelWarn:  1,
+	logLevelInfo:  2,
+	logLevelDebug: 3,
+	logLevelTrace: 4,
+}
+
+// The color prefixes of the log package's error and warning messages.
+var (
+	errorMessagePrefix = []byte("\x1b[31;1m")
+	warnMessagePrefix  = []byte("\x1b[33;1m")
+)
+
+// logFilter is the step's log output, it filters the messages by the log_level and quiet inputs (see configureLogging).
+var logFilter = &levelWriter{w: newRedactingWriter(os.Stdout), level: logLevelInfo}
+
+// levelWriter drops the log messages above its level. The log package writes every message at once,
+// its level is told by its color: the errors are red, the warnings are yellow, everything else is info
+// (the debug messages are not written at all, unless the debug log is enabled).
+type levelWriter struct {
+	w     io.Writer
+	level string
+	// quiet drops every message but the errors, the summary is printed by Summaryf.
+	quiet bool
+}
+
+// Write implements the io.Writer interface.
+func (w *levelWriter) Write(p []byte) (int, error) {
+	if !w.Enabled(messageLevel(p)) {
+		return len(p), nil
+	}
+	if _, err := w.w.Write(p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Enabled reports whether the messages of the level are printed.
+func (w *levelWriter) Enabled(level string) bool {
+	if w.quiet && level != logLevelError {
+		return false
+	}
+	return logLevels[level] <= logLevels[w.level]
+}
+
+// Summaryf prints the final summary of the pull, in quiet mode too.
+func (w *levelWriter) Summaryf(format string, args ...interface{}) {
+	if _, err := fmt.Fprintf(w.w, format+"\n", args...); err != nil {
+		fmt.Printf("failed to print summary: %s\n", err)
+	}
+}
+
+// At returns a writer of the messages of the level, for the output not written by the log package
+// (e.g. the hooks' output), so it is filtered by its source instead of its color.
+func (w *levelWriter) At(level string) io.Writer {
+	return fixedLevelWriter{w: w, level: level}
+}
+
+type fixedLevelWriter struct {
+	w     *levelWriter
+	level string
+}
+
+// Write implements the io.Writer interface.
+func (w fixedLevelWriter) Write(p []byte) (int, error) {
+	if !w.w.Enabled(w.level) {
+		return len(p), nil
+	}
+	if _, err := w.w.w.Write(p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func messageLevel(p []byte) string {
+	switch {
+	case bytes.HasPrefix(p, errorMessagePrefix):
+		return logLevelError
+	case bytes.HasPrefix(p, warnMessagePrefix):
+		return logLevelWarn
+	default:
+		return logLevelInfo
+	}
+}
+
+// configureLogging sets the log level (is_debug_mode enables the debug log at the info level too) and the quiet mode.
+func configureLogging(level string, debugMode, quiet bool) {
+	if level == "" {
+		level = logLevelInfo
+	}
+	if debugMode && logLevels[level] < logLevels[logLevelDebug] {
+		level = logLevelDebug
+	}
+	logFilter.level = level
+	logFilter.quiet = quiet
+	log.SetEnableDebugLog(logLevels[level] >= logLevels[logLevelDebug])
+}
+
+// traceTransport logs the HTTP requests and their responses, at the trace log level.
+type traceTransport struct {
+	next http.RoundTripper
+}
+
+func newTraceTransport(next http.RoundTripper) http.RoundTripper {
+	return traceTransport{next: next}
+}
+
+// RoundTrip implements the http.RoundTripper interface.
+func (t traceTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	if r := req.Header.Get("Range"); r != "" {
+		log.Debugf("HTTP %s %s (%s)", req.Method, redactURL(req.URL.String()), r)
+	} else {
+		log.Debugf("HTTP %s %s", req.Method, redactURL(req.URL.String()))
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		log.Debugf("HTTP %s %s failed after %s: %s", req.Method, redactURL(req.URL.String()), time.Since(start).Round(time.Millisecond), err)
+		return nil, err
+	}
+	log.Debugf("HTTP %s %s: %d, %d Bytes, %s", req.Method, redactURL(req.URL.String()), resp.StatusCode, resp.ContentLength, time.Since(start).Round(time.Millisecond))
+	return resp, nil
+}
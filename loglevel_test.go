@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// colorPattern matches the ANSI color sequences of the log messages.
+var colorPattern = regexp.MustCompile("\x1b\\[[0-9;]*m")
+
+func TestLevelWriter(t *testing.T) {
+	tests := []struct {
+		level string
+		quiet bool
+		want  []string
+	}{
+		{level: logLevelError, want: []string{"error"}},
+		{level: logLevelWarn, want: []string{"warn", "error"}},
+		{level: logLevelInfo, want: []string{"info", "print", "done", "warn", "error"}},
+		{level: logLevelDebug, want: []string{"info", "print", "done", "debug", "warn", "error"}},
+		{level: logLevelDebug, quiet: true, want: []string{"error"}},
+	}
+	defer func() {
+		log.SetOutWriter(logFilter)
+		log.SetEnableDebugLog(false)
+	}()
+
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		w := &levelWriter{w: &buf, level: tt.level, quiet: tt.quiet}
+		log.SetOutWriter(w)
+		log.SetEnableDebugLog(w.Enabled(logLevelDebug))
+
+		log.Infof("info")
+		log.Printf("print")
+		log.Donef("done")
+		log.Debugf("debug")
+		log.Warnf("warn")
+		log.Errorf("error")
+
+		var got []string
+		for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+			got = append(got, colorPattern.ReplaceAllString(line, ""))
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("level: %s, quiet: %v, printed = %q, want %q", tt.level, tt.quiet, got, tt.want)
+		}
+	}
+}
+
+func TestLevelWriter_At(t *testing.T) {
+	tests := []struct {
+		level string
+		quiet bool
+		want  string
+	}{
+		{level: logLevelError, want: ""},
+		{level: logLevelWarn, want: "stderr\n"},
+		{level: logLevelInfo, want: "stdout\nstderr\n"},
+		{level: logLevelInfo, quiet: true, want: ""},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		w := &levelWriter{w: &buf, level: tt.level, quiet: tt.quiet}
+
+		// the colored output of a child process is not a warning of the step
+		if _, err := w.At(logLevelInfo).Write([]byte(string(warnMessagePrefix) + "stdout\n")); err != nil {
+			t.Fatalf("Write() error = %s", err)
+		}
+		if _, err := w.At(logLevelWarn).Write([]byte("stderr\n")); err != nil {
+			t.Fatalf("Write() error = %s", err)
+		}
+
+		if got := colorPattern.ReplaceAllString(buf.String(), ""); got != tt.want {
+			t.Errorf("level: %s, quiet: %v, printed = %q, want %q", tt.level, tt.quiet, got, tt.want)
+		}
+	}
+}
+
+func TestConfigureLogging(t *testing.T) {
+	defer configureLogging(logLevelInfo, false, false)
+
+	tests := []struct {
+		level     string
+		debugMode bool
+		want      string
+	}{
+		{level: "", want: logLevelInfo},
+		{level: logLevelWarn, want: logLevelWarn},
+		{level: logLevelInfo, debugMode: true, want: logLevelDebug},
+		{level: logLevelTrace, debugMode: true, want: logLevelTrace},
+	}
+	for _, tt := range tests {
+		configureLogging(tt.level, tt.debugMode, false)
+		if logFilter.level != tt.want {
+			t.Errorf("configureLogging(%s, %v) level = %s, want %s", tt.level, tt.debugMode, logFilter.level, tt.want)
+		}
+	}
+}
@@ -1,21 +1,29 @@
 package main
 
 import (
-	"encoding/json"
+	"archive/tar"
+	"bufio"
+	"context"
+	"crypto/sha256"
 	"errors"
+	"flag"
 	"fmt"
+	"hash"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
+	"os/exec"
 	"path/filepath"
-	"regexp"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/bitrise-io/go-steputils/stepconf"
 	"github.com/bitrise-io/go-utils/log"
+	"github.com/bitrise-steplib/steps-cache-pull/pkg/cachepreset"
+	"github.com/bitrise-steplib/steps-cache-pull/pkg/cachepull"
 )
 
 const (
@@ -26,54 +34,31 @@ const (
 	cachePullEndTimePath = "/tmp/cache_pull_end_time"
 )
 
-// Config stores the step inputs.
-type Config struct {
-	CacheAPIURL           string `env:"cache_api_url"`
-	DebugMode             bool   `env:"is_debug_mode,opt[true,false]"`
-	AllowFallback         bool   `env:"allow_fallback,opt[true,false]"`
-	ExtractToRelativePath bool   `env:"extract_to_relative_path,opt[true,false]"`
-
-	StackID   string `env:"BITRISEIO_STACK_ID"`
-	BuildSlug string `env:"BITRISE_BUILD_SLUG"`
-}
-
-// downloadCacheArchive downloads the cache archive and returns the downloaded file's path.
-// If the URI points to a local file it returns the local paths.
-func downloadCacheArchive(url string, buildSlug string) (string, error) {
-	if strings.HasPrefix(url, "file://") {
-		return strings.TrimPrefix(url, "file://"), nil
+// downloadCacheArchive downloads the cache archive (concatenating the parts of a split archive) and returns the downloaded file's path.
+// If the URI points to a local, non split file it returns the local paths.
+func downloadCacheArchive(parts []string, buildSlug string) (string, error) {
+	if len(parts) == 1 && strings.HasPrefix(parts[0], "file://") {
+		return strings.TrimPrefix(parts[0], "file://"), nil
 	}
 
-	resp, err := http.Get(url)
+	cacheArchivePath := filepath.Join(stepRunDir, "cache-archive.tar")
+	f, err := os.OpenFile(cacheArchivePath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
 	if err != nil {
-		return "", err
+		return "", fmt.Errorf("failed to open the local cache file for write: %s", err)
 	}
-
 	defer func() {
-		if err := resp.Body.Close(); err != nil {
-			log.Warnf("Failed to close response body: %s", err)
+		if err := f.Close(); err != nil {
+			log.Warnf("Failed to close the local cache file: %s", err)
 		}
 	}()
 
-	if resp.StatusCode != 200 {
-		responseBytes, err := ioutil.ReadAll(resp.Body)
+	var bytesWritten int64
+	for i, part := range parts {
+		n, err := appendPart(f, part, i)
 		if err != nil {
 			return "", err
 		}
-
-		return "", fmt.Errorf("non success response code: %d, body: %s", resp.StatusCode, string(responseBytes))
-	}
-
-	const cacheArchivePath = "/tmp/cache-archive.tar"
-	f, err := os.Create(cacheArchivePath)
-	if err != nil {
-		return "", fmt.Errorf("failed to open the local cache file for write: %s", err)
-	}
-
-	var bytesWritten int64
-	bytesWritten, err = io.Copy(f, resp.Body)
-	if err != nil {
-		return "", err
+		bytesWritten += n
 	}
 
 	data := map[string]interface{}{
@@ -86,9 +71,51 @@ func downloadCacheArchive(url string, buildSlug string) (string, error) {
 	return cacheArchivePath, nil
 }
 
+// appendPart downloads the part to the end of the file, the download is retried once if it is corrupted.
+func appendPart(f *os.File, part string, index int) (int64, error) {
+	offset, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+
+	var n int64
+	err = retryOnChecksumMismatch(fmt.Sprintf("archive part (%d)", index), func() error {
+		if err := f.Truncate(offset); err != nil {
+			return err
+		}
+		if _, err := f.Seek(offset, io.SeekStart); err != nil {
+			return err
+		}
+
+		r, err := openPart(part)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err := r.Close(); err != nil {
+				log.Warnf("Failed to close archive part (%d): %s", index, err)
+			}
+		}()
+
+		n, err = io.Copy(f, r)
+		return err
+	})
+	return n, err
+}
+
 // performRequest performs an http request and returns the response's body, if the status code is 200.
+// The body is verified against the response's checksum header (if any), when reading it to the end.
 func performRequest(url string) (io.ReadCloser, error) {
-	resp, err := http.Get(url)
+	return performRequestContext(context.Background(), url)
+}
+
+// performRequestContext is performRequest, the request is canceled with the context.
+func performRequestContext(ctx context.Context, url string) (io.ReadCloser, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
 	if err != nil {
 		return nil, err
 	}
@@ -108,70 +135,64 @@ func performRequest(url string) (io.ReadCloser, error) {
 		return nil, fmt.Errorf("non success response code: %d, body: %s", resp.StatusCode, string(responseBytes))
 	}
 
-	return resp.Body, nil
+	return decodeContentEncoding(resp.Header, newVerifyingReader(resp))
 }
 
-// getCacheDownloadURL gets the given build's cache download URL.
-func getCacheDownloadURL(cacheAPIURL string) (string, error) {
-	req, err := http.NewRequest("GET", cacheAPIURL, nil)
-	if err != nil {
-		return "", fmt.Errorf("failed to create request: %s", err)
-	}
-
-	client := &http.Client{Timeout: 20 * time.Second}
-	resp, err := client.Do(req)
-	if err != nil {
-		return "", fmt.Errorf("failed to send request: %s", err)
-	}
-	defer func() {
-		if err := resp.Body.Close(); err != nil {
-			log.Warnf("Failed to close response body: %s", err)
-		}
-	}()
-
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return "", fmt.Errorf("request sent, but failed to read response body (http-code: %d): %s", resp.StatusCode, body)
-	}
-
-	if resp.StatusCode < 200 || resp.StatusCode > 202 {
-		return "", fmt.Errorf("build cache not found: probably cache not initialised yet (first cache push initialises the cache), nothing to worry about ;)")
-	}
-
-	var respModel struct {
-		DownloadURL string `json:"download_url"`
-	}
-	if err := json.Unmarshal(body, &respModel); err != nil {
-		return "", fmt.Errorf("failed to parse JSON response (%s): %s", body, err)
-	}
-
-	if respModel.DownloadURL == "" {
-		return "", errors.New("download URL not included in the response")
-	}
+var errCacheNotFound = errors.New("build cache not found: probably cache not initialised yet (first cache push initialises the cache), nothing to worry about ;)")
 
-	return respModel.DownloadURL, nil
+// cacheDownloadInfo is the cache API's response.
+type cacheDownloadInfo struct {
+	DownloadURL string `json:"download_url"`
+	// Mirrors are additional URLs serving the same archive as DownloadURL.
+	Mirrors []string `json:"mirrors"`
+	// Chunks are the archive's byte ranges, which can be downloaded from different mirrors.
+	Chunks []archiveChunk `json:"chunks"`
+	// Datacenters are the datacenters of DownloadURL and the Mirrors, in order.
+	Datacenters []string `json:"datacenters"`
+	// Compression (none, gzip, zstd) and Fingerprint (sha256:<hex> of the archive) are the archive's metadata,
+	// trusted in handoff mode.
+	Compression string `json:"compression"`
+	Fingerprint string `json:"fingerprint"`
+	// Regions are the regional download URLs of the archive, the first one is the default region's.
+	Regions []regionalURL `json:"regions"`
+	// Checkpoints are the checksums of the archive's byte ranges, verified while the archive is downloaded.
+	Checkpoints *archiveCheckpoints `json:"checkpoints"`
 }
 
-// parseStackID reads the stack id from the given json bytes.
-func parseStackID(b []byte) (string, error) {
-	type ArchiveInfo struct {
-		StackID string `json:"stack_id,omitempty"`
+// getCacheDownloadInfo gets the given build's cache download URL and mirrors.
+func getCacheDownloadInfo(cacheAPIURL string) (cacheDownloadInfo, error) {
+	client := &http.Client{Timeout: 20 * time.Second, Transport: http.DefaultClient.Transport, CheckRedirect: http.DefaultClient.CheckRedirect}
+	var info cacheDownloadInfo
+	err := cachepull.GetDownloadInfo(context.Background(), client, cacheAPIURL, &info)
+	if err == cachepull.ErrCacheNotFound {
+		return cacheDownloadInfo{}, errCacheNotFound
 	}
-	var archiveInfo ArchiveInfo
-	if err := json.Unmarshal(b, &archiveInfo); err != nil {
-		return "", err
+	if err != nil {
+		return cacheDownloadInfo{}, err
 	}
-	return archiveInfo.StackID, nil
+	return info, nil
 }
 
 // failf prints an error and terminates the step.
+// If the circuit breaker tripped, the cache pull is skipped instead, so that the build proceeds without cache.
 func failf(format string, args ...interface{}) {
+	if breaker.Open() && result != nil {
+		result.Warnf(format, args...)
+		result.Warnf("Skipping cache pull, the cache backend is unhealthy")
+		result.Finish(statusSkipped, nil)
+		exit(0)
+	}
+
 	log.Errorf(format, args...)
-	os.Exit(1)
+	if result != nil {
+		result.Finish(statusFailed, fmt.Errorf(format, args...))
+	}
+	exit(1)
 }
 
-func isBitriseCacheAPIURL(url string) bool {
-	return url == os.Getenv("BITRISE_CACHE_API_URL")
+// isBitriseCacheAPIURL reports whether the url is the Bitrise cache API's url (BITRISE_CACHE_API_URL).
+func isBitriseCacheAPIURL(url, bitriseCacheAPIURL string) bool {
+	return url != "" && url == bitriseCacheAPIURL
 }
 
 func writeCachePullTimestamp() (err error) {
@@ -192,123 +213,591 @@ func writeCachePullTimestamp() (err error) {
 }
 
 func main() {
-	var conf Config
-	if err := stepconf.Parse(&conf); err != nil {
-		failf(err.Error())
+	os.Exit(run())
+}
+
+// run runs the step and returns its exit code.
+func run() (code int) {
+	defer recoverExit(&code)
+	log.SetOutWriter(logFilter)
+
+	probe := flag.Bool("probe", false, "measure the latency and throughput to the cache backend(s) given as arguments (or cache_api_url) and exit")
+	diff := flag.Bool("diff", false, "compare the manifests of the two cache archives given as arguments (old, new) and exit")
+	reportUnused := flag.Bool("report-unused", false, "list the restored paths of the usage snapshot given as argument (or BITRISE_CACHE_PULL_USAGE_SNAPSHOT_PATH) not accessed by the build and exit")
+	selfTest := flag.Bool("selftest", false, "extract a synthetic archive (symlinks, hard links, unicode names, long paths, sparse files) on the current stack, report the problems and exit")
+	replayDir := flag.String("replay", "", "serve the cache API and blob responses from the fixtures recorded in the directory (see --record), without network access")
+	recordDir := flag.String("record", "", "record the cache API and blob responses into the fixture directory, for --replay")
+	flag.Parse()
+
+	if runToolMode(*probe, *diff, *reportUnused, *selfTest) {
+		return 0
 	}
-	stepconf.Print(conf)
-	log.SetEnableDebugLog(conf.DebugMode)
 
-	if conf.CacheAPIURL == "" {
-		log.Warnf("No Cache API URL specified, there's no cache to use, exiting.")
-		return
+	conf := loadConfig()
+
+	tenant := tenantID(conf.AppSlug, conf.SourceDir)
+	if err := ensurePrivateDir(tenantTempDir(tenant)); err != nil {
+		failf("Failed to create the temporary directory: %s", err)
+	}
+	stepTempDir = tenantTempDir(tenant)
+	runDir, l, err := createRunDir(stepTempDir)
+	if err != nil {
+		failf("Failed to create the temporary directory of the step run: %s", err)
+	}
+	stepRunDir, runLock = runDir, l
+	defer func() {
+		if err := os.RemoveAll(stepRunDir); err != nil {
+			log.Warnf("Failed to remove %s: %s", stepRunDir, err)
+		}
+		if err := runLock.Unlock(); err != nil {
+			log.Debugf("Failed to release the lock of %s: %s", stepRunDir, err)
+		}
+	}()
+
+	configureNetwork(&conf, *replayDir, *recordDir)
+
+	notifier := NewNotifier(string(conf.WebhookURL), conf.BuildSlug, conf.Branch)
+
+	breaker = NewCircuitBreaker(conf.CircuitBreakerErrors, time.Duration(conf.CircuitBreakerTimeout)*time.Second)
+	breaker.OnTrip = func(reason string) {
+		notifier.Notify(anomalyCircuitOpen, "circuit breaker tripped, skipping cache pull: %s", reason)
+	}
+
+	headers, err := parseRequestHeaders(conf.RequestHeaders)
+	if err != nil {
+		failAs(failureConfig, "Invalid request headers: %s", err)
+	}
+	umask := applyRestoreUmask(conf)
+	stateDir := NewStateDir(namespacedStateDir(conf.StateDir, tenant, conf.InstanceName))
+	warmStart := conf.LocalWarmStart && isLocalRun(conf.BuildSlug) && stateDir != nil
+	if warmStart {
+		log.Printf("Local run, skipping the unchanged cache and the unchanged cached paths (local_warm_start)")
+		conf.SkipUnchanged = true
+	}
+	etags := configureHTTPClient(conf, headers, stateDir != nil)
+
+	if conf.ZstdDictionary != "" {
+		if zstdDictionary, err = fetchZstdDictionary(conf.ZstdDictionary); err != nil {
+			failAs(failureDownload, "Failed to get the zstd dictionary: %s", err)
+		}
+	}
+
+	quarantined := quarantine{}
+	if conf.QuarantineFile != "" || conf.QuarantineURL != "" {
+		if quarantined, err = loadQuarantine(conf.QuarantineFile, conf.QuarantineURL); err != nil {
+			failAs(failureDownload, "Failed to load the quarantined cache fingerprints: %s", err)
+		}
+	}
+
+	if !conf.Offline && conf.CacheAPI == cacheAPILegacy && conf.CacheAPIURL == "" {
+		result.Warnf("No Cache API URL specified, there's no cache to use, exiting.")
+		result.Finish(statusSkipped, nil)
+		return 0
 	}
 
 	startTime := time.Now()
 
+	projectPath, err := cleanProjectPath(conf.ProjectPath)
+	if err != nil {
+		failAs(failureConfig, "Invalid project path: %s", err)
+	}
+	filter := pathFilter{Skip: resolveSkippedPaths(conf), Only: resolveProjectPaths(projectPath)}
+	if conf.AndroidProjectPath != "" {
+		filter.skipAlso(planAndroidRestore(conf.AndroidProjectPath))
+	}
+	hooks := NewHooks(conf.HooksDir)
+
+	var blobCache *BuildBlobCache
+	var keptIndex *blobIndex
+	if conf.ReuseWithinBuild {
+		blobCache = NewBuildBlobCache(conf.BuildSlug, conf.CacheAPI, conf.CacheAPIURL, conf.Key, projectPath, conf.LocalCacheDir)
+		if keptIndex, err = blobCache.Load(); err != nil {
+			result.Warnf("Failed to load the cache archive kept earlier in this build: %s", err)
+		}
+	}
+
+	resolved, ok := resolveCacheArchive(conf, projectPath, filter, keptIndex, blobCache, quarantined, notifier)
+	if !ok {
+		return 0
+	}
+	if keptIndex != nil {
+		// the archive is already kept
+		blobCache = nil
+	}
+	cacheURI, downloadInfo, handoff, archiveFingerprint := resolved.URI, resolved.DownloadInfo, resolved.Handoff, resolved.Fingerprint
+
 	var cacheReader io.Reader
-	var cacheURI string
+	// resumable is the download persisted in the partial_downloads_dir, if any
+	var resumable *resumableDownload
 
-	if strings.HasPrefix(conf.CacheAPIURL, "file://") {
-		cacheURI = conf.CacheAPIURL
+	result.CacheURL = redactURL(cacheURI)
+	if keptIndex != nil {
+		result.CacheURL = keptIndex.CacheURL
+	}
 
-		fmt.Println()
-		log.Infof("Using local cache archive")
+	cacheParts, err := resolveArchiveParts(cacheURI)
+	if err != nil {
+		failAs(failureDownload, "Failed to resolve cache archive parts: %s", err)
+	}
 
-		pth := strings.TrimPrefix(conf.CacheAPIURL, "file://")
+	if conf.MaxArchiveAgeDays > 0 {
+		checkArchiveAge(cacheParts[0], conf.MaxArchiveAgeDays, notifier)
+	}
 
-		var err error
-		cacheReader, err = os.Open(pth)
-		if err != nil {
-			failf("Failed to open cache archive file: %s", err)
+	// validated above
+	if maxSize, _ := parseMaxArchiveSize(conf.MaxArchiveSize); maxSize > 0 && keptIndex == nil && strings.HasPrefix(cacheParts[0], "http") {
+		if !checkArchiveSize(cacheParts, downloadInfo.Chunks, maxSize) {
+			if err := writeCachePullTimestamp(); err != nil {
+				failf("Couldn't save cache pull timestamp: %s", err)
+			}
+			result.Finish(statusSkipped, nil)
+			return 0
 		}
-	} else {
-		fmt.Println()
-		log.Infof("Downloading remote cache archive")
+	}
 
-		var err error
-		if isBitriseCacheAPIURL(conf.CacheAPIURL) {
-			cacheURI, err = getCacheDownloadURL(conf.CacheAPIURL)
-			if err != nil {
-				failf("Failed to get cache download url: %s", err)
+	if conf.SkipUnchanged && keptIndex == nil && len(cacheParts) == 1 && strings.HasPrefix(cacheParts[0], "http") {
+		if last, unchanged := checkUnchangedArchive(stateDir, cacheParts[0]); unchanged {
+			log.Donef("The cache archive (%s) did not change since its last restore on this machine, skipping the download", last.Fingerprint)
+
+			if err := writeCachePullTimestamp(); err != nil {
+				failf("Couldn't save cache pull timestamp: %s", err)
+			}
+
+			last.BuildSlug = conf.BuildSlug
+			last.CacheKey = result.CacheKey
+			saveRestoreState(conf, last)
+			result.Finish(statusUnchanged, nil)
+			return 0
+		}
+	}
+
+	if conf.Preflight && keptIndex == nil && strings.HasPrefix(cacheParts[0], "http") {
+		preflight(conf, cacheParts, downloadInfo.Chunks)
+	}
+
+	runHook(hooks, HookEvent{Phase: hookPreDownload, BuildSlug: conf.BuildSlug, CacheURL: result.CacheURL, CacheKey: result.CacheKey})
+
+	if conf.LazyRestore && keptIndex == nil && !conf.VerifyOnly {
+		if status := restoreLazily(conf, cacheParts, filter.active()); status != "" {
+			if err := writeCachePullTimestamp(); err != nil {
+				failf("Couldn't save cache pull timestamp: %s", err)
+			}
+			runHook(hooks, HookEvent{Phase: hookPostRestore, BuildSlug: conf.BuildSlug, CacheURL: result.CacheURL, CacheKey: result.CacheKey, ArchiveSize: result.ArchiveSize, Status: status})
+			result.Finish(status, nil)
+			return 0
+		}
+	}
+
+	var partsReader *PartsReader
+	if len(downloadInfo.Chunks) > 0 && len(cacheParts) == 1 {
+		mirrors := append([]string{cacheURI}, downloadInfo.Mirrors...)
+		log.Printf("Downloading %d chunks from %d mirrors", len(downloadInfo.Chunks), len(mirrors))
+		partsReader = NewChunksReader(mirrors, downloadInfo.Chunks)
+		cacheReader = partsReader
+	} else if len(cacheParts) > 1 {
+		log.Printf("Split cache archive, downloading %d parts", len(cacheParts))
+		partsReader = NewPartsReader(cacheParts)
+		cacheReader = partsReader
+	} else {
+		var downloaded string
+		cacheReader, resumable, downloaded = openArchiveStream(conf, cacheParts, downloadInfo, headers, archiveFingerprint)
+		if downloaded != "" {
+			defer func() {
+				if err := os.Remove(downloaded); err != nil {
+					log.Warnf("Failed to remove %s: %s", downloaded, err)
+				}
+			}()
+		}
+	}
+	if partsReader != nil {
+		// the pending downloads are canceled and the downloaded parts removed, even if the restore fails
+		defer func() {
+			if err := partsReader.Close(); err != nil {
+				log.Warnf("Failed to close the archive parts: %s", err)
 			}
+		}()
+	}
+
+	var total int64
+	for _, chunk := range downloadInfo.Chunks {
+		total += chunk.Size
+	}
+	progressMode := resolveProgressMode(conf.ProgressMode, isTerminal(os.Stdout))
+	if !logFilter.Enabled(logLevelInfo) {
+		progressMode = progressNone
+	}
+	progress := NewProgressReader(cacheReader, total, progressMode, time.Duration(conf.ProgressInterval)*time.Second, os.Stdout)
+	cacheReader = progress
+
+	// the checksum of the downloaded archive, see the restore state
+	archiveDigest := sha256.New()
+	var digest io.Writer = archiveDigest
+	var kept *keptArchive
+	if conf.KeepArchive && !conf.VerifyOnly {
+		if kept, err = createKeptArchive(keptArchiveDir(conf.KeepArchiveDir)); err != nil {
+			result.Warnf("Failed to keep the cache archive for the later steps: %s", err)
 		} else {
-			cacheURI = conf.CacheAPIURL
+			defer kept.Discard()
+			digest = io.MultiWriter(archiveDigest, kept)
 		}
+	}
+	bufferedReader := bufio.NewReader(io.TeeReader(cacheReader, digest))
+	cacheReader = bufferedReader
 
-		cacheReader, err = performRequest(cacheURI)
+	if doc := sniffErrorDocument(bufferedReader); doc != nil {
+		result.Warnf("%s", doc)
+		result.Warnf("Treating the error document as a cache miss")
+		finishMiss()
+		return 0
+	}
+
+	var zstdCompressed bool
+	var zstdReader *ZstdReader
+	if handoff {
+		zstdCompressed = downloadInfo.Compression == archiveCompressionZstd
+	} else {
+		zstdCompressed = isZstdStream(bufferedReader)
+	}
+	if zstdCompressed {
+		log.Printf("zstd compressed cache archive")
+
+		if err := checkZstdDictionary(bufferedReader, zstdDictionary); err != nil {
+			failAs(failureExtraction, "Failed to decompress cache archive: %s", err)
+		}
+		zstdReader, err = NewZstdReader(bufferedReader)
 		if err != nil {
-			failf("Failed to perform cache download request: %s", err)
+			failAs(failureExtraction, "Failed to decompress cache archive: %s", err)
 		}
+		cacheReader = zstdReader
 	}
 
+	result.StartSection("download_and_extract", "Reading the cache archive")
 	cacheRecorderReader := NewRestoreReader(cacheReader)
 
-	r, hdr, compressed, err := readFirstEntry(cacheRecorderReader)
+	var r *tar.Reader
+	var hdr *tar.Header
+	var compressed bool
+	if handoff {
+		compressed = downloadInfo.Compression == archiveCompressionGzip
+		r, hdr, err = readFirstEntryAs(cacheRecorderReader, compressed)
+	} else {
+		r, hdr, compressed, err = readFirstEntry(cacheRecorderReader)
+	}
 	if err != nil {
-		failf("Failed to get first archive entry: %s", err)
+		failAs(failureExtraction, "Failed to get first archive entry: %s", err)
 	}
 
 	cacheRecorderReader.Restore()
+	result.Compressed = compressed
 
-	currentStackID := strings.TrimSpace(conf.StackID)
-	if len(currentStackID) > 0 {
-		fmt.Println()
-		log.Infof("Checking archive and current stacks")
-		log.Printf("current stack id: %s", currentStackID)
+	var archiveReader io.Reader = cacheRecorderReader
+	var blobFile *os.File
+	if blobCache != nil && !conf.VerifyOnly {
+		if blobFile, err = blobCache.Create(); err != nil {
+			result.Warnf("Failed to keep the cache archive for the later pulls of this build: %s", err)
+		} else {
+			archiveReader = io.TeeReader(archiveReader, blobFile)
+		}
+	}
 
-		if filepath.Base(hdr.Name) == "archive_info.json" {
-			b, err := ioutil.ReadAll(r)
-			if err != nil {
-				failf("Failed to read first archive entry: %s", err)
+	var counter *entryCounter
+	if conf.StatsFilePath != "" || blobFile != nil || conf.collectsRestoredPaths() {
+		counter = newEntryCounter(compressed, blobFile != nil || conf.collectsRestoredPaths())
+		archiveReader = io.TeeReader(archiveReader, counter)
+	}
+
+	if hdr != nil && isLegacyCacheInfoEntry(hdr.Name) && conf.VerifyOnly {
+		result.Warnf("The legacy (%s) cache archive can not be verified, exiting.", cacheInfoFileName)
+		result.Finish(statusSkipped, nil)
+		return 0
+	}
+
+	if hdr != nil && isLegacyCacheInfoEntry(hdr.Name) {
+		result.StartSection("", "Restoring legacy (%s) cache archive", cacheInfoFileName)
+
+		items, fingerprint, err := restoreLegacyCache(archiveReader, compressed, filter, umask)
+		progress.Done()
+		if err != nil {
+			failAs(failureExtraction, "Failed to restore legacy cache archive: %s", err)
+		}
+		result.Items = items
+		state := restoreState{BuildSlug: conf.BuildSlug, CacheKey: result.CacheKey, Fingerprint: fingerprint, ArchiveChecksum: drainArchive(cacheReader, archiveDigest, resumable)}
+		runHook(hooks, HookEvent{Phase: hookPostDownload, BuildSlug: conf.BuildSlug, CacheURL: result.CacheURL, CacheKey: result.CacheKey, ArchiveSize: int64(cacheRecorderReader.BytesRead)})
+		checkFailedItems(items, conf.FailedItemsThreshold, conf.FailedItemsAction)
+
+		checkRestoredCaches(conf)
+		var restored []string
+		for _, item := range items {
+			if item.Status == itemRestored {
+				restored = append(restored, item.Path)
 			}
+		}
+		postProcessRestoredPaths(conf, restored)
+		if err := writeCachePullTimestamp(); err != nil {
+			failf("Couldn't save cache pull timestamp: %s", err)
+		}
 
-			archiveStackID, err := parseStackID(b)
-			if err != nil {
-				failf("Failed to parse first archive entry: %s", err)
+		result.ArchiveSize = int64(cacheRecorderReader.BytesRead)
+		if blobFile != nil {
+			blobCache.Discard(blobFile)
+		}
+		if conf.StatsFilePath != "" {
+			compareRestoreStats(conf, notifier, restoreStats{ArchiveSize: result.ArchiveSize, FileCount: counter.Count(), Duration: time.Since(startTime).Seconds()})
+		}
+		saveRestoreState(conf, state)
+		recordCacheState(stateDir, state, result.CacheURL, downloadInfo.Chunks, etags.ETags(), nil)
+		runHook(hooks, HookEvent{Phase: hookPostRestore, BuildSlug: conf.BuildSlug, CacheURL: result.CacheURL, CacheKey: result.CacheKey, ArchiveSize: result.ArchiveSize, Status: statusRestored})
+		result.Finish(statusRestored, nil)
+
+		return 0
+	}
+
+	hasArchiveInfo := hdr != nil && filepath.Base(hdr.Name) == archiveInfoFileName
+	var info archiveInfo
+	if hasArchiveInfo {
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			failAs(failureExtraction, "Failed to read first archive entry: %s", err)
+		}
+
+		info, err = parseArchiveInfo(b)
+		if err != nil {
+			failAs(failureExtraction, "Failed to parse first archive entry: %s", err)
+		}
+
+		warning, err := checkArchiveSchema(info)
+		if err != nil {
+			result.Warnf("Incompatible cache archive: %s", err)
+			result.Warnf("Skipping cache pull, because of the incompatible cache archive")
+
+			if err := writeCachePullTimestamp(); err != nil {
+				failf("Couldn't save cache pull timestamp: %s", err)
 			}
+
+			result.Finish(statusSkipped, nil)
+			return 0
+		}
+		if warning != "" {
+			result.Warnf("%s", warning)
+		}
+	}
+	state := restoreState{BuildSlug: conf.BuildSlug, CacheKey: result.CacheKey, Fingerprint: info.Fingerprint, ContentHashes: info.ContentHashes}
+
+	currentStackID := strings.TrimSpace(conf.StackID)
+	if len(currentStackID) > 0 {
+		result.StartSection("", "Checking archive and current stacks")
+		log.Printf("current stack id: %s", currentStackID)
+
+		if hasArchiveInfo {
+			archiveStackID := info.StackID
 			log.Printf("archive stack id: %s", archiveStackID)
 
 			if !isSameStack(archiveStackID, currentStackID) {
-				log.Warnf("Cache was created on stack: %s, current stack: %s", archiveStackID, currentStackID)
-				log.Warnf("Skipping cache pull, because of the stack has changed")
+				result.Warnf("Cache was created on stack: %s, current stack: %s", archiveStackID, currentStackID)
+				result.Warnf("Skipping cache pull, because of the stack has changed")
 
 				if err := writeCachePullTimestamp(); err != nil {
 					failf("Couldn't save cache pull timestamp: %s", err)
 				}
 
-				os.Exit(0)
+				result.Finish(statusSkipped, nil)
+				return 0
 			}
 		} else {
-			log.Warnf("cache archive does not contain stack information, skipping stack check")
+			result.Warnf("cache archive does not contain stack information, skipping stack check")
+		}
+	}
+
+	planArchiveRestore(conf, info, &filter, stateDir, warmStart)
+
+	if conf.VerifyOnly {
+		verifyRestore(conf, archiveReader, compressed, filter)
+		return 0
+	}
+
+	result.StartSection("", "Extracting cache archive")
+
+	extractor := newStreamExtractor(conf, filter, info, startTime)
+
+	// the stream is extracted in-process, the tar tool would need the archive on its standard input,
+	// which is missing in some containers and sandboxed shells
+	err = extractArchive(archiveReader, extractor, compressed)
+	progress.Done()
+	result.decompression += extractor.DecompressionTime
+
+	fileCount := 0
+	if counter != nil {
+		fileCount = counter.Count()
+	}
+
+	reportExtraction(extractor)
+
+	if len(extractor.Collisions) > 0 {
+		result.Warnf("%d archive entries collide on the case-insensitive filesystem (policy: %s)", len(extractor.Collisions), conf.CaseCollisionPolicy)
+		if conf.CaseCollisionPolicy == collisionPolicyFail {
+			// the fallback tar extraction would overwrite the colliding entries
+			failAs(failureExtraction, "Failed to extract cache archive: %s", err)
 		}
 	}
 
-	fmt.Println()
-	log.Infof("Extracting cache archive")
+	partial := err == errTimeBudgetExceeded
+	if partial {
+		err = nil
+		if extractor.BudgetSkippedEntries > 0 {
+			result.Warnf("Cache restore exceeded the time budget (%ds), %d archive entries outside of the priority paths are not restored", conf.TimeBudget, extractor.BudgetSkippedEntries)
+		} else {
+			result.Warnf("Cache restore exceeded the time budget (%ds), the rest of the archive is not restored", conf.TimeBudget)
+		}
+	}
+	if err == nil && extractor.Budgets != nil && extractor.Budgets.Truncated() {
+		partial = true
+		reportTruncatedGroups(extractor.Budgets)
+	}
 
-	if err := extractCacheArchive(cacheRecorderReader, conf.ExtractToRelativePath, compressed); err != nil {
+	if err != nil {
 		if !conf.AllowFallback {
-			failf("Failed to uncompress cache archive stream: %s", err)
+			failAs(failureExtraction, "Failed to uncompress cache archive stream: %s", err)
 		}
 
-		log.Warnf("Failed to uncompress cache archive stream: %s", err)
-		log.Warnf("Downloading the archive file and trying to uncompress using tar tool")
+		result.Warnf("Failed to uncompress cache archive stream: %s", err)
+		result.Warnf("Downloading the archive file and trying to uncompress using tar tool")
+		if filter.active() {
+			result.Warnf("The tar tool does not support skip_on_change, project_path, swift_package_resolved and android_project_path, every path is restored")
+		}
+		if extractor.Budgets != nil {
+			result.Warnf("The tar tool does not support path_budgets, every path is restored")
+		}
+		if extractor.AuditOverwrites {
+			result.Warnf("The tar tool does not support overwrite_audit_path, the overwritten files are not recorded")
+		}
+		if conf.DestinationRoots != "" {
+			result.Warnf("The tar tool does not support destination_roots, the archive is restored into the working directory")
+		}
+		result.StartSection("fallback", "Restoring the cache archive with the tar tool")
 		data := map[string]interface{}{
 			"archive_bytes_read": cacheRecorderReader.BytesRead,
 			"build_slug":         conf.BuildSlug,
 		}
 		log.RInfof(stepID, "cache_archive_fallback", data, "Failed to uncompress cache archive stream: %s", err)
+		notifier.Notify(anomalyExtractionFailed, "failed to uncompress cache archive stream, falling back to tar: %s", err)
+
+		pth, err := downloadCacheArchive(cacheParts, conf.BuildSlug)
+		if _, ok := err.(*checksumMismatchError); ok {
+			handleCorruptedArchive(err)
+			return 0
+		}
+		if err != nil {
+			failAs(failureDownload, "Fallback failed, unable to download cache archive: %s", err)
+		}
+		if resumable != nil {
+			// the archive is downloaded again, the persisted bytes of the stream are not needed
+			resumable.Discard()
+			if err := resumable.Close(); err != nil {
+				log.Warnf("Failed to remove the partial download: %s", err)
+			}
+		}
+
+		if err := verifyArchiveFile(pth, compressed, zstdCompressed); err != nil {
+			handleCorruptedArchive(err)
+			return 0
+		}
+
+		if info, err := os.Stat(pth); err == nil {
+			result.ArchiveSize = info.Size()
+		}
+		runHook(hooks, HookEvent{Phase: hookPostDownload, BuildSlug: conf.BuildSlug, CacheURL: result.CacheURL, CacheKey: result.CacheKey, ArchivePath: pth, ArchiveSize: result.ArchiveSize})
+		if state.ArchiveChecksum, err = fileChecksum(pth); err != nil {
+			log.Debugf("No archive checksum: %s", err)
+		}
+		if quarantined.contains(state.ArchiveChecksum) {
+			reportQuarantined(notifier, []string{state.ArchiveChecksum})
+			failAs(failureVerification, "The downloaded cache archive is quarantined (%s), the restored files can not be trusted", state.ArchiveChecksum)
+		}
+		if (handoff || resumable != nil) && state.ArchiveChecksum != archiveFingerprint {
+			handleCorruptedArchive(fmt.Errorf("the archive (%s) does not match its fingerprint (%s)", state.ArchiveChecksum, archiveFingerprint))
+			return 0
+		}
 
-		pth, err := downloadCacheArchive(cacheURI, conf.BuildSlug)
+		if zstdCompressed {
+			// the tar tool can not decompress zstd everywhere, the archive is extracted in-process (without the filters)
+			var fallback *Extractor
+			if fallback, err = newCacheExtractor(conf); err == nil {
+				err = extractZstdArchiveFile(pth, fallback)
+				result.decompression += fallback.DecompressionTime
+			}
+		} else {
+			err = uncompressArchive(pth, conf.ExtractToRelativePath, compressed)
+		}
 		if err != nil {
-			failf("Fallback failed, unable to download cache archive: %s", err)
+			failAs(failureExtraction, "Fallback failed, unable to uncompress cache archive file: %s", err)
+		}
+		if kept != nil {
+			// the streamed archive is incomplete, the downloaded one is kept instead
+			kept.Discard()
+			switch {
+			case len(cacheParts) == 1 && strings.HasPrefix(cacheParts[0], "file://"):
+				result.Warnf("The local cache archive is not kept for the later steps: %s", pth)
+			case state.ArchiveChecksum == "":
+				result.Warnf("The cache archive is not kept for the later steps, its checksum is unknown")
+			default:
+				kept, err := keepDownloadedArchive(pth, keptArchiveDir(conf.KeepArchiveDir), keptArchiveName(state.ArchiveChecksum, compressed, zstdCompressed))
+				exportKeptArchive(conf, kept, err)
+			}
+		}
+		if conf.FsyncPolicy != fsyncNone {
+			// the tar tool can not flush the files one by one
+			syncFilesystems()
 		}
 
-		if err := uncompressArchive(pth, conf.ExtractToRelativePath, compressed); err != nil {
-			failf("Fallback failed, unable to uncompress cache archive file: %s", err)
+		result.Status = statusFallbackRestored
+		// the entries of the fallback extraction are not counted
+		fileCount = 0
+		if blobFile != nil {
+			blobCache.Discard(blobFile)
+		}
+	} else if partial {
+		result.ArchiveSize = int64(cacheRecorderReader.BytesRead)
+		result.Status = statusPartial
+		if resumable != nil {
+			// the restored part of the archive is verified by the rest of the download, which is not extracted
+			drainArchive(cacheReader, archiveDigest, resumable)
+		}
+		if kept != nil {
+			result.Warnf("The partially read cache archive is not kept for the later steps")
+		}
+		if blobFile != nil {
+			blobCache.Discard(blobFile)
 		}
 	} else {
+		result.ArchiveSize = int64(cacheRecorderReader.BytesRead)
+		result.Status = statusRestored
+		state.ArchiveChecksum = drainArchive(cacheReader, archiveDigest, resumable)
+		if quarantined.contains(state.ArchiveChecksum) {
+			reportQuarantined(notifier, []string{state.ArchiveChecksum})
+			failAs(failureVerification, "The restored cache archive is quarantined (%s), the restored files can not be trusted", state.ArchiveChecksum)
+		}
+		if handoff && state.ArchiveChecksum != downloadInfo.Fingerprint {
+			invalidateCorruptedArchive(fmt.Errorf("the archive (%s) does not match its fingerprint (%s)", state.ArchiveChecksum, downloadInfo.Fingerprint))
+			failAs(failureVerification, "The restored cache archive (%s) does not match its fingerprint (%s)", state.ArchiveChecksum, downloadInfo.Fingerprint)
+		}
+		runHook(hooks, HookEvent{Phase: hookPostDownload, BuildSlug: conf.BuildSlug, CacheURL: result.CacheURL, CacheKey: result.CacheKey, ArchiveSize: result.ArchiveSize})
+
+		if kept != nil {
+			if state.ArchiveChecksum == "" {
+				result.Warnf("The cache archive is not kept for the later steps, it was not read completely")
+				kept.Discard()
+			} else {
+				pth, err := kept.Keep(keptArchiveName(state.ArchiveChecksum, compressed, zstdCompressed))
+				exportKeptArchive(conf, pth, err)
+			}
+		}
+		if blobFile != nil {
+			index := blobIndex{CacheURL: result.CacheURL, CacheKey: result.CacheKey, Compressed: compressed, Entries: counter.Names()}
+			if err := blobCache.Store(blobFile, index); err != nil {
+				result.Warnf("Failed to keep the cache archive for the later pulls of this build: %s", err)
+			}
+		}
+
 		data := map[string]interface{}{
 			"cache_archive_size": cacheRecorderReader.BytesRead,
 			"build_slug":         conf.BuildSlug,
@@ -317,19 +806,1384 @@ func main() {
 		log.RInfof(stepID, "cache_archive_size", data, "Size of extracted cache archive: %d Bytes", cacheRecorderReader.BytesRead)
 	}
 
+	result.StartSection("post_restore", "Checking the restored files")
+	// the files read by the step itself from now on are used by the build
+	restoredAt := time.Now()
+	expandNestedArchives(conf, extractor.NestedArchives)
+	verifyPlatformArtifacts(info.PlatformArtifacts, result.SkippedPlatformArtifacts)
+	checkRestoredCaches(conf)
+	if conf.postProcessesRestoredPaths() {
+		postProcessRestoredPaths(conf, restoredRoots(counter.Names(), extractor))
+	}
+	writeRestoreReports(conf, extractor, counter, restoredAt)
 	if err := writeCachePullTimestamp(); err != nil {
 		failf("Couldn't save cache pull timestamp: %s", err)
 	}
 
-	fmt.Println()
-	log.Donef("Done")
-	log.Printf("Took: " + time.Since(startTime).String())
+	if conf.StatsFilePath != "" && !partial {
+		compareRestoreStats(conf, notifier, restoreStats{ArchiveSize: result.ArchiveSize, FileCount: fileCount, Duration: time.Since(startTime).Seconds()})
+	}
+
+	if took := time.Since(startTime); conf.SlowRestoreThreshold > 0 && took > time.Duration(conf.SlowRestoreThreshold)*time.Second {
+		notifier.Notify(anomalySlowRestore, "cache restore took %s, threshold: %ds", took.Round(time.Second), conf.SlowRestoreThreshold)
+	}
+
+	if conf.TimeBudget > 0 || conf.PathBudgets != "" {
+		if err := exportEnv(partialEnvKey, strconv.FormatBool(partial)); err != nil {
+			result.Warnf("%s", err)
+		}
+	}
+
+	var components []componentState
+	if extractor.Components != nil && result.Status != statusFallbackRestored && !partial {
+		components = extractor.Components.Components()
+		if err := exportComponents(components); err != nil {
+			result.Warnf("%s", err)
+		}
+	}
+	if !partial {
+		// the partially restored cache does not describe the archive
+		saveRestoreState(conf, state)
+		recordCacheState(stateDir, state, result.CacheURL, downloadInfo.Chunks, etags.ETags(), components)
+	}
+	runHook(hooks, HookEvent{Phase: hookPostRestore, BuildSlug: conf.BuildSlug, CacheURL: result.CacheURL, CacheKey: result.CacheKey, ArchiveSize: result.ArchiveSize, Status: result.Status})
+	collectBlobCaches(conf)
+	result.Finish(result.Status, nil)
+
+	if conf.SendTelemetry && isBitriseCacheAPIURL(conf.CacheAPIURL, conf.BitriseCacheAPIURL) {
+		// the streamed archive's zstd tool exited by now (drainArchive reads the stream to its end)
+		result.decompression += zstdReader.CPUTime()
+		NewTelemetryClient(conf.CacheAPIURL).Report(newPullTelemetry(conf, result))
+	}
+	return 0
+}
+
+// runToolMode runs the command line tool selected by the flags, it reports whether one ran.
+func runToolMode(probe, diff, reportUnused, selfTest bool) bool {
+	switch {
+	case probe:
+		if err := runProbe(probeURLs(flag.Args())); err != nil {
+			failf("Probe failed: %s", err)
+		}
+	case diff:
+		if err := runDiff(flag.Args()); err != nil {
+			failf("Diff failed: %s", err)
+		}
+	case reportUnused:
+		if err := runUnusedReport(flag.Args()); err != nil {
+			failf("Unused paths report failed: %s", err)
+		}
+	case selfTest:
+		if err := runSelfTest(); err != nil {
+			failf("Self-test failed: %s", err)
+		}
+	default:
+		return false
+	}
+	return true
+}
+
+// loadConfig parses, prints and validates the step's inputs, and creates the pull's result.
+func loadConfig() Config {
+	var conf Config
+	if err := stepconf.Parse(&conf); err != nil {
+		failAs(failureConfig, "%s", err)
+	}
+	configureLogging(conf.LogLevel, conf.DebugMode, conf.Quiet)
+	for _, secret := range []stepconf.Secret{conf.WebhookURL, conf.ABCSAccessToken, conf.ServicesAccessToken, conf.OAuth2ClientSecret, conf.AWSSecretAccessKey, conf.AWSSessionToken, conf.TLSClientKey, conf.AzureClientSecret} {
+		addSecret(string(secret))
+	}
+	if logFilter.Enabled(logLevelInfo) {
+		// stepconf prints to the standard output directly, the secrets are redacted by printable
+		stepconf.Print(conf.printable())
+	}
+	migrationWarnings := conf.applyCompatibility()
+	if err := conf.validate(); err != nil {
+		failAs(failureConfig, "%s", err)
+	}
+	// validated above
+	fatalFailures, _ = parseFatalFailures(conf.FatalFailures)
+	tarNoSameOwner = conf.PermissionErrors != permissionErrorsFail
+
+	result = NewPullResult(conf.ResultFilePath, conf.ExportJUnitResult)
+	for _, warning := range migrationWarnings {
+		result.Warnf("%s", warning)
+	}
+	return conf
+}
+
+// configureNetwork sets up the default transport: disables the network in offline mode, replays or records
+// the responses (see the --replay and --record flags), applies the dial and TLS settings otherwise.
+func configureNetwork(conf *Config, replayDir, recordDir string) {
+	if conf.Offline {
+		log.Printf("Offline mode, network access is disabled")
+		disableNetwork()
+		conf.WebhookURL = ""
+		conf.SendTelemetry = false
+	} else {
+		hosts, err := parseHostOverrides(conf.HostOverrides)
+		if err != nil {
+			failAs(failureConfig, "Invalid host overrides: %s", err)
+		}
+		tlsConfig, err := newTLSConfig(conf.tlsOptions())
+		if err != nil {
+			failAs(failureConfig, "Invalid TLS settings: %s", err)
+		}
+		http.DefaultTransport = newTransport(dialOptions{IPVersion: conf.IPVersion, DNSServer: conf.DNSServer, Hosts: hosts}, tlsConfig)
+	}
+
+	if replayDir != "" {
+		log.Printf("Replay mode, serving the responses recorded in: %s", replayDir)
+		replay, err := newReplayTransport(replayDir)
+		if err != nil {
+			failAs(failureConfig, "Failed to load the replay fixtures: %s", err)
+		}
+		http.DefaultTransport = replay
+		conf.WebhookURL = ""
+		conf.SendTelemetry = false
+		// the external downloaders would access the network
+		conf.Downloader = downloaderBuiltin
+	} else if recordDir != "" {
+		log.Printf("Recording the responses into: %s", recordDir)
+		record, err := newRecordTransport(http.DefaultTransport, recordDir)
+		if err != nil {
+			failf("Failed to create the fixture directory: %s", err)
+		}
+		http.DefaultTransport = record
+		conf.Downloader = downloaderBuiltin
+	}
+	if conf.LogLevel == logLevelTrace {
+		http.DefaultTransport = newTraceTransport(http.DefaultTransport)
+	}
+}
+
+// applyRestoreUmask parses the restore_umask input and applies it to the process, it returns nil if not set.
+func applyRestoreUmask(conf Config) *os.FileMode {
+	umask, err := parseUmask(conf.RestoreUmask)
+	if err != nil {
+		failAs(failureConfig, "Invalid restore umask: %s", err)
+	}
+	if umask != nil {
+		// the files are created (by the tar tool too) with the umask
+		syscall.Umask(int(*umask))
+	}
+	return umask
+}
+
+// configureHTTPClient sets up the default client's transport (circuit breaker, credentials, ETags and request headers)
+// and redirect policy. It returns the ETag recording transport, if recordETags is set.
+func configureHTTPClient(conf Config, headers http.Header, recordETags bool) *etagTransport {
+	transport := breaker.Transport(http.DefaultTransport)
+	if provider := newCredentialProvider(conf); provider != nil {
+		transport = newAuthTransport(transport, provider, conf.BitriseCacheAPIURL, conf.ABCSAPIURL)
+	}
+	var etags *etagTransport
+	if recordETags {
+		etags = newETagTransport(transport)
+		transport = etags
+	}
+	http.DefaultClient.Transport = newHeaderTransport(transport, conf.BuildSlug, headers)
+	allowedHosts, err := parseAllowedHosts(conf.RedirectAllowedHosts)
+	if err != nil {
+		failAs(failureConfig, "Invalid redirect allowed hosts: %s", err)
+	}
+	http.DefaultClient.CheckRedirect = newRedirectPolicy(conf.MaxRedirects, allowedHosts)
+	return etags
+}
+
+// resolvedArchive is the cache archive to restore.
+type resolvedArchive struct {
+	URI          string
+	DownloadInfo cacheDownloadInfo
+	// Handoff reports whether the archive's metadata is trusted, see the handoff_mode input
+	Handoff bool
+	// Fingerprint is the archive's sha256:<hex> checksum announced by the cache API, if any
+	Fingerprint string
+}
+
+// resolveCacheArchive resolves the archive to restore: the one kept earlier in the build, a local one,
+// the pinned one or the one of the cache API. It returns false if the pull is finished (there is nothing to restore).
+func resolveCacheArchive(conf Config, projectPath string, filter pathFilter, keptIndex *blobIndex, blobCache *BuildBlobCache, quarantined quarantine, notifier *Notifier) (resolvedArchive, bool) {
+	var resolved resolvedArchive
+	if keptIndex != nil {
+		result.StartSection("resolve", "Using the cache archive downloaded earlier in this build")
+
+		wd, err := os.Getwd()
+		if err != nil {
+			failf("Failed to get working directory: %s", err)
+		}
+		if !keptIndex.restoresAny(filter, wd, conf.ExtractToRelativePath) {
+			result.Warnf("The cache archive does not contain any path to restore, exiting.")
+			result.Finish(statusSkipped, nil)
+			return resolvedArchive{}, false
+		}
+
+		result.CacheKey = keptIndex.CacheKey
+		resolved.URI = "file://" + blobCache.BlobPath()
+	} else if conf.Offline {
+		result.StartSection("resolve", "Using local cache archive from: %s", conf.LocalCacheDir)
+
+		var keys []string
+		if conf.CacheAPI == cacheAPIKeyBased {
+			var err error
+			if keys, err = resolveCacheKeys(conf); err != nil {
+				failAs(failureConfig, "Invalid cache key: %s", err)
+			}
+			keys = scopeCacheKeys(keys, projectPath)
+		}
+
+		pth, key, err := findLocalArchive(conf.LocalCacheDir, keys)
+		if err != nil {
+			failf("Failed to find local cache archive: %s", err)
+		}
+		if pth == "" {
+			result.Warnf("No local cache archive found in %s, there's no cache to use, exiting.", conf.LocalCacheDir)
+			finishMiss()
+			return resolvedArchive{}, false
+		}
+
+		log.Printf("Local cache archive: %s", pth)
+		result.CacheKey = key
+		resolved.URI = "file://" + pth
+	} else if conf.PinnedCacheKey != "" {
+		result.StartSection("resolve", "Downloading pinned cache archive")
+
+		uri, key, err := resolvePinnedCache(conf.PinnedCacheKey, conf.ABCSAPIURL, accessToken(conf))
+		if err == errCacheNotFound {
+			exportPinned(false)
+			handleCacheMiss(conf, notifier)
+			result.Warnf("No cache entry found for the pinned key: %s", conf.PinnedCacheKey)
+			finishMiss()
+			return resolvedArchive{}, false
+		}
+		if err != nil {
+			failAs(failureDownload, "Failed to get pinned cache download url: %s", err)
+		}
+
+		log.Printf("Pinned cache: %s", redactURL(conf.PinnedCacheKey))
+		result.CacheKey = key
+		result.Pinned = true
+		exportPinned(true)
+		resolved.URI = uri
+	} else if conf.CacheAPI == cacheAPIKeyBased {
+		result.StartSection("resolve", "Downloading remote cache archive by key")
+
+		keys, err := resolveCacheKeys(conf)
+		if err != nil {
+			failAs(failureConfig, "Invalid cache key: %s", err)
+		}
+		keys = scopeCacheKeys(keys, projectPath)
+
+		keyInfo, refused, err := resolveUnquarantinedKey(conf.ABCSAPIURL, accessToken(conf), keys, quarantined)
+		reportQuarantined(notifier, refused)
+		if err == errCacheNotFound {
+			handleCacheMiss(conf, notifier)
+			result.Warnf("No cache entry found for the keys: %s", strings.Join(keys, ", "))
+			finishMiss()
+			return resolvedArchive{}, false
+		}
+		if err != nil {
+			failAs(failureDownload, "Failed to get cache download url: %s", err)
+		}
+
+		log.Printf("Matched cache key: %s", keyInfo.MatchedKey)
+		result.CacheKey = keyInfo.MatchedKey
+		resolved.URI = keyInfo.URL
+		resolved.Fingerprint = keyInfo.Fingerprint
+		if conf.InvalidateCorrupted {
+			entry := corruptedEntry{BuildSlug: conf.BuildSlug, CacheKey: keyInfo.MatchedKey, Fingerprint: keyInfo.Fingerprint}
+			corruptedArchiveInvalidator = newCorruptedArchiveInvalidator(NewInvalidationClient(conf.ABCSAPIURL, accessToken(conf)), entry)
+		}
+	} else if strings.HasPrefix(conf.CacheAPIURL, "file://") {
+		resolved.URI = conf.CacheAPIURL
+
+		result.StartSection("resolve", "Using local cache archive")
+	} else {
+		result.StartSection("resolve", "Downloading remote cache archive")
+
+		if isBitriseCacheAPIURL(conf.CacheAPIURL, conf.BitriseCacheAPIURL) {
+			var err error
+			if conf.SourceBuild != "" {
+				log.Printf("Using the cache of the build: %s", conf.SourceBuild)
+				sourceURL, urlErr := sourceBuildCacheAPIURL(conf.CacheAPIURL, conf.SourceBuild)
+				if urlErr != nil {
+					failAs(failureConfig, "Invalid source build: %s", urlErr)
+				}
+				resolved.DownloadInfo, err = getScopedCacheDownloadInfo(sourceURL, projectPath)
+			} else {
+				pipelineID := ""
+				if conf.PipelineCache {
+					if pipelineID = conf.PipelineID; pipelineID == "" {
+						log.Debugf("Not running in a pipeline, using the branch cache")
+					}
+				}
+				resolved.DownloadInfo, result.Intermediate, err = getPipelineCacheDownloadInfo(conf.CacheAPIURL, pipelineID, projectPath)
+				if result.Intermediate {
+					log.Printf("Using the intermediate cache of the pipeline (%s)", pipelineID)
+				}
+			}
+			if err == errCacheNotFound {
+				handleCacheMiss(conf, notifier)
+				result.Warnf("No cache archive found for the build, there's no cache to use, exiting.")
+				finishMiss()
+				return resolvedArchive{}, false
+			}
+			if err != nil {
+				failAs(failureDownload, "Failed to get cache download url: %s", err)
+			}
+			if quarantined.contains(resolved.DownloadInfo.Fingerprint) {
+				reportQuarantined(notifier, []string{resolved.DownloadInfo.Fingerprint})
+				result.Warnf("The cache archive is quarantined, there's no older cache to use, exiting.")
+				finishMiss()
+				return resolvedArchive{}, false
+			}
+			if conf.HandoffMode {
+				if resolved.Handoff, err = handoffMetadata(resolved.DownloadInfo); err != nil {
+					result.Warnf("Not using the handoff mode: %s", err)
+				} else if !resolved.Handoff {
+					log.Printf("The cache API did not send the archive's compression and fingerprint, not using the handoff mode")
+				}
+				resolved.DownloadInfo = preferDatacenter(resolved.DownloadInfo, conf.Datacenter)
+			}
+			if conf.SelectFastestRegion {
+				resolved.DownloadInfo = selectFastestRegion(resolved.DownloadInfo)
+			}
+			resolved.URI = resolved.DownloadInfo.DownloadURL
+			resolved.Fingerprint = resolved.DownloadInfo.Fingerprint
+			if conf.InvalidateCorrupted {
+				entry := corruptedEntry{BuildSlug: conf.BuildSlug, Fingerprint: resolved.DownloadInfo.Fingerprint}
+				corruptedArchiveInvalidator = newCorruptedArchiveInvalidator(NewInvalidationClient(conf.CacheAPIURL, ""), entry)
+			}
+		} else {
+			resolved.URI = conf.CacheAPIURL
+		}
+	}
+	return resolved, true
+}
+
+// openArchiveStream opens the stream of the (not split) archive: downloaded by the external downloader first,
+// resumed from the partial_downloads_dir, verified at its checkpoints or just downloaded.
+// It returns the resumable download (if any) and the external downloader's file, removed by the caller after the restore.
+func openArchiveStream(conf Config, parts []string, downloadInfo cacheDownloadInfo, headers http.Header, fingerprint string) (io.Reader, *resumableDownload, string) {
+	var downloaded string
+	if pth := downloadExternally(conf, parts[0], downloadInfo.Mirrors, headers); pth != "" {
+		downloaded = pth
+		parts[0] = "file://" + pth
+	}
+
+	var r io.Reader
+	var resumable *resumableDownload
+	var err error
+	if conf.PartialDownloadsDir != "" && fingerprint != "" && strings.HasPrefix(parts[0], "http") {
+		if err := prunePartialDownloads(conf.PartialDownloadsDir, partialDownloadPath(conf.PartialDownloadsDir, fingerprint), partialDownloadMaxAge, time.Now()); err != nil {
+			result.Warnf("Failed to remove the old partial downloads: %s", err)
+		}
+		resumable, err = openResumableDownload(conf.PartialDownloadsDir, fingerprint, parts[0])
+		if err == nil {
+			r = resumable
+		} else if err == errPartialDownloadInUse {
+			log.Printf("The archive is being downloaded by another step, downloading it without persisting the download")
+			r, err = openPart(parts[0])
+		}
+	} else if downloadInfo.Checkpoints.valid() && strings.HasPrefix(parts[0], "http") {
+		log.Printf("Verifying the download at every %s", formatBytes(downloadInfo.Checkpoints.Interval))
+		r, err = openCheckpointedDownload(parts[0], *downloadInfo.Checkpoints)
+	} else {
+		if downloadInfo.Checkpoints != nil && downloadInfo.Checkpoints.Interval > maxCheckpointInterval {
+			result.Warnf("The archive's checkpoint interval (%s) is larger than %s, downloading it without verifying the checkpoints",
+				formatBytes(downloadInfo.Checkpoints.Interval), formatBytes(maxCheckpointInterval))
+		}
+		r, err = openPart(parts[0])
+	}
+	if err != nil {
+		failAs(failureDownload, "Failed to open cache archive: %s", err)
+	}
+	return r, resumable, downloaded
+}
+
+// planArchiveRestore adds the paths not restored from the archive (see its archiveInfo) to the filter.
+func planArchiveRestore(conf Config, info archiveInfo, filter *pathFilter, stateDir *StateDir, warmStart bool) {
+	if conf.SwiftPackageResolved != "" {
+		filter.Skip = append(filter.Skip, planSwiftPackageRestore(conf, info)...)
+	}
+	if conf.CargoTargetDir != "" {
+		filter.skipAlso(planCargoTargetRestore(conf, info))
+	}
+	if conf.CachePresets != "" {
+		filter.Skip = append(filter.Skip, planCachePresetRestore(conf.CachePresets, info)...)
+	}
+	filter.Skip = append(filter.Skip, planPlatformArtifactRestore(conf, info)...)
+	if warmStart {
+		filter.Skip = append(filter.Skip, planWarmStartRestore(stateDir, info)...)
+	}
+}
+
+// newStreamExtractor creates the Extractor of the archive stream with the filter and the archive's layout.
+func newStreamExtractor(conf Config, filter pathFilter, info archiveInfo, startTime time.Time) *Extractor {
+	extractor, err := newCacheExtractor(conf)
+	if err != nil {
+		failAs(failureExtraction, "Failed to prepare cache extraction: %s", err)
+	}
+	extractor.Filter = filter
+	if conf.SplitComponents && conf.CachePresets == "" {
+		// the cache_presets' archives are split by the presets already
+		extractor.Components = detectComponents()
+	}
+	if conf.TimeBudget > 0 {
+		extractor.Deadline = startTime.Add(time.Duration(conf.TimeBudget) * time.Second)
+		extractor.PriorityPaths = resolvePathList(conf.PriorityPaths)
+	}
+	extractor.LargeDirectories = info.Directories
+	extractor.Budgets = resolvePathBudgets(conf.PathBudgets)
+	extractor.AuditOverwrites = conf.OverwriteAuditPath != ""
+	for _, artifact := range info.PlatformArtifacts {
+		extractor.SparsePaths = append(extractor.SparsePaths, artifact.Path)
+	}
+	if conf.DestinationRoots != "" {
+		roots, err := parseDestinationRoots(conf.DestinationRoots, extractor.Dir)
+		if err != nil {
+			failAs(failureExtraction, "Failed to parse destination roots: %s", err)
+		}
+		extractor.restoreInto(roots)
+		log.Printf("Restoring the cache archive into: %s", extractor.Dir)
+		for _, replica := range extractor.Replicas {
+			log.Printf("Restoring the cache archive also into: %s", replica.Dir)
+		}
+	}
+	return extractor
+}
+
+// reportExtraction prints the extraction's skipped and specially restored entries.
+func reportExtraction(extractor *Extractor) {
+	if extractor.SkippedSpecialFiles > 0 {
+		result.Warnf("%d special files (devices, FIFOs) skipped", extractor.SkippedSpecialFiles)
+	}
+	if extractor.IgnoredPermissionErrors > 0 {
+		result.Warnf("%d directory modes or modification times not restored, because of permission errors", extractor.IgnoredPermissionErrors)
+	}
+
+	if extractor.SkippedEntries > 0 {
+		log.Printf("%d archive entries skipped, because of the changed files", extractor.SkippedEntries)
+	}
+
+	if extractor.PreallocatedDirs > 0 {
+		log.Printf("%d directories of the large cached directories created before the extraction", extractor.PreallocatedDirs)
+	}
+	if extractor.CopiedLinks > 0 {
+		log.Printf("%d hard links restored as copies", extractor.CopiedLinks)
+	}
+}
+
+// checkRestoredCaches validates the restored tool caches and applies the cache presets, if enabled.
+func checkRestoredCaches(conf Config) {
+	if conf.VerifyRepositoryCaches {
+		verifyRepositoryCaches()
+	}
+	if conf.ValidateDerivedData {
+		validateDerivedData(conf)
+	}
+	if conf.CachePresets != "" {
+		applyCachePresets(conf.CachePresets)
+	}
+	if conf.CargoTargetDir != "" {
+		validateCargoTarget(conf)
+	}
+	placeOnTmpfs(conf)
+}
+
+// writeRestoreReports writes the overwrite audit and the usage snapshot of the restore, if enabled.
+func writeRestoreReports(conf Config, extractor *Extractor, counter *entryCounter, restoredAt time.Time) {
+	if extractor.AuditOverwrites && result.Status != statusFallbackRestored {
+		if len(extractor.Overwritten) > 0 {
+			log.Printf("%d pre-existing files overwritten, see: %s", len(extractor.Overwritten), conf.OverwriteAuditPath)
+		}
+		audit := overwriteAudit{CacheKey: result.CacheKey, CacheURL: result.CacheURL, Overwritten: extractor.Overwritten}
+		if err := writeOverwriteAudit(conf.OverwriteAuditPath, audit); err != nil {
+			result.Warnf("Failed to write the overwrite audit: %s", err)
+		}
+	}
+	if conf.UsageSnapshotPath != "" {
+		if err := writeUsageSnapshot(conf.UsageSnapshotPath, restoredRoots(counter.Names(), extractor), restoredAt); err != nil {
+			result.Warnf("Failed to write the usage snapshot: %s", err)
+		}
+	}
+}
+
+// expandNestedArchives expands the restored archives selected by the expand_nested_archives patterns,
+// the others are only reported.
+func expandNestedArchives(conf Config, archives []string) {
+	if len(archives) == 0 {
+		return
+	}
+	patterns, err := parseNestedArchivePatterns(conf.ExpandNestedArchives)
+	if err != nil {
+		result.Warnf("Invalid nested archive patterns: %s", err)
+		return
+	}
+
+	expanded := 0
+	for _, pth := range archives {
+		if !matchesNestedArchivePattern(pth, patterns) {
+			continue
+		}
+		log.Printf("Expanding nested archive: %s", pth)
+		if err := expandNestedArchive(pth); err != nil {
+			result.Warnf("Failed to expand the nested archive (%s): %s", pth, err)
+			continue
+		}
+		expanded++
+	}
+
+	log.Printf("%d nested archive(s) found in the cache, %d expanded", len(archives), expanded)
+	if len(patterns) == 0 {
+		log.Printf("Set expand_nested_archives to expand them during the restore")
+	}
+}
+
+// verifyRepositoryCaches removes the entries of the restored Gradle, Maven and Ivy repository caches
+// not matching their checksum (e.g. truncated by an interrupted push), so the build downloads them again
+// instead of failing with a checksum mismatch. A failure only warns.
+func verifyRepositoryCaches() {
+	caches, err := repositoryCaches()
+	if err != nil {
+		result.Warnf("Failed to locate the repository caches: %s", err)
+		return
+	}
+
+	for _, c := range caches {
+		if _, err := os.Stat(c.Path); err != nil {
+			log.Debugf("No %s repository cache (%s): %s", c.Kind, c.Path, err)
+			continue
+		}
+
+		broken, err := c.brokenEntries()
+		if err != nil {
+			result.Warnf("Failed to verify the %s repository cache (%s): %s", c.Kind, c.Path, err)
+			continue
+		}
+		for _, pth := range broken {
+			if err := c.removeBrokenEntry(pth); err != nil {
+				result.Warnf("Failed to remove the broken %s repository cache entry (%s): %s", c.Kind, pth, err)
+				continue
+			}
+			result.BrokenArtifacts = append(result.BrokenArtifacts, pth)
+		}
+		if len(broken) > 0 {
+			listed := broken
+			if len(listed) > 10 {
+				listed = listed[:10]
+			}
+			result.Warnf("%d entries of the %s repository cache do not match their checksum, removed: %s", len(broken), c.Kind, strings.Join(listed, ", "))
+		} else {
+			log.Printf("The %s repository cache (%s) is verified", c.Kind, c.Path)
+		}
+	}
+}
+
+// validateDerivedData clears the module caches of the restored DerivedData, if it was built
+// with another Xcode or other build settings, as they slow down or break the build.
+// The current Xcode and build settings are recorded in the DerivedData for the next pull. A failure only warns.
+func validateDerivedData(conf Config) {
+	if _, err := os.Stat(conf.DerivedDataPath); err != nil {
+		log.Printf("No DerivedData restored (%s), nothing to validate", conf.DerivedDataPath)
+		return
+	}
+	xcodeVersion, err := currentXcodeVersion()
+	if err != nil {
+		result.Warnf("Failed to get the Xcode version, the restored DerivedData is not validated: %s", err)
+		return
+	}
+	current := derivedDataMarker{XcodeVersion: xcodeVersion, BuildSettingsHash: buildSettingsHash(conf.DerivedDataBuildSettings)}
+
+	marker, err := readDerivedDataMarker(conf.DerivedDataPath)
+	if err != nil {
+		result.Warnf("Failed to read the restored DerivedData's marker: %s", err)
+	}
+	switch {
+	case marker == nil:
+		log.Printf("The restored DerivedData has no Xcode and build settings recorded, its module caches are kept")
+	case marker.incompatibility(current) != "":
+		cleared, err := clearModuleCaches(conf.DerivedDataPath)
+		result.ClearedModuleCaches = cleared
+		if err != nil {
+			result.Warnf("Failed to clear the module caches of the restored DerivedData: %s", err)
+			return
+		}
+		result.Warnf("The restored DerivedData was %s, %d module caches cleared", marker.incompatibility(current), len(cleared))
+	default:
+		log.Printf("The restored DerivedData matches the current Xcode (%s) and build settings", xcodeVersion)
+	}
+
+	if err := writeDerivedDataMarker(conf.DerivedDataPath, current); err != nil {
+		result.Warnf("Failed to record the Xcode and build settings in the DerivedData: %s", err)
+	}
+}
+
+// planCachePresetRestore returns the toolchain paths of the cache_presets not to restore: the ones the archive lists
+// another toolchain for than the current one (e.g. GOCACHE of another Go version or platform).
+// Without the archive's toolchain the restored paths are checked after the restore, see applyCachePresets.
+func planCachePresetRestore(names string, info archiveInfo) []string {
+	if len(info.PresetToolchains) == 0 {
+		return nil
+	}
+	presets, err := cachepreset.Parse(names)
+	if err != nil {
+		return nil
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		result.Warnf("Failed to get working directory, the cache presets' toolchain paths are restored as they are: %s", err)
+		return nil
+	}
+	env, err := cachepreset.NewEnv(wd)
+	if err != nil {
+		result.Warnf("Failed to get the cache presets' environment: %s", err)
+		return nil
+	}
+
+	var skip []string
+	for _, p := range presets {
+		cached := info.PresetToolchains[p.Name]
+		if cached == "" {
+			continue
+		}
+		x, err := p.Expand(env)
+		if err != nil {
+			result.Warnf("Failed to expand the %s cache preset, its toolchain paths are restored as they are: %s", p.Name, err)
+			continue
+		}
+		if len(x.ToolchainPaths) == 0 || x.Toolchain == "" || x.Toolchain == cached {
+			continue
+		}
+		log.Printf("The %s cache preset's %s are built by %s, the current toolchain is %s: not restored",
+			p.Name, strings.Join(x.ToolchainPaths, ", "), cached, x.Toolchain)
+		skip = append(skip, x.ToolchainPaths...)
+	}
+	return skip
+}
+
+// applyCachePresets expands the cache_presets in the working directory, removes the restored project paths
+// not matching the project's lockfiles, and exports the presets' paths and fingerprint for the cache push step.
+// A failure only warns.
+func applyCachePresets(names string) {
+	presets, err := cachepreset.Parse(names)
+	if err != nil {
+		result.Warnf("Invalid cache presets: %s", err)
+		return
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		result.Warnf("Failed to get working directory, the cache presets are not applied: %s", err)
+		return
+	}
+	env, err := cachepreset.NewEnv(wd)
+	if err != nil {
+		result.Warnf("Failed to get the cache presets' environment: %s", err)
+		return
+	}
+
+	var expansions []cachepreset.Expansion
+	var paths []string
+	for _, p := range presets {
+		x, err := p.Expand(env)
+		if err != nil {
+			result.Warnf("Failed to expand the %s cache preset: %s", p.Name, err)
+			continue
+		}
+		expansions = append(expansions, x)
+		paths = append(paths, x.AllPaths()...)
+
+		cleared, err := clearStalePresetPaths(x, os.Getenv("FLUTTER_ROOT"))
+		result.ClearedStalePaths = append(result.ClearedStalePaths, cleared...)
+		for _, pth := range cleared {
+			log.Printf("%s does not match the project's %s lockfiles or toolchain, removed", pth, p.Name)
+		}
+		if err != nil {
+			result.Warnf("Failed to check the restored %s caches: %s", p.Name, err)
+		}
+	}
+
+	if err := exportEnv(presetPathsEnvKey, strings.Join(paths, "\n")); err != nil {
+		result.Warnf("%s", err)
+	}
+	if err := exportEnv(presetFingerprintEnvKey, cachepreset.CombinedFingerprint(expansions)); err != nil {
+		result.Warnf("%s", err)
+	}
+}
+
+// placeOnTmpfs moves the restored tmpfs_paths into the tmpfs_dir, see moveToTmpfs.
+// A failure only warns, the paths not moved are used from the disk.
+func placeOnTmpfs(conf Config) {
+	paths := resolvePathList(conf.TmpfsPaths)
+	if len(paths) == 0 {
+		return
+	}
+
+	moved, err := moveToTmpfs(paths, conf.TmpfsDir, int64(conf.TmpfsMaxSizeMB)*1024*1024)
+	for _, p := range moved {
+		log.Printf("%s (%s) moved to the tmpfs: %s", p.Path, formatBytes(p.Size), p.Target)
+	}
+	if err != nil {
+		result.Warnf("Failed to move the cache paths to the tmpfs: %s", err)
+	}
+}
+
+// postProcessRestoredPaths applies the restore_acl and restore_selinux_labels inputs to the restored paths.
+func postProcessRestoredPaths(conf Config, paths []string) {
+	if conf.RestoreACL != "" {
+		applyRestoreACL(conf, paths)
+	}
+	if conf.RestoreSELinuxLabels {
+		relabelRestoredPaths(paths)
+	}
+}
+
+// applyRestoreACL adds the restore_acl entries to the restored paths, a failure only warns.
+func applyRestoreACL(conf Config, paths []string) {
+	if _, err := exec.LookPath("setfacl"); err != nil {
+		result.Warnf("setfacl is not installed, the ACL (%s) is not applied to the restored paths", conf.RestoreACL)
+		return
+	}
+	if len(paths) == 0 {
+		result.Warnf("The restored paths are unknown, the ACL (%s) is not applied", conf.RestoreACL)
+		return
+	}
+
+	if err := applyACL(conf.RestoreACL, paths); err != nil {
+		result.Warnf("Failed to apply the ACL to the restored paths: %s", err)
+		return
+	}
+	log.Printf("ACL (%s) applied to %d restored path(s)", conf.RestoreACL, len(paths))
+}
+
+// relabelRestoredPaths re-applies the SELinux contexts of the restored paths, see relabelPaths.
+// The paths whose context could not be set are reported in the result, a failure only warns.
+func relabelRestoredPaths(paths []string) {
+	if !selinuxEnabled() {
+		log.Printf("SELinux is not enabled, the restored paths are not relabeled")
+		return
+	}
+	if _, err := exec.LookPath("restorecon"); err != nil {
+		result.Warnf("restorecon is not installed, the SELinux contexts of the restored paths are not applied")
+		return
+	}
+	if len(paths) == 0 {
+		result.Warnf("The restored paths are unknown, the SELinux contexts are not applied")
+		return
+	}
+
+	failed, err := relabelPaths(paths)
+	if err != nil {
+		result.Warnf("Failed to apply the SELinux contexts of the restored paths: %s", err)
+		return
+	}
+	if len(failed) > 0 {
+		result.Unlabeled = failed
+		listed := failed
+		if len(listed) > 10 {
+			listed = listed[:10]
+		}
+		result.Warnf("The SELinux context of %d restored path(s) could not be set: %s", len(failed), strings.Join(listed, ", "))
+		return
+	}
+	log.Printf("SELinux contexts applied to %d restored path(s)", len(paths))
+}
+
+// runHook runs the hooks of the phase, a failing hook fails the cache pull.
+func runHook(hooks *Hooks, event HookEvent) {
+	if err := hooks.Run(event); err != nil {
+		failf("Hook failed: %s", err)
+	}
+}
+
+// verifyRestore compares the archive with the workspace instead of restoring it, see the verify_only input.
+func verifyRestore(conf Config, archive io.Reader, compressed bool, filter pathFilter) {
+	wd, err := os.Getwd()
+	if err != nil {
+		failf("Failed to get working directory: %s", err)
+	}
+
+	extractor := NewExtractor(wd, conf.ExtractToRelativePath)
+	if extractor.Normalization, err = resolveNormalization(conf.UnicodeNormalization, wd); err != nil {
+		failf("Failed to check the filesystem's unicode normalization: %s", err)
+	}
+	extractor.Filter = filter
+
+	report, err := verifyArchive(archive, compressed, extractor)
+	if err != nil {
+		failAs(failureVerification, "Failed to verify cache archive: %s", err)
+	}
+	printVerifyReport(report, 20)
+
+	if conf.VerifyReportPath != "" {
+		if err := writeVerifyReport(conf.VerifyReportPath, report); err != nil {
+			result.Warnf("Failed to write the verification report: %s", err)
+		}
+	}
+	result.Finish(statusVerified, nil)
+}
+
+// saveRestoreState writes the restore state for the cache push step, if enabled.
+func saveRestoreState(conf Config, state restoreState) {
+	if conf.RestoreStatePath == "" {
+		return
+	}
+	if err := writeRestoreState(conf.RestoreStatePath, state); err != nil {
+		result.Warnf("Failed to write the restore state: %s", err)
+	}
+}
+
+// downloadExternally downloads the remote archive with aria2c or axel, if enabled and installed (see the downloader input),
+// and returns the downloaded file's path. It returns an empty path if the built-in downloader is used.
+// The external tools can not sign the requests, constrain the redirects or apply the TLS settings,
+// so they are not used with download_auth, redirect_allowed_hosts, non default TLS settings or client certificates.
+// axel is not used with request_headers either, it only takes the headers as arguments.
+func downloadExternally(conf Config, uri string, mirrors []string, headers http.Header) string {
+	if conf.Offline || conf.DownloadAuth != downloadAuthNone || conf.RedirectAllowedHosts != "" || !strings.HasPrefix(uri, "http") {
+		return ""
+	}
+	if conf.TLSCipherSuites != "" || (conf.TLSMinVersion != "" && conf.TLSMinVersion != "1.2") || conf.TLSClientCert != "" {
+		return ""
+	}
+	tool := resolveDownloader(conf.Downloader, exec.LookPath)
+	if tool == downloaderBuiltin {
+		return ""
+	}
+	if tool == downloaderAxel && len(headers) > 0 {
+		log.Warnf("axel would expose the request headers on its command line, using the built-in downloader")
+		return ""
+	}
+
+	log.Printf("Downloading cache archive with %s", tool)
+	pth := filepath.Join(stepRunDir, "cache-archive.download")
+	h := http.Header{"User-Agent": []string{userAgent(conf.BuildSlug)}}
+	for name, values := range headers {
+		h[name] = values
+	}
+	if err := downloadWithExternalTool(tool, append([]string{uri}, mirrors...), pth, h); err != nil {
+		result.Warnf("Failed to download the cache archive with %s, using the built-in downloader: %s", tool, err)
+		if err := os.Remove(pth); err != nil && !os.IsNotExist(err) {
+			log.Warnf("Failed to remove %s: %s", pth, err)
+		}
+		return ""
+	}
+	return pth
+}
+
+// collectBlobCaches removes the archives kept by the earlier builds, see the blob_cache_max_* inputs.
+func collectBlobCaches(conf Config) {
+	if conf.BuildSlug == "" {
+		// the archives of the build are kept in the root
+		return
+	}
+
+	keep := NewBuildBlobCache(conf.BuildSlug).Dir
+	maxAge := time.Duration(conf.BlobCacheMaxAgeHours) * time.Hour
+	maxSize := int64(conf.BlobCacheMaxSizeMB) * 1024 * 1024
+	removed, freed, err := gcBlobCaches(blobCacheRoot(), keep, maxAge, maxSize, time.Now())
+	if err != nil {
+		result.Warnf("Failed to remove the archives kept by earlier builds: %s", err)
+	}
+	if removed > 0 {
+		log.Printf("Removed %d kept archive(s) of earlier builds, freed %s", removed, formatBytes(freed))
+	}
+}
+
+// recordCacheState updates the state dir's bookkeeping with the restored cache, if enabled.
+func recordCacheState(stateDir *StateDir, restored restoreState, cacheURL string, chunks []archiveChunk, etags map[string]string, components []componentState) {
+	if stateDir == nil {
+		return
+	}
+
+	l, err := stateDir.Lock()
+	if err != nil {
+		result.Warnf("Failed to lock the state: %s", err)
+		return
+	}
+	defer func() {
+		if err := l.Unlock(); err != nil {
+			log.Warnf("Failed to release the lock of the state: %s", err)
+		}
+	}()
+
+	state, err := stateDir.Load()
+	if err != nil {
+		result.Warnf("Failed to read the state: %s", err)
+		return
+	}
+
+	state.LastKey = restored.CacheKey
+	state.CacheURL = cacheURL
+	state.ArchiveChecksum = restored.ArchiveChecksum
+	state.Fingerprint = restored.Fingerprint
+	state.Chunks = chunks
+	state.ContentHashes = restored.ContentHashes
+	state.Components = components
+	if state.ETags == nil {
+		state.ETags = map[string]string{}
+	}
+	for u, etag := range etags {
+		state.ETags[u] = etag
+	}
+
+	if err := stateDir.Save(state); err != nil {
+		result.Warnf("Failed to write the state: %s", err)
+	}
+}
+
+// exportKeptArchive exports the path of the archive kept for the later steps, and removes the archives over
+// the keep_archive_max_count. A failure only warns.
+func exportKeptArchive(conf Config, pth string, err error) {
+	if err != nil {
+		result.Warnf("Failed to keep the cache archive for the later steps: %s", err)
+		return
+	}
+	log.Printf("Cache archive kept for the later steps: %s", pth)
+	if err := exportEnv(keptArchivePathEnvKey, pth); err != nil {
+		result.Warnf("%s", err)
+	}
+
+	removed, err := pruneKeptArchives(filepath.Dir(pth), pth, conf.KeepArchiveMaxCount)
+	for _, p := range removed {
+		log.Debugf("Removed the kept cache archive: %s", p)
+	}
+	if err != nil {
+		result.Warnf("Failed to remove the old kept cache archives: %s", err)
+	}
+}
+
+// preflight prints the remote archive's size, last modification time and estimated download time, see the preflight input.
+// A failure only logs.
+func preflight(conf Config, parts []string, chunks []archiveChunk) {
+	p, err := preflightArchive(parts, chunks)
+	if err != nil {
+		log.Printf("Failed to read the cache archive's metadata: %s", err)
+		return
+	}
+
+	previousSize := int64(-1)
+	if conf.StatsFilePath != "" {
+		if previous, err := readStats(conf.StatsFilePath); err != nil {
+			log.Debugf("Failed to read the previous restore's statistics: %s", err)
+		} else if previous != nil {
+			previousSize = previous.ArchiveSize
+		}
+	}
+	printPreflight(p, previousSize, time.Now())
+}
+
+// checkUnchangedArchive reads the archive's fingerprint from its first Bytes and reports whether it is the archive
+// restored last on this machine (see the skip_unchanged input). It returns the state of the last restore.
+func checkUnchangedArchive(stateDir *StateDir, uri string) (restoreState, bool) {
+	state, err := stateDir.Load()
+	if err != nil {
+		result.Warnf("Failed to read the state: %s", err)
+		return restoreState{}, false
+	}
+	if state.Fingerprint == "" {
+		log.Debugf("no fingerprint of the last restored archive")
+		return restoreState{}, false
+	}
+
+	fingerprint, err := peekArchiveFingerprint(uri)
+	if err != nil {
+		log.Debugf("Failed to read the cache archive's fingerprint: %s", err)
+		return restoreState{}, false
+	}
+	if fingerprint != state.Fingerprint {
+		log.Debugf("cache archive fingerprint: %s, last restored: %s", fingerprint, state.Fingerprint)
+		return restoreState{}, false
+	}
+
+	return restoreState{Fingerprint: state.Fingerprint, ArchiveChecksum: state.ArchiveChecksum}, true
+}
+
+// compareRestoreStats prints the change of the restore statistics since the previous build, warns about sudden growth
+// and persists the current statistics for the next build.
+func compareRestoreStats(conf Config, notifier *Notifier, stats restoreStats) {
+	stats.BuildSlug = conf.BuildSlug
+
+	prev, err := readStats(conf.StatsFilePath)
+	if err != nil {
+		result.Warnf("Failed to read the previous restore statistics: %s", err)
+	} else if prev == nil {
+		log.Debugf("no previous restore statistics (%s)", conf.StatsFilePath)
+	} else if growth := printStatsDiff(*prev, stats); conf.StatsGrowthThreshold > 0 && growth >= float64(conf.StatsGrowthThreshold) {
+		result.Warnf("Cache archive grew by %.1f%% since the previous build, threshold: %d%%", growth, conf.StatsGrowthThreshold)
+		notifier.Notify(anomalyCacheGrowth, "cache archive grew by %.1f%% (%d -> %d Bytes), threshold: %d%%", growth, prev.ArchiveSize, stats.ArchiveSize, conf.StatsGrowthThreshold)
+	}
+
+	if err := writeStats(conf.StatsFilePath, stats); err != nil {
+		result.Warnf("Failed to write the restore statistics: %s", err)
+	}
+}
+
+// reportQuarantined reports the refused quarantined cache archives.
+func reportQuarantined(notifier *Notifier, fingerprints []string) {
+	for _, fingerprint := range fingerprints {
+		result.Warnf("Refused the quarantined cache archive: %s", fingerprint)
+		notifier.Notify(anomalyQuarantined, "refused the quarantined cache archive: %s", fingerprint)
+	}
+	result.Quarantined = append(result.Quarantined, fingerprints...)
+}
+
+// drainArchive reads the rest of the archive stream and returns its checksum (empty if the stream can not be read).
+// The download persisted in the partial_downloads_dir is closed, the step fails if it does not match its fingerprint.
+func drainArchive(r io.Reader, digest hash.Hash, resumable *resumableDownload) string {
+	sum, err := streamChecksum(r, digest)
+	if err != nil {
+		log.Debugf("Failed to read the rest of the archive, no archive checksum: %s", err)
+	}
+	if resumable == nil {
+		return sum
+	}
+
+	vErr := resumable.Verify()
+	if err := resumable.Close(); err != nil {
+		log.Warnf("Failed to close the partial download: %s", err)
+	}
+	if vErr != nil {
+		invalidateCorruptedArchive(vErr)
+		failAs(failureVerification, "The restored cache archive can not be trusted: %s", vErr)
+	}
+	return sum
+}
+
+// handleCorruptedArchive treats the corrupted cache archive as a cache miss, so that the build proceeds without cache.
+func handleCorruptedArchive(err error) {
+	result.Warnf("Fallback failed, the cache archive is corrupted: %s", err)
+	invalidateCorruptedArchive(err)
+	result.Warnf("Treating the corrupted cache archive as a cache miss")
+	finishMiss()
+}
+
+// checkFailedItems prints the summary of the legacy cache items
+// and warns or fails if the number of failed items reaches the threshold.
+func checkFailedItems(items []ItemResult, threshold int, action string) {
+	failed := countItems(items, itemFailed)
+	log.Printf("Cache items restored: %d, failed: %d, skipped: %d", countItems(items, itemRestored), failed, countItems(items, itemSkipped))
+
+	if threshold <= 0 || failed < threshold {
+		return
+	}
+	if action == failedItemsActionFail {
+		failAs(failureExtraction, "%d cache items failed to restore, threshold: %d", failed, threshold)
+	}
+	result.Warnf("%d cache items failed to restore, threshold: %d", failed, threshold)
+}
+
+// handleCacheMiss notifies the webhook and the telemetry about the missing cache.
+func handleCacheMiss(conf Config, notifier *Notifier) {
+	if conf.DefaultBranch != "" && conf.Branch == conf.DefaultBranch {
+		notifier.Notify(anomalyCacheMiss, "no cache found for the default branch")
+	}
+	if conf.SendTelemetry && isBitriseCacheAPIURL(conf.CacheAPIURL, conf.BitriseCacheAPIURL) {
+		NewTelemetryClient(conf.CacheAPIURL).Report(pullTelemetry{BuildSlug: conf.BuildSlug, StackID: conf.StackID})
+	}
+}
+
+// accessToken returns the key-based cache API's access token.
+func accessToken(conf Config) string {
+	if conf.ABCSAccessToken != "" {
+		return string(conf.ABCSAccessToken)
+	}
+	return string(conf.ServicesAccessToken)
+}
+
+// checkArchiveAge notifies if the archive is older than maxAgeDays.
+func checkArchiveAge(uri string, maxAgeDays int, notifier *Notifier) {
+	lastModified, err := archiveLastModified(uri)
+	if err != nil {
+		log.Debugf("Failed to get the cache archive's modification time: %s", err)
+		return
+	}
+
+	age := time.Since(lastModified)
+	log.Debugf("cache archive age: %s", age.Round(time.Minute))
+	if age > time.Duration(maxAgeDays)*24*time.Hour {
+		result.Warnf("Cache archive is %d days old", int(age.Hours()/24))
+		notifier.Notify(anomalyStaleArchive, "cache archive is %d days old, limit: %d days", int(age.Hours()/24), maxAgeDays)
+	}
+}
+
+// newCacheExtractor creates the in-process Extractor for the working directory.
+func newCacheExtractor(conf Config) (*Extractor, error) {
+	wd, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+
+	caseInsensitive, err := isCaseInsensitiveFS(wd)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check filesystem case sensitivity: %s", err)
+	}
+	log.Debugf("case-insensitive filesystem: %v", caseInsensitive)
+
+	extractor := NewExtractor(wd, conf.ExtractToRelativePath)
+	extractor.CaseInsensitive = caseInsensitive
+	extractor.CollisionPolicy = conf.CaseCollisionPolicy
+	if extractor.Normalization, err = resolveNormalization(conf.UnicodeNormalization, wd); err != nil {
+		return nil, fmt.Errorf("failed to check the filesystem's unicode normalization: %s", err)
+	}
+	extractor.SpecialFilePolicy = conf.SpecialFilePolicy
+	extractor.Workers = conf.ExtractionWorkers
+	extractor.PipelineBuffer = int64(conf.PipelineBufferMB) * 1024 * 1024
+	extractor.FsyncPolicy = conf.FsyncPolicy
+	extractor.PermissionErrors = conf.PermissionErrors
+	if extractor.Umask, err = parseUmask(conf.RestoreUmask); err != nil {
+		return nil, err
+	}
+	log.Debugf("unicode normalization: %s", extractor.Normalization)
+
+	return extractor, nil
+}
+
+// resolveProjectPaths returns the subproject's directory, as the only path to restore.
+func resolveProjectPaths(projectPath string) []string {
+	if projectPath == "" {
+		return nil
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		result.Warnf("Failed to get working directory, restoring every path: %s", err)
+		return nil
+	}
+	return []string{filepath.Join(wd, filepath.FromSlash(projectPath))}
+}
+
+// resolvePathList returns the paths of the input (one per line, e.g. priority_paths),
+// the relative paths are relative to the working directory.
+func resolvePathList(s string) []string {
+	wd, err := os.Getwd()
+	if err != nil {
+		result.Warnf("Failed to get working directory, ignoring the paths: %s", err)
+		return nil
+	}
+
+	var paths []string
+	for _, line := range strings.Split(s, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if !filepath.IsAbs(line) {
+			line = filepath.Join(wd, line)
+		}
+		paths = append(paths, filepath.Clean(line))
+	}
+	return paths
+}
+
+// planAndroidRestore detects the Android project of the directory, exports its cache paths
+// and returns the filter skipping the caches of the other Gradle and Android Gradle Plugin versions.
+// Nothing is skipped, if it is not an Android project.
+func planAndroidRestore(dir string) func(string) bool {
+	project, err := detectAndroidProject(dir)
+	if err != nil {
+		result.Warnf("Failed to detect the Android project (%s): %s", dir, err)
+		return nil
+	}
+	if project == nil {
+		log.Printf("%s is not a Gradle wrapper based Android project, the Gradle caches are restored as they are", dir)
+		return nil
+	}
+	dirs, err := userAndroidCacheDirs()
+	if err != nil {
+		result.Warnf("Failed to locate the Gradle and Android caches: %s", err)
+		return nil
+	}
+
+	agpVersion := project.AGPVersion
+	if agpVersion == "" {
+		agpVersion = "unknown"
+	}
+	log.Printf("Android project detected, Gradle %s, Android Gradle Plugin %s, the caches of the other versions are not restored", project.GradleVersion, agpVersion)
+	if err := exportEnv(androidCachePathsEnvKey, strings.Join(project.CachePaths(dirs), "\n")); err != nil {
+		result.Warnf("%s", err)
+	}
+	return func(pth string) bool {
+		return project.staleCachePath(pth, dirs)
+	}
+}
+
+// cargoTargetDir returns the cargo_target_dir input's directory, relative to the working directory.
+func cargoTargetDir(conf Config) (string, error) {
+	if filepath.IsAbs(conf.CargoTargetDir) {
+		return filepath.Clean(conf.CargoTargetDir), nil
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(wd, conf.CargoTargetDir), nil
+}
+
+// planCargoTargetRestore returns the filter skipping the compiled directories of the cargo target directory,
+// if the archive lists the toolchain they were compiled by, and it is not the current one.
+// Without the archive's toolchain the restored target directory is checked after the restore, see validateCargoTarget.
+func planCargoTargetRestore(conf Config, info archiveInfo) func(string) bool {
+	if info.RustcVersion == "" {
+		return nil
+	}
+	targetDir, err := cargoTargetDir(conf)
+	if err != nil {
+		result.Warnf("Failed to get working directory, the cargo target directory is restored as it is: %s", err)
+		return nil
+	}
+	current, err := currentRustcVersion(filepath.Dir(targetDir))
+	if err != nil {
+		result.Warnf("Failed to get the rustc version, the cargo target directory is restored as it is: %s", err)
+		return nil
+	}
+	if current == info.RustcVersion {
+		log.Printf("The cargo target directory is compiled by the current toolchain (%s)", current)
+		return nil
+	}
+
+	log.Printf("The cargo target directory is compiled by %s, the current toolchain is %s: its compiled files are not restored", info.RustcVersion, current)
+	return func(pth string) bool {
+		return isCargoCompiledPath(pth, targetDir)
+	}
+}
+
+// validateCargoTarget prunes the compiled directories of the restored cargo target directory,
+// if they were compiled by another toolchain than the current one. A failure only warns.
+func validateCargoTarget(conf Config) {
+	targetDir, err := cargoTargetDir(conf)
+	if err != nil {
+		result.Warnf("Failed to get working directory, the cargo target directory is not checked: %s", err)
+		return
+	}
+	restored, err := readTargetRustcVersion(targetDir)
+	if err != nil {
+		result.Warnf("Failed to read the cargo target directory's toolchain: %s", err)
+		return
+	}
+	if restored == "" {
+		// not restored, or its compiled files were skipped
+		return
+	}
+	current, err := currentRustcVersion(filepath.Dir(targetDir))
+	if err != nil {
+		result.Warnf("Failed to get the rustc version, the cargo target directory is not checked: %s", err)
+		return
+	}
+	if current == restored {
+		return
+	}
+
+	pruned, err := pruneCargoTarget(targetDir)
+	result.ClearedStalePaths = append(result.ClearedStalePaths, pruned...)
+	if err != nil {
+		result.Warnf("Failed to prune the cargo target directory: %s", err)
+		return
+	}
+	log.Printf("The cargo target directory was compiled by %s, the current toolchain is %s: %d compiled directories removed", restored, current, len(pruned))
+}
+
+// planSwiftPackageRestore compares the current Package.resolved with the archive's Swift packages,
+// and returns the Swift package paths not to restore, see swiftPackageRestore.
+// The packages are restored fully, if the current ones are unknown.
+func planSwiftPackageRestore(conf Config, info archiveInfo) []string {
+	result.StartSection("", "Checking the cached Swift packages")
+
+	current, err := readPackageResolved(conf.SwiftPackageResolved)
+	if err != nil {
+		result.Warnf("Failed to read the Package.resolved, restoring the Swift packages fully: %s", err)
+		return nil
+	}
+	if len(info.SwiftPackages) == 0 {
+		log.Printf("The cache archive does not list its Swift packages, restoring them fully")
+	}
+
+	mode, changed := swiftPackageRestore(info.SwiftPackages, current)
+	result.SwiftPackages = mode
+	switch mode {
+	case spmRestorePartial:
+		log.Printf("%d of %d Swift packages changed, their checkouts are not restored: %s", len(changed), len(current), strings.Join(changed, ", "))
+	case spmRestoreSkipped:
+		log.Printf("Every Swift package changed, the Swift package caches are not restored")
+	default:
+		log.Printf("The Swift packages did not change, restoring them fully")
+	}
+
+	buildDir := conf.SwiftPackageBuildDir
+	if !filepath.IsAbs(buildDir) {
+		wd, err := os.Getwd()
+		if err != nil {
+			result.Warnf("Failed to get working directory, restoring the Swift packages fully: %s", err)
+			return nil
+		}
+		buildDir = filepath.Join(wd, buildDir)
+	}
+	cacheDir, err := swiftPackageCacheDir()
+	if err != nil {
+		result.Warnf("Failed to locate the SwiftPM cache, restoring the Swift packages fully: %s", err)
+		return nil
+	}
+	return swiftPackageSkippedPaths(mode, changed, current, filepath.Clean(buildDir), cacheDir)
+}
+
+// resolvePathBudgets returns the path_budgets input's budgets, nil if it is empty.
+// The relative paths are relative to the working directory.
+func resolvePathBudgets(s string) *pathBudgets {
+	if s == "" {
+		return nil
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		result.Warnf("Failed to get working directory, ignoring the path budgets: %s", err)
+		return nil
+	}
+	budgets, err := parsePathBudgets(s, wd)
+	if err != nil {
+		result.Warnf("Invalid path budgets, ignoring them: %s", err)
+		return nil
+	}
+	return budgets
+}
+
+// reportTruncatedGroups warns about the path groups skipped (partially) because of their size budgets,
+// and records them in the result.
+func reportTruncatedGroups(budgets *pathBudgets) {
+	for _, g := range budgets.TruncatedGroups() {
+		result.Warnf("%s (%s priority) is truncated, %d files (%s) over the size budget are not restored", g.Path, g.Priority, g.SkippedEntries, formatBytes(g.SkippedSize))
+		result.Truncated = append(result.Truncated, g.Path)
+	}
+	if budgets.SkippedEntries > 0 {
+		result.Warnf("%d files outside of the path groups are not restored, the total size budget (%s) is exceeded", budgets.SkippedEntries, formatBytes(budgets.Total))
+	}
+}
+
+// resolveSkippedPaths returns the cache paths not to restore, because of the files changed in the current commit.
+func resolveSkippedPaths(conf Config) []string {
+	if conf.SkipOnChange == "" {
+		return nil
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		result.Warnf("Failed to get working directory, restoring every path: %s", err)
+		return nil
+	}
+
+	rules, err := parseChangeRules(conf.SkipOnChange, wd)
+	if err != nil {
+		result.Warnf("Invalid skip_on_change rules, restoring every path: %s", err)
+		return nil
+	}
+
+	changed, err := changedFiles(wd)
+	if err != nil {
+		result.Warnf("Failed to list the changed files, restoring every path: %s", err)
+		return nil
+	}
+	log.Debugf("changed files: %s", strings.Join(changed, ", "))
+
+	return skippedPaths(rules, changed)
 }
 
 func isSameStack(archiveStackID string, currentStackID string) bool {
-	// TODO This check is a temporary solution to support GEN2 VMs having different ids for same stack types
-	r := regexp.MustCompile("^(.+)-gen2.*$")
-	currentStackID = r.ReplaceAllString(currentStackID, "$1")
-	archiveStackID = r.ReplaceAllString(archiveStackID, "$1")
-	return archiveStackID == currentStackID
+	return cachepull.SameStack(archiveStackID, currentStackID)
 }
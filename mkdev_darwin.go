@@ -0,0 +1,6 @@
+package main
+
+// mkdev returns the device number of the given major and minor numbers, in the BSD encoding.
+func mkdev(major, minor int64) int {
+	return int((major << 24) | minor)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// projectPathParam is the cache API's query parameter selecting the subproject's cache.
+const projectPathParam = "project_path"
+
+// cleanProjectPath returns the subproject's path relative to the repository root, in slash separated form.
+func cleanProjectPath(projectPath string) (string, error) {
+	p := path.Clean(strings.TrimSuffix(filepath.ToSlash(strings.TrimSpace(projectPath)), "/"))
+	switch {
+	case projectPath == "" || p == ".":
+		return "", nil
+	case path.IsAbs(p):
+		return "", fmt.Errorf("project path (%s) is not relative to the repository root", projectPath)
+	case p == ".." || strings.HasPrefix(p, "../"):
+		return "", fmt.Errorf("project path (%s) is outside of the repository", projectPath)
+	}
+	return p, nil
+}
+
+// scopeCacheKeys returns the subproject's keys (<project path>/<key>) followed by the repo-wide keys as fallbacks,
+// at most maxCacheKeys of them.
+func scopeCacheKeys(keys []string, projectPath string) []string {
+	if projectPath == "" {
+		return keys
+	}
+
+	scoped := make([]string, 0, 2*len(keys))
+	for _, key := range keys {
+		scoped = append(scoped, projectPath+"/"+key)
+	}
+	scoped = append(scoped, keys...)
+
+	if len(scoped) > maxCacheKeys {
+		log.Warnf("Using the first %d of the subproject and repo-wide cache keys", maxCacheKeys)
+		scoped = scoped[:maxCacheKeys]
+	}
+	return scoped
+}
+
+// scopeCacheAPIURL adds the subproject's path to the cache API URL.
+func scopeCacheAPIURL(cacheAPIURL, projectPath string) (string, error) {
+	u, err := url.Parse(cacheAPIURL)
+	if err != nil {
+		return "", err
+	}
+	query := u.Query()
+	query.Set(projectPathParam, projectPath)
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+// getScopedCacheDownloadInfo gets the subproject's cache download URL, falling back to the repo-wide cache.
+func getScopedCacheDownloadInfo(cacheAPIURL, projectPath string) (cacheDownloadInfo, error) {
+	if projectPath == "" {
+		return getCacheDownloadInfo(cacheAPIURL)
+	}
+
+	scopedURL, err := scopeCacheAPIURL(cacheAPIURL, projectPath)
+	if err != nil {
+		return cacheDownloadInfo{}, fmt.Errorf("invalid cache API URL: %s", err)
+	}
+
+	info, err := getCacheDownloadInfo(scopedURL)
+	if err != errCacheNotFound {
+		return info, err
+	}
+
+	log.Printf("No cache found for the subproject (%s), using the repo-wide cache", projectPath)
+	return getCacheDownloadInfo(cacheAPIURL)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestCleanProjectPath(t *testing.T) {
+	tests := []struct {
+		projectPath string
+		want        string
+		wantErr     bool
+	}{
+		{projectPath: "", want: ""},
+		{projectPath: ".", want: ""},
+		{projectPath: "apps/ios/", want: "apps/ios"},
+		{projectPath: "./apps//android", want: "apps/android"},
+		{projectPath: "/apps/ios", wantErr: true},
+		{projectPath: "apps/../../other", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := cleanProjectPath(tt.projectPath)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("cleanProjectPath(%s) error = %v, wantErr %v", tt.projectPath, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("cleanProjectPath(%s) = %s, want %s", tt.projectPath, got, tt.want)
+		}
+	}
+}
+
+func TestScopeCacheKeys(t *testing.T) {
+	got := scopeCacheKeys([]string{"npm-main", "npm"}, "apps/web")
+	want := []string{"apps/web/npm-main", "apps/web/npm", "npm-main", "npm"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("scopeCacheKeys() = %v, want %v", got, want)
+	}
+
+	keys := []string{"1", "2", "3", "4", "5"}
+	if got := scopeCacheKeys(keys, "apps/web"); len(got) != maxCacheKeys {
+		t.Errorf("scopeCacheKeys() = %v, want %d keys", got, maxCacheKeys)
+	}
+}
+
+func TestGetScopedCacheDownloadInfo(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		archive := "repo"
+		switch r.URL.Query().Get(projectPathParam) {
+		case "":
+		case "apps/ios":
+			archive = "ios"
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if _, err := w.Write([]byte(`{"download_url":"https://cache.example.com/` + archive + `.tar.gz"}`)); err != nil {
+			t.Errorf("failed to write response: %s", err)
+		}
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		projectPath string
+		want        string
+	}{
+		{projectPath: "", want: "https://cache.example.com/repo.tar.gz"},
+		{projectPath: "apps/ios", want: "https://cache.example.com/ios.tar.gz"},
+		{projectPath: "apps/android", want: "https://cache.example.com/repo.tar.gz"},
+	}
+	for _, tt := range tests {
+		info, err := getScopedCacheDownloadInfo(server.URL+"/?build_slug=slug", tt.projectPath)
+		if err != nil {
+			t.Fatalf("getScopedCacheDownloadInfo(%s) error = %v", tt.projectPath, err)
+		}
+		if info.DownloadURL != tt.want {
+			t.Errorf("getScopedCacheDownloadInfo(%s) = %s, want %s", tt.projectPath, info.DownloadURL, tt.want)
+		}
+	}
+}
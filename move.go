@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// movePath renames src to dst, if they are on different filesystems
+// it falls back to recursively copying src (preserving permissions and symlinks) and removing it.
+func movePath(src, dst string) error {
+	err := os.Rename(src, dst)
+	if err == nil {
+		return nil
+	}
+	if linkErr, ok := err.(*os.LinkError); !ok || linkErr.Err != syscall.EXDEV {
+		return err
+	}
+
+	log.Debugf("%s and %s are on different filesystems, copying", src, dst)
+
+	if err := copyTree(src, dst); err != nil {
+		return fmt.Errorf("failed to copy across filesystems: %s", err)
+	}
+	return os.RemoveAll(src)
+}
+
+// copyTree recursively copies src to dst, preserving the permissions, modification times and symlinks.
+func copyTree(src, dst string) error {
+	var dirs []string
+	err := filepath.Walk(src, func(pth string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, pth)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		switch mode := info.Mode(); {
+		case mode.IsDir():
+			dirs = append(dirs, pth)
+			return os.MkdirAll(target, 0755)
+		case mode&os.ModeSymlink != 0:
+			link, err := os.Readlink(pth)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case mode.IsRegular():
+			return copyFile(pth, target, info)
+		default:
+			log.Warnf("Skipping special file: %s", pth)
+			return nil
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	// directory permissions are applied after their content is written, as they can be read-only
+	for i := len(dirs) - 1; i >= 0; i-- {
+		info, err := os.Stat(dirs[i])
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, dirs[i])
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if err := os.Chmod(target, info.Mode().Perm()); err != nil {
+			return err
+		}
+		if err := os.Chtimes(target, info.ModTime(), info.ModTime()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_copyTree(t *testing.T) {
+	dir, err := ioutil.TempDir("", "move-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Logf("failed to remove temp dir: %s", err)
+		}
+	}()
+
+	src := filepath.Join(dir, "src")
+	if err := os.MkdirAll(filepath.Join(src, "bin"), 0755); err != nil {
+		t.Fatalf("failed to create dir: %s", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(src, "bin", "tool"), []byte("tool"), 0751); err != nil {
+		t.Fatalf("failed to write file: %s", err)
+	}
+	if err := os.Symlink("bin/tool", filepath.Join(src, "tool")); err != nil {
+		t.Fatalf("failed to create symlink: %s", err)
+	}
+	if err := os.Chmod(filepath.Join(src, "bin"), 0700); err != nil {
+		t.Fatalf("failed to chmod: %s", err)
+	}
+
+	dst := filepath.Join(dir, "dst")
+	if err := copyTree(src, dst); err != nil {
+		t.Fatalf("copyTree() error = %v", err)
+	}
+
+	info, err := os.Stat(filepath.Join(dst, "bin", "tool"))
+	if err != nil {
+		t.Fatalf("failed to stat copied file: %s", err)
+	}
+	if info.Mode().Perm() != 0751 {
+		t.Errorf("copied file mode = %s, want %s", info.Mode().Perm(), os.FileMode(0751))
+	}
+
+	link, err := os.Readlink(filepath.Join(dst, "tool"))
+	if err != nil {
+		t.Fatalf("failed to read copied symlink: %s", err)
+	}
+	if link != "bin/tool" {
+		t.Errorf("copied symlink = %s, want %s", link, "bin/tool")
+	}
+
+	info, err = os.Stat(filepath.Join(dst, "bin"))
+	if err != nil {
+		t.Fatalf("failed to stat copied dir: %s", err)
+	}
+	if info.Mode().Perm() != 0700 {
+		t.Errorf("copied dir mode = %s, want %s", info.Mode().Perm(), os.FileMode(0700))
+	}
+}
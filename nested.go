@@ -0,0 +1,219 @@
+package main
+
+import (
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// Nested archive formats, see nestedArchiveFormat.
+const (
+	nestedFormatTar   = "tar"
+	nestedFormatTarGz = "tar.gz"
+	nestedFormatZip   = "zip"
+)
+
+// nestedArchiveFormat returns the format of the cached file by its name, empty if it is not an archive.
+func nestedArchiveFormat(name string) string {
+	lower := strings.ToLower(name)
+	switch {
+	case strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"):
+		return nestedFormatTarGz
+	case strings.HasSuffix(lower, ".tar"):
+		return nestedFormatTar
+	case strings.HasSuffix(lower, ".zip"):
+		return nestedFormatZip
+	}
+	return ""
+}
+
+// parseNestedArchivePatterns parses the expand_nested_archives input: glob patterns, one per line.
+func parseNestedArchivePatterns(s string) ([]string, error) {
+	var patterns []string
+	for _, line := range strings.Split(s, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if _, err := filepath.Match(line, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern (%s): %s", line, err)
+		}
+		patterns = append(patterns, line)
+	}
+	return patterns, nil
+}
+
+// matchesNestedArchivePattern reports whether the nested archive is selected by the patterns:
+// the patterns with a path separator are matched against the whole path, the others against the file name.
+func matchesNestedArchivePattern(pth string, patterns []string) bool {
+	for _, pattern := range patterns {
+		name := filepath.Base(pth)
+		if strings.ContainsRune(pattern, filepath.Separator) {
+			name = pth
+		}
+		if ok, err := filepath.Match(pattern, name); err == nil && ok {
+			return true
+		}
+	}
+	return false
+}
+
+// expandNestedArchive extracts the nested archive into its directory, the archive is kept.
+// The entries outside of the directory are not extracted, the symlinks pointing outside of it
+// and the entries written through a symlink fail the expansion.
+func expandNestedArchive(pth string) error {
+	dir := filepath.Dir(pth)
+	format := nestedArchiveFormat(pth)
+	if format == nestedFormatZip {
+		return expandZip(pth, dir)
+	}
+
+	f, err := os.Open(pth)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := f.Close(); err != nil {
+			log.Warnf("Failed to close %s: %s", pth, err)
+		}
+	}()
+
+	var r io.Reader = f
+	if format == nestedFormatTarGz {
+		gr, err := gzip.NewReader(f)
+		if err != nil {
+			return fmt.Errorf("failed to open gzip stream: %s", err)
+		}
+		defer func() {
+			if err := gr.Close(); err != nil {
+				log.Warnf("Failed to close gzip reader: %s", err)
+			}
+		}()
+		r = gr
+	}
+
+	extractor := NewExtractor(dir, true)
+	extractor.Filter = pathFilter{Only: []string{dir}}
+	extractor.Confined = true
+	if err := extractor.Extract(r); err != nil {
+		return err
+	}
+	if extractor.SkippedEntries > 0 {
+		log.Warnf("%d entries of %s are outside of its directory, not extracted", extractor.SkippedEntries, pth)
+	}
+	return nil
+}
+
+// expandZip extracts the zip archive into dir, skipping the entries outside of it.
+func expandZip(pth, dir string) error {
+	zr, err := zip.OpenReader(pth)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := zr.Close(); err != nil {
+			log.Warnf("Failed to close %s: %s", pth, err)
+		}
+	}()
+
+	for _, file := range zr.File {
+		target := filepath.Join(dir, file.Name)
+		if !isUnderPath(target, []string{dir}) {
+			log.Warnf("Skipping %s of %s, it is outside of the archive's directory", file.Name, pth)
+			continue
+		}
+		if err := checkSymlinkParents(dir, target); err != nil {
+			return err
+		}
+		if err := expandZipFile(file, dir, target); err != nil {
+			return fmt.Errorf("failed to extract %s: %s", file.Name, err)
+		}
+	}
+	return nil
+}
+
+func expandZipFile(file *zip.File, dir, target string) (err error) {
+	info := file.FileInfo()
+	if info.IsDir() {
+		return os.MkdirAll(target, 0755)
+	}
+	if err := prepareTarget(target, nil); err != nil {
+		return err
+	}
+
+	src, err := file.Open()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cErr := src.Close(); cErr != nil && err == nil {
+			err = cErr
+		}
+	}()
+
+	if info.Mode()&os.ModeSymlink != 0 {
+		var link strings.Builder
+		if _, err := io.Copy(&link, src); err != nil {
+			return err
+		}
+		if err := checkConfinedLink(dir, target, link.String()); err != nil {
+			return err
+		}
+		return os.Symlink(link.String(), target)
+	}
+
+	dst, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, info.Mode().Perm()|0600)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cErr := dst.Close(); cErr != nil && err == nil {
+			err = cErr
+		}
+	}()
+
+	if _, err := io.Copy(dst, src); err != nil {
+		return err
+	}
+	if file.Modified.IsZero() {
+		return nil
+	}
+	return os.Chtimes(target, file.Modified, file.Modified)
+}
+
+// checkConfinedLink returns an error if the symlink at target points outside of dir: to an absolute path
+// or leaving dir with `..`.
+func checkConfinedLink(dir, target, link string) error {
+	if filepath.IsAbs(link) {
+		return fmt.Errorf("the symlink %s points to the absolute path %s", target, link)
+	}
+	resolved := filepath.Join(filepath.Dir(target), link)
+	if rel, err := filepath.Rel(dir, resolved); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("the symlink %s points outside of %s: %s", target, dir, link)
+	}
+	return nil
+}
+
+// checkSymlinkParents returns an error if a parent of target (within dir) is a symlink,
+// so nothing is written through a symlink.
+func checkSymlinkParents(dir, target string) error {
+	for pth := filepath.Dir(target); pth != dir && isUnderPath(pth, []string{dir}); pth = filepath.Dir(pth) {
+		info, err := os.Lstat(pth)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("%s is written through the symlink %s", target, pth)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMatchesNestedArchivePattern(t *testing.T) {
+	patterns := []string{"*.tar.gz", "/deps/*.zip"}
+	tests := []struct {
+		pth  string
+		want bool
+	}{
+		{pth: "/root/artifacts/sdk.tar.gz", want: true},
+		{pth: "/deps/lib.zip", want: true},
+		{pth: "/other/lib.zip", want: false},
+		{pth: "/root/artifacts/sdk.tgz", want: false},
+	}
+	for _, tt := range tests {
+		if got := matchesNestedArchivePattern(tt.pth, patterns); got != tt.want {
+			t.Errorf("matchesNestedArchivePattern(%s) = %v, want %v", tt.pth, got, tt.want)
+		}
+	}
+
+	if _, err := parseNestedArchivePatterns("*.zip\n[a-"); err == nil {
+		t.Errorf("parseNestedArchivePatterns() error = nil, want error")
+	}
+}
+
+func TestExpandNestedArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nested-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Logf("failed to remove temp dir: %s", err)
+		}
+	}()
+	artifacts := filepath.Join(dir, "artifacts")
+	if err := os.MkdirAll(artifacts, 0755); err != nil {
+		t.Fatalf("failed to create dir: %s", err)
+	}
+
+	var tgz bytes.Buffer
+	gw := gzip.NewWriter(&tgz)
+	if _, err := gw.Write(createTestArchive(t, []testEntry{
+		{name: "sdk/bin/tool", content: "tool"},
+		{name: "../escaped", content: "escaped"},
+	}).Bytes()); err != nil {
+		t.Fatalf("failed to compress: %s", err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatalf("failed to close gzip writer: %s", err)
+	}
+
+	var zipped bytes.Buffer
+	zw := zip.NewWriter(&zipped)
+	for name, content := range map[string]string{"lib/lib.so": "lib", "../../zip-escaped": "escaped"} {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatalf("failed to create zip entry: %s", err)
+		}
+		if _, err := w.Write([]byte(content)); err != nil {
+			t.Fatalf("failed to write zip entry: %s", err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("failed to close zip writer: %s", err)
+	}
+
+	for name, b := range map[string][]byte{"sdk.tar.gz": tgz.Bytes(), "lib.zip": zipped.Bytes()} {
+		pth := filepath.Join(artifacts, name)
+		if err := ioutil.WriteFile(pth, b, 0644); err != nil {
+			t.Fatalf("failed to write file: %s", err)
+		}
+		if err := expandNestedArchive(pth); err != nil {
+			t.Fatalf("expandNestedArchive(%s) error = %v", name, err)
+		}
+	}
+
+	for pth, want := range map[string]string{"sdk/bin/tool": "tool", "lib/lib.so": "lib"} {
+		if b, err := ioutil.ReadFile(filepath.Join(artifacts, pth)); err != nil || string(b) != want {
+			t.Errorf("%s = %s (%v), want %s", pth, b, err, want)
+		}
+	}
+	for _, pth := range []string{filepath.Join(dir, "escaped"), filepath.Join(filepath.Dir(dir), "zip-escaped")} {
+		if _, err := os.Stat(pth); !os.IsNotExist(err) {
+			t.Errorf("%s exists, want the entry outside of the directory skipped", pth)
+		}
+	}
+}
+
+func TestExpandNestedArchive_symlinks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nested-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Logf("failed to remove temp dir: %s", err)
+		}
+	}()
+	outside := filepath.Join(dir, "outside")
+
+	tgz := func(entries []testEntry) []byte {
+		var b bytes.Buffer
+		gw := gzip.NewWriter(&b)
+		if _, err := gw.Write(createTestArchive(t, entries).Bytes()); err != nil {
+			t.Fatalf("failed to compress: %s", err)
+		}
+		if err := gw.Close(); err != nil {
+			t.Fatalf("failed to close gzip writer: %s", err)
+		}
+		return b.Bytes()
+	}
+	zipped := func(links map[string]string, files map[string]string) []byte {
+		var b bytes.Buffer
+		zw := zip.NewWriter(&b)
+		for name, link := range links {
+			hdr := &zip.FileHeader{Name: name}
+			hdr.SetMode(os.ModeSymlink | 0777)
+			w, err := zw.CreateHeader(hdr)
+			if err != nil {
+				t.Fatalf("failed to create zip entry: %s", err)
+			}
+			if _, err := w.Write([]byte(link)); err != nil {
+				t.Fatalf("failed to write zip entry: %s", err)
+			}
+		}
+		for name, content := range files {
+			w, err := zw.Create(name)
+			if err != nil {
+				t.Fatalf("failed to create zip entry: %s", err)
+			}
+			if _, err := w.Write([]byte(content)); err != nil {
+				t.Fatalf("failed to write zip entry: %s", err)
+			}
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatalf("failed to close zip writer: %s", err)
+		}
+		return b.Bytes()
+	}
+
+	tests := []struct {
+		name     string
+		archive  string
+		content  []byte
+		existing map[string]string
+		wantErr  bool
+	}{
+		{
+			name:    "tar relative symlink outside",
+			archive: "sdk.tar.gz",
+			content: tgz([]testEntry{
+				{name: "link", typeflag: tar.TypeSymlink, linkname: "../outside"},
+				{name: "link/evil", content: "evil"},
+			}),
+			wantErr: true,
+		},
+		{
+			name:    "tar absolute symlink",
+			archive: "sdk.tar.gz",
+			content: tgz([]testEntry{
+				{name: "link", typeflag: tar.TypeSymlink, linkname: outside},
+				{name: "link/evil", content: "evil"},
+			}),
+			wantErr: true,
+		},
+		{
+			name:     "tar through existing symlink",
+			archive:  "sdk.tar.gz",
+			content:  tgz([]testEntry{{name: "existing/evil", content: "evil"}}),
+			existing: map[string]string{"existing": outside},
+			wantErr:  true,
+		},
+		{
+			name:    "tar symlink within the directory",
+			archive: "sdk.tar.gz",
+			content: tgz([]testEntry{
+				{name: "sdk/lib/lib.so", content: "lib"},
+				{name: "sdk/current", typeflag: tar.TypeSymlink, linkname: "lib"},
+			}),
+		},
+		{
+			name:    "zip absolute symlink",
+			archive: "lib.zip",
+			content: zipped(map[string]string{"link": outside}, nil),
+			wantErr: true,
+		},
+		{
+			name:    "zip relative symlink outside",
+			archive: "lib.zip",
+			content: zipped(map[string]string{"lib/link": "../../outside"}, nil),
+			wantErr: true,
+		},
+		{
+			name:     "zip through existing symlink",
+			archive:  "lib.zip",
+			content:  zipped(nil, map[string]string{"existing/evil": "evil"}),
+			existing: map[string]string{"existing": outside},
+			wantErr:  true,
+		},
+		{
+			name:    "zip symlink within the directory",
+			archive: "lib.zip",
+			content: zipped(map[string]string{"lib/current": "../lib"}, map[string]string{"lib/lib.so": "lib"}),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			artifacts := filepath.Join(dir, "artifacts")
+			for _, pth := range []string{artifacts, outside} {
+				if err := os.RemoveAll(pth); err != nil {
+					t.Fatalf("failed to remove %s: %s", pth, err)
+				}
+				if err := os.MkdirAll(pth, 0755); err != nil {
+					t.Fatalf("failed to create dir: %s", err)
+				}
+			}
+			for name, link := range tt.existing {
+				if err := os.Symlink(link, filepath.Join(artifacts, name)); err != nil {
+					t.Fatalf("failed to create symlink: %s", err)
+				}
+			}
+
+			pth := filepath.Join(artifacts, tt.archive)
+			if err := ioutil.WriteFile(pth, tt.content, 0644); err != nil {
+				t.Fatalf("failed to write file: %s", err)
+			}
+			if err := expandNestedArchive(pth); (err != nil) != tt.wantErr {
+				t.Fatalf("expandNestedArchive() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if _, err := os.Stat(filepath.Join(outside, "evil")); !os.IsNotExist(err) {
+				t.Errorf("evil is written outside of the directory")
+			}
+		})
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// Anomaly kinds, sent in the webhook payload's anomaly field.
+const (
+	anomalyCacheMiss        = "cache_miss"
+	anomalyStaleArchive     = "stale_archive"
+	anomalySlowRestore      = "slow_restore"
+	anomalyExtractionFailed = "extraction_failed"
+	anomalyCircuitOpen      = "circuit_open"
+	anomalyCacheGrowth      = "cache_growth"
+	anomalyQuarantined      = "quarantined"
+)
+
+// Notifier posts the cache anomalies to a (Slack compatible) webhook.
+type Notifier struct {
+	URL       string
+	BuildSlug string
+	Branch    string
+
+	client *http.Client
+}
+
+// NewNotifier creates a new Notifier, it is a no-op if the url is empty.
+func NewNotifier(url, buildSlug, branch string) *Notifier {
+	return &Notifier{
+		URL:       url,
+		BuildSlug: buildSlug,
+		Branch:    branch,
+		client:    &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+type webhookPayload struct {
+	Text      string `json:"text"`
+	Anomaly   string `json:"anomaly"`
+	Message   string `json:"message"`
+	BuildSlug string `json:"build_slug,omitempty"`
+	Branch    string `json:"branch,omitempty"`
+}
+
+// Notify posts the anomaly to the webhook, failing to do so is not fatal.
+func (n *Notifier) Notify(anomaly, format string, args ...interface{}) {
+	if n.URL == "" {
+		return
+	}
+
+	msg := redactSecrets(fmt.Sprintf(format, args...))
+	payload := webhookPayload{
+		Text:      fmt.Sprintf("Cache pull anomaly (%s) on branch %s: %s", anomaly, n.Branch, msg),
+		Anomaly:   anomaly,
+		Message:   msg,
+		BuildSlug: n.BuildSlug,
+		Branch:    n.Branch,
+	}
+
+	if err := n.post(payload); err != nil {
+		log.Warnf("Failed to notify webhook about %s: %s", anomaly, err)
+		return
+	}
+	log.Debugf("webhook notified about %s", anomaly)
+}
+
+func (n *Notifier) post(payload webhookPayload) error {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	resp, err := n.client.Post(n.URL, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			log.Warnf("Failed to close response body: %s", err)
+		}
+	}()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("non success response code: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// archiveLastModified returns the modification time of the (first part of the) archive.
+func archiveLastModified(uri string) (time.Time, error) {
+	if strings.HasPrefix(uri, "file://") {
+		info, err := os.Stat(strings.TrimPrefix(uri, "file://"))
+		if err != nil {
+			return time.Time{}, err
+		}
+		return info.ModTime(), nil
+	}
+
+	header, _, err := statArchive(uri)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return http.ParseTime(header.Get("Last-Modified"))
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestNotifier_Notify(t *testing.T) {
+	var payloads []webhookPayload
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("request = %s %s, want a JSON POST", r.Method, r.Header.Get("Content-Type"))
+		}
+		var payload webhookPayload
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			t.Errorf("failed to decode payload: %s", err)
+		}
+		payloads = append(payloads, payload)
+	}))
+	defer server.Close()
+
+	n := NewNotifier(server.URL, "build-slug", "main")
+	n.Notify(anomalyCacheMiss, "no cache for %s", "https://bucket/cache.tar?X-Amz-Signature=secret")
+
+	want := webhookPayload{
+		Text:      "Cache pull anomaly (cache_miss) on branch main: no cache for https://bucket/cache.tar?X-Amz-Signature=" + redacted,
+		Anomaly:   anomalyCacheMiss,
+		Message:   "no cache for https://bucket/cache.tar?X-Amz-Signature=" + redacted,
+		BuildSlug: "build-slug",
+		Branch:    "main",
+	}
+	if len(payloads) != 1 || payloads[0] != want {
+		t.Errorf("payloads = %+v, want %+v", payloads, want)
+	}
+
+	// the notifier without a webhook is a no-op
+	NewNotifier("", "build-slug", "main").Notify(anomalyCacheMiss, "no cache")
+	if len(payloads) != 1 {
+		t.Errorf("payloads = %d, want no request without a webhook URL", len(payloads))
+	}
+}
+
+func TestNotifier_post(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		wantErr bool
+	}{
+		{name: "ok", status: http.StatusOK},
+		{name: "no content", status: http.StatusNoContent},
+		{name: "not found", status: http.StatusNotFound, wantErr: true},
+		{name: "server error", status: http.StatusInternalServerError, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+			}))
+			defer server.Close()
+
+			n := NewNotifier(server.URL, "", "")
+			if err := n.post(webhookPayload{Anomaly: anomalySlowRestore}); (err != nil) != tt.wantErr {
+				t.Errorf("post() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestArchiveLastModified(t *testing.T) {
+	lastModified := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		// presigned URLs are only signed for GET requests
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Last-Modified", lastModified.Format(http.TimeFormat))
+	}))
+	defer server.Close()
+
+	f, err := ioutil.TempFile("", "archive")
+	if err != nil {
+		t.Fatalf("failed to create temp file: %s", err)
+	}
+	defer func() {
+		if err := os.Remove(f.Name()); err != nil {
+			t.Logf("failed to remove temp file: %s", err)
+		}
+	}()
+	if err := f.Close(); err != nil {
+		t.Fatalf("failed to close temp file: %s", err)
+	}
+	if err := os.Chtimes(f.Name(), lastModified, lastModified); err != nil {
+		t.Fatalf("failed to change modification time: %s", err)
+	}
+
+	tests := []struct {
+		name    string
+		uri     string
+		wantErr bool
+	}{
+		{name: "remote archive", uri: server.URL + "/cache.tar"},
+		{name: "local archive", uri: "file://" + f.Name()},
+		{name: "missing remote archive", uri: server.URL + "/missing", wantErr: true},
+		{name: "missing local archive", uri: "file://" + f.Name() + "-missing", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := archiveLastModified(tt.uri)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("archiveLastModified() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !got.Equal(lastModified) {
+				t.Errorf("archiveLastModified() = %s, want %s", got, lastModified)
+			}
+		})
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// offlineArchiveName is the local archive's name (without extension) when not using cache keys.
+const offlineArchiveName = "cache-archive"
+
+// offlineArchiveExtensions are the extensions of the local archives, in order of preference.
+var offlineArchiveExtensions = []string{".tar.zst", ".tar.gz", ".tgz", ".tar", ".tar.gz.000", ".tar" + splitIndexSuffix}
+
+var errOffline = errors.New("network access is disabled in offline mode")
+
+// offlineTransport fails every request, to guarantee that the step does not access the network in offline mode.
+type offlineTransport struct{}
+
+// RoundTrip implements the http.RoundTripper interface.
+func (offlineTransport) RoundTrip(*http.Request) (*http.Response, error) {
+	return nil, errOffline
+}
+
+// disableNetwork makes every http request fail.
+func disableNetwork() {
+	http.DefaultTransport = offlineTransport{}
+	http.DefaultClient.Transport = offlineTransport{}
+}
+
+// findLocalArchive returns the path of the local cache dir's archive matching the first possible key,
+// and the matched key (empty without keys). The archives are named after the keys (or cache-archive without keys),
+// see offlineArchiveExtensions for the accepted extensions. It returns an empty path if no archive matches.
+func findLocalArchive(dir string, keys []string) (string, string, error) {
+	names := keys
+	if len(names) == 0 {
+		names = []string{offlineArchiveName}
+	}
+
+	for _, name := range names {
+		base := filepath.Join(dir, strings.Replace(name, string(filepath.Separator), "-", -1))
+		for _, ext := range offlineArchiveExtensions {
+			pth := base + ext
+			info, err := os.Stat(pth)
+			if os.IsNotExist(err) {
+				continue
+			}
+			if err != nil {
+				return "", "", err
+			}
+			if !info.Mode().IsRegular() {
+				continue
+			}
+			if len(keys) == 0 {
+				return pth, "", nil
+			}
+			return pth, name, nil
+		}
+	}
+	return "", "", nil
+}
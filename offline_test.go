@@ -0,0 +1,63 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFindLocalArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "offline-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Logf("failed to remove temp dir: %s", err)
+		}
+	}()
+
+	for _, name := range []string{"cache-archive.tar.gz", "npm-main.tar.zst", "npm-main.tar", "feature-x-npm.tar"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("archive"), 0644); err != nil {
+			t.Fatalf("failed to write %s: %s", name, err)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		keys     []string
+		wantPath string
+		wantKey  string
+	}{
+		{name: "no keys", wantPath: "cache-archive.tar.gz"},
+		{name: "first key matches", keys: []string{"npm-main", "npm"}, wantPath: "npm-main.tar.zst", wantKey: "npm-main"},
+		{name: "fallback key matches", keys: []string{"npm-feature", "npm-main"}, wantPath: "npm-main.tar.zst", wantKey: "npm-main"},
+		{name: "path separator in key", keys: []string{"feature/x-npm"}, wantPath: "feature-x-npm.tar", wantKey: "feature/x-npm"},
+		{name: "no match", keys: []string{"gradle"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pth, key, err := findLocalArchive(dir, tt.keys)
+			if err != nil {
+				t.Fatalf("findLocalArchive() error = %v", err)
+			}
+
+			wantPath := tt.wantPath
+			if wantPath != "" {
+				wantPath = filepath.Join(dir, wantPath)
+			}
+			if pth != wantPath || key != tt.wantKey {
+				t.Errorf("findLocalArchive() = %s, %s, want %s, %s", pth, key, wantPath, tt.wantKey)
+			}
+		})
+	}
+}
+
+func TestOfflineTransport(t *testing.T) {
+	client := &http.Client{Transport: offlineTransport{}}
+	if _, err := client.Get("http://localhost"); err == nil {
+		t.Errorf("offlineTransport.RoundTrip() error = %v, want %v", err, errOffline)
+	}
+}
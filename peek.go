@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// metadataPeekSize is the number of Bytes downloaded to read the archive's metadata entry:
+// the cache push step writes it as the archive's first entry, within this size (see the README's Archive schema).
+const metadataPeekSize = 64 * 1024
+
+// peekArchiveFingerprint downloads the first Bytes of the archive (a ranged GET) and returns the fingerprint
+// from its metadata entry, without downloading the whole archive.
+func peekArchiveFingerprint(uri string) (string, error) {
+	req, err := http.NewRequest("GET", uri, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to create request: %s", err)
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=0-%d", metadataPeekSize-1))
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			log.Warnf("Failed to close response body: %s", err)
+		}
+	}()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		return "", fmt.Errorf("non success response code: %d", resp.StatusCode)
+	}
+
+	// servers ignoring the Range header send the whole archive, only its beginning is read
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, metadataPeekSize))
+	if err != nil {
+		return "", err
+	}
+	return readArchiveFingerprint(b)
+}
+
+// readArchiveFingerprint returns the fingerprint from the metadata entry (the legacy cache-info.json,
+// or archive_info.json) at the beginning of the archive. It returns an empty fingerprint if the metadata has none.
+func readArchiveFingerprint(b []byte) (string, error) {
+	br := bufio.NewReader(bytes.NewReader(b))
+	var r io.Reader = br
+	if isZstdStream(br) {
+		zr, err := NewZstdReader(br)
+		if err != nil {
+			return "", err
+		}
+		defer func() {
+			if err := zr.Close(); err != nil {
+				log.Warnf("Failed to close zstd reader: %s", err)
+			}
+		}()
+		r = zr
+	}
+
+	tr, hdr, _, err := readFirstEntry(r)
+	if err != nil {
+		return "", fmt.Errorf("failed to get first archive entry: %s", err)
+	}
+	if hdr == nil {
+		return "", nil
+	}
+
+	legacy := isLegacyCacheInfoEntry(hdr.Name)
+	if !legacy && filepath.Base(hdr.Name) != archiveInfoFileName {
+		return "", nil
+	}
+
+	content, err := ioutil.ReadAll(tr)
+	if err != nil {
+		return "", fmt.Errorf("the metadata entry (%s) is not within the first %d Bytes of the archive: %s", hdr.Name, metadataPeekSize, err)
+	}
+
+	if legacy {
+		var cacheInfo CacheInfosModel
+		if err := json.Unmarshal(content, &cacheInfo); err != nil {
+			return "", fmt.Errorf("failed to parse %s: %s", cacheInfoFileName, err)
+		}
+		return cacheInfo.Fingerprint, nil
+	}
+
+	info, err := parseArchiveInfo(content)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse %s: %s", archiveInfoFileName, err)
+	}
+	return info.Fingerprint, nil
+}
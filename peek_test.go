@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestReadArchiveFingerprint(t *testing.T) {
+	gzipped := func(b []byte) []byte {
+		var buff bytes.Buffer
+		gw := gzip.NewWriter(&buff)
+		if _, err := gw.Write(b); err != nil {
+			t.Fatalf("failed to compress: %s", err)
+		}
+		if err := gw.Close(); err != nil {
+			t.Fatalf("failed to close gzip writer: %s", err)
+		}
+		return buff.Bytes()
+	}
+
+	archive := createTestArchive(t, []testEntry{
+		{name: archiveInfoFileName, content: `{"schema_version": 3, "fingerprint": "sha256:abc"}`},
+		{name: "/cache/file", content: strings.Repeat("x", 2*metadataPeekSize)},
+	}).Bytes()
+	legacy := createTestArchive(t, []testEntry{
+		{name: "./" + cacheInfoFileName, content: `{"fingerprint": "legacy-fingerprint", "cache_contents": []}`},
+	}).Bytes()
+	noFingerprint := createTestArchive(t, []testEntry{{name: archiveInfoFileName, content: `{"stack_id": "linux-docker-android"}`}}).Bytes()
+	noMetadata := createTestArchive(t, []testEntry{{name: "/cache/file", content: "content"}}).Bytes()
+	truncated := createTestArchive(t, []testEntry{{name: archiveInfoFileName, content: strings.Repeat(" ", 2*metadataPeekSize)}}).Bytes()[:metadataPeekSize]
+
+	tests := []struct {
+		name    string
+		b       []byte
+		want    string
+		wantErr bool
+	}{
+		{name: "archive info", b: archive[:metadataPeekSize], want: "sha256:abc"},
+		{name: "gzip legacy", b: gzipped(legacy), want: "legacy-fingerprint"},
+		{name: "no fingerprint", b: noFingerprint},
+		{name: "no metadata entry", b: noMetadata},
+		{name: "metadata beyond the peek size", b: truncated, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := readArchiveFingerprint(tt.b)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("readArchiveFingerprint() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("readArchiveFingerprint() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPeekArchiveFingerprint(t *testing.T) {
+	archive := createTestArchive(t, []testEntry{
+		{name: archiveInfoFileName, content: `{"schema_version": 3, "fingerprint": "sha256:def"}`},
+		{name: "/cache/file", content: strings.Repeat("x", 2*metadataPeekSize)},
+	}).Bytes()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := archive
+		if r.URL.Path == "/ranged" {
+			if r.Header.Get("Range") != "bytes=0-65535" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			body = archive[:metadataPeekSize]
+			w.WriteHeader(http.StatusPartialContent)
+		}
+		if _, err := w.Write(body); err != nil {
+			t.Errorf("failed to write response: %s", err)
+		}
+	}))
+	defer server.Close()
+
+	for _, path := range []string{"/ranged", "/no-range-support"} {
+		got, err := peekArchiveFingerprint(server.URL + path)
+		if err != nil {
+			t.Fatalf("peekArchiveFingerprint(%s) error = %v", path, err)
+		}
+		if got != "sha256:def" {
+			t.Errorf("peekArchiveFingerprint(%s) = %s, want sha256:def", path, got)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"os"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+const (
+	permissionErrorsWarn = "warn"
+	permissionErrorsFail = "fail"
+)
+
+// tarNoSameOwner makes the tar tool of the fallback extraction create the files owned by the current user,
+// instead of the archive's owners (tar restores the owners as root, which fails under rootless Docker and Podman).
+var tarNoSameOwner bool
+
+// permissionError applies the permission_errors policy to the error of restoring an entry's mode or modification time:
+// with the warn policy the EPERM and EACCES errors are counted in IgnoredPermissionErrors and logged only once,
+// the entry is left with the current user's permissions.
+func (e *Extractor) permissionError(name string, err error) error {
+	if e.PermissionErrors == permissionErrorsFail || !os.IsPermission(err) {
+		return err
+	}
+
+	if e.IgnoredPermissionErrors == 0 {
+		log.Warnf("Failed to restore the attributes of %s, running in a rootless container? The entries are left with the current user's permissions, further errors are not logged: %s", name, err)
+	}
+	e.IgnoredPermissionErrors++
+	return nil
+}
+
+// tarArgs returns the tar tool's arguments extracting the archive at pth, "-" for the standard input.
+func tarArgs(pth string, relative, compressed bool) []string {
+	args := []string{processArgs(relative, compressed), pth}
+	if tarNoSameOwner {
+		args = append([]string{"--no-same-owner"}, args...)
+	}
+	return args
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"syscall"
+	"testing"
+)
+
+func TestExtractor_permissionError(t *testing.T) {
+	eperm := &os.PathError{Op: "chmod", Path: "dir", Err: syscall.EPERM}
+	enoent := &os.PathError{Op: "chmod", Path: "dir", Err: syscall.ENOENT}
+
+	tests := []struct {
+		name        string
+		policy      string
+		errs        []error
+		wantErr     bool
+		wantIgnored int
+	}{
+		{
+			name:        "warn ignores the permission errors",
+			policy:      permissionErrorsWarn,
+			errs:        []error{eperm, eperm},
+			wantIgnored: 2,
+		},
+		{
+			name:    "warn keeps the other errors",
+			policy:  permissionErrorsWarn,
+			errs:    []error{enoent},
+			wantErr: true,
+		},
+		{
+			name:    "fail",
+			policy:  permissionErrorsFail,
+			errs:    []error{eperm},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := NewExtractor("", true)
+			e.PermissionErrors = tt.policy
+
+			var err error
+			for _, pErr := range tt.errs {
+				if err = e.permissionError("dir", pErr); err != nil {
+					break
+				}
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("permissionError() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if e.IgnoredPermissionErrors != tt.wantIgnored {
+				t.Errorf("IgnoredPermissionErrors = %d, want %d", e.IgnoredPermissionErrors, tt.wantIgnored)
+			}
+		})
+	}
+}
+
+func Test_tarArgs(t *testing.T) {
+	defer func(v bool) { tarNoSameOwner = v }(tarNoSameOwner)
+
+	tests := []struct {
+		name        string
+		noSameOwner bool
+		want        []string
+	}{
+		{name: "archive owners", want: []string{"-xzf", "-"}},
+		{name: "current user", noSameOwner: true, want: []string{"--no-same-owner", "-xzf", "-"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tarNoSameOwner = tt.noSameOwner
+			if got := tarArgs("-", true, true); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("tarArgs() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
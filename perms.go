@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/bitrise-io/go-utils/command"
+)
+
+// parseUmask parses the octal umask of the restore_umask input, nil if s is empty.
+func parseUmask(s string) (*os.FileMode, error) {
+	if s == "" {
+		return nil, nil
+	}
+	v, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || v > 0777 {
+		return nil, fmt.Errorf("%s is not an octal umask (e.g. 002)", s)
+	}
+	umask := os.FileMode(v)
+	return &umask, nil
+}
+
+// restoredRoots returns the topmost restored paths of the archive's entries: the entries without a parent entry,
+// named with the Extractor's settings and selected by its Filter.
+func restoredRoots(names []string, e *Extractor) []string {
+	targets := map[string]bool{}
+	for _, name := range names {
+		targets[e.targetPath(name)] = true
+	}
+
+	var roots []string
+	for target := range targets {
+		if !targets[filepath.Dir(target)] && !e.Filter.excludes(target) {
+			roots = append(roots, target)
+		}
+	}
+	sort.Strings(roots)
+	return roots
+}
+
+// pathBatchSize is the number of paths passed to a setfacl or restorecon run.
+const pathBatchSize = 256
+
+// runBatched runs the command with the paths appended to the args, pathBatchSize paths at a time.
+func runBatched(name string, args []string, paths []string) (string, error) {
+	var outs []string
+	for start := 0; start < len(paths); start += pathBatchSize {
+		end := start + pathBatchSize
+		if end > len(paths) {
+			end = len(paths)
+		}
+
+		cmd := command.New(name, append(append([]string{}, args...), paths[start:end]...)...)
+		out, err := cmd.RunAndReturnTrimmedCombinedOutput()
+		if out != "" {
+			outs = append(outs, out)
+		}
+		if err != nil {
+			return strings.Join(outs, "\n"), err
+		}
+	}
+	return strings.Join(outs, "\n"), nil
+}
+
+// applyACL adds the ACL entries (in setfacl's format, e.g. u:builder:rwX) to the paths and their content, recursively.
+func applyACL(spec string, paths []string) error {
+	if out, err := runBatched("setfacl", []string{"-R", "-m", spec, "--"}, paths); err != nil {
+		return fmt.Errorf("setfacl failed: %s", out)
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestParseUmask(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    os.FileMode
+		wantNil bool
+		wantErr bool
+	}{
+		{s: "", wantNil: true},
+		{s: "002", want: 02},
+		{s: "0027", want: 027},
+		{s: "777", want: 0777},
+		{s: "1777", wantErr: true},
+		{s: "u=rwx", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseUmask(tt.s)
+		if (err != nil) != tt.wantErr {
+			t.Fatalf("parseUmask(%s) error = %v, wantErr %v", tt.s, err, tt.wantErr)
+		}
+		if tt.wantErr {
+			continue
+		}
+		if (got == nil) != tt.wantNil || (got != nil && *got != tt.want) {
+			t.Errorf("parseUmask(%s) = %v, want %o", tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestRestoredRoots(t *testing.T) {
+	e := NewExtractor("/workdir", false)
+	e.Filter = pathFilter{Skip: []string{"/root/.npm"}}
+	names := []string{
+		"/root/.gradle/", "/root/.gradle/caches/", "/root/.gradle/caches/file",
+		"/root/.npm/", "/root/.npm/file",
+		"node_modules/", "node_modules/a",
+		"/root/.ccache/0/object.o",
+	}
+
+	got := restoredRoots(names, e)
+	want := []string{"/root/.ccache/0/object.o", "/root/.gradle", "/workdir/node_modules"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("restoredRoots() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// pinnedEnvKey is the env var exporting whether the pinned cache was restored, see the pinned_cache_key input.
+const pinnedEnvKey = "BITRISE_CACHE_PULL_PINNED"
+
+// isArchiveURL reports whether the pinned cache is an archive URL, instead of a cache key.
+func isArchiveURL(s string) bool {
+	for _, prefix := range []string{"http://", "https://", "file://"} {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolvePinnedCache returns the archive URL and the cache key of the pinned cache: the archive URL as it is,
+// or the download URL of the key-based cache entry matching exactly the key (not a newer entry of its prefix).
+func resolvePinnedCache(pinned, abcsAPIURL, token string) (string, string, error) {
+	if isArchiveURL(pinned) {
+		return pinned, "", nil
+	}
+
+	info, err := getKeyBasedDownloadInfo(abcsAPIURL, token, []string{pinned})
+	if err != nil {
+		return "", "", err
+	}
+	if info.MatchedKey != pinned {
+		log.Printf("Only a different cache entry (%s) matches the pinned key", info.MatchedKey)
+		return "", "", errCacheNotFound
+	}
+	return info.URL, info.MatchedKey, nil
+}
+
+// exportPinned exports whether the pinned cache was restored.
+func exportPinned(pinned bool) {
+	if err := exportEnv(pinnedEnvKey, strconv.FormatBool(pinned)); err != nil {
+		result.Warnf("%s", err)
+	}
+}
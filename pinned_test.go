@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestResolvePinnedCache(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body string
+		switch r.URL.Query().Get("cache_keys") {
+		case "release-1.2":
+			body = `{"url": "https://cache.example.com/release-1.2.tar.zst", "matched_cache_key": "release-1.2"}`
+		case "release":
+			// a prefix match of a newer entry
+			body = `{"url": "https://cache.example.com/release-1.3.tar.zst", "matched_cache_key": "release-1.3"}`
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if _, err := w.Write([]byte(body)); err != nil {
+			t.Errorf("failed to write response: %s", err)
+		}
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		pinned  string
+		wantURL string
+		wantKey string
+		wantErr error
+	}{
+		{pinned: "release-1.2", wantURL: "https://cache.example.com/release-1.2.tar.zst", wantKey: "release-1.2"},
+		{pinned: "release", wantErr: errCacheNotFound},
+		{pinned: "missing", wantErr: errCacheNotFound},
+		{pinned: "https://storage.example.com/snapshot.tar.gz", wantURL: "https://storage.example.com/snapshot.tar.gz"},
+		{pinned: "file:///cache/snapshot.tar", wantURL: "file:///cache/snapshot.tar"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pinned, func(t *testing.T) {
+			gotURL, gotKey, err := resolvePinnedCache(tt.pinned, server.URL, "token")
+			if err != tt.wantErr {
+				t.Fatalf("resolvePinnedCache() error = %v, want %v", err, tt.wantErr)
+			}
+			if gotURL != tt.wantURL || gotKey != tt.wantKey {
+				t.Errorf("resolvePinnedCache() = %s, %s, want %s, %s", gotURL, gotKey, tt.wantURL, tt.wantKey)
+			}
+		})
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/url"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// pipelineIDParam is the cache API's query parameter selecting the intermediate cache of the pipeline run,
+// pushed by an upstream stage.
+const pipelineIDParam = "pipeline_id"
+
+// pipelineCacheAPIURL adds the pipeline run's ID to the cache API URL.
+func pipelineCacheAPIURL(cacheAPIURL, pipelineID string) (string, error) {
+	u, err := url.Parse(cacheAPIURL)
+	if err != nil {
+		return "", err
+	}
+	query := u.Query()
+	query.Set(pipelineIDParam, pipelineID)
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+// getPipelineCacheDownloadInfo gets the intermediate cache download URL of the pipeline run (if pipelineID is set),
+// falling back to the branch cache. The returned bool reports whether the intermediate cache was found.
+func getPipelineCacheDownloadInfo(cacheAPIURL, pipelineID, projectPath string) (cacheDownloadInfo, bool, error) {
+	if pipelineID == "" {
+		info, err := getScopedCacheDownloadInfo(cacheAPIURL, projectPath)
+		return info, false, err
+	}
+
+	pipelineURL, err := pipelineCacheAPIURL(cacheAPIURL, pipelineID)
+	if err != nil {
+		return cacheDownloadInfo{}, false, err
+	}
+	info, err := getScopedCacheDownloadInfo(pipelineURL, projectPath)
+	if err != errCacheNotFound {
+		return info, err == nil, err
+	}
+
+	log.Printf("No intermediate cache found in the pipeline (%s), using the branch cache", pipelineID)
+	info, err = getScopedCacheDownloadInfo(cacheAPIURL, projectPath)
+	return info, false, err
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGetPipelineCacheDownloadInfo(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		archive := "branch"
+		switch r.URL.Query().Get(pipelineIDParam) {
+		case "":
+		case "pipeline-1":
+			archive = "intermediate"
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.URL.Query().Get("build_slug") != "slug" {
+			t.Errorf("build_slug = %s, want slug", r.URL.Query().Get("build_slug"))
+		}
+		if _, err := w.Write([]byte(`{"download_url":"https://cache.example.com/` + archive + `.tar.gz"}`)); err != nil {
+			t.Errorf("failed to write response: %s", err)
+		}
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		pipelineID       string
+		want             string
+		wantIntermediate bool
+	}{
+		{pipelineID: "", want: "https://cache.example.com/branch.tar.gz"},
+		{pipelineID: "pipeline-1", want: "https://cache.example.com/intermediate.tar.gz", wantIntermediate: true},
+		{pipelineID: "pipeline-2", want: "https://cache.example.com/branch.tar.gz"},
+	}
+	for _, tt := range tests {
+		info, intermediate, err := getPipelineCacheDownloadInfo(server.URL+"/?build_slug=slug", tt.pipelineID, "")
+		if err != nil {
+			t.Fatalf("getPipelineCacheDownloadInfo(%s) error = %v", tt.pipelineID, err)
+		}
+		if info.DownloadURL != tt.want || intermediate != tt.wantIntermediate {
+			t.Errorf("getPipelineCacheDownloadInfo(%s) = %s, %v, want %s, %v", tt.pipelineID, info.DownloadURL, intermediate, tt.want, tt.wantIntermediate)
+		}
+	}
+}
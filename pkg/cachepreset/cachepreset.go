@@ -0,0 +1,566 @@
+// Package cachepreset maps the common ecosystems' caches (e.g. gradle, npm, cargo) to their cache paths
+// and lockfile fingerprints, so the cache pull and push steps (and other tools) cache the same paths
+// without the users listing the tools' internal directories.
+//
+// A preset has two kinds of paths:
+//
+//   - the global caches (e.g. ~/.npm), content addressed by the tools, always usable,
+//   - the project paths (e.g. node_modules), only valid for the lockfiles they were installed by.
+//
+// Some presets also have toolchain paths (e.g. GOCACHE, virtualenvs), only valid for the toolchain that built them.
+//
+// The project paths record the lockfiles' fingerprint in MarkerName, the toolchain paths the toolchain
+// in ToolchainMarkerName after the restore, so the next restore can tell whether they still match.
+package cachepreset
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// MarkerName is the file in the project paths recording the lockfiles' fingerprint they were installed by.
+const MarkerName = ".bitrise-cache-lockfile"
+
+// ToolchainMarkerName is the file in the toolchain paths recording the toolchain they were built by.
+const ToolchainMarkerName = ".bitrise-cache-toolchain"
+
+// Env is the environment the presets are expanded in.
+type Env struct {
+	// Home is the user's home directory.
+	Home string
+	// ProjectDir is the project's directory, the lockfiles and project paths are relative to it.
+	ProjectDir string
+	// GOOS selects the platform's cache directories (darwin or linux).
+	GOOS string
+	// Getenv returns the environment variables overriding the tools' default directories.
+	Getenv func(string) string
+}
+
+// NewEnv returns the environment of the current process, with the project in dir.
+func NewEnv(dir string) (Env, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return Env{}, err
+	}
+	return Env{Home: home, ProjectDir: dir, GOOS: runtime.GOOS, Getenv: os.Getenv}, nil
+}
+
+// dir returns the environment variable's value, def if it is not set.
+func (e Env) dir(key, def string) string {
+	if v := e.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+// userCache returns the platform's user cache directory of the tool: ~/Library/Caches/<mac> on macOS,
+// $XDG_CACHE_HOME/<linux> (~/.cache/<linux>) otherwise.
+func (e Env) userCache(mac, linux string) string {
+	if e.GOOS == "darwin" {
+		return filepath.Join(e.Home, "Library", "Caches", mac)
+	}
+	return filepath.Join(e.dir("XDG_CACHE_HOME", filepath.Join(e.Home, ".cache")), linux)
+}
+
+// Preset is an ecosystem's caches.
+type Preset struct {
+	Name string
+	// Lockfiles are the files pinning the dependencies, relative to the project. The missing ones are ignored.
+	Lockfiles []string
+	// ProjectPaths are the project's installed dependencies, relative to the project, valid for the Lockfiles.
+	ProjectPaths []string
+	// paths returns the global caches, nil if there are none.
+	paths func(e Env) []string
+	// toolchainPaths returns the caches valid for the toolchain only, identified by toolchain.
+	toolchainPaths func(e Env) []string
+	toolchain      func(e Env) (string, error)
+	// builtBy returns the toolchain a toolchain path without a ToolchainMarkerName is built by, empty if it is unknown.
+	builtBy func(pth string) (string, error)
+}
+
+var presets = []Preset{
+	{
+		Name:      "gradle",
+		Lockfiles: []string{"gradle/wrapper/gradle-wrapper.properties", "gradle/libs.versions.toml", "gradle.lockfile", "settings.gradle", "settings.gradle.kts", "build.gradle", "build.gradle.kts"},
+		paths: func(e Env) []string {
+			home := e.dir("GRADLE_USER_HOME", filepath.Join(e.Home, ".gradle"))
+			return []string{
+				filepath.Join(home, "caches", "modules-2"),
+				filepath.Join(home, "caches", "jars-9"),
+				filepath.Join(home, "caches", "build-cache-1"),
+				filepath.Join(home, "wrapper", "dists"),
+			}
+		},
+	},
+	{
+		Name:         "cocoapods",
+		Lockfiles:    []string{"Podfile.lock"},
+		ProjectPaths: []string{"Pods"},
+		paths: func(e Env) []string {
+			return []string{e.dir("CP_CACHE_DIR", filepath.Join(e.Home, "Library", "Caches", "CocoaPods"))}
+		},
+	},
+	{
+		Name:         "npm",
+		Lockfiles:    []string{"package-lock.json", "npm-shrinkwrap.json"},
+		ProjectPaths: []string{"node_modules"},
+		paths: func(e Env) []string {
+			return []string{e.dir("npm_config_cache", filepath.Join(e.Home, ".npm"))}
+		},
+	},
+	{
+		Name:         "yarn",
+		Lockfiles:    []string{"yarn.lock"},
+		ProjectPaths: []string{"node_modules", ".yarn/cache"},
+		paths: func(e Env) []string {
+			return []string{e.dir("YARN_CACHE_FOLDER", e.userCache("Yarn", "yarn"))}
+		},
+	},
+	{
+		Name:         "pnpm",
+		Lockfiles:    []string{"pnpm-lock.yaml"},
+		ProjectPaths: []string{"node_modules"},
+		paths: func(e Env) []string {
+			if e.GOOS == "darwin" {
+				return []string{filepath.Join(e.Home, "Library", "pnpm", "store")}
+			}
+			return []string{filepath.Join(e.dir("XDG_DATA_HOME", filepath.Join(e.Home, ".local", "share")), "pnpm", "store")}
+		},
+	},
+	{
+		Name:      "pip",
+		Lockfiles: pythonLockfiles,
+		paths: func(e Env) []string {
+			poetry := poetryCacheDir(e)
+			return []string{
+				e.dir("PIP_CACHE_DIR", e.userCache("pip", "pip")),
+				filepath.Join(poetry, "cache"),
+				filepath.Join(poetry, "artifacts"),
+			}
+		},
+	},
+	{
+		// the virtualenvs link the interpreter they were created by, they are broken for another one
+		Name:      "virtualenv",
+		Lockfiles: pythonLockfiles,
+		toolchainPaths: func(e Env) []string {
+			return []string{
+				filepath.Join(e.ProjectDir, ".venv"),
+				e.dir("POETRY_VIRTUALENVS_PATH", filepath.Join(poetryCacheDir(e), "virtualenvs")),
+			}
+		},
+		toolchain: pythonToolchain,
+		builtBy:   virtualenvPythonVersion,
+	},
+	{
+		// the target directory stays usable as the lockfile changes, but not for another toolchain,
+		// the cache pull step checks it (cargo_target_dir)
+		Name:      "cargo",
+		Lockfiles: []string{"Cargo.lock"},
+		paths: func(e Env) []string {
+			home := e.dir("CARGO_HOME", filepath.Join(e.Home, ".cargo"))
+			// the extracted registry sources (registry/src) and git checkouts are recreated from these
+			return []string{
+				filepath.Join(home, "registry", "index"),
+				filepath.Join(home, "registry", "cache"),
+				filepath.Join(home, "git", "db"),
+			}
+		},
+	},
+	{
+		Name:      "go-mod",
+		Lockfiles: []string{"go.sum"},
+		paths: func(e Env) []string {
+			gopath := e.dir("GOPATH", filepath.Join(e.Home, "go"))
+			return []string{e.dir("GOMODCACHE", filepath.Join(strings.Split(gopath, string(filepath.ListSeparator))[0], "pkg", "mod"))}
+		},
+		// the build cache's entries are keyed by the toolchain, another toolchain's are never used
+		toolchainPaths: func(e Env) []string {
+			return []string{e.dir("GOCACHE", e.userCache("go-build", "go-build"))}
+		},
+		toolchain: goToolchain,
+	},
+	{
+		Name:         "composer",
+		Lockfiles:    []string{"composer.lock"},
+		ProjectPaths: []string{"vendor"},
+		paths: func(e Env) []string {
+			return []string{e.dir("COMPOSER_CACHE_DIR", e.userCache("composer", "composer"))}
+		},
+	},
+	{
+		Name:         "flutter",
+		Lockfiles:    []string{"pubspec.lock"},
+		ProjectPaths: []string{".dart_tool"},
+		paths: func(e Env) []string {
+			paths := []string{e.dir("PUB_CACHE", filepath.Join(e.Home, ".pub-cache"))}
+			if sdk := e.Getenv("FLUTTER_ROOT"); sdk != "" {
+				// the engine artifacts
+				paths = append(paths, filepath.Join(sdk, "bin", "cache"))
+			}
+			return paths
+		},
+	},
+	{
+		Name:      "homebrew",
+		Lockfiles: homebrewLockfiles,
+		paths: func(e Env) []string {
+			return []string{e.dir("HOMEBREW_CACHE", e.userCache("Homebrew", "Homebrew"))}
+		},
+	},
+	{
+		// the kegs are poured for the platform and prefix, the safe subset is the Brewfile's formulae,
+		// linked by brew bundle
+		Name:           "homebrew-cellar",
+		Lockfiles:      homebrewLockfiles,
+		toolchainPaths: homebrewKegs,
+		toolchain:      homebrewToolchain,
+	},
+}
+
+// homebrewLockfiles are the lockfiles of brew bundle.
+var homebrewLockfiles = []string{"Brewfile", "Brewfile.lock.json"}
+
+// homebrewPrefix returns Homebrew's prefix: HOMEBREW_PREFIX, or the platform's default.
+func homebrewPrefix(e Env) string {
+	if prefix := e.Getenv("HOMEBREW_PREFIX"); prefix != "" {
+		return prefix
+	}
+	if e.GOOS != "darwin" {
+		return "/home/linuxbrew/.linuxbrew"
+	}
+	if runtime.GOARCH == "arm64" {
+		return "/opt/homebrew"
+	}
+	return "/usr/local"
+}
+
+// brewfileFormulae returns the formulae of the Brewfile (brew "name"), without their tap.
+func brewfileFormulae(content string) []string {
+	var formulae []string
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "brew ") {
+			continue
+		}
+		rest := strings.TrimSpace(strings.TrimPrefix(line, "brew "))
+		if len(rest) < 2 || (rest[0] != '"' && rest[0] != '\'') {
+			continue
+		}
+		end := strings.IndexByte(rest[1:], rest[0])
+		if end < 1 {
+			continue
+		}
+		name := rest[1 : end+1]
+		formulae = append(formulae, name[strings.LastIndex(name, "/")+1:])
+	}
+	return formulae
+}
+
+// homebrewKegs returns the Cellar kegs of the project's Brewfile formulae.
+func homebrewKegs(e Env) []string {
+	content, err := ioutil.ReadFile(filepath.Join(e.ProjectDir, "Brewfile"))
+	if err != nil {
+		return nil
+	}
+	cellar := filepath.Join(homebrewPrefix(e), "Cellar")
+	var kegs []string
+	for _, formula := range brewfileFormulae(string(content)) {
+		kegs = append(kegs, filepath.Join(cellar, formula))
+	}
+	return kegs
+}
+
+// homebrewToolchain returns the platform the bottles are poured for: the macOS major version (or Linux),
+// the architecture and Homebrew's prefix, e.g. macOS 14 arm64 /opt/homebrew.
+func homebrewToolchain(e Env) (string, error) {
+	platform := "Linux"
+	if e.GOOS == "darwin" {
+		out, err := exec.Command("sw_vers", "-productVersion").CombinedOutput()
+		if err != nil {
+			return "", fmt.Errorf("sw_vers failed: %s", strings.TrimSpace(string(out)))
+		}
+		platform = "macOS " + strings.Split(strings.TrimSpace(string(out)), ".")[0]
+	}
+	return fmt.Sprintf("%s %s %s", platform, runtime.GOARCH, homebrewPrefix(e)), nil
+}
+
+// pythonLockfiles are the lockfiles of pip, pipenv and poetry.
+var pythonLockfiles = []string{"requirements.txt", "Pipfile.lock", "poetry.lock"}
+
+// poetryCacheDir returns poetry's cache directory, holding its caches and virtualenvs.
+func poetryCacheDir(e Env) string {
+	return e.dir("POETRY_CACHE_DIR", e.userCache("pypoetry", "pypoetry"))
+}
+
+// pythonToolchain returns the project's Python interpreter version (e.g. Python 3.11.4), empty if Python is not installed.
+// The pyenv version of the project is respected, as the interpreter runs in the project.
+func pythonToolchain(e Env) (string, error) {
+	if _, err := exec.LookPath("python3"); err != nil {
+		return "", nil
+	}
+	cmd := exec.Command("python3", "-c", "import platform; print(platform.python_version())")
+	cmd.Dir = e.ProjectDir
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("python3 failed: %s", strings.TrimSpace(string(out)))
+	}
+	return "Python " + strings.TrimSpace(string(out)), nil
+}
+
+// virtualenvPythonVersion returns the interpreter version a virtualenv was created by, from its pyvenv.cfg
+// (version of venv, version_info of virtualenv), empty if it is not a virtualenv.
+func virtualenvPythonVersion(pth string) (string, error) {
+	content, err := ioutil.ReadFile(filepath.Join(pth, "pyvenv.cfg"))
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		if key := strings.TrimSpace(parts[0]); key != "version" && key != "version_info" {
+			continue
+		}
+		// version_info is e.g. 3.11.4.final.0
+		version := strings.Split(strings.TrimSpace(parts[1]), ".")
+		if len(version) > 3 {
+			version = version[:3]
+		}
+		return "Python " + strings.Join(version, "."), nil
+	}
+	return "", nil
+}
+
+// goToolchain returns the project's Go toolchain: its version and target platform (e.g. go1.21.5 darwin/arm64),
+// empty if Go is not installed. The go.mod's toolchain directive is respected, as the go command runs in the project.
+func goToolchain(e Env) (string, error) {
+	if _, err := exec.LookPath("go"); err != nil {
+		return "", nil
+	}
+	cmd := exec.Command("go", "env", "GOVERSION", "GOOS", "GOARCH")
+	cmd.Dir = e.ProjectDir
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("go env failed: %s", strings.TrimSpace(string(out)))
+	}
+	fields := strings.Fields(string(out))
+	if len(fields) != 3 {
+		return "", fmt.Errorf("unexpected go env output: %s", strings.TrimSpace(string(out)))
+	}
+	return fmt.Sprintf("%s %s/%s", fields[0], fields[1], fields[2]), nil
+}
+
+// Names returns the presets' names.
+func Names() []string {
+	var names []string
+	for _, p := range presets {
+		names = append(names, p.Name)
+	}
+	return names
+}
+
+// Lookup returns the named preset.
+func Lookup(name string) (Preset, bool) {
+	for _, p := range presets {
+		if p.Name == name {
+			return p, true
+		}
+	}
+	return Preset{}, false
+}
+
+// Detect returns the presets of the project's ecosystems, the ones with a lockfile in the project directory.
+func Detect(e Env) []Preset {
+	var detected []Preset
+	for _, p := range presets {
+		for _, name := range p.Lockfiles {
+			if _, err := os.Stat(filepath.Join(e.ProjectDir, filepath.FromSlash(name))); err == nil {
+				detected = append(detected, p)
+				break
+			}
+		}
+	}
+	return detected
+}
+
+// Parse returns the presets of a comma or newline separated list of names.
+func Parse(s string) ([]Preset, error) {
+	var parsed []Preset
+	seen := map[string]bool{}
+	for _, name := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == '\n' }) {
+		name = strings.TrimSpace(name)
+		if name == "" || seen[name] {
+			continue
+		}
+		p, ok := Lookup(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown cache preset (%s), available: %s", name, strings.Join(Names(), ", "))
+		}
+		seen[name] = true
+		parsed = append(parsed, p)
+	}
+	return parsed, nil
+}
+
+// Expansion is a preset expanded in an Env.
+type Expansion struct {
+	Preset string
+	// Paths are the global caches.
+	Paths []string
+	// ProjectPaths are the project's installed dependencies, valid for the Fingerprint.
+	ProjectPaths []string
+	// Fingerprint is the fingerprint of the project's lockfiles, empty if the project has none.
+	Fingerprint string
+	// ToolchainPaths are the caches valid for the Toolchain only.
+	ToolchainPaths []string
+	// Toolchain identifies the current toolchain, empty if it is unknown.
+	Toolchain string
+
+	builtBy func(pth string) (string, error)
+}
+
+// Expand expands the preset's paths and fingerprints the project's lockfiles.
+func (p Preset) Expand(e Env) (Expansion, error) {
+	expansion := Expansion{Preset: p.Name}
+	if p.paths != nil {
+		expansion.Paths = p.paths(e)
+	}
+	for _, pth := range p.ProjectPaths {
+		expansion.ProjectPaths = append(expansion.ProjectPaths, filepath.Join(e.ProjectDir, filepath.FromSlash(pth)))
+	}
+
+	fingerprint, err := fingerprint(e.ProjectDir, p.Lockfiles)
+	if err != nil {
+		return Expansion{}, err
+	}
+	expansion.Fingerprint = fingerprint
+
+	if p.toolchainPaths != nil {
+		expansion.ToolchainPaths = p.toolchainPaths(e)
+		expansion.builtBy = p.builtBy
+		if expansion.Toolchain, err = p.toolchain(e); err != nil {
+			return Expansion{}, err
+		}
+	}
+	return expansion, nil
+}
+
+// AllPaths returns the global caches, the project paths and the toolchain paths.
+func (x Expansion) AllPaths() []string {
+	return append(append(append([]string{}, x.Paths...), x.ProjectPaths...), x.ToolchainPaths...)
+}
+
+// fingerprint returns the fingerprint of the lockfiles in dir (their names and contents), empty if none exists.
+func fingerprint(dir string, lockfiles []string) (string, error) {
+	names := append([]string{}, lockfiles...)
+	sort.Strings(names)
+
+	h := sha256.New()
+	found := false
+	for _, name := range names {
+		content, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		found = true
+		fmt.Fprintf(h, "%s\x00%d\x00", name, len(content))
+		h.Write(content)
+	}
+	if !found {
+		return "", nil
+	}
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// StaleProjectPaths returns the existing project paths recording another fingerprint than the current one,
+// installed by other lockfiles. The paths without a record are not stale (their lockfiles are unknown).
+func (x Expansion) StaleProjectPaths() ([]string, error) {
+	return staleMarked(x.ProjectPaths, MarkerName, x.Fingerprint, nil)
+}
+
+// RecordFingerprint records the current fingerprint in the existing project paths.
+func (x Expansion) RecordFingerprint() error {
+	return writeMarker(x.ProjectPaths, MarkerName, x.Fingerprint)
+}
+
+// StaleToolchainPaths returns the existing toolchain paths recording another toolchain than the current one.
+// The paths without a record are checked by the preset (e.g. a virtualenv's pyvenv.cfg), otherwise not stale.
+func (x Expansion) StaleToolchainPaths() ([]string, error) {
+	return staleMarked(x.ToolchainPaths, ToolchainMarkerName, x.Toolchain, x.builtBy)
+}
+
+// RecordToolchain records the current toolchain in the existing toolchain paths.
+func (x Expansion) RecordToolchain() error {
+	return writeMarker(x.ToolchainPaths, ToolchainMarkerName, x.Toolchain)
+}
+
+// staleMarked returns the paths whose marker file (or the fallback, without a marker file) records another value
+// than want, nothing if want is empty.
+func staleMarked(paths []string, marker, want string, fallback func(pth string) (string, error)) ([]string, error) {
+	if want == "" {
+		return nil, nil
+	}
+	var stale []string
+	for _, pth := range paths {
+		var got string
+		content, err := ioutil.ReadFile(filepath.Join(pth, marker))
+		switch {
+		case err == nil:
+			got = strings.TrimSpace(string(content))
+		case os.IsNotExist(err) && fallback != nil:
+			if got, err = fallback(pth); err != nil {
+				return nil, err
+			}
+		case !os.IsNotExist(err):
+			return nil, err
+		}
+		if got != "" && got != want {
+			stale = append(stale, pth)
+		}
+	}
+	return stale, nil
+}
+
+// writeMarker records the value in the marker file of the existing directories, nothing if the value is empty.
+func writeMarker(paths []string, marker, value string) error {
+	if value == "" {
+		return nil
+	}
+	for _, pth := range paths {
+		if info, err := os.Stat(pth); err != nil || !info.IsDir() {
+			continue
+		}
+		if err := ioutil.WriteFile(filepath.Join(pth, marker), []byte(value+"\n"), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CombinedFingerprint returns the fingerprint of the expansions' fingerprints and toolchains, e.g. for a cache key.
+func CombinedFingerprint(expansions []Expansion) string {
+	h := sha256.New()
+	for _, x := range expansions {
+		fmt.Fprintf(h, "%s=%s\n", x.Preset, x.Fingerprint)
+		if x.Toolchain != "" {
+			fmt.Fprintf(h, "%s.toolchain=%s\n", x.Preset, x.Toolchain)
+		}
+	}
+	return "sha256:" + hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,222 @@
+package cachepreset
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	presets, err := Parse("npm, cargo\ngo-mod,npm")
+	if err != nil {
+		t.Fatalf("Parse() error = %s", err)
+	}
+	var names []string
+	for _, p := range presets {
+		names = append(names, p.Name)
+	}
+	if want := []string{"npm", "cargo", "go-mod"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("Parse() = %v, want %v", names, want)
+	}
+
+	if _, err := Parse("npm,maven"); err == nil {
+		t.Errorf("Parse(unknown) error = nil, want error")
+	}
+}
+
+func TestDetect(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cachepreset-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Logf("failed to remove temp dir: %s", err)
+		}
+	}()
+
+	for _, name := range []string{"yarn.lock", "gradle/wrapper/gradle-wrapper.properties"} {
+		pth := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(pth), 0755); err != nil {
+			t.Fatalf("failed to create dir: %s", err)
+		}
+		if err := ioutil.WriteFile(pth, nil, 0644); err != nil {
+			t.Fatalf("failed to write lockfile: %s", err)
+		}
+	}
+
+	var names []string
+	for _, p := range Detect(Env{Home: "/home/user", ProjectDir: dir, GOOS: "linux"}) {
+		names = append(names, p.Name)
+	}
+	if want := []string{"gradle", "yarn"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("Detect() = %v, want %v", names, want)
+	}
+}
+
+func TestExpand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cachepreset-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Logf("failed to remove temp dir: %s", err)
+		}
+	}()
+
+	env := Env{Home: "/home/user", ProjectDir: dir, GOOS: "linux", Getenv: func(key string) string {
+		if key == "COMPOSER_CACHE_DIR" {
+			return "/opt/composer"
+		}
+		return ""
+	}}
+	composer, _ := Lookup("composer")
+
+	x, err := composer.Expand(env)
+	if err != nil {
+		t.Fatalf("Expand() error = %s", err)
+	}
+	want := Expansion{
+		Preset:       "composer",
+		Paths:        []string{"/opt/composer"},
+		ProjectPaths: []string{filepath.Join(dir, "vendor")},
+	}
+	if !reflect.DeepEqual(x, want) {
+		t.Errorf("Expand() = %+v, want %+v", x, want)
+	}
+
+	t.Log("the lockfiles are fingerprinted")
+	{
+		if err := ioutil.WriteFile(filepath.Join(dir, "composer.lock"), []byte(`{"packages": []}`), 0644); err != nil {
+			t.Fatalf("failed to write lockfile: %s", err)
+		}
+		x, err := composer.Expand(env)
+		if err != nil || x.Fingerprint == "" {
+			t.Fatalf("Expand() = %+v, %v, want fingerprint", x, err)
+		}
+
+		if err := os.MkdirAll(x.ProjectPaths[0], 0755); err != nil {
+			t.Fatalf("failed to create dir: %s", err)
+		}
+		if err := x.RecordFingerprint(); err != nil {
+			t.Fatalf("RecordFingerprint() error = %s", err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, "composer.lock"), []byte(`{"packages": [{"name": "monolog/monolog"}]}`), 0644); err != nil {
+			t.Fatalf("failed to write lockfile: %s", err)
+		}
+		changed, err := composer.Expand(env)
+		if err != nil {
+			t.Fatalf("Expand() error = %s", err)
+		}
+		if stale, err := changed.StaleProjectPaths(); err != nil || !reflect.DeepEqual(stale, x.ProjectPaths) {
+			t.Errorf("StaleProjectPaths() = %v, %v, want %v", stale, err, x.ProjectPaths)
+		}
+	}
+}
+
+func TestStaleToolchainPaths(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cachepreset-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Logf("failed to remove temp dir: %s", err)
+		}
+	}()
+
+	buildCache := filepath.Join(dir, "go-build")
+	if err := os.MkdirAll(buildCache, 0755); err != nil {
+		t.Fatalf("failed to create dir: %s", err)
+	}
+	x := Expansion{Preset: "go-mod", ToolchainPaths: []string{buildCache, filepath.Join(dir, "missing")}, Toolchain: "go1.21.5 linux/amd64"}
+
+	if stale, err := x.StaleToolchainPaths(); err != nil || len(stale) != 0 {
+		t.Errorf("StaleToolchainPaths() = %v, %v, want none without a record", stale, err)
+	}
+	if err := x.RecordToolchain(); err != nil {
+		t.Fatalf("RecordToolchain() error = %s", err)
+	}
+	if stale, err := x.StaleToolchainPaths(); err != nil || len(stale) != 0 {
+		t.Errorf("StaleToolchainPaths() = %v, %v, want none for the same toolchain", stale, err)
+	}
+
+	for _, toolchain := range []string{"go1.22.0 linux/amd64", "go1.21.5 darwin/arm64"} {
+		other := x
+		other.Toolchain = toolchain
+		if stale, err := other.StaleToolchainPaths(); err != nil || !reflect.DeepEqual(stale, []string{buildCache}) {
+			t.Errorf("StaleToolchainPaths(%s) = %v, %v, want %v", toolchain, stale, err, []string{buildCache})
+		}
+	}
+
+	t.Log("an unknown toolchain is not stale")
+	{
+		unknown := x
+		unknown.Toolchain = ""
+		if stale, err := unknown.StaleToolchainPaths(); err != nil || len(stale) != 0 {
+			t.Errorf("StaleToolchainPaths() = %v, %v, want none", stale, err)
+		}
+	}
+}
+
+func TestVirtualenvPythonVersion(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cachepreset-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Logf("failed to remove temp dir: %s", err)
+		}
+	}()
+
+	tests := []struct {
+		name string
+		cfg  string
+		want string
+	}{
+		{name: "venv", cfg: "home = /usr/local/bin\ninclude-system-site-packages = false\nversion = 3.11.4\n", want: "Python 3.11.4"},
+		{name: "virtualenv", cfg: "home = /usr/bin\nimplementation = CPython\nversion_info = 3.12.1.final.0\n", want: "Python 3.12.1"},
+		{name: "poetry cache", want: ""},
+	}
+	for _, tt := range tests {
+		venv := filepath.Join(dir, tt.name)
+		if err := os.MkdirAll(venv, 0755); err != nil {
+			t.Fatalf("failed to create dir: %s", err)
+		}
+		if tt.cfg != "" {
+			if err := ioutil.WriteFile(filepath.Join(venv, "pyvenv.cfg"), []byte(tt.cfg), 0644); err != nil {
+				t.Fatalf("failed to write pyvenv.cfg: %s", err)
+			}
+		}
+		if got, err := virtualenvPythonVersion(venv); err != nil || got != tt.want {
+			t.Errorf("virtualenvPythonVersion(%s) = %s, %v, want %s", tt.name, got, err, tt.want)
+		}
+	}
+
+	t.Log("a virtualenv of another interpreter is stale without a record")
+	{
+		x := Expansion{Preset: "virtualenv", ToolchainPaths: []string{filepath.Join(dir, "venv"), filepath.Join(dir, "poetry cache")}, Toolchain: "Python 3.12.1", builtBy: virtualenvPythonVersion}
+		if stale, err := x.StaleToolchainPaths(); err != nil || !reflect.DeepEqual(stale, []string{filepath.Join(dir, "venv")}) {
+			t.Errorf("StaleToolchainPaths() = %v, %v, want the venv", stale, err)
+		}
+	}
+}
+
+func TestBrewfileFormulae(t *testing.T) {
+	brewfile := `tap "homebrew/bundle"
+brew "swiftlint"
+brew 'xcbeautify', link: true
+brew "mint/tap/mint"
+  brew "carthage" # indented
+cask "fastlane"
+mas "Xcode", id: 497799835
+`
+	want := []string{"swiftlint", "xcbeautify", "mint", "carthage"}
+	if got := brewfileFormulae(brewfile); !reflect.DeepEqual(got, want) {
+		t.Errorf("brewfileFormulae() = %v, want %v", got, want)
+	}
+}
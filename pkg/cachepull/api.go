@@ -0,0 +1,107 @@
+package cachepull
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// ErrCacheNotFound is returned if the cache API does not have a cache archive for the build.
+var ErrCacheNotFound = errors.New("build cache not found")
+
+// DownloadInfo is the cache API's response, the archive's download URL.
+type DownloadInfo struct {
+	DownloadURL string `json:"download_url"`
+}
+
+// GetDownloadInfo gets the build's cache download URL from the cache API, and decodes the response into v
+// (a *DownloadInfo, or the caller's own response model with a download_url).
+// It returns ErrCacheNotFound if the API does not have a cache archive for the build.
+func GetDownloadInfo(ctx context.Context, client *http.Client, cacheAPIURL string, v interface{}) error {
+	req, err := http.NewRequest("GET", cacheAPIURL, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %s", err)
+	}
+
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("failed to send request: %s", err)
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			log.Warnf("Failed to close response body: %s", err)
+		}
+	}()
+
+	decoded, err := DecodeContentEncoding(resp.Header, resp.Body)
+	if err != nil {
+		return fmt.Errorf("request sent, but failed to read response body (http-code: %d): %s", resp.StatusCode, err)
+	}
+	body, err := ioutil.ReadAll(decoded)
+	if err != nil {
+		return fmt.Errorf("request sent, but failed to read response body (http-code: %d): %s", resp.StatusCode, err)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 202 {
+		return ErrCacheNotFound
+	}
+
+	var info DownloadInfo
+	if err := json.Unmarshal(body, &info); err != nil {
+		return fmt.Errorf("failed to parse JSON response (%s): %s", body, err)
+	}
+	if info.DownloadURL == "" {
+		return errors.New("download URL not included in the response")
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("failed to parse JSON response (%s): %s", body, err)
+	}
+	return nil
+}
+
+// gzipBody decodes the body of a gzip Content-Encoding response.
+type gzipBody struct {
+	*gzip.Reader
+	body io.ReadCloser
+}
+
+// Close closes the response body.
+func (b gzipBody) Close() error {
+	if err := b.Reader.Close(); err != nil {
+		log.Debugf("Failed to close gzip reader: %s", err)
+	}
+	return b.body.Close()
+}
+
+// DecodeContentEncoding wraps the body to decode the response's Content-Encoding (if any) and returns the decoded body.
+// The body is closed if the encoding can not be decoded.
+func DecodeContentEncoding(header http.Header, body io.ReadCloser) (io.ReadCloser, error) {
+	encoding := strings.ToLower(strings.TrimSpace(header.Get("Content-Encoding")))
+	switch encoding {
+	case "", "identity":
+		return body, nil
+	case "gzip", "x-gzip":
+		log.Debugf("decoding the gzip Content-Encoding of the response")
+		gr, err := gzip.NewReader(body)
+		if err == nil {
+			return gzipBody{Reader: gr, body: body}, nil
+		}
+		if cErr := body.Close(); cErr != nil {
+			log.Warnf("Failed to close response body: %s", cErr)
+		}
+		return nil, fmt.Errorf("failed to decode the gzip Content-Encoding: %s", err)
+	default:
+		if err := body.Close(); err != nil {
+			log.Warnf("Failed to close response body: %s", err)
+		}
+		return nil, fmt.Errorf("unsupported Content-Encoding: %s", encoding)
+	}
+}
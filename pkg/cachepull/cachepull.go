@@ -0,0 +1,196 @@
+// Package cachepull restores a Bitrise build cache archive, so that other steps and tools can embed
+// the cache restoration instead of running the cache pull step.
+//
+// Pull covers the basic flow of the step, with the step's own cache API request (GetDownloadInfo)
+// and archive checks (CheckSchema, SameStack): it gets the archive's download URL from the cache API,
+// downloads the archive, checks its archive_info.json and extracts it in-process.
+// The additional features of the step (key-based caches, mirrors, in-process extraction, notifications...)
+// are only available in the step.
+package cachepull
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// gzipMagic is the header of a gzip compressed archive.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// Options configures Pull.
+type Options struct {
+	// CacheAPIURL is the cache API's URL (e.g. $BITRISE_CACHE_API_URL),
+	// or a file:// URL of a local cache archive.
+	CacheAPIURL string
+	// ExtractToRelativePath extracts the archive into Dir, stripping the leading `/` from the entry names.
+	ExtractToRelativePath bool
+	// Dir is the working directory of the extraction, the current directory if empty.
+	Dir string
+	// StackID is the current stack's ID, the archives created on another stack are not restored (ErrStackChanged).
+	// The stack is not checked if it is empty.
+	StackID string
+	// HTTPClient performs the requests, http.DefaultClient if nil.
+	HTTPClient *http.Client
+}
+
+// Result describes the restored archive.
+type Result struct {
+	// DownloadURL is the archive's URL.
+	DownloadURL string
+	// Compressed reports whether the archive is gzip compressed.
+	Compressed bool
+	// ArchiveSize is the number of the downloaded bytes.
+	ArchiveSize int64
+	// Warning is set if the archive is restored without its newer features, see CheckSchema.
+	Warning string
+}
+
+// Pull downloads the cache archive described by the options and extracts it.
+// It returns ErrCacheNotFound if there is no cache to restore, a *SchemaError if the archive requires a newer
+// cache pull step and ErrStackChanged if the archive was created on another stack.
+func Pull(ctx context.Context, opts Options) (Result, error) {
+	if opts.CacheAPIURL == "" {
+		return Result{}, errors.New("no cache API URL specified")
+	}
+	if opts.HTTPClient == nil {
+		opts.HTTPClient = http.DefaultClient
+	}
+
+	var result Result
+	var archive io.ReadCloser
+	if strings.HasPrefix(opts.CacheAPIURL, "file://") {
+		result.DownloadURL = opts.CacheAPIURL
+
+		f, err := os.Open(strings.TrimPrefix(opts.CacheAPIURL, "file://"))
+		if os.IsNotExist(err) {
+			return Result{}, ErrCacheNotFound
+		}
+		if err != nil {
+			return Result{}, err
+		}
+		archive = f
+	} else {
+		var info DownloadInfo
+		if err := GetDownloadInfo(ctx, opts.HTTPClient, opts.CacheAPIURL, &info); err != nil {
+			return Result{}, err
+		}
+		result.DownloadURL = info.DownloadURL
+
+		var err error
+		if archive, err = download(ctx, opts.HTTPClient, info.DownloadURL); err != nil {
+			return Result{}, fmt.Errorf("failed to download cache archive: %s", err)
+		}
+	}
+	defer func() {
+		if err := archive.Close(); err != nil {
+			log.Warnf("Failed to close cache archive: %s", err)
+		}
+	}()
+
+	counter := &countingReader{r: archive}
+	r := bufio.NewReader(counter)
+	magic, err := r.Peek(len(gzipMagic))
+	if err != nil {
+		return Result{}, fmt.Errorf("failed to read cache archive: %s", err)
+	}
+	result.Compressed = bytes.Equal(magic, gzipMagic)
+
+	// the first entry is read from a copy of the stream's head, the whole stream is extracted
+	var head bytes.Buffer
+	info, hasInfo, err := readArchiveInfo(io.TeeReader(r, &head), result.Compressed)
+	if err != nil {
+		return Result{}, fmt.Errorf("failed to read first archive entry: %s", err)
+	}
+	if hasInfo {
+		if result.Warning, err = CheckSchema(info.SchemaVersion, info.MinReaderVersion); err != nil {
+			return Result{}, err
+		}
+		if opts.StackID != "" && !SameStack(info.StackID, opts.StackID) {
+			return Result{}, ErrStackChanged
+		}
+	}
+
+	if err := extract(ctx, io.MultiReader(&head, r), opts, result.Compressed); err != nil {
+		return Result{}, err
+	}
+	result.ArchiveSize = counter.n
+	return result, nil
+}
+
+// readArchiveInfo reads the archive's first entry, and returns its archive_info.json (if it is the first entry).
+func readArchiveInfo(r io.Reader, compressed bool) (ArchiveInfo, bool, error) {
+	if compressed {
+		gr, err := gzip.NewReader(r)
+		if err != nil {
+			return ArchiveInfo{}, false, err
+		}
+		r = gr
+	}
+
+	tr := tar.NewReader(r)
+	hdr, err := tr.Next()
+	if err == io.EOF {
+		return ArchiveInfo{}, false, nil
+	}
+	if err != nil {
+		return ArchiveInfo{}, false, err
+	}
+	if filepath.Base(hdr.Name) != ArchiveInfoFileName {
+		return ArchiveInfo{}, false, nil
+	}
+
+	b, err := ioutil.ReadAll(tr)
+	if err != nil {
+		return ArchiveInfo{}, false, err
+	}
+	info, err := ParseArchiveInfo(b)
+	if err != nil {
+		return ArchiveInfo{}, false, fmt.Errorf("failed to parse %s: %s", ArchiveInfoFileName, err)
+	}
+	return info, true, nil
+}
+
+// download returns the archive's body, if the status code is 200.
+func download(ctx context.Context, client *http.Client, url string) (io.ReadCloser, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		if err := resp.Body.Close(); err != nil {
+			log.Warnf("Failed to close response body: %s", err)
+		}
+		return nil, fmt.Errorf("non success response code: %d", resp.StatusCode)
+	}
+	return resp.Body, nil
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,143 @@
+package cachepull
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+// createTestArchive writes the files into an archive, in the order of their names.
+func createTestArchive(t *testing.T, files map[string]string) []byte {
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buff bytes.Buffer
+	gw := gzip.NewWriter(&buff)
+	tw := tar.NewWriter(gw)
+	for _, name := range names {
+		content := files[name]
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatalf("failed to write header: %s", err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatalf("failed to write content: %s", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("failed to close archive: %s", err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatalf("failed to close gzip writer: %s", err)
+	}
+	return buff.Bytes()
+}
+
+func TestPull(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cachepull-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Logf("failed to remove temp dir: %s", err)
+		}
+	}()
+
+	archive := createTestArchive(t, map[string]string{"cache/file": "content"})
+
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	mux.HandleFunc("/api", func(w http.ResponseWriter, r *http.Request) {
+		if _, err := fmt.Fprintf(w, `{"download_url": "%s/archive"}`, server.URL); err != nil {
+			t.Errorf("failed to write response: %s", err)
+		}
+	})
+	mux.HandleFunc("/archive", func(w http.ResponseWriter, r *http.Request) {
+		if _, err := w.Write(archive); err != nil {
+			t.Errorf("failed to write response: %s", err)
+		}
+	})
+
+	result, err := Pull(context.Background(), Options{CacheAPIURL: server.URL + "/api", ExtractToRelativePath: true, Dir: dir})
+	if err != nil {
+		t.Fatalf("Pull() error = %v", err)
+	}
+	if !result.Compressed || result.DownloadURL != server.URL+"/archive" {
+		t.Errorf("Pull() = %+v, want compressed archive from %s/archive", result, server.URL)
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, "cache", "file"))
+	if err != nil {
+		t.Fatalf("failed to read restored file: %s", err)
+	}
+	if string(b) != "content" {
+		t.Errorf("restored file content = %s, want content", b)
+	}
+
+	t.Log("the archive_info.json is checked, and restored")
+	{
+		archive = createTestArchive(t, map[string]string{
+			ArchiveInfoFileName: `{"schema_version": 9, "min_reader_version": 2, "stack_id": "linux-docker-android-22.04"}`,
+			"cache/file":        "content",
+		})
+		result, err := Pull(context.Background(), Options{CacheAPIURL: server.URL + "/api", ExtractToRelativePath: true, Dir: dir, StackID: "linux-docker-android-22.04"})
+		if err != nil {
+			t.Fatalf("Pull() error = %v", err)
+		}
+		if result.Warning == "" {
+			t.Errorf("Pull() warning is empty, want the newer schema's warning")
+		}
+		if _, err := os.Stat(filepath.Join(dir, ArchiveInfoFileName)); err != nil {
+			t.Errorf("%s is not restored: %s", ArchiveInfoFileName, err)
+		}
+	}
+
+	t.Log("the archive of another stack is not restored")
+	{
+		if _, err := Pull(context.Background(), Options{CacheAPIURL: server.URL + "/api", ExtractToRelativePath: true, Dir: dir, StackID: "osx-xcode-15.0.x"}); err != ErrStackChanged {
+			t.Errorf("Pull() error = %v, want %v", err, ErrStackChanged)
+		}
+	}
+
+	t.Log("the archive requiring a newer step is not restored")
+	{
+		archive = createTestArchive(t, map[string]string{
+			ArchiveInfoFileName: `{"schema_version": 10, "min_reader_version": 10}`,
+			"cache/file":        "content",
+		})
+		if _, err := Pull(context.Background(), Options{CacheAPIURL: server.URL + "/api", ExtractToRelativePath: true, Dir: dir}); err == nil {
+			t.Errorf("Pull() error = nil, want a schema error")
+		} else if _, ok := err.(*SchemaError); !ok {
+			t.Errorf("Pull() error = %v, want a *SchemaError", err)
+		}
+	}
+
+	t.Log("cache not found")
+	{
+		if _, err := Pull(context.Background(), Options{CacheAPIURL: server.URL + "/missing", Dir: dir}); err != ErrCacheNotFound {
+			t.Errorf("Pull() error = %v, want %v", err, ErrCacheNotFound)
+		}
+	}
+
+	t.Log("canceled context")
+	{
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if _, err := Pull(ctx, Options{CacheAPIURL: server.URL + "/api", Dir: dir}); err == nil {
+			t.Errorf("Pull() error = %v, want error", err)
+		}
+	}
+}
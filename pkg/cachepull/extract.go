@@ -0,0 +1,142 @@
+package cachepull
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// extract extracts the archive stream in-process: its directories, regular files, symlinks and hard links
+// (the step restores the other entry types too). The absolute entry names are extracted to their path,
+// unless opts.ExtractToRelativePath strips their leading `/` (like tar without -P).
+func extract(ctx context.Context, r io.Reader, opts Options, compressed bool) error {
+	if compressed {
+		gr, err := gzip.NewReader(r)
+		if err != nil {
+			return fmt.Errorf("failed to open gzip stream: %s", err)
+		}
+		defer func() {
+			if err := gr.Close(); err != nil {
+				log.Warnf("Failed to close gzip reader: %s", err)
+			}
+		}()
+		r = gr
+	}
+
+	dir := opts.Dir
+	if dir == "" {
+		wd, err := os.Getwd()
+		if err != nil {
+			return err
+		}
+		dir = wd
+	}
+
+	tr := tar.NewReader(r)
+	var dirs []*tar.Header
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read archive: %s", err)
+		}
+
+		target, err := entryTarget(dir, hdr.Name, opts.ExtractToRelativePath)
+		if err != nil {
+			return err
+		}
+		if err := extractEntry(tr, hdr, target, dir, opts.ExtractToRelativePath); err != nil {
+			return fmt.Errorf("failed to extract %s: %s", hdr.Name, err)
+		}
+		if hdr.Typeflag == tar.TypeDir {
+			dirs = append(dirs, hdr)
+		}
+	}
+
+	// the directories' modification times are changed by the extraction of their content
+	for i := len(dirs) - 1; i >= 0; i-- {
+		target, err := entryTarget(dir, dirs[i].Name, opts.ExtractToRelativePath)
+		if err != nil {
+			return err
+		}
+		if err := os.Chtimes(target, dirs[i].ModTime, dirs[i].ModTime); err != nil {
+			return fmt.Errorf("failed to restore the modification time of %s: %s", target, err)
+		}
+	}
+	return nil
+}
+
+// entryTarget returns the path of the entry name, the relative names are extracted into dir.
+func entryTarget(dir, name string, relative bool) (string, error) {
+	if relative {
+		name = strings.TrimLeft(name, "/")
+	}
+	if filepath.IsAbs(name) {
+		return filepath.Clean(name), nil
+	}
+
+	target := filepath.Join(dir, name)
+	if rel, err := filepath.Rel(dir, target); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("the archive entry %s is outside of the extraction directory", name)
+	}
+	return target, nil
+}
+
+func extractEntry(tr *tar.Reader, hdr *tar.Header, target, dir string, relative bool) error {
+	mode := os.FileMode(hdr.Mode).Perm()
+	if hdr.Typeflag != tar.TypeDir {
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		// the existing file is replaced, like tar does
+		if err := os.Remove(target); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if err := os.MkdirAll(target, mode); err != nil {
+			return err
+		}
+		return os.Chmod(target, mode)
+	case tar.TypeReg, tar.TypeRegA:
+		f, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(f, tr); err != nil {
+			if cErr := f.Close(); cErr != nil {
+				log.Warnf("Failed to close %s: %s", target, cErr)
+			}
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+		return os.Chtimes(target, hdr.ModTime, hdr.ModTime)
+	case tar.TypeSymlink:
+		return os.Symlink(hdr.Linkname, target)
+	case tar.TypeLink:
+		source, err := entryTarget(dir, hdr.Linkname, relative)
+		if err != nil {
+			return err
+		}
+		return os.Link(source, target)
+	default:
+		log.Warnf("Skipping the unsupported archive entry %s (type %c)", hdr.Name, hdr.Typeflag)
+		return nil
+	}
+}
@@ -0,0 +1,88 @@
+package cachepull
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_entryTarget(t *testing.T) {
+	tests := []struct {
+		name     string
+		entry    string
+		relative bool
+		want     string
+		wantErr  bool
+	}{
+		{name: "relative", entry: "cache/file", want: "/work/cache/file"},
+		{name: "absolute", entry: "/root/.gradle/file", want: "/root/.gradle/file"},
+		{name: "absolute, extracted to relative path", entry: "/root/.gradle/file", relative: true, want: "/work/root/.gradle/file"},
+		{name: "outside of the directory", entry: "../file", wantErr: true},
+		{name: "outside of the directory, extracted to relative path", entry: "/../file", relative: true, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := entryTarget("/work", tt.entry, tt.relative)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("entryTarget() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("entryTarget() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_extract(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cachepull-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Logf("failed to remove temp dir: %s", err)
+		}
+	}()
+
+	var buff bytes.Buffer
+	tw := tar.NewWriter(&buff)
+	for _, hdr := range []*tar.Header{
+		{Name: "cache/", Mode: 0700, Typeflag: tar.TypeDir},
+		{Name: "cache/file", Mode: 0600, Size: 7, Typeflag: tar.TypeReg},
+		{Name: "cache/symlink", Linkname: "file", Typeflag: tar.TypeSymlink},
+		{Name: "cache/hardlink", Linkname: "cache/file", Typeflag: tar.TypeLink},
+	} {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("failed to write header: %s", err)
+		}
+		if hdr.Size > 0 {
+			if _, err := tw.Write([]byte("content")); err != nil {
+				t.Fatalf("failed to write content: %s", err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("failed to close archive: %s", err)
+	}
+
+	if err := extract(context.Background(), &buff, Options{Dir: dir}, false); err != nil {
+		t.Fatalf("extract() error = %s", err)
+	}
+
+	for _, name := range []string{"file", "symlink", "hardlink"} {
+		b, err := ioutil.ReadFile(filepath.Join(dir, "cache", name))
+		if err != nil || string(b) != "content" {
+			t.Errorf("cache/%s = %q, %v, want content", name, b, err)
+		}
+	}
+	if info, err := os.Lstat(filepath.Join(dir, "cache", "symlink")); err != nil || info.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("cache/symlink is not a symlink: %v, %v", info, err)
+	}
+	if info, err := os.Stat(filepath.Join(dir, "cache")); err != nil || info.Mode().Perm() != 0700 {
+		t.Errorf("cache mode = %v, %v, want %v", info.Mode().Perm(), err, os.FileMode(0700))
+	}
+}
@@ -0,0 +1,88 @@
+package cachepull
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+)
+
+// ArchiveInfoFileName is the name of the archive's metadata entry, written by the cache push step
+// as the archive's first entry.
+const ArchiveInfoFileName = "archive_info.json"
+
+// The archive schema versions, written by the cache push step in archive_info.json:
+//
+//   - 1: archive_info.json with the stack ID (archives without schema_version),
+//   - 2: the cached paths' content hashes,
+//   - 3: the archive's fingerprint, with archive_info.json within the archive's first 64 KB,
+//   - 4: the directory trees of the large directories,
+//   - 5: the cached Swift packages' revisions,
+//   - 6: the cargo target directory's toolchain,
+//   - 7: the cache presets' toolchains,
+//   - 8: the platform artifacts, with their stack and digest.
+const (
+	LegacySchemaVersion = 1
+	// SchemaVersion is the newest schema version the cache pull step restores every feature of.
+	SchemaVersion = 8
+)
+
+// ErrStackChanged is returned by Pull, if the archive was created on another stack than Options.StackID.
+var ErrStackChanged = errors.New("the cache archive was created on another stack")
+
+// ArchiveInfo is the part of the archive's archive_info.json deciding whether the archive can be restored.
+type ArchiveInfo struct {
+	// SchemaVersion and MinReaderVersion are the archive's schema version and the oldest one able to restore it,
+	// see CheckSchema.
+	SchemaVersion    int    `json:"schema_version,omitempty"`
+	MinReaderVersion int    `json:"min_reader_version,omitempty"`
+	StackID          string `json:"stack_id,omitempty"`
+}
+
+// ParseArchiveInfo parses the content of archive_info.json.
+func ParseArchiveInfo(b []byte) (ArchiveInfo, error) {
+	var info ArchiveInfo
+	if err := json.Unmarshal(b, &info); err != nil {
+		return ArchiveInfo{}, err
+	}
+	return info, nil
+}
+
+// SchemaError is returned for the archives the cache pull step can not restore.
+type SchemaError struct {
+	SchemaVersion    int
+	MinReaderVersion int
+}
+
+func (e *SchemaError) Error() string {
+	return fmt.Sprintf("the cache archive (schema version %d) requires a cache pull step supporting schema version %d, this step supports up to %d: update the cache pull step, or push a new cache with a compatible cache push step",
+		e.SchemaVersion, e.MinReaderVersion, SchemaVersion)
+}
+
+// CheckSchema checks the compatibility of the archive (by its archive_info.json's versions) with the cache pull step:
+//
+//   - archives requiring a newer reader (min_reader_version) are incompatible (a *SchemaError),
+//   - archives of a newer schema, readable by the step, are restored without the newer features (a warning is returned),
+//   - archives of this or an older schema are restored.
+func CheckSchema(schemaVersion, minReaderVersion int) (string, error) {
+	if schemaVersion == 0 {
+		schemaVersion = LegacySchemaVersion
+	}
+	if minReaderVersion > SchemaVersion {
+		return "", &SchemaError{SchemaVersion: schemaVersion, MinReaderVersion: minReaderVersion}
+	}
+	if schemaVersion > SchemaVersion {
+		return fmt.Sprintf("The cache archive has a newer schema version (%d) than this step supports (%d), its newer features are ignored: update the cache pull step", schemaVersion, SchemaVersion), nil
+	}
+	return "", nil
+}
+
+var gen2StackPattern = regexp.MustCompile("^(.+)-gen2.*$")
+
+// SameStack reports whether the archive created on archiveStackID can be restored on currentStackID.
+func SameStack(archiveStackID, currentStackID string) bool {
+	// TODO This check is a temporary solution to support GEN2 VMs having different ids for same stack types
+	currentStackID = gen2StackPattern.ReplaceAllString(currentStackID, "$1")
+	archiveStackID = gen2StackPattern.ReplaceAllString(archiveStackID, "$1")
+	return archiveStackID == currentStackID
+}
@@ -0,0 +1,46 @@
+package cachepull
+
+import "testing"
+
+func TestCheckSchema(t *testing.T) {
+	tests := []struct {
+		name             string
+		schemaVersion    int
+		minReaderVersion int
+		wantWarning      bool
+		wantErr          bool
+	}{
+		{name: "legacy"},
+		{name: "current", schemaVersion: SchemaVersion, minReaderVersion: 1},
+		{name: "newer, readable", schemaVersion: SchemaVersion + 1, minReaderVersion: SchemaVersion, wantWarning: true},
+		{name: "newer, not readable", schemaVersion: SchemaVersion + 1, minReaderVersion: SchemaVersion + 1, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			warning, err := CheckSchema(tt.schemaVersion, tt.minReaderVersion)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("CheckSchema() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if (warning != "") != tt.wantWarning {
+				t.Errorf("CheckSchema() warning = %q, wantWarning %v", warning, tt.wantWarning)
+			}
+		})
+	}
+}
+
+func TestSameStack(t *testing.T) {
+	tests := []struct {
+		archiveStackID string
+		currentStackID string
+		want           bool
+	}{
+		{archiveStackID: "osx-xcode-15.0.x", currentStackID: "osx-xcode-15.0.x", want: true},
+		{archiveStackID: "osx-xcode-15.0.x", currentStackID: "osx-xcode-15.0.x-gen2-mmg4", want: true},
+		{archiveStackID: "osx-xcode-15.0.x", currentStackID: "osx-xcode-14.3.x", want: false},
+	}
+	for _, tt := range tests {
+		if got := SameStack(tt.archiveStackID, tt.currentStackID); got != tt.want {
+			t.Errorf("SameStack(%s, %s) = %v, want %v", tt.archiveStackID, tt.currentStackID, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// platformArtifact is a large platform artifact of the archive (schema version 8), e.g. an iOS simulator runtime
+// (~/Library/Developer/CoreSimulator/Profiles/Runtimes/iOS 17.2.simruntime) or an Android emulator system image
+// ($ANDROID_HOME/system-images/android-34/google_apis/arm64-v8a).
+type platformArtifact struct {
+	Path string `json:"path"`
+	// Stack is the stack the artifact was cached on, it is only usable on the same stack.
+	Stack string `json:"stack,omitempty"`
+	// Digest is the artifact's content digest, see artifactDigest.
+	Digest string `json:"digest,omitempty"`
+}
+
+// sparseBlockSize is the size of the zero blocks written as holes.
+const sparseBlockSize = 4096
+
+// sparseWriter writes a file's zero blocks as holes, by seeking past them.
+type sparseWriter struct {
+	f      *os.File
+	offset int64
+}
+
+func (w *sparseWriter) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		zero := isZeroBlock(p[written:])
+		end := written
+		for end < len(p) && isZeroBlock(p[end:]) == zero {
+			end += sparseBlockLen(p[end:])
+		}
+
+		if zero {
+			if _, err := w.f.Seek(int64(end-written), io.SeekCurrent); err != nil {
+				return written, err
+			}
+		} else if _, err := w.f.Write(p[written:end]); err != nil {
+			return written, err
+		}
+		w.offset += int64(end - written)
+		written = end
+	}
+	return written, nil
+}
+
+// finish sets the file's size, a trailing hole is not written by the seeks.
+func (w *sparseWriter) finish() error {
+	return w.f.Truncate(w.offset)
+}
+
+func sparseBlockLen(p []byte) int {
+	if len(p) < sparseBlockSize {
+		return len(p)
+	}
+	return sparseBlockSize
+}
+
+// isZeroBlock reports whether the first block of p is zeros.
+func isZeroBlock(p []byte) bool {
+	for _, b := range p[:sparseBlockLen(p)] {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// artifactDigest returns the digest of the directory's regular files and symlinks, in the sha256:<hex> format:
+// the sha256 of the lines "<sha256 hex of the file> <relative path>" and "-> <link target> <relative path>" in lexical order.
+func artifactDigest(dir string) (string, error) {
+	h := sha256.New()
+	err := filepath.Walk(dir, func(pth string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, pth)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		switch {
+		case info.Mode().IsRegular():
+			sum, err := fileHash(pth, sha256.New())
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(h, "%s %s\n", sum, rel)
+		case info.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(pth)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(h, "-> %s %s\n", target, rel)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return formatChecksum(h), nil
+}
+
+// planPlatformArtifactRestore returns the platform artifacts not to restore: the ones cached on another stack.
+// Without the current stack every artifact is restored.
+func planPlatformArtifactRestore(conf Config, info archiveInfo) []string {
+	if len(info.PlatformArtifacts) == 0 {
+		return nil
+	}
+	if conf.StackID == "" {
+		log.Printf("The current stack is unknown, the platform artifacts are restored without the stack check")
+		return nil
+	}
+
+	var skip []string
+	for _, artifact := range info.PlatformArtifacts {
+		if artifact.Stack == "" || isSameStack(artifact.Stack, conf.StackID) {
+			continue
+		}
+		log.Printf("%s is cached on stack %s, the current stack is %s: not restored", artifact.Path, artifact.Stack, conf.StackID)
+		skip = append(skip, artifact.Path)
+	}
+	result.SkippedPlatformArtifacts = skip
+	return skip
+}
+
+// verifyPlatformArtifacts removes the restored platform artifacts not matching their digest:
+// a partly restored simulator runtime or system image breaks the tools using it, they reinstall a missing one.
+// The skipped artifacts are not checked.
+func verifyPlatformArtifacts(artifacts []platformArtifact, skipped []string) {
+	for _, artifact := range artifacts {
+		if artifact.Digest == "" || isUnderPath(artifact.Path, skipped) {
+			continue
+		}
+		if _, err := os.Lstat(artifact.Path); err != nil {
+			continue
+		}
+
+		digest, err := artifactDigest(artifact.Path)
+		if err != nil {
+			result.Warnf("Failed to verify the platform artifact %s: %s", artifact.Path, err)
+			continue
+		}
+		if digest == artifact.Digest {
+			log.Printf("%s matches its digest", artifact.Path)
+			continue
+		}
+
+		result.Warnf("%s does not match its digest (%s, expected %s), removed", artifact.Path, digest, artifact.Digest)
+		if err := os.RemoveAll(artifact.Path); err != nil {
+			result.Warnf("Failed to remove %s: %s", artifact.Path, err)
+			continue
+		}
+		result.CorruptPlatformArtifacts = append(result.CorruptPlatformArtifacts, artifact.Path)
+	}
+}
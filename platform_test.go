@@ -0,0 +1,128 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestWriteFileSparse(t *testing.T) {
+	dir, err := ioutil.TempDir("", "platform-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Logf("failed to remove temp dir: %s", err)
+		}
+	}()
+
+	// data, a hole, data, a trailing hole
+	content := make([]byte, 10*sparseBlockSize+100)
+	copy(content, "header")
+	copy(content[5*sparseBlockSize+10:], "footer")
+
+	target := filepath.Join(dir, "userdata.img")
+	hdr := &tar.Header{Name: "userdata.img", Mode: 0644, Size: int64(len(content)), ModTime: time.Unix(1600000000, 0)}
+	if err := writeFile(bytes.NewReader(content), target, hdr, false, true, nil); err != nil {
+		t.Fatalf("writeFile() error = %s", err)
+	}
+
+	got, err := ioutil.ReadFile(target)
+	if err != nil {
+		t.Fatalf("failed to read %s: %s", target, err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Errorf("writeFile() wrote %d Bytes, want the %d Bytes of the content", len(got), len(content))
+	}
+}
+
+func TestArtifactDigest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "platform-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Logf("failed to remove temp dir: %s", err)
+		}
+	}()
+
+	runtime := filepath.Join(dir, "iOS 17.2.simruntime")
+	writeTestFiles(t, map[string]string{
+		filepath.Join(runtime, "Contents", "Info.plist"):                    "<plist/>",
+		filepath.Join(runtime, "Contents", "Resources", "RuntimeRoot", "a"): "a",
+	})
+	if err := os.Symlink("Info.plist", filepath.Join(runtime, "Contents", "link")); err != nil {
+		t.Fatalf("failed to create symlink: %s", err)
+	}
+
+	digest, err := artifactDigest(runtime)
+	if err != nil {
+		t.Fatalf("artifactDigest() error = %s", err)
+	}
+	if again, err := artifactDigest(runtime); err != nil || again != digest {
+		t.Errorf("artifactDigest() = %s, %v, want %s", again, err, digest)
+	}
+
+	t.Log("a changed file changes the digest")
+	{
+		writeTestFiles(t, map[string]string{filepath.Join(runtime, "Contents", "Resources", "RuntimeRoot", "a"): "b"})
+		if changed, err := artifactDigest(runtime); err != nil || changed == digest {
+			t.Errorf("artifactDigest() = %s, %v, want another digest", changed, err)
+		}
+	}
+}
+
+func TestPlatformArtifactRestore(t *testing.T) {
+	result = NewPullResult("", false)
+	defer func() { result = nil }()
+
+	dir, err := ioutil.TempDir("", "platform-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Logf("failed to remove temp dir: %s", err)
+		}
+	}()
+
+	runtime := filepath.Join(dir, "iOS 17.2.simruntime")
+	image := filepath.Join(dir, "system-images", "android-34")
+	other := filepath.Join(dir, "iOS 16.4.simruntime")
+	writeTestFiles(t, map[string]string{
+		filepath.Join(runtime, "Contents", "Info.plist"): "<plist/>",
+		filepath.Join(image, "system.img"):               "image",
+	})
+	digest, err := artifactDigest(runtime)
+	if err != nil {
+		t.Fatalf("artifactDigest() error = %s", err)
+	}
+
+	info := archiveInfo{PlatformArtifacts: []platformArtifact{
+		{Path: runtime, Stack: "osx-xcode-15.2.x", Digest: digest},
+		{Path: image, Stack: "osx-xcode-15.2.x-gen2", Digest: "sha256:other"},
+		{Path: other, Stack: "osx-xcode-14.3.x", Digest: "sha256:other"},
+	}}
+	skipped := planPlatformArtifactRestore(Config{StackID: "osx-xcode-15.2.x"}, info)
+	if want := []string{other}; !reflect.DeepEqual(skipped, want) {
+		t.Errorf("planPlatformArtifactRestore() = %v, want %v", skipped, want)
+	}
+
+	verifyPlatformArtifacts(info.PlatformArtifacts, skipped)
+	if want := []string{image}; !reflect.DeepEqual(result.CorruptPlatformArtifacts, want) {
+		t.Errorf("CorruptPlatformArtifacts = %v, want %v", result.CorruptPlatformArtifacts, want)
+	}
+	if _, err := os.Stat(image); !os.IsNotExist(err) {
+		t.Errorf("%s exists after verifyPlatformArtifacts()", image)
+	}
+	if _, err := os.Stat(runtime); err != nil {
+		t.Errorf("the matching artifact removed: %s", err)
+	}
+}
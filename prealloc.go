@@ -0,0 +1,81 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// largeDirectoryEntries is the number of entries from which the archive's directory is pre-created
+// before the extraction, see Extractor.LargeDirectories.
+const largeDirectoryEntries = 100000
+
+// largeDirectory is a directory of the archive with many entries, listed in archive_info.json (schema version 4).
+type largeDirectory struct {
+	Path string `json:"path"`
+	// Entries is the number of the archive's entries under the directory.
+	Entries int `json:"entries"`
+	// Directories are the directory's subdirectories, relative to Path.
+	Directories []string `json:"directories,omitempty"`
+}
+
+// dirSet is a set of directories known to exist, a nil dirSet is empty.
+type dirSet map[string]bool
+
+func (s dirSet) contains(dir string) bool {
+	return s[dir]
+}
+
+// preallocateDirs creates the directory trees of the large directories in a single batched pass, parents first,
+// before any file is written. On network filesystems this saves resolving the parent of every extracted file
+// and the lock contention of creating the directories between the file writes.
+// It returns the directories created (or already existing).
+func (e *Extractor) preallocateDirs() (dirSet, error) {
+	var targets []string
+	for _, dir := range e.LargeDirectories {
+		if dir.Entries < largeDirectoryEntries {
+			continue
+		}
+		root := e.targetPath(dir.Path)
+		targets = append(targets, root)
+		for _, sub := range dir.Directories {
+			sub = filepath.Clean(normalizeName(sub, e.Normalization))
+			if filepath.IsAbs(sub) || sub == ".." || strings.HasPrefix(sub, ".."+string(filepath.Separator)) {
+				continue
+			}
+			targets = append(targets, filepath.Join(root, sub))
+		}
+	}
+	if len(targets) == 0 {
+		return nil, nil
+	}
+	// a directory sorts before its subdirectories
+	sort.Strings(targets)
+
+	created := dirSet{}
+	for _, target := range targets {
+		if created.contains(target) || e.Filter.excludes(target) {
+			continue
+		}
+
+		var err error
+		if created.contains(filepath.Dir(target)) {
+			err = os.Mkdir(target, 0755)
+		} else {
+			err = os.MkdirAll(target, 0755)
+		}
+		if os.IsExist(err) {
+			// the existing non-directories are replaced (or fail) as without the pre-creation
+			info, statErr := os.Stat(target)
+			if statErr != nil || !info.IsDir() {
+				continue
+			}
+		} else if err != nil {
+			return nil, err
+		}
+		created[target] = true
+	}
+	e.PreallocatedDirs = len(created)
+	return created, nil
+}
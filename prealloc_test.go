@@ -0,0 +1,51 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestExtractor_Extract_largeDirectories(t *testing.T) {
+	dir, err := ioutil.TempDir("", "prealloc-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Logf("failed to remove temp dir: %s", err)
+		}
+	}()
+
+	e := NewExtractor(dir, true)
+	e.Workers = 4
+	e.Filter = pathFilter{Skip: []string{filepath.Join(dir, "node_modules", "skipped")}}
+	e.LargeDirectories = []largeDirectory{
+		{Path: "/node_modules", Entries: largeDirectoryEntries, Directories: []string{"a", "a/lib", "b/lib", "skipped", "../escaped"}},
+		{Path: "/small", Entries: largeDirectoryEntries - 1, Directories: []string{"sub"}},
+	}
+	entries := []testEntry{
+		{name: "/node_modules/a/lib/index.js", content: "a"},
+		{name: "/node_modules/b/lib/index.js", content: "b"},
+		{name: "/small/file", content: "small"},
+	}
+	if err := e.Extract(createTestArchive(t, entries)); err != nil {
+		t.Fatalf("Extractor.Extract() error = %v", err)
+	}
+
+	// node_modules, a, a/lib, b/lib
+	if e.PreallocatedDirs != 4 {
+		t.Errorf("Extractor.PreallocatedDirs = %d, want 4", e.PreallocatedDirs)
+	}
+	for _, entry := range entries {
+		if _, err := os.Stat(filepath.Join(dir, entry.name)); err != nil {
+			t.Errorf("%s not extracted: %s", entry.name, err)
+		}
+	}
+	for _, pth := range []string{"node_modules/skipped", "escaped", "small/sub"} {
+		if _, err := os.Stat(filepath.Join(dir, pth)); !os.IsNotExist(err) {
+			t.Errorf("%s exists, want not created", pth)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// preflightSampleSize is the number of bytes downloaded to measure the bandwidth before the download.
+const preflightSampleSize = 1024 * 1024
+
+// archivePreflight is the remote archive's metadata, read before the download (see the preflight input).
+type archivePreflight struct {
+	// Size is -1 if unknown.
+	Size         int64
+	LastModified time.Time
+	// Throughput is the measured bandwidth in Bytes per second, 0 if unknown.
+	Throughput float64
+}
+
+// ETA returns the estimated download time of the archive, 0 if unknown.
+func (p archivePreflight) ETA() time.Duration {
+	if p.Size < 0 || p.Throughput <= 0 {
+		return 0
+	}
+	return time.Duration(float64(p.Size) / p.Throughput * float64(time.Second))
+}
+
+// preflightArchive reads the archive's size and last modification time (see statArchive),
+// and measures the bandwidth with a ranged GET of its first preflightSampleSize Bytes.
+// A failed measurement leaves the Throughput unknown.
+func preflightArchive(parts []string, chunks []archiveChunk) (archivePreflight, error) {
+	header, size, err := statArchive(parts[0])
+	if err != nil {
+		return archivePreflight{}, err
+	}
+
+	p := archivePreflight{Size: size}
+	if modified, err := http.ParseTime(header.Get("Last-Modified")); err == nil {
+		p.LastModified = modified
+	}
+	if len(chunks) > 0 || len(parts) > 1 {
+		if p.Size, err = remoteArchiveSize(parts, chunks); err != nil {
+			return archivePreflight{}, err
+		}
+	}
+
+	if p.Throughput, err = measureThroughput(parts[0], preflightSampleSize); err != nil {
+		log.Debugf("Failed to measure the bandwidth: %s", err)
+	}
+	return p, nil
+}
+
+// measureThroughput downloads the first size Bytes of the url and returns the throughput in Bytes per second.
+func measureThroughput(url string, size int64) (float64, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=0-%d", size-1))
+
+	start := time.Now()
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			log.Warnf("Failed to close response body: %s", err)
+		}
+	}()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		return 0, fmt.Errorf("non success response code: %d", resp.StatusCode)
+	}
+	n, err := io.Copy(ioutil.Discard, io.LimitReader(resp.Body, size))
+	if err != nil {
+		return 0, err
+	}
+	elapsed := time.Since(start).Seconds()
+	if elapsed <= 0 {
+		return 0, nil
+	}
+	return float64(n) / elapsed, nil
+}
+
+// printPreflight prints the archive's metadata, and its size at the previous restore, if known (previousSize is -1 otherwise).
+func printPreflight(p archivePreflight, previousSize int64, now time.Time) {
+	size := "unknown size"
+	if p.Size >= 0 {
+		size = formatBytes(p.Size)
+		if previousSize > 0 {
+			size += fmt.Sprintf(" (previous restore: %s)", formatBytes(previousSize))
+		}
+	}
+	log.Printf("Cache archive: %s", size)
+
+	if !p.LastModified.IsZero() {
+		log.Printf("Last modified: %s (%s ago)", p.LastModified.UTC().Format(time.RFC3339), now.Sub(p.LastModified).Round(time.Second))
+	}
+	if eta := p.ETA(); eta > 0 {
+		log.Printf("Estimated download time: %s at %s/s", eta.Round(time.Second), formatBytes(int64(p.Throughput)))
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestPreflightArchive(t *testing.T) {
+	modTime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	content := bytes.Repeat([]byte("x"), 2048)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// presigned URLs are only signed for GET requests
+		if r.URL.Path != "/archive" || r.Method != "GET" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		http.ServeContent(w, r, "archive", modTime, bytes.NewReader(content))
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name     string
+		parts    []string
+		chunks   []archiveChunk
+		wantSize int64
+		wantErr  bool
+	}{
+		{name: "archive", parts: []string{server.URL + "/archive"}, wantSize: 2048},
+		{name: "chunks reported by the cache API", parts: []string{server.URL + "/archive"}, chunks: []archiveChunk{{Size: 100}, {Size: 50}}, wantSize: 150},
+		{name: "missing archive", parts: []string{server.URL + "/missing"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := preflightArchive(tt.parts, tt.chunks)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("preflightArchive() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if got.Size != tt.wantSize {
+				t.Errorf("Size = %d, want %d", got.Size, tt.wantSize)
+			}
+			if !got.LastModified.Equal(modTime) {
+				t.Errorf("LastModified = %s, want %s", got.LastModified, modTime)
+			}
+			if got.Throughput <= 0 {
+				t.Errorf("Throughput = %f, want measured", got.Throughput)
+			}
+		})
+	}
+}
+
+func TestArchivePreflight_ETA(t *testing.T) {
+	tests := []struct {
+		name string
+		p    archivePreflight
+		want time.Duration
+	}{
+		{name: "estimated", p: archivePreflight{Size: 100 * 1024 * 1024, Throughput: 10 * 1024 * 1024}, want: 10 * time.Second},
+		{name: "unknown size", p: archivePreflight{Size: -1, Throughput: 10 * 1024 * 1024}},
+		{name: "unknown throughput", p: archivePreflight{Size: 1024}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.p.ETA(); got != tt.want {
+				t.Errorf("ETA() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
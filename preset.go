@@ -0,0 +1,76 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/bitrise-steplib/steps-cache-pull/pkg/cachepreset"
+)
+
+// Outputs of the cache_presets input, for the cache push step.
+const (
+	presetPathsEnvKey       = "BITRISE_CACHE_PRESET_PATHS"
+	presetFingerprintEnvKey = "BITRISE_CACHE_PRESET_FINGERPRINT"
+)
+
+// presetFlutter is the preset also checking the Flutter SDK's engine artifacts, see staleFlutterEngineCache.
+const presetFlutter = "flutter"
+
+// staleFlutterEngineCache reports whether the restored engine artifacts (bin/cache) are of another engine version
+// than the SDK's: the SDK pins the engine in bin/internal/engine.version, the artifacts' version is in bin/cache/engine.stamp.
+// It is false if either is unknown.
+func staleFlutterEngineCache(sdkDir string) (bool, error) {
+	want, err := ioutil.ReadFile(filepath.Join(sdkDir, "bin", "internal", "engine.version"))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	got, err := ioutil.ReadFile(filepath.Join(sdkDir, "bin", "cache", "engine.stamp"))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return strings.TrimSpace(string(got)) != strings.TrimSpace(string(want)), nil
+}
+
+// clearStalePresetPaths removes the restored project paths of the preset installed by other lockfiles,
+// the toolchain paths built by another toolchain (and the Flutter engine artifacts of another engine version),
+// then records the current lockfiles and toolchain in them. It returns the removed paths.
+func clearStalePresetPaths(x cachepreset.Expansion, flutterRoot string) ([]string, error) {
+	stale, err := x.StaleProjectPaths()
+	if err != nil {
+		return nil, err
+	}
+	staleToolchain, err := x.StaleToolchainPaths()
+	if err != nil {
+		return nil, err
+	}
+	stale = append(stale, staleToolchain...)
+	if x.Preset == presetFlutter && flutterRoot != "" {
+		engineStale, err := staleFlutterEngineCache(flutterRoot)
+		if err != nil {
+			return nil, err
+		}
+		if engineStale {
+			stale = append(stale, filepath.Join(flutterRoot, "bin", "cache"))
+		}
+	}
+
+	var cleared []string
+	for _, pth := range stale {
+		if err := os.RemoveAll(pth); err != nil {
+			return cleared, err
+		}
+		cleared = append(cleared, pth)
+	}
+	if err := x.RecordFingerprint(); err != nil {
+		return cleared, err
+	}
+	return cleared, x.RecordToolchain()
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/bitrise-steplib/steps-cache-pull/pkg/cachepreset"
+)
+
+func TestClearStalePresetPaths(t *testing.T) {
+	dir, err := ioutil.TempDir("", "preset-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Logf("failed to remove temp dir: %s", err)
+		}
+	}()
+
+	project := filepath.Join(dir, "app")
+	sdk := filepath.Join(dir, "flutter")
+	writeTestFiles(t, map[string]string{
+		filepath.Join(project, ".dart_tool", "package_config.json"):      "{}",
+		filepath.Join(project, ".dart_tool", cachepreset.MarkerName):     "sha256:other\n",
+		filepath.Join(sdk, "bin", "internal", "engine.version"):          "e2\n",
+		filepath.Join(sdk, "bin", "cache", "engine.stamp"):               "e1\n",
+		filepath.Join(sdk, "bin", "cache", "artifacts", "engine", "bin"): "",
+	})
+
+	x := cachepreset.Expansion{Preset: presetFlutter, ProjectPaths: []string{filepath.Join(project, ".dart_tool")}, Fingerprint: "sha256:current"}
+	cleared, err := clearStalePresetPaths(x, sdk)
+	if err != nil {
+		t.Fatalf("clearStalePresetPaths() error = %s", err)
+	}
+	want := []string{filepath.Join(project, ".dart_tool"), filepath.Join(sdk, "bin", "cache")}
+	if !reflect.DeepEqual(cleared, want) {
+		t.Errorf("clearStalePresetPaths() = %v, want %v", cleared, want)
+	}
+
+	t.Log("the reinstalled project paths record the current lockfiles")
+	{
+		writeTestFiles(t, map[string]string{filepath.Join(project, ".dart_tool", "package_config.json"): "{}"})
+		if cleared, err := clearStalePresetPaths(x, sdk); err != nil || len(cleared) != 0 {
+			t.Errorf("clearStalePresetPaths() = %v, %v, want nothing cleared", cleared, err)
+		}
+		if stale, err := x.StaleProjectPaths(); err != nil || len(stale) != 0 {
+			t.Errorf("StaleProjectPaths() = %v, %v, want none", stale, err)
+		}
+	}
+}
+
+func TestClearStalePresetPathsToolchain(t *testing.T) {
+	dir, err := ioutil.TempDir("", "preset-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Logf("failed to remove temp dir: %s", err)
+		}
+	}()
+
+	modCache := filepath.Join(dir, "pkg", "mod")
+	buildCache := filepath.Join(dir, "go-build")
+	writeTestFiles(t, map[string]string{
+		filepath.Join(modCache, "cache", "download", "list"):       "",
+		filepath.Join(buildCache, "00", "0a1b-d"):                  "",
+		filepath.Join(buildCache, cachepreset.ToolchainMarkerName): "go1.21.5 darwin/arm64\n",
+	})
+
+	x := cachepreset.Expansion{Preset: "go-mod", Paths: []string{modCache}, ToolchainPaths: []string{buildCache}, Toolchain: "go1.22.0 darwin/arm64"}
+	cleared, err := clearStalePresetPaths(x, "")
+	if err != nil {
+		t.Fatalf("clearStalePresetPaths() error = %s", err)
+	}
+	if want := []string{buildCache}; !reflect.DeepEqual(cleared, want) {
+		t.Errorf("clearStalePresetPaths() = %v, want %v", cleared, want)
+	}
+	if _, err := os.Stat(modCache); err != nil {
+		t.Errorf("module cache removed: %s", err)
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+const (
+	// probeRequests is the number of requests (of the first Byte, see statArchive) used to measure the latency.
+	probeRequests = 3
+	// probeDownloadSize is the number of bytes downloaded to measure the throughput.
+	probeDownloadSize = 16 * 1024 * 1024
+
+	slowLatency    = 500 * time.Millisecond
+	slowThroughput = 10 * 1024 * 1024 // Bytes per second
+)
+
+type probeResult struct {
+	Name       string
+	Latency    time.Duration
+	Bytes      int64
+	Throughput float64 // Bytes per second
+	Err        error
+}
+
+// probeURLs returns the backends to probe: the command line arguments, or the configured cache API URL.
+func probeURLs(args []string) []string {
+	if len(args) > 0 {
+		return args
+	}
+	for _, key := range []string{"cache_api_url", "cache_download_url", "BITRISE_CACHE_API_URL"} {
+		if value := os.Getenv(key); value != "" {
+			return []string{value}
+		}
+	}
+	return nil
+}
+
+// runProbe measures the latency and throughput to the given backends and prints a diagnosis.
+func runProbe(urls []string) error {
+	if len(urls) == 0 {
+		return fmt.Errorf("no backend to probe: pass the URLs as arguments or set cache_api_url")
+	}
+
+	var results []probeResult
+	for _, uri := range urls {
+		if !isBitriseCacheAPIURL(uri, os.Getenv("BITRISE_CACHE_API_URL")) {
+			results = append(results, probeDownload(redactURL(uri), uri))
+			continue
+		}
+
+		start := time.Now()
+		downloadInfo, err := getCacheDownloadInfo(uri)
+		if err != nil {
+			results = append(results, probeResult{Name: "cache API", Err: err})
+			continue
+		}
+		results = append(results, probeResult{Name: "cache API", Latency: time.Since(start)})
+
+		results = append(results, probeDownload("download URL", downloadInfo.DownloadURL))
+		for i, mirror := range downloadInfo.Mirrors {
+			results = append(results, probeDownload(fmt.Sprintf("mirror (%d)", i), mirror))
+		}
+	}
+
+	printProbeResults(results)
+	return nil
+}
+
+func probeDownload(name, uri string) probeResult {
+	result := probeResult{Name: name}
+
+	latencies := make([]time.Duration, 0, probeRequests)
+	for i := 0; i < probeRequests; i++ {
+		start := time.Now()
+		if _, _, err := statArchive(uri); err != nil {
+			result.Err = err
+			return result
+		}
+		latencies = append(latencies, time.Since(start))
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	result.Latency = latencies[len(latencies)/2]
+
+	req, err := http.NewRequest("GET", uri, nil)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=0-%d", probeDownloadSize-1))
+
+	start := time.Now()
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			log.Warnf("Failed to close response body: %s", err)
+		}
+	}()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		result.Err = fmt.Errorf("non success response code: %d", resp.StatusCode)
+		return result
+	}
+
+	result.Bytes, result.Err = io.Copy(ioutil.Discard, io.LimitReader(resp.Body, probeDownloadSize))
+	if elapsed := time.Since(start).Seconds(); elapsed > 0 {
+		result.Throughput = float64(result.Bytes) / elapsed
+	}
+	return result
+}
+
+func printProbeResults(results []probeResult) {
+	fmt.Println()
+	log.Infof("Probe results")
+
+	for _, result := range results {
+		if result.Err != nil {
+			log.Errorf("%s: %s", result.Name, result.Err)
+			continue
+		}
+
+		line := fmt.Sprintf("%s: latency %s", result.Name, result.Latency.Round(time.Millisecond))
+		if result.Bytes > 0 {
+			line += fmt.Sprintf(", throughput %.2f MB/s (%d Bytes)", result.Throughput/1024/1024, result.Bytes)
+		}
+		log.Printf(line)
+
+		if result.Latency > slowLatency {
+			log.Warnf("- high latency, check the network route to the backend")
+		}
+		if result.Bytes > 0 && result.Throughput < slowThroughput {
+			log.Warnf("- low throughput, large caches will download slowly")
+		}
+	}
+}
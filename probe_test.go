@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestProbeURLs(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		env  map[string]string
+		want []string
+	}{
+		{name: "arguments", args: []string{"https://a", "https://b"}, env: map[string]string{"cache_api_url": "https://api"}, want: []string{"https://a", "https://b"}},
+		{name: "cache API URL", env: map[string]string{"cache_api_url": "https://api", "BITRISE_CACHE_API_URL": "https://bitrise"}, want: []string{"https://api"}},
+		{name: "download URL", env: map[string]string{"cache_download_url": "https://download", "BITRISE_CACHE_API_URL": "https://bitrise"}, want: []string{"https://download"}},
+		{name: "Bitrise cache API URL", env: map[string]string{"BITRISE_CACHE_API_URL": "https://bitrise"}, want: []string{"https://bitrise"}},
+		{name: "not configured"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, key := range []string{"cache_api_url", "cache_download_url", "BITRISE_CACHE_API_URL"} {
+				t.Setenv(key, tt.env[key])
+			}
+			if got := probeURLs(tt.args); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("probeURLs() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProbeDownload(t *testing.T) {
+	content := bytes.Repeat([]byte("a"), 1024)
+	stats := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		// presigned URLs are only signed for GET requests
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if r.Header.Get("Range") == "bytes=0-0" {
+			stats++
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes 0-0/%d", len(content)))
+			w.WriteHeader(http.StatusPartialContent)
+			if _, err := w.Write(content[:1]); err != nil {
+				t.Errorf("failed to write response: %s", err)
+			}
+			return
+		}
+		if want := fmt.Sprintf("bytes=0-%d", probeDownloadSize-1); r.Header.Get("Range") != want {
+			t.Errorf("Range = %s, want %s", r.Header.Get("Range"), want)
+		}
+		w.WriteHeader(http.StatusPartialContent)
+		if _, err := w.Write(content); err != nil {
+			t.Errorf("failed to write response: %s", err)
+		}
+	}))
+	defer server.Close()
+
+	got := probeDownload("backend", server.URL+"/cache.tar")
+	if got.Err != nil {
+		t.Fatalf("probeDownload() error = %s", got.Err)
+	}
+	if got.Name != "backend" || got.Bytes != int64(len(content)) || got.Latency <= 0 || got.Throughput <= 0 {
+		t.Errorf("probeDownload() = %+v, want %d Bytes with a latency and throughput", got, len(content))
+	}
+	if stats != probeRequests {
+		t.Errorf("first Byte requests = %d, want %d", stats, probeRequests)
+	}
+
+	if got := probeDownload("missing", server.URL+"/missing"); got.Err == nil || got.Bytes != 0 {
+		t.Errorf("probeDownload() = %+v, want a non success response code error", got)
+	}
+}
+
+func TestRunProbe(t *testing.T) {
+	t.Setenv("cache_api_url", "")
+	t.Setenv("cache_download_url", "")
+
+	if err := runProbe(nil); err == nil {
+		t.Errorf("runProbe() error = nil without a backend")
+	}
+
+	var requests []string
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, strings.TrimSpace(r.Method+" "+r.URL.Path+" "+r.Header.Get("Range")))
+		if r.URL.Path == "/api" {
+			if _, err := fmt.Fprintf(w, `{"download_url": "%s/archive", "mirrors": ["%s/mirror"]}`, server.URL, server.URL); err != nil {
+				t.Errorf("failed to write response: %s", err)
+			}
+		}
+	}))
+	defer server.Close()
+	t.Setenv("BITRISE_CACHE_API_URL", server.URL+"/api")
+
+	if err := runProbe([]string{server.URL + "/api"}); err != nil {
+		t.Fatalf("runProbe() error = %s", err)
+	}
+	want := []string{
+		"GET /api",
+		"GET /archive bytes=0-0", "GET /archive bytes=0-0", "GET /archive bytes=0-0", fmt.Sprintf("GET /archive bytes=0-%d", probeDownloadSize-1),
+		"GET /mirror bytes=0-0", "GET /mirror bytes=0-0", "GET /mirror bytes=0-0", fmt.Sprintf("GET /mirror bytes=0-%d", probeDownloadSize-1),
+	}
+	if !reflect.DeepEqual(requests, want) {
+		t.Errorf("requests = %v, want %v", requests, want)
+	}
+}
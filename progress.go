@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// Progress modes, see the progress_mode input.
+const (
+	progressAuto  = "auto"
+	progressBar   = "bar"
+	progressLines = "lines"
+	progressNone  = "none"
+)
+
+const progressBarWidth = 30
+
+// progressBarInterval is the refresh interval of the in-place progress bar.
+const progressBarInterval = 200 * time.Millisecond
+
+// isTerminal reports whether the file is a terminal (e.g. running `bitrise run` locally), not a CI log.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// resolveProgressMode returns the progress mode of the auto mode: an in-place bar on a terminal, plain lines otherwise.
+func resolveProgressMode(mode string, terminal bool) string {
+	if mode != progressAuto {
+		return mode
+	}
+	if terminal {
+		return progressBar
+	}
+	return progressLines
+}
+
+// ProgressReader reports the progress of the download while reading it.
+type ProgressReader struct {
+	r io.Reader
+	// Total is the size of the download, 0 if unknown.
+	Total int64
+	read  int64
+
+	mode     string
+	interval time.Duration
+	out      io.Writer
+	start    time.Time
+	last     time.Time
+	now      func() time.Time
+}
+
+// NewProgressReader creates a new ProgressReader, reporting the progress in the given mode to out.
+// The plain lines are printed every interval.
+func NewProgressReader(r io.Reader, total int64, mode string, interval time.Duration, out io.Writer) *ProgressReader {
+	p := &ProgressReader{r: r, Total: total, mode: mode, interval: interval, out: out, now: time.Now}
+	if mode == progressBar {
+		p.interval = progressBarInterval
+	}
+	p.start = p.now()
+	p.last = p.start
+	return p
+}
+
+// Read implements the io.Reader interface.
+func (p *ProgressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.read += int64(n)
+
+	if now := p.now(); p.mode != progressNone && now.Sub(p.last) >= p.interval {
+		p.last = now
+		p.render(now)
+	}
+	return n, err
+}
+
+// Done prints the final progress.
+func (p *ProgressReader) Done() {
+	if p.mode == progressNone {
+		return
+	}
+	p.render(p.now())
+	if p.mode == progressBar {
+		fmt.Fprintln(p.out)
+	}
+}
+
+func (p *ProgressReader) render(now time.Time) {
+	rate := 0.0
+	if elapsed := now.Sub(p.start).Seconds(); elapsed > 0 {
+		rate = float64(p.read) / elapsed
+	}
+
+	status := fmt.Sprintf("%s (%s/s)", formatBytes(p.read), formatBytes(int64(rate)))
+	if p.Total > 0 {
+		status = fmt.Sprintf("%s / %s (%s/s)", formatBytes(p.read), formatBytes(p.Total), formatBytes(int64(rate)))
+	}
+
+	if p.mode != progressBar {
+		fmt.Fprintf(p.out, "Downloaded %s\n", status)
+		return
+	}
+
+	if p.Total <= 0 {
+		fmt.Fprintf(p.out, "\rDownloaded %s", status)
+		return
+	}
+	done := int(float64(progressBarWidth) * float64(p.read) / float64(p.Total))
+	if done > progressBarWidth {
+		done = progressBarWidth
+	}
+	fmt.Fprintf(p.out, "\r[%s%s] %3d%% %s", strings.Repeat("#", done), strings.Repeat(".", progressBarWidth-done), 100*p.read/p.Total, status)
+}
+
+// formatBytes formats the size in the largest fitting unit.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
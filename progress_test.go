@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_resolveProgressMode(t *testing.T) {
+	tests := []struct {
+		mode     string
+		terminal bool
+		want     string
+	}{
+		{mode: progressAuto, terminal: true, want: progressBar},
+		{mode: progressAuto, terminal: false, want: progressLines},
+		{mode: progressBar, terminal: false, want: progressBar},
+		{mode: progressNone, terminal: true, want: progressNone},
+	}
+	for _, tt := range tests {
+		if got := resolveProgressMode(tt.mode, tt.terminal); got != tt.want {
+			t.Errorf("resolveProgressMode(%s, %v) = %s, want %s", tt.mode, tt.terminal, got, tt.want)
+		}
+	}
+}
+
+func Test_formatBytes(t *testing.T) {
+	tests := []struct {
+		n    int64
+		want string
+	}{
+		{n: 512, want: "512 B"},
+		{n: 1536, want: "1.5 KB"},
+		{n: 5 * 1024 * 1024, want: "5.0 MB"},
+	}
+	for _, tt := range tests {
+		if got := formatBytes(tt.n); got != tt.want {
+			t.Errorf("formatBytes(%d) = %s, want %s", tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestProgressReader(t *testing.T) {
+	content := strings.Repeat("x", 4096)
+
+	tests := []struct {
+		name  string
+		mode  string
+		total int64
+		want  []string
+	}{
+		{name: "lines", mode: progressLines, want: []string{"Downloaded 1.0 KB (1.0 KB/s)\n", "Downloaded 4.0 KB"}},
+		{name: "bar", mode: progressBar, total: 4096, want: []string{"\r[#######.......................]  25% 1.0 KB / 4.0 KB", "\r[##############################] 100% 4.0 KB / 4.0 KB"}},
+		{name: "none", mode: progressNone},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+			var out bytes.Buffer
+
+			p := NewProgressReader(strings.NewReader(content), tt.total, tt.mode, time.Second, &out)
+			p.now = func() time.Time { return clock }
+			p.start, p.last = clock, clock
+
+			buf := make([]byte, 1024)
+			for {
+				clock = clock.Add(time.Second)
+				if _, err := p.Read(buf); err == io.EOF {
+					break
+				} else if err != nil {
+					t.Fatalf("ProgressReader.Read() error = %v", err)
+				}
+			}
+			p.Done()
+
+			for _, want := range tt.want {
+				if !strings.Contains(out.String(), want) {
+					t.Errorf("progress = %q, want to contain %q", out.String(), want)
+				}
+			}
+			if len(tt.want) == 0 && out.Len() > 0 {
+				t.Errorf("progress = %q, want none", out.String())
+			}
+		})
+	}
+
+	t.Log("the progress does not change the content")
+	{
+		b, err := ioutil.ReadAll(NewProgressReader(strings.NewReader(content), 0, progressNone, time.Second, ioutil.Discard))
+		if err != nil || string(b) != content {
+			t.Errorf("ProgressReader content = %d bytes, %v, want %d bytes", len(b), err, len(content))
+		}
+	}
+}
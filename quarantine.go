@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// quarantineTimeout is the timeout of downloading the quarantined fingerprints (quarantine_url).
+const quarantineTimeout = 20 * time.Second
+
+// quarantine is the set of the cache archive fingerprints (sha256:<hex>) known to be corrupted or poisoned.
+type quarantine map[string]bool
+
+// parseQuarantine parses the newline separated fingerprints, `#` starts a comment.
+// The hex checksums without the sha256: prefix are accepted too.
+func parseQuarantine(content string) (quarantine, error) {
+	q := quarantine{}
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		fingerprint := strings.ToLower(strings.TrimSpace(line))
+		if fingerprint == "" {
+			continue
+		}
+		if !strings.HasPrefix(fingerprint, "sha256:") {
+			fingerprint = "sha256:" + fingerprint
+		}
+		if !isSHA256Hex(strings.TrimPrefix(fingerprint, "sha256:")) {
+			return nil, fmt.Errorf("invalid fingerprint (%s), expected sha256:<hex>", strings.TrimSpace(line))
+		}
+		q[fingerprint] = true
+	}
+	return q, scanner.Err()
+}
+
+func isSHA256Hex(s string) bool {
+	if len(s) != 64 {
+		return false
+	}
+	for _, r := range s {
+		if !strings.ContainsRune("0123456789abcdef", r) {
+			return false
+		}
+	}
+	return true
+}
+
+// loadQuarantine loads the quarantined fingerprints of the local denylist file and the URL (if set).
+func loadQuarantine(pth, url string) (quarantine, error) {
+	q := quarantine{}
+	if pth != "" {
+		b, err := ioutil.ReadFile(pth)
+		if err != nil {
+			return nil, err
+		}
+		fromFile, err := parseQuarantine(string(b))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", pth, err)
+		}
+		q.add(fromFile)
+	}
+	if url != "" {
+		content, err := downloadQuarantine(url)
+		if err != nil {
+			return nil, fmt.Errorf("failed to download the quarantined fingerprints: %s", err)
+		}
+		fromURL, err := parseQuarantine(content)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", redactURL(url), err)
+		}
+		q.add(fromURL)
+	}
+	log.Debugf("%d quarantined cache archives", len(q))
+	return q, nil
+}
+
+func downloadQuarantine(url string) (string, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return "", err
+	}
+	client := &http.Client{Timeout: quarantineTimeout, Transport: http.DefaultClient.Transport, CheckRedirect: http.DefaultClient.CheckRedirect}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	return readMetadataResponse(resp)
+}
+
+func (q quarantine) add(other quarantine) {
+	for fingerprint := range other {
+		q[fingerprint] = true
+	}
+}
+
+// contains reports whether the fingerprint is quarantined, the unknown (empty) fingerprint is not.
+func (q quarantine) contains(fingerprint string) bool {
+	return fingerprint != "" && q[strings.ToLower(fingerprint)]
+}
+
+// resolveUnquarantinedKey gets the download URL of the first cache entry matching the keys, which is not quarantined.
+// The quarantined entries are refused, and the keys after the one matching them are tried (the older fallbacks).
+// The fingerprints of the refused entries are returned too.
+func resolveUnquarantinedKey(baseURL, token string, keys []string, q quarantine) (keyBasedDownloadInfo, []string, error) {
+	var refused []string
+	for len(keys) > 0 {
+		info, err := getKeyBasedDownloadInfo(baseURL, token, keys)
+		if err != nil || !q.contains(info.Fingerprint) {
+			return info, refused, err
+		}
+
+		log.Warnf("The cache entry of the key (%s) is quarantined: %s", info.MatchedKey, info.Fingerprint)
+		refused = append(refused, info.Fingerprint)
+		keys = keys[matchingKeyIndex(keys, info.MatchedKey)+1:]
+	}
+	return keyBasedDownloadInfo{}, refused, errCacheNotFound
+}
+
+// matchingKeyIndex returns the index of the key matching the cache entry's key exactly or as a prefix.
+func matchingKeyIndex(keys []string, matchedKey string) int {
+	for i, key := range keys {
+		if key == matchedKey || strings.HasPrefix(matchedKey, key) {
+			return i
+		}
+	}
+	return len(keys) - 1
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const (
+	quarantinedFingerprint = "sha256:1111111111111111111111111111111111111111111111111111111111111111"
+	olderFingerprint       = "sha256:2222222222222222222222222222222222222222222222222222222222222222"
+)
+
+func TestParseQuarantine(t *testing.T) {
+	content := "# poisoned on 2024-03-01\n" + quarantinedFingerprint + "\n\n  " + strings.ToUpper(strings.TrimPrefix(olderFingerprint, "sha256:")) + " # no prefix\n"
+	got, err := parseQuarantine(content)
+	if err != nil {
+		t.Fatalf("parseQuarantine() error = %v", err)
+	}
+	want := quarantine{quarantinedFingerprint: true, olderFingerprint: true}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseQuarantine() = %v, want %v", got, want)
+	}
+
+	if _, err := parseQuarantine("sha256:abc"); err == nil {
+		t.Errorf("parseQuarantine() error = nil, want error for the truncated fingerprint")
+	}
+
+	if want.contains("") {
+		t.Errorf("contains() = true, want false for the unknown fingerprint")
+	}
+}
+
+func TestResolveUnquarantinedKey(t *testing.T) {
+	entries := map[string]string{
+		"deps-abc": quarantinedFingerprint,
+		"deps-old": olderFingerprint,
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keys := strings.Split(r.URL.Query().Get("cache_keys"), ",")
+		var matched string
+		switch keys[0] {
+		case "deps-abc":
+			matched = "deps-abc"
+		case "deps-":
+			matched = "deps-old"
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		body := `{"url": "https://cache.example.com/` + matched + `", "matched_cache_key": "` + matched + `", "fingerprint": "` + entries[matched] + `"}`
+		if _, err := w.Write([]byte(body)); err != nil {
+			t.Errorf("failed to write response: %s", err)
+		}
+	}))
+	defer server.Close()
+
+	q := quarantine{quarantinedFingerprint: true}
+
+	info, refused, err := resolveUnquarantinedKey(server.URL, "token", []string{"deps-abc", "deps-"}, q)
+	if err != nil {
+		t.Fatalf("resolveUnquarantinedKey() error = %v", err)
+	}
+	if info.MatchedKey != "deps-old" || !reflect.DeepEqual(refused, []string{quarantinedFingerprint}) {
+		t.Errorf("resolveUnquarantinedKey() = %s, %v, want the older entry", info.MatchedKey, refused)
+	}
+
+	t.Log("no older entry")
+	{
+		_, refused, err := resolveUnquarantinedKey(server.URL, "token", []string{"deps-abc"}, q)
+		if err != errCacheNotFound || len(refused) != 1 {
+			t.Errorf("resolveUnquarantinedKey() = %v, %v, want cache not found", refused, err)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+const redacted = "<redacted>"
+
+var (
+	// sensitiveParamPattern matches the values of the query parameters holding the presigned URLs' signatures and tokens
+	// (S3, GCS, Azure SAS) and the Bitrise API tokens.
+	sensitiveParamPattern = regexp.MustCompile(`(?i)([?&](?:x-amz-signature|x-amz-credential|x-amz-security-token|x-goog-signature|x-goog-credential|signature|sig|token|access_token|api_key)=)[^&\s"']+`)
+	// authHeaderPattern matches the credentials of Authorization headers.
+	authHeaderPattern = regexp.MustCompile(`(?i)((?:bearer|basic)\s+)[A-Za-z0-9\-._~+/]+=*`)
+)
+
+var (
+	secretsMu sync.RWMutex
+	secrets   []string
+)
+
+// addSecret registers a sensitive value (e.g. a secret input), to mask it wherever it appears in the log.
+func addSecret(secret string) {
+	if secret == "" {
+		return
+	}
+	secretsMu.Lock()
+	defer secretsMu.Unlock()
+	secrets = append(secrets, secret)
+}
+
+// redactSecrets masks the registered secrets, signatures and tokens in the given text,
+// while keeping the rest (host, path, non sensitive query parameters) for debugging.
+func redactSecrets(s string) string {
+	secretsMu.RLock()
+	for _, secret := range secrets {
+		s = strings.Replace(s, secret, redacted, -1)
+	}
+	secretsMu.RUnlock()
+
+	s = sensitiveParamPattern.ReplaceAllString(s, "${1}"+redacted)
+	return authHeaderPattern.ReplaceAllString(s, "${1}"+redacted)
+}
+
+// redactURL strips the query (usually holding the presigned URL's signature) from the URL.
+func redactURL(uri string) string {
+	if i := strings.Index(uri, "?"); i != -1 {
+		return redactSecrets(uri[:i]) + "?" + redacted
+	}
+	return redactSecrets(uri)
+}
+
+// redactingWriter masks the secrets in everything written to the underlying writer.
+type redactingWriter struct {
+	w io.Writer
+}
+
+func newRedactingWriter(w io.Writer) io.Writer {
+	return redactingWriter{w: w}
+}
+
+// Write implements the io.Writer interface.
+func (w redactingWriter) Write(p []byte) (int, error) {
+	if _, err := w.w.Write([]byte(redactSecrets(string(p)))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// parseAllowedHosts parses the comma or newline separated host patterns, a *. prefix matches the subdomains.
+func parseAllowedHosts(s string) ([]string, error) {
+	var hosts []string
+	for _, field := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == '\n' }) {
+		host := strings.ToLower(strings.TrimSpace(field))
+		if host == "" {
+			continue
+		}
+		if strings.ContainsAny(host, "/: \t") || strings.Contains(strings.TrimPrefix(host, "*."), "*") {
+			return nil, fmt.Errorf("invalid host (%s), expected a host name or *.<domain>", field)
+		}
+		hosts = append(hosts, host)
+	}
+	return hosts, nil
+}
+
+// hostAllowed reports whether the host matches any of the patterns, every host is allowed if there are no patterns.
+func hostAllowed(host string, patterns []string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	host = strings.ToLower(host)
+	for _, pattern := range patterns {
+		if domain := strings.TrimPrefix(pattern, "*"); domain != pattern {
+			if strings.HasSuffix(host, domain) {
+				return true
+			}
+		} else if host == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// newRedirectPolicy returns the http.Client's CheckRedirect function: it follows at most maxRedirects redirects,
+// only to the allowed hosts (any host if empty), and logs each redirect in debug mode.
+func newRedirectPolicy(maxRedirects int, allowedHosts []string) func(req *http.Request, via []*http.Request) error {
+	return func(req *http.Request, via []*http.Request) error {
+		status := 0
+		if req.Response != nil {
+			status = req.Response.StatusCode
+		}
+		log.Debugf("redirect (%d, %d): %s -> %s", len(via), status, redactSecrets(via[len(via)-1].URL.String()), redactSecrets(req.URL.String()))
+
+		if len(via) > maxRedirects {
+			return fmt.Errorf("stopped after %d redirect(s), see the max_redirects input", maxRedirects)
+		}
+		if !hostAllowed(req.URL.Hostname(), allowedHosts) {
+			return fmt.Errorf("redirect to a not allowed host (%s), see the redirect_allowed_hosts input", req.URL.Hostname())
+		}
+		return nil
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func Test_parseAllowedHosts(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    []string
+		wantErr bool
+	}{
+		{name: "empty", input: ""},
+		{name: "hosts", input: "Cache.example.com, *.cloudfront.net\n\ncdn.example.com\n", want: []string{"cache.example.com", "*.cloudfront.net", "cdn.example.com"}},
+		{name: "url", input: "https://cache.example.com", wantErr: true},
+		{name: "inner wildcard", input: "cache.*.com", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseAllowedHosts(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseAllowedHosts() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseAllowedHosts() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_hostAllowed(t *testing.T) {
+	patterns := []string{"cache.example.com", "*.cloudfront.net"}
+	tests := []struct {
+		host     string
+		patterns []string
+		want     bool
+	}{
+		{host: "anything.com", want: true},
+		{host: "CACHE.example.com", patterns: patterns, want: true},
+		{host: "d111.cloudfront.net", patterns: patterns, want: true},
+		{host: "cloudfront.net", patterns: patterns, want: false},
+		{host: "evilcloudfront.net", patterns: patterns, want: false},
+		{host: "example.com", patterns: patterns, want: false},
+	}
+	for _, tt := range tests {
+		if got := hostAllowed(tt.host, tt.patterns); got != tt.want {
+			t.Errorf("hostAllowed(%s, %v) = %v, want %v", tt.host, tt.patterns, got, tt.want)
+		}
+	}
+}
+
+func Test_newRedirectPolicy(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/hop1":
+			http.Redirect(w, r, "/hop2", http.StatusFound)
+		case "/hop2":
+			http.Redirect(w, r, "/archive", http.StatusTemporaryRedirect)
+		case "/external":
+			http.Redirect(w, r, "http://cdn.invalid/archive", http.StatusFound)
+		default:
+			if _, err := w.Write([]byte("archive")); err != nil {
+				t.Errorf("failed to write response: %s", err)
+			}
+		}
+	}))
+	defer server.Close()
+
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatalf("failed to parse server URL: %s", err)
+	}
+
+	tests := []struct {
+		name         string
+		path         string
+		maxRedirects int
+		allowedHosts []string
+		wantErr      string
+	}{
+		{name: "followed", path: "/hop1", maxRedirects: 2},
+		{name: "too many redirects", path: "/hop1", maxRedirects: 1, wantErr: "stopped after 1 redirect"},
+		{name: "no redirects", path: "/hop2", maxRedirects: 0, wantErr: "stopped after 0 redirect"},
+		{name: "allowed host", path: "/hop1", maxRedirects: 10, allowedHosts: []string{u.Hostname()}},
+		{name: "not allowed host", path: "/external", maxRedirects: 10, allowedHosts: []string{u.Hostname()}, wantErr: "not allowed host (cdn.invalid)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &http.Client{CheckRedirect: newRedirectPolicy(tt.maxRedirects, tt.allowedHosts)}
+			resp, err := client.Get(server.URL + tt.path)
+			if err == nil {
+				if cErr := resp.Body.Close(); cErr != nil {
+					t.Logf("failed to close response body: %s", cErr)
+				}
+			}
+
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("Get() error = %v, want nil", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("Get() error = %v, want %s", err, tt.wantErr)
+			}
+		})
+	}
+}
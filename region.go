@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// regionEnvKey is the env var exporting the region which served the archive, see the select_fastest_region input.
+const regionEnvKey = "BITRISE_CACHE_PULL_REGION"
+
+const (
+	// regionProbeSize is the number of bytes downloaded from each region to measure it.
+	regionProbeSize = 256 * 1024
+	// regionProbeTimeout is the time a region has to serve the probe, the slower regions are not selected.
+	regionProbeTimeout = 5 * time.Second
+)
+
+// regionalURL is a regional download URL of the archive, sent by the legacy cache API.
+type regionalURL struct {
+	Region string `json:"region"`
+	URL    string `json:"url"`
+}
+
+type regionProbe struct {
+	regionalURL
+	Duration time.Duration
+	Err      error
+}
+
+// probeRegions downloads the first regionProbeSize bytes of the archive from each region concurrently.
+// The probes are returned in the order of the regions.
+func probeRegions(regions []regionalURL, timeout time.Duration) []regionProbe {
+	client := &http.Client{Transport: http.DefaultClient.Transport, CheckRedirect: http.DefaultClient.CheckRedirect, Timeout: timeout}
+
+	probes := make([]regionProbe, len(regions))
+	var wg sync.WaitGroup
+	for i, region := range regions {
+		wg.Add(1)
+		go func(i int, region regionalURL) {
+			defer wg.Done()
+			start := time.Now()
+			err := probeRegion(client, region.URL)
+			probes[i] = regionProbe{regionalURL: region, Duration: time.Since(start), Err: err}
+		}(i, region)
+	}
+	wg.Wait()
+	return probes
+}
+
+func probeRegion(client *http.Client, uri string) error {
+	req, err := http.NewRequest("GET", uri, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=0-%d", regionProbeSize-1))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			log.Warnf("Failed to close response body: %s", err)
+		}
+	}()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		return fmt.Errorf("non success response code: %d", resp.StatusCode)
+	}
+	_, err = io.Copy(ioutil.Discard, io.LimitReader(resp.Body, regionProbeSize))
+	return err
+}
+
+// fastestRegion returns the region whose probe succeeded the fastest, false if every probe failed.
+func fastestRegion(probes []regionProbe) (regionProbe, bool) {
+	var fastest regionProbe
+	found := false
+	for _, probe := range probes {
+		if probe.Err != nil {
+			log.Debugf("Region (%s) probe failed: %s", probe.Region, probe.Err)
+			continue
+		}
+		log.Debugf("Region (%s) probe: %s", probe.Region, probe.Duration.Round(time.Millisecond))
+		if !found || probe.Duration < fastest.Duration {
+			fastest, found = probe, true
+		}
+	}
+	return fastest, found
+}
+
+// preferRegion makes the region's URL the download URL, the previous download URL becomes the first mirror.
+func preferRegion(info cacheDownloadInfo, region regionalURL) cacheDownloadInfo {
+	if region.URL == info.DownloadURL {
+		return info
+	}
+
+	var mirrors []string
+	for _, mirror := range append([]string{info.DownloadURL}, info.Mirrors...) {
+		if mirror != region.URL {
+			mirrors = append(mirrors, mirror)
+		}
+	}
+	info.DownloadURL, info.Mirrors = region.URL, mirrors
+	// the datacenters do not describe the reordered URLs
+	info.Datacenters = nil
+	return info
+}
+
+// selectFastestRegion probes the regional download URLs of the archive and downloads it from the fastest region.
+// The region is exported, if the archive has regional URLs.
+func selectFastestRegion(info cacheDownloadInfo) cacheDownloadInfo {
+	if len(info.Regions) == 0 {
+		return info
+	}
+
+	region := info.Regions[0]
+	if len(info.Regions) > 1 {
+		if fastest, ok := fastestRegion(probeRegions(info.Regions, regionProbeTimeout)); ok {
+			region = fastest.regionalURL
+			log.Printf("Fastest region: %s (%s)", region.Region, fastest.Duration.Round(time.Millisecond))
+		} else {
+			result.Warnf("Failed to probe the regions, using the default region (%s)", region.Region)
+		}
+	}
+
+	if err := exportEnv(regionEnvKey, region.Region); err != nil {
+		result.Warnf("%s", err)
+	}
+	result.Region = region.Region
+	return preferRegion(info, region)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestProbeRegions(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/slow":
+			time.Sleep(100 * time.Millisecond)
+		case "/missing":
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if _, err := w.Write([]byte("archive")); err != nil {
+			t.Errorf("failed to write response: %s", err)
+		}
+	}))
+	defer server.Close()
+
+	regions := []regionalURL{
+		{Region: "us", URL: server.URL + "/slow"},
+		{Region: "eu", URL: server.URL + "/fast"},
+		{Region: "ap", URL: server.URL + "/missing"},
+	}
+	probes := probeRegions(regions, time.Second)
+	if len(probes) != len(regions) {
+		t.Fatalf("probeRegions() returned %d probes, want %d", len(probes), len(regions))
+	}
+	if probes[2].Err == nil {
+		t.Errorf("probe of the missing archive should fail")
+	}
+
+	fastest, ok := fastestRegion(probes)
+	if !ok || fastest.Region != "eu" {
+		t.Errorf("fastestRegion() = %s, %v, want eu", fastest.Region, ok)
+	}
+
+	if _, ok := fastestRegion(probes[2:]); ok {
+		t.Errorf("fastestRegion() of the failed probes should not find a region")
+	}
+}
+
+func TestPreferRegion(t *testing.T) {
+	info := cacheDownloadInfo{
+		DownloadURL: "https://us.example.com/archive",
+		Mirrors:     []string{"https://eu.example.com/archive", "https://mirror.example.com/archive"},
+		Datacenters: []string{"us", "eu", "us"},
+	}
+
+	got := preferRegion(info, regionalURL{Region: "eu", URL: "https://eu.example.com/archive"})
+	want := []string{"https://eu.example.com/archive", "https://us.example.com/archive", "https://mirror.example.com/archive"}
+	if urls := append([]string{got.DownloadURL}, got.Mirrors...); !reflect.DeepEqual(urls, want) {
+		t.Errorf("preferRegion() urls = %v, want %v", urls, want)
+	}
+	if got.Datacenters != nil {
+		t.Errorf("preferRegion() datacenters = %v, want none", got.Datacenters)
+	}
+
+	if got := preferRegion(info, regionalURL{Region: "us", URL: "https://us.example.com/archive"}); !reflect.DeepEqual(got, info) {
+		t.Errorf("preferRegion() of the default region = %v, want %v", got, info)
+	}
+}
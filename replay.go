@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// replayIndexFileName is the fixture directory's list of the recorded HTTP interactions.
+const replayIndexFileName = "interactions.json"
+
+// interaction is a recorded HTTP request and its response, the response body is stored in the fixture directory.
+type interaction struct {
+	Method string `json:"method"`
+	URL    string `json:"url"`
+	// Range is the request's Range header, the ranged requests of the same URL are served different responses.
+	Range    string      `json:"range,omitempty"`
+	Status   int         `json:"status"`
+	Header   http.Header `json:"header,omitempty"`
+	BodyFile string      `json:"body_file,omitempty"`
+}
+
+// key identifies the requests served the interaction's response: the URL's query (e.g. the signature) is ignored.
+func (i interaction) key() string {
+	return i.Method + " " + withoutQuery(i.URL) + " " + i.Range
+}
+
+func withoutQuery(s string) string {
+	u, err := url.Parse(s)
+	if err != nil {
+		return s
+	}
+	u.RawQuery = ""
+	return u.String()
+}
+
+// replayTransport serves the responses recorded in the fixture directory (see the --replay mode), without network access.
+// The interactions of the same request are served in order, the last one is repeated.
+type replayTransport struct {
+	dir string
+
+	mu           sync.Mutex
+	interactions map[string][]interaction
+}
+
+// newReplayTransport loads the fixture directory's interactions.
+func newReplayTransport(dir string) (*replayTransport, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, replayIndexFileName))
+	if err != nil {
+		return nil, err
+	}
+	var recorded []interaction
+	if err := json.Unmarshal(b, &recorded); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %s", replayIndexFileName, err)
+	}
+
+	t := &replayTransport{dir: dir, interactions: map[string][]interaction{}}
+	for _, i := range recorded {
+		t.interactions[i.key()] = append(t.interactions[i.key()], i)
+	}
+	return t, nil
+}
+
+// RoundTrip implements the http.RoundTripper interface.
+func (t *replayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		if err := req.Body.Close(); err != nil {
+			return nil, err
+		}
+	}
+
+	key := interaction{Method: req.Method, URL: req.URL.String(), Range: req.Header.Get("Range")}.key()
+	t.mu.Lock()
+	queue := t.interactions[key]
+	if len(queue) == 0 {
+		t.mu.Unlock()
+		return nil, fmt.Errorf("no recorded interaction for %s", redactURL(key))
+	}
+	recorded := queue[0]
+	if len(queue) > 1 {
+		t.interactions[key] = queue[1:]
+	}
+	t.mu.Unlock()
+
+	body, size, err := t.openBody(recorded)
+	if err != nil {
+		return nil, err
+	}
+
+	header := http.Header{}
+	for k, v := range recorded.Header {
+		header[k] = v
+	}
+	if req.Method == "HEAD" {
+		// the HEAD responses have no body, but the Content-Length of the GET response
+		if size, err = strconv.ParseInt(header.Get("Content-Length"), 10, 64); err != nil {
+			size = -1
+		}
+	} else {
+		header.Set("Content-Length", strconv.FormatInt(size, 10))
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", recorded.Status, http.StatusText(recorded.Status)),
+		StatusCode:    recorded.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          body,
+		ContentLength: size,
+		Request:       req,
+	}, nil
+}
+
+// openBody opens the recorded response body and returns its size.
+func (t *replayTransport) openBody(recorded interaction) (io.ReadCloser, int64, error) {
+	if recorded.BodyFile == "" {
+		return ioutil.NopCloser(bytes.NewReader(nil)), 0, nil
+	}
+
+	f, err := os.Open(filepath.Join(t.dir, recorded.BodyFile))
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		if cErr := f.Close(); cErr != nil {
+			log.Warnf("Failed to close %s: %s", f.Name(), cErr)
+		}
+		return nil, 0, err
+	}
+	return f, info.Size(), nil
+}
+
+// recordTransport records the HTTP interactions into a fixture directory for the --replay mode (see the --record mode).
+// The response bodies are written to the directory while they are read. An interaction is added to the index
+// once its response body is closed, the index is rewritten after each one, so the interactions before a failure are kept.
+type recordTransport struct {
+	next http.RoundTripper
+	dir  string
+
+	mu           sync.Mutex
+	recorded     int
+	interactions []interaction
+}
+
+// newRecordTransport creates the fixture directory and records the interactions of next into it.
+func newRecordTransport(next http.RoundTripper, dir string) (*recordTransport, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &recordTransport{next: next, dir: dir}, nil
+}
+
+// RoundTrip implements the http.RoundTripper interface.
+func (t *recordTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+
+	t.mu.Lock()
+	t.recorded++
+	recorded := interaction{
+		Method:   req.Method,
+		URL:      withoutQuery(req.URL.String()),
+		Range:    req.Header.Get("Range"),
+		Status:   resp.StatusCode,
+		Header:   resp.Header,
+		BodyFile: fmt.Sprintf("body-%04d", t.recorded),
+	}
+	t.mu.Unlock()
+
+	f, err := os.Create(filepath.Join(t.dir, recorded.BodyFile))
+	if err != nil {
+		if cErr := resp.Body.Close(); cErr != nil {
+			log.Warnf("Failed to close response body: %s", cErr)
+		}
+		return nil, fmt.Errorf("failed to record interaction: %s", err)
+	}
+	resp.Body = &recordingBody{ReadCloser: resp.Body, file: f, onClose: func() error {
+		return t.record(recorded)
+	}}
+	return resp, nil
+}
+
+func (t *recordTransport) record(recorded interaction) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.interactions = append(t.interactions, recorded)
+	b, err := json.MarshalIndent(t.interactions, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(t.dir, replayIndexFileName), b, 0644)
+}
+
+// recordingBody writes the read response body into the file, and calls onClose once the body is closed.
+type recordingBody struct {
+	io.ReadCloser
+	file    *os.File
+	onClose func() error
+}
+
+// Read implements the io.Reader interface.
+func (b *recordingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if _, wErr := b.file.Write(p[:n]); wErr != nil {
+		return n, fmt.Errorf("failed to record interaction: %s", wErr)
+	}
+	return n, err
+}
+
+// Close implements the io.Closer interface.
+func (b *recordingBody) Close() error {
+	err := b.ReadCloser.Close()
+	if fErr := b.file.Close(); fErr != nil && err == nil {
+		err = fmt.Errorf("failed to record interaction: %s", fErr)
+	}
+	if rErr := b.onClose(); rErr != nil && err == nil {
+		err = fmt.Errorf("failed to record interaction: %s", rErr)
+	}
+	return err
+}
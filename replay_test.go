@@ -0,0 +1,94 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestRecordAndReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "replay-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Logf("failed to remove temp dir: %s", err)
+		}
+	}()
+
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Header.Get("Range") != "" {
+			w.WriteHeader(http.StatusPartialContent)
+			if _, err := w.Write([]byte("arch")); err != nil {
+				t.Errorf("failed to write response: %s", err)
+			}
+			return
+		}
+		if _, err := w.Write([]byte("archive " + r.URL.Query().Get("n"))); err != nil {
+			t.Errorf("failed to write response: %s", err)
+		}
+	}))
+	defer server.Close()
+
+	record, err := newRecordTransport(http.DefaultTransport, dir)
+	if err != nil {
+		t.Fatalf("newRecordTransport() error = %v", err)
+	}
+	client := &http.Client{Transport: record}
+	for _, uri := range []string{"/archive?n=1", "/archive?n=2"} {
+		if got := replayGet(t, client, server.URL+uri, ""); got != "archive "+uri[len(uri)-1:] {
+			t.Errorf("recorded response = %s", got)
+		}
+	}
+	replayGet(t, client, server.URL+"/archive", "bytes=0-3")
+
+	replay, err := newReplayTransport(dir)
+	if err != nil {
+		t.Fatalf("newReplayTransport() error = %v", err)
+	}
+	client = &http.Client{Transport: replay}
+	server.Close()
+
+	// the query is ignored, the responses are served in order and the last one is repeated
+	for _, want := range []string{"archive 1", "archive 2", "archive 2"} {
+		if got := replayGet(t, client, server.URL+"/archive?signature=x", ""); got != want {
+			t.Errorf("replayed response = %s, want %s", got, want)
+		}
+	}
+	if got := replayGet(t, client, server.URL+"/archive", "bytes=0-3"); got != "arch" {
+		t.Errorf("replayed ranged response = %s, want arch", got)
+	}
+	if _, err := client.Get(server.URL + "/missing"); err == nil {
+		t.Errorf("request without recorded interaction should fail")
+	}
+	if requests != 3 {
+		t.Errorf("requests = %d, want 3", requests)
+	}
+}
+
+func replayGet(t *testing.T, client *http.Client, uri, byteRange string) string {
+	req, err := http.NewRequest("GET", uri, nil)
+	if err != nil {
+		t.Fatalf("failed to create request: %s", err)
+	}
+	if byteRange != "" {
+		req.Header.Set("Range", byteRange)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %s", err)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("failed to read response: %s", err)
+	}
+	if err := resp.Body.Close(); err != nil {
+		t.Fatalf("failed to close response body: %s", err)
+	}
+	return string(b)
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/hex"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// Repository cache kinds, see repositoryCache.
+const (
+	repositoryCacheGradle = "gradle"
+	repositoryCacheMaven  = "maven"
+	repositoryCacheIvy    = "ivy"
+)
+
+// repositoryCache is a dependency manager's local artifact repository, verified after the restore.
+type repositoryCache struct {
+	Kind string
+	Path string
+}
+
+// gradleFilesDepth is the depth of the artifacts in Gradle's files cache: group/module/version/sha1/file.
+const gradleFilesDepth = 5
+
+// checksumSuffixes are the checksum files of the Maven and Ivy artifacts, the first existing one is verified.
+var checksumSuffixes = []struct {
+	Suffix string
+	New    func() hash.Hash
+}{
+	{Suffix: ".sha1", New: sha1.New},
+	{Suffix: ".md5", New: md5.New},
+}
+
+// repositoryCaches returns the Gradle (GRADLE_USER_HOME), Maven and Ivy repository caches of the user.
+func repositoryCaches() ([]repositoryCache, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil, err
+	}
+	return []repositoryCache{
+		{Kind: repositoryCacheGradle, Path: filepath.Join(gradleUserHome(home), "caches", "modules-2", "files-2.1")},
+		{Kind: repositoryCacheMaven, Path: filepath.Join(home, ".m2", "repository")},
+		{Kind: repositoryCacheIvy, Path: filepath.Join(home, ".ivy2", "cache")},
+	}, nil
+}
+
+// gradleUserHome returns Gradle's user home: GRADLE_USER_HOME, ~/.gradle by default.
+func gradleUserHome(home string) string {
+	if dir := os.Getenv("GRADLE_USER_HOME"); dir != "" {
+		return dir
+	}
+	return filepath.Join(home, ".gradle")
+}
+
+// fileHash returns the hex digest of the file.
+func fileHash(pth string, h hash.Hash) (string, error) {
+	f, err := os.Open(pth)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if err := f.Close(); err != nil {
+			log.Warnf("Failed to close %s: %s", pth, err)
+		}
+	}()
+
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// brokenEntries returns the entries of the repository cache not matching their checksum.
+func (c repositoryCache) brokenEntries() ([]string, error) {
+	if c.Kind == repositoryCacheGradle {
+		return brokenGradleEntries(c.Path)
+	}
+	return brokenChecksumEntries(c.Path)
+}
+
+// brokenGradleEntries returns the directories of Gradle's files cache whose file does not match the SHA1
+// the directory is named after (Gradle drops the hash's leading zeros), e.g. the files truncated by an interrupted download.
+func brokenGradleEntries(root string) ([]string, error) {
+	var broken []string
+	err := filepath.Walk(root, func(pth string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(root, pth)
+		if err != nil || len(strings.Split(rel, string(filepath.Separator))) != gradleFilesDepth {
+			return nil
+		}
+		dir := filepath.Dir(pth)
+		want := strings.TrimLeft(strings.ToLower(filepath.Base(dir)), "0")
+		if _, err := hex.DecodeString(strings.Repeat("0", len(want)%2) + want); err != nil {
+			return nil
+		}
+
+		got, err := fileHash(pth, sha1.New())
+		if err != nil {
+			return err
+		}
+		if strings.TrimLeft(got, "0") != want {
+			broken = append(broken, dir)
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	return broken, err
+}
+
+// brokenChecksumEntries returns the artifacts of a Maven or Ivy repository not matching their .sha1 (or .md5) file.
+// The artifacts without a checksum file are not verified.
+func brokenChecksumEntries(root string) ([]string, error) {
+	var broken []string
+	err := filepath.Walk(root, func(pth string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		for _, checksum := range checksumSuffixes {
+			if strings.HasSuffix(pth, checksum.Suffix) {
+				return nil
+			}
+		}
+
+		for _, checksum := range checksumSuffixes {
+			content, err := ioutil.ReadFile(pth + checksum.Suffix)
+			if os.IsNotExist(err) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			// the checksum may be followed by the file name (sha1sum's format)
+			fields := strings.Fields(string(content))
+			if len(fields) == 0 {
+				return nil
+			}
+
+			got, err := fileHash(pth, checksum.New())
+			if err != nil {
+				return err
+			}
+			if got != strings.ToLower(fields[0]) {
+				broken = append(broken, pth)
+			}
+			return nil
+		}
+		return nil
+	})
+	return broken, err
+}
+
+// removeBrokenEntry removes the broken entry of the repository cache, so the dependency manager downloads it again:
+// the hash directory of Gradle, the artifact and its checksum files of Maven and Ivy.
+func (c repositoryCache) removeBrokenEntry(pth string) error {
+	if c.Kind == repositoryCacheGradle {
+		return os.RemoveAll(pth)
+	}
+	for _, checksum := range checksumSuffixes {
+		if err := os.Remove(pth + checksum.Suffix); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Remove(pth)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeTestFiles(t *testing.T, files map[string]string) {
+	for pth, content := range files {
+		if err := os.MkdirAll(filepath.Dir(pth), 0755); err != nil {
+			t.Fatalf("failed to create dir: %s", err)
+		}
+		if err := ioutil.WriteFile(pth, []byte(content), 0644); err != nil {
+			t.Fatalf("failed to write %s: %s", pth, err)
+		}
+	}
+}
+
+func sha1Hex(s string) string {
+	sum := sha1.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestVerifyGradleRepositoryCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "repocache-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Logf("failed to remove temp dir: %s", err)
+		}
+	}()
+
+	valid := filepath.Join(dir, "com.squareup", "okio", "1.0", sha1Hex("okio jar"))
+	broken := filepath.Join(dir, "com.squareup", "okhttp", "1.0", sha1Hex("okhttp jar"))
+	writeTestFiles(t, map[string]string{
+		filepath.Join(valid, "okio-1.0.jar"):    "okio jar",
+		filepath.Join(broken, "okhttp-1.0.jar"): "okhttp j",
+	})
+
+	c := repositoryCache{Kind: repositoryCacheGradle, Path: dir}
+	got, err := c.brokenEntries()
+	if err != nil {
+		t.Fatalf("brokenEntries() error = %s", err)
+	}
+	if len(got) != 1 || got[0] != broken {
+		t.Fatalf("brokenEntries() = %v, want [%s]", got, broken)
+	}
+
+	if err := c.removeBrokenEntry(got[0]); err != nil {
+		t.Fatalf("removeBrokenEntry() error = %s", err)
+	}
+	if _, err := os.Stat(broken); !os.IsNotExist(err) {
+		t.Errorf("broken entry exists after removeBrokenEntry()")
+	}
+	if _, err := os.Stat(valid); err != nil {
+		t.Errorf("valid entry removed: %s", err)
+	}
+}
+
+func TestVerifyMavenRepositoryCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "repocache-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Logf("failed to remove temp dir: %s", err)
+		}
+	}()
+
+	version := filepath.Join(dir, "junit", "junit", "4.13")
+	writeTestFiles(t, map[string]string{
+		filepath.Join(version, "junit-4.13.jar"):       "junit jar",
+		filepath.Join(version, "junit-4.13.jar.sha1"):  sha1Hex("junit jar") + "  junit-4.13.jar\n",
+		filepath.Join(version, "junit-4.13.pom"):       "truncated pom",
+		filepath.Join(version, "junit-4.13.pom.sha1"):  sha1Hex("junit pom"),
+		filepath.Join(version, "junit-4.13.pom.md5"):   "ignored, the sha1 is verified",
+		filepath.Join(version, "_remote.repositories"): "no checksum",
+	})
+
+	c := repositoryCache{Kind: repositoryCacheMaven, Path: dir}
+	got, err := c.brokenEntries()
+	if err != nil {
+		t.Fatalf("brokenEntries() error = %s", err)
+	}
+	pom := filepath.Join(version, "junit-4.13.pom")
+	if len(got) != 1 || got[0] != pom {
+		t.Fatalf("brokenEntries() = %v, want [%s]", got, pom)
+	}
+
+	if err := c.removeBrokenEntry(pom); err != nil {
+		t.Fatalf("removeBrokenEntry() error = %s", err)
+	}
+	for _, name := range []string{"junit-4.13.pom", "junit-4.13.pom.sha1", "junit-4.13.pom.md5"} {
+		if _, err := os.Stat(filepath.Join(version, name)); !os.IsNotExist(err) {
+			t.Errorf("%s exists after removeBrokenEntry()", name)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(version, "junit-4.13.jar")); err != nil {
+		t.Errorf("valid artifact removed: %s", err)
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/bitrise-io/go-utils/command"
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// Pull statuses, see the result file's status field.
+const (
+	statusRestored         = "restored"
+	statusFallbackRestored = "fallback_restored"
+	statusSkipped          = "skipped"
+	statusUnchanged        = "unchanged"
+	statusPartial          = "partial"
+	statusVerified         = "verified"
+	statusMiss             = "miss"
+	statusFailed           = "failed"
+)
+
+const (
+	resultPathEnvKey      = "BITRISE_CACHE_PULL_RESULT_PATH"
+	junitResultPathEnvKey = "BITRISE_CACHE_PULL_JUNIT_RESULT_PATH"
+	partialEnvKey         = "BITRISE_CACHE_PULL_PARTIAL"
+)
+
+// PullResult summarizes the cache pull for the result file.
+type PullResult struct {
+	Status                   string             `json:"status"`
+	CacheURL                 string             `json:"cache_url,omitempty"`
+	CacheKey                 string             `json:"cache_key,omitempty"`
+	Intermediate             bool               `json:"intermediate,omitempty"`
+	Pinned                   bool               `json:"pinned,omitempty"`
+	Region                   string             `json:"region,omitempty"`
+	Quarantined              []string           `json:"quarantined,omitempty"`
+	Unlabeled                []string           `json:"unlabeled,omitempty"`
+	Truncated                []string           `json:"truncated,omitempty"`
+	BrokenArtifacts          []string           `json:"broken_artifacts,omitempty"`
+	ClearedModuleCaches      []string           `json:"cleared_module_caches,omitempty"`
+	SwiftPackages            string             `json:"swift_packages,omitempty"`
+	ClearedStalePaths        []string           `json:"cleared_stale_paths,omitempty"`
+	SkippedPlatformArtifacts []string           `json:"skipped_platform_artifacts,omitempty"`
+	CorruptPlatformArtifacts []string           `json:"corrupt_platform_artifacts,omitempty"`
+	ArchiveSize              int64              `json:"archive_size"`
+	Compressed               bool               `json:"compressed"`
+	Duration                 float64            `json:"duration_seconds"`
+	Phases                   map[string]float64 `json:"phase_durations_seconds"`
+	Warnings                 []string           `json:"warnings"`
+	Items                    []ItemResult       `json:"items,omitempty"`
+	Error                    string             `json:"error,omitempty"`
+	FailureClass             string             `json:"failure_class,omitempty"`
+
+	path       string
+	junit      bool
+	startTime  time.Time
+	phase      string
+	phaseStart time.Time
+	// phaseOrder are the recorded phases in their order.
+	phaseOrder []string
+	// section is the title of the current section, see StartSection.
+	section      string
+	sectionStart time.Time
+	// decompression is the time spent decompressing the archive, reported in the telemetry.
+	decompression time.Duration
+}
+
+// result is the current pull's result, written by failf too.
+var result *PullResult
+
+// NewPullResult creates a new PullResult written to the given path (if not empty).
+func NewPullResult(path string, junit bool) *PullResult {
+	return &PullResult{
+		Phases:    map[string]float64{},
+		Warnings:  []string{},
+		path:      path,
+		junit:     junit,
+		startTime: time.Now(),
+	}
+}
+
+// Warnf prints a warning and records it in the result.
+func (r *PullResult) Warnf(format string, args ...interface{}) {
+	log.Warnf(format, args...)
+	r.Warnings = append(r.Warnings, redactSecrets(fmt.Sprintf(format, args...)))
+}
+
+// StartPhase records the duration of the previous phase and starts measuring the given one.
+func (r *PullResult) StartPhase(name string) {
+	r.endPhase()
+	r.phase = name
+	r.phaseStart = time.Now()
+}
+
+func (r *PullResult) endPhase() {
+	if r.phase != "" {
+		if _, ok := r.Phases[r.phase]; !ok {
+			r.phaseOrder = append(r.phaseOrder, r.phase)
+		}
+		r.Phases[r.phase] = time.Since(r.phaseStart).Seconds()
+		r.phase = ""
+	}
+}
+
+// Finish sets the status, prints the summary and writes the result files.
+func (r *PullResult) Finish(status string, err error) {
+	r.endSection()
+	r.endPhase()
+	r.Status = status
+	if err != nil {
+		r.Error = redactSecrets(err.Error())
+	}
+	r.Duration = time.Since(r.startTime).Seconds()
+	if logFilter.quiet {
+		logFilter.Summaryf("%s", r.summary())
+	} else if logFilter.Enabled(logLevelInfo) {
+		log.Printf("")
+		if err := printSummaryBox(logFilter.w, "Cache pull summary", r.summaryRows(), summaryColor(r.Status)); err != nil {
+			log.Warnf("Failed to print summary: %s", err)
+		}
+	}
+
+	if r.path == "" {
+		return
+	}
+
+	if err := r.write(); err != nil {
+		log.Warnf("Failed to write result file: %s", err)
+	}
+}
+
+// summary is the one line summary of the pull, printed in quiet mode.
+func (r *PullResult) summary() string {
+	s := fmt.Sprintf("Cache pull %s in %s", r.Status, (time.Duration(r.Duration * float64(time.Second))).Round(time.Millisecond))
+	if r.ArchiveSize > 0 {
+		s += fmt.Sprintf(", archive: %s", formatBytes(r.ArchiveSize))
+	}
+	if r.CacheKey != "" {
+		s += fmt.Sprintf(", key: %s", r.CacheKey)
+	}
+	if len(r.Warnings) > 0 {
+		s += fmt.Sprintf(", %d warning(s)", len(r.Warnings))
+	}
+	if r.Error != "" {
+		s += fmt.Sprintf(", error: %s", r.Error)
+	}
+	return s
+}
+
+func (r *PullResult) write() error {
+	b, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(r.path, b, 0644); err != nil {
+		return err
+	}
+	if err := exportEnv(resultPathEnvKey, r.path); err != nil {
+		return err
+	}
+
+	if !r.junit {
+		return nil
+	}
+
+	junitPath := strings.TrimSuffix(r.path, ".json") + ".xml"
+	b, err = r.junitXML()
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(junitPath, b, 0644); err != nil {
+		return err
+	}
+	return exportEnv(junitResultPathEnvKey, junitPath)
+}
+
+type junitTestSuite struct {
+	XMLName   xml.Name        `xml:"testsuite"`
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	Skipped   int             `xml:"skipped,attr"`
+	Time      float64         `xml:"time,attr"`
+	TestCases []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      float64       `xml:"time,attr"`
+	Failure   *junitMessage `xml:"failure,omitempty"`
+	Skipped   *junitMessage `xml:"skipped,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitMessage struct {
+	Message string `xml:"message,attr"`
+}
+
+func (r *PullResult) junitXML() ([]byte, error) {
+	testCase := junitTestCase{
+		Name:      "cache restore",
+		ClassName: stepID,
+		Time:      r.Duration,
+		SystemOut: strings.Join(r.Warnings, "\n"),
+	}
+	suite := junitTestSuite{
+		Name:  stepID,
+		Tests: 1,
+		Time:  r.Duration,
+	}
+
+	switch r.Status {
+	case statusFailed:
+		testCase.Failure = &junitMessage{Message: r.Error}
+		suite.Failures = 1
+	case statusSkipped, statusMiss:
+		testCase.Skipped = &junitMessage{Message: strings.Join(r.Warnings, "; ")}
+		suite.Skipped = 1
+	}
+	suite.TestCases = []junitTestCase{testCase}
+
+	b, err := xml.MarshalIndent(suite, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), b...), nil
+}
+
+// exportEnv exports the env var with envman, for the next steps.
+func exportEnv(key, value string) error {
+	cmd := command.New("envman", "add", "--key", key, "--value", value)
+	if out, err := cmd.RunAndReturnTrimmedCombinedOutput(); err != nil {
+		return fmt.Errorf("failed to export %s: %s", key, out)
+	}
+	return nil
+}
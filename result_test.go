@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPullResult_Warnf(t *testing.T) {
+	r := NewPullResult("", false)
+	r.Warnf("Failed to download %s", "https://bucket/cache.tar?X-Amz-Signature=secret&partNumber=1")
+
+	want := []string{"Failed to download https://bucket/cache.tar?X-Amz-Signature=" + redacted + "&partNumber=1"}
+	if !reflect.DeepEqual(r.Warnings, want) {
+		t.Errorf("Warnings = %v, want %v", r.Warnings, want)
+	}
+}
+
+func TestPullResult_StartPhase(t *testing.T) {
+	r := NewPullResult("", false)
+	r.StartPhase("resolve")
+	r.StartPhase("download_and_extract")
+	r.StartPhase("resolve")
+	r.Finish(statusRestored, nil)
+
+	if want := []string{"resolve", "download_and_extract"}; !reflect.DeepEqual(r.phaseOrder, want) {
+		t.Errorf("phaseOrder = %v, want %v", r.phaseOrder, want)
+	}
+	if len(r.Phases) != 2 {
+		t.Errorf("Phases = %v, want the resolve and download_and_extract phases", r.Phases)
+	}
+}
+
+func TestPullResult_Finish(t *testing.T) {
+	r := NewPullResult("", false)
+	r.Finish(statusFailed, errors.New("failed to download https://bucket/cache.tar?token=secret"))
+
+	if r.Status != statusFailed {
+		t.Errorf("Status = %s, want %s", r.Status, statusFailed)
+	}
+	if want := "failed to download https://bucket/cache.tar?token=" + redacted; r.Error != want {
+		t.Errorf("Error = %s, want %s", r.Error, want)
+	}
+	if r.Duration <= 0 {
+		t.Errorf("Duration = %f, want the pull's duration", r.Duration)
+	}
+}
+
+func TestPullResult_summary(t *testing.T) {
+	tests := []struct {
+		name   string
+		result PullResult
+		want   string
+	}{
+		{
+			name:   "miss",
+			result: PullResult{Status: statusMiss, Duration: 1.5},
+			want:   "Cache pull miss in 1.5s",
+		},
+		{
+			name:   "restored",
+			result: PullResult{Status: statusRestored, Duration: 2, ArchiveSize: 2048, CacheKey: "npm-main", Warnings: []string{"slow"}},
+			want:   "Cache pull restored in 2s, archive: 2.0 KB, key: npm-main, 1 warning(s)",
+		},
+		{
+			name:   "failed",
+			result: PullResult{Status: statusFailed, Duration: 0.25, Error: "download failed"},
+			want:   "Cache pull failed in 250ms, error: download failed",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.result.summary(); got != tt.want {
+				t.Errorf("summary() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPullResult_junitXML(t *testing.T) {
+	tests := []struct {
+		name         string
+		result       PullResult
+		wantFailure  string
+		wantSkipped  string
+		wantFailures int
+		wantSkips    int
+	}{
+		{
+			name:   "restored",
+			result: PullResult{Status: statusRestored, Warnings: []string{"slow download"}},
+		},
+		{
+			name:         "failed",
+			result:       PullResult{Status: statusFailed, Error: "download failed"},
+			wantFailure:  "download failed",
+			wantFailures: 1,
+		},
+		{
+			name:        "miss",
+			result:      PullResult{Status: statusMiss, Warnings: []string{"cache not found", "no fallback"}},
+			wantSkipped: "cache not found; no fallback",
+			wantSkips:   1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := tt.result.junitXML()
+			if err != nil {
+				t.Fatalf("junitXML() error = %s", err)
+			}
+			if !strings.HasPrefix(string(b), xml.Header) {
+				t.Errorf("junitXML() has no XML header: %s", b)
+			}
+
+			var suite junitTestSuite
+			if err := xml.Unmarshal(b, &suite); err != nil {
+				t.Fatalf("failed to parse junit XML: %s", err)
+			}
+			if suite.Tests != 1 || len(suite.TestCases) != 1 || suite.Failures != tt.wantFailures || suite.Skipped != tt.wantSkips {
+				t.Fatalf("junitXML() = %+v, want 1 test case, %d failure(s), %d skipped", suite, tt.wantFailures, tt.wantSkips)
+			}
+
+			testCase := suite.TestCases[0]
+			if got := junitMessageText(testCase.Failure); got != tt.wantFailure {
+				t.Errorf("failure = %q, want %q", got, tt.wantFailure)
+			}
+			if got := junitMessageText(testCase.Skipped); got != tt.wantSkipped {
+				t.Errorf("skipped = %q, want %q", got, tt.wantSkipped)
+			}
+			if want := strings.Join(tt.result.Warnings, "\n"); testCase.SystemOut != want {
+				t.Errorf("system-out = %q, want %q", testCase.SystemOut, want)
+			}
+		})
+	}
+}
+
+func junitMessageText(m *junitMessage) string {
+	if m == nil {
+		return ""
+	}
+	return m.Message
+}
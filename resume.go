@@ -0,0 +1,264 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// partialDownloadMaxAge is the age of the other archives' partial downloads removed from the partial_downloads_dir.
+const partialDownloadMaxAge = 7 * 24 * time.Hour
+
+const partialDownloadExt = ".partial"
+
+// resumableDownload reads a remote archive, starting with the bytes persisted by an earlier, interrupted download
+// of the same archive (by its fingerprint), and persists the downloaded bytes after them.
+// At the end of the archive its checksum is verified (see Verify), an archive not matching its fingerprint is an error.
+// The persisted bytes are removed on Close, if the archive was read to its end (or discarded).
+type resumableDownload struct {
+	r           io.Reader
+	partial     *os.File
+	body        io.Closer
+	hash        hash.Hash
+	fingerprint string
+	// done is set at the end of the archive, or on Discard: the persisted bytes are not needed anymore
+	done   bool
+	err    error
+	closed bool
+}
+
+// fingerprintMismatchError is the error of a downloaded archive not matching its fingerprint.
+type fingerprintMismatchError struct {
+	checksum    string
+	fingerprint string
+}
+
+func (e *fingerprintMismatchError) Error() string {
+	return fmt.Sprintf("the downloaded archive (%s) does not match its fingerprint (%s)", e.checksum, e.fingerprint)
+}
+
+// errPartialDownloadInUse is returned by openResumableDownload, if another step run is downloading the same archive.
+var errPartialDownloadInUse = errors.New("the partial download is in use by another step")
+
+// partialDownloadPath returns the path of the archive's persisted bytes.
+func partialDownloadPath(dir, fingerprint string) string {
+	return filepath.Join(dir, strings.TrimPrefix(fingerprint, "sha256:")+partialDownloadExt)
+}
+
+// openResumableDownload starts the download of the archive at the end of its persisted bytes in dir.
+// The download restarts from the beginning, if the server does not serve the rest of the archive.
+func openResumableDownload(dir, fingerprint, uri string) (*resumableDownload, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	pth := partialDownloadPath(dir, fingerprint)
+	partial, err := os.OpenFile(pth, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	// the lock is released when the partial download is closed
+	if locked, err := tryLock(partial); err != nil || !locked {
+		if cErr := partial.Close(); cErr != nil {
+			log.Warnf("Failed to close %s: %s", pth, cErr)
+		}
+		if err == nil {
+			err = errPartialDownloadInUse
+		}
+		return nil, err
+	}
+	d, err := resumeDownload(partial, uri)
+	if err != nil {
+		if cErr := partial.Close(); cErr != nil {
+			log.Warnf("Failed to close %s: %s", pth, cErr)
+		}
+		return nil, err
+	}
+	d.fingerprint = fingerprint
+	return d, nil
+}
+
+func resumeDownload(partial *os.File, uri string) (*resumableDownload, error) {
+	offset, err := partial.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("GET", uri, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %s", err)
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	encoded := !isIdentityEncoding(resp.Header.Get("Content-Encoding"))
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && offset > 0 && !encoded && contentRangeStart(resp.Header.Get("Content-Range")) == offset:
+		log.Printf("Resuming the interrupted download of the archive at %s", formatBytes(offset))
+		head := io.NewSectionReader(partial, 0, offset)
+		return &resumableDownload{r: io.MultiReader(head, io.TeeReader(resp.Body, partial)), partial: partial, body: resp.Body, hash: sha256.New()}, nil
+	case resp.StatusCode == http.StatusOK && !encoded:
+		if offset > 0 {
+			log.Printf("The server does not serve the rest of the archive, restarting the download")
+		}
+		if err := partial.Truncate(0); err != nil {
+			closeBody(resp)
+			return nil, err
+		}
+		if _, err := partial.Seek(0, io.SeekStart); err != nil {
+			closeBody(resp)
+			return nil, err
+		}
+		return &resumableDownload{r: io.TeeReader(resp.Body, partial), partial: partial, body: resp.Body, hash: sha256.New()}, nil
+	case resp.StatusCode == http.StatusOK:
+		// the offsets of the encoded bytes are not the archive's, the download is not persisted
+		if err := partial.Truncate(0); err != nil {
+			closeBody(resp)
+			return nil, err
+		}
+		body, err := decodeContentEncoding(resp.Header, resp.Body)
+		if err != nil {
+			closeBody(resp)
+			return nil, err
+		}
+		return &resumableDownload{r: body, partial: partial, body: body, hash: sha256.New()}, nil
+	case (resp.StatusCode == http.StatusRequestedRangeNotSatisfiable || resp.StatusCode == http.StatusPartialContent) && offset > 0:
+		// the persisted bytes are all of the archive (or not the beginning of it), the range is encoded
+		// or it does not start at the end of the persisted bytes: restarting
+		closeBody(resp)
+		if err := partial.Truncate(0); err != nil {
+			return nil, err
+		}
+		return resumeDownload(partial, uri)
+	default:
+		defer closeBody(resp)
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("non success response code: %d, body: %s", resp.StatusCode, string(body))
+	}
+}
+
+// contentRangeStart returns the first byte position of the Content-Range header, -1 if it is not a byte range.
+func contentRangeStart(contentRange string) int64 {
+	rng := strings.TrimPrefix(strings.TrimSpace(contentRange), "bytes ")
+	i := strings.Index(rng, "-")
+	if i == -1 {
+		return -1
+	}
+	start, err := strconv.ParseInt(rng[:i], 10, 64)
+	if err != nil {
+		return -1
+	}
+	return start
+}
+
+func isIdentityEncoding(encoding string) bool {
+	encoding = strings.ToLower(strings.TrimSpace(encoding))
+	return encoding == "" || encoding == "identity"
+}
+
+func closeBody(resp *http.Response) {
+	if err := resp.Body.Close(); err != nil {
+		log.Warnf("Failed to close response body: %s", err)
+	}
+}
+
+// Read implements the io.Reader interface.
+func (d *resumableDownload) Read(p []byte) (int, error) {
+	if d.done {
+		if d.err != nil {
+			return 0, d.err
+		}
+		return 0, io.EOF
+	}
+
+	n, err := d.r.Read(p)
+	if _, hErr := d.hash.Write(p[:n]); hErr != nil {
+		return n, hErr
+	}
+	if err != io.EOF {
+		return n, err
+	}
+
+	d.done = true
+	if sum := formatChecksum(d.hash); sum != d.fingerprint {
+		d.err = &fingerprintMismatchError{checksum: sum, fingerprint: d.fingerprint}
+		return n, d.err
+	}
+	return n, io.EOF
+}
+
+// Verify returns the fingerprint mismatch of the archive, or an error if it was not read to its end.
+// The readers on top of the download (e.g. the decompression) may not return its errors as they are, so the
+// archive is verified by Verify after reading the stream.
+func (d *resumableDownload) Verify() error {
+	if !d.done {
+		return errors.New("the archive was not read to its end, it can not be verified")
+	}
+	return d.err
+}
+
+// Discard marks the persisted bytes to be removed on Close, e.g. the archive was downloaded again by the fallback.
+func (d *resumableDownload) Discard() {
+	d.done = true
+}
+
+// Close closes the download. The persisted bytes of an incomplete download are kept for the next pull,
+// the ones of an archive read to its end (matching its fingerprint or not) are removed.
+func (d *resumableDownload) Close() error {
+	if d.closed {
+		return nil
+	}
+	d.closed = true
+
+	if err := d.body.Close(); err != nil {
+		log.Warnf("Failed to close response body: %s", err)
+	}
+	pth := d.partial.Name()
+	if err := d.partial.Close(); err != nil {
+		return err
+	}
+	if d.done {
+		return os.Remove(pth)
+	}
+	return nil
+}
+
+// prunePartialDownloads removes the other archives' partial downloads older than maxAge.
+func prunePartialDownloads(dir, keep string, maxAge time.Duration, now time.Time) error {
+	matches, err := filepath.Glob(filepath.Join(dir, "*"+partialDownloadExt))
+	if err != nil {
+		return err
+	}
+	for _, pth := range matches {
+		if pth == keep {
+			continue
+		}
+		info, err := os.Stat(pth)
+		if err != nil || now.Sub(info.ModTime()) < maxAge {
+			continue
+		}
+		log.Debugf("Removing the old partial download: %s", pth)
+		if err := os.Remove(pth); err != nil {
+			return err
+		}
+	}
+	return nil
+}
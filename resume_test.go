@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResumableDownload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "resume-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Logf("failed to remove temp dir: %s", err)
+		}
+	}()
+
+	content := bytes.Repeat([]byte("archive content "), 1024)
+	var ranges []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		http.ServeContent(w, r, "cache.tar", time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+
+	h := sha256.New()
+	h.Write(content)
+	fingerprint := formatChecksum(h)
+	partial := partialDownloadPath(dir, fingerprint)
+
+	t.Log("the download resumes at the end of the persisted bytes")
+	{
+		if err := ioutil.WriteFile(partial, content[:1000], 0600); err != nil {
+			t.Fatalf("failed to write %s: %s", partial, err)
+		}
+
+		d, err := openResumableDownload(dir, fingerprint, server.URL)
+		if err != nil {
+			t.Fatalf("openResumableDownload() error = %s", err)
+		}
+		got, err := ioutil.ReadAll(d)
+		if err != nil {
+			t.Fatalf("ReadAll() error = %s", err)
+		}
+		if err := d.Close(); err != nil {
+			t.Errorf("Close() error = %s", err)
+		}
+
+		if !bytes.Equal(got, content) {
+			t.Errorf("read %d Bytes, want the %d Bytes of the content", len(got), len(content))
+		}
+		if want := "bytes=1000-"; len(ranges) != 1 || ranges[0] != want {
+			t.Errorf("requested ranges = %v, want [%s]", ranges, want)
+		}
+		if _, err := os.Stat(partial); !os.IsNotExist(err) {
+			t.Errorf("%s exists after the download", partial)
+		}
+	}
+
+	t.Log("an interrupted download keeps its persisted bytes")
+	{
+		d, err := openResumableDownload(dir, fingerprint, server.URL)
+		if err != nil {
+			t.Fatalf("openResumableDownload() error = %s", err)
+		}
+		buf := make([]byte, 2000)
+		if _, err := d.Read(buf); err != nil {
+			t.Fatalf("Read() error = %s", err)
+		}
+		if err := d.Verify(); err == nil {
+			t.Errorf("Verify() error = nil, want an error for the incomplete download")
+		}
+		if err := d.Close(); err != nil {
+			t.Errorf("Close() error = %s", err)
+		}
+		if info, err := os.Stat(partial); err != nil || info.Size() == 0 {
+			t.Errorf("the persisted bytes of the interrupted download: %v, %v", info, err)
+		}
+		if err := os.Remove(partial); err != nil {
+			t.Fatalf("failed to remove %s: %s", partial, err)
+		}
+	}
+
+	t.Log("the download not matching its fingerprint is an error")
+	{
+		wrong := "sha256:" + strings.Repeat("0", 64)
+		d, err := openResumableDownload(dir, wrong, server.URL)
+		if err != nil {
+			t.Fatalf("openResumableDownload() error = %s", err)
+		}
+		if _, err := ioutil.ReadAll(d); err == nil {
+			t.Errorf("ReadAll() error = nil, want a fingerprint mismatch")
+		}
+		// the readers on top of the download drain the stream after its error too
+		if _, err := d.Read(make([]byte, 10)); err == nil {
+			t.Errorf("Read() error = nil after the mismatch")
+		}
+		if _, ok := d.Verify().(*fingerprintMismatchError); !ok {
+			t.Errorf("Verify() error = %v, want a fingerprint mismatch", d.Verify())
+		}
+		if err := d.Close(); err != nil {
+			t.Errorf("Close() error = %s", err)
+		}
+		if _, err := os.Stat(partialDownloadPath(dir, wrong)); !os.IsNotExist(err) {
+			t.Errorf("%s exists after the mismatching download", partialDownloadPath(dir, wrong))
+		}
+	}
+
+	t.Log("the download restarts if the served range does not start at the end of the persisted bytes")
+	{
+		var misranges []string
+		misranged := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			misranges = append(misranges, r.Header.Get("Range"))
+			if r.Header.Get("Range") == "" {
+				if _, err := w.Write(content); err != nil {
+					t.Errorf("failed to write response: %s", err)
+				}
+				return
+			}
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes 0-%d/%d", len(content)-1, len(content)))
+			w.WriteHeader(http.StatusPartialContent)
+			if _, err := w.Write(content); err != nil {
+				t.Errorf("failed to write response: %s", err)
+			}
+		}))
+		defer misranged.Close()
+
+		if err := ioutil.WriteFile(partial, content[:1000], 0600); err != nil {
+			t.Fatalf("failed to write %s: %s", partial, err)
+		}
+		d, err := openResumableDownload(dir, fingerprint, misranged.URL)
+		if err != nil {
+			t.Fatalf("openResumableDownload() error = %s", err)
+		}
+		got, err := ioutil.ReadAll(d)
+		if err != nil {
+			t.Fatalf("ReadAll() error = %s", err)
+		}
+		if err := d.Close(); err != nil {
+			t.Errorf("Close() error = %s", err)
+		}
+
+		if !bytes.Equal(got, content) {
+			t.Errorf("read %d Bytes, want the %d Bytes of the content", len(got), len(content))
+		}
+		if want := []string{"bytes=1000-", ""}; !reflect.DeepEqual(misranges, want) {
+			t.Errorf("requested ranges = %q, want %q", misranges, want)
+		}
+	}
+
+	t.Log("a discarded download removes its persisted bytes")
+	{
+		d, err := openResumableDownload(dir, fingerprint, server.URL)
+		if err != nil {
+			t.Fatalf("openResumableDownload() error = %s", err)
+		}
+		if _, err := d.Read(make([]byte, 2000)); err != nil {
+			t.Fatalf("Read() error = %s", err)
+		}
+		d.Discard()
+		if err := d.Close(); err != nil {
+			t.Errorf("Close() error = %s", err)
+		}
+		if _, err := os.Stat(partial); !os.IsNotExist(err) {
+			t.Errorf("%s exists after the discarded download", partial)
+		}
+	}
+}
+
+func TestPrunePartialDownloads(t *testing.T) {
+	dir, err := ioutil.TempDir("", "resume-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Logf("failed to remove temp dir: %s", err)
+		}
+	}()
+
+	now := time.Now()
+	old := now.Add(-2 * partialDownloadMaxAge)
+	keep := filepath.Join(dir, "keep"+partialDownloadExt)
+	stale := filepath.Join(dir, "stale"+partialDownloadExt)
+	fresh := filepath.Join(dir, "fresh"+partialDownloadExt)
+	other := filepath.Join(dir, "other.txt")
+	for _, pth := range []string{keep, stale, fresh, other} {
+		if err := ioutil.WriteFile(pth, []byte("partial"), 0600); err != nil {
+			t.Fatalf("failed to write %s: %s", pth, err)
+		}
+	}
+	for _, pth := range []string{keep, stale, other} {
+		if err := os.Chtimes(pth, old, old); err != nil {
+			t.Fatalf("failed to set the times of %s: %s", pth, err)
+		}
+	}
+
+	if err := prunePartialDownloads(dir, keep, partialDownloadMaxAge, now); err != nil {
+		t.Fatalf("prunePartialDownloads() error = %s", err)
+	}
+	for pth, want := range map[string]bool{keep: true, stale: false, fresh: true, other: true} {
+		if _, err := os.Stat(pth); (err == nil) != want {
+			t.Errorf("%s exists = %v, want %v", filepath.Base(pth), err == nil, want)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// destinationRoot is a directory the relative archive entries are restored into, see the destination_roots input.
+type destinationRoot struct {
+	Dir string
+	// Include are the restored entries (relative to the root), every entry is restored if empty.
+	Include []string
+}
+
+// parseDestinationRoots parses the newline separated `<dir>[: <path>, <path>...]` list of the destination_roots input,
+// the relative directories are relative to dir.
+func parseDestinationRoots(s, dir string) ([]destinationRoot, error) {
+	var roots []destinationRoot
+	seen := map[string]bool{}
+	for _, line := range strings.Split(s, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		root := destinationRoot{Dir: line}
+		if i := strings.Index(line, ":"); i >= 0 {
+			root.Dir = strings.TrimSpace(line[:i])
+			for _, include := range strings.Split(line[i+1:], ",") {
+				include = strings.Trim(strings.TrimSpace(include), "/")
+				if include == "" {
+					continue
+				}
+				// validated after cleaning, a/../../b is not within the root either
+				cleaned := filepath.Clean(filepath.FromSlash(include))
+				if cleaned == "." || cleaned == ".." || strings.HasPrefix(cleaned, ".."+string(filepath.Separator)) || filepath.IsAbs(cleaned) {
+					return nil, fmt.Errorf("invalid destination root (%s): %s is not within the root", line, include)
+				}
+				root.Include = append(root.Include, cleaned)
+			}
+		}
+		if root.Dir == "" {
+			return nil, fmt.Errorf("invalid destination root (%s), use <dir>[: <path>, <path>...]", line)
+		}
+		if !filepath.IsAbs(root.Dir) {
+			root.Dir = filepath.Join(dir, root.Dir)
+		}
+		root.Dir = filepath.Clean(root.Dir)
+		if seen[root.Dir] {
+			return nil, fmt.Errorf("duplicated destination root: %s", root.Dir)
+		}
+		seen[root.Dir] = true
+		roots = append(roots, root)
+	}
+	return roots, nil
+}
+
+// restoreInto makes the Extractor restore into the first root, and its Replicas into the others.
+// The replicas only restore the entries, the large directories, path budgets, components and overwrites are the first root's.
+func (e *Extractor) restoreInto(roots []destinationRoot) {
+	if len(roots) == 0 {
+		return
+	}
+
+	template := *e
+	e.setRoot(roots[0])
+	for _, root := range roots[1:] {
+		replica := template
+		replica.seen = map[string]string{}
+		replica.links = map[string]bool{}
+		replica.LargeDirectories = nil
+		replica.Budgets = nil
+		replica.Components = nil
+		replica.AuditOverwrites = false
+		replica.Replicas = nil
+		replica.setRoot(root)
+		e.Replicas = append(e.Replicas, &replica)
+	}
+}
+
+func (e *Extractor) setRoot(root destinationRoot) {
+	e.Dir = root.Dir
+	if len(root.Include) == 0 {
+		return
+	}
+	e.Filter.Only = nil
+	for _, include := range root.Include {
+		e.Filter.Only = append(e.Filter.Only, filepath.Join(root.Dir, include))
+	}
+}
+
+// extractReplicated extracts the tar stream with the Extractor and its Replicas concurrently, the stream is read once.
+// A replica's failure fails the extraction.
+func (e *Extractor) extractReplicated(r io.Reader) error {
+	if len(e.Replicas) == 0 {
+		return e.Extract(r)
+	}
+
+	var wg sync.WaitGroup
+	writers := make([]io.Writer, len(e.Replicas))
+	pipes := make([]*io.PipeWriter, len(e.Replicas))
+	errs := make([]error, len(e.Replicas))
+	for i, replica := range e.Replicas {
+		pr, pw := io.Pipe()
+		writers[i], pipes[i] = pw, pw
+
+		wg.Add(1)
+		go func(i int, replica *Extractor) {
+			defer wg.Done()
+			err := replica.Extract(pr)
+			if err == nil {
+				// the rest of the stream (the archive's padding) is read, so the other extractions are not blocked
+				_, err = io.Copy(ioutil.Discard, pr)
+			}
+			if err != nil {
+				errs[i] = fmt.Errorf("failed to restore into %s: %s", replica.Dir, err)
+				pr.CloseWithError(errs[i])
+			}
+		}(i, replica)
+	}
+
+	err := e.Extract(io.TeeReader(r, io.MultiWriter(writers...)))
+	for _, pw := range pipes {
+		if err != nil {
+			pw.CloseWithError(err)
+		} else {
+			pw.Close()
+		}
+	}
+	wg.Wait()
+
+	if err != nil {
+		return err
+	}
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
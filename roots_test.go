@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseDestinationRoots(t *testing.T) {
+	tests := []struct {
+		name    string
+		s       string
+		want    []destinationRoot
+		wantErr bool
+	}{
+		{
+			name: "roots",
+			s:    "apps/ios: Pods, .bundle/\n\n/abs\napps/android:",
+			want: []destinationRoot{
+				{Dir: "/project/apps/ios", Include: []string{"Pods", ".bundle"}},
+				{Dir: "/abs"},
+				{Dir: "/project/apps/android"},
+			},
+		},
+		{name: "empty", s: "\n"},
+		{name: "missing dir", s: ": Pods", wantErr: true},
+		{name: "include outside root", s: "apps/ios: ../Pods", wantErr: true},
+		{name: "cleaned include outside root", s: "apps/ios: Pods/../../android", wantErr: true},
+		{name: "include of the whole root", s: "apps/ios: Pods/..", wantErr: true},
+		{name: "duplicated root", s: "apps/ios\napps/ios/: Pods", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseDestinationRoots(tt.s, "/project")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseDestinationRoots() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseDestinationRoots() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExtractor_restoreInto(t *testing.T) {
+	dir, err := ioutil.TempDir("", "destination-roots")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Logf("failed to remove temp dir: %s", err)
+		}
+	}()
+
+	var entries []testEntry
+	for _, name := range []string{"Pods/a.txt", "vendor/b.txt", "node_modules/c.txt"} {
+		// large enough entries to fill the pipes of the replicas
+		entries = append(entries, testEntry{name: name, content: string(bytes.Repeat([]byte(name), 64*1024))})
+	}
+	archive := createTestArchive(t, entries)
+
+	for _, compressed := range []bool{false, true} {
+		root := filepath.Join(dir, map[bool]string{false: "tar", true: "gzip"}[compressed])
+		roots, err := parseDestinationRoots("ios: Pods, vendor\nandroid\nweb: node_modules", root)
+		if err != nil {
+			t.Fatalf("parseDestinationRoots() error = %s", err)
+		}
+
+		extractor := NewExtractor(dir, true)
+		extractor.PipelineBuffer = stageBlockSize
+		extractor.restoreInto(roots)
+		if len(extractor.Replicas) != 2 {
+			t.Fatalf("restoreInto() = %d replicas, want 2", len(extractor.Replicas))
+		}
+
+		b := archive.Bytes()
+		if compressed {
+			b = gzipBytes(t, b)
+		}
+		if err := extractArchive(bytes.NewReader(b), extractor, compressed); err != nil {
+			t.Fatalf("extractArchive() error = %s", err)
+		}
+
+		for name, want := range map[string][]string{
+			"ios":     {"Pods", "vendor"},
+			"android": {"Pods", "node_modules", "vendor"},
+			"web":     {"node_modules"},
+		} {
+			got, err := readDirNames(filepath.Join(root, name))
+			if err != nil {
+				t.Fatalf("failed to read %s: %s", name, err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("compressed: %v, %s = %v, want %v", compressed, name, got, want)
+			}
+		}
+
+		content, err := ioutil.ReadFile(filepath.Join(root, "web", "node_modules", "c.txt"))
+		if err != nil {
+			t.Fatalf("failed to read restored file: %s", err)
+		}
+		if string(content) != entries[2].content {
+			t.Errorf("restored file differs from the archived one")
+		}
+	}
+}
+
+func TestExtractor_extractReplicated_failure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "destination-roots")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Logf("failed to remove temp dir: %s", err)
+		}
+	}()
+
+	// a file where the replica's root would be
+	if err := ioutil.WriteFile(filepath.Join(dir, "blocked"), nil, 0644); err != nil {
+		t.Fatalf("failed to write file: %s", err)
+	}
+
+	extractor := NewExtractor(dir, true)
+	extractor.restoreInto([]destinationRoot{{Dir: filepath.Join(dir, "ok")}, {Dir: filepath.Join(dir, "blocked")}})
+	archive := createTestArchive(t, []testEntry{{name: "Pods/a.txt", content: "a"}})
+	if err := extractor.extractReplicated(archive); err == nil {
+		t.Errorf("extractReplicated() error = nil, want the replica's error")
+	}
+}
+
+func TestExtractor_extractReplicated_outsideRoot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "destination-roots")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Logf("failed to remove temp dir: %s", err)
+		}
+	}()
+
+	roots, err := parseDestinationRoots("apps/ios\napps/android", dir)
+	if err != nil {
+		t.Fatalf("parseDestinationRoots() error = %s", err)
+	}
+	extractor := NewExtractor(dir, true)
+	extractor.restoreInto(roots)
+	archive := createTestArchive(t, []testEntry{{name: "../escaped.txt", content: "escaped"}})
+	if err := extractor.extractReplicated(archive); err == nil {
+		t.Errorf("extractReplicated() error = nil, want an error for the entry outside of the roots")
+	}
+	if _, err := os.Lstat(filepath.Join(dir, "apps", "escaped.txt")); err == nil {
+		t.Errorf("escaped.txt is restored outside of the roots")
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+const (
+	runDirPrefix    = "run-"
+	runLockFileName = "run.lock"
+	// runsLockTimeout is the wait for the other step runs creating or removing their run directories.
+	runsLockTimeout = 30 * time.Second
+)
+
+// stepRunDir is the directory of the current step run's temporary files (e.g. the downloaded archive), in the
+// tenant's temporary directory (see createRunDir), so the concurrent step runs don't overwrite each other's files.
+var stepRunDir = os.TempDir()
+
+// runLock is the lock of the current step run's directory, held until the step exits.
+var runLock *fileLock
+
+// createTempFile creates a new temporary file in the step run's directory, see ioutil.TempFile.
+// The files not removed by the step (e.g. interrupted by an error) are removed with the directory when the step exits.
+func createTempFile(pattern string) (*os.File, error) {
+	return ioutil.TempFile(stepRunDir, pattern)
+}
+
+// createRunDir creates the current step run's directory in dir/runs, and locks it until the step exits.
+// The directories of the finished (or crashed) earlier runs are removed.
+func createRunDir(dir string) (string, *fileLock, error) {
+	root := filepath.Join(dir, "runs")
+	if err := ensurePrivateDir(root); err != nil {
+		return "", nil, err
+	}
+
+	// the run directories are created and removed by one step run at a time,
+	// so a new directory is not removed before it is locked
+	rootLock, err := lockFile(filepath.Join(root, ".lock"), runsLockTimeout)
+	if err != nil {
+		return "", nil, err
+	}
+	defer func() {
+		if err := rootLock.Unlock(); err != nil {
+			log.Warnf("Failed to release the lock of %s: %s", root, err)
+		}
+	}()
+
+	removed, err := pruneRunDirs(root)
+	for _, pth := range removed {
+		log.Debugf("Removed the temporary directory of an earlier step run: %s", pth)
+	}
+	if err != nil {
+		log.Warnf("Failed to remove the temporary directories of the earlier step runs: %s", err)
+	}
+
+	runDir, err := ioutil.TempDir(root, runDirPrefix)
+	if err != nil {
+		return "", nil, err
+	}
+	l, err := tryLockFile(filepath.Join(runDir, runLockFileName))
+	if err == nil && l == nil {
+		err = os.ErrExist
+	}
+	if err != nil {
+		if rErr := os.RemoveAll(runDir); rErr != nil {
+			log.Warnf("Failed to remove %s: %s", runDir, rErr)
+		}
+		return "", nil, err
+	}
+	return runDir, l, nil
+}
+
+// pruneRunDirs removes the run directories in root which are not locked by a running step, and returns them.
+func pruneRunDirs(root string) ([]string, error) {
+	infos, err := ioutil.ReadDir(root)
+	if err != nil {
+		return nil, err
+	}
+
+	var removed []string
+	for _, info := range infos {
+		if !info.IsDir() || !strings.HasPrefix(info.Name(), runDirPrefix) {
+			continue
+		}
+		pth := filepath.Join(root, info.Name())
+		l, err := tryLockFile(filepath.Join(pth, runLockFileName))
+		if err != nil {
+			return removed, err
+		}
+		if l == nil {
+			// a running step's directory
+			continue
+		}
+		err = os.RemoveAll(pth)
+		if uErr := l.Unlock(); uErr != nil {
+			log.Debugf("Failed to release the lock of %s: %s", pth, uErr)
+		}
+		if err != nil {
+			return removed, err
+		}
+		removed = append(removed, pth)
+	}
+	return removed, nil
+}
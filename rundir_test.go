@@ -0,0 +1,96 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestCreateRunDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rundir-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Logf("failed to remove temp dir: %s", err)
+		}
+	}()
+
+	running, runningLock, err := createRunDir(dir)
+	if err != nil {
+		t.Fatalf("createRunDir() error = %v", err)
+	}
+	defer func() {
+		if err := runningLock.Unlock(); err != nil {
+			t.Logf("failed to unlock: %s", err)
+		}
+	}()
+	if err := ioutil.WriteFile(filepath.Join(running, "cache-archive.tar"), []byte("running"), 0600); err != nil {
+		t.Fatalf("failed to write file: %s", err)
+	}
+
+	finished, finishedLock, err := createRunDir(dir)
+	if err != nil {
+		t.Fatalf("createRunDir() error = %v", err)
+	}
+	if err := finishedLock.Unlock(); err != nil {
+		t.Fatalf("failed to unlock: %s", err)
+	}
+	// a crashed run, without its lock file
+	crashed := filepath.Join(dir, "runs", runDirPrefix+"crashed")
+	if err := os.Mkdir(crashed, 0700); err != nil {
+		t.Fatalf("failed to create dir: %s", err)
+	}
+
+	current, currentLock, err := createRunDir(dir)
+	if err != nil {
+		t.Fatalf("createRunDir() error = %v", err)
+	}
+	defer func() {
+		if err := currentLock.Unlock(); err != nil {
+			t.Logf("failed to unlock: %s", err)
+		}
+	}()
+	if current == running || filepath.Dir(current) != filepath.Join(dir, "runs") {
+		t.Errorf("createRunDir() = %s, want a new directory in %s", current, filepath.Join(dir, "runs"))
+	}
+
+	for pth, wantExists := range map[string]bool{running: true, current: true, finished: false, crashed: false} {
+		if _, err := os.Stat(pth); (err == nil) != wantExists {
+			t.Errorf("%s exists = %v, want %v", pth, err == nil, wantExists)
+		}
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(running, "cache-archive.tar")); err != nil || !reflect.DeepEqual(b, []byte("running")) {
+		t.Errorf("the running step's file = %s, %v, want unchanged", b, err)
+	}
+}
+
+func TestCreateTempFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rundir-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Logf("failed to remove temp dir: %s", err)
+		}
+	}()
+
+	original := stepRunDir
+	stepRunDir = dir
+	defer func() { stepRunDir = original }()
+
+	f, err := createTempFile("cache-archive-part-000-")
+	if err != nil {
+		t.Fatalf("createTempFile() error = %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("failed to close %s: %s", f.Name(), err)
+	}
+	if filepath.Dir(f.Name()) != dir {
+		t.Errorf("createTempFile() = %s, want a file in the step run's directory (%s)", f.Name(), dir)
+	}
+}
@@ -0,0 +1,11 @@
+package main
+
+import "github.com/bitrise-steplib/steps-cache-pull/pkg/cachepull"
+
+// archiveSchemaVersion is the newest schema version this step restores every feature of, see cachepull.SchemaVersion.
+const archiveSchemaVersion = cachepull.SchemaVersion
+
+// checkArchiveSchema checks the compatibility of the archive with this step, see cachepull.CheckSchema.
+func checkArchiveSchema(info archiveInfo) (string, error) {
+	return cachepull.CheckSchema(info.SchemaVersion, info.MinReaderVersion)
+}
@@ -0,0 +1,28 @@
+package main
+
+import "testing"
+
+func TestCheckArchiveSchema(t *testing.T) {
+	tests := []struct {
+		name        string
+		info        archiveInfo
+		wantWarning bool
+		wantErr     bool
+	}{
+		{name: "no schema version", info: archiveInfo{StackID: "osx-xcode-15"}},
+		{name: "current", info: archiveInfo{SchemaVersion: archiveSchemaVersion, MinReaderVersion: 1}},
+		{name: "newer, readable", info: archiveInfo{SchemaVersion: archiveSchemaVersion + 1, MinReaderVersion: archiveSchemaVersion}, wantWarning: true},
+		{name: "newer, not readable", info: archiveInfo{SchemaVersion: archiveSchemaVersion + 1, MinReaderVersion: archiveSchemaVersion + 1}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			warning, err := checkArchiveSchema(tt.info)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("checkArchiveSchema() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if (warning != "") != tt.wantWarning {
+				t.Errorf("checkArchiveSchema() warning = %q, wantWarning %v", warning, tt.wantWarning)
+			}
+		})
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/bitrise-io/go-utils/colorstring"
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// summaryMaxWidth is the maximal width (in terminal columns) of the values in the summary box, longer ones are truncated.
+const summaryMaxWidth = 80
+
+// StartSection prints the header of the next section of the pull, and the duration of the previous one.
+// If phase is not empty, the section starts the phase of the result (see StartPhase), otherwise the current phase goes on.
+func (r *PullResult) StartSection(phase, format string, args ...interface{}) {
+	r.endSection()
+	if phase != "" {
+		r.StartPhase(phase)
+	}
+	r.section = fmt.Sprintf(format, args...)
+	r.sectionStart = time.Now()
+
+	log.Printf("")
+	log.Infof("%s", r.section)
+}
+
+func (r *PullResult) endSection() {
+	if r.section == "" {
+		return
+	}
+	log.Donef("%s: done in %s", r.section, time.Since(r.sectionStart).Round(time.Millisecond))
+	r.section = ""
+}
+
+// summaryRows returns the rows of the summary box: the status, the restored cache, the phases' and the total durations.
+func (r *PullResult) summaryRows() [][2]string {
+	rows := [][2]string{{"Status", r.Status}}
+	if r.CacheKey != "" {
+		rows = append(rows, [2]string{"Cache key", r.CacheKey})
+	}
+	if r.ArchiveSize > 0 {
+		size := formatBytes(r.ArchiveSize)
+		if r.Compressed {
+			size += " (compressed)"
+		}
+		rows = append(rows, [2]string{"Archive", size})
+	}
+	for _, phase := range r.phaseOrder {
+		rows = append(rows, [2]string{strings.Replace(phase, "_", " ", -1), formatSeconds(r.Phases[phase])})
+	}
+	rows = append(rows, [2]string{"Total", formatSeconds(r.Duration)})
+	if len(r.Warnings) > 0 {
+		rows = append(rows, [2]string{"Warnings", fmt.Sprintf("%d", len(r.Warnings))})
+	}
+	if r.Error != "" {
+		rows = append(rows, [2]string{"Error", r.Error})
+	}
+	return rows
+}
+
+// summaryColor returns the color of the status' summary box.
+func summaryColor(status string) colorstring.ColorfFunc {
+	switch status {
+	case statusRestored, statusUnchanged, statusVerified:
+		return colorstring.Greenf
+	case statusFailed:
+		return colorstring.Redf
+	default:
+		return colorstring.Yellowf
+	}
+}
+
+// printSummaryBox prints the rows in a box of the color. The box is aligned by the values' terminal width,
+// so the non-ASCII keys and errors (wide or combining characters) do not break it.
+func printSummaryBox(w io.Writer, title string, rows [][2]string, color colorstring.ColorfFunc) error {
+	labelWidth := 0
+	for _, row := range rows {
+		if width := displayWidth(row[0]); width > labelWidth {
+			labelWidth = width
+		}
+	}
+
+	lines := make([]string, len(rows))
+	width := displayWidth(title)
+	for i, row := range rows {
+		lines[i] = padRight(row[0], labelWidth) + "  " + truncateWidth(row[1], summaryMaxWidth)
+		if lw := displayWidth(lines[i]); lw > width {
+			width = lw
+		}
+	}
+
+	border := strings.Repeat("─", width+2)
+	out := []string{
+		color("┌%s┐", border),
+		color("│ %s │", padRight(title, width)),
+		color("├%s┤", border),
+	}
+	for _, line := range lines {
+		out = append(out, color("│ ")+padRight(line, width)+color(" │"))
+	}
+	out = append(out, color("└%s┘", border))
+
+	_, err := fmt.Fprintln(w, strings.Join(out, "\n"))
+	return err
+}
+
+// displayWidth returns the number of terminal columns of the string: the East Asian wide characters take two columns,
+// the combining marks, the format and the control characters none.
+func displayWidth(s string) int {
+	width := 0
+	for _, r := range s {
+		width += runeWidth(r)
+	}
+	return width
+}
+
+func runeWidth(r rune) int {
+	switch {
+	case unicode.Is(unicode.Mn, r) || unicode.Is(unicode.Me, r) || unicode.Is(unicode.Cf, r) || unicode.IsControl(r):
+		return 0
+	case r >= 0x1100 && r <= 0x115f, // Hangul Jamo
+		r >= 0x2e80 && r <= 0xa4cf && r != 0x303f,              // CJK, Kana, Yi
+		r >= 0xac00 && r <= 0xd7a3,                             // Hangul syllables
+		r >= 0xf900 && r <= 0xfaff,                             // CJK compatibility ideographs
+		r >= 0xfe30 && r <= 0xfe4f,                             // CJK compatibility forms
+		r >= 0xff00 && r <= 0xff60, r >= 0xffe0 && r <= 0xffe6, // fullwidth forms
+		r >= 0x1f300 && r <= 0x1f6ff, r >= 0x1f900 && r <= 0x1f9ff, // emoji
+		r >= 0x20000 && r <= 0x3fffd: // CJK extensions
+		return 2
+	default:
+		return 1
+	}
+}
+
+// padRight pads the string with spaces to the terminal width.
+func padRight(s string, width int) string {
+	if pad := width - displayWidth(s); pad > 0 {
+		return s + strings.Repeat(" ", pad)
+	}
+	return s
+}
+
+// truncateWidth truncates the string to the terminal width (with an ellipsis), at a character boundary.
+// Its new lines are replaced, so a multiline value does not break the box.
+func truncateWidth(s string, width int) string {
+	s = strings.Join(strings.Fields(s), " ")
+	if displayWidth(s) <= width {
+		return s
+	}
+
+	var b strings.Builder
+	used := 0
+	for _, r := range s {
+		rw := runeWidth(r)
+		if used+rw > width-1 {
+			break
+		}
+		b.WriteRune(r)
+		used += rw
+	}
+	return b.String() + "…"
+}
+
+// formatSeconds formats the duration in seconds, rounded to milliseconds.
+func formatSeconds(seconds float64) string {
+	return time.Duration(seconds * float64(time.Second)).Round(time.Millisecond).String()
+}
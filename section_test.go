@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/bitrise-io/go-utils/colorstring"
+)
+
+func Test_displayWidth(t *testing.T) {
+	tests := []struct {
+		s    string
+		want int
+	}{
+		{s: "npm-main", want: 8},
+		{s: "キャッシュ", want: 10},
+		{s: "cafe\u0301", want: 4},
+		{s: "a\u200bb", want: 2},
+		{s: "build-🚀", want: 8},
+	}
+	for _, tt := range tests {
+		if got := displayWidth(tt.s); got != tt.want {
+			t.Errorf("displayWidth(%q) = %d, want %d", tt.s, got, tt.want)
+		}
+	}
+}
+
+func Test_truncateWidth(t *testing.T) {
+	tests := []struct {
+		s     string
+		width int
+		want  string
+	}{
+		{s: "short", width: 10, want: "short"},
+		{s: "first line\nsecond line", width: 30, want: "first line second line"},
+		{s: "abcdefghij", width: 5, want: "abcd…"},
+		{s: "キャッシュキー", width: 6, want: "キャ…"},
+	}
+	for _, tt := range tests {
+		got := truncateWidth(tt.s, tt.width)
+		if got != tt.want {
+			t.Errorf("truncateWidth(%q, %d) = %q, want %q", tt.s, tt.width, got, tt.want)
+		}
+		if displayWidth(got) > tt.width {
+			t.Errorf("truncateWidth(%q, %d) width = %d", tt.s, tt.width, displayWidth(got))
+		}
+	}
+}
+
+func Test_printSummaryBox(t *testing.T) {
+	rows := [][2]string{
+		{"Status", statusRestored},
+		{"Cache key", "npm-キャッシュ-cafe\u0301"},
+		{"Error", strings.Repeat("x", 2*summaryMaxWidth)},
+	}
+
+	var buf bytes.Buffer
+	if err := printSummaryBox(&buf, "Cache pull summary", rows, colorstring.NoColorf); err != nil {
+		t.Fatalf("printSummaryBox() error = %v", err)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != len(rows)+4 {
+		t.Fatalf("printSummaryBox() = %d lines, want %d:\n%s", len(lines), len(rows)+4, buf.String())
+	}
+	width := displayWidth(lines[0])
+	for _, line := range lines {
+		if got := displayWidth(line); got != width {
+			t.Errorf("printSummaryBox() line width = %d, want %d:\n%s", got, width, buf.String())
+		}
+	}
+	if !strings.Contains(buf.String(), "npm-キャッシュ-cafe\u0301") {
+		t.Errorf("printSummaryBox() = %s, want the cache key", buf.String())
+	}
+}
+
+func TestPullResult_summaryRows(t *testing.T) {
+	r := NewPullResult("", false)
+	r.StartPhase("resolve")
+	r.StartPhase("download_and_extract")
+	r.StartPhase("resolve")
+	r.endPhase()
+	r.Status = statusRestored
+	r.CacheKey = "npm-main"
+
+	var labels []string
+	for _, row := range r.summaryRows() {
+		labels = append(labels, row[0])
+	}
+	if got, want := strings.Join(labels, ","), "Status,Cache key,resolve,download and extract,Total"; got != want {
+		t.Errorf("summaryRows() labels = %s, want %s", got, want)
+	}
+}
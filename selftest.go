@@ -0,0 +1,232 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+const (
+	selfTestContent = "cache-pull self-test"
+	// selfTestSparseSize is the size of the self-test's sparse file, its only data is at its end.
+	selfTestSparseSize = 8 * 1024 * 1024
+)
+
+// selfTestNames are the entry names of the self-test archive.
+var selfTestNames = struct {
+	File, Symlink, Hardlink, NFC, NFD, LongPath, Sparse string
+}{
+	File:     "file.txt",
+	Symlink:  "symlink",
+	Hardlink: "hardlink",
+	NFC:      "unicode/caf\u00e9-\u65e5\u672c\u8a9e.txt",
+	NFD:      "unicode/cafe\u0301-nfd.txt",
+	LongPath: strings.Repeat("long-directory-name/", 15) + "file.txt",
+	Sparse:   "sparse.img",
+}
+
+// selfTestCheck is a restored feature of the self-test and its problem on the current stack, if any.
+type selfTestCheck struct {
+	Name string
+	Err  error
+}
+
+// runSelfTest extracts a synthetic archive (symlinks, hard links, unicode names, long paths, sparse files) on the current stack
+// and reports the features not restored correctly, see the --selftest mode.
+func runSelfTest() error {
+	dir, err := ioutil.TempDir("", "cache-pull-selftest")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			log.Warnf("Failed to remove %s: %s", dir, err)
+		}
+	}()
+
+	checks := selfTest(dir)
+	printSelfTestChecks(checks)
+	if insensitive, err := isCaseInsensitiveFS(dir); err == nil && insensitive {
+		log.Printf("The filesystem is case-insensitive, the colliding archive entries are handled by the case_collision_policy input")
+	}
+
+	failed := 0
+	for _, check := range checks {
+		if check.Err != nil {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of the %d checks failed on this stack", failed, len(checks))
+	}
+	return nil
+}
+
+// selfTest extracts the self-test archive into dir and checks the restored entries.
+func selfTest(dir string) []selfTestCheck {
+	archive, err := selfTestArchive()
+	if err != nil {
+		return []selfTestCheck{{Name: "archive", Err: err}}
+	}
+
+	extractor := NewExtractor(dir, true)
+	extractor.SparsePaths = []string{filepath.Join(dir, selfTestNames.Sparse)}
+	if err := extractor.Extract(bytes.NewReader(archive)); err != nil {
+		return []selfTestCheck{{Name: "extraction", Err: err}}
+	}
+
+	pth := func(name string) string { return filepath.Join(dir, name) }
+	checks := []selfTestCheck{
+		{Name: "regular file", Err: checkSelfTestFile(pth(selfTestNames.File))},
+		{Name: "symlink", Err: checkSelfTestSymlink(pth(selfTestNames.Symlink), selfTestNames.File)},
+		{Name: "hard link", Err: checkSelfTestHardlink(pth(selfTestNames.Hardlink), pth(selfTestNames.File), extractor.CopiedLinks)},
+		{Name: "unicode names", Err: checkSelfTestUnicode(pth("unicode"), selfTestNames.NFC, selfTestNames.NFD)},
+		{Name: "long path", Err: checkSelfTestFile(pth(selfTestNames.LongPath))},
+		{Name: "sparse file", Err: checkSelfTestSparse(pth(selfTestNames.Sparse))},
+	}
+	for _, tool := range []string{"tar", "zstd"} {
+		_, err := exec.LookPath(tool)
+		checks = append(checks, selfTestCheck{Name: tool + " tool", Err: err})
+	}
+	return checks
+}
+
+// selfTestArchive returns the self-test tar archive.
+func selfTestArchive() ([]byte, error) {
+	var b bytes.Buffer
+	w := tar.NewWriter(&b)
+	modTime := time.Now().Truncate(time.Second)
+
+	sparse := make([]byte, selfTestSparseSize)
+	copy(sparse[len(sparse)-len(selfTestContent):], selfTestContent)
+
+	entries := []struct {
+		hdr     tar.Header
+		content []byte
+	}{
+		{hdr: tar.Header{Name: selfTestNames.File, Typeflag: tar.TypeReg, Mode: 0644}, content: []byte(selfTestContent)},
+		{hdr: tar.Header{Name: selfTestNames.Symlink, Typeflag: tar.TypeSymlink, Linkname: selfTestNames.File, Mode: 0777}},
+		{hdr: tar.Header{Name: selfTestNames.Hardlink, Typeflag: tar.TypeLink, Linkname: selfTestNames.File, Mode: 0644}},
+		{hdr: tar.Header{Name: selfTestNames.NFC, Typeflag: tar.TypeReg, Mode: 0644}, content: []byte(selfTestContent)},
+		{hdr: tar.Header{Name: selfTestNames.NFD, Typeflag: tar.TypeReg, Mode: 0644}, content: []byte(selfTestContent)},
+		{hdr: tar.Header{Name: selfTestNames.LongPath, Typeflag: tar.TypeReg, Mode: 0644}, content: []byte(selfTestContent)},
+		{hdr: tar.Header{Name: selfTestNames.Sparse, Typeflag: tar.TypeReg, Mode: 0644}, content: sparse},
+	}
+	for _, entry := range entries {
+		hdr := entry.hdr
+		hdr.Size = int64(len(entry.content))
+		hdr.ModTime = modTime
+		if err := w.WriteHeader(&hdr); err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(entry.content); err != nil {
+			return nil, err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func checkSelfTestFile(pth string) error {
+	b, err := ioutil.ReadFile(pth)
+	if err != nil {
+		return err
+	}
+	if string(b) != selfTestContent {
+		return fmt.Errorf("content mismatch: %q", b)
+	}
+	return nil
+}
+
+func checkSelfTestSymlink(pth, target string) error {
+	got, err := os.Readlink(pth)
+	if err != nil {
+		return err
+	}
+	if got != target {
+		return fmt.Errorf("points to %s, want %s", got, target)
+	}
+	return checkSelfTestFile(pth)
+}
+
+func checkSelfTestHardlink(pth, source string, copiedLinks int) error {
+	if copiedLinks > 0 {
+		return fmt.Errorf("restored as a copy, the filesystem does not support hard links")
+	}
+	info, err := os.Stat(pth)
+	if err != nil {
+		return err
+	}
+	sourceInfo, err := os.Stat(source)
+	if err != nil {
+		return err
+	}
+	if !os.SameFile(info, sourceInfo) {
+		return fmt.Errorf("not linked to %s", source)
+	}
+	return nil
+}
+
+// checkSelfTestUnicode checks that the NFC and NFD names are restored as they are, not normalized by the filesystem.
+func checkSelfTestUnicode(dir string, names ...string) error {
+	restored, err := readDirNames(dir)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		found := false
+		for _, r := range restored {
+			if r == filepath.Base(name) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%q is not restored as it is (restored: %q), the filesystem normalizes the names, see the unicode_normalization input", filepath.Base(name), restored)
+		}
+	}
+	return nil
+}
+
+// checkSelfTestSparse checks that the sparse file's hole is not allocated on the disk.
+func checkSelfTestSparse(pth string) error {
+	info, err := os.Stat(pth)
+	if err != nil {
+		return err
+	}
+	if info.Size() != selfTestSparseSize {
+		return fmt.Errorf("size is %d, want %d", info.Size(), selfTestSparseSize)
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fmt.Errorf("allocated size is unknown")
+	}
+	if allocated := stat.Blocks * 512; allocated >= selfTestSparseSize {
+		return fmt.Errorf("%d Bytes allocated, the filesystem does not support sparse files", allocated)
+	}
+	return nil
+}
+
+func printSelfTestChecks(checks []selfTestCheck) {
+	fmt.Println()
+	log.Infof("Self-test results")
+
+	for _, check := range checks {
+		if check.Err != nil {
+			log.Warnf("%s: %s", check.Name, check.Err)
+			continue
+		}
+		log.Donef("%s: ok", check.Name)
+	}
+}
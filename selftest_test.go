@@ -0,0 +1,37 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestSelfTest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "selftest-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Logf("failed to remove temp dir: %s", err)
+		}
+	}()
+
+	checks := selfTest(dir)
+	if len(checks) < 6 {
+		t.Fatalf("selfTest() = %v, want every check", checks)
+	}
+	for _, check := range checks {
+		switch check.Name {
+		case "regular file", "symlink", "long path":
+			// supported on every stack
+			if check.Err != nil {
+				t.Errorf("%s check failed: %s", check.Name, check.Err)
+			}
+		default:
+			if check.Err != nil {
+				t.Logf("%s check failed: %s", check.Name, check.Err)
+			}
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+)
+
+// selinuxEnforcePath exists if SELinux is enabled.
+const selinuxEnforcePath = "/sys/fs/selinux/enforce"
+
+// restoreconFailurePattern matches restorecon's messages about the paths whose context could not be set,
+// "Could not set context for <path>: <reason>" and the older "restorecon set context <path>->... failed".
+var restoreconFailurePattern = regexp.MustCompile(`(?:[Cc]ould not set context for|set context) (/[^:\s]+?)(?:->|:|\s|$)`)
+
+// selinuxEnabled reports whether SELinux is enabled on the machine.
+func selinuxEnabled() bool {
+	_, err := os.Stat(selinuxEnforcePath)
+	return err == nil
+}
+
+// relabelPaths re-applies the default SELinux contexts of the policy (restorecon) to the paths and their content,
+// so the confined processes of the later steps can read the restored files.
+// It returns the paths whose context could not be set.
+func relabelPaths(paths []string) ([]string, error) {
+	out, err := runBatched("restorecon", []string{"-R", "--"}, paths)
+	failed := failedRelabels(out)
+	if err != nil && len(failed) == 0 {
+		return nil, fmt.Errorf("restorecon failed: %s", out)
+	}
+	return failed, nil
+}
+
+// failedRelabels returns the paths of restorecon's failure messages.
+func failedRelabels(out string) []string {
+	var paths []string
+	for _, match := range restoreconFailurePattern.FindAllStringSubmatch(out, -1) {
+		paths = append(paths, match[1])
+	}
+	return paths
+}
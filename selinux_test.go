@@ -0,0 +1,17 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFailedRelabels(t *testing.T) {
+	out := `restorecon: Could not set context for /root/.gradle/caches/file:  Operation not supported
+restorecon set context /root/.npm/index->system_u:object_r:user_home_t:s0 failed:'Read-only file system'
+Relabeled /root/.m2 from unconfined_u:object_r:tmp_t:s0 to unconfined_u:object_r:user_home_t:s0`
+
+	want := []string{"/root/.gradle/caches/file", "/root/.npm/index"}
+	if got := failedRelabels(out); !reflect.DeepEqual(got, want) {
+		t.Errorf("failedRelabels() = %v, want %v", got, want)
+	}
+}
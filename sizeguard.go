@@ -0,0 +1,68 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// oversizedEnvKey is the env var exporting whether the restore was skipped because of the archive's size,
+// see the max_archive_size input.
+const oversizedEnvKey = "BITRISE_CACHE_PULL_OVERSIZED"
+
+// parseMaxArchiveSize parses the max_archive_size input (e.g. 512MB, 2GB), 0 if empty.
+func parseMaxArchiveSize(s string) (int64, error) {
+	if strings.TrimSpace(s) == "" {
+		return 0, nil
+	}
+	return parseBudgetSize(s)
+}
+
+// remoteArchiveSize returns the size of the remote archive in Bytes: the sum of the chunk sizes reported by the cache API,
+// or of the parts' sizes (see statArchive). It returns -1 if the size is unknown.
+func remoteArchiveSize(parts []string, chunks []archiveChunk) (int64, error) {
+	if len(chunks) > 0 {
+		var total int64
+		for _, chunk := range chunks {
+			total += chunk.Size
+		}
+		return total, nil
+	}
+
+	var total int64
+	for _, part := range parts {
+		_, size, err := statArchive(part)
+		if err != nil {
+			return -1, err
+		}
+		if size < 0 {
+			return -1, nil
+		}
+		total += size
+	}
+	return total, nil
+}
+
+// checkArchiveSize reports whether the remote archive fits the maximum size (in Bytes).
+// An archive of unknown size fits, so that a failed size check does not skip the restore.
+func checkArchiveSize(parts []string, chunks []archiveChunk, maxSize int64) bool {
+	size, err := remoteArchiveSize(parts, chunks)
+	if err != nil {
+		log.Debugf("Failed to get the cache archive's size: %s", err)
+	} else if size < 0 {
+		log.Debugf("The cache archive's size is unknown")
+	} else {
+		log.Debugf("cache archive size: %d Bytes", size)
+	}
+
+	fits := err != nil || size <= maxSize
+	if !fits {
+		result.Warnf("The cache archive (%s) is larger than max_archive_size (%s)", formatBytes(size), formatBytes(maxSize))
+		result.Warnf("Skipping cache pull, the archive would not fit the disk")
+	}
+	if err := exportEnv(oversizedEnvKey, strconv.FormatBool(!fits)); err != nil {
+		result.Warnf("%s", err)
+	}
+	return fits
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRemoteArchiveSize(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/part.000", "/part.001":
+			// presigned URLs are only signed for GET requests
+			if r.Method != "GET" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			http.ServeContent(w, r, "part", time.Time{}, bytes.NewReader(make([]byte, 1024)))
+		case "/chunked":
+			w.Header().Set("Transfer-Encoding", "chunked")
+			w.WriteHeader(http.StatusOK)
+			if f, ok := w.(http.Flusher); ok {
+				f.Flush()
+			}
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name    string
+		parts   []string
+		chunks  []archiveChunk
+		want    int64
+		wantErr bool
+	}{
+		{
+			name:   "chunks reported by the cache API",
+			parts:  []string{server.URL + "/missing"},
+			chunks: []archiveChunk{{Size: 100}, {Size: 50}},
+			want:   150,
+		},
+		{
+			name:  "parts",
+			parts: []string{server.URL + "/part.000", server.URL + "/part.001"},
+			want:  2048,
+		},
+		{
+			name:  "unknown size",
+			parts: []string{server.URL + "/chunked"},
+			want:  -1,
+		},
+		{
+			name:    "missing archive",
+			parts:   []string{server.URL + "/missing"},
+			want:    -1,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := remoteArchiveSize(tt.parts, tt.chunks)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("remoteArchiveSize() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("remoteArchiveSize() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseMaxArchiveSize(t *testing.T) {
+	if got, err := parseMaxArchiveSize(""); err != nil || got != 0 {
+		t.Errorf("parseMaxArchiveSize(\"\") = %d, %v, want 0", got, err)
+	}
+	if got, err := parseMaxArchiveSize("2GB"); err != nil || got != 2*1024*1024*1024 {
+		t.Errorf("parseMaxArchiveSize(2GB) = %d, %v, want %d", got, err, 2*1024*1024*1024)
+	}
+	if _, err := parseMaxArchiveSize("2 gigs"); err == nil {
+		t.Errorf("parseMaxArchiveSize(2 gigs) should fail")
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// The cache API's query parameters selecting the cache produced by a specific past build.
+const (
+	sourceBuildSlugParam   = "source_build_slug"
+	sourceBuildNumberParam = "source_build_number"
+)
+
+var (
+	buildNumberPattern = regexp.MustCompile(`^#?[0-9]+$`)
+	buildSlugPattern   = regexp.MustCompile(`^[0-9a-zA-Z-]+$`)
+)
+
+// parseSourceBuild returns the cache API's query parameter and value of the build slug or build number (e.g. #1234).
+func parseSourceBuild(s string) (string, string, error) {
+	s = strings.TrimSpace(s)
+	switch {
+	case buildNumberPattern.MatchString(s):
+		return sourceBuildNumberParam, strings.TrimPrefix(s, "#"), nil
+	case buildSlugPattern.MatchString(s):
+		return sourceBuildSlugParam, s, nil
+	}
+	return "", "", fmt.Errorf("not a build slug or build number (%s)", s)
+}
+
+// sourceBuildCacheAPIURL adds the past build's slug or number to the cache API URL.
+func sourceBuildCacheAPIURL(cacheAPIURL, sourceBuild string) (string, error) {
+	param, value, err := parseSourceBuild(sourceBuild)
+	if err != nil {
+		return "", err
+	}
+	u, err := url.Parse(cacheAPIURL)
+	if err != nil {
+		return "", err
+	}
+	query := u.Query()
+	query.Set(param, value)
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
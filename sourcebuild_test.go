@@ -0,0 +1,28 @@
+package main
+
+import "testing"
+
+func TestSourceBuildCacheAPIURL(t *testing.T) {
+	tests := []struct {
+		sourceBuild string
+		want        string
+		wantErr     bool
+	}{
+		{sourceBuild: "1234", want: "https://cache.example.com/?build_slug=slug&source_build_number=1234"},
+		{sourceBuild: "#1234", want: "https://cache.example.com/?build_slug=slug&source_build_number=1234"},
+		{sourceBuild: " 7f3a9c1e-2b4d-4e6f-8a1b-3c5d7e9f0a2b ", want: "https://cache.example.com/?build_slug=slug&source_build_slug=7f3a9c1e-2b4d-4e6f-8a1b-3c5d7e9f0a2b"},
+		{sourceBuild: "../builds", wantErr: true},
+		{sourceBuild: "#", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.sourceBuild, func(t *testing.T) {
+			got, err := sourceBuildCacheAPIURL("https://cache.example.com/?build_slug=slug", tt.sourceBuild)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("sourceBuildCacheAPIURL() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("sourceBuildCacheAPIURL() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+const (
+	// splitIndexSuffix marks the index file listing the parts of a split archive.
+	splitIndexSuffix = ".index.json"
+	// maxParallelPartDownloads is the number of parts downloaded at the same time.
+	maxParallelPartDownloads = 4
+)
+
+var (
+	// firstPartPattern matches the numeric suffix of a split archive's first part (cache-archive.tar.gz.000).
+	firstPartPattern = regexp.MustCompile(`\.(0+)$`)
+	// signatureParamPattern matches the signature query parameters of the presigned URLs (S3, GCS, Azure SAS),
+	// the signature is only valid for the signed object's path.
+	signatureParamPattern = regexp.MustCompile(`(?i)[?&](?:x-amz-signature|x-goog-signature|signature|sig)=`)
+)
+
+// splitIndex is the index file of a split archive.
+type splitIndex struct {
+	Parts []string `json:"parts"`
+}
+
+// resolveArchiveParts returns the URIs of the archive parts in order.
+// The URI can point to an index file (*.index.json), to the first part of
+// consecutively numbered parts (*.000) or to a non split archive.
+// The numbered parts can not be discovered by a presigned URL, its signature is not valid for the other parts.
+func resolveArchiveParts(uri string) ([]string, error) {
+	pth := uriPath(uri)
+
+	if strings.HasSuffix(pth, splitIndexSuffix) {
+		return readSplitIndex(uri)
+	}
+
+	if match := firstPartPattern.FindStringSubmatch(pth); match != nil {
+		if isSignedURL(uri) {
+			return nil, fmt.Errorf("the parts of a split archive can not be discovered by a presigned URL, use the URL of its index file (*%s)", splitIndexSuffix)
+		}
+		return discoverParts(uri, len(match[1]))
+	}
+
+	return []string{uri}, nil
+}
+
+// isSignedURL reports whether the URL is a presigned one.
+func isSignedURL(uri string) bool {
+	return signatureParamPattern.MatchString(uri)
+}
+
+// uriPath returns the URI without the query or the local path of a file:// URI.
+func uriPath(uri string) string {
+	if strings.HasPrefix(uri, "file://") {
+		return strings.TrimPrefix(uri, "file://")
+	}
+	if u, err := url.Parse(uri); err == nil {
+		return u.Path
+	}
+	return uri
+}
+
+func readSplitIndex(uri string) ([]string, error) {
+	r, err := openPart(uri)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open split archive index: %s", err)
+	}
+	defer func() {
+		if err := r.Close(); err != nil {
+			log.Warnf("Failed to close split archive index: %s", err)
+		}
+	}()
+
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read split archive index: %s", err)
+	}
+
+	var index splitIndex
+	if err := json.Unmarshal(b, &index); err != nil {
+		return nil, fmt.Errorf("failed to parse split archive index (%s): %s", b, err)
+	}
+	if len(index.Parts) == 0 {
+		return nil, fmt.Errorf("split archive index does not list any part")
+	}
+
+	parts := make([]string, 0, len(index.Parts))
+	for _, part := range index.Parts {
+		resolved, err := resolveReference(uri, part)
+		if err != nil {
+			return nil, fmt.Errorf("invalid part (%s) in split archive index: %s", part, err)
+		}
+		parts = append(parts, resolved)
+	}
+	return parts, nil
+}
+
+// resolveReference resolves a part reference of an index file, relative references are relative to the index.
+func resolveReference(indexURI, ref string) (string, error) {
+	if strings.HasPrefix(indexURI, "file://") {
+		if strings.Contains(ref, "://") || strings.HasPrefix(ref, "/") {
+			return ref, nil
+		}
+		dir := indexURI[:strings.LastIndex(indexURI, "/")+1]
+		return dir + ref, nil
+	}
+
+	base, err := url.Parse(indexURI)
+	if err != nil {
+		return "", err
+	}
+	refURL, err := url.Parse(ref)
+	if err != nil {
+		return "", err
+	}
+	return base.ResolveReference(refURL).String(), nil
+}
+
+// discoverParts lists the consecutively numbered parts, starting with the given first part.
+func discoverParts(firstURI string, digits int) ([]string, error) {
+	parts := []string{firstURI}
+	for i := 1; ; i++ {
+		uri := partURI(firstURI, i, digits)
+		exists, err := partExists(uri)
+		if err != nil {
+			return nil, fmt.Errorf("failed to check archive part (%d): %s", i, err)
+		}
+		if !exists {
+			break
+		}
+		parts = append(parts, uri)
+	}
+	return parts, nil
+}
+
+// partURI replaces the first part's numeric suffix with the given index.
+func partURI(firstURI string, index, digits int) string {
+	suffix := fmt.Sprintf(".%0"+strconv.Itoa(digits)+"d", index)
+
+	if strings.HasPrefix(firstURI, "file://") {
+		return firstPartPattern.ReplaceAllString(firstURI, suffix)
+	}
+
+	u, err := url.Parse(firstURI)
+	if err != nil {
+		return firstPartPattern.ReplaceAllString(firstURI, suffix)
+	}
+	u.Path = firstPartPattern.ReplaceAllString(u.Path, suffix)
+	return u.String()
+}
+
+func partExists(uri string) (bool, error) {
+	if strings.HasPrefix(uri, "file://") {
+		_, err := os.Stat(strings.TrimPrefix(uri, "file://"))
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return err == nil, err
+	}
+
+	resp, err := http.Head(uri)
+	if err != nil {
+		return false, err
+	}
+	if err := resp.Body.Close(); err != nil {
+		log.Warnf("Failed to close response body: %s", err)
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		return true, nil
+	case resp.StatusCode == http.StatusNotFound:
+		return false, nil
+	case resp.StatusCode == http.StatusForbidden && !isSignedURL(uri):
+		// object stores respond 403 for missing objects if listing is not allowed,
+		// for a presigned URL it is an invalid signature
+		return false, nil
+	default:
+		return false, fmt.Errorf("non success response code: %d", resp.StatusCode)
+	}
+}
+
+// openPart opens a local (file://) or remote archive part.
+func openPart(uri string) (io.ReadCloser, error) {
+	return openPartContext(context.Background(), uri)
+}
+
+// openPartContext is openPart, the remote part's request is canceled with the context.
+func openPartContext(ctx context.Context, uri string) (io.ReadCloser, error) {
+	if strings.HasPrefix(uri, "file://") {
+		return os.Open(strings.TrimPrefix(uri, "file://"))
+	}
+	return performRequestContext(ctx, uri)
+}
+
+type partResult struct {
+	pth string
+	err error
+}
+
+// PartsReader downloads the parts of a split archive in parallel and reads them in order.
+// At most maxParallelPartDownloads parts are downloaded or waiting to be read at the same time:
+// the parts are started in order, and a part's slot is freed once it is read.
+// The first error is returned by every later Read, Close cancels the pending downloads.
+type PartsReader struct {
+	results []chan partResult
+	next    int
+	current *os.File
+	err     error
+	slots   chan struct{}
+	done    chan struct{}
+	cancel  context.CancelFunc
+}
+
+// NewPartsReader creates a new PartsReader and starts downloading the parts.
+func NewPartsReader(parts []string) *PartsReader {
+	return newPartsReader(len(parts), func(ctx context.Context, i int) (string, error) {
+		return downloadPart(ctx, parts[i], i)
+	})
+}
+
+// newPartsReader creates a PartsReader which reads the files created by the fetch function in order.
+// The fetch function's context is canceled by Close.
+func newPartsReader(count int, fetch func(ctx context.Context, i int) (string, error)) *PartsReader {
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &PartsReader{
+		results: make([]chan partResult, count),
+		slots:   make(chan struct{}, maxParallelPartDownloads),
+		done:    make(chan struct{}),
+		cancel:  cancel,
+	}
+	for i := range r.results {
+		r.results[i] = make(chan partResult, 1)
+	}
+
+	go func() {
+		for i := 0; i < count; i++ {
+			select {
+			case r.slots <- struct{}{}:
+			case <-r.done:
+				for ; i < count; i++ {
+					r.results[i] <- partResult{err: fmt.Errorf("reader closed")}
+				}
+				return
+			}
+
+			go func(i int) {
+				pth, err := fetch(ctx, i)
+				r.results[i] <- partResult{pth: pth, err: err}
+			}(i)
+		}
+	}()
+
+	return r
+}
+
+// releaseSlot frees the slot of a read part, to start downloading the next one.
+func (r *PartsReader) releaseSlot() {
+	select {
+	case <-r.slots:
+	default:
+	}
+}
+
+// Read implements the io.Reader interface.
+func (r *PartsReader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	for {
+		if r.current == nil {
+			if r.next >= len(r.results) {
+				return 0, io.EOF
+			}
+
+			res := <-r.results[r.next]
+			r.next++
+			if res.err != nil {
+				r.releaseSlot()
+				// the later parts are not read after the failed one
+				r.err = fmt.Errorf("failed to download archive part (%d): %s", r.next-1, res.err)
+				return 0, r.err
+			}
+
+			f, err := os.Open(res.pth)
+			if err != nil {
+				removePart(res.pth)
+				r.releaseSlot()
+				r.err = err
+				return 0, r.err
+			}
+			r.current = f
+		}
+
+		n, err := r.current.Read(p)
+		if err == io.EOF {
+			r.closeCurrent()
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		if err != nil {
+			r.err = err
+		}
+		return n, err
+	}
+}
+
+// Close cancels the pending downloads and removes the downloaded parts.
+func (r *PartsReader) Close() error {
+	r.cancel()
+	close(r.done)
+	r.closeCurrent()
+	for ; r.next < len(r.results); r.next++ {
+		if res := <-r.results[r.next]; res.pth != "" {
+			removePart(res.pth)
+		}
+	}
+	return nil
+}
+
+func (r *PartsReader) closeCurrent() {
+	if r.current == nil {
+		return
+	}
+	if err := r.current.Close(); err != nil {
+		log.Warnf("Failed to close archive part: %s", err)
+	}
+	removePart(r.current.Name())
+	r.current = nil
+	r.releaseSlot()
+}
+
+func removePart(pth string) {
+	if err := os.Remove(pth); err != nil {
+		log.Warnf("Failed to remove archive part: %s", err)
+	}
+}
+
+// downloadPart downloads an archive part into a temporary file and returns its path.
+// The download is retried once if it is corrupted.
+func downloadPart(ctx context.Context, uri string, index int) (string, error) {
+	log.Debugf("downloading archive part (%d)", index)
+
+	var pth string
+	err := retryOnChecksumMismatch(fmt.Sprintf("archive part (%d)", index), func() error {
+		src, err := openPartContext(ctx, uri)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err := src.Close(); err != nil {
+				log.Warnf("Failed to close archive part (%d): %s", index, err)
+			}
+		}()
+
+		var n int64
+		pth, n, err = writeTempPart(src, index)
+		if err != nil {
+			return err
+		}
+		log.Debugf("archive part (%d) downloaded: %d Bytes", index, n)
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return pth, nil
+}
+
+// writeTempPart writes the content of the reader into a temporary file and returns its path and size.
+func writeTempPart(r io.Reader, index int) (pth string, n int64, err error) {
+	f, err := createTempFile(fmt.Sprintf("cache-archive-part-%03d-", index))
+	if err != nil {
+		return "", 0, err
+	}
+	defer func() {
+		if cErr := f.Close(); cErr != nil && err == nil {
+			err = cErr
+		}
+		if err != nil {
+			removePart(f.Name())
+		}
+	}()
+
+	n, err = io.Copy(f, r)
+	if err != nil {
+		return "", 0, err
+	}
+
+	return f.Name(), n, nil
+}
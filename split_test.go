@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func Test_resolveArchiveParts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "split-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Logf("failed to remove temp dir: %s", err)
+		}
+	}()
+
+	for name, content := range map[string]string{
+		"cache-archive.tar.gz.000": "first-",
+		"cache-archive.tar.gz.001": "second-",
+		"cache-archive.tar.gz.002": "third",
+		"cache.index.json":         `{"parts": ["cache-archive.tar.gz.002", "cache-archive.tar.gz.000"]}`,
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("failed to write %s: %s", name, err)
+		}
+	}
+
+	uri := func(name string) string { return "file://" + filepath.Join(dir, name) }
+
+	tests := []struct {
+		name        string
+		uri         string
+		want        []string
+		wantContent string
+	}{
+		{
+			name:        "not split",
+			uri:         uri("cache-archive.tar.gz.001"),
+			want:        []string{uri("cache-archive.tar.gz.001")},
+			wantContent: "second-",
+		},
+		{
+			name:        "numbered parts",
+			uri:         uri("cache-archive.tar.gz.000"),
+			want:        []string{uri("cache-archive.tar.gz.000"), uri("cache-archive.tar.gz.001"), uri("cache-archive.tar.gz.002")},
+			wantContent: "first-second-third",
+		},
+		{
+			name:        "index file",
+			uri:         uri("cache.index.json"),
+			want:        []string{uri("cache-archive.tar.gz.002"), uri("cache-archive.tar.gz.000")},
+			wantContent: "thirdfirst-",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := resolveArchiveParts(tt.uri)
+			if err != nil {
+				t.Fatalf("resolveArchiveParts() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("resolveArchiveParts() = %v, want %v", got, tt.want)
+			}
+
+			r := NewPartsReader(got)
+			b, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Fatalf("PartsReader.Read() error = %v", err)
+			}
+			if err := r.Close(); err != nil {
+				t.Errorf("PartsReader.Close() error = %v", err)
+			}
+			if string(b) != tt.wantContent {
+				t.Errorf("PartsReader content = %s, want %s", b, tt.wantContent)
+			}
+		})
+	}
+}
+
+func Test_partURI(t *testing.T) {
+	got := partURI("https://storage.example.com/caches/cache.tar.gz.000?X-Signature=abc", 12, 3)
+	want := "https://storage.example.com/caches/cache.tar.gz.012?X-Signature=abc"
+	if got != want {
+		t.Errorf("partURI() = %s, want %s", got, want)
+	}
+}
+
+func Test_newPartsReader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "split-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Logf("failed to remove temp dir: %s", err)
+		}
+	}()
+
+	const count = 3 * maxParallelPartDownloads
+	var mu sync.Mutex
+	var inFlight int
+	fetch := func(ctx context.Context, i int) (string, error) {
+		mu.Lock()
+		inFlight++
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			t.Errorf("failed to read dir: %s", err)
+		}
+		// the parts being downloaded and the downloaded ones waiting to be read
+		if pending := inFlight + len(files); pending > maxParallelPartDownloads {
+			t.Errorf("part (%d) started with %d pending parts, want at most %d", i, pending, maxParallelPartDownloads)
+		}
+		mu.Unlock()
+
+		time.Sleep(time.Millisecond)
+
+		mu.Lock()
+		defer mu.Unlock()
+		inFlight--
+		pth := filepath.Join(dir, fmt.Sprintf("part-%03d", i))
+		return pth, ioutil.WriteFile(pth, []byte(fmt.Sprintf("%d,", i)), 0600)
+	}
+
+	t.Run("read", func(t *testing.T) {
+		r := newPartsReader(count, fetch)
+		var got strings.Builder
+		p := make([]byte, 1)
+		for {
+			n, err := r.Read(p)
+			got.Write(p[:n])
+			if err != nil {
+				break
+			}
+			// a slow reader, the downloads must not run ahead of it
+			time.Sleep(100 * time.Microsecond)
+		}
+		if err := r.Close(); err != nil {
+			t.Errorf("PartsReader.Close() error = %v", err)
+		}
+
+		var want strings.Builder
+		for i := 0; i < count; i++ {
+			want.WriteString(fmt.Sprintf("%d,", i))
+		}
+		if got.String() != want.String() {
+			t.Errorf("PartsReader content = %s, want %s", got.String(), want.String())
+		}
+	})
+
+	t.Run("closed while reading", func(t *testing.T) {
+		r := newPartsReader(count, fetch)
+		if _, err := r.Read(make([]byte, 1)); err != nil {
+			t.Fatalf("PartsReader.Read() error = %v", err)
+		}
+		if err := r.Close(); err != nil {
+			t.Errorf("PartsReader.Close() error = %v", err)
+		}
+		if files, err := ioutil.ReadDir(dir); err != nil || len(files) != 0 {
+			t.Errorf("%d parts left after Close(), %v", len(files), err)
+		}
+	})
+
+	t.Run("failed part", func(t *testing.T) {
+		r := newPartsReader(3, func(ctx context.Context, i int) (string, error) {
+			if i == 1 {
+				return "", errors.New("connection reset")
+			}
+			return fetch(ctx, i)
+		})
+		b, err := ioutil.ReadAll(r)
+		if err == nil || string(b) != "0," {
+			t.Fatalf("PartsReader content = %s (%v), want the first part and the second part's error", b, err)
+		}
+		// the error is sticky, the third part is not read
+		if n, err := r.Read(make([]byte, 16)); n != 0 || err == nil {
+			t.Errorf("PartsReader.Read() = %d, %v, want the second part's error", n, err)
+		}
+		if err := r.Close(); err != nil {
+			t.Errorf("PartsReader.Close() error = %v", err)
+		}
+		if files, err := ioutil.ReadDir(dir); err != nil || len(files) != 0 {
+			t.Errorf("%d parts left after Close(), %v", len(files), err)
+		}
+	})
+
+	t.Run("closed while downloading", func(t *testing.T) {
+		r := newPartsReader(count, func(ctx context.Context, i int) (string, error) {
+			<-ctx.Done()
+			return "", ctx.Err()
+		})
+		closed := make(chan error)
+		go func() { closed <- r.Close() }()
+		select {
+		case err := <-closed:
+			if err != nil {
+				t.Errorf("PartsReader.Close() error = %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("PartsReader.Close() did not cancel the pending downloads")
+		}
+	})
+}
+
+func Test_partExists(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/cache.tar.gz.001":
+		case "/cache.tar.gz.002":
+			w.WriteHeader(http.StatusForbidden)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		uri     string
+		want    bool
+		wantErr bool
+	}{
+		{uri: server.URL + "/cache.tar.gz.001", want: true},
+		{uri: server.URL + "/cache.tar.gz.003"},
+		{uri: server.URL + "/cache.tar.gz.002"},
+		{uri: server.URL + "/cache.tar.gz.002?X-Amz-Signature=abc", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := partExists(tt.uri)
+		if (err != nil) != tt.wantErr {
+			t.Fatalf("partExists(%s) error = %v, wantErr %v", tt.uri, err, tt.wantErr)
+		}
+		if got != tt.want {
+			t.Errorf("partExists(%s) = %v, want %v", tt.uri, got, tt.want)
+		}
+	}
+
+	if _, err := resolveArchiveParts(server.URL + "/cache.tar.gz.000?X-Amz-Signature=abc"); err == nil {
+		t.Errorf("resolveArchiveParts() error = nil, want an error for the presigned URL of the first part")
+	}
+	got, err := resolveArchiveParts(server.URL + "/cache.tar.gz.000")
+	if err != nil {
+		t.Fatalf("resolveArchiveParts() error = %v", err)
+	}
+	if want := []string{server.URL + "/cache.tar.gz.000", server.URL + "/cache.tar.gz.001"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("resolveArchiveParts() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Swift package restore modes, see swiftPackageRestore.
+const (
+	spmRestoreFull    = "full"
+	spmRestorePartial = "partial"
+	spmRestoreSkipped = "skipped"
+)
+
+// swiftPackagePin is a resolved package of Package.resolved.
+type swiftPackagePin struct {
+	Location string
+	Revision string
+}
+
+// swiftPackageName returns the package's name of its location: the last path component without the .git extension,
+// SwiftPM names the package's checkout directory after it.
+func swiftPackageName(location string) string {
+	name := strings.TrimSuffix(strings.TrimRight(location, "/"), ".git")
+	if i := strings.LastIndexAny(name, "/:"); i >= 0 {
+		name = name[i+1:]
+	}
+	return name
+}
+
+// swiftPackageIdentity returns the package's identity of its location, the lowercase name as SwiftPM identifies it.
+func swiftPackageIdentity(location string) string {
+	return strings.ToLower(swiftPackageName(location))
+}
+
+// parsePackageResolved parses the pins of a Package.resolved file (version 1, 2 and 3), by the packages' identity.
+func parsePackageResolved(b []byte) (map[string]swiftPackagePin, error) {
+	type state struct {
+		Revision string `json:"revision"`
+	}
+	type pin struct {
+		// version 1
+		RepositoryURL string `json:"repositoryURL"`
+		// version 2 and 3
+		Location string `json:"location"`
+		State    state  `json:"state"`
+	}
+	var resolved struct {
+		Version int   `json:"version"`
+		Pins    []pin `json:"pins"`
+		Object  struct {
+			Pins []pin `json:"pins"`
+		} `json:"object"`
+	}
+	if err := json.Unmarshal(b, &resolved); err != nil {
+		return nil, err
+	}
+
+	pins := resolved.Pins
+	if resolved.Version == 1 {
+		pins = resolved.Object.Pins
+	}
+	parsed := map[string]swiftPackagePin{}
+	for _, p := range pins {
+		location := p.Location
+		if location == "" {
+			location = p.RepositoryURL
+		}
+		if location == "" {
+			return nil, fmt.Errorf("pin without location")
+		}
+		parsed[swiftPackageIdentity(location)] = swiftPackagePin{Location: location, Revision: p.State.Revision}
+	}
+	return parsed, nil
+}
+
+// readPackageResolved reads the pins of the Package.resolved file.
+func readPackageResolved(pth string) (map[string]swiftPackagePin, error) {
+	b, err := ioutil.ReadFile(pth)
+	if err != nil {
+		return nil, err
+	}
+	pins, err := parsePackageResolved(b)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %s", pth, err)
+	}
+	return pins, nil
+}
+
+// swiftPackageRestore decides how the cached Swift packages are restored, comparing the current Package.resolved pins
+// with the cached ones (the archive's swift_packages, identity to revision):
+//
+//   - full, if no package changed (or the archive does not list its packages),
+//   - partial, if some packages changed: their checkouts are not restored, SwiftPM checks them out again,
+//   - skipped, if every package changed: the cached packages are useless, nothing is restored.
+//
+// It returns the mode and the changed packages' identity.
+func swiftPackageRestore(cached map[string]string, current map[string]swiftPackagePin) (string, []string) {
+	if len(cached) == 0 {
+		return spmRestoreFull, nil
+	}
+
+	var changed []string
+	for identity, pin := range current {
+		if cached[identity] != pin.Revision {
+			changed = append(changed, identity)
+		}
+	}
+	sort.Strings(changed)
+
+	switch {
+	case len(changed) == 0:
+		return spmRestoreFull, nil
+	case len(changed) == len(current):
+		return spmRestoreSkipped, changed
+	}
+	return spmRestorePartial, changed
+}
+
+// swiftPackageCacheDir returns SwiftPM's shared cache of the user (~/Library/Caches/org.swift.swiftpm).
+func swiftPackageCacheDir() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, "Library", "Caches", "org.swift.swiftpm"), nil
+}
+
+// swiftPackageSkippedPaths returns the paths not restored in the given mode: the changed packages' checkouts
+// in the build directory if partial, the build directory and the shared cache (cacheDir) if skipped.
+func swiftPackageSkippedPaths(mode string, changed []string, current map[string]swiftPackagePin, buildDir, cacheDir string) []string {
+	switch mode {
+	case spmRestoreSkipped:
+		return []string{buildDir, cacheDir}
+	case spmRestorePartial:
+		var paths []string
+		for _, identity := range changed {
+			paths = append(paths, filepath.Join(buildDir, "checkouts", swiftPackageName(current[identity].Location)))
+		}
+		return paths
+	}
+	return nil
+}
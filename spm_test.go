@@ -0,0 +1,74 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParsePackageResolved(t *testing.T) {
+	tests := []struct {
+		name     string
+		resolved string
+	}{
+		{
+			name:     "version 1",
+			resolved: `{"object": {"pins": [{"package": "Alamofire", "repositoryURL": "https://github.com/Alamofire/Alamofire.git", "state": {"revision": "abc", "version": "5.8.0"}}]}, "version": 1}`,
+		},
+		{
+			name:     "version 2",
+			resolved: `{"pins": [{"identity": "alamofire", "kind": "remoteSourceControl", "location": "https://github.com/Alamofire/Alamofire.git", "state": {"revision": "abc", "version": "5.8.0"}}], "version": 2}`,
+		},
+	}
+	want := map[string]swiftPackagePin{"alamofire": {Location: "https://github.com/Alamofire/Alamofire.git", Revision: "abc"}}
+	for _, tt := range tests {
+		got, err := parsePackageResolved([]byte(tt.resolved))
+		if err != nil {
+			t.Fatalf("%s: parsePackageResolved() error = %s", tt.name, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: parsePackageResolved() = %v, want %v", tt.name, got, want)
+		}
+	}
+}
+
+func TestSwiftPackageRestore(t *testing.T) {
+	current := map[string]swiftPackagePin{
+		"alamofire": {Location: "https://github.com/Alamofire/Alamofire.git", Revision: "a2"},
+		"swift-log": {Location: "git@github.com:apple/swift-log.git", Revision: "l1"},
+	}
+	tests := []struct {
+		name        string
+		cached      map[string]string
+		wantMode    string
+		wantChanged []string
+		wantSkipped []string
+	}{
+		{name: "unknown", cached: nil, wantMode: spmRestoreFull},
+		{name: "unchanged", cached: map[string]string{"alamofire": "a2", "swift-log": "l1"}, wantMode: spmRestoreFull},
+		{
+			name:        "some changed",
+			cached:      map[string]string{"alamofire": "a1", "swift-log": "l1"},
+			wantMode:    spmRestorePartial,
+			wantChanged: []string{"alamofire"},
+			wantSkipped: []string{"/project/.build/checkouts/Alamofire"},
+		},
+		{
+			name:        "every changed",
+			cached:      map[string]string{"alamofire": "a1"},
+			wantMode:    spmRestoreSkipped,
+			wantChanged: []string{"alamofire", "swift-log"},
+			wantSkipped: []string{"/project/.build", "/cache"},
+		},
+	}
+	for _, tt := range tests {
+		mode, changed := swiftPackageRestore(tt.cached, current)
+		if mode != tt.wantMode || !reflect.DeepEqual(changed, tt.wantChanged) {
+			t.Errorf("%s: swiftPackageRestore() = %s, %v, want %s, %v", tt.name, mode, changed, tt.wantMode, tt.wantChanged)
+		}
+		skipped := swiftPackageSkippedPaths(mode, changed, current, filepath.FromSlash("/project/.build"), filepath.FromSlash("/cache"))
+		if !reflect.DeepEqual(skipped, tt.wantSkipped) {
+			t.Errorf("%s: swiftPackageSkippedPaths() = %v, want %v", tt.name, skipped, tt.wantSkipped)
+		}
+	}
+}
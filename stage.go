@@ -0,0 +1,105 @@
+package main
+
+import (
+	"io"
+	"sync"
+)
+
+// stageBlockSize is the size of the blocks passed between the stages of the extraction pipeline.
+const stageBlockSize = 256 * 1024
+
+type stageBlock struct {
+	data []byte
+	err  error
+}
+
+// stageReader reads its source in a separate goroutine, so the source (e.g. the download, the decompression)
+// runs concurrently with the reader of the stage. The blocks read ahead are bounded by the stage's buffer size:
+// the goroutine waits while the buffer is full.
+type stageReader struct {
+	blocks chan stageBlock
+	free   chan []byte
+	done   chan struct{}
+	exited chan struct{}
+	once   sync.Once
+
+	// buf is the block being read, current is its unread part.
+	buf     []byte
+	current []byte
+	err     error
+}
+
+// newStageReader starts reading src ahead, up to size Bytes (at least a block).
+func newStageReader(src io.Reader, size int64) *stageReader {
+	count := int(size / stageBlockSize)
+	if count < 1 {
+		count = 1
+	}
+
+	s := &stageReader{
+		blocks: make(chan stageBlock, count),
+		// the queued blocks, the one being read and the one being filled
+		free:   make(chan []byte, count+2),
+		done:   make(chan struct{}),
+		exited: make(chan struct{}),
+	}
+	go s.run(src)
+	return s
+}
+
+func (s *stageReader) run(src io.Reader) {
+	defer close(s.exited)
+
+	for {
+		var buf []byte
+		select {
+		case buf = <-s.free:
+		default:
+			buf = make([]byte, stageBlockSize)
+		}
+
+		n, err := io.ReadFull(src, buf)
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+		select {
+		case s.blocks <- stageBlock{data: buf[:n], err: err}:
+		case <-s.done:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Read implements the io.Reader interface.
+func (s *stageReader) Read(p []byte) (int, error) {
+	for len(s.current) == 0 {
+		if s.err != nil {
+			return 0, s.err
+		}
+		if s.buf != nil {
+			select {
+			case s.free <- s.buf[:cap(s.buf)]:
+			default:
+			}
+			s.buf = nil
+		}
+
+		block := <-s.blocks
+		s.buf, s.current, s.err = block.data, block.data, block.err
+	}
+
+	n := copy(p, s.current)
+	s.current = s.current[n:]
+	return n, nil
+}
+
+// Close stops the stage and waits for its goroutine, the source is not read afterwards.
+// The blocks read ahead are dropped.
+func (s *stageReader) Close() error {
+	s.once.Do(func() { close(s.done) })
+	<-s.exited
+	return nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestStageReader(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), stageBlockSize/4)
+	errRead := errors.New("connection reset")
+
+	tests := []struct {
+		name    string
+		src     io.Reader
+		size    int64
+		want    []byte
+		wantErr error
+	}{
+		{name: "read ahead", src: bytes.NewReader(content), size: 2 * stageBlockSize, want: content},
+		{name: "smaller than a block", src: bytes.NewReader(content), size: 1, want: content},
+		{name: "source failure", src: io.MultiReader(bytes.NewReader(content[:100]), &failingReader{err: errRead}), size: stageBlockSize, want: content[:100], wantErr: errRead},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newStageReader(tt.src, tt.size)
+			got, err := ioutil.ReadAll(s)
+			if err != tt.wantErr {
+				t.Fatalf("Read() error = %v, want %v", err, tt.wantErr)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("Read() = %d Bytes, want %d Bytes", len(got), len(tt.want))
+			}
+			if err := s.Close(); err != nil {
+				t.Errorf("Close() error = %v", err)
+			}
+		})
+	}
+
+	t.Log("the source is not read after the stage is closed")
+	{
+		s := newStageReader(infiniteReader{}, stageBlockSize)
+		if _, err := io.ReadFull(s, make([]byte, 10)); err != nil {
+			t.Fatalf("Read() error = %v", err)
+		}
+		if err := s.Close(); err != nil {
+			t.Errorf("Close() error = %v", err)
+		}
+	}
+}
+
+type failingReader struct {
+	err error
+}
+
+func (r *failingReader) Read([]byte) (int, error) {
+	return 0, r.err
+}
+
+type infiniteReader struct{}
+
+func (infiniteReader) Read(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func Test_extractArchive_pipeline(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pipeline-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Logf("failed to remove temp dir: %s", err)
+		}
+	}()
+
+	large := strings.Repeat("x", 3*stageBlockSize)
+	archive := createTestArchive(t, []testEntry{
+		{name: "small.txt", content: "small"},
+		{name: "large.bin", content: large},
+	})
+
+	extractor := NewExtractor(dir, true)
+	extractor.PipelineBuffer = stageBlockSize
+	if err := extractArchive(bytes.NewReader(gzipBytes(t, archive.Bytes())), extractor, true); err != nil {
+		t.Fatalf("extractArchive() error = %v", err)
+	}
+
+	for name, want := range map[string]string{"small.txt": "small", "large.bin": large} {
+		got, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatalf("failed to read %s: %s", name, err)
+		}
+		if string(got) != want {
+			t.Errorf("%s = %d Bytes, want %d Bytes", name, len(got), len(want))
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/bitrise-io/go-utils/log"
+	"github.com/bitrise-steplib/steps-cache-pull/pkg/cachepull"
+)
+
+// restoreStateVersion is the version of the restore state file format, increased on incompatible changes.
+const restoreStateVersion = 1
+
+const (
+	restoreStatePathEnvKey = "BITRISE_CACHE_PULL_STATE_PATH"
+	archiveChecksumEnvKey  = "BITRISE_CACHE_PULL_ARCHIVE_CHECKSUM"
+)
+
+// archiveInfoFileName is the first entry of the archives created by the cache push step.
+const archiveInfoFileName = cachepull.ArchiveInfoFileName
+
+// archiveInfo is the content of the archive's archive_info.json.
+type archiveInfo struct {
+	// SchemaVersion and MinReaderVersion are the archive's schema version and the oldest one able to restore it,
+	// see checkArchiveSchema.
+	SchemaVersion    int    `json:"schema_version,omitempty"`
+	MinReaderVersion int    `json:"min_reader_version,omitempty"`
+	StackID          string `json:"stack_id,omitempty"`
+	// ContentHashes are the cached paths' content hashes, written by the newer cache push steps.
+	ContentHashes map[string]string `json:"content_hashes,omitempty"`
+	// Fingerprint identifies the archive's content (schema version 3), see the skip_unchanged input.
+	Fingerprint string `json:"fingerprint,omitempty"`
+	// Directories are the archive's large directories (schema version 4).
+	Directories []largeDirectory `json:"directories,omitempty"`
+	// SwiftPackages are the revisions of the cached Swift packages by their identity (schema version 5),
+	// see the swift_package_resolved input.
+	SwiftPackages map[string]string `json:"swift_packages,omitempty"`
+	// RustcVersion is the toolchain the cached cargo target directory is compiled by (schema version 6),
+	// see the cargo_target_dir input.
+	RustcVersion string `json:"rustc_version,omitempty"`
+	// PresetToolchains are the toolchains the cached toolchain paths of the cache presets are built by, by preset
+	// (schema version 7), see the cache_presets input.
+	PresetToolchains map[string]string `json:"preset_toolchains,omitempty"`
+	// PlatformArtifacts are the archive's large platform artifacts (schema version 8).
+	PlatformArtifacts []platformArtifact `json:"platform_artifacts,omitempty"`
+}
+
+// parseArchiveInfo reads the archive info from the given json bytes.
+func parseArchiveInfo(b []byte) (archiveInfo, error) {
+	var info archiveInfo
+	if err := json.Unmarshal(b, &info); err != nil {
+		return archiveInfo{}, err
+	}
+	return info, nil
+}
+
+// restoreState describes the restored archive, so the cache push step can cheaply decide
+// whether anything changed and skip the upload.
+type restoreState struct {
+	Version   int    `json:"version"`
+	BuildSlug string `json:"build_slug,omitempty"`
+	CacheKey  string `json:"cache_key,omitempty"`
+	// ArchiveChecksum is the downloaded archive's checksum, in the `sha256:<hex>` format.
+	ArchiveChecksum string `json:"archive_checksum,omitempty"`
+	// Fingerprint is the archive's fingerprint, from the legacy archive's cache-info.json or archive_info.json.
+	Fingerprint string `json:"fingerprint,omitempty"`
+	// ContentHashes are the cached paths' content hashes, if the archive info contains them.
+	ContentHashes map[string]string `json:"content_hashes,omitempty"`
+}
+
+// writeRestoreState writes the restore state file and exports its path and the archive checksum for the next steps.
+func writeRestoreState(pth string, state restoreState) error {
+	state.Version = restoreStateVersion
+
+	b, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(pth), 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(pth, b, 0644); err != nil {
+		return err
+	}
+
+	if err := exportEnv(restoreStatePathEnvKey, pth); err != nil {
+		return err
+	}
+	return exportEnv(archiveChecksumEnvKey, state.ArchiveChecksum)
+}
+
+// formatChecksum returns the hash's sum in the `sha256:<hex>` format.
+func formatChecksum(h hash.Hash) string {
+	return "sha256:" + hex.EncodeToString(h.Sum(nil))
+}
+
+// fileChecksum returns the file's checksum in the `sha256:<hex>` format.
+func fileChecksum(pth string) (string, error) {
+	f, err := os.Open(pth)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if err := f.Close(); err != nil {
+			log.Warnf("Failed to close %s: %s", pth, err)
+		}
+	}()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("failed to read %s: %s", pth, err)
+	}
+	return formatChecksum(h), nil
+}
+
+// streamChecksum reads the rest of the stream and returns the checksum of the bytes written to the digest.
+func streamChecksum(r io.Reader, digest hash.Hash) (string, error) {
+	if _, err := io.Copy(ioutil.Discard, r); err != nil {
+		return "", err
+	}
+	return formatChecksum(digest), nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func Test_parseArchiveInfo(t *testing.T) {
+	tests := []struct {
+		name    string
+		json    string
+		want    archiveInfo
+		wantErr bool
+	}{
+		{name: "stack id", json: `{"stack_id": "osx-xcode-12.0.x"}`, want: archiveInfo{StackID: "osx-xcode-12.0.x"}},
+		{
+			name: "content hashes",
+			json: `{"stack_id": "linux", "content_hashes": {"/cache/pods": "abc"}}`,
+			want: archiveInfo{StackID: "linux", ContentHashes: map[string]string{"/cache/pods": "abc"}},
+		},
+		{name: "invalid", json: `{`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseArchiveInfo([]byte(tt.json))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseArchiveInfo() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseArchiveInfo() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestArchiveChecksum(t *testing.T) {
+	dir, err := ioutil.TempDir("", "state-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Logf("failed to remove temp dir: %s", err)
+		}
+	}()
+
+	archive := createTestArchive(t, []testEntry{{name: "/cache/file", content: "content"}}).Bytes()
+	pth := filepath.Join(dir, "cache-archive.tar")
+	if err := ioutil.WriteFile(pth, archive, 0644); err != nil {
+		t.Fatalf("failed to write archive: %s", err)
+	}
+
+	want, err := fileChecksum(pth)
+	if err != nil {
+		t.Fatalf("fileChecksum() error = %v", err)
+	}
+
+	// the streamed checksum covers the bytes not read by the extraction too
+	digest := sha256.New()
+	r := io.TeeReader(bytes.NewReader(archive), digest)
+	if _, err := io.CopyN(ioutil.Discard, r, 512); err != nil {
+		t.Fatalf("failed to read archive: %s", err)
+	}
+	if got, err := streamChecksum(r, digest); err != nil || got != want {
+		t.Errorf("streamChecksum() = %s, %v, want %s", got, err, want)
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// stateSchemaVersion is the version of the state file format, increased on incompatible changes.
+// A state file of an older version is discarded, a newer one is ignored (and kept for the newer step version).
+const stateSchemaVersion = 1
+
+const stateFileName = "state.json"
+
+// cacheState is the bookkeeping of the previous cache pulls on this machine,
+// shared by the cache pulls of the later steps and builds.
+type cacheState struct {
+	SchemaVersion int       `json:"schema_version"`
+	UpdatedAt     time.Time `json:"updated_at"`
+	// LastKey is the key (or the cache API URL) of the last restored cache.
+	LastKey         string `json:"last_key,omitempty"`
+	CacheURL        string `json:"cache_url,omitempty"`
+	ArchiveChecksum string `json:"archive_checksum,omitempty"`
+	Fingerprint     string `json:"fingerprint,omitempty"`
+	// ETags are the ETags of the downloaded archives, by the archive URL without its query.
+	ETags map[string]string `json:"etags,omitempty"`
+	// Chunks is the chunk inventory of the last restored archive.
+	Chunks []archiveChunk `json:"chunks,omitempty"`
+	// ContentHashes are the content hashes of the last restored archive's cached paths, see the local_warm_start input.
+	ContentHashes map[string]string `json:"content_hashes,omitempty"`
+	// Components are the components of the last restored archive, see the split_components input.
+	Components []componentState `json:"components,omitempty"`
+}
+
+// StateDir stores the cacheState, see the state_dir input.
+type StateDir struct {
+	Dir string
+	// readOnly is set if the state file was written by a newer step version.
+	readOnly bool
+}
+
+// NewStateDir creates a new StateDir, it returns nil if dir is empty.
+func NewStateDir(dir string) *StateDir {
+	if dir == "" {
+		return nil
+	}
+	return &StateDir{Dir: dir}
+}
+
+// stateLockTimeout is the wait for the other step runs updating the state.
+const stateLockTimeout = 30 * time.Second
+
+func (d *StateDir) path() string {
+	return filepath.Join(d.Dir, stateFileName)
+}
+
+// Load reads the state, it returns an empty state if there is no (compatible) state yet.
+// A corrupted state file is moved aside, so the next Save starts a new one.
+func (d *StateDir) Load() (cacheState, error) {
+	empty := cacheState{SchemaVersion: stateSchemaVersion}
+
+	if err := ensurePrivateDir(d.Dir); err != nil {
+		return empty, err
+	}
+
+	b, err := ioutil.ReadFile(d.path())
+	if os.IsNotExist(err) {
+		return empty, nil
+	}
+	if err != nil {
+		return empty, err
+	}
+
+	var state cacheState
+	if err := json.Unmarshal(b, &state); err != nil {
+		corrupted := d.path() + ".corrupted"
+		log.Warnf("State file is corrupted, moving it to %s: %s", corrupted, err)
+		if err := os.Rename(d.path(), corrupted); err != nil {
+			return empty, fmt.Errorf("failed to move corrupted state file: %s", err)
+		}
+		return empty, nil
+	}
+
+	switch {
+	case state.SchemaVersion > stateSchemaVersion:
+		log.Warnf("State file was written by a newer step version (schema version: %d), ignoring it", state.SchemaVersion)
+		d.readOnly = true
+		return empty, nil
+	case state.SchemaVersion < stateSchemaVersion:
+		log.Debugf("Discarding state file of schema version %d", state.SchemaVersion)
+		return empty, nil
+	}
+	return state, nil
+}
+
+// Lock locks the state for an update (Load and Save) until Unlock, so the concurrent step runs don't lose
+// each other's updates. The state can be read without the lock (Save writes it atomically).
+func (d *StateDir) Lock() (*fileLock, error) {
+	if err := ensurePrivateDir(d.Dir); err != nil {
+		return nil, err
+	}
+	return lockFile(d.path()+".lock", stateLockTimeout)
+}
+
+// Save writes the state atomically, so an interrupted step does not leave a corrupted state file behind.
+func (d *StateDir) Save(state cacheState) error {
+	if d.readOnly {
+		return nil
+	}
+	state.SchemaVersion = stateSchemaVersion
+	state.UpdatedAt = time.Now()
+
+	b, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ensurePrivateDir(d.Dir); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(d.Dir, stateFileName+"-")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(b); err != nil {
+		if cErr := tmp.Close(); cErr != nil {
+			log.Debugf("Failed to close %s: %s", tmp.Name(), cErr)
+		}
+		if rErr := os.Remove(tmp.Name()); rErr != nil {
+			log.Warnf("Failed to remove %s: %s", tmp.Name(), rErr)
+		}
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), d.path())
+}
+
+// etagTransport records the ETags of the successful GET responses.
+type etagTransport struct {
+	next http.RoundTripper
+
+	mu    sync.Mutex
+	etags map[string]string
+}
+
+func newETagTransport(next http.RoundTripper) *etagTransport {
+	return &etagTransport{next: next, etags: map[string]string{}}
+}
+
+// RoundTrip implements the http.RoundTripper interface.
+func (t *etagTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if err != nil || req.Method != "GET" {
+		return resp, err
+	}
+
+	if etag := resp.Header.Get("ETag"); etag != "" && (resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusPartialContent) {
+		u := *req.URL
+		u.RawQuery = ""
+		t.mu.Lock()
+		t.etags[u.String()] = etag
+		t.mu.Unlock()
+	}
+	return resp, nil
+}
+
+// ETags returns the recorded ETags by the URL without its query, nil if t is nil.
+func (t *etagTransport) ETags() map[string]string {
+	if t == nil {
+		return nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	etags := make(map[string]string, len(t.etags))
+	for k, v := range t.etags {
+		etags[k] = v
+	}
+	return etags
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStateDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "statedir-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Logf("failed to remove temp dir: %s", err)
+		}
+	}()
+
+	d := NewStateDir(filepath.Join(dir, "state"))
+	if state, err := d.Load(); err != nil || state.LastKey != "" {
+		t.Fatalf("StateDir.Load() = %v, %v, want empty state", state, err)
+	}
+
+	want := cacheState{LastKey: "key", ArchiveChecksum: "sha256:abc", ETags: map[string]string{"https://cache/archive": `"etag"`}}
+	if err := d.Save(want); err != nil {
+		t.Fatalf("StateDir.Save() error = %v", err)
+	}
+	got, err := d.Load()
+	if err != nil {
+		t.Fatalf("StateDir.Load() error = %v", err)
+	}
+	if got.LastKey != want.LastKey || got.ArchiveChecksum != want.ArchiveChecksum || got.ETags["https://cache/archive"] != `"etag"` {
+		t.Errorf("StateDir.Load() = %+v, want %+v", got, want)
+	}
+
+	tests := []struct {
+		name          string
+		content       string
+		wantCorrupted bool
+		wantReadOnly  bool
+	}{
+		{name: "corrupted", content: `{"schema_version": 1, "last_key"`, wantCorrupted: true},
+		{name: "older schema", content: `{"last_key": "old"}`},
+		{name: "newer schema", content: `{"schema_version": 99, "last_key": "new"}`, wantReadOnly: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := NewStateDir(filepath.Join(dir, tt.name))
+			if err := os.MkdirAll(d.Dir, 0700); err != nil {
+				t.Fatalf("failed to create state dir: %s", err)
+			}
+			if err := ioutil.WriteFile(d.path(), []byte(tt.content), 0600); err != nil {
+				t.Fatalf("failed to write state file: %s", err)
+			}
+
+			state, err := d.Load()
+			if err != nil {
+				t.Fatalf("StateDir.Load() error = %v", err)
+			}
+			if state.LastKey != "" || state.SchemaVersion != stateSchemaVersion {
+				t.Errorf("StateDir.Load() = %+v, want empty state", state)
+			}
+
+			_, err = os.Stat(d.path() + ".corrupted")
+			if corrupted := err == nil; corrupted != tt.wantCorrupted {
+				t.Errorf("corrupted state file moved aside = %v, want %v", corrupted, tt.wantCorrupted)
+			}
+
+			if err := d.Save(cacheState{LastKey: "key"}); err != nil {
+				t.Fatalf("StateDir.Save() error = %v", err)
+			}
+			b, err := ioutil.ReadFile(d.path())
+			if err != nil {
+				t.Fatalf("failed to read state file: %s", err)
+			}
+			if kept := string(b) == tt.content; kept != tt.wantReadOnly {
+				t.Errorf("state file kept = %v, want %v", kept, tt.wantReadOnly)
+			}
+		})
+	}
+}
+
+func TestETagTransport(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/archive" {
+			w.Header().Set("ETag", `"v1"`)
+		}
+		if _, err := w.Write([]byte("content")); err != nil {
+			t.Errorf("failed to write response: %s", err)
+		}
+	}))
+	defer server.Close()
+
+	transport := newETagTransport(http.DefaultTransport)
+	client := &http.Client{Transport: transport}
+	for _, pth := range []string{"/archive?signature=secret", "/other"} {
+		resp, err := client.Get(server.URL + pth)
+		if err != nil {
+			t.Fatalf("failed to send request: %s", err)
+		}
+		if err := resp.Body.Close(); err != nil {
+			t.Logf("failed to close response body: %s", err)
+		}
+	}
+
+	etags := transport.ETags()
+	if len(etags) != 1 || etags[server.URL+"/archive"] != `"v1"` {
+		t.Errorf("etagTransport.ETags() = %v, want the archive's ETag", etags)
+	}
+	if (*etagTransport)(nil).ETags() != nil {
+		t.Errorf("etagTransport.ETags() = not nil, want nil")
+	}
+}
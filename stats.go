@@ -0,0 +1,163 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// restoreStats are the statistics of a cache restore, persisted to compare with the next build's restore.
+type restoreStats struct {
+	BuildSlug   string  `json:"build_slug,omitempty"`
+	ArchiveSize int64   `json:"archive_size"`
+	FileCount   int     `json:"file_count,omitempty"`
+	Duration    float64 `json:"duration_seconds"`
+}
+
+// readStats reads the previous restore's statistics, it returns nil if the file does not exist.
+func readStats(pth string) (*restoreStats, error) {
+	b, err := ioutil.ReadFile(pth)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var stats restoreStats
+	if err := json.Unmarshal(b, &stats); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %s", pth, err)
+	}
+	return &stats, nil
+}
+
+func writeStats(pth string, stats restoreStats) error {
+	b, err := json.MarshalIndent(stats, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(pth), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(pth, b, 0644)
+}
+
+// growthPercent returns the change from the previous value in percent, 0 if there is no previous value.
+func growthPercent(prev, cur float64) float64 {
+	if prev <= 0 {
+		return 0
+	}
+	return (cur - prev) / prev * 100
+}
+
+// printStatsDiff prints the change of the restore statistics since the previous build
+// and returns the change of the archive size in percent.
+func printStatsDiff(prev, cur restoreStats) float64 {
+	fmt.Println()
+	if prev.BuildSlug != "" {
+		log.Infof("Restore statistics compared to the previous build (%s)", prev.BuildSlug)
+	} else {
+		log.Infof("Restore statistics compared to the previous build")
+	}
+
+	sizeGrowth := growthPercent(float64(prev.ArchiveSize), float64(cur.ArchiveSize))
+	log.Printf("- archive size: %d Bytes (%+d Bytes, %+.1f%%)", cur.ArchiveSize, cur.ArchiveSize-prev.ArchiveSize, sizeGrowth)
+	if prev.FileCount > 0 && cur.FileCount > 0 {
+		log.Printf("- files: %d (%+d, %+.1f%%)", cur.FileCount, cur.FileCount-prev.FileCount, growthPercent(float64(prev.FileCount), float64(cur.FileCount)))
+	}
+	log.Printf("- duration: %.1fs (%+.1fs, %+.1f%%)", cur.Duration, cur.Duration-prev.Duration, growthPercent(prev.Duration, cur.Duration))
+
+	return sizeGrowth
+}
+
+// entryCounter counts the entries of the archive stream written to it, in the background.
+type entryCounter struct {
+	pw    *io.PipeWriter
+	done  chan struct{}
+	count int
+	// names are the entries' names, if collected.
+	names        []string
+	collectNames bool
+}
+
+// newEntryCounter creates a new entryCounter, the stream is gzip decompressed if compressed is set.
+func newEntryCounter(compressed, collectNames bool) *entryCounter {
+	pr, pw := io.Pipe()
+	c := &entryCounter{pw: pw, done: make(chan struct{}), collectNames: collectNames}
+
+	go func() {
+		defer close(c.done)
+		if err := c.countEntries(pr, compressed); err != nil {
+			log.Debugf("Failed to count archive entries: %s", err)
+			c.count = 0
+			c.names = nil
+		}
+		// keep draining the stream, the writes must not block the extraction
+		if _, err := io.Copy(ioutil.Discard, pr); err != nil {
+			log.Debugf("Failed to drain archive stream: %s", err)
+		}
+	}()
+
+	return c
+}
+
+func (c *entryCounter) countEntries(r io.Reader, compressed bool) error {
+	if compressed {
+		gr, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		r = gr
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag == tar.TypeXGlobalHeader {
+			continue
+		}
+		if hdr.Typeflag != tar.TypeDir {
+			c.count++
+		}
+		if c.collectNames {
+			c.names = append(c.names, hdr.Name)
+		}
+	}
+}
+
+// Write implements the io.Writer interface.
+func (c *entryCounter) Write(p []byte) (int, error) {
+	return c.pw.Write(p)
+}
+
+// Count waits for the end of the stream and returns the number of (non directory) entries, 0 if the stream is invalid.
+func (c *entryCounter) Count() int {
+	c.wait()
+	return c.count
+}
+
+// Names waits for the end of the stream and returns the collected entry names, nil if the stream is invalid.
+func (c *entryCounter) Names() []string {
+	c.wait()
+	return c.names
+}
+
+func (c *entryCounter) wait() {
+	if err := c.pw.Close(); err != nil {
+		log.Debugf("Failed to close entry counter: %s", err)
+	}
+	<-c.done
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEntryCounter(t *testing.T) {
+	entries := []testEntry{
+		{name: "dir/", typeflag: tar.TypeDir},
+		{name: "dir/a", content: "a"},
+		{name: "dir/b", content: "b"},
+		{name: "dir/c", typeflag: tar.TypeSymlink, linkname: "a"},
+	}
+
+	t.Log("tar stream")
+	{
+		c := newEntryCounter(false, false)
+		if _, err := io.Copy(c, createTestArchive(t, entries)); err != nil {
+			t.Fatalf("failed to write archive: %s", err)
+		}
+		if got := c.Count(); got != 3 {
+			t.Errorf("entryCounter.Count() = %d, want 3", got)
+		}
+	}
+
+	t.Log("gzip compressed tar stream")
+	{
+		var buff bytes.Buffer
+		gw := gzip.NewWriter(&buff)
+		if _, err := io.Copy(gw, createTestArchive(t, entries)); err != nil {
+			t.Fatalf("failed to compress archive: %s", err)
+		}
+		if err := gw.Close(); err != nil {
+			t.Fatalf("failed to close gzip writer: %s", err)
+		}
+
+		c := newEntryCounter(true, false)
+		if _, err := io.Copy(c, &buff); err != nil {
+			t.Fatalf("failed to write archive: %s", err)
+		}
+		if got := c.Count(); got != 3 {
+			t.Errorf("entryCounter.Count() = %d, want 3", got)
+		}
+	}
+
+	t.Log("invalid stream")
+	{
+		c := newEntryCounter(true, false)
+		if _, err := c.Write([]byte("not an archive")); err != nil {
+			t.Fatalf("entryCounter.Write() error = %v", err)
+		}
+		if got := c.Count(); got != 0 {
+			t.Errorf("entryCounter.Count() = %d, want 0", got)
+		}
+	}
+}
+
+func TestStats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stats-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Logf("failed to remove temp dir: %s", err)
+		}
+	}()
+
+	pth := filepath.Join(dir, "stats", "cache-pull-stats.json")
+	if prev, err := readStats(pth); err != nil || prev != nil {
+		t.Fatalf("readStats() = %v, %v, want nil, nil", prev, err)
+	}
+
+	prev := restoreStats{BuildSlug: "previous", ArchiveSize: 100, FileCount: 10, Duration: 2}
+	if err := writeStats(pth, prev); err != nil {
+		t.Fatalf("writeStats() error = %v", err)
+	}
+	got, err := readStats(pth)
+	if err != nil {
+		t.Fatalf("readStats() error = %v", err)
+	}
+	if *got != prev {
+		t.Errorf("readStats() = %v, want %v", *got, prev)
+	}
+
+	if growth := printStatsDiff(prev, restoreStats{ArchiveSize: 250, FileCount: 12, Duration: 3}); growth != 150 {
+		t.Errorf("printStatsDiff() = %v, want 150", growth)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"sync/atomic"
+	"time"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// telemetryPath is appended to the cache API URL to report the pull's telemetry.
+const telemetryPath = "/telemetry"
+
+// pullTelemetry is reported to the cache API, to let the service suggest better cache configurations.
+type pullTelemetry struct {
+	BuildSlug            string  `json:"build_slug"`
+	StackID              string  `json:"stack_id"`
+	Hit                  bool    `json:"hit"`
+	Fallback             bool    `json:"fallback"`
+	Compressed           bool    `json:"compressed"`
+	ArchiveSize          int64   `json:"archive_size"`
+	DecompressionSeconds float64 `json:"decompression_seconds"`
+}
+
+// TelemetryClient reports the pull's telemetry to the cache API.
+type TelemetryClient struct {
+	URL string
+
+	client *http.Client
+}
+
+// NewTelemetryClient creates a new TelemetryClient for the given cache API URL.
+// The telemetryPath is joined to the URL's path, its query is kept.
+func NewTelemetryClient(cacheAPIURL string) *TelemetryClient {
+	c := &TelemetryClient{client: &http.Client{Timeout: 10 * time.Second}}
+	u, err := url.Parse(cacheAPIURL)
+	if err != nil {
+		log.Debugf("Invalid cache API URL, no telemetry: %s", err)
+		return c
+	}
+	u.Path = path.Join("/", u.Path, telemetryPath)
+	u.RawPath = ""
+	c.URL = u.String()
+	return c
+}
+
+// Report sends the telemetry, failing to do so is not fatal.
+func (c *TelemetryClient) Report(telemetry pullTelemetry) {
+	if err := c.post(telemetry); err != nil {
+		log.Debugf("Failed to report telemetry: %s", err)
+		return
+	}
+	log.Debugf("telemetry reported")
+}
+
+func (c *TelemetryClient) post(telemetry pullTelemetry) error {
+	b, err := json.Marshal(telemetry)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.client.Post(c.URL, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			log.Warnf("Failed to close response body: %s", err)
+		}
+	}()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("non success response code: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// newPullTelemetry creates the telemetry of the given result.
+func newPullTelemetry(conf Config, r *PullResult) pullTelemetry {
+	return pullTelemetry{
+		BuildSlug:            conf.BuildSlug,
+		StackID:              conf.StackID,
+		Hit:                  r.Status == statusRestored || r.Status == statusFallbackRestored || r.Status == statusUnchanged,
+		Fallback:             r.Status == statusFallbackRestored,
+		Compressed:           r.Compressed,
+		ArchiveSize:          r.ArchiveSize,
+		DecompressionSeconds: r.decompression.Seconds(),
+	}
+}
+
+// decompressionTimer measures the time a decompressor spends decompressing: the time spent reading the decompressed stream,
+// less the time the decompressor waited for the compressed stream (the download).
+type decompressionTimer struct {
+	// the durations in nanoseconds, the decompression may run in a pipeline stage's goroutine
+	source       int64
+	decompressed int64
+}
+
+// Source wraps the decompressor's compressed source.
+func (t *decompressionTimer) Source(r io.Reader) io.Reader {
+	return timedReader{r: r, elapsed: &t.source}
+}
+
+// Decompressed wraps the decompressor.
+func (t *decompressionTimer) Decompressed(r io.Reader) io.Reader {
+	return timedReader{r: r, elapsed: &t.decompressed}
+}
+
+// Opened records the time of opening the decompressor, which reads its header from the source.
+func (t *decompressionTimer) Opened(d time.Duration) {
+	atomic.AddInt64(&t.decompressed, int64(d))
+}
+
+// Elapsed returns the time spent decompressing.
+func (t *decompressionTimer) Elapsed() time.Duration {
+	return time.Duration(atomic.LoadInt64(&t.decompressed) - atomic.LoadInt64(&t.source))
+}
+
+// timedReader sums the time spent in its Read calls.
+type timedReader struct {
+	r       io.Reader
+	elapsed *int64
+}
+
+// Read implements the io.Reader interface.
+func (r timedReader) Read(p []byte) (int, error) {
+	start := time.Now()
+	n, err := r.r.Read(p)
+	atomic.AddInt64(r.elapsed, int64(time.Since(start)))
+	return n, err
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func TestNewTelemetryClient(t *testing.T) {
+	for uri, want := range map[string]string{
+		"https://cache.bitrise.io/api":           "https://cache.bitrise.io/api/telemetry",
+		"https://cache.bitrise.io/api/":          "https://cache.bitrise.io/api/telemetry",
+		"https://cache.bitrise.io":               "https://cache.bitrise.io/telemetry",
+		"https://cache.bitrise.io/api?region=eu": "https://cache.bitrise.io/api/telemetry?region=eu",
+	} {
+		if got := NewTelemetryClient(uri).URL; got != want {
+			t.Errorf("NewTelemetryClient(%s).URL = %s, want %s", uri, got, want)
+		}
+	}
+}
+
+func TestTelemetryClient_post(t *testing.T) {
+	telemetry := pullTelemetry{BuildSlug: "build-slug", StackID: "linux-docker-android", Hit: true, Compressed: true, ArchiveSize: 1024, DecompressionSeconds: 1.5}
+
+	tests := []struct {
+		name    string
+		status  int
+		wantErr bool
+	}{
+		{name: "ok", status: http.StatusOK},
+		{name: "accepted", status: http.StatusAccepted},
+		{name: "server error", status: http.StatusInternalServerError, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got pullTelemetry
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != "POST" || r.URL.Path != "/api"+telemetryPath {
+					t.Errorf("request = %s %s, want POST /api%s", r.Method, r.URL.Path, telemetryPath)
+				}
+				if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+					t.Errorf("failed to decode telemetry: %s", err)
+				}
+				w.WriteHeader(tt.status)
+			}))
+			defer server.Close()
+
+			if err := NewTelemetryClient(server.URL + "/api").post(telemetry); (err != nil) != tt.wantErr {
+				t.Fatalf("post() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != telemetry {
+				t.Errorf("reported telemetry = %+v, want %+v", got, telemetry)
+			}
+		})
+	}
+}
+
+func TestNewPullTelemetry(t *testing.T) {
+	conf := Config{BuildSlug: "build-slug", StackID: "osx-xcode-16"}
+	// the download and the extraction are not part of the decompression time
+	phases := map[string]float64{"resolve": 1, "download_and_extract": 2, "fallback": 3}
+
+	tests := []struct {
+		status       string
+		wantHit      bool
+		wantFallback bool
+	}{
+		{status: statusRestored, wantHit: true},
+		{status: statusFallbackRestored, wantHit: true, wantFallback: true},
+		{status: statusUnchanged, wantHit: true},
+		{status: statusMiss},
+		{status: statusFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.status, func(t *testing.T) {
+			r := &PullResult{Status: tt.status, Compressed: true, ArchiveSize: 1024, Phases: phases, decompression: 1500 * time.Millisecond}
+			want := pullTelemetry{
+				BuildSlug:            "build-slug",
+				StackID:              "osx-xcode-16",
+				Hit:                  tt.wantHit,
+				Fallback:             tt.wantFallback,
+				Compressed:           true,
+				ArchiveSize:          1024,
+				DecompressionSeconds: 1.5,
+			}
+			if got := newPullTelemetry(conf, r); got != want {
+				t.Errorf("newPullTelemetry() = %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+// slowReader is a download waiting for the network before each read.
+type slowReader struct {
+	r     io.Reader
+	delay time.Duration
+}
+
+func (r slowReader) Read(p []byte) (int, error) {
+	time.Sleep(r.delay)
+	return r.r.Read(p)
+}
+
+func TestDecompressionTimer(t *testing.T) {
+	var compressed bytes.Buffer
+	gw := gzip.NewWriter(&compressed)
+	if _, err := gw.Write(bytes.Repeat([]byte("archive content "), 64*1024)); err != nil {
+		t.Fatalf("failed to compress: %s", err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatalf("failed to compress: %s", err)
+	}
+
+	var timer decompressionTimer
+	download := slowReader{r: iotest.HalfReader(&compressed), delay: 10 * time.Millisecond}
+	start := time.Now()
+	gr, err := gzip.NewReader(timer.Source(download))
+	timer.Opened(time.Since(start))
+	if err != nil {
+		t.Fatalf("failed to open gzip stream: %s", err)
+	}
+	if _, err := io.Copy(ioutil.Discard, timer.Decompressed(gr)); err != nil {
+		t.Fatalf("failed to decompress: %s", err)
+	}
+	total := time.Since(start)
+
+	elapsed := timer.Elapsed()
+	if elapsed <= 0 || elapsed > total/2 {
+		t.Errorf("Elapsed() = %s, want the decompression time without the download's waiting (total %s)", elapsed, total)
+	}
+}
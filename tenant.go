@@ -0,0 +1,70 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"syscall"
+)
+
+// unsafeTenantChars are replaced in the tenant ID, so it can be used as a path element.
+var unsafeTenantChars = regexp.MustCompile(`[^A-Za-z0-9_-]`)
+
+// stepTempDir is the directory of the step's temporary files: the current tenant's private directory
+// (see tenantTempDir) once the step config is parsed.
+var stepTempDir = os.TempDir()
+
+// tenantID identifies the app the local state and temporary files belong to, so the builds of different apps
+// on a shared runner don't use each other's files: the app slug, or the hash of the workspace if the slug is unknown.
+func tenantID(appSlug, workspace string) string {
+	if appSlug != "" {
+		return unsafeTenantChars.ReplaceAllString(appSlug, "_")
+	}
+	if workspace != "" {
+		sum := sha256.Sum256([]byte(filepath.Clean(workspace)))
+		return "ws-" + hex.EncodeToString(sum[:8])
+	}
+	return "default"
+}
+
+// tenantTempDir is the tenant's directory in the system's temporary directory.
+// It is not shared between the tenants (unlike a common parent), so the first tenant can not lock out the others.
+func tenantTempDir(tenant string) string {
+	return filepath.Join(os.TempDir(), "cache-pull-"+tenant)
+}
+
+// namespacedStateDir is the tenant's directory in the state dir (the instance's subdirectory if the instance is named),
+// empty if keeping the state is disabled.
+func namespacedStateDir(dir, tenant, instance string) string {
+	if dir == "" {
+		return ""
+	}
+	return filepath.Join(dir, tenant, instance)
+}
+
+// ensurePrivateDir creates the directory (with its parents) accessible only to the current user.
+// An existing directory must be owned by the current user and its group and other permissions are removed,
+// so another user of the host can not read or plant files in it.
+func ensurePrivateDir(dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok && int(stat.Uid) != os.Getuid() {
+		return fmt.Errorf("%s is owned by another user (uid: %d)", dir, stat.Uid)
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		return os.Chmod(dir, 0700)
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func Test_tenantID(t *testing.T) {
+	tests := []struct {
+		name      string
+		appSlug   string
+		workspace string
+		want      string
+	}{
+		{name: "app slug", appSlug: "a1b2c3", workspace: "/bitrise/src", want: "a1b2c3"},
+		{name: "unsafe app slug", appSlug: "../app", want: "___app"},
+		{name: "workspace", workspace: "/bitrise/src", want: tenantID("", "/bitrise/src/")},
+		{name: "none", want: "default"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tenantID(tt.appSlug, tt.workspace); got != tt.want {
+				t.Errorf("tenantID() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+
+	if a, b := tenantID("", "/workspace/a"), tenantID("", "/workspace/b"); a == b || !strings.HasPrefix(a, "ws-") {
+		t.Errorf("tenantID() of different workspaces = %s, %s, want different ws- IDs", a, b)
+	}
+}
+
+func Test_ensurePrivateDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tenant-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Logf("failed to remove temp dir: %s", err)
+		}
+	}()
+
+	t.Log("creates the directory")
+	{
+		pth := filepath.Join(dir, "new", "tenant")
+		if err := ensurePrivateDir(pth); err != nil {
+			t.Fatalf("ensurePrivateDir() error = %v", err)
+		}
+		if info, err := os.Stat(pth); err != nil || info.Mode().Perm() != 0700 {
+			t.Errorf("ensurePrivateDir() mode = %v, %v, want 0700", info, err)
+		}
+	}
+
+	t.Log("removes the group and other permissions")
+	{
+		pth := filepath.Join(dir, "shared")
+		if err := os.Mkdir(pth, 0777); err != nil {
+			t.Fatalf("failed to create dir: %s", err)
+		}
+		if err := os.Chmod(pth, 0777); err != nil {
+			t.Fatalf("failed to set mode: %s", err)
+		}
+		if err := ensurePrivateDir(pth); err != nil {
+			t.Fatalf("ensurePrivateDir() error = %v", err)
+		}
+		if info, err := os.Stat(pth); err != nil || info.Mode().Perm() != 0700 {
+			t.Errorf("ensurePrivateDir() mode = %v, %v, want 0700", info, err)
+		}
+	}
+
+	t.Log("rejects a symlink")
+	{
+		pth := filepath.Join(dir, "link")
+		if err := os.Symlink(filepath.Join(dir, "shared"), pth); err != nil {
+			t.Fatalf("failed to create symlink: %s", err)
+		}
+		if err := ensurePrivateDir(pth); err == nil {
+			t.Errorf("ensurePrivateDir() error = nil, want error")
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// tlsVersions are the supported minimum TLS versions, see the tls_min_version input.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// parseTLSVersion parses the minimum TLS version, empty defaults to TLS 1.2.
+func parseTLSVersion(s string) (uint16, error) {
+	if s == "" {
+		return tls.VersionTLS12, nil
+	}
+	version, ok := tlsVersions[s]
+	if !ok {
+		return 0, fmt.Errorf("unsupported TLS version (%s), expected one of 1.0, 1.1, 1.2, 1.3", s)
+	}
+	return version, nil
+}
+
+// parseCipherSuites parses the comma or newline separated cipher suite names (e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256).
+// Only the secure cipher suites of crypto/tls are accepted.
+func parseCipherSuites(s string) ([]uint16, error) {
+	suites := map[string]uint16{}
+	for _, suite := range tls.CipherSuites() {
+		suites[suite.Name] = suite.ID
+	}
+
+	var ids []uint16
+	for _, field := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == '\n' }) {
+		name := strings.TrimSpace(field)
+		if name == "" {
+			continue
+		}
+		id, ok := suites[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown or insecure cipher suite (%s)", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// tlsOptions are the TLS settings of the step's connections.
+type tlsOptions struct {
+	// MinVersion is the minimum TLS version (1.0, 1.1, 1.2, 1.3), empty defaults to TLS 1.2.
+	MinVersion string
+	// CipherSuites are the comma or newline separated TLS 1.2 cipher suite names, empty allows the Go defaults.
+	CipherSuites string
+	// ClientCert and ClientKey are the client certificate and its private key for mutual TLS,
+	// either PEM encoded contents or the paths of PEM files.
+	ClientCert string
+	ClientKey  string
+}
+
+// loadPEM returns the PEM encoded value, or the contents of the file if the value is a path.
+func loadPEM(value string) ([]byte, error) {
+	if strings.HasPrefix(strings.TrimSpace(value), "-----BEGIN") {
+		return []byte(value), nil
+	}
+	return ioutil.ReadFile(value)
+}
+
+// loadClientCertificate loads the client certificate and key, see tlsOptions.
+func loadClientCertificate(cert, key string) (tls.Certificate, error) {
+	if cert == "" || key == "" {
+		return tls.Certificate{}, fmt.Errorf("both the client certificate and key are required")
+	}
+	certPEM, err := loadPEM(cert)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to read the client certificate: %s", err)
+	}
+	keyPEM, err := loadPEM(key)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to read the client key: %s", err)
+	}
+	certificate, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("invalid client certificate or key: %s", err)
+	}
+	return certificate, nil
+}
+
+// newTLSConfig returns the TLS config of the step's connections.
+// The TLS 1.3 cipher suites are not configurable, the cipher suites only restrict the TLS 1.2 (and older) connections.
+// The client certificate is sent to the servers requesting one (e.g. an internal cache API), for any request.
+func newTLSConfig(opts tlsOptions) (*tls.Config, error) {
+	version, err := parseTLSVersion(opts.MinVersion)
+	if err != nil {
+		return nil, err
+	}
+	suites, err := parseCipherSuites(opts.CipherSuites)
+	if err != nil {
+		return nil, err
+	}
+	if len(suites) > 0 && version == tls.VersionTLS13 {
+		return nil, fmt.Errorf("the cipher suites of TLS 1.3 are not configurable")
+	}
+	config := &tls.Config{MinVersion: version, CipherSuites: suites}
+
+	if opts.ClientCert != "" || opts.ClientKey != "" {
+		certificate, err := loadClientCertificate(opts.ClientCert, opts.ClientKey)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{certificate}
+	}
+	return config, nil
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func Test_newTLSConfig(t *testing.T) {
+	tests := []struct {
+		name         string
+		minVersion   string
+		cipherSuites string
+		want         *tls.Config
+		wantErr      bool
+	}{
+		{name: "defaults", want: &tls.Config{MinVersion: tls.VersionTLS12}},
+		{name: "TLS 1.3", minVersion: "1.3", want: &tls.Config{MinVersion: tls.VersionTLS13}},
+		{
+			name:         "cipher suites",
+			minVersion:   "1.2",
+			cipherSuites: "TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,\nTLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384\n",
+			want:         &tls.Config{MinVersion: tls.VersionTLS12, CipherSuites: []uint16{tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384, tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384}},
+		},
+		{name: "unknown version", minVersion: "2.0", wantErr: true},
+		{name: "insecure cipher suite", cipherSuites: "TLS_RSA_WITH_RC4_128_SHA", wantErr: true},
+		{name: "TLS 1.3 cipher suites", minVersion: "1.3", cipherSuites: "TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := newTLSConfig(tlsOptions{MinVersion: tt.minVersion, CipherSuites: tt.cipherSuites})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("newTLSConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("newTLSConfig() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewTransport_tlsMinVersion(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.TLS = &tls.Config{MaxVersion: tls.VersionTLS12}
+	server.StartTLS()
+	defer server.Close()
+
+	for _, tt := range []struct {
+		minVersion string
+		wantErr    bool
+	}{
+		{minVersion: "1.2"},
+		{minVersion: "1.3", wantErr: true},
+	} {
+		tlsConfig, err := newTLSConfig(tlsOptions{MinVersion: tt.minVersion})
+		if err != nil {
+			t.Fatalf("newTLSConfig() error = %v", err)
+		}
+		// trust the test server's certificate
+		tlsConfig.RootCAs = server.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+
+		client := &http.Client{Transport: newTransport(dialOptions{}, tlsConfig)}
+		resp, err := client.Get(server.URL)
+		if err == nil {
+			if cErr := resp.Body.Close(); cErr != nil {
+				t.Logf("failed to close response body: %s", cErr)
+			}
+		}
+		if (err != nil) != tt.wantErr {
+			t.Errorf("Get() with minimum TLS %s error = %v, wantErr %v", tt.minVersion, err, tt.wantErr)
+		}
+	}
+}
+
+// createClientCertificate returns a self-signed client certificate and its key, PEM encoded.
+func createClientCertificate(t *testing.T) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "cache-pull"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %s", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("failed to marshal key: %s", err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}))
+}
+
+func TestNewTransport_clientCertificate(t *testing.T) {
+	certPEM, keyPEM := createClientCertificate(t)
+
+	dir, err := ioutil.TempDir("", "tls-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Logf("failed to remove temp dir: %s", err)
+		}
+	}()
+	certPath, keyPath := filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key")
+	if err := ioutil.WriteFile(certPath, []byte(certPEM), 0600); err != nil {
+		t.Fatalf("failed to write certificate: %s", err)
+	}
+	if err := ioutil.WriteFile(keyPath, []byte(keyPEM), 0600); err != nil {
+		t.Fatalf("failed to write key: %s", err)
+	}
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AppendCertsFromPEM([]byte(certPEM))
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	server.StartTLS()
+	defer server.Close()
+
+	tests := []struct {
+		name    string
+		opts    tlsOptions
+		wantErr bool
+	}{
+		{name: "PEM contents", opts: tlsOptions{ClientCert: certPEM, ClientKey: keyPEM}},
+		{name: "PEM files", opts: tlsOptions{ClientCert: certPath, ClientKey: keyPath}},
+		{name: "no client certificate", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tlsConfig, err := newTLSConfig(tt.opts)
+			if err != nil {
+				t.Fatalf("newTLSConfig() error = %v", err)
+			}
+			tlsConfig.RootCAs = server.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+
+			client := &http.Client{Transport: newTransport(dialOptions{}, tlsConfig)}
+			resp, err := client.Get(server.URL)
+			if err == nil {
+				if cErr := resp.Body.Close(); cErr != nil {
+					t.Logf("failed to close response body: %s", cErr)
+				}
+			}
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Get() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	t.Log("missing key")
+	{
+		if _, err := newTLSConfig(tlsOptions{ClientCert: certPEM}); err == nil {
+			t.Errorf("newTLSConfig() error = nil, want error")
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// tmpfsPath is a restored cache path kept in RAM, see the tmpfs_paths input.
+type tmpfsPath struct {
+	Path string
+	// Target is the path's copy on the tmpfs, Path is a symlink to it.
+	Target string
+	Size   int64
+}
+
+// treeSize returns the total size of the regular files under pth.
+func treeSize(pth string) (int64, error) {
+	var size int64
+	err := filepath.Walk(pth, func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+// freeSpace returns the Bytes available to the user on the filesystem of dir.
+func freeSpace(dir string) (int64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, err
+	}
+	return int64(uint64(st.Bavail) * uint64(st.Bsize)), nil
+}
+
+// tmpfsTarget returns the path's location in the tmpfs directory, named after the path.
+func tmpfsTarget(dir, pth string) string {
+	return filepath.Join(dir, strings.Replace(strings.TrimLeft(pth, string(filepath.Separator)), string(filepath.Separator), "_", -1))
+}
+
+// moveToTmpfs moves the restored paths into the tmpfs directory (e.g. a ramdisk) and symlinks them into place,
+// so the builds reading them heavily (e.g. ccache) don't wait for a slow disk.
+// The paths larger than maxSize (in Bytes), or not fitting the tmpfs, stay on the disk.
+func moveToTmpfs(paths []string, dir string, maxSize int64) ([]tmpfsPath, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	var moved []tmpfsPath
+	for _, pth := range paths {
+		info, err := os.Lstat(pth)
+		if os.IsNotExist(err) {
+			log.Debugf("%s is not restored, not moving it to the tmpfs", pth)
+			continue
+		}
+		if err != nil {
+			return moved, err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			log.Debugf("%s is a symlink, not moving it to the tmpfs", pth)
+			continue
+		}
+
+		size, err := treeSize(pth)
+		if err != nil {
+			return moved, fmt.Errorf("failed to get the size of %s: %s", pth, err)
+		}
+		if maxSize > 0 && size > maxSize {
+			result.Warnf("%s (%s) is larger than the tmpfs size limit (%s), keeping it on the disk", pth, formatBytes(size), formatBytes(maxSize))
+			continue
+		}
+		if free, err := freeSpace(dir); err != nil {
+			log.Debugf("Failed to get the free space of %s: %s", dir, err)
+		} else if size > free {
+			result.Warnf("%s (%s) does not fit the tmpfs (%s free), keeping it on the disk", pth, formatBytes(size), formatBytes(free))
+			continue
+		}
+
+		target := tmpfsTarget(dir, pth)
+		if err := os.RemoveAll(target); err != nil {
+			return moved, err
+		}
+		if err := movePath(pth, target); err != nil {
+			return moved, fmt.Errorf("failed to move %s to the tmpfs: %s", pth, err)
+		}
+		if err := os.Symlink(target, pth); err != nil {
+			if mErr := movePath(target, pth); mErr != nil {
+				return moved, fmt.Errorf("failed to link %s to the tmpfs (%s) and failed to move it back: %s", pth, err, mErr)
+			}
+			return moved, fmt.Errorf("failed to link %s to the tmpfs: %s", pth, err)
+		}
+		moved = append(moved, tmpfsPath{Path: pth, Target: target, Size: size})
+	}
+	return moved, nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMoveToTmpfs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tmpfs-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Logf("failed to remove temp dir: %s", err)
+		}
+	}()
+	result = NewPullResult("", false)
+	defer func() { result = nil }()
+
+	hot := filepath.Join(dir, "home", ".ccache")
+	large := filepath.Join(dir, "home", ".gradle")
+	for pth, content := range map[string]string{
+		filepath.Join(hot, "0", "object.o"): "object",
+		filepath.Join(large, "caches.bin"):  strings.Repeat("x", 2048),
+	} {
+		if err := os.MkdirAll(filepath.Dir(pth), 0755); err != nil {
+			t.Fatalf("failed to create dir: %s", err)
+		}
+		if err := ioutil.WriteFile(pth, []byte(content), 0644); err != nil {
+			t.Fatalf("failed to write file: %s", err)
+		}
+	}
+
+	tmpfsDir := filepath.Join(dir, "shm")
+	paths := []string{hot, large, filepath.Join(dir, "home", "missing")}
+	moved, err := moveToTmpfs(paths, tmpfsDir, 1024)
+	if err != nil {
+		t.Fatalf("moveToTmpfs() error = %v", err)
+	}
+	if len(moved) != 1 || moved[0].Path != hot || moved[0].Size != int64(len("object")) {
+		t.Fatalf("moveToTmpfs() = %+v, want only %s", moved, hot)
+	}
+
+	if target, err := os.Readlink(hot); err != nil || target != tmpfsTarget(tmpfsDir, hot) {
+		t.Errorf("%s links to %s (%v), want %s", hot, target, err, tmpfsTarget(tmpfsDir, hot))
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(hot, "0", "object.o")); err != nil || string(b) != "object" {
+		t.Errorf("object.o = %s (%v), want the restored content", b, err)
+	}
+	if info, err := os.Lstat(large); err != nil || !info.IsDir() {
+		t.Errorf("%s moved, want it kept on the disk (above the size limit)", large)
+	}
+	if len(result.Warnings) != 1 {
+		t.Errorf("warnings = %v, want the size limit warning", result.Warnings)
+	}
+
+	t.Log("already moved")
+	{
+		moved, err := moveToTmpfs([]string{hot}, tmpfsDir, 0)
+		if err != nil || len(moved) != 0 {
+			t.Errorf("moveToTmpfs() = %+v, %v, want the symlink skipped", moved, err)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"unicode/utf8"
+
+	"github.com/bitrise-io/go-utils/log"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Unicode normalization forms, see the unicode_normalization input.
+const (
+	normalizationNone = "none"
+	normalizationAuto = "auto"
+	normalizationNFC  = "nfc"
+	normalizationNFD  = "nfd"
+)
+
+// resolveNormalization returns the normalization form to use in dir. For auto, it is the form of the names
+// on the directory's filesystem: HFS+ stores the names decomposed, the others keep them as written
+// (composed by the Linux tools).
+func resolveNormalization(form, dir string) (string, error) {
+	if form != normalizationAuto {
+		return form, nil
+	}
+	decomposing, err := isDecomposingFS(dir)
+	if err != nil {
+		return "", err
+	}
+	if decomposing {
+		return normalizationNFD, nil
+	}
+	return normalizationNFC, nil
+}
+
+// isDecomposingFS reports whether the filesystem of the given directory stores the file names decomposed (NFD).
+func isDecomposingFS(dir string) (bool, error) {
+	probeDir, err := ioutil.TempDir(dir, "normalization-probe-")
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		if err := os.RemoveAll(probeDir); err != nil {
+			log.Warnf("Failed to remove %s: %s", probeDir, err)
+		}
+	}()
+
+	if err := ioutil.WriteFile(filepath.Join(probeDir, "\u00e9"), nil, 0600); err != nil {
+		return false, err
+	}
+	names, err := readDirNames(probeDir)
+	if err != nil {
+		return false, err
+	}
+	return len(names) == 1 && names[0] == "e\u0301", nil
+}
+
+// normalizeName converts the name to the given normalization form.
+func normalizeName(name, form string) string {
+	if !isNonASCII(name) {
+		return name
+	}
+	switch form {
+	case normalizationNFC:
+		return norm.NFC.String(name)
+	case normalizationNFD:
+		return norm.NFD.String(name)
+	default:
+		return name
+	}
+}
+
+func isNonASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_normalizeName(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		form string
+		want string
+	}{
+		{"ASCII is untouched", "Pods/Alamofire", normalizationNFD, "Pods/Alamofire"},
+		{"composed to NFD", "r\u00e9sum\u00e9.txt", normalizationNFD, "re\u0301sume\u0301.txt"},
+		{"decomposed to NFC", "re\u0301sume\u0301.txt", normalizationNFC, "r\u00e9sum\u00e9.txt"},
+		{"composed stays NFC", "\u00fcber", normalizationNFC, "\u00fcber"},
+		{"multiple marks to NFD", "\u01d6", normalizationNFD, "u\u0308\u0304"},
+		{"multiple marks to NFC", "u\u0308\u0304", normalizationNFC, "\u01d6"},
+		{"Hangul to NFD", "\ud55c", normalizationNFD, "\u1112\u1161\u11ab"},
+		{"Hangul to NFC", "\u1112\u1161\u11ab", normalizationNFC, "\ud55c"},
+		{"combining marks reordered", "a\u0301\u0323", normalizationNFD, "a\u0323\u0301"},
+		{"reordered marks to NFC", "a\u0301\u0323", normalizationNFC, "\u1ea1\u0301"},
+		{"Japanese dakuten to NFC", "\u304b\u3099", normalizationNFC, "\u304c"},
+		{"none keeps the name", "re\u0301sume\u0301.txt", normalizationNone, "re\u0301sume\u0301.txt"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := normalizeName(tt.in, tt.form); got != tt.want {
+				t.Errorf("normalizeName() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_resolveNormalization(t *testing.T) {
+	dir, err := ioutil.TempDir("", "normalization-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Logf("failed to remove temp dir: %s", err)
+		}
+	}()
+
+	decomposing, err := isDecomposingFS(dir)
+	if err != nil {
+		t.Fatalf("isDecomposingFS() error = %v", err)
+	}
+	wantAuto := normalizationNFC
+	if decomposing {
+		wantAuto = normalizationNFD
+	}
+
+	for form, want := range map[string]string{
+		normalizationAuto: wantAuto,
+		normalizationNone: normalizationNone,
+		normalizationNFD:  normalizationNFD,
+	} {
+		got, err := resolveNormalization(form, dir)
+		if err != nil {
+			t.Fatalf("resolveNormalization(%s) error = %v", form, err)
+		}
+		if got != want {
+			t.Errorf("resolveNormalization(%s) = %s, want %s", form, got, want)
+		}
+	}
+	if names, err := readDirNames(dir); err != nil || len(names) != 0 {
+		t.Errorf("probe files left: %v (%v)", names, err)
+	}
+
+	if _, err := resolveNormalization(normalizationAuto, filepath.Join(dir, "missing")); err == nil {
+		t.Errorf("resolveNormalization() error = nil for a missing directory")
+	}
+}
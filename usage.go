@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// usageSnapshotPathEnvKey is exported with the usage snapshot's path, for the --report-unused mode of the cache push step.
+const usageSnapshotPathEnvKey = "BITRISE_CACHE_PULL_USAGE_SNAPSHOT_PATH"
+
+// usageSnapshot records the restored paths, so the --report-unused mode can tell which ones the build did not access.
+type usageSnapshot struct {
+	// RestoredAt is the end of the extraction, the files accessed later are used.
+	RestoredAt time.Time `json:"restored_at"`
+	// Paths are the restored paths (the archive's topmost entries).
+	Paths []string `json:"paths"`
+	// AccessTimes reports whether the restored paths' filesystem records the access times.
+	AccessTimes bool `json:"access_times"`
+}
+
+// unusedPath is a restored path without an accessed file.
+type unusedPath struct {
+	Path string
+	Size int64
+}
+
+// recordsAccessTimes reports whether the filesystem of dir updates the access time of a read file
+// (it does not with the noatime mount option).
+func recordsAccessTimes(dir string) (bool, error) {
+	f, err := ioutil.TempFile(dir, "atime-probe-")
+	if err != nil {
+		return false, err
+	}
+	pth := f.Name()
+	defer func() {
+		if err := os.Remove(pth); err != nil {
+			log.Warnf("Failed to remove %s: %s", pth, err)
+		}
+	}()
+	if _, err := f.WriteString("probe"); err != nil {
+		return false, err
+	}
+	if err := f.Close(); err != nil {
+		return false, err
+	}
+
+	// the restored files' access time is their modification time, as the probe's
+	past := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(pth, past, past); err != nil {
+		return false, err
+	}
+	if _, err := ioutil.ReadFile(pth); err != nil {
+		return false, err
+	}
+	info, err := os.Stat(pth)
+	if err != nil {
+		return false, err
+	}
+	return accessTime(info).After(past), nil
+}
+
+// writeUsageSnapshot writes the usage snapshot of the restored paths and exports its path.
+func writeUsageSnapshot(pth string, paths []string, restoredAt time.Time) error {
+	snapshot := usageSnapshot{RestoredAt: restoredAt, Paths: paths}
+	if len(paths) > 0 {
+		dir := paths[0]
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			dir = filepath.Dir(dir)
+		}
+		recorded, err := recordsAccessTimes(dir)
+		if err != nil {
+			return fmt.Errorf("failed to check the access times: %s", err)
+		}
+		snapshot.AccessTimes = recorded
+	}
+
+	b, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(pth), 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(pth, b, 0644); err != nil {
+		return err
+	}
+	return exportEnv(usageSnapshotPathEnvKey, pth)
+}
+
+// unusedPaths returns the topmost paths under the roots without a file accessed after since, largest first.
+// The symlinks are not accounted.
+func unusedPaths(roots []string, since time.Time) ([]unusedPath, error) {
+	var unused []unusedPath
+	for _, root := range roots {
+		used, size, children, err := walkUsage(root, since)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if used {
+			unused = append(unused, children...)
+		} else {
+			unused = append(unused, unusedPath{Path: root, Size: size})
+		}
+	}
+	sort.SliceStable(unused, func(i, j int) bool { return unused[i].Size > unused[j].Size })
+	return unused, nil
+}
+
+// walkUsage reports whether a file under pth is accessed after since, the size of the files under it,
+// and if it is used, its topmost unused paths.
+func walkUsage(pth string, since time.Time) (bool, int64, []unusedPath, error) {
+	info, err := os.Lstat(pth)
+	if err != nil {
+		return false, 0, nil, err
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		return false, 0, nil, nil
+	}
+	if !info.IsDir() {
+		return accessTime(info).After(since), info.Size(), nil, nil
+	}
+
+	names, err := readDirNames(pth)
+	if err != nil {
+		return false, 0, nil, err
+	}
+	var used bool
+	var size int64
+	var unusedChildren, unused []unusedPath
+	for _, name := range names {
+		child := filepath.Join(pth, name)
+		childUsed, childSize, childUnused, err := walkUsage(child, since)
+		if err != nil {
+			return false, 0, nil, err
+		}
+		size += childSize
+		if childUsed {
+			used = true
+			unused = append(unused, childUnused...)
+		} else {
+			unusedChildren = append(unusedChildren, unusedPath{Path: child, Size: childSize})
+		}
+	}
+	if !used {
+		return false, size, nil, nil
+	}
+	return true, size, append(unused, unusedChildren...), nil
+}
+
+func readDirNames(dir string) ([]string, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := f.Close(); err != nil {
+			log.Warnf("Failed to close %s: %s", dir, err)
+		}
+	}()
+	names, err := f.Readdirnames(-1)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// runUnusedReport prints the restored paths of the usage snapshot (the argument, or BITRISE_CACHE_PULL_USAGE_SNAPSHOT_PATH)
+// not accessed since the restore.
+func runUnusedReport(args []string) error {
+	pth := os.Getenv(usageSnapshotPathEnvKey)
+	if len(args) > 0 {
+		pth = args[0]
+	}
+	if pth == "" {
+		return fmt.Errorf("no usage snapshot: --report-unused <snapshot path>, see the usage_snapshot_path input")
+	}
+
+	b, err := ioutil.ReadFile(pth)
+	if err != nil {
+		return err
+	}
+	var snapshot usageSnapshot
+	if err := json.Unmarshal(b, &snapshot); err != nil {
+		return fmt.Errorf("invalid usage snapshot: %s", err)
+	}
+	if !snapshot.AccessTimes {
+		return fmt.Errorf("the filesystem of the restored paths does not record the access times (noatime), the unused paths are unknown")
+	}
+
+	unused, err := unusedPaths(snapshot.Paths, snapshot.RestoredAt)
+	if err != nil {
+		return err
+	}
+	printUnusedReport(unused, diffListLimit)
+	return nil
+}
+
+// printUnusedReport prints the unused paths, at most limit of them.
+func printUnusedReport(unused []unusedPath, limit int) {
+	var total int64
+	for _, u := range unused {
+		total += u.Size
+	}
+
+	fmt.Println()
+	log.Infof("Unused restored paths")
+	log.Printf("- %d paths, %s not accessed by the build since the restore", len(unused), formatBytes(total))
+	for i, u := range unused {
+		if i == limit {
+			log.Printf("  ... and %d more", len(unused)-limit)
+			break
+		}
+		log.Printf("  %s (%s)", u.Path, formatBytes(u.Size))
+	}
+	if len(unused) > 0 {
+		log.Printf("Consider not caching them.")
+	}
+}
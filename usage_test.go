@@ -0,0 +1,63 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestUnusedPaths(t *testing.T) {
+	dir, err := ioutil.TempDir("", "usage-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Logf("failed to remove temp dir: %s", err)
+		}
+	}()
+
+	gradle := filepath.Join(dir, ".gradle")
+	npm := filepath.Join(dir, ".npm")
+	writeTestFiles(t, map[string]string{
+		filepath.Join(gradle, "caches", "modules-2", "okhttp", "okhttp.jar"):  "used",
+		filepath.Join(gradle, "caches", "modules-2", "okhttp", "okhttp.pom"):  "pom",
+		filepath.Join(gradle, "caches", "modules-2", "retrofit", "a.jar"):     "unused",
+		filepath.Join(gradle, "caches", "modules-2", "retrofit", "b.jar"):     "unused",
+		filepath.Join(gradle, "wrapper", "dists", "gradle-7.6", "gradle.zip"): "unused zip",
+		filepath.Join(npm, "_cacache", "index"):                               "unused",
+	})
+
+	restoredAt := time.Now().Add(-time.Hour)
+	before := restoredAt.Add(-time.Hour)
+	err = filepath.Walk(dir, func(pth string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		return os.Chtimes(pth, before, before)
+	})
+	if err != nil {
+		t.Fatalf("failed to set the access times: %s", err)
+	}
+	used := filepath.Join(gradle, "caches", "modules-2", "okhttp", "okhttp.jar")
+	if err := os.Chtimes(used, time.Now(), before); err != nil {
+		t.Fatalf("failed to set the access time: %s", err)
+	}
+
+	got, err := unusedPaths([]string{gradle, npm, filepath.Join(dir, "missing")}, restoredAt)
+	if err != nil {
+		t.Fatalf("unusedPaths() error = %s", err)
+	}
+	want := []unusedPath{
+		{Path: filepath.Join(gradle, "caches", "modules-2", "retrofit"), Size: 12},
+		{Path: filepath.Join(gradle, "wrapper"), Size: 10},
+		{Path: npm, Size: 6},
+		{Path: filepath.Join(gradle, "caches", "modules-2", "okhttp", "okhttp.pom"), Size: 3},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("unusedPaths() = %v, want %v", got, want)
+	}
+}
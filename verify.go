@@ -0,0 +1,150 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+const verifyReportPathEnvKey = "BITRISE_CACHE_PULL_VERIFY_REPORT_PATH"
+
+// verifyDiff is a workspace path the restore would overwrite.
+type verifyDiff struct {
+	Path   string `json:"path"`
+	Reason string `json:"reason"`
+}
+
+// verifyReport compares the archive with the workspace, see the verify_only input.
+type verifyReport struct {
+	// Missing are the paths of the archive not in the workspace.
+	Missing []string `json:"missing"`
+	// Changed are the workspace paths different from the archive's, the restore would overwrite them.
+	Changed []verifyDiff `json:"changed"`
+	// Unchanged is the number of paths matching the archive.
+	Unchanged int `json:"unchanged"`
+}
+
+// verifyArchive reads the archive stream and compares its entries with the filesystem, without writing anything.
+// The entries are resolved (and filtered) like the Extractor would extract them.
+func verifyArchive(r io.Reader, compressed bool, e *Extractor) (verifyReport, error) {
+	report := verifyReport{Missing: []string{}, Changed: []verifyDiff{}}
+
+	if compressed {
+		gr, err := gzip.NewReader(r)
+		if err != nil {
+			return report, fmt.Errorf("failed to open gzip stream: %s", err)
+		}
+		r = gr
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return report, nil
+		}
+		if err != nil {
+			return report, fmt.Errorf("failed to read archive entry: %s", err)
+		}
+		if hdr.Typeflag == tar.TypeXGlobalHeader {
+			continue
+		}
+
+		target := e.targetPath(hdr.Name)
+		if e.Filter.excludes(target) {
+			continue
+		}
+
+		reason, err := compareEntry(hdr, target)
+		switch {
+		case os.IsNotExist(err):
+			report.Missing = append(report.Missing, target)
+		case err != nil:
+			report.Changed = append(report.Changed, verifyDiff{Path: target, Reason: err.Error()})
+		case reason != "":
+			report.Changed = append(report.Changed, verifyDiff{Path: target, Reason: reason})
+		default:
+			report.Unchanged++
+		}
+	}
+}
+
+// compareEntry returns the difference of the target from the archive entry, an empty string if they match.
+func compareEntry(hdr *tar.Header, target string) (string, error) {
+	info, err := os.Lstat(target)
+	if err != nil {
+		return "", err
+	}
+
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if !info.IsDir() {
+			return "not a directory", nil
+		}
+	case tar.TypeSymlink:
+		if info.Mode()&os.ModeSymlink == 0 {
+			return "not a symlink", nil
+		}
+		link, err := os.Readlink(target)
+		if err != nil {
+			return "", err
+		}
+		if link != hdr.Linkname {
+			return fmt.Sprintf("symlink target: %s, archive: %s", link, hdr.Linkname), nil
+		}
+	case tar.TypeReg, tar.TypeRegA, tar.TypeGNUSparse:
+		if !info.Mode().IsRegular() {
+			return "not a regular file", nil
+		}
+		if info.Size() != hdr.Size {
+			return fmt.Sprintf("size: %d Bytes, archive: %d Bytes", info.Size(), hdr.Size), nil
+		}
+		if !info.ModTime().Equal(hdr.ModTime) {
+			return fmt.Sprintf("modified: %s, archive: %s", info.ModTime().UTC(), hdr.ModTime.UTC()), nil
+		}
+	}
+	return "", nil
+}
+
+// printVerifyReport prints the summary of the report, listing at most limit paths per group.
+func printVerifyReport(report verifyReport, limit int) {
+	fmt.Println()
+	log.Infof("Restore verification")
+	log.Printf("- unchanged: %d", report.Unchanged)
+
+	log.Printf("- missing from the workspace: %d", len(report.Missing))
+	for i, pth := range report.Missing {
+		if i == limit {
+			log.Printf("  ... and %d more", len(report.Missing)-limit)
+			break
+		}
+		log.Printf("  %s", pth)
+	}
+
+	log.Printf("- would be overwritten: %d", len(report.Changed))
+	for i, diff := range report.Changed {
+		if i == limit {
+			log.Printf("  ... and %d more", len(report.Changed)-limit)
+			break
+		}
+		log.Printf("  %s (%s)", diff.Path, diff.Reason)
+	}
+}
+
+// writeVerifyReport writes the report and exports its path for the next steps.
+func writeVerifyReport(pth string, report verifyReport) error {
+	b, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(pth, b, 0644); err != nil {
+		return err
+	}
+	return exportEnv(verifyReportPathEnvKey, pth)
+}
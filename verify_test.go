@@ -0,0 +1,77 @@
+package main
+
+import (
+	"archive/tar"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func Test_verifyArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "verify-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Logf("failed to remove temp dir: %s", err)
+		}
+	}()
+
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	for name, content := range map[string]string{"same": "content", "resized": "old", "touched": "content"} {
+		pth := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(pth, []byte(content), 0644); err != nil {
+			t.Fatalf("failed to write file: %s", err)
+		}
+		if err := os.Chtimes(pth, modTime, modTime); err != nil {
+			t.Fatalf("failed to set modification time: %s", err)
+		}
+	}
+	if err := os.Chtimes(filepath.Join(dir, "touched"), time.Now(), time.Now()); err != nil {
+		t.Fatalf("failed to set modification time: %s", err)
+	}
+	if err := os.Symlink("same", filepath.Join(dir, "link")); err != nil {
+		t.Fatalf("failed to create symlink: %s", err)
+	}
+
+	entries := []testEntry{
+		{name: "same", content: "content", modTime: modTime},
+		{name: "resized", content: "new content", modTime: modTime},
+		{name: "touched", content: "content", modTime: modTime},
+		{name: "link", typeflag: tar.TypeSymlink, linkname: "other"},
+		{name: "missing/file", content: "content"},
+		{name: "skipped/file", content: "content"},
+	}
+
+	e := NewExtractor(dir, true)
+	e.Filter = pathFilter{Skip: []string{filepath.Join(dir, "skipped")}}
+	report, err := verifyArchive(createTestArchive(t, entries), false, e)
+	if err != nil {
+		t.Fatalf("verifyArchive() error = %v", err)
+	}
+
+	if report.Unchanged != 1 {
+		t.Errorf("verifyArchive() unchanged = %d, want 1", report.Unchanged)
+	}
+	if want := []string{filepath.Join(dir, "missing/file")}; !reflect.DeepEqual(report.Missing, want) {
+		t.Errorf("verifyArchive() missing = %v, want %v", report.Missing, want)
+	}
+	var changed []string
+	for _, diff := range report.Changed {
+		changed = append(changed, filepath.Base(diff.Path))
+	}
+	if want := []string{"resized", "touched", "link"}; !reflect.DeepEqual(changed, want) {
+		t.Errorf("verifyArchive() changed = %v, want %v", report.Changed, want)
+	}
+
+	t.Log("nothing is written")
+	{
+		if _, err := os.Stat(filepath.Join(dir, "missing")); !os.IsNotExist(err) {
+			t.Errorf("missing path created: %v", err)
+		}
+	}
+}
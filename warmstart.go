@@ -0,0 +1,49 @@
+package main
+
+import (
+	"os"
+	"sort"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// isLocalRun reports whether the step runs in a local `bitrise run`, not in a build of the Bitrise CI.
+func isLocalRun(buildSlug string) bool {
+	return buildSlug == ""
+}
+
+// planWarmStartRestore returns the cached paths whose content did not change since their last restore on this machine
+// (their content hash in the archive info is the one recorded in the state), so they are not restored again.
+// The paths missing from the disk are restored.
+func planWarmStartRestore(stateDir *StateDir, info archiveInfo) []string {
+	if stateDir == nil || len(info.ContentHashes) == 0 {
+		return nil
+	}
+
+	state, err := stateDir.Load()
+	if err != nil {
+		result.Warnf("Failed to read the state: %s", err)
+		return nil
+	}
+
+	var unchanged []string
+	for pth, hash := range info.ContentHashes {
+		if state.ContentHashes[pth] != hash {
+			continue
+		}
+		if _, err := os.Lstat(pth); err != nil {
+			log.Debugf("%s is unchanged, but missing: %s", pth, err)
+			continue
+		}
+		unchanged = append(unchanged, pth)
+	}
+	sort.Strings(unchanged)
+
+	if len(unchanged) > 0 {
+		log.Printf("%d of the %d cached paths did not change since their last restore, not restoring them", len(unchanged), len(info.ContentHashes))
+		for _, pth := range unchanged {
+			log.Debugf("- %s", pth)
+		}
+	}
+	return unchanged
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestPlanWarmStartRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "warmstart-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Logf("failed to remove temp dir: %s", err)
+		}
+	}()
+
+	pods := filepath.Join(dir, "Pods")
+	nodeModules := filepath.Join(dir, "node_modules")
+	gradle := filepath.Join(dir, ".gradle")
+	for _, pth := range []string{pods, nodeModules} {
+		if err := os.MkdirAll(pth, 0755); err != nil {
+			t.Fatalf("failed to create %s: %s", pth, err)
+		}
+	}
+
+	stateDir := NewStateDir(filepath.Join(dir, "state"))
+	if err := stateDir.Save(cacheState{ContentHashes: map[string]string{pods: "a", nodeModules: "b", gradle: "c"}}); err != nil {
+		t.Fatalf("failed to save state: %s", err)
+	}
+
+	info := archiveInfo{ContentHashes: map[string]string{pods: "a", nodeModules: "changed", gradle: "c"}}
+	// the missing .gradle is restored, although unchanged
+	if got, want := planWarmStartRestore(stateDir, info), []string{pods}; !reflect.DeepEqual(got, want) {
+		t.Errorf("planWarmStartRestore() = %v, want %v", got, want)
+	}
+
+	if got := planWarmStartRestore(stateDir, archiveInfo{}); got != nil {
+		t.Errorf("planWarmStartRestore() without content hashes = %v, want nil", got)
+	}
+	if got := planWarmStartRestore(nil, info); got != nil {
+		t.Errorf("planWarmStartRestore() without state = %v, want nil", got)
+	}
+}
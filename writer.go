@@ -0,0 +1,114 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// Fsync policies, see the fsync_policy input.
+const (
+	fsyncNone    = "none"
+	fsyncPerFile = "per-file"
+	fsyncEnd     = "end"
+)
+
+// smallFileSize is the size up to which the regular files are buffered and written in parallel,
+// the larger files are written by the extracting goroutine.
+const smallFileSize = 1024 * 1024
+
+type writeJob struct {
+	target  string
+	hdr     *tar.Header
+	content []byte
+}
+
+// writerPool writes the small files of the archive in parallel.
+// The extracting goroutine flushes the pool before an entry depending on a pending write
+// (a hard link to it, or an entry with the same target), so the archive order is kept where it matters.
+type writerPool struct {
+	jobs  chan writeJob
+	wg    sync.WaitGroup
+	fsync bool
+	// foldCase makes the pending targets case-insensitive, for case-insensitive filesystems.
+	foldCase bool
+	// created are the pre-created directories, read-only while the pool runs.
+	created dirSet
+
+	mu  sync.Mutex
+	err error
+
+	// pending are the targets written since the last Flush, only used by the extracting goroutine.
+	pending map[string]bool
+}
+
+func newWriterPool(workers int, fsync, foldCase bool, created dirSet) *writerPool {
+	p := &writerPool{
+		jobs:     make(chan writeJob, 2*workers),
+		fsync:    fsync,
+		foldCase: foldCase,
+		created:  created,
+		pending:  map[string]bool{},
+	}
+	for i := 0; i < workers; i++ {
+		go p.work()
+	}
+	return p
+}
+
+func (p *writerPool) work() {
+	for job := range p.jobs {
+		if err := writeFile(bytes.NewReader(job.content), job.target, job.hdr, p.fsync, false, p.created); err != nil {
+			p.mu.Lock()
+			if p.err == nil {
+				p.err = fmt.Errorf("failed to extract %s: %s", job.hdr.Name, err)
+			}
+			p.mu.Unlock()
+		}
+		p.wg.Done()
+	}
+}
+
+func (p *writerPool) key(target string) string {
+	if p.foldCase {
+		return strings.ToLower(target)
+	}
+	return target
+}
+
+// Submit writes the file in the background.
+func (p *writerPool) Submit(target string, hdr *tar.Header, content []byte) {
+	p.pending[p.key(target)] = true
+	p.wg.Add(1)
+	p.jobs <- writeJob{target: target, hdr: hdr, content: content}
+}
+
+// Pending reports whether the target is written in the background.
+func (p *writerPool) Pending(target string) bool {
+	return p.pending[p.key(target)]
+}
+
+// Flush waits for the submitted writes and returns the first failure.
+func (p *writerPool) Flush() error {
+	p.wg.Wait()
+	p.pending = map[string]bool{}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err
+}
+
+// Close flushes the pool and stops its workers.
+func (p *writerPool) Close() error {
+	err := p.Flush()
+	close(p.jobs)
+	return err
+}
+
+// syncFilesystems flushes the written files to the disks, see the fsync end policy.
+func syncFilesystems() {
+	syscall.Sync()
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestExtractor_Extract_workers(t *testing.T) {
+	var entries []testEntry
+	want := map[string]string{}
+	for i := 0; i < 100; i++ {
+		name := fmt.Sprintf("node_modules/pkg%d/index.js", i)
+		entries = append(entries, testEntry{name: name, content: name})
+		want[name] = name
+	}
+	entries = append(entries,
+		// repeated entry, the later one wins
+		testEntry{name: "node_modules/pkg0/index.js", content: "overwritten"},
+		// hard link to a file written in the background
+		testEntry{name: "node_modules/.bin/pkg1", typeflag: tar.TypeLink, linkname: "node_modules/pkg1/index.js"},
+		testEntry{name: "node_modules/large.bin", content: strings.Repeat("x", smallFileSize+1)},
+	)
+	want["node_modules/pkg0/index.js"] = "overwritten"
+	want["node_modules/.bin/pkg1"] = "node_modules/pkg1/index.js"
+	want["node_modules/large.bin"] = strings.Repeat("x", smallFileSize+1)
+
+	for _, policy := range []string{fsyncNone, fsyncPerFile, fsyncEnd} {
+		t.Run(policy, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "writer-test")
+			if err != nil {
+				t.Fatalf("failed to create temp dir: %s", err)
+			}
+			defer func() {
+				if err := os.RemoveAll(dir); err != nil {
+					t.Logf("failed to remove temp dir: %s", err)
+				}
+			}()
+
+			e := NewExtractor(dir, true)
+			e.Workers = 4
+			e.FsyncPolicy = policy
+			if err := e.Extract(createTestArchive(t, entries)); err != nil {
+				t.Fatalf("Extractor.Extract() error = %v", err)
+			}
+
+			for name, content := range want {
+				b, err := ioutil.ReadFile(filepath.Join(dir, name))
+				if err != nil {
+					t.Errorf("failed to read %s: %s", name, err)
+					continue
+				}
+				if string(b) != content {
+					t.Errorf("%s content = %.20s, want %.20s", name, b, content)
+				}
+			}
+		})
+	}
+}
+
+func TestExtractor_Extract_workersError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "writer-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Logf("failed to remove temp dir: %s", err)
+		}
+	}()
+
+	// the parent of the second entry is a file
+	entries := []testEntry{
+		{name: "file", content: "content"},
+		{name: "file/child", content: "content"},
+	}
+
+	e := NewExtractor(dir, true)
+	e.Workers = 4
+	if err := e.Extract(createTestArchive(t, entries)); err == nil || !strings.Contains(err.Error(), "file/child") {
+		t.Errorf("Extractor.Extract() error = %v, want file/child failure", err)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os/exec"
+	"time"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// zstdMagic is the zstd frame's magic number.
+var zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+// isZstdStream reports whether the buffered stream starts with a zstd frame.
+func isZstdStream(r *bufio.Reader) bool {
+	magic, err := r.Peek(len(zstdMagic))
+	return err == nil && bytes.Equal(magic, zstdMagic)
+}
+
+// ZstdReader decompresses a zstd stream by piping it through the zstd tool.
+type ZstdReader struct {
+	cmd    *exec.Cmd
+	stdout io.ReadCloser
+	stderr bytes.Buffer
+}
+
+// NewZstdReader starts the zstd tool decompressing r, with the zstdDictionary if set.
+func NewZstdReader(r io.Reader) (*ZstdReader, error) {
+	args := []string{"-d", "-c"}
+	if zstdDictionary != "" {
+		args = append(args, "-D", zstdDictionary)
+	}
+
+	z := &ZstdReader{}
+	z.cmd = exec.Command("zstd", args...)
+	z.cmd.Stdin = r
+	z.cmd.Stderr = &z.stderr
+
+	stdout, err := z.cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	z.stdout = stdout
+
+	if err := z.cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start zstd (is it installed?): %s", err)
+	}
+	return z, nil
+}
+
+// Read implements the io.Reader interface.
+func (z *ZstdReader) Read(p []byte) (int, error) {
+	n, err := z.stdout.Read(p)
+	if err == io.EOF {
+		if wErr := z.cmd.Wait(); wErr != nil {
+			return n, fmt.Errorf("zstd failed: %s: %s", wErr, z.stderr.String())
+		}
+	}
+	return n, err
+}
+
+// CPUTime returns the CPU time the zstd tool spent decompressing the stream, 0 until it exited.
+func (z *ZstdReader) CPUTime() time.Duration {
+	if z == nil || z.cmd.ProcessState == nil {
+		return 0
+	}
+	return z.cmd.ProcessState.UserTime() + z.cmd.ProcessState.SystemTime()
+}
+
+// Close stops the zstd tool.
+func (z *ZstdReader) Close() error {
+	if z.cmd.ProcessState != nil {
+		return nil
+	}
+	if err := z.cmd.Process.Kill(); err != nil {
+		log.Debugf("Failed to stop zstd: %s", err)
+	}
+	_ = z.cmd.Wait()
+	return nil
+}
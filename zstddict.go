@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// zstdDictionaryMagic is the zstd dictionary file's magic number.
+var zstdDictionaryMagic = []byte{0x37, 0xa4, 0x30, 0xec}
+
+// zstdDictionary is the path of the dictionary the zstd streams are decompressed with, see the zstd_dictionary input.
+var zstdDictionary string
+
+// zstdFrameDictionaryID returns the dictionary ID in the header of the buffered zstd stream's first frame,
+// 0 if the frame was compressed without a dictionary (or without recording its ID).
+func zstdFrameDictionaryID(r *bufio.Reader) (uint32, error) {
+	// magic number, frame header descriptor, window descriptor, dictionary ID
+	header, err := r.Peek(len(zstdMagic) + 1 + 1 + 4)
+	if err != nil && len(header) < len(zstdMagic)+1 {
+		return 0, fmt.Errorf("failed to read zstd frame header: %s", err)
+	}
+	if !bytes.Equal(header[:len(zstdMagic)], zstdMagic) {
+		return 0, fmt.Errorf("not a zstd frame")
+	}
+
+	descriptor := header[len(zstdMagic)]
+	offset := len(zstdMagic) + 1
+	if singleSegment := descriptor&0x20 != 0; !singleSegment {
+		offset++
+	}
+	size := []int{0, 1, 2, 4}[descriptor&0x03]
+	if len(header) < offset+size {
+		return 0, fmt.Errorf("truncated zstd frame header")
+	}
+
+	id := header[offset : offset+size]
+	switch size {
+	case 1:
+		return uint32(id[0]), nil
+	case 2:
+		return uint32(binary.LittleEndian.Uint16(id)), nil
+	case 4:
+		return binary.LittleEndian.Uint32(id), nil
+	}
+	return 0, nil
+}
+
+// readZstdDictionaryID returns the ID of the zstd dictionary file.
+func readZstdDictionaryID(pth string) (uint32, error) {
+	f, err := os.Open(pth)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err := f.Close(); err != nil {
+			log.Warnf("Failed to close %s: %s", pth, err)
+		}
+	}()
+
+	header := make([]byte, len(zstdDictionaryMagic)+4)
+	if _, err := io.ReadFull(f, header); err != nil {
+		return 0, fmt.Errorf("failed to read zstd dictionary header: %s", err)
+	}
+	if !bytes.Equal(header[:len(zstdDictionaryMagic)], zstdDictionaryMagic) {
+		return 0, fmt.Errorf("not a zstd dictionary: %s", pth)
+	}
+	return binary.LittleEndian.Uint32(header[len(zstdDictionaryMagic):]), nil
+}
+
+// fetchZstdDictionary returns the local path of the zstd_dictionary input: the path as it is,
+// or the file the dictionary's http(s) URL is downloaded to.
+func fetchZstdDictionary(dictionary string) (string, error) {
+	if !strings.HasPrefix(dictionary, "http://") && !strings.HasPrefix(dictionary, "https://") {
+		return strings.TrimPrefix(dictionary, "file://"), nil
+	}
+
+	body, err := performRequest(dictionary)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if err := body.Close(); err != nil {
+			log.Warnf("Failed to close response body: %s", err)
+		}
+	}()
+
+	b, err := ioutil.ReadAll(body)
+	if err != nil {
+		return "", err
+	}
+	pth := filepath.Join(stepRunDir, "zstd-dictionary")
+	if err := ioutil.WriteFile(pth, b, 0600); err != nil {
+		return "", err
+	}
+	return pth, nil
+}
+
+// checkZstdDictionary checks that the zstd stream can be decompressed with the dictionary (empty if none):
+// the dictionary's ID has to match the one recorded by the push step in the frame header.
+func checkZstdDictionary(r *bufio.Reader, dictionary string) error {
+	frameID, err := zstdFrameDictionaryID(r)
+	if err != nil {
+		return err
+	}
+	if frameID == 0 {
+		return nil
+	}
+	if dictionary == "" {
+		return fmt.Errorf("the archive is compressed with a zstd dictionary (ID: %d), set the zstd_dictionary input", frameID)
+	}
+
+	dictionaryID, err := readZstdDictionaryID(dictionary)
+	if err != nil {
+		return err
+	}
+	if dictionaryID != frameID {
+		return fmt.Errorf("the archive is compressed with another zstd dictionary (ID: %d) than zstd_dictionary (ID: %d)", frameID, dictionaryID)
+	}
+	return nil
+}
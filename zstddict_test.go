@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestZstdFrameDictionaryID(t *testing.T) {
+	frame := func(header ...byte) *bufio.Reader {
+		return bufio.NewReader(bytes.NewReader(append(append([]byte{}, zstdMagic...), header...)))
+	}
+
+	tests := []struct {
+		name    string
+		r       *bufio.Reader
+		want    uint32
+		wantErr bool
+	}{
+		{name: "no dictionary", r: frame(0x00, 0x58, 0, 0, 0, 0), want: 0},
+		{name: "1 byte ID", r: frame(0x01, 0x58, 0x2a, 0, 0, 0), want: 42},
+		{name: "2 bytes ID, single segment", r: frame(0x22, 0x34, 0x12, 0, 0, 0), want: 0x1234},
+		{name: "4 bytes ID", r: frame(0x03, 0x58, 0x78, 0x56, 0x34, 0x12), want: 0x12345678},
+		{name: "truncated", r: frame(0x03, 0x58, 0x78), wantErr: true},
+		{name: "not zstd", r: bufio.NewReader(strings.NewReader("archive")), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := zstdFrameDictionaryID(tt.r)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("zstdFrameDictionaryID() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("zstdFrameDictionaryID() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckZstdDictionary(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zstddict-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Logf("failed to remove temp dir: %s", err)
+		}
+	}()
+
+	dictionary := filepath.Join(dir, "dictionary")
+	if err := ioutil.WriteFile(dictionary, append(append([]byte{}, zstdDictionaryMagic...), 0x2a, 0, 0, 0, 0xff), 0600); err != nil {
+		t.Fatalf("failed to write dictionary: %s", err)
+	}
+	frame := func(id byte) *bufio.Reader {
+		return bufio.NewReader(bytes.NewReader(append(append([]byte{}, zstdMagic...), 0x01, 0x58, id, 0, 0, 0)))
+	}
+
+	if err := checkZstdDictionary(frame(42), dictionary); err != nil {
+		t.Errorf("checkZstdDictionary() of the matching dictionary error = %v", err)
+	}
+	if err := checkZstdDictionary(frame(43), dictionary); err == nil {
+		t.Errorf("checkZstdDictionary() of another dictionary should fail")
+	}
+	if err := checkZstdDictionary(frame(42), ""); err == nil {
+		t.Errorf("checkZstdDictionary() without the dictionary should fail")
+	}
+	if err := checkZstdDictionary(frame(0), ""); err != nil {
+		t.Errorf("checkZstdDictionary() of an archive without dictionary error = %v", err)
+	}
+}